@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// outputDevices returns the devices that can play, with their index in
+// PortAudio's device list, which is what -device takes
+func outputDevices() ([]*portaudio.DeviceInfo, []int, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, nil, err
+	}
+	var outputs []*portaudio.DeviceInfo
+	var indexes []int
+	for i, d := range devices {
+		if d.MaxOutputChannels > 0 {
+			outputs = append(outputs, d)
+			indexes = append(indexes, i)
+		}
+	}
+	return outputs, indexes, nil
+}
+
+// listDevices prints the output devices to w, marking the default one
+func listDevices(w io.Writer) error {
+	outputs, indexes, err := outputDevices()
+	if err != nil {
+		return err
+	}
+	if len(outputs) == 0 {
+		fmt.Fprintln(w, "No output devices found")
+		return nil
+	}
+	def, _ := portaudio.DefaultOutputDevice()
+	for i, d := range outputs {
+		mark := ""
+		if d == def {
+			mark = " (default)"
+		}
+		fmt.Fprintf(w, "%3d  %s [%s, %d ch, %.0fHz]%s\n", indexes[i], d.Name, d.HostApi.Name,
+			d.MaxOutputChannels, d.DefaultSampleRate, mark)
+	}
+	return nil
+}
+
+// findOutputDevice returns an output device given to -device: an index
+// from -list-devices, or a name, matched exactly or by a part of it that
+// only one device has. An empty name is the default output device.
+func findOutputDevice(name string) (*portaudio.DeviceInfo, error) {
+	if name == "" {
+		return portaudio.DefaultOutputDevice()
+	}
+	outputs, indexes, err := outputDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		for i, d := range outputs {
+			if indexes[i] == n {
+				return d, nil
+			}
+		}
+		return nil, fmt.Errorf("no output device with index %d (see -list-devices)", n)
+	}
+
+	var matches []*portaudio.DeviceInfo
+	for _, d := range outputs {
+		if strings.EqualFold(d.Name, name) {
+			return d, nil
+		}
+		if strings.Contains(strings.ToLower(d.Name), strings.ToLower(name)) {
+			matches = append(matches, d)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no output device matches %q (see -list-devices)", name)
+	case 1:
+		return matches[0], nil
+	}
+	names := make([]string, len(matches))
+	for i, d := range matches {
+		names[i] = fmt.Sprintf("%q", d.Name)
+	}
+	return nil, fmt.Errorf("%q matches several output devices: %s", name, strings.Join(names, ", "))
+}
+
+// outputParameters returns the parameters playing channels at rate on
+// device, or at the device's default rate when it cannot play rate itself
+func outputParameters(device *portaudio.DeviceInfo, channels int, rate float64) (portaudio.StreamParameters, error) {
+	params := portaudio.HighLatencyParameters(nil, device)
+	params.Output.Channels = channels
+	params.SampleRate = rate
+	params.FramesPerBuffer = framesPerBuffer
+	if portaudio.IsFormatSupported(params, make([]int16, framesPerBuffer*channels)) == nil {
+		return params, nil
+	}
+	params.SampleRate = device.DefaultSampleRate
+	if err := portaudio.IsFormatSupported(params, make([]int16, framesPerBuffer*channels)); err != nil {
+		return params, fmt.Errorf("%s cannot play %d channel(s) at %.0fHz or %.0fHz: %v", device.Name, channels, rate, device.DefaultSampleRate, err)
+	}
+	return params, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/mdns"
+)
+
+// discoverWait is how long the LAN is searched for servers
+const discoverWait = 2 * time.Second
+
+// discoverServer finds a server advertised on the LAN and returns its
+// address: the first by name, if there are several
+func discoverServer() (string, error) {
+	found, err := mdns.Browse(context.Background(), mdns.ServiceType, discoverWait)
+	if err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", errors.New("no server found on the LAN; servers are advertised when started with -mdns")
+	}
+	for _, other := range found[1:] {
+		fmt.Printf("Also found %q at %s; use -addr to listen to it\n", other.Name, other.Addr())
+	}
+	fmt.Printf("Found %q at %s\n", found[0].Name, found[0].Addr())
+	return found[0].Addr(), nil
+}
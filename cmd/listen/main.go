@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gordonklaus/portaudio"
+	"github.com/gorilla/websocket"
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/clock"
+	"github.com/maks112v/minicast/pkg/frame"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+const help = "Keys: up/+ louder, down/- quieter, m mute, ] more buffer, [ less buffer, r reconnect, s stats, q quit"
+
+// formatMessage is the text frame announcing the audio format
+type formatMessage struct {
+	Type string `json:"type"`
+	ws.SourceFormat
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8001", "server address, as host:port or a ws:// or wss:// URL")
+	profile := flag.String("profile", "balanced", "listener profile: stable, balanced or low-latency")
+	buffer := flag.Duration("buffer", 200*time.Millisecond, "audio to buffer before playing")
+	device := flag.String("device", "", "play on this output device, by name (or a unique part of it) or index from -list-devices (default: the system's default output)")
+	list := flag.Bool("list-devices", false, "list the output devices and exit")
+	volume := flag.Float64("volume", 0, "starting volume in dB")
+	mono := flag.Bool("mono", false, "ask the server for a mono mix, for a single speaker or to halve the bandwidth")
+	discover := flag.Bool("discover", false, "find the server on the LAN over mDNS instead of giving -addr")
+	clockSource := flag.String("clock", "", "measure latency against an NTP server (e.g. pool.ntp.org) or a PTP hardware clock (ptp:/dev/ptp0) rather than the system clock")
+	flag.Parse()
+
+	if err := portaudio.Initialize(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize PortAudio: %v\n", err)
+		os.Exit(1)
+	}
+	defer portaudio.Terminate()
+
+	if *list {
+		if err := listDevices(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list devices: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	out, err := findOutputDevice(*device)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -device: %v\n", err)
+		os.Exit(1)
+	}
+	if *discover {
+		addrSet := false
+		flag.Visit(func(f *flag.Flag) { addrSet = addrSet || f.Name == "addr" })
+		if addrSet {
+			fmt.Fprintln(os.Stderr, "-discover and -addr cannot be combined")
+			os.Exit(1)
+		}
+		if *addr, err = discoverServer(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to discover a server: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	u, err := streamURL(*addr, *profile, *mono)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -addr: %v\n", err)
+		os.Exit(1)
+	}
+
+	p := newPlayer(out, max(minBuffer, min(maxBuffer, *buffer)), *volume)
+	defer p.close()
+
+	// Run as a service or in the background, there is no keyboard to read
+	interactive := isTerminal(os.Stdin)
+	raw := false
+	if interactive {
+		var restore func()
+		restore, raw = rawInput()
+		defer restore()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	var keys chan byte
+	if interactive {
+		keys = make(chan byte)
+		go readKeys(keys)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Latency is measured from the capture time stamped by the server, so
+	// both should follow the same reference
+	var clk *clock.Clock
+	if *clockSource != "" {
+		logger, _ := zap.NewProduction()
+		var err error
+		if clk, err = clock.New(*clockSource, clock.DefaultPoll, logger.Sugar()); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -clock: %v\n", err)
+			os.Exit(1)
+		}
+		go clk.Run(ctx)
+	}
+
+	reconnect := make(chan struct{}, 1)
+	go listen(ctx, u, p, clk, reconnect)
+
+	fmt.Printf("Playing on %s\n", out.Name)
+	if interactive {
+		fmt.Println(help)
+		if !raw {
+			fmt.Println("(press Enter after each key)")
+		}
+	}
+
+	for {
+		select {
+		case <-interrupt:
+			return
+		case key, ok := <-keys:
+			if !ok {
+				// Stdin closed, e.g. running in the background: keep playing
+				keys = nil
+				continue
+			}
+			switch key {
+			case '+', '=', 'A':
+				fmt.Printf("Volume %+.0f dB\n", p.adjustVolume(volumeStep))
+			case '-', '_', 'B':
+				fmt.Printf("Volume %+.0f dB\n", p.adjustVolume(-volumeStep))
+			case 'm':
+				if p.toggleMute() {
+					fmt.Println("Muted")
+				} else {
+					fmt.Println("Unmuted")
+				}
+			case ']':
+				fmt.Printf("Buffer %s\n", p.adjustBuffer(bufferStep))
+			case '[':
+				fmt.Printf("Buffer %s\n", p.adjustBuffer(-bufferStep))
+			case 'r':
+				fmt.Println("Reconnecting...")
+				select {
+				case reconnect <- struct{}{}:
+				default:
+				}
+			case 's':
+				fmt.Println(p.stats())
+				if stats := clk.Stats(); stats != nil {
+					fmt.Printf("clock %s | offset %.3f ms | drift %+.2f ppm | synced %t\n",
+						stats.Source, stats.OffsetMs, stats.DriftPPM, stats.Synced)
+				}
+			case 'h', '?':
+				fmt.Println(help)
+			case 'q':
+				return
+			}
+		}
+	}
+}
+
+// readKeys sends each key pressed. Arrow keys arrive as escape sequences
+// and are sent as their final letter (A up, B down).
+func readKeys(keys chan<- byte) {
+	defer close(keys)
+	r := bufio.NewReader(os.Stdin)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if b == 0x1b {
+			if next, _ := r.ReadByte(); next != '[' {
+				continue
+			}
+			if b, err = r.ReadByte(); err != nil {
+				return
+			}
+		}
+		keys <- b
+	}
+}
+
+// errBusy is returned when the server turns the listener away while
+// others reconnect
+type errBusy struct {
+	retryAfter time.Duration
+}
+
+// Error describes the refusal
+func (e errBusy) Error() string {
+	return fmt.Sprintf("server busy, retry after %s", e.retryAfter)
+}
+
+// listen plays the stream until ctx is done, reconnecting with backoff
+// when the connection drops or on request
+func listen(ctx context.Context, u string, p *player, clk *clock.Clock, reconnect chan struct{}) {
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := listenOnce(ctx, u, p, clk, reconnect)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A connection that lasted a while was healthy, so start over
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		wait := delay
+		var busy errBusy
+		if errors.As(err, &busy) {
+			// The server says when to come back, so come back then
+			wait = busy.retryAfter
+			fmt.Printf("Server busy, retrying in %s\n", wait)
+		} else if err != nil {
+			fmt.Printf("Disconnected, retrying in %s: %v\n", delay, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-reconnect:
+			delay = minReconnectDelay
+		case <-time.After(wait):
+			delay = min(delay*2, maxReconnectDelay)
+		}
+	}
+}
+
+// listenOnce connects and plays until the connection fails or a
+// reconnect is requested, which returns nil
+func listenOnce(ctx context.Context, u string, p *player, clk *clock.Clock, reconnect chan struct{}) error {
+	c, resp, err := websocket.DefaultDialer.DialContext(ctx, u, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			return errBusy{retryAfter: time.Duration(max(seconds, 1)) * time.Second}
+		}
+		return err
+	}
+	defer c.Close()
+	fmt.Printf("Connected to %s\n", u)
+
+	// Closing the connection ends the read loop below
+	stop := make(chan struct{})
+	defer close(stop)
+	requested := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+		case <-reconnect:
+			close(requested)
+		}
+		c.Close()
+	}()
+
+	var format ws.SourceFormat
+	var next uint32
+	for {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			select {
+			case <-requested:
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if messageType == websocket.TextMessage {
+			var msg formatMessage
+			if json.Unmarshal(data, &msg) != nil || msg.Type != "format" {
+				continue
+			}
+			format = msg.SourceFormat
+			if err := p.setFormat(format); err != nil {
+				return err
+			}
+			fmt.Printf("Playing %dHz, %d channel(s)\n", format.SampleRate, format.Channels)
+			continue
+		}
+
+		header, payload, err := frame.Decode(data)
+		if err != nil || format.SampleRate == 0 {
+			continue
+		}
+		if header.Flags&frame.FlagDiscontinuity == 0 && header.Seq != next {
+			p.gap(int(header.Seq - next))
+		}
+		next = header.Seq + 1
+		p.push(audio.BytesToPCM(payload), clk.Now().Sub(header.Captured))
+	}
+}
+
+// streamURL returns the WebSocket URL to listen at for addr, given as
+// host:port or a ws:// or wss:// URL, whose path defaults to /ws
+func streamURL(addr, profile string, mono bool) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "ws://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return "", fmt.Errorf("unsupported scheme %q (use ws or wss)", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host in %q", addr)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+	query := u.Query()
+	query.Set("format", "framed")
+	query.Set("profile", profile)
+	if mono {
+		query.Set("channels", "1")
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// isTerminal reports whether f is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
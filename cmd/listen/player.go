@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gordonklaus/portaudio"
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+const (
+	// framesPerBuffer is how much the output device asks for at a time
+	framesPerBuffer = 1024
+
+	minBuffer  = 50 * time.Millisecond
+	maxBuffer  = 5 * time.Second
+	bufferStep = 50 * time.Millisecond
+
+	minVolume  = -60.0
+	maxVolume  = 12.0
+	volumeStep = 3.0
+)
+
+// player plays received PCM on an output device. It holds back the buffer
+// target before starting, and again after running dry, so network jitter
+// does not cause dropouts.
+type player struct {
+	mu sync.Mutex
+
+	device *portaudio.DeviceInfo
+	format ws.SourceFormat
+	stream *portaudio.Stream
+	// rate is the rate the device plays at. When it cannot play the
+	// stream's, resampler converts to it.
+	rate      int
+	resampler audio.Stage
+
+	pending    []int16
+	target     time.Duration
+	prefilling bool
+
+	volume float64
+	muted  bool
+
+	frames    int
+	lost      int
+	underruns int
+	dropped   time.Duration
+	latency   time.Duration
+}
+
+// newPlayer creates a player on device buffering target of audio, at
+// volume dB
+func newPlayer(device *portaudio.DeviceInfo, target time.Duration, volume float64) *player {
+	return &player{device: device, target: target, volume: max(minVolume, min(maxVolume, volume)), prefilling: true}
+}
+
+// setFormat (re)opens the output for format, discarding buffered audio
+func (p *player) setFormat(format ws.SourceFormat) error {
+	p.mu.Lock()
+	if p.stream != nil && format == p.format {
+		p.mu.Unlock()
+		return nil
+	}
+	old := p.stream
+	p.stream = nil
+	p.format = format
+	p.pending = nil
+	p.prefilling = true
+	p.mu.Unlock()
+
+	// Closing waits for the callback, which takes the lock
+	if old != nil {
+		old.Stop()
+		old.Close()
+	}
+
+	params, err := outputParameters(p.device, format.Channels, float64(format.SampleRate))
+	if err != nil {
+		return err
+	}
+	var resampler audio.Stage
+	if rate := int(params.SampleRate); rate != format.SampleRate {
+		resampler = audio.NewSincResampler(format.Channels, format.SampleRate, rate)
+		fmt.Printf("Resampling to %dHz for %s\n", rate, p.device.Name)
+	}
+
+	p.mu.Lock()
+	p.rate, p.resampler = int(params.SampleRate), resampler
+	p.mu.Unlock()
+
+	stream, err := portaudio.OpenStream(params, p.fill)
+	if err != nil {
+		return fmt.Errorf("failed to open output: %v", err)
+	}
+	if err := stream.Start(); err != nil {
+		stream.Close()
+		return fmt.Errorf("failed to start output: %v", err)
+	}
+
+	p.mu.Lock()
+	p.stream = stream
+	p.mu.Unlock()
+	return nil
+}
+
+// push queues received samples, dropping the oldest when far ahead of
+// the target so playback stays close to live
+func (p *player) push(pcm []int16, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.frames++
+	p.latency = latency
+	if p.resampler != nil {
+		pcm = p.resampler.Process(pcm)
+	}
+	p.pending = append(p.pending, pcm...)
+
+	if excess := len(p.pending) - 2*p.samples(p.target); excess > 0 && p.samples(p.target) > 0 {
+		excess -= excess % max(1, p.format.Channels)
+		p.pending = p.pending[excess:]
+		p.dropped += p.duration(excess)
+	}
+}
+
+// gap records frames lost in the network
+func (p *player) gap(frames int) {
+	p.mu.Lock()
+	p.lost += frames
+	p.mu.Unlock()
+}
+
+// fill is the output callback: it plays buffered samples, or silence
+// while prefilling
+func (p *player) fill(out []int16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.prefilling && len(p.pending) >= p.samples(p.target) {
+		p.prefilling = false
+	}
+	if !p.prefilling && len(p.pending) < len(out) {
+		p.underruns++
+		p.prefilling = true
+	}
+	if p.prefilling {
+		clear(out)
+		return
+	}
+
+	gain := math.Pow(10, p.volume/20)
+	if p.muted {
+		gain = 0
+	}
+	for i, sample := range p.pending[:len(out)] {
+		out[i] = int16(max(math.MinInt16, min(math.MaxInt16, math.Round(float64(sample)*gain))))
+	}
+	p.pending = p.pending[len(out):]
+}
+
+// adjustVolume changes the volume by db decibels and returns it
+func (p *player) adjustVolume(db float64) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.volume = max(minVolume, min(maxVolume, p.volume+db))
+	return p.volume
+}
+
+// toggleMute mutes or unmutes and returns whether muted
+func (p *player) toggleMute() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.muted = !p.muted
+	return p.muted
+}
+
+// adjustBuffer changes the buffer target by d and returns it. A larger
+// target takes effect by prefilling again.
+func (p *player) adjustBuffer(d time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.target = max(minBuffer, min(maxBuffer, p.target+d))
+	if d > 0 {
+		p.prefilling = true
+	}
+	return p.target
+}
+
+// stats describes the playback state in one line
+func (p *player) stats() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	volume := fmt.Sprintf("%+.0f dB", p.volume)
+	if p.muted {
+		volume = "muted"
+	}
+	return fmt.Sprintf("%dHz %dch | buffered %s of %s | latency %s | frames %d, lost %d | underruns %d, skipped %s | volume %s",
+		p.format.SampleRate, p.format.Channels,
+		p.duration(len(p.pending)).Round(time.Millisecond), p.target,
+		p.latency.Round(time.Millisecond), p.frames, p.lost,
+		p.underruns, p.dropped.Round(time.Millisecond), volume)
+}
+
+// close stops playback
+func (p *player) close() {
+	p.mu.Lock()
+	stream := p.stream
+	p.stream = nil
+	p.mu.Unlock()
+
+	if stream != nil {
+		stream.Stop()
+		stream.Close()
+	}
+}
+
+// samples returns how many interleaved samples last d
+func (p *player) samples(d time.Duration) int {
+	return int(d.Seconds()*float64(p.rate)) * p.format.Channels
+}
+
+// duration returns how long n interleaved samples last
+func (p *player) duration(n int) time.Duration {
+	if p.rate == 0 || p.format.Channels == 0 {
+		return 0
+	}
+	return time.Duration(n/p.format.Channels) * time.Second / time.Duration(p.rate)
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+// rawInput is unavailable here, so keys take effect after Enter
+func rawInput() (restore func(), ok bool) {
+	return func() {}, false
+}
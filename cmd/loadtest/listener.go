@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maks112v/minicast/pkg/frame"
+)
+
+// retryDelay is how long a listener waits to reconnect after failing,
+// unless the server says otherwise
+const retryDelay = time.Second
+
+// errRefused is returned when the server turns a listener away
+type errRefused struct {
+	retryAfter time.Duration
+}
+
+// Error describes the refusal
+func (e errRefused) Error() string {
+	return "refused, retry after " + e.retryAfter.String()
+}
+
+// behaviour is how a simulated listener reads
+type behaviour struct {
+	// readBytesPerSecond caps how fast it reads, if not 0, like a player
+	// on a slow link
+	readBytesPerSecond float64
+	// stall, if set, is how long it now and then stops reading, like a
+	// frozen player, leaving the server to queue or drop its audio
+	stall time.Duration
+	// churn, if set, is how long it stays connected on average before
+	// hanging up and reconnecting
+	churn time.Duration
+}
+
+// simListener is one simulated listener
+type simListener struct {
+	url   string
+	do    behaviour
+	stats *stats
+	rng   *rand.Rand
+}
+
+// run keeps the listener connected until ctx is done
+func (l *simListener) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		wait := retryDelay
+		err := l.session(ctx)
+		var refused errRefused
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.As(err, &refused):
+			l.stats.refused.Add(1)
+			wait = refused.retryAfter
+		case err != nil:
+			l.stats.failed.Add(1)
+		default:
+			// Hung up on purpose; come straight back
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// session connects once and reads until ctx is done, the listener hangs
+// up, or the server drops it. It returns nil unless connecting failed.
+func (l *simListener) session(ctx context.Context) error {
+	c, resp, err := websocket.DefaultDialer.DialContext(ctx, l.url, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			return errRefused{retryAfter: time.Duration(max(seconds, 1)) * time.Second}
+		}
+		return err
+	}
+	defer c.Close()
+	l.stats.connects.Add(1)
+	l.stats.connected.Add(1)
+	defer l.stats.connected.Add(-1)
+
+	if l.do.churn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(l.rng.ExpFloat64()*float64(l.do.churn)))
+		defer cancel()
+	}
+	// Closing the connection ends the read loop below
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-stop:
+		case <-ctx.Done():
+			c.Close()
+		}
+	}()
+
+	started := time.Now()
+	var read int64
+	var next uint32
+	first := true
+	nextStall := l.stallAfter(started)
+	for {
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil {
+				l.stats.dropped.Add(1)
+			}
+			return nil
+		}
+		now := time.Now()
+		if messageType == websocket.BinaryMessage {
+			if h, _, err := frame.Decode(data); err == nil {
+				if !first && h.Flags&frame.FlagDiscontinuity == 0 && h.Seq != next {
+					l.stats.lost.Add(int64(h.Seq - next))
+				}
+				next, first = h.Seq+1, false
+				l.stats.frame(len(data), now.Sub(h.Captured))
+			}
+		}
+
+		// Reading no faster than the cap, the rest waits in the socket
+		read += int64(len(data))
+		if rate := l.do.readBytesPerSecond; rate > 0 {
+			due := started.Add(time.Duration(float64(read) / rate * float64(time.Second)))
+			if !l.sleepUntil(ctx, due) {
+				return nil
+			}
+		}
+		if !nextStall.IsZero() && now.After(nextStall) {
+			if !l.sleepUntil(ctx, now.Add(l.do.stall)) {
+				return nil
+			}
+			// The stall does not count towards the read rate
+			started = started.Add(l.do.stall)
+			nextStall = l.stallAfter(time.Now())
+		}
+	}
+}
+
+// stallAfter returns when the listener next stalls after now: on average
+// after twice the stall's length, or never if it does not stall
+func (l *simListener) stallAfter(now time.Time) time.Time {
+	if l.do.stall <= 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(l.rng.ExpFloat64() * float64(2*l.do.stall)))
+}
+
+// sleepUntil waits until t, reporting false if ctx was done first
+func (l *simListener) sleepUntil(ctx context.Context, t time.Time) bool {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
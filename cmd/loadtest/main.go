@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8001", "server address, as host:port or a ws:// or wss:// URL")
+	listeners := flag.Int("listeners", 100, "simulated listeners to connect")
+	ramp := flag.Duration("ramp", 10*time.Second, "spread the listeners' first connections over this long")
+	duration := flag.Duration("duration", time.Minute, "how long to run, including the ramp; 0 runs until interrupted")
+	profile := flag.String("profile", "balanced", "listener profile, which sets how the server queues and drops audio for slow listeners: stable, balanced or low-latency")
+	report := flag.Duration("report", 5*time.Second, "how often to print the figures")
+	slow := flag.Float64("slow", 0, "fraction of listeners that read no faster than -slow-kbps")
+	slowKbps := flag.Float64("slow-kbps", 64, "how fast slow listeners read, in kilobits per second")
+	stall := flag.Float64("stall", 0, "fraction of listeners that now and then stop reading for -stall-time, like a frozen player")
+	stallTime := flag.Duration("stall-time", 10*time.Second, "how long stalling listeners stop reading")
+	churn := flag.Duration("churn", 0, "how long listeners stay on average before hanging up and reconnecting; 0 stays connected")
+	flag.Parse()
+
+	if *listeners < 1 {
+		fmt.Fprintln(os.Stderr, "-listeners must be at least 1")
+		os.Exit(2)
+	}
+	u, err := streamURL(*addr, *profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -addr: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	var s stats
+	var wg sync.WaitGroup
+	start := time.Now()
+	// The ramp counts in wg, so listeners are added before it is waited on
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range *listeners {
+			rng := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+			do := behaviour{churn: *churn}
+			// Listeners are assigned behaviours in proportion, by position
+			// rather than chance, so small runs get what was asked for
+			if fractionHas(i, *slow) {
+				do.readBytesPerSecond = *slowKbps * 1000 / 8
+			}
+			if fractionHas(i, *stall) {
+				do.stall = *stallTime
+			}
+			l := &simListener{url: u, do: do, stats: &s, rng: rng}
+
+			wait := time.Until(start.Add(*ramp * time.Duration(i) / time.Duration(*listeners)))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.run(ctx)
+			}()
+		}
+	}()
+
+	fmt.Printf("Connecting %d listeners to %s over %s\n", *listeners, u, *ramp)
+	ticker := time.NewTicker(*report)
+	defer ticker.Stop()
+	last, lastFrames, lastBytes := start, int64(0), int64(0)
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			s.mu.Lock()
+			total := s.total
+			s.mu.Unlock()
+			elapsed := time.Since(start)
+			fmt.Printf("\nRan %s: %d connections (%d refused, %d failed, %d dropped by the server), %d frames, %s received (%s/s), %d lost\n%s\n",
+				elapsed.Round(time.Second), s.connects.Load(), s.refused.Load(), s.failed.Load(), s.dropped.Load(),
+				s.frames.Load(), megabytes(s.bytes.Load()), megabytes(int64(float64(s.bytes.Load())/elapsed.Seconds())), s.lost.Load(), total.String())
+			return
+		case now := <-ticker.C:
+			seconds := now.Sub(last).Seconds()
+			frames, bytes := s.frames.Load(), s.bytes.Load()
+			interval := s.takeInterval()
+			fmt.Printf("%5s  listeners %d/%d  connects %d (refused %d, failed %d, dropped %d)  %s/s  %.0f frames/s  %s  lost %d\n",
+				now.Sub(start).Round(time.Second), s.connected.Load(), *listeners,
+				s.connects.Load(), s.refused.Load(), s.failed.Load(), s.dropped.Load(),
+				megabytes(int64(float64(bytes-lastBytes)/seconds)), float64(frames-lastFrames)/seconds,
+				interval.String(), s.lost.Load())
+			last, lastFrames, lastBytes = now, frames, bytes
+		}
+	}
+}
+
+// fractionHas reports whether listener i is among the fraction given a
+// behaviour, spreading them evenly
+func fractionHas(i int, fraction float64) bool {
+	return fraction > 0 && int(float64(i+1)*fraction) > int(float64(i)*fraction)
+}
+
+// megabytes formats a byte count in MB
+func megabytes(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/1e6)
+}
+
+// streamURL returns the WebSocket URL to listen at for addr, given as
+// host:port or a ws:// or wss:// URL, whose path defaults to /ws. Framed
+// audio carries the capture time latency is measured from.
+func streamURL(addr, profile string) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "ws://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return "", fmt.Errorf("unsupported scheme %q (use ws or wss)", u.Scheme)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("no host in %q", addr)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+	query := u.Query()
+	query.Set("format", "framed")
+	query.Set("profile", profile)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLatency is the largest latency the histogram tells apart; later
+// frames count in its last bucket
+const maxLatency = 10 * time.Second
+
+// stats counts what the simulated listeners see
+type stats struct {
+	connected atomic.Int64
+	connects  atomic.Int64
+	failed    atomic.Int64
+	refused   atomic.Int64
+	dropped   atomic.Int64
+
+	frames atomic.Int64
+	bytes  atomic.Int64
+	lost   atomic.Int64
+
+	mu sync.Mutex
+	// interval and total are frame latency histograms in milliseconds,
+	// since the last report and overall
+	interval, total histogram
+}
+
+// frame records a frame of n bytes arriving latency after capture
+func (s *stats) frame(n int, latency time.Duration) {
+	s.frames.Add(1)
+	s.bytes.Add(int64(n))
+	s.mu.Lock()
+	s.interval.add(latency)
+	s.total.add(latency)
+	s.mu.Unlock()
+}
+
+// takeInterval returns the latencies since the last call and starts over
+func (s *stats) takeInterval() histogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.interval
+	s.interval = histogram{}
+	return h
+}
+
+// histogram counts latencies in 1ms buckets
+type histogram struct {
+	counts []int64
+	n      int64
+	max    time.Duration
+}
+
+// add counts a latency. Negative ones, from clocks that disagree, count
+// as 0.
+func (h *histogram) add(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, maxLatency/time.Millisecond+1)
+	}
+	i := min(max(d, 0), maxLatency) / time.Millisecond
+	h.counts[i]++
+	h.n++
+	h.max = max(h.max, d)
+}
+
+// percentile returns the latency p (0-100) percent of frames were within
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	target := int64(float64(h.n)*p/100 + 0.5)
+	var seen int64
+	for i, c := range h.counts {
+		if seen += c; seen >= max(target, 1) {
+			return time.Duration(i) * time.Millisecond
+		}
+	}
+	return maxLatency
+}
+
+// String summarizes the latencies
+func (h *histogram) String() string {
+	if h.n == 0 {
+		return "latency -"
+	}
+	return fmt.Sprintf("latency p50 %s p95 %s p99 %s max %s",
+		h.percentile(50), h.percentile(95), h.percentile(99), h.max.Round(time.Millisecond))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds every API call, so a hung server does not hang
+// the terminal
+const requestTimeout = 10 * time.Second
+
+// client calls the server's admin API
+type client struct {
+	base  *url.URL
+	token string
+	http  *http.Client
+}
+
+// newClient returns a client for the server at addr, given as host:port
+// or an http:// or https:// URL
+func newClient(addr, token string) (*client, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q (use http or https)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %q", addr)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &client{base: u, token: token, http: &http.Client{Timeout: requestTimeout}}, nil
+}
+
+// do sends body, if not nil, as JSON to path and decodes the answer into
+// out, if not nil
+func (c *client) do(method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base.String()+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		text := strings.TrimSpace(string(msg))
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			return fmt.Errorf("%s (set -token or MINICAST_TOKEN)", text)
+		case resp.StatusCode == http.StatusNotFound && (text == "" || text == "404 page not found"):
+			return fmt.Errorf("%s %s: not found (is this a minicast server?)", method, path)
+		case text == "":
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return errors.New(text)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	// Servers without the endpoint answer with the index page
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return fmt.Errorf("%s %s is not part of the server's API; it may need upgrading", method, path)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid answer to %s %s: %v", method, path, err)
+	}
+	return nil
+}
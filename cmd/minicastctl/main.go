@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/server"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// usage describes the commands
+const usage = `usage: minicastctl [-addr URL] [-token TOKEN] [-json] COMMAND [ARGS]
+
+Commands:
+  status                          the source, listeners and what is on air
+  listeners                       the connected listeners
+  cluster                         the instances sharing the broadcast
+  kick ID...                      disconnect listeners
+  metadata                        the now-playing metadata
+  metadata set [-title T] [-artist A]
+                                  change the now-playing metadata
+  record start [-name NAME]       record the broadcast on the server
+  record stop                     stop recording
+  record status                   the recording in progress
+
+Flags:
+`
+
+func main() {
+	addr := flag.String("addr", envOr("MINICAST_ADDR", "localhost:8001"), "server address, as host:port or an http:// or https:// URL ($MINICAST_ADDR)")
+	token := flag.String("token", os.Getenv("MINICAST_TOKEN"), "API token, needed once the server has tokens ($MINICAST_TOKEN)")
+	asJSON := flag.Bool("json", false, "print the server's answers as JSON")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient(*addr, *token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -addr: %v\n", err)
+		os.Exit(2)
+	}
+	ctl := &ctl{client: c, json: *asJSON}
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "status":
+		err = ctl.status()
+	case "listeners":
+		err = ctl.listeners()
+	case "cluster":
+		err = ctl.cluster()
+	case "kick":
+		err = ctl.kick(args)
+	case "metadata":
+		err = ctl.metadata(args)
+	case "record":
+		err = ctl.record(args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// envOr returns the environment variable key, or def when it is not set
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// ctl runs the commands against a server
+type ctl struct {
+	client *client
+	json   bool
+}
+
+// print writes v as indented JSON
+func (c *ctl) print(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// status prints the source, listener count, metadata and any hold,
+// maintenance or recording
+func (c *ctl) status() error {
+	var stats ws.Stats
+	if err := c.client.do(http.MethodGet, "/api/v1/stats", nil, &stats); err != nil {
+		return err
+	}
+	var md ws.Metadata
+	if err := c.client.do(http.MethodGet, "/api/v1/metadata", nil, &md); err != nil {
+		return err
+	}
+	// Servers from before recording was added have no state to report
+	var rec *server.RecordingState
+	c.client.do(http.MethodGet, "/api/v1/recording", nil, &rec)
+
+	if c.json {
+		return c.print(struct {
+			ws.Stats
+			Metadata  ws.Metadata            `json:"metadata"`
+			Recording *server.RecordingState `json:"recording"`
+		}{stats, md, rec})
+	}
+
+	now := time.Now()
+	if stats.Source == nil {
+		fmt.Println("Source:      none")
+	} else {
+		fmt.Printf("Source:      %s from %s, on for %s\n", stats.Source.Transport, stats.Source.RemoteAddr, since(now, stats.Source.ConnectedAt))
+		if f := stats.SourceFormat; f != nil {
+			fmt.Printf("Format:      %s %d-bit, %dHz, %d channel(s)\n", f.Codec, f.BitDepth, f.SampleRate, f.Channels)
+		}
+	}
+	remote := 0
+	for _, l := range stats.Listeners {
+		if l.Transport == "websocket" || l.Transport == "http" {
+			remote++
+		}
+	}
+	fmt.Printf("Listeners:   %d\n", remote)
+	if title := md.StreamTitle(); title != "" {
+		fmt.Printf("Now playing: %s\n", title)
+	}
+	if m := stats.Maintenance; m != nil {
+		fmt.Printf("Maintenance: %q for %s\n", m.Message, since(now, m.Since))
+	}
+	if h := stats.Hold; h != nil {
+		fmt.Printf("On hold:     %q for %s\n", h.Message, since(now, h.Since))
+	}
+	if rec != nil {
+		fmt.Printf("Recording:   %s\n", describeRecording(now, *rec))
+	}
+	return nil
+}
+
+// listeners prints a table of the connected listeners, including the
+// server's own outputs such as the DVR
+func (c *ctl) listeners() error {
+	var listeners []ws.ListenerStats
+	if err := c.client.do(http.MethodGet, "/api/v1/listeners", nil, &listeners); err != nil {
+		return err
+	}
+	if c.json {
+		return c.print(listeners)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTRANSPORT\tPROFILE\tREMOTE\tCONNECTED\tQUEUED\tDROPPED\tUSER AGENT")
+	for _, l := range listeners {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", l.ID, l.Transport, l.Profile, l.RemoteAddr,
+			since(now, l.ConnectedAt), l.Queued, l.Dropped, l.UserAgent)
+	}
+	return w.Flush()
+}
+
+// cluster prints a table of the instances sharing the broadcast over a
+// fanout bus
+func (c *ctl) cluster() error {
+	var state server.ClusterState
+	if err := c.client.do(http.MethodGet, "/api/v1/cluster", nil, &state); err != nil {
+		return err
+	}
+	if c.json {
+		return c.print(state)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tLISTENERS\tSOURCE\tUP\tLAST SEEN")
+	for _, instance := range state.Instances {
+		name, source := instance.Name, "-"
+		if name == state.Instance {
+			name += " (this)"
+		}
+		if instance.Source != nil {
+			source = fmt.Sprintf("%s from %s", instance.Source.Transport, instance.Source.RemoteAddr)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s ago\n", name, instance.Listeners, source,
+			since(now, instance.Started), since(now, instance.LastSeen))
+	}
+	fmt.Fprintf(w, "TOTAL\t%d\t\t\t\n", state.Listeners)
+	return w.Flush()
+}
+
+// kick disconnects the listeners with the given IDs
+func (c *ctl) kick(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: minicastctl kick ID...")
+	}
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid listener id %q", arg)
+		}
+		if err := c.client.do(http.MethodDelete, "/api/v1/listeners/"+arg, nil, nil); err != nil {
+			return fmt.Errorf("listener %d: %v", id, err)
+		}
+		if !c.json {
+			fmt.Printf("Kicked listener %d\n", id)
+		}
+	}
+	return nil
+}
+
+// metadata prints the now-playing metadata, or with "set" changes the
+// fields given and keeps the rest
+func (c *ctl) metadata(args []string) error {
+	var md ws.Metadata
+	if err := c.client.do(http.MethodGet, "/api/v1/metadata", nil, &md); err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "get" {
+		if c.json {
+			return c.print(md)
+		}
+		fmt.Printf("Title:  %s\nArtist: %s\n", md.Title, md.Artist)
+		return nil
+	}
+	if args[0] != "set" {
+		return fmt.Errorf("unknown metadata command %q (use get or set)", args[0])
+	}
+
+	flags := flag.NewFlagSet("metadata set", flag.ExitOnError)
+	title := flags.String("title", md.Title, "title of what is playing")
+	artist := flags.String("artist", md.Artist, "artist of what is playing")
+	flags.Parse(args[1:])
+	if flags.NFlag() == 0 {
+		return errors.New("usage: minicastctl metadata set [-title T] [-artist A]")
+	}
+	md = ws.Metadata{Title: strings.TrimSpace(*title), Artist: strings.TrimSpace(*artist)}
+	if err := c.client.do(http.MethodPut, "/api/v1/metadata", md, &md); err != nil {
+		return err
+	}
+	if c.json {
+		return c.print(md)
+	}
+	fmt.Printf("Now playing: %s\n", md.StreamTitle())
+	return nil
+}
+
+// record starts, stops or reports on a recording made by the server
+func (c *ctl) record(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: minicastctl record start [-name NAME] | stop | status")
+	}
+
+	var rec *server.RecordingState
+	switch args[0] {
+	case "start":
+		flags := flag.NewFlagSet("record start", flag.ExitOnError)
+		name := flags.String("name", "", "file to record into on the server, without a directory (default: named after the time)")
+		flags.Parse(args[1:])
+		if err := c.client.do(http.MethodPost, "/api/v1/recording", server.Recording{Name: *name}, &rec); err != nil {
+			return err
+		}
+	case "stop":
+		if err := c.client.do(http.MethodDelete, "/api/v1/recording", nil, &rec); err != nil {
+			return err
+		}
+	case "status":
+		if err := c.client.do(http.MethodGet, "/api/v1/recording", nil, &rec); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown record command %q (use start, stop or status)", args[0])
+	}
+
+	if c.json {
+		return c.print(rec)
+	}
+	if rec == nil {
+		fmt.Println("Not recording")
+		return nil
+	}
+	switch args[0] {
+	case "start":
+		fmt.Printf("Recording to %s\n", rec.Path)
+	case "stop":
+		fmt.Printf("Stopped: %s\n", describeRecording(time.Now(), *rec))
+	default:
+		fmt.Println(describeRecording(time.Now(), *rec))
+	}
+	return nil
+}
+
+// describeRecording summarizes a recording in one line
+func describeRecording(now time.Time, rec server.RecordingState) string {
+	line := fmt.Sprintf("%s, %s, %.1f MB", rec.Path, since(now, rec.Started), float64(rec.Bytes)/1e6)
+	if rec.Error != "" {
+		line += " (failed: " + rec.Error + ")"
+	}
+	return line
+}
+
+// since formats how long ago t was, to the second
+func since(now, t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return now.Sub(t).Round(time.Second).String()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maks112v/minicast/pkg/frame"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// downstreamQueue is how many frames may wait for a slow downstream
+	// (about 3s of audio) before the oldest are dropped
+	downstreamQueue = 32
+
+	// pingInterval is how often the downstream is pinged
+	pingInterval = 5 * time.Second
+	// pongTimeout is how long the downstream may go unheard before the
+	// connection counts as hung
+	pongTimeout = 12 * time.Second
+	// writeTimeout bounds a single write, so a stalled link is noticed
+	writeTimeout = 10 * time.Second
+
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// outFrame is a framed message waiting to be sent, with the format of its
+// audio
+type outFrame struct {
+	format ws.SourceFormat
+	data   []byte
+}
+
+// metadataMessage is the text frame telling the server what is playing
+type metadataMessage struct {
+	Type string `json:"type"`
+	ws.Metadata
+}
+
+// downstream republishes an upstream's broadcast as the source of another
+// server. As the upstream's handler it numbers frames afresh, so frames it
+// has to drop show up downstream as gaps.
+type downstream struct {
+	url    string
+	dialer *websocket.Dialer
+	header http.Header
+	queue  chan outFrame
+	logger *zap.SugaredLogger
+
+	// format and seq are only used by the upstream's goroutine
+	format ws.SourceFormat
+	seq    uint32
+
+	mu              sync.Mutex
+	metadata        *ws.Metadata
+	metadataChanged chan struct{}
+}
+
+// newDownstream returns a downstream for addr, a ws:// or wss:// URL of a
+// server or its /ws endpoint, sending token if set
+func newDownstream(addr, token string, dialer *websocket.Dialer, logger *zap.SugaredLogger) (*downstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported scheme %q (use ws or wss)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %s", addr)
+	}
+	if !strings.HasSuffix(u.Path, "/ws") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	}
+	query := u.Query()
+	query.Set("source", "true")
+	u.RawQuery = query.Encode()
+
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return &downstream{
+		url:             u.String(),
+		dialer:          dialer,
+		header:          header,
+		queue:           make(chan outFrame, downstreamQueue),
+		logger:          logger,
+		metadataChanged: make(chan struct{}, 1),
+	}, nil
+}
+
+// Connect starts relaying a new upstream connection
+func (d *downstream) Connect(info ws.ConnInfo, format ws.SourceFormat) error {
+	d.format = format
+	return nil
+}
+
+// Format switches the format of the frames that follow
+func (d *downstream) Format(format ws.SourceFormat) error {
+	d.format = format
+	return nil
+}
+
+// Metadata passes the upstream's now-playing metadata on, now and again
+// on every reconnection
+func (d *downstream) Metadata(md ws.Metadata) {
+	d.mu.Lock()
+	d.metadata = &md
+	d.mu.Unlock()
+	select {
+	case d.metadataChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Frame queues a frame for the downstream. It never blocks: a downstream
+// that falls behind loses the oldest frames.
+func (d *downstream) Frame(pcm []byte, captured time.Time, flags frame.Flags) {
+	d.seq++
+	f := outFrame{format: d.format, data: frame.Encode(frame.Header{Seq: d.seq, Captured: captured, Flags: flags}, pcm)}
+	select {
+	case d.queue <- f:
+		return
+	default:
+	}
+	select {
+	case <-d.queue:
+	default:
+	}
+	select {
+	case d.queue <- f:
+	default:
+	}
+}
+
+// Disconnect notes that the upstream was lost. The downstream stays
+// connected, silent, so its listeners stay too.
+func (d *downstream) Disconnect() {}
+
+// nowPlaying returns the metadata to send, if any, clearing any pending
+// change signal since it is being sent
+func (d *downstream) nowPlaying() *ws.Metadata {
+	select {
+	case <-d.metadataChanged:
+	default:
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.metadata
+}
+
+// run keeps a connection to the downstream while there is audio to send,
+// backing off between attempts
+func (d *downstream) run(ctx context.Context) {
+	delay := minReconnectDelay
+	for {
+		// Wait for audio, since the handshake needs its format
+		var first outFrame
+		select {
+		case <-ctx.Done():
+			return
+		case first = <-d.queue:
+		}
+		// Frames queued while disconnected are stale; start from the newest
+		for len(d.queue) > 0 {
+			first = <-d.queue
+		}
+
+		started := time.Now()
+		err := d.stream(ctx, first)
+		if ctx.Err() != nil {
+			return
+		}
+		d.logger.Warnf("Not connected to %s, retrying in %s: %v", d.url, delay, err)
+
+		// A connection that lasted a while starts the backoff over
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// stream connects once, announcing first's format, and sends frames until
+// the connection fails or ctx is done
+func (d *downstream) stream(ctx context.Context, first outFrame) error {
+	conn, resp, err := d.dialer.DialContext(ctx, d.url, d.header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("the server needs a valid source token (-token): %v", err)
+		}
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	write := func(messageType int, data []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteMessage(messageType, data)
+	}
+	writeJSON := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(v)
+	}
+	sendFormat := func(format ws.SourceFormat) error {
+		format.Framed = true
+		handshake, err := format.Handshake()
+		if err != nil {
+			return err
+		}
+		return write(websocket.TextMessage, handshake)
+	}
+
+	format := first.format
+	if err := sendFormat(format); err != nil {
+		return err
+	}
+	if md := d.nowPlaying(); md != nil {
+		if err := writeJSON(metadataMessage{Type: "metadata", Metadata: *md}); err != nil {
+			return err
+		}
+	}
+	if err := write(websocket.BinaryMessage, first.data); err != nil {
+		return err
+	}
+
+	// Read so rejections, pongs and closes are noticed
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					err = fmt.Errorf("connection hung: no answer from the server in %s", pongTimeout)
+				}
+				closed <- err
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(pongTimeout))
+			if messageType == websocket.TextMessage {
+				d.logger.Warnf("Server says: %s", data)
+			}
+		}
+	}()
+
+	d.logger.Infof("Publishing to %s", d.url)
+	keepalive := time.NewTicker(pingInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+			}
+			return nil
+		case err := <-closed:
+			return err
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return err
+			}
+		case f := <-d.queue:
+			if f.format != format {
+				format = f.format
+				if err := sendFormat(format); err != nil {
+					return err
+				}
+			}
+			if err := write(websocket.BinaryMessage, f.data); err != nil {
+				return err
+			}
+		case <-d.metadataChanged:
+			if md := d.nowPlaying(); md != nil {
+				if err := writeJSON(metadataMessage{Type: "metadata", Metadata: *md}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
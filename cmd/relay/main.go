@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"github.com/maks112v/minicast/pkg/relay"
+	"go.uber.org/zap"
+)
+
+func main() {
+	from := flag.String("from", "", "server to listen to, as a ws:// or wss:// URL (e.g. wss://edge1.example.com/ws)")
+	to := flag.String("to", "", "server to publish to as its source, as a ws:// or wss:// URL (e.g. wss://origin.example.com/ws)")
+	token := flag.String("token", "", "source token sent to the -to server if it requires one (an api token with the source scope)")
+	insecure := flag.Bool("insecure-skip-verify", false, "connect to wss:// servers without verifying their certificates, for labs with self-signed ones")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: relay -from wss://edge1.example.com/ws -to wss://origin.example.com/ws [-token TOKEN]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *from == "" || *to == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+	sugar := logger.Sugar()
+
+	dialer := *websocket.DefaultDialer
+	if *insecure {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	upstream, err := relay.NewUpstream(*from, &dialer, sugar.With("side", "from"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -from: %v\n", err)
+		os.Exit(2)
+	}
+	down, err := newDownstream(*to, *token, &dialer, sugar.With("side", "to"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -to: %v\n", err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	sugar.Infof("Relaying %s to %s", upstream.URL(), down.url)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		upstream.Run(ctx, down)
+	}()
+	go func() {
+		defer wg.Done()
+		down.run(ctx)
+	}()
+	wg.Wait()
+	sugar.Info("Relay stopped")
+}
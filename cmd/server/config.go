@@ -0,0 +1,426 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/clock"
+	"github.com/maks112v/minicast/pkg/events"
+	"github.com/maks112v/minicast/pkg/server"
+	"github.com/maks112v/minicast/pkg/sink"
+	"github.com/maks112v/minicast/pkg/snapcast"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the server's YAML config file. Every setting also has a
+// flag, and flags given on the command line override the file.
+type fileConfig struct {
+	Listen    string `yaml:"listen"`
+	StaticDir string `yaml:"static_dir"`
+	Templates string `yaml:"templates,omitempty"`
+
+	RelayURL    string `yaml:"relay_url,omitempty"`
+	Origin      string `yaml:"origin,omitempty"`
+	Passthrough bool   `yaml:"passthrough"`
+
+	Fanout struct {
+		URL     string `yaml:"url,omitempty"`
+		Channel string `yaml:"channel"`
+	} `yaml:"fanout"`
+
+	MQTT struct {
+		URL      string            `yaml:"url,omitempty"`
+		Topic    string            `yaml:"topic"`
+		Topics   server.MQTTTopics `yaml:"topics,omitempty"`
+		Interval time.Duration     `yaml:"interval"`
+	} `yaml:"mqtt"`
+
+	RTP struct {
+		Addr               string `yaml:"addr,omitempty"`
+		Codec              string `yaml:"codec"`
+		Redundancy         string `yaml:"redundancy"`
+		RedundancyDistance int    `yaml:"redundancy_distance"`
+	} `yaml:"rtp"`
+
+	Snapcast struct {
+		Addr   string        `yaml:"addr,omitempty"`
+		Buffer time.Duration `yaml:"buffer"`
+	} `yaml:"snapcast"`
+
+	WebRTC struct {
+		Addr      string     `yaml:"addr,omitempty"`
+		PublicIPs stringList `yaml:"public_ips,omitempty"`
+	} `yaml:"webrtc"`
+
+	PortMapping struct {
+		Method  string `yaml:"method,omitempty"`
+		Gateway string `yaml:"gateway,omitempty"`
+	} `yaml:"port_mapping"`
+
+	MDNS struct {
+		Enabled bool   `yaml:"enabled"`
+		Name    string `yaml:"name,omitempty"`
+	} `yaml:"mdns"`
+
+	DLNA struct {
+		Enabled bool   `yaml:"enabled"`
+		Name    string `yaml:"name"`
+	} `yaml:"dlna"`
+
+	DVR struct {
+		Dir    string        `yaml:"dir,omitempty"`
+		Depth  time.Duration `yaml:"depth"`
+		Format string        `yaml:"format"`
+		Tap    string        `yaml:"tap"`
+	} `yaml:"dvr"`
+
+	RecordDir  string `yaml:"record_dir,omitempty"`
+	SessionsDB string `yaml:"sessions_db,omitempty"`
+	GeoIPDB    string `yaml:"geoip_db,omitempty"`
+
+	UDPIngest struct {
+		Addr  string        `yaml:"addr,omitempty"`
+		Delay time.Duration `yaml:"delay"`
+	} `yaml:"udp_ingest"`
+
+	Clock struct {
+		Source string        `yaml:"source,omitempty"`
+		Poll   time.Duration `yaml:"poll"`
+	} `yaml:"clock"`
+
+	LoopProtection   string        `yaml:"loop_protection"`
+	JitterBuffer     time.Duration `yaml:"jitter_buffer"`
+	Resample         string        `yaml:"resample"`
+	Remix            bool          `yaml:"remix"`
+	MaintenanceAudio string        `yaml:"maintenance_audio,omitempty"`
+	HoldAudio        string        `yaml:"hold_audio,omitempty"`
+	LoudnessTarget   float64       `yaml:"loudness_target"`
+
+	Silence struct {
+		Threshold float64       `yaml:"threshold"`
+		After     time.Duration `yaml:"after"`
+		Pause     bool          `yaml:"pause"`
+		Fallback  string        `yaml:"fallback,omitempty"`
+	} `yaml:"silence"`
+
+	DSCP server.DSCP `yaml:"dscp,omitempty"`
+
+	Admission struct {
+		Rate  float64 `yaml:"rate"`
+		Burst int     `yaml:"burst"`
+	} `yaml:"admission"`
+
+	RateLimit struct {
+		Rate   float64       `yaml:"rate"`
+		Burst  int           `yaml:"burst"`
+		Ban    time.Duration `yaml:"ban"`
+		Exempt stringList    `yaml:"exempt,omitempty"`
+	} `yaml:"rate_limit"`
+
+	MP3 struct {
+		Encoder string `yaml:"encoder"`
+		Bitrate int    `yaml:"bitrate"`
+	} `yaml:"mp3"`
+
+	TSUDP string `yaml:"ts_udp,omitempty"`
+
+	DASHSegment time.Duration `yaml:"dash_segment"`
+
+	Idle struct {
+		Timeout time.Duration `yaml:"timeout"`
+		Command commandLine   `yaml:"command,omitempty"`
+	} `yaml:"idle"`
+
+	// Preset supplies the pipeline for a kind of programme, adjusted by
+	// the overrides
+	Preset          string     `yaml:"preset,omitempty"`
+	PresetOverrides stringList `yaml:"preset_overrides,omitempty"`
+
+	// The pipeline, triggers, listener thresholds, webhooks, sinks and API
+	// tokens have no flags
+	Pipeline           []audio.StageConfig `yaml:"pipeline,omitempty"`
+	Triggers           []server.Trigger    `yaml:"triggers,omitempty"`
+	ListenerThresholds []int               `yaml:"listener_thresholds,omitempty"`
+	Webhooks           []webhookConfig     `yaml:"webhooks,omitempty"`
+	Sinks              []sink.Config       `yaml:"sinks,omitempty"`
+	APITokens          []server.APIToken   `yaml:"api_tokens,omitempty"`
+}
+
+// webhookConfig is a webhook in the config file: a URL, receiving every
+// event unsigned, or a mapping with the URL, a secret and the events
+type webhookConfig events.WebhookConfig
+
+// UnmarshalYAML reads a URL or a mapping
+func (w *webhookConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&w.URL)
+	}
+	return node.Decode((*events.WebhookConfig)(w))
+}
+
+// bindFlags defines a flag for every setting, storing into cfg. Defining
+// them sets cfg to the defaults.
+func bindFlags(flags *flag.FlagSet, cfg *fileConfig) {
+	flags.StringVar(&cfg.Listen, "listen", defaultListen(), "address to listen on (default :$PORT when PORT is set)")
+	flags.StringVar(&cfg.StaticDir, "static", ".", "directory served under /static/")
+	flags.StringVar(&cfg.Templates, "templates", "", "directory of templates overriding the embedded ones")
+	flags.StringVar(&cfg.RelayURL, "url", "", "stream to relay as the source (relay mode only)")
+	flags.StringVar(&cfg.Origin, "origin", "", "run as an edge of this minicast server (a ws:// or wss:// URL), broadcasting what it does")
+	flags.StringVar(&cfg.Fanout.URL, "fanout", "", "share the broadcast with other instances over this bus: redis://[:password@]host[:port] (rediss:// for TLS) or nats://[user:password@]host[:port] (tls:// for TLS; list cluster servers separated by commas)")
+	flags.StringVar(&cfg.Fanout.Channel, "fanout-channel", "minicast", "channel (NATS subject) on the fanout bus; instances of one stream share it")
+	flags.StringVar(&cfg.MQTT.URL, "mqtt", "", "publish the stream's state, listener count and levels to this MQTT broker: mqtt://[user:password@]host[:port] (mqtts:// for TLS)")
+	flags.StringVar(&cfg.MQTT.Topic, "mqtt-topic", "minicast", "prefix of the MQTT topics status is published to")
+	flags.DurationVar(&cfg.MQTT.Interval, "mqtt-interval", time.Second, "how often levels are published over MQTT")
+	flags.StringVar(&cfg.RTP.Addr, "rtp", "", "send the stream as RTP to this host:port (unicast or multicast)")
+	flags.StringVar(&cfg.RTP.Codec, "rtp-codec", "l16", "RTP payload format: l16 (lossless) or pcmu (G.711 for PBXs)")
+	flags.StringVar(&cfg.RTP.Redundancy, "rtp-redundancy", "off", "resend RTP audio for lossy networks: off, red (RFC 2198) or repeat")
+	flags.IntVar(&cfg.RTP.RedundancyDistance, "rtp-redundancy-distance", 1, "how many packets later RTP audio is resent")
+	flags.StringVar(&cfg.Snapcast.Addr, "snapcast", "", "serve Snapcast clients on this address (e.g. :1704) for synchronized multiroom playback")
+	flags.DurationVar(&cfg.Snapcast.Buffer, "snapcast-buffer", snapcast.DefaultBuffer, "how far behind the server Snapcast clients play; longer rides out worse networks")
+	flags.StringVar(&cfg.WebRTC.Addr, "webrtc", "", "take WHIP sources and serve WHEP players over WebRTC, with media on this UDP address (e.g. :8189)")
+	flags.Var(&cfg.WebRTC.PublicIPs, "webrtc-public-ip", "advertise this address to WebRTC peers instead of the host's own, when behind NAT; repeatable")
+	flags.StringVar(&cfg.PortMapping.Method, "port-mapping", "", "ask the router to forward the listen port from the internet: auto, upnp or natpmp")
+	flags.StringVar(&cfg.PortMapping.Gateway, "port-mapping-gateway", "", "the NAT-PMP gateway's address (default: the default route's gateway)")
+	flags.BoolVar(&cfg.MDNS.Enabled, "mdns", false, "advertise the server on the LAN over mDNS, so sources and listeners started with -discover find it")
+	flags.StringVar(&cfg.MDNS.Name, "mdns-name", "", `name the server is advertised under (default "MiniCast on <host>")`)
+	flags.BoolVar(&cfg.DLNA.Enabled, "dlna", false, "announce the stream over UPnP so smart TVs and network speakers list it")
+	flags.StringVar(&cfg.DLNA.Name, "dlna-name", "MiniCast", "name the stream is listed under on the LAN")
+	flags.StringVar(&cfg.LoopProtection, "loop-protection", "warn", "when a source captures the stream's own output: off, warn or mute")
+	flags.DurationVar(&cfg.JitterBuffer, "jitter-buffer", 0, "buffer this much source audio and re-emit it on a steady clock (e.g. 200ms)")
+	flags.StringVar(&cfg.Clock.Source, "clock", "", "discipline frame and DVR timestamps from an NTP server (e.g. pool.ntp.org) or a PTP hardware clock (ptp:/dev/ptp0)")
+	flags.DurationVar(&cfg.Clock.Poll, "clock-poll", clock.DefaultPoll, "how often the -clock reference is queried")
+	flags.StringVar(&cfg.UDPIngest.Addr, "udp-ingest", "", "also take sources over UDP on this address (e.g. :8001), for lossy networks where TCP stalls")
+	flags.DurationVar(&cfg.UDPIngest.Delay, "udp-ingest-delay", 250*time.Millisecond, "how long UDP ingest waits for lost packets to be resent before skipping them")
+	flags.StringVar(&cfg.Resample, "resample", "sinc", "convert sources at other sample rates to the broadcast rate: sinc, linear, or off")
+	flags.BoolVar(&cfg.Remix, "remix", true, "mix sources with other channel counts (e.g. mono microphones) to the broadcast's")
+	flags.StringVar(&cfg.MaintenanceAudio, "maintenance-audio", "", "WAV or MP3 announcement looped to listeners during maintenance")
+	flags.StringVar(&cfg.HoldAudio, "hold-audio", "", "WAV or MP3 hold music looped to listeners while the broadcast is on hold")
+	flags.Float64Var(&cfg.Silence.Threshold, "silence-threshold", -60, "level in dBFS below which the source counts as silent")
+	flags.DurationVar(&cfg.Silence.After, "silence-after", 10*time.Second, "how long the source must stay silent before it is reported (and paused)")
+	flags.BoolVar(&cfg.Silence.Pause, "silence-pause", false, "stop broadcasting a silent source until its audio resumes")
+	flags.StringVar(&cfg.Silence.Fallback, "silence-fallback", "", "WAV or MP3 looped to listeners while a silent source is paused")
+	flags.Float64Var(&cfg.LoudnessTarget, "loudness-target", -16, "integrated loudness in LUFS the stream should have, reported with the measurements")
+	flags.StringVar(&cfg.DVR.Dir, "dvr-dir", "", "keep a rolling archive in this directory for rewind and clips")
+	flags.DurationVar(&cfg.DVR.Depth, "dvr-depth", 2*time.Hour, "how much audio the DVR keeps")
+	flags.StringVar(&cfg.DVR.Format, "dvr-format", "pcm", "how the DVR stores audio: pcm, or flac (lossless, about half the size)")
+	flags.StringVar(&cfg.DVR.Tap, "dvr-tap", "mix", "what the DVR records: mix (the broadcast as heard) or source (before processing)")
+	flags.StringVar(&cfg.RecordDir, "record-dir", "", "directory recordings started through the API (or minicastctl record) are written to")
+	flags.StringVar(&cfg.SessionsDB, "sessions-db", "", "SQLite database every listener and source session is recorded in, for audience history")
+	flags.StringVar(&cfg.GeoIPDB, "geoip-db", "", "MaxMind GeoIP2 or GeoLite2 Country or City database (.mmdb) listeners are located with")
+	flags.StringVar(&cfg.DSCP.Listeners, "dscp", "", "mark audio sent to listeners with this DSCP class (e.g. af41); the config file can set it per profile")
+	flags.StringVar(&cfg.DSCP.RTP, "rtp-dscp", "", "mark RTP packets with this DSCP class (e.g. ef)")
+	flags.Float64Var(&cfg.Admission.Rate, "admission-rate", 50, "listeners let in per second once a burst has connected, so reconnect storms are staggered; 0 for no limit")
+	flags.IntVar(&cfg.Admission.Burst, "admission-burst", 100, "listeners let in at once before -admission-rate applies")
+	flags.Float64Var(&cfg.RateLimit.Rate, "rate-limit", 0, "requests per second each client IP may make, WebSocket upgrades included, once a burst is spent; 0 for no limit")
+	flags.IntVar(&cfg.RateLimit.Burst, "rate-limit-burst", 20, "requests a client IP may make at once before -rate-limit applies")
+	flags.DurationVar(&cfg.RateLimit.Ban, "rate-limit-ban", time.Minute, "ban a client IP that keeps going over the rate limit for this long; 0 never bans")
+	flags.Var(&cfg.RateLimit.Exempt, "rate-limit-exempt", "never rate limit this address or CIDR range (e.g. 10.0.0.0/8), besides loopback; repeatable")
+	flags.StringVar(&cfg.MP3.Encoder, "mp3-encoder", server.MP3EncoderGo, "encoder of the MP3 stream at /stream.mp3: go (built in, no cgo), or off")
+	flags.IntVar(&cfg.MP3.Bitrate, "mp3-bitrate", 128, "bitrate of the MP3 stream in kbit/s, from 32 to 320")
+	flags.StringVar(&cfg.TSUDP, "ts-udp", "", "also send the MPEG-TS stream to this host:port over UDP (unicast or multicast)")
+	flags.DurationVar(&cfg.DASHSegment, "dash-segment", 0, "serve the stream as MPEG-DASH at /stream.mpd in segments this long (e.g. 2s)")
+	flags.DurationVar(&cfg.Idle.Timeout, "idle-timeout", 0, "exit after this long with no source and no listeners (e.g. 15m), for scale-to-zero platforms")
+	flags.Var(&cfg.Idle.Command, "idle-command", "run this command on going idle instead of exiting, e.g. to scale the deployment down (split at spaces; use the config file for quoting)")
+	flags.StringVar(&cfg.Preset, "preset", "", "processing preset for the source's audio: "+strings.Join(audio.PresetNames(), ", "))
+	flags.Var(&cfg.PresetOverrides, "preset-override", "change a preset setting, e.g. compressor.ratio=4 or gate=off; repeatable")
+	flags.BoolVar(&cfg.Passthrough, "passthrough", false, "relay source frames byte-for-byte, refusing listeners that need re-framing")
+}
+
+// stringList is a flag that may be repeated
+type stringList []string
+
+// String returns the values joined by commas
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set adds a value
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// commandLine is a command and its arguments, given to a flag as one string
+// split at spaces
+type commandLine []string
+
+// String returns the command joined by spaces
+func (c *commandLine) String() string {
+	return strings.Join(*c, " ")
+}
+
+// Set replaces the command
+func (c *commandLine) Set(v string) error {
+	*c = strings.Fields(v)
+	return nil
+}
+
+// defaultListen listens on $PORT when set, as scale-to-zero platforms expect
+func defaultListen() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8001"
+}
+
+// applyPreset sets the pipeline from the preset, if one is chosen. A
+// pipeline written out in full cannot be combined with one.
+func (c *fileConfig) applyPreset() error {
+	if c.Preset == "" {
+		if len(c.PresetOverrides) > 0 {
+			return fmt.Errorf("preset overrides given without a preset")
+		}
+		return nil
+	}
+	if len(c.Pipeline) > 0 {
+		return fmt.Errorf("a preset and a pipeline cannot both be configured; use preset overrides instead")
+	}
+
+	preset, ok := audio.LookupPreset(c.Preset)
+	if !ok {
+		return fmt.Errorf("unknown preset %q (available: %s)", c.Preset, strings.Join(audio.PresetNames(), ", "))
+	}
+	for _, override := range c.PresetOverrides {
+		if err := preset.Override(override); err != nil {
+			return fmt.Errorf("preset %s: %v", c.Preset, err)
+		}
+	}
+	c.Pipeline = preset.Stages
+	return nil
+}
+
+// loadConfigFile reads path over cfg, leaving settings it omits unchanged
+func loadConfigFile(path string, cfg *fileConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return nil
+}
+
+// serverConfig returns the settings for server.New
+func (c fileConfig) serverConfig() server.Config {
+	return server.Config{
+		StaticDir:   c.StaticDir,
+		TemplateDir: c.Templates,
+		RelayURL:    c.RelayURL,
+		OriginURL:   c.Origin,
+		Passthrough: c.Passthrough,
+		RTPAddr:     c.RTP.Addr,
+		RTPCodec:    c.RTP.Codec,
+
+		RTPRedundancy:         c.RTP.Redundancy,
+		RTPRedundancyDistance: c.RTP.RedundancyDistance,
+
+		SnapcastAddr:   c.Snapcast.Addr,
+		SnapcastBuffer: c.Snapcast.Buffer,
+
+		WebRTCAddr:      c.WebRTC.Addr,
+		WebRTCPublicIPs: c.WebRTC.PublicIPs,
+
+		PortMapping:        c.PortMapping.Method,
+		PortMappingGateway: c.PortMapping.Gateway,
+
+		MDNS:     c.MDNS.Enabled,
+		MDNSName: c.MDNS.Name,
+
+		DLNA:     c.DLNA.Enabled,
+		DLNAName: c.DLNA.Name,
+
+		FanoutURL:     c.Fanout.URL,
+		FanoutChannel: c.Fanout.Channel,
+
+		MQTTURL:      c.MQTT.URL,
+		MQTTTopic:    c.MQTT.Topic,
+		MQTTTopics:   c.MQTT.Topics,
+		MQTTInterval: c.MQTT.Interval,
+
+		DVRDir:    c.DVR.Dir,
+		DVRDepth:  c.DVR.Depth,
+		DVRFormat: c.DVR.Format,
+		DVRTap:    c.DVR.Tap,
+
+		RecordDir:  c.RecordDir,
+		SessionsDB: c.SessionsDB,
+		GeoIPDB:    c.GeoIPDB,
+
+		LoopProtection:   c.LoopProtection,
+		JitterBuffer:     c.JitterBuffer,
+		ClockSource:      c.Clock.Source,
+		ClockPoll:        c.Clock.Poll,
+		UDPIngestAddr:    c.UDPIngest.Addr,
+		UDPIngestDelay:   c.UDPIngest.Delay,
+		Resample:         c.resample(),
+		ChannelMixing:    c.Remix,
+		MaintenanceAudio: c.MaintenanceAudio,
+		HoldAudio:        c.HoldAudio,
+		LoudnessTarget:   c.LoudnessTarget,
+
+		Silence: ws.SilenceConfig{
+			Threshold: c.Silence.Threshold,
+			After:     c.Silence.After,
+			Pause:     c.Silence.Pause,
+		},
+		SilenceFallback: c.Silence.Fallback,
+
+		Pipeline:           c.Pipeline,
+		Triggers:           c.Triggers,
+		ListenerThresholds: c.ListenerThresholds,
+		Webhooks:           c.webhooks(),
+		Sinks:              c.Sinks,
+
+		APITokens: c.APITokens,
+
+		DSCP: c.DSCP,
+
+		AdmissionRate:  c.Admission.Rate,
+		AdmissionBurst: c.Admission.Burst,
+
+		RateLimit:       c.RateLimit.Rate,
+		RateLimitBurst:  c.RateLimit.Burst,
+		RateLimitBan:    c.RateLimit.Ban,
+		RateLimitExempt: c.RateLimit.Exempt,
+
+		MP3Encoder: c.mp3Encoder(),
+		MP3Bitrate: c.MP3.Bitrate,
+		TSUDPAddr:  c.TSUDP,
+
+		DASHSegment: c.DASHSegment,
+
+		IdleTimeout: c.Idle.Timeout,
+		IdleCommand: c.Idle.Command,
+	}
+}
+
+// mp3Encoder returns the MP3 encoder, where "off" disables the stream
+func (c fileConfig) mp3Encoder() string {
+	if c.MP3.Encoder == "off" {
+		return ""
+	}
+	return c.MP3.Encoder
+}
+
+// resample returns the resampling quality, where "off" disables it
+func (c fileConfig) resample() string {
+	if c.Resample == "off" {
+		return ""
+	}
+	return c.Resample
+}
+
+// webhooks returns the webhooks as the server takes them
+func (c fileConfig) webhooks() []events.WebhookConfig {
+	hooks := make([]events.WebhookConfig, len(c.Webhooks))
+	for i, hook := range c.Webhooks {
+		hooks[i] = events.WebhookConfig(hook)
+	}
+	return hooks
+}
@@ -1,15 +1,102 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/maks112v/minicast/pkg/server"
+	"github.com/maks112v/minicast/pkg/sink"
 	"go.uber.org/zap"
 )
 
 func main() {
+	// The server re-executes itself to start sink commands with limits
+	sink.Init()
+
+	// "migrate" turns a legacy command line into a config file
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// "verify-archive" checks a DVR archive against its checksums
+	if len(os.Args) > 1 && os.Args[1] == "verify-archive" {
+		if err := verifyArchive(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// "install-service" and "uninstall-service" set the server up to
+	// start at boot
+	if len(os.Args) > 1 && (os.Args[1] == "install-service" || os.Args[1] == "uninstall-service") {
+		command := installServiceCommand
+		if os.Args[1] == "uninstall-service" {
+			command = uninstallServiceCommand
+		}
+		if err := command(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// "relay" runs the server with an external stream as its source, and
+	// "edge" with the broadcast of another minicast server
+	relayMode := len(os.Args) > 1 && os.Args[1] == "relay"
+	edgeMode := len(os.Args) > 1 && os.Args[1] == "edge"
+	args := os.Args[1:]
+	if relayMode || edgeMode {
+		args = os.Args[2:]
+	}
+
+	var cfg fileConfig
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	bindFlags(flags, &cfg)
+	configPath := flags.String("config", "", "YAML config file; flags given alongside it take precedence")
+	flags.Parse(args)
+
+	if *configPath != "" {
+		if err := loadConfigFile(*configPath, &cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// Parse again so the command line wins over the file
+		flags.Parse(args)
+	}
+
+	if err := cfg.applyPreset(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if relayMode && cfg.RelayURL == "" {
+		fmt.Fprintln(os.Stderr, "usage: server relay -url http://icecast.example/stream.mp3")
+		os.Exit(2)
+	}
+	if edgeMode && cfg.Origin == "" {
+		fmt.Fprintln(os.Stderr, "usage: server edge -origin wss://origin.example.com/ws")
+		os.Exit(2)
+	}
+
 	zap, _ := zap.NewProduction()
 	defer zap.Sync()
 	logger := zap.Sugar().With("module", "server")
 
-	srv := server.New(logger)
-	logger.Fatal(srv.Start(":8001"))
+	srv := server.New(logger, cfg.serverConfig())
+	start := func() error { return srv.Start(cfg.Listen) }
+	if service, err := runService(start, logger); service || err != nil {
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if err := start(); err != nil {
+		logger.Fatal(err)
+	}
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// migrate writes a config file equivalent to a legacy command line. Older
+// deployments were configured only by flags and relied on the working
+// directory: the server always listened on :8001 and served the directory
+// it was started in under /static/. Relative paths are resolved against
+// the current directory so the config keeps working from anywhere.
+func migrate(args []string) error {
+	header := "# Generated by `server migrate` from: server " + strings.Join(args, " ") + "\n"
+	if len(args) > 0 && args[0] == "relay" {
+		args = args[1:]
+	}
+
+	var cfg fileConfig
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	bindFlags(flags, &cfg)
+	out := flags.String("o", "", "write the config to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: server migrate [relay] [legacy flags...] [-o minicast.yaml]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	absPaths(&cfg, wd)
+	data, err := encodeConfig(header, &cfg)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s; start the server with -config %s\n", *out, *out)
+	return nil
+}
+
+// absPaths resolves the relative paths in cfg against dir
+func absPaths(cfg *fileConfig, dir string) {
+	for _, path := range []*string{&cfg.StaticDir, &cfg.Templates, &cfg.DVR.Dir, &cfg.RecordDir, &cfg.SessionsDB, &cfg.GeoIPDB, &cfg.MaintenanceAudio, &cfg.HoldAudio} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+}
+
+// encodeConfig returns cfg as a config file starting with header
+func encodeConfig(header string, cfg *fileConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(cfg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// serviceSpec describes the service install-service sets up
+type serviceSpec struct {
+	// Name names the service, its config and data directories
+	Name string
+	// Exe is the installed binary the service runs
+	Exe string
+	// Config is the config file the service starts with
+	Config string
+	// DataDir is the service's working directory, holding its static files
+	DataDir string
+	// User runs the service, where the platform supports it
+	User string
+}
+
+// servicePaths are where a platform keeps an installed service's files
+type servicePaths struct {
+	Bin     string
+	Config  string
+	DataDir string
+}
+
+// validServiceName matches names safe to use in file and unit names
+var validServiceName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// installServiceCommand installs the running binary as a system service
+// that starts at boot: systemd on Linux, launchd on macOS, or the service
+// manager on Windows. Server flags given alongside write the service's
+// config file when it does not exist yet, so one downloaded binary is all
+// an appliance needs.
+func installServiceCommand(args []string) error {
+	var cfg fileConfig
+	flags := flag.NewFlagSet("install-service", flag.ExitOnError)
+	bindFlags(flags, &cfg)
+	name := flags.String("name", "minicast", "service name")
+	configPath := flags.String("config", "", "config file the service runs with (default: a new one in the platform's config directory)")
+	user := flags.String("user", "", "run the service as this user instead of root (Linux and macOS)")
+	dryRun := flags.Bool("dry-run", false, "print what would be installed without changing anything")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: server install-service [-name minicast] [-config FILE] [-user USER] [-dry-run] [server flags...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if !validServiceName.MatchString(*name) {
+		return fmt.Errorf("invalid service name %q", *name)
+	}
+	if *user != "" && runtime.GOOS == "windows" {
+		return errors.New("-user is not supported on Windows; change the account in services.msc")
+	}
+	if err := requireRoot(*dryRun); err != nil {
+		return err
+	}
+
+	paths, err := defaultServicePaths(*name)
+	if err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	spec := serviceSpec{Name: *name, Exe: paths.Bin, Config: paths.Config, DataDir: paths.DataDir, User: *user}
+
+	// Flags other than install-service's own describe the config to write
+	var serverFlags []string
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name", "config", "user", "dry-run":
+		default:
+			serverFlags = append(serverFlags, "-"+f.Name)
+		}
+	})
+
+	if *configPath != "" {
+		if len(serverFlags) > 0 {
+			return fmt.Errorf("%s cannot be combined with -config; put the settings in the file", strings.Join(serverFlags, ", "))
+		}
+		if spec.Config, err = filepath.Abs(*configPath); err != nil {
+			return err
+		}
+		if _, err := os.Stat(spec.Config); err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(spec.Config); err == nil {
+		if len(serverFlags) > 0 {
+			fmt.Fprintf(os.Stderr, "Keeping the existing %s; %s not applied\n", spec.Config, strings.Join(serverFlags, ", "))
+		}
+	} else if errors.Is(err, os.ErrNotExist) {
+		// The working directory holds the service's files, so the static
+		// directory gets its own folder rather than serving all of them
+		if !flagSet(flags, "static") {
+			cfg.StaticDir = "static"
+		}
+		absPaths(&cfg, spec.DataDir)
+		if err := mkdirAll(*dryRun, cfg.StaticDir); err != nil {
+			return err
+		}
+		header := "# Generated by `server install-service`; restart the service after editing\n"
+		data, err := encodeConfig(header, &cfg)
+		if err != nil {
+			return err
+		}
+		if err := mkdirAll(*dryRun, filepath.Dir(spec.Config)); err != nil {
+			return err
+		}
+		if err := writeFile(*dryRun, spec.Config, data, 0o644); err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+
+	if err := mkdirAll(*dryRun, spec.DataDir); err != nil {
+		return err
+	}
+	if exe != spec.Exe {
+		if err := mkdirAll(*dryRun, filepath.Dir(spec.Exe)); err != nil {
+			return err
+		}
+		if err := copyBinary(*dryRun, exe, spec.Exe); err != nil {
+			return err
+		}
+	}
+	if err := installService(spec, *dryRun); err != nil {
+		return err
+	}
+	if !*dryRun {
+		fmt.Fprintf(os.Stderr, "Installed the %s service with %s\n", spec.Name, spec.Config)
+	}
+	return nil
+}
+
+// uninstallServiceCommand stops and removes the service, leaving its
+// config, data and binary in place
+func uninstallServiceCommand(args []string) error {
+	flags := flag.NewFlagSet("uninstall-service", flag.ExitOnError)
+	name := flags.String("name", "minicast", "service name")
+	dryRun := flags.Bool("dry-run", false, "print what would be removed without changing anything")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: server uninstall-service [-name minicast] [-dry-run]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if !validServiceName.MatchString(*name) {
+		return fmt.Errorf("invalid service name %q", *name)
+	}
+	if err := requireRoot(*dryRun); err != nil {
+		return err
+	}
+
+	paths, err := defaultServicePaths(*name)
+	if err != nil {
+		return err
+	}
+	if err := removeService(*name, *dryRun); err != nil {
+		return err
+	}
+	if !*dryRun {
+		fmt.Fprintf(os.Stderr, "Removed the %s service; %s and %s were kept\n", *name, paths.Config, paths.DataDir)
+	}
+	return nil
+}
+
+// flagSet reports whether the flag was given on the command line
+func flagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// runCommand runs a command, or prints it for a dry run
+func runCommand(dryRun bool, name string, args ...string) error {
+	if dryRun {
+		fmt.Println("+", name, strings.Join(args, " "))
+		return nil
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// writeFile writes a file, or prints it for a dry run
+func writeFile(dryRun bool, path string, data []byte, perm os.FileMode) error {
+	if dryRun {
+		fmt.Printf("+ write %s\n%s\n", path, data)
+		return nil
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+// mkdirAll creates a directory and its parents, or prints it for a dry run
+func mkdirAll(dryRun bool, dir string) error {
+	if dryRun {
+		fmt.Println("+ mkdir -p", dir)
+		return nil
+	}
+	return os.MkdirAll(dir, 0o755)
+}
+
+// copyBinary copies the binary at src to dst, replacing dst in one step so
+// a running copy keeps working until it restarts
+func copyBinary(dryRun bool, src, dst string) error {
+	if dryRun {
+		fmt.Println("+ cp", src, dst)
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".new"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// launchDaemonDir holds launchd jobs that run at boot
+const launchDaemonDir = "/Library/LaunchDaemons"
+
+// defaultServicePaths returns where the service's files go on macOS
+func defaultServicePaths(name string) (servicePaths, error) {
+	return servicePaths{
+		Bin:     filepath.Join("/usr/local/bin", name),
+		Config:  filepath.Join("/usr/local/etc", name, name+".yaml"),
+		DataDir: filepath.Join("/usr/local/var", name),
+	}, nil
+}
+
+// launchdLabel returns the launchd label of the service
+func launchdLabel(name string) string {
+	return "com.minicast." + name
+}
+
+// installService writes a launch daemon for the server and loads it
+func installService(spec serviceSpec, dryRun bool) error {
+	if err := chownToUser(dryRun, spec.User, spec.DataDir); err != nil {
+		return err
+	}
+
+	label := launchdLabel(spec.Name)
+	logPath := filepath.Join(spec.DataDir, spec.Name+".log")
+	var plist bytes.Buffer
+	plist.WriteString(xml.Header)
+	plist.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	plist.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	plistString(&plist, "Label", label)
+	plist.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range []string{spec.Exe, "-config", spec.Config} {
+		plist.WriteString("\t\t<string>")
+		xml.EscapeText(&plist, []byte(arg))
+		plist.WriteString("</string>\n")
+	}
+	plist.WriteString("\t</array>\n")
+	plistString(&plist, "WorkingDirectory", spec.DataDir)
+	if spec.User != "" {
+		plistString(&plist, "UserName", spec.User)
+	}
+	plistString(&plist, "StandardOutPath", logPath)
+	plistString(&plist, "StandardErrorPath", logPath)
+	plist.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	plist.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	plist.WriteString("</dict>\n</plist>\n")
+
+	path := filepath.Join(launchDaemonDir, label+".plist")
+	// Unload a previous install first, so the new binary and job are used
+	if _, err := os.Stat(path); err == nil {
+		runCommand(dryRun, "launchctl", "unload", path)
+	}
+	if err := writeFile(dryRun, path, plist.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return runCommand(dryRun, "launchctl", "load", "-w", path)
+}
+
+// plistString writes a key with a string value
+func plistString(b *bytes.Buffer, key, value string) {
+	fmt.Fprintf(b, "\t<key>%s</key>\n\t<string>", key)
+	xml.EscapeText(b, []byte(value))
+	b.WriteString("</string>\n")
+}
+
+// removeService unloads the launch daemon and removes it
+func removeService(name string, dryRun bool) error {
+	path := filepath.Join(launchDaemonDir, launchdLabel(name)+".plist")
+	if err := runCommand(dryRun, "launchctl", "unload", "-w", path); err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Println("+ rm", path)
+		return nil
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// unitDir holds systemd units installed by the administrator
+const unitDir = "/etc/systemd/system"
+
+// defaultServicePaths returns where the service's files go on Linux
+func defaultServicePaths(name string) (servicePaths, error) {
+	return servicePaths{
+		Bin:     filepath.Join("/usr/local/bin", name),
+		Config:  filepath.Join("/etc", name, name+".yaml"),
+		DataDir: filepath.Join("/var/lib", name),
+	}, nil
+}
+
+// installService writes a systemd unit for the server and starts it
+func installService(spec serviceSpec, dryRun bool) error {
+	if err := chownToUser(dryRun, spec.User, spec.DataDir); err != nil {
+		return err
+	}
+
+	var unit bytes.Buffer
+	fmt.Fprintf(&unit, "[Unit]\n")
+	fmt.Fprintf(&unit, "Description=MiniCast audio streaming server\n")
+	fmt.Fprintf(&unit, "Wants=network-online.target\n")
+	fmt.Fprintf(&unit, "After=network-online.target\n\n")
+	fmt.Fprintf(&unit, "[Service]\n")
+	fmt.Fprintf(&unit, "ExecStart=%q -config %q\n", spec.Exe, spec.Config)
+	fmt.Fprintf(&unit, "WorkingDirectory=%s\n", spec.DataDir)
+	if spec.User != "" {
+		fmt.Fprintf(&unit, "User=%s\n", spec.User)
+	}
+	fmt.Fprintf(&unit, "Restart=on-failure\n")
+	fmt.Fprintf(&unit, "RestartSec=2\n\n")
+	fmt.Fprintf(&unit, "[Install]\n")
+	fmt.Fprintf(&unit, "WantedBy=multi-user.target\n")
+
+	path := filepath.Join(unitDir, spec.Name+".service")
+	if err := writeFile(dryRun, path, unit.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if err := runCommand(dryRun, "systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	if err := runCommand(dryRun, "systemctl", "enable", spec.Name); err != nil {
+		return err
+	}
+	// Restart rather than start, so reinstalling picks up the new binary
+	return runCommand(dryRun, "systemctl", "restart", spec.Name)
+}
+
+// removeService stops the service and removes its unit
+func removeService(name string, dryRun bool) error {
+	if err := runCommand(dryRun, "systemctl", "disable", "--now", name); err != nil {
+		return err
+	}
+	path := filepath.Join(unitDir, name+".service")
+	if dryRun {
+		fmt.Println("+ rm", path)
+	} else if err := os.Remove(path); err != nil {
+		return err
+	}
+	return runCommand(dryRun, "systemctl", "daemon-reload")
+}
@@ -0,0 +1,38 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+// errNoServices means the platform has no supported service manager
+var errNoServices = errors.New("install-service supports Linux (systemd), macOS (launchd) and Windows")
+
+// requireRoot fails: services are not supported here
+func requireRoot(dryRun bool) error {
+	return errNoServices
+}
+
+// defaultServicePaths fails: services are not supported here
+func defaultServicePaths(name string) (servicePaths, error) {
+	return servicePaths{}, errNoServices
+}
+
+// installService fails: services are not supported here
+func installService(spec serviceSpec, dryRun bool) error {
+	return errNoServices
+}
+
+// removeService fails: services are not supported here
+func removeService(name string, dryRun bool) error {
+	return errNoServices
+}
+
+// runService reports that the server is never run by a service manager
+// here
+func runService(start func() error, logger *zap.SugaredLogger) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,47 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// requireRoot fails unless running as root, which installing a system
+// service needs
+func requireRoot(dryRun bool) error {
+	if !dryRun && os.Geteuid() != 0 {
+		return errors.New("managing services needs root; run it with sudo")
+	}
+	return nil
+}
+
+// chownToUser gives the service's user its data directory, so it can write
+// archives there
+func chownToUser(dryRun bool, name, dir string) error {
+	if name == "" {
+		return nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Println("+ chown", name, dir)
+		return nil
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	return os.Chown(dir, uid, gid)
+}
+
+// runService reports that the server was not started by a service manager
+// needing a handshake; systemd and launchd run it like any command
+func runService(start func() error, logger *zap.SugaredLogger) (bool, error) {
+	return false, nil
+}
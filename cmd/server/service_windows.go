@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// defaultServicePaths returns where the service's files go on Windows
+func defaultServicePaths(name string) (servicePaths, error) {
+	programFiles, programData := os.Getenv("ProgramFiles"), os.Getenv("ProgramData")
+	if programFiles == "" || programData == "" {
+		return servicePaths{}, errors.New("ProgramFiles or ProgramData is not set")
+	}
+	return servicePaths{
+		Bin:     filepath.Join(programFiles, name, name+".exe"),
+		Config:  filepath.Join(programData, name, name+".yaml"),
+		DataDir: filepath.Join(programData, name),
+	}, nil
+}
+
+// requireRoot fails unless running elevated, which installing a service
+// needs
+func requireRoot(dryRun bool) error {
+	if !dryRun && !windows.GetCurrentProcessToken().IsElevated() {
+		return errors.New("managing services needs an administrator prompt")
+	}
+	return nil
+}
+
+// connectManager connects to the service manager, explaining the usual
+// reason it fails
+func connectManager() (*mgr.Mgr, error) {
+	m, err := mgr.Connect()
+	if errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+		return nil, errors.New("managing services needs an administrator prompt")
+	}
+	return m, err
+}
+
+// installService registers the server with the service manager to start
+// at boot, and starts it
+func installService(spec serviceSpec, dryRun bool) error {
+	if dryRun {
+		fmt.Printf("+ create service %s: %q -config %q, starting automatically\n", spec.Name, spec.Exe, spec.Config)
+		return nil
+	}
+	m, err := connectManager()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(spec.Name); err == nil {
+		s.Close()
+		return fmt.Errorf("the %s service already exists; run uninstall-service first", spec.Name)
+	}
+
+	s, err := m.CreateService(spec.Name, spec.Exe, mgr.Config{
+		DisplayName: "MiniCast",
+		Description: "MiniCast audio streaming server",
+		StartType:   mgr.StartAutomatic,
+	}, "-config", spec.Config)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+// removeService stops the service and unregisters it
+func removeService(name string, dryRun bool) error {
+	if dryRun {
+		fmt.Printf("+ stop and delete service %s\n", name)
+		return nil
+	}
+	m, err := connectManager()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("the %s service is not installed", name)
+	}
+	defer s.Close()
+	// Stopping fails if it already stopped, which is fine
+	s.Control(svc.Stop)
+	return s.Delete()
+}
+
+// runService runs start under the service manager when it started the
+// server, reporting whether it did. Windows services must answer the
+// manager, or it kills them for not starting.
+func runService(start func() error, logger *zap.SugaredLogger) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, err
+	}
+	return true, svc.Run("", &serviceHandler{start: start, logger: logger})
+}
+
+// serviceHandler answers the service manager while the server runs
+type serviceHandler struct {
+	start  func() error
+	logger *zap.SugaredLogger
+}
+
+// Execute starts the server and waits for it to fail or be stopped
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	failed := make(chan error, 1)
+	go func() { failed <- h.start() }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-failed:
+			if err == nil {
+				// Shut down after going idle
+				return false, 0
+			}
+			h.logger.Errorw("Server failed", "error", err)
+			return false, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				return false, 0
+			}
+		}
+	}
+}
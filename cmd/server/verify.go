@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/maks112v/minicast/pkg/dvr"
+)
+
+// verifyArchive checks a DVR archive against its checksum manifest,
+// printing one line per file. It fails if any file changed or is missing.
+func verifyArchive(args []string) error {
+	flags := flag.NewFlagSet("verify-archive", flag.ExitOnError)
+	quiet := flags.Bool("quiet", false, "only print files that fail")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: server verify-archive [-quiet] DIR")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	checks, err := dvr.Verify(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, check := range checks {
+		bad := check.Status == dvr.CheckFailed || check.Status == dvr.CheckMissing
+		if bad {
+			failed++
+		}
+		if bad || !*quiet {
+			fmt.Printf("%s: %s\n", check.Name, check.Status)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, len(checks))
+	}
+	return nil
+}
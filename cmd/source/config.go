@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configName is the config file looked for when -config is not given
+const configName = "source.yaml"
+
+// defaultConfigPath returns the config file to load without -config:
+// source.yaml in the working directory, or else in the user's config
+// directory (such as ~/.config/minicast), or "" when neither exists
+func defaultConfigPath() string {
+	candidates := []string{configName}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "minicast", configName))
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// loadConfig sets the flags from a YAML file of settings named like them
+// (with - or _), such as addr, device, codec or rate. Lists set repeatable
+// flags once per item. Flags given on the command line take precedence.
+func loadConfig(flags *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var settings map[string]any
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for key, value := range settings {
+		name := strings.ReplaceAll(key, "_", "-")
+		if flags.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+		if given[name] {
+			continue
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			if v == nil {
+				return fmt.Errorf("%s: %s has no value", path, key)
+			}
+			if _, nested := v.(map[string]any); nested {
+				return fmt.Errorf("%s: %s must be a value or a list of values", path, key)
+			}
+			if err := flags.Set(name, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: invalid %s: %v", path, key, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gordonklaus/portaudio"
+	"go.uber.org/zap"
+)
+
+// deviceInput captures from an input device
+type deviceInput struct {
+	name   string
+	stream *portaudio.Stream
+	buf    []float32
+	// gain scales the captured samples, 1 leaving them as they are
+	gain float32
+	// mono is set when a mono device is captured into several channels
+	mono bool
+}
+
+// openDevice starts capturing channels from the input devices given to
+// -device, mixed when there are several, or with loopback what the
+// computer plays, reading frames at a time. It returns the input with the
+// rate it captures at: the (first) device's native rate when it supports
+// that, or the supported rate closest to targetRate.
+func openDevice(devices deviceList, loopback bool, channels, frames, targetRate int, logger *zap.SugaredLogger) (input, int, error) {
+	if loopback {
+		// Audio servers pick the capture source when PortAudio starts
+		if err := prepareLoopback(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := portaudio.Initialize(); err != nil {
+		return nil, 0, fmt.Errorf("failed to initialize PortAudio: %v", err)
+	}
+
+	var in input
+	var rate int
+	var err error
+	if len(devices) > 1 {
+		in, rate, err = startMix(devices, channels, frames, targetRate, logger)
+	} else {
+		spec := deviceSpec{}
+		if len(devices) == 1 {
+			spec = devices[0]
+		}
+		in, rate, err = startDevice(spec, loopback, channels, frames, targetRate, 0, logger)
+	}
+	if err != nil {
+		portaudio.Terminate()
+	}
+	return in, rate, err
+}
+
+// startDevice opens and starts the capture stream of openDevice. A mono
+// device has its channel copied to all of them. A non-zero rate must be
+// captured at exactly, as the devices of a mix are.
+func startDevice(spec deviceSpec, loopback bool, channels, frames, targetRate int, rate float64, logger *zap.SugaredLogger) (*deviceInput, int, error) {
+	var device *portaudio.DeviceInfo
+	var err error
+	if loopback {
+		device, err = findLoopbackDevice()
+	} else {
+		device, err = findInputDevice(spec.name)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	in := &deviceInput{name: device.Name, gain: float32(math.Pow(10, spec.gainDB/20))}
+	captured := channels
+	if device.MaxInputChannels < channels {
+		if device.MaxInputChannels != 1 {
+			return nil, 0, fmt.Errorf("input device %q has %d channels, fewer than -channels %d", device.Name, device.MaxInputChannels, channels)
+		}
+		captured, in.mono = 1, true
+	}
+	params := portaudio.HighLatencyParameters(device, nil)
+	params.Input.Channels = captured
+	params.FramesPerBuffer = frames
+
+	if rate == 0 {
+		var reason string
+		if rate, reason, err = selectSampleRate(params, float64(targetRate)); err != nil {
+			return nil, 0, err
+		}
+		logger.Infow("Selected sample rate", "device", device.Name, "rate", rate, "target", targetRate, "reason", reason)
+	} else {
+		params.SampleRate = rate
+		if err := portaudio.IsFormatSupported(params, make([]float32, captured)); err != nil {
+			return nil, 0, fmt.Errorf("input device %q cannot capture at %.0fHz like the first device: %v", device.Name, rate, err)
+		}
+	}
+	params.SampleRate = rate
+
+	in.buf = make([]float32, frames*captured)
+	if in.stream, err = portaudio.OpenStream(params, in.buf); err != nil {
+		return nil, 0, fmt.Errorf("failed to open input stream: %v", err)
+	}
+	if err := in.stream.Start(); err != nil {
+		in.stream.Close()
+		return nil, 0, fmt.Errorf("failed to start input stream: %v", err)
+	}
+	return in, int(rate), nil
+}
+
+// Read waits for the next buffer of captured samples
+func (in *deviceInput) Read(buf []float32) error {
+	if err := in.stream.Read(); err != nil {
+		return err
+	}
+	switch {
+	case in.mono:
+		channels := len(buf) / len(in.buf)
+		for i, v := range in.buf {
+			for c := range channels {
+				buf[i*channels+c] = v * in.gain
+			}
+		}
+	case in.gain != 1:
+		for i, v := range in.buf {
+			buf[i] = v * in.gain
+		}
+	default:
+		copy(buf, in.buf)
+	}
+	return nil
+}
+
+// Close stops capturing and releases PortAudio
+func (in *deviceInput) Close() error {
+	err := in.stream.Close()
+	portaudio.Terminate()
+	return err
+}
+
+// standardRates are the sample rates probed on the capture device
+var standardRates = []float64{8000, 11025, 16000, 22050, 32000, 44100, 48000, 88200, 96000}
+
+// selectSampleRate picks the capture rate for the input device in params.
+// The device's native rate wins when it is supported, since anything else
+// makes the OS resample; otherwise the supported rate closest to target is
+// used. It returns the rate and a short reason for logging.
+func selectSampleRate(params portaudio.StreamParameters, target float64) (float64, string, error) {
+	native := params.Input.Device.DefaultSampleRate
+	probe := make([]float32, params.Input.Channels)
+
+	supported := func(rate float64) bool {
+		p := params
+		p.SampleRate = rate
+		return portaudio.IsFormatSupported(p, probe) == nil
+	}
+
+	if native == target && supported(target) {
+		return target, "target is the device's native rate", nil
+	}
+	if native > 0 && supported(native) {
+		return native, fmt.Sprintf("device's native rate, avoiding OS resampling to %.0fHz", target), nil
+	}
+
+	best := 0.0
+	for _, rate := range standardRates {
+		if supported(rate) && (best == 0 || math.Abs(rate-target) < math.Abs(best-target)) {
+			best = rate
+		}
+	}
+	if best == 0 {
+		return 0, "", fmt.Errorf("device %q supports none of the standard sample rates", params.Input.Device.Name)
+	}
+	return best, "closest supported rate to the target", nil
+}
+
+// inputDevices returns the devices that can capture, with their index in
+// PortAudio's device list, which is what -device takes
+func inputDevices() ([]*portaudio.DeviceInfo, []int, error) {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, nil, err
+	}
+	var inputs []*portaudio.DeviceInfo
+	var indexes []int
+	for i, d := range devices {
+		if d.MaxInputChannels > 0 {
+			inputs = append(inputs, d)
+			indexes = append(indexes, i)
+		}
+	}
+	return inputs, indexes, nil
+}
+
+// listDevices prints the input devices to w, marking the default one
+func listDevices(w io.Writer) error {
+	if err := portaudio.Initialize(); err != nil {
+		return err
+	}
+	defer portaudio.Terminate()
+
+	inputs, indexes, err := inputDevices()
+	if err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		fmt.Fprintln(w, "No input devices found")
+		return nil
+	}
+	def, _ := portaudio.DefaultInputDevice()
+	for i, d := range inputs {
+		mark := ""
+		if d == def {
+			mark = " (default)"
+		}
+		fmt.Fprintf(w, "%3d  %s [%s, %d ch, %.0fHz]%s\n", indexes[i], d.Name, d.HostApi.Name,
+			d.MaxInputChannels, d.DefaultSampleRate, mark)
+	}
+	return nil
+}
+
+// findInputDevice returns an input device given to -device: an index from
+// -list-devices, or a name, matched exactly or by a part of it that only
+// one device has. An empty name is the default input device.
+func findInputDevice(name string) (*portaudio.DeviceInfo, error) {
+	if name == "" {
+		return portaudio.DefaultInputDevice()
+	}
+	inputs, indexes, err := inputDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := strconv.Atoi(name); err == nil {
+		for i, d := range inputs {
+			if indexes[i] == n {
+				return d, nil
+			}
+		}
+		return nil, fmt.Errorf("no input device with index %d (see -list-devices)", n)
+	}
+
+	var matches []*portaudio.DeviceInfo
+	for _, d := range inputs {
+		if strings.EqualFold(d.Name, name) {
+			return d, nil
+		}
+		if strings.Contains(strings.ToLower(d.Name), strings.ToLower(name)) {
+			matches = append(matches, d)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no input device matches %q (see -list-devices)", name)
+	case 1:
+		return matches[0], nil
+	}
+	names := make([]string, len(matches))
+	for i, d := range matches {
+		names[i] = fmt.Sprintf("%q", d.Name)
+	}
+	return nil, fmt.Errorf("%q matches several input devices: %s", name, strings.Join(names, ", "))
+}
+
+// firstInputMatching returns the first input device whose name contains one
+// of names, trying them in order, or nil if none does
+func firstInputMatching(names ...string) (*portaudio.DeviceInfo, error) {
+	inputs, _, err := inputDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		for _, d := range inputs {
+			if strings.Contains(strings.ToLower(d.Name), strings.ToLower(name)) {
+				return d, nil
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/mdns"
+	"go.uber.org/zap"
+)
+
+// discoverWait is how long the LAN is searched for servers
+const discoverWait = 2 * time.Second
+
+// discoverServer finds a server advertised on the LAN and returns its
+// address: the first by name, if there are several
+func discoverServer(logger *zap.SugaredLogger) (string, error) {
+	found, err := mdns.Browse(context.Background(), mdns.ServiceType, discoverWait)
+	if err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", errors.New("no server found on the LAN; servers are advertised when started with -mdns")
+	}
+	for _, other := range found[1:] {
+		logger.Infof("Also found %q at %s; use -addr to publish to it", other.Name, other.Addr())
+	}
+	logger.Infow("Found server", "name", found[0].Name, "addr", found[0].Addr())
+	return found[0].Addr(), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync/atomic"
+
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+// gainMessage is the text frame in which a server sets the gain, and the
+// client reports the gain it applies
+type gainMessage struct {
+	Type   string  `json:"type"`
+	GainDB float64 `json:"gain_db"`
+}
+
+// gainControl is the gain applied to captured audio, set with -gain and,
+// unless remote changes are refused, by a server
+type gainControl struct {
+	db     atomic.Uint64
+	remote bool
+	logger *zap.SugaredLogger
+
+	// applied is the factor the last buffer ended at, ramped from when
+	// the gain changes so it does not click
+	applied float32
+}
+
+// newGainControl starts at db
+func newGainControl(db float64, remote bool, logger *zap.SugaredLogger) *gainControl {
+	g := &gainControl{remote: remote, logger: logger}
+	g.db.Store(math.Float64bits(db))
+	g.applied = g.factor()
+	return g
+}
+
+// get returns the gain in dB
+func (g *gainControl) get() float64 {
+	return math.Float64frombits(g.db.Load())
+}
+
+// factor returns the gain as a factor
+func (g *gainControl) factor() float32 {
+	return float32(math.Pow(10, g.get()/20))
+}
+
+// apply scales a buffer of interleaved samples by the gain
+func (g *gainControl) apply(buf []float32, channels int) {
+	target := g.factor()
+	if target == 1 && g.applied == 1 {
+		return
+	}
+	frames := len(buf) / channels
+	for i := range frames {
+		gain := target
+		if g.applied != target {
+			gain = g.applied + (target-g.applied)*float32(i+1)/float32(frames)
+		}
+		for c := range channels {
+			buf[i*channels+c] *= gain
+		}
+	}
+	g.applied = target
+}
+
+// handleMessage applies a gain change sent by a server, reporting whether
+// data was one
+func (g *gainControl) handleMessage(data []byte, addr string) bool {
+	var msg gainMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "gain" {
+		return false
+	}
+	if !g.remote {
+		g.logger.Warnw("Ignored a gain change from the server", "server", addr, "gain_db", msg.GainDB)
+		return true
+	}
+	if math.IsNaN(msg.GainDB) || math.Abs(msg.GainDB) > ws.MaxSourceGain {
+		g.logger.Warnw("Ignored an out of range gain from the server", "server", addr, "gain_db", msg.GainDB)
+		return true
+	}
+	g.db.Store(math.Float64bits(msg.GainDB))
+	g.logger.Infow("Server changed the gain", "server", addr, "gain_db", msg.GainDB)
+	return true
+}
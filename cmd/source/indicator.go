@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// indicator is a light showing the broadcaster they are on air
+type indicator interface {
+	Set(on bool) error
+	Close() error
+}
+
+// errNoBusylight is returned when no supported USB busylight is plugged in
+var errNoBusylight = errors.New("no supported USB busylight found")
+
+// onAir lights its indicators while the client is actually streaming: at
+// least one server connected, the microphone not muted, and in
+// push-to-talk or VOX mode, the broadcaster talking
+type onAir struct {
+	mu         sync.Mutex
+	indicators []indicator
+	connected  bool
+	muted      bool
+	standby    bool
+	lit        bool
+	logger     *zap.SugaredLogger
+}
+
+// newOnAir opens the indicators asked for: a GPIO pin, if gpio is not
+// negative, and a USB busylight, if usb is set. It returns nil when none
+// are.
+func newOnAir(gpio int, usb bool, logger *zap.SugaredLogger) (*onAir, error) {
+	a := &onAir{logger: logger}
+	if gpio >= 0 {
+		pin, err := openGPIO(gpio)
+		if err != nil {
+			return nil, err
+		}
+		a.indicators = append(a.indicators, pin)
+	}
+	if usb {
+		light, err := openBusylight()
+		if err != nil {
+			a.close()
+			return nil, err
+		}
+		a.indicators = append(a.indicators, light)
+	}
+	if len(a.indicators) == 0 {
+		return nil, nil
+	}
+	a.update()
+	return a, nil
+}
+
+// setConnected records whether any server is connected
+func (a *onAir) setConnected(connected bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.connected = connected
+	a.update()
+}
+
+// setMuted records whether the microphone is muted
+func (a *onAir) setMuted(muted bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.muted = muted
+	a.update()
+}
+
+// setStandby records whether push-to-talk or VOX is holding the audio back
+func (a *onAir) setStandby(standby bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.standby = standby
+	a.update()
+}
+
+// update switches the indicators to match the state, with a.mu held
+func (a *onAir) update() {
+	lit := a.connected && !a.muted && !a.standby
+	if lit == a.lit {
+		return
+	}
+	a.lit = lit
+	for _, ind := range a.indicators {
+		if err := ind.Set(lit); err != nil {
+			a.logger.Warnf("Failed to switch the on-air indicator: %v", err)
+		}
+	}
+}
+
+// close switches the indicators off and releases them
+func (a *onAir) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, ind := range a.indicators {
+		ind.Set(false)
+		ind.Close()
+	}
+	a.indicators = nil
+}
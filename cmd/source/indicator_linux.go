@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// gpioChipLabels name the Raspberry Pi's main GPIO controllers, whose lines
+// are numbered as on the header's BCM pinout
+var gpioChipLabels = []string{"pinctrl-bcm2835", "pinctrl-bcm2711", "pinctrl-rp1"}
+
+// gpioPin is an output pin driven through the sysfs GPIO interface
+type gpioPin struct {
+	number int
+	value  *os.File
+}
+
+// openGPIO exports BCM line as an output, starting low
+func openGPIO(line int) (*gpioPin, error) {
+	number := gpioBase() + line
+	dir := fmt.Sprintf("/sys/class/gpio/gpio%d", number)
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if err := os.WriteFile("/sys/class/gpio/export", []byte(strconv.Itoa(number)), 0); err != nil {
+			return nil, fmt.Errorf("failed to export GPIO %d: %v", line, err)
+		}
+	}
+
+	// udev may take a moment to make a newly exported pin writable
+	var err error
+	for range 20 {
+		if err = os.WriteFile(dir+"/direction", []byte("low"), 0); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to make GPIO %d an output: %v", line, err)
+	}
+	value, err := os.OpenFile(dir+"/value", os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GPIO %d: %v", line, err)
+	}
+	return &gpioPin{number: number, value: value}, nil
+}
+
+// gpioBase returns the sysfs number of the Pi's first GPIO line, which is
+// not 0 on newer kernels, or 0 when no Pi controller is found
+func gpioBase() int {
+	chips, _ := filepath.Glob("/sys/class/gpio/gpiochip*")
+	for _, chip := range chips {
+		label, err := os.ReadFile(filepath.Join(chip, "label"))
+		if err != nil {
+			continue
+		}
+		for _, want := range gpioChipLabels {
+			if strings.TrimSpace(string(label)) != want {
+				continue
+			}
+			if base, err := os.ReadFile(filepath.Join(chip, "base")); err == nil {
+				if n, err := strconv.Atoi(strings.TrimSpace(string(base))); err == nil {
+					return n
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// Set drives the pin high or low
+func (p *gpioPin) Set(on bool) error {
+	value := "0"
+	if on {
+		value = "1"
+	}
+	_, err := p.value.WriteAt([]byte(value), 0)
+	return err
+}
+
+// Close releases the pin
+func (p *gpioPin) Close() error {
+	p.value.Close()
+	return os.WriteFile("/sys/class/gpio/unexport", []byte(strconv.Itoa(p.number)), 0)
+}
+
+// Supported busylights, by USB vendor and product ID
+const (
+	luxaforVendor  = 0x04d8
+	luxaforProduct = 0xf372
+	blink1Vendor   = 0x27b8
+	blink1Product  = 0x01ed
+)
+
+// busylight is a USB light driven through its hidraw device
+type busylight struct {
+	dev *os.File
+	// set switches the light to red, or off
+	set func(dev *os.File, on bool) error
+}
+
+// openBusylight opens the first supported busylight found
+func openBusylight() (*busylight, error) {
+	devices, _ := filepath.Glob("/sys/class/hidraw/hidraw*")
+	for _, device := range devices {
+		vendor, product, ok := hidID(filepath.Join(device, "device", "uevent"))
+		if !ok {
+			continue
+		}
+		var set func(*os.File, bool) error
+		switch {
+		case vendor == luxaforVendor && product == luxaforProduct:
+			set = setLuxafor
+		case vendor == blink1Vendor && product == blink1Product:
+			set = setBlink1
+		default:
+			continue
+		}
+		path := "/dev/" + filepath.Base(device)
+		dev, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open busylight %s: %v", path, err)
+		}
+		return &busylight{dev: dev, set: set}, nil
+	}
+	return nil, errNoBusylight
+}
+
+// hidID reads a HID device's vendor and product ID from its uevent file,
+// which has a line like HID_ID=0003:000004D8:0000F372
+func hidID(path string) (vendor, product uint32, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id, found := strings.CutPrefix(scanner.Text(), "HID_ID=")
+		if !found {
+			continue
+		}
+		parts := strings.Split(id, ":")
+		if len(parts) != 3 {
+			return 0, 0, false
+		}
+		v, err1 := strconv.ParseUint(parts[1], 16, 32)
+		p, err2 := strconv.ParseUint(parts[2], 16, 32)
+		return uint32(v), uint32(p), err1 == nil && err2 == nil
+	}
+	return 0, 0, false
+}
+
+// setLuxafor sets every LED of a Luxafor Flag to a static color
+func setLuxafor(dev *os.File, on bool) error {
+	report := []byte{0x01, 0xff, 0, 0, 0, 0, 0, 0}
+	if on {
+		report[2] = 0xff
+	}
+	_, err := dev.Write(report)
+	return err
+}
+
+// setBlink1 fades a blink(1) to a color at once, sent as a feature report
+func setBlink1(dev *os.File, on bool) error {
+	report := []byte{0x01, 'n', 0, 0, 0, 0, 0, 0, 0}
+	if on {
+		report[2] = 0xff
+	}
+	// HIDIOCSFEATURE(len): _IOC(_IOC_READ|_IOC_WRITE, 'H', 0x06, len)
+	req := uintptr(3)<<30 | uintptr(len(report))<<16 | 'H'<<8 | 0x06
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dev.Fd(), req, uintptr(unsafe.Pointer(&report[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Set switches the light on or off
+func (b *busylight) Set(on bool) error {
+	return b.set(b.dev, on)
+}
+
+// Close releases the light
+func (b *busylight) Close() error {
+	return b.dev.Close()
+}
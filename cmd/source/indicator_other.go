@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// openGPIO is unsupported off Linux
+func openGPIO(line int) (indicator, error) {
+	return nil, errors.New("GPIO indicators are only supported on Linux")
+}
+
+// openBusylight is unsupported off Linux
+func openBusylight() (indicator, error) {
+	return nil, errors.New("USB busylights are only supported on Linux")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// input is where the source client's audio comes from
+type input interface {
+	// Read fills buf with the next interleaved samples, returning once
+	// they have been captured, or are due when played from a file.
+	// io.EOF means the input has ended.
+	Read(buf []float32) error
+	Close() error
+}
+
+// track is an open track's 16-bit PCM, in the input's format
+type track struct {
+	io.Reader
+	io.Closer
+	// metadata describes the track, if known
+	metadata *ws.Metadata
+}
+
+// fileInput plays audio files one after another, or raw PCM piped to
+// standard input, in real time, as if it were being captured
+type fileInput struct {
+	rate     int
+	channels int
+	// next opens the next track, returning io.EOF after the last
+	next     func() (*track, error)
+	track    *track
+	pcm      []byte
+	start    time.Time
+	frames   int64
+	finished bool
+
+	// onTrack is told the metadata of each track as it starts, if set
+	onTrack func(ws.Metadata)
+}
+
+// openStdin reads raw interleaved 16-bit little-endian PCM from standard
+// input, at the rate and channel count the producer sends
+func openStdin(rate, channels int) *fileInput {
+	opened := false
+	return &fileInput{rate: rate, channels: channels, next: func() (*track, error) {
+		if opened {
+			return nil, io.EOF
+		}
+		opened = true
+		return &track{Reader: os.Stdin, Closer: os.Stdin}, nil
+	}}
+}
+
+// Read fills buf from the current track, moving on to the next without a
+// gap when it ends, and waits until the samples would have been captured,
+// counting from the first read. The end of the last track is padded with
+// silence to fill the buffer.
+func (in *fileInput) Read(buf []float32) error {
+	if in.finished {
+		return io.EOF
+	}
+	if in.start.IsZero() {
+		in.start = time.Now()
+	}
+
+	if cap(in.pcm) < len(buf)*2 {
+		in.pcm = make([]byte, len(buf)*2)
+	}
+	pcm := in.pcm[:len(buf)*2]
+	frameSize := 2 * in.channels
+	n := 0
+	for n < len(pcm) {
+		if in.track == nil {
+			t, err := in.next()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return err
+			}
+			in.track = t
+			if t.metadata != nil && in.onTrack != nil {
+				in.onTrack(*t.metadata)
+			}
+		}
+		read, err := io.ReadFull(in.track, pcm[n:])
+		n += read
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// A partial sample at the end would shift the next track's
+			// channels
+			n -= n % frameSize
+			in.track.Close()
+			in.track = nil
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	if n == 0 {
+		in.finished = true
+		return io.EOF
+	}
+	if n < len(pcm) {
+		clear(pcm[n:])
+		in.finished = true
+	}
+	for i, sample := range audio.BytesToPCM(pcm) {
+		buf[i] = float32(sample) / 32768
+	}
+
+	in.frames += int64(len(buf) / in.channels)
+	due := in.start.Add(time.Duration(in.frames) * time.Second / time.Duration(in.rate))
+	time.Sleep(time.Until(due))
+	return nil
+}
+
+// Close closes the current track
+func (in *fileInput) Close() error {
+	if in.track == nil {
+		return nil
+	}
+	return in.track.Close()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// prepareLoopback does nothing; macOS needs a virtual device to loop back
+func prepareLoopback() error {
+	return nil
+}
+
+// findLoopbackDevice returns a virtual loopback device. macOS cannot
+// capture its own output, so one has to be installed and played to.
+func findLoopbackDevice() (*portaudio.DeviceInfo, error) {
+	device, err := firstInputMatching("BlackHole", "Soundflower", "Loopback Audio")
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, errors.New("no loopback device found; install BlackHole (https://existential.audio/blackhole/) " +
+			"and, in Audio MIDI Setup, create a Multi-Output Device with your speakers and BlackHole and play to it")
+	}
+	return device, nil
+}
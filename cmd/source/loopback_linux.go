@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// prepareLoopback points PulseAudio (or PipeWire's PulseAudio server) at
+// the monitor of the default output, which carries whatever it plays, so
+// its capture device records that instead of the microphone
+func prepareLoopback() error {
+	sink, err := defaultSink()
+	if err != nil {
+		return fmt.Errorf("failed to find the default output with pactl (is PulseAudio or PipeWire running?): %v", err)
+	}
+	return os.Setenv("PULSE_SOURCE", sink+".monitor")
+}
+
+// defaultSink returns the name of PulseAudio's default output
+func defaultSink() (string, error) {
+	if out, err := exec.Command("pactl", "get-default-sink").Output(); err == nil {
+		if sink := strings.TrimSpace(string(out)); sink != "" {
+			return sink, nil
+		}
+	}
+	// Servers before PulseAudio 15 only report it in pactl info
+	out, err := exec.Command("pactl", "info").Output()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if sink, ok := strings.CutPrefix(line, "Default Sink: "); ok {
+			return strings.TrimSpace(sink), nil
+		}
+	}
+	return "", errors.New("no default sink")
+}
+
+// findLoopbackDevice returns the PulseAudio capture device, which records
+// the monitor prepareLoopback chose
+func findLoopbackDevice() (*portaudio.DeviceInfo, error) {
+	device, err := firstInputMatching("pulse", "pipewire", "default")
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, errors.New("no PulseAudio or PipeWire input device found; loopback capture needs PortAudio built with ALSA and the PulseAudio ALSA plugin")
+	}
+	return device, nil
+}
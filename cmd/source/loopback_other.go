@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// prepareLoopback is unsupported on this platform
+func prepareLoopback() error {
+	return errors.New("loopback capture is not supported on this platform; pick a monitor input with -device")
+}
+
+// findLoopbackDevice is unsupported on this platform
+func findLoopbackDevice() (*portaudio.DeviceInfo, error) {
+	return nil, errors.New("loopback capture is not supported on this platform")
+}
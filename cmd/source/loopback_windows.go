@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// prepareLoopback does nothing; loopback devices are listed as inputs
+func prepareLoopback() error {
+	return nil
+}
+
+// findLoopbackDevice returns the WASAPI loopback input of the default
+// output, which PortAudio lists as "<output> [Loopback]", or another
+// loopback input such as Stereo Mix
+func findLoopbackDevice() (*portaudio.DeviceInfo, error) {
+	if out, err := portaudio.DefaultOutputDevice(); err == nil {
+		if device, err := firstInputMatching(out.Name + " [Loopback]"); device != nil || err != nil {
+			return device, err
+		}
+	}
+	device, err := firstInputMatching("[Loopback]", "Stereo Mix", "What U Hear", "Wave Out Mix")
+	if err != nil {
+		return nil, err
+	}
+	if device == nil {
+		return nil, errors.New("no loopback input found; use a PortAudio build with WASAPI loopback support, or enable Stereo Mix in the Recording tab of the Sound control panel")
+	}
+	return device, nil
+}
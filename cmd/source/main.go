@@ -1,67 +1,232 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"net/url"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/gordonklaus/portaudio"
-	"github.com/gorilla/websocket"
+	"fyne.io/systray"
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/frame"
+	ws "github.com/maks112v/minicast/pkg/websocket"
 	"go.uber.org/zap"
 )
 
+// Capture defaults
 const (
 	sampleRate  = 44100
 	numChannels = 2
 	bufferSize  = 4096
+	bitDepth    = 16
 )
 
 func main() {
 	// Parse command line flags
-	addr := flag.String("addr", "localhost:8001", "server address")
+	var addrs addrList
+	flag.Var(&addrs, "addr", "server address, as host:port or a ws://, wss://, http:// or https:// URL; repeat to publish to several servers (default localhost:8001)")
+	trayMode := flag.Bool("tray", false, "run in the background with a system tray icon")
+	targetRate := flag.Int("rate", sampleRate, "target sample rate; the device's native rate is preferred when supported. With -stdin, the rate of the piped audio")
+	channels := flag.Int("channels", numChannels, "channels to capture")
+	bufferFrames := flag.Int("buffer-frames", bufferSize, "frames captured per read; smaller buffers lower latency but send more, smaller messages")
+	depth := flag.Int("bit-depth", bitDepth, "bits per sample sent: 16, 24, or 32 for float; 24 and 32 are sent unprocessed and reduced to 16-bit with dither by the server")
+	limit := flag.Bool("limiter", true, "limit peaks to -1 dBFS before converting to 16-bit, instead of clipping them")
+	reconnectBuffer := flag.Duration("reconnect-buffer", 10*time.Second, "keep up to this much audio while a server is unreachable and send it once reconnected, running that far behind live until silences are skipped to catch up; 0 drops it")
+	recordPath := flag.String("record", "", "also write what is broadcast to this WAV file, before any lossy encoding; an existing file is kept and the next free name (out-1.wav, ...) used instead")
+	spoolDir := flag.String("spool", "", "record audio a server misses while unreachable in this directory, and upload it to the server's DVR once it is back")
+	token := flag.String("token", "", "source token sent to servers that require one (an api token with the source scope)")
+	insecure := flag.Bool("insecure-skip-verify", false, "connect to wss:// and https:// servers without verifying their certificates, for labs with self-signed ones")
+	statsInterval := flag.Duration("stats-interval", time.Minute, "log each server's frames per second, kbps, total bytes sent and round trip this often; 0 turns it off")
+	dscp := flag.String("dscp", "", "mark outgoing audio with this DSCP class (e.g. ef) for QoS-aware networks")
+	presetName := flag.String("preset", "", "processing preset: "+strings.Join(audio.PresetNames(), ", "))
+	var overrides overrideList
+	flag.Var(&overrides, "preset-override", "change a preset setting, e.g. compressor.ratio=4, gate=off or opus.frame=40ms; repeatable")
+	udp := flag.Bool("udp", false, "send audio over UDP, resending lost packets, to servers started with -udp-ingest on the same port; falls back to WebSocket where UDP is blocked")
+	codec := flag.String("codec", ws.CodecPCM, "send audio as pcm, or as opus (needs a build with -tags opus)")
+	var devices deviceList
+	flag.Var(&devices, "device", "capture from this input device, by name (or a unique part of it) or index from -list-devices (default: the system's default input); "+
+		"repeat to mix several, each optionally at a gain in dB after @, e.g. \"USB Mic@-3\"")
+	list := flag.Bool("list-devices", false, "list the input devices and exit")
+	gainDB := flag.Float64("gain", 0, "gain in dB applied to the captured audio")
+	remoteGain := flag.Bool("remote-gain", true, "let servers change -gain while streaming")
+	showMeter := flag.Bool("meter", true, "draw a live peak/RMS level meter while streaming, when running in a terminal")
+	ptt := flag.Bool("ptt", false, "push-to-talk: transmit only after pressing -ptt-key, until it is pressed again; nothing is sent meanwhile")
+	pttKeyName := flag.String("ptt-key", "space", "the push-to-talk key: a single character, space, enter or tab")
+	vox := flag.Bool("vox", false, "voice-activated: transmit only while the level is above -vox-threshold, and for -vox-hang after")
+	voxThreshold := flag.Float64("vox-threshold", -40, "the RMS level in dBFS that opens VOX")
+	voxHang := flag.Duration("vox-hang", time.Second, "how long VOX keeps transmitting after the level falls below -vox-threshold, so words are not cut apart")
+	loopback := flag.Bool("loopback", false, "capture what the computer is playing instead of a microphone: the output's monitor on PulseAudio/PipeWire, WASAPI loopback or Stereo Mix on Windows, BlackHole or Soundflower on macOS")
+	notify := flag.Bool("notify", true, "show a desktop notification when a server connection is lost or regained")
+	notifySound := flag.Bool("notify-sound", false, "play the desktop's alert sound with connection notifications")
+	onAirGPIO := flag.Int("onair-gpio", -1, "drive this Raspberry Pi GPIO pin (BCM numbering) high while on air (Linux)")
+	onAirUSB := flag.Bool("onair-usb", false, "light a USB busylight (Luxafor Flag or blink(1)) red while on air (Linux)")
+	stdin := flag.Bool("stdin", false, "stream raw 16-bit little-endian PCM read from standard input, at -rate and -channels, instead of capturing a device")
+	filePath := flag.String("file", "", "stream this WAV or MP3 file, directory of them or M3U playlist in real time, at the first track's sample rate and channel count, instead of capturing a device")
+	loop := flag.Bool("loop", false, "with -file, start over after the last track")
+	shuffle := flag.Bool("shuffle", false, "with -file, play the tracks in random order, reshuffled on each loop")
+	discover := flag.Bool("discover", false, "find the server on the LAN over mDNS instead of giving -addr")
+	configPath := flag.String("config", "", "YAML file of settings named like these flags, which take precedence (default: "+configName+" in the working directory or the user's config directory, if there is one)")
 	flag.Parse()
+	if *configPath == "" {
+		*configPath = defaultConfigPath()
+	}
+	if *configPath != "" {
+		if err := loadConfig(flag.CommandLine, *configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *discover && len(addrs) > 0 {
+		fmt.Fprintln(os.Stderr, "-discover and -addr cannot be combined")
+		os.Exit(1)
+	}
+	if len(addrs) == 0 && !*discover {
+		addrs = addrList{"localhost:8001"}
+	}
+	// Opus encodes at 48kHz, so capture at that unless asked otherwise
+	rateSet := false
+	flag.Visit(func(f *flag.Flag) { rateSet = rateSet || f.Name == "rate" })
+	if *codec == ws.CodecOpus && !rateSet {
+		*targetRate = audio.OpusSampleRate
+	}
 
-	// Initialize logger
-	logger, _ := zap.NewProduction()
+	// Initialize logger, written around the level meter when one is drawn
+	var meter *vuMeter
+	if *showMeter && !*trayMode {
+		meter = newVUMeter()
+	}
+	logger, _ := meter.logger()
 	defer logger.Sync()
 	sugar := logger.Sugar()
+	if *configPath != "" {
+		sugar.Infow("Loaded settings", "config", *configPath)
+	}
 
-	// Initialize PortAudio
-	err := portaudio.Initialize()
+	if *discover {
+		addr, err := discoverServer(sugar)
+		if err != nil {
+			sugar.Fatalf("Failed to discover a server: %v", err)
+		}
+		addrs = addrList{addr}
+	}
+
+	dialer, err := newDialer(*dscp, *insecure)
 	if err != nil {
-		sugar.Fatalf("Failed to initialize PortAudio: %v", err)
-	}
-	defer portaudio.Terminate()
-
-	// Open default input stream
-	inputStream, err := portaudio.OpenDefaultStream(
-		numChannels, // input channels
-		0,           // output channels
-		float64(sampleRate),
-		bufferSize, // frames per buffer
-		make([]float32, bufferSize*numChannels),
-	)
+		sugar.Fatalf("Invalid -dscp: %v", err)
+	}
+	client := newHTTPClient(dialer)
+	var targets []*server
+	for _, addr := range addrs {
+		target, err := newServer(addr, *token, client)
+		if err != nil {
+			sugar.Fatalf("Invalid -addr: %v", err)
+		}
+		targets = append(targets, target)
+	}
+	preset, err := loadPreset(*presetName, overrides)
 	if err != nil {
-		sugar.Fatalf("Failed to open input stream: %v", err)
+		sugar.Fatalf("Invalid -preset: %v", err)
 	}
-	defer inputStream.Close()
-
-	err = inputStream.Start()
+	pttKey, err := parseKey(*pttKeyName)
 	if err != nil {
-		sugar.Fatalf("Failed to start input stream: %v", err)
+		sugar.Fatalf("Invalid -ptt-key: %v", err)
+	}
+	switch {
+	case *ptt && *vox:
+		sugar.Fatalf("-ptt and -vox cannot be combined")
+	case *ptt && (*stdin || *trayMode):
+		sugar.Fatalf("-ptt reads its key from the terminal, so it cannot be combined with -stdin or -tray")
+	}
+	if *spoolDir != "" && (*codec != ws.CodecPCM || *depth != 16) {
+		sugar.Fatalf("-spool needs -codec pcm and -bit-depth 16")
+	}
+	if *channels < 1 || *channels > 8 {
+		sugar.Fatalf("-channels must be between 1 and 8")
+	}
+	if *bufferFrames < 64 || *bufferFrames > 32768 {
+		sugar.Fatalf("-buffer-frames must be between 64 and 32768")
 	}
+	if math.Abs(*gainDB) > ws.MaxSourceGain {
+		sugar.Fatalf("-gain must be between -%g and %g dB", ws.MaxSourceGain, ws.MaxSourceGain)
+	}
+	gain := newGainControl(*gainDB, *remoteGain, sugar)
 
-	// Connect to WebSocket server
-	u := url.URL{Scheme: "ws", Host: *addr, Path: "/ws", RawQuery: "source=true"}
-	sugar.Infof("Connecting to %s", u.String())
+	if *list {
+		if err := listDevices(os.Stdout); err != nil {
+			sugar.Fatalf("Failed to list input devices: %v", err)
+		}
+		return
+	}
 
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	// Stream a pipe at the rate given, a file at its own rate and channel
+	// count, or capture from a device at the rate it supports best
+	var in input
+	var fileIn *fileInput
+	captureRate, captureChannels := 0, *channels
+	if *loopback && (*stdin || *filePath != "") {
+		sugar.Fatalf("-loopback cannot be combined with -stdin or -file")
+	}
+	if *stdin {
+		if *filePath != "" {
+			sugar.Fatalf("-stdin cannot be combined with -file")
+		}
+		if *targetRate <= 0 {
+			sugar.Fatalf("-rate must be positive")
+		}
+		captureRate = *targetRate
+		in = openStdin(captureRate, captureChannels)
+		sugar.Infow("Streaming standard input", "rate", captureRate, "channels", captureChannels)
+	} else if *filePath != "" {
+		if fileIn, captureRate, captureChannels, err = openFile(*filePath, *loop, *shuffle, sugar); err != nil {
+			sugar.Fatalf("Failed to open file: %v", err)
+		}
+		sugar.Infow("Streaming file", "file", *filePath, "rate", captureRate, "channels", captureChannels)
+		in = fileIn
+	} else {
+		if *loopback && len(devices) > 0 {
+			sugar.Fatalf("-loopback cannot be combined with -device")
+		}
+		if in, captureRate, err = openDevice(devices, *loopback, *channels, *bufferFrames, *targetRate, sugar); err != nil {
+			sugar.Fatalf("Failed to open input device: %v", err)
+		}
+	}
+	defer in.Close()
+	audioBuffer := make([]float32, *bufferFrames*captureChannels)
+
+	// The preset's stages run before the audio is sent, encoded as asked
+	enc, format, err := newEncoder(preset, *codec, captureRate, captureChannels, *depth)
 	if err != nil {
-		sugar.Fatalf("Failed to connect to WebSocket server: %v", err)
+		sugar.Fatalf("Failed to set up encoding: %v", err)
+	}
+	if *recordPath != "" {
+		// Opus is recorded before resampling, at the capture rate
+		if enc.record, err = newRecorder(*recordPath, captureRate, captureChannels, *depth, sugar); err != nil {
+			sugar.Fatalf("Failed to start recording: %v", err)
+		}
+		defer enc.record.close()
+	}
+	if *presetName != "" {
+		sugar.Infow("Using preset", "preset", *presetName, "stages", len(preset.Stages), "codec", format.Codec)
+	}
+
+	// The handshake tells each server what it is receiving
+	handshake, err := format.Handshake()
+	if err != nil {
+		sugar.Fatalf("Failed to encode handshake: %v", err)
+	}
+
+	// Hot inputs can exceed full scale; the limiter turns them down ahead of
+	// the peak rather than letting the 16-bit conversion clip
+	var limiter *audio.Limiter
+	if *limit {
+		limiter = audio.NewLimiter(captureRate, captureChannels, -1, 5*time.Millisecond, 100*time.Millisecond)
 	}
-	defer c.Close()
 
 	// Handle interrupt signal
 	interrupt := make(chan os.Signal, 1)
@@ -70,53 +235,162 @@ func main() {
 	// Start streaming
 	sugar.Info("Started streaming. Press Ctrl+C to stop.")
 
-	audioBuffer := make([]float32, bufferSize*numChannels)
 	done := make(chan struct{})
 
+	// Mute and status are driven by the tray menu
+	var muted atomic.Bool
+	status := make(chan string, 1)
+	status <- "Connecting..."
+
+	// Every server gets the same frames, each over its own connection
+	ctx, cancel := context.WithCancel(context.Background())
+	// The reconnect buffer is counted in frames as sent
+	frameDuration := time.Duration(*bufferFrames) * time.Second / time.Duration(captureRate)
+	if format.Codec == ws.CodecOpus {
+		frameDuration = preset.Frame
+	}
+	backlog := int(*reconnectBuffer / frameDuration)
+	servers, err := newPublishers(targets, handshake, dialer, *udp, backlog, *spoolDir, format, status, sugar)
+	if err != nil {
+		sugar.Fatalf("Failed to open spool: %v", err)
+	}
+	if *notify {
+		servers.notifier = newNotifier(*notifySound, sugar)
+	}
+	light, err := newOnAir(*onAirGPIO, *onAirUSB, sugar)
+	if err != nil {
+		sugar.Fatalf("Failed to open the on-air indicator: %v", err)
+	}
+	defer light.close()
+	servers.onAir = light
+	servers.gain = gain
+	servers.statsInterval = *statsInterval
+	if fileIn != nil {
+		fileIn.onTrack = servers.setMetadata
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		servers.run(ctx)
+	}()
+
+	// Push-to-talk and VOX hold the audio back until the broadcaster talks
+	var talk *talkGate
+	switch {
+	case *ptt:
+		talk = newPushToTalk(light, sugar)
+		restore, _ := rawInput()
+		defer restore()
+		go talk.readKeys(pttKey)
+		sugar.Infof("Push-to-talk: press %s to start and stop transmitting", *pttKeyName)
+	case *vox:
+		talk = newVOX(*voxThreshold, *voxHang, light, sugar)
+	}
+
+	// sendAudio sends payloads captured together, returning the next
+	// sequence number
+	sendAudio := func(seq uint32, held heldAudio) uint32 {
+		for _, payload := range held.payloads {
+			servers.send(frame.Encode(frame.Header{Seq: seq, Captured: held.captured, Flags: held.flags}, payload))
+			seq++
+		}
+		return seq
+	}
+
 	go func() {
 		defer close(done)
+		var seq uint32
+		var preRoll heldAudio
 		for {
-			err := inputStream.Read()
-			if err != nil {
-				sugar.Errorf("Failed to read from input stream: %v", err)
+			if err := in.Read(audioBuffer); err == io.EOF {
+				sugar.Info("Input ended")
+				return
+			} else if err != nil {
+				sugar.Errorf("Failed to read from input: %v", err)
 				return
 			}
+			captured, flags := time.Now(), frame.Flags(0)
 
-			// Convert float32 samples to bytes (16-bit PCM)
-			pcmData := make([]byte, len(audioBuffer)*2)
-			for i, sample := range audioBuffer {
-				// Convert float32 [-1,1] to int16 and then to bytes
-				pcmSample := int16(sample * 32767)
-				pcmData[i*2] = byte(pcmSample)
-				pcmData[i*2+1] = byte(pcmSample >> 8)
-			}
-
-			err = c.WriteMessage(websocket.BinaryMessage, pcmData)
-			if err != nil {
-				sugar.Errorf("Failed to write to WebSocket: %v", err)
-				return
+			// While muted the frame stays silent so listeners keep their timing
+			if muted.Load() {
+				flags |= frame.FlagMuted
+				clear(audioBuffer)
+			} else {
+				gain.apply(audioBuffer, captureChannels)
+				// Metered before the limiter, so clipped input shows
+				meter.add(audioBuffer)
+				if limiter != nil {
+					limiter.ProcessFloat(audioBuffer)
+				}
 			}
 
-			// Sleep for approximately the buffer duration (93ms for 4096 samples at 44.1kHz)
-			time.Sleep(93 * time.Millisecond)
-		}
-	}()
+			send, start := talk.update(audioBuffer, captured)
 
-	for {
-		select {
-		case <-done:
-			return
-		case <-interrupt:
-			sugar.Info("Interrupt received, stopping...")
-			err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			payloads, err := enc.encodeCapture(audioBuffer)
 			if err != nil {
-				sugar.Errorf("Failed to write close message: %v", err)
+				sugar.Errorf("Failed to encode audio: %v", err)
 			}
-			select {
-			case <-done:
-			case <-time.After(time.Second):
+			if !send {
+				// VOX leads in with the buffer before it crossed the
+				// threshold, so the first syllable is not cut
+				if *vox {
+					preRoll = heldAudio{captured: captured, flags: flags, payloads: payloads}
+				}
+				continue
 			}
-			return
+			if start {
+				// Players resync at the start of each transmission
+				if preRoll.payloads != nil {
+					preRoll.flags |= frame.FlagDiscontinuity
+					seq = sendAudio(seq, preRoll)
+				} else {
+					flags |= frame.FlagDiscontinuity
+				}
+				preRoll = heldAudio{}
+			}
+			seq = sendAudio(seq, heldAudio{captured: captured, flags: flags, payloads: payloads})
 		}
+	}()
+
+	stopMeter := meter.start(captureChannels)
+
+	// shutdown stops capture, then closes every connection cleanly
+	shutdown := func() {
+		waitForShutdown(done, interrupt, sugar)
+		stopMeter()
+		cancel()
+		<-stopped
+	}
+
+	if *trayMode {
+		go func() {
+			shutdown()
+			systray.Quit()
+		}()
+		runTray(status, func(m bool) {
+			muted.Store(m)
+			light.setMuted(m)
+		}, interrupt)
+		return
+	}
+
+	shutdown()
+}
+
+// setStatus replaces any unread status update with s
+func setStatus(status chan string, s string) {
+	select {
+	case <-status:
+	default:
+	}
+	status <- s
+}
+
+// waitForShutdown blocks until capture stops or an interrupt arrives
+func waitForShutdown(done chan struct{}, interrupt chan os.Signal, sugar *zap.SugaredLogger) {
+	select {
+	case <-done:
+	case <-interrupt:
+		sugar.Info("Interrupt received, stopping...")
 	}
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// meterInterval is how often the meter is redrawn
+	meterInterval = 100 * time.Millisecond
+	// meterFloor is the level at the left end of the bars, in dBFS
+	meterFloor = -60.0
+	// meterWidth is how wide the bars are for all channels together
+	meterWidth = 60
+	// peakHold is how long a peak stays marked on a bar
+	peakHold = 1500 * time.Millisecond
+	// clipHold is how long CLIP stays lit after the input reached full scale
+	clipHold = 3 * time.Second
+	// clipLevel is how close to full scale a sample counts as clipped
+	clipLevel = 0.999
+)
+
+// vuMeter draws the captured level as a line of peak and RMS bars in the
+// terminal. Log lines written through it clear the line first, and the
+// next redraw puts it back below them.
+type vuMeter struct {
+	out io.Writer
+
+	mu       sync.Mutex
+	channels int
+	peak     []float64
+	sum      []float64
+	samples  int
+	held     []float64
+	heldAt   []time.Time
+	clipped  time.Time
+	drawn    int
+}
+
+// newVUMeter returns a meter drawing on stderr, or nil when stderr is not a
+// terminal
+func newVUMeter() *vuMeter {
+	if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &vuMeter{out: os.Stderr}
+}
+
+// logger returns a logger whose lines are written through the meter
+func (m *vuMeter) logger() (*zap.Logger, error) {
+	if m == nil {
+		return zap.NewProduction()
+	}
+	return zap.NewProduction(zap.WrapCore(func(zapcore.Core) zapcore.Core {
+		encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+		return zapcore.NewCore(encoder, zapcore.Lock(zapcore.AddSync(m)), zap.InfoLevel)
+	}))
+}
+
+// start measures audio with channels and redraws it until the returned
+// function is called, which removes the meter
+func (m *vuMeter) start(channels int) (stop func()) {
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	m.channels = channels
+	m.peak, m.sum = make([]float64, channels), make([]float64, channels)
+	m.held, m.heldAt = make([]float64, channels), make([]time.Time, channels)
+	for ch := range m.held {
+		m.held[ch] = math.Inf(-1)
+	}
+	m.mu.Unlock()
+
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(meterInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				m.clear()
+				return
+			case now := <-ticker.C:
+				m.draw(now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// add measures a buffer of captured samples
+func (m *vuMeter) add(buf []float32) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.channels == 0 {
+		return
+	}
+	for i := 0; i+m.channels <= len(buf); i += m.channels {
+		for ch := range m.channels {
+			v := math.Abs(float64(buf[i+ch]))
+			m.peak[ch] = max(m.peak[ch], v)
+			m.sum[ch] += v * v
+			if v >= clipLevel {
+				m.clipped = time.Now()
+			}
+		}
+		m.samples++
+	}
+}
+
+// draw replaces the meter line with the levels measured since the last one
+func (m *vuMeter) draw(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	width := max(meterWidth/m.channels, 10)
+	var line strings.Builder
+	for ch := range m.channels {
+		peak, rms := toDBFS(m.peak[ch]), meterFloor-1
+		if m.samples > 0 {
+			rms = toDBFS(math.Sqrt(m.sum[ch] / float64(m.samples)))
+		}
+		if peak >= m.held[ch] || now.Sub(m.heldAt[ch]) > peakHold {
+			// A new peak, or the held one has expired
+			m.held[ch], m.heldAt[ch] = peak, now
+		}
+		fmt.Fprintf(&line, "%s [%s] %5s  ", channelLabel(ch, m.channels), meterBar(rms, m.held[ch], width), formatLevel(rms))
+	}
+	if now.Sub(m.clipped) < clipHold {
+		line.WriteString("CLIP")
+	}
+	clear(m.peak)
+	clear(m.sum)
+	m.samples = 0
+
+	text := strings.TrimRight(line.String(), " ")
+	fmt.Fprintf(m.out, "\r%s%s", text, strings.Repeat(" ", max(m.drawn-len(text), 0)))
+	m.drawn = len(text)
+}
+
+// Write clears the meter line and writes p, a log line, in its place
+func (m *vuMeter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.erase()
+	return m.out.Write(p)
+}
+
+// clear removes the meter line
+func (m *vuMeter) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.erase()
+}
+
+// erase blanks the meter line, leaving the cursor at its start
+func (m *vuMeter) erase() {
+	if m.drawn > 0 {
+		fmt.Fprintf(m.out, "\r%s\r", strings.Repeat(" ", m.drawn))
+		m.drawn = 0
+	}
+}
+
+// meterBar fills a bar up to the RMS level and marks the held peak with |
+func meterBar(rms, peak float64, width int) string {
+	position := func(level float64) int {
+		return int(math.Round((level - meterFloor) / -meterFloor * float64(width)))
+	}
+	bar := []byte(strings.Repeat("=", min(max(position(rms), 0), width)) + strings.Repeat(" ", width))[:width]
+	if p := position(peak); p > 0 {
+		bar[min(p, width)-1] = '|'
+	}
+	return string(bar)
+}
+
+// channelLabel names channel ch of channels
+func channelLabel(ch, channels int) string {
+	switch {
+	case channels == 1:
+		return "M"
+	case channels == 2:
+		return [2]string{"L", "R"}[ch]
+	}
+	return fmt.Sprint(ch + 1)
+}
+
+// formatLevel formats a level in dBFS, or "-inf" below the meter
+func formatLevel(level float64) string {
+	if level < meterFloor {
+		return "-inf"
+	}
+	return fmt.Sprintf("%.0f", level)
+}
+
+// toDBFS converts a linear level to dBFS
+func toDBFS(v float64) float64 {
+	if v <= 0 {
+		return math.Inf(-1)
+	}
+	return 20 * math.Log10(v)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gordonklaus/portaudio"
+	"go.uber.org/zap"
+)
+
+const (
+	// mixCushion is how many reads of a mixed device are buffered before
+	// it is heard, absorbing the jitter between the devices' reads
+	mixCushion = 2
+	// mixMaxBuffered is how many reads may pile up before a device whose
+	// clock runs faster than the first one's has its oldest audio skipped
+	mixMaxBuffered = 4
+)
+
+// deviceSpec is an input device given to -device, with the gain in dB it
+// is captured at
+type deviceSpec struct {
+	name   string
+	gainDB float64
+}
+
+// deviceList is a repeatable -device flag. Each value may end in @ and a
+// gain in dB, as in "USB Mic@-6"; anything else after an @ is part of the
+// name.
+type deviceList []deviceSpec
+
+// String returns the devices as given
+func (d *deviceList) String() string {
+	specs := make([]string, len(*d))
+	for i, spec := range *d {
+		specs[i] = spec.name
+		if spec.gainDB != 0 {
+			specs[i] += "@" + strconv.FormatFloat(spec.gainDB, 'g', -1, 64)
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+// Set adds a device
+func (d *deviceList) Set(value string) error {
+	spec := deviceSpec{name: value}
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		gain, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(value[i+1:]), "db"), 64)
+		if err == nil && !math.IsInf(gain, 0) && !math.IsNaN(gain) {
+			spec = deviceSpec{name: value[:i], gainDB: gain}
+		}
+	}
+	*d = append(*d, spec)
+	return nil
+}
+
+// deviceMix captures several devices and mixes them. Each device has its
+// own clock, so the first one paces the stream and the others are
+// buffered, skipping or waiting briefly when their clocks drift apart.
+type deviceMix struct {
+	first  *deviceInput
+	others []*mixedDevice
+}
+
+// mixedDevice is a device captured in the background for a mix
+type mixedDevice struct {
+	in     *deviceInput
+	logger *zap.SugaredLogger
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending []float32
+	primed  bool
+	closing bool
+	err     error
+}
+
+// startMix opens every device at the rate chosen for the first one
+func startMix(devices deviceList, channels, frames, targetRate int, logger *zap.SugaredLogger) (*deviceMix, int, error) {
+	first, rate, err := startDevice(devices[0], false, channels, frames, targetRate, 0, logger)
+	if err != nil {
+		return nil, 0, err
+	}
+	mix := &deviceMix{first: first}
+	for _, spec := range devices[1:] {
+		in, _, err := startDevice(spec, false, channels, frames, targetRate, float64(rate), logger)
+		if err != nil {
+			mix.stop()
+			return nil, 0, err
+		}
+		d := &mixedDevice{in: in, logger: logger, done: make(chan struct{})}
+		mix.others = append(mix.others, d)
+		go d.run(frames * channels)
+	}
+	names := []string{first.name}
+	for _, d := range mix.others {
+		names = append(names, d.in.name)
+	}
+	logger.Infow("Mixing input devices", "devices", names, "rate", rate)
+	return mix, rate, nil
+}
+
+// Read waits for the first device's next buffer and mixes the others in
+func (m *deviceMix) Read(buf []float32) error {
+	if err := m.first.Read(buf); err != nil {
+		return err
+	}
+	for _, d := range m.others {
+		if err := d.mixInto(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops every device and releases PortAudio
+func (m *deviceMix) Close() error {
+	err := m.stop()
+	portaudio.Terminate()
+	return err
+}
+
+// stop closes the mixed devices' streams, then the first one's
+func (m *deviceMix) stop() error {
+	for _, d := range m.others {
+		d.mu.Lock()
+		d.closing = true
+		d.mu.Unlock()
+		d.in.stream.Abort()
+		<-d.done
+		d.in.stream.Close()
+	}
+	return m.first.stream.Close()
+}
+
+// run captures the device until it fails or is closed
+func (d *mixedDevice) run(samples int) {
+	defer close(d.done)
+	buf := make([]float32, samples)
+	for {
+		err := d.in.Read(buf)
+		if errors.Is(err, portaudio.InputOverflowed) {
+			// The lost audio is made up for like a slow clock
+			continue
+		}
+
+		d.mu.Lock()
+		if err != nil {
+			if !d.closing {
+				d.err = err
+			}
+			d.mu.Unlock()
+			return
+		}
+		d.pending = append(d.pending, buf...)
+		if len(d.pending) > mixMaxBuffered*samples {
+			skip := len(d.pending) - mixCushion*samples
+			d.pending = d.pending[:copy(d.pending, d.pending[skip:])]
+			d.logger.Debugw("Skipped audio of a mixed device running ahead", "device", d.in.name, "samples", skip)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// mixInto adds the device's oldest buffered audio to buf. Until enough is
+// buffered, the device is left out.
+func (d *mixedDevice) mixInto(buf []float32) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return fmt.Errorf("input device %q failed: %v", d.in.name, d.err)
+	}
+	if !d.primed {
+		if len(d.pending) < mixCushion*len(buf) {
+			return nil
+		}
+		d.primed = true
+	}
+	n := min(len(buf), len(d.pending))
+	for i, v := range d.pending[:n] {
+		buf[i] += v
+	}
+	d.pending = d.pending[:copy(d.pending, d.pending[n:])]
+	if n < len(buf) {
+		// The device's clock runs slower: build the cushion up again
+		d.primed = false
+		d.logger.Debugw("Mixed device fell behind", "device", d.in.name, "samples", len(buf)-n)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// notification is a desktop notification about the connection
+type notification struct {
+	Title   string
+	Message string
+	// Urgent asks the desktop to keep it on screen until dismissed, where
+	// it supports that
+	Urgent bool
+	// Sound plays the desktop's alert sound with it
+	Sound bool
+}
+
+// notifier raises desktop notifications when a server is lost or regained,
+// for broadcasters who are not watching the terminal
+type notifier struct {
+	sound  bool
+	logger *zap.SugaredLogger
+	// failed stops further attempts once the desktop could not show one
+	failed atomic.Bool
+}
+
+// newNotifier returns a notifier, playing the alert sound with each
+// notification if sound is set
+func newNotifier(sound bool, logger *zap.SugaredLogger) *notifier {
+	return &notifier{sound: sound, logger: logger}
+}
+
+// notify shows a notification in the background. A nil notifier shows
+// nothing.
+func (n *notifier) notify(title, message string, urgent bool) {
+	if n == nil || n.failed.Load() {
+		return
+	}
+	go func() {
+		err := showNotification(notification{Title: title, Message: message, Urgent: urgent, Sound: n.sound})
+		if err != nil && !n.failed.Swap(true) {
+			n.logger.Warnf("Desktop notifications are unavailable: %v", err)
+		}
+	}()
+}
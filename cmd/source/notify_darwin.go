@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// showNotification shows the notification through Notification Center. The
+// text is passed as arguments so it needs no quoting.
+func showNotification(n notification) error {
+	script := `on run argv
+	display notification (item 2 of argv) with title (item 1 of argv)
+end run`
+	if n.Sound {
+		script = `on run argv
+	display notification (item 2 of argv) with title (item 1 of argv) sound name "Basso"
+end run`
+	}
+	return exec.Command("osascript", "-e", script, n.Title, n.Message).Run()
+}
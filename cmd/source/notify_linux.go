@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/godbus/dbus/v5"
+)
+
+// showNotification sends the notification to the desktop's notification
+// server over the session bus
+func showNotification(n notification) error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return err
+	}
+	hints := map[string]dbus.Variant{
+		"urgency": dbus.MakeVariant(byte(1)),
+	}
+	if n.Urgent {
+		hints["urgency"] = dbus.MakeVariant(byte(2))
+	}
+	if n.Sound {
+		hints["sound-name"] = dbus.MakeVariant("dialog-warning")
+	} else {
+		hints["suppress-sound"] = dbus.MakeVariant(true)
+	}
+
+	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	return obj.Call("org.freedesktop.Notifications.Notify", 0,
+		"minicast", uint32(0), "audio-input-microphone", n.Title, n.Message,
+		[]string{}, hints, int32(-1)).Err
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+)
+
+// showNotification is unsupported on this platform
+func showNotification(n notification) error {
+	return errors.New("not supported on this platform")
+}
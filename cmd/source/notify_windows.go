@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// toastScript shows a toast notification, reading its text from the
+// environment so it needs no quoting. Toasts are raised as PowerShell,
+// which Windows allows without registering an app.
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode($env:MINICAST_TITLE)) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode($env:MINICAST_MESSAGE)) > $null
+$audio = $xml.CreateElement('audio')
+if ($env:MINICAST_SOUND -eq '1') { $audio.SetAttribute('src', 'ms-winsoundevent:Notification.Default') } else { $audio.SetAttribute('silent', 'true') }
+$xml.DocumentElement.AppendChild($audio) > $null
+$app = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe'
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($app).Show([Windows.UI.Notifications.ToastNotification]::new($xml))
+`
+
+// showNotification shows the notification as a toast
+func showNotification(n notification) error {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(),
+		"MINICAST_TITLE="+n.Title,
+		"MINICAST_MESSAGE="+n.Message,
+		"MINICAST_SOUND="+flagValue(n.Sound),
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd.Run()
+}
+
+// flagValue renders a bool for the toast script
+func flagValue(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+// playableExts are the extensions of files played from a directory
+var playableExts = map[string]bool{".wav": true, ".mp3": true}
+
+// playlistEntry is a file to play, with its title from the playlist if it
+// had one
+type playlistEntry struct {
+	path  string
+	title string
+}
+
+// playlist is the tracks -file plays, in order or shuffled, once or looping.
+// Tracks in another format than the first are converted to it, since the
+// stream's format is fixed when it connects.
+type playlist struct {
+	entries []playlistEntry
+	order   []int
+	pos     int
+	loop    bool
+	shuffle bool
+	logger  *zap.SugaredLogger
+
+	rate     int
+	channels int
+	// pending is the first track, opened early to learn the format
+	pending *track
+}
+
+// openFile opens a WAV or MP3 file, a directory of them or an M3U
+// playlist to stream, returning the sample rate and channel count of the
+// first track, which the stream keeps
+func openFile(path string, loop, shuffle bool, logger *zap.SugaredLogger) (*fileInput, int, int, error) {
+	entries, err := loadPlaylist(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(entries) == 0 {
+		return nil, 0, 0, fmt.Errorf("no WAV or MP3 files in %s", path)
+	}
+
+	p := &playlist{entries: entries, loop: loop, shuffle: shuffle, logger: logger}
+	p.order = make([]int, len(entries))
+	for i := range p.order {
+		p.order[i] = i
+	}
+	p.reorder()
+
+	// The first track sets the format, so it is opened now
+	if p.pending, err = p.next(); err != nil {
+		return nil, 0, 0, err
+	}
+	return &fileInput{rate: p.rate, channels: p.channels, next: p.next}, p.rate, p.channels, nil
+}
+
+// loadPlaylist lists the files at path: the playable files of a directory,
+// by name, the entries of an M3U playlist, or path itself
+func loadPlaylist(path string) ([]playlistEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		files, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var entries []playlistEntry
+		for _, f := range files {
+			if !f.IsDir() && playableExts[strings.ToLower(filepath.Ext(f.Name()))] {
+				entries = append(entries, playlistEntry{path: filepath.Join(path, f.Name())})
+			}
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+		return entries, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u", ".m3u8":
+		return readM3U(path)
+	}
+	return []playlistEntry{{path: path}}, nil
+}
+
+// readM3U reads an M3U playlist. Relative paths are relative to the
+// playlist, and #EXTINF lines give the title of the entry that follows.
+func readM3U(path string) ([]playlistEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []playlistEntry
+	var title string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// #EXTINF:<seconds>,<title>
+			if _, t, ok := strings.Cut(line, ","); ok {
+				title = strings.TrimSpace(t)
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(filepath.Dir(path), filepath.FromSlash(line))
+			}
+			entries = append(entries, playlistEntry{path: line, title: title})
+			title = ""
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// reorder shuffles the play order, if asked to
+func (p *playlist) reorder() {
+	if p.shuffle {
+		rand.Shuffle(len(p.order), func(i, j int) { p.order[i], p.order[j] = p.order[j], p.order[i] })
+	}
+}
+
+// next opens the next track that plays, skipping files that cannot be
+// read, and returns io.EOF once the playlist is done
+func (p *playlist) next() (*track, error) {
+	if t := p.pending; t != nil {
+		p.pending = nil
+		return t, nil
+	}
+	for range p.entries {
+		if p.pos == len(p.order) {
+			if !p.loop {
+				return nil, io.EOF
+			}
+			p.pos = 0
+			p.reorder()
+		}
+		entry := p.entries[p.order[p.pos]]
+		p.pos++
+
+		t, err := p.open(entry.path)
+		if err != nil {
+			p.logger.Warnf("Skipping %s: %v", entry.path, err)
+			continue
+		}
+		md := entry.metadata()
+		t.metadata = &md
+		p.logger.Infow("Playing", "file", entry.path, "title", md.Title, "artist", md.Artist)
+		return t, nil
+	}
+	return nil, errors.New("no playable files")
+}
+
+// open decodes a file, converting it to the stream's format, or adopting
+// its format for the first track
+func (p *playlist) open(path string) (*track, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := audio.NewDecoder(mime.TypeByExtension(filepath.Ext(path)), f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if decoded.NumChannels < 1 || decoded.NumChannels > 8 {
+		f.Close()
+		return nil, fmt.Errorf("%d channels", decoded.NumChannels)
+	}
+	if p.rate == 0 {
+		p.rate, p.channels = decoded.SampleRate, decoded.NumChannels
+	}
+
+	var stages []audio.Stage
+	if decoded.NumChannels != p.channels {
+		stages = append(stages, audio.NewMixer(decoded.NumChannels, p.channels))
+	}
+	if decoded.SampleRate != p.rate {
+		resampler, err := audio.NewResampler(audio.ResampleSinc, p.channels, decoded.SampleRate, p.rate)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		stages = append(stages, resampler)
+	}
+	if len(stages) == 0 {
+		return &track{Reader: decoded, Closer: f}, nil
+	}
+	return &track{Reader: &convertReader{src: decoded, frameSize: 2 * decoded.NumChannels, pipeline: audio.Pipeline{Stages: stages}}, Closer: f}, nil
+}
+
+// metadata returns the entry's now-playing metadata: its title from the
+// playlist, or else its file name, split into artist and title when it
+// reads "Artist - Title"
+func (e playlistEntry) metadata() ws.Metadata {
+	name := e.title
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(e.path), filepath.Ext(e.path))
+	}
+	if artist, title, ok := strings.Cut(name, " - "); ok {
+		return ws.Metadata{Artist: strings.TrimSpace(artist), Title: strings.TrimSpace(title)}
+	}
+	return ws.Metadata{Title: name}
+}
+
+// convertReader converts decoded PCM through a pipeline as it is read
+type convertReader struct {
+	src       io.Reader
+	frameSize int
+	pipeline  audio.Pipeline
+	chunk     []byte
+	out       []byte
+}
+
+// Read returns converted PCM, decoding more as needed
+func (r *convertReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.chunk == nil {
+			r.chunk = make([]byte, 4096*r.frameSize)
+		}
+		n, err := io.ReadFull(r.src, r.chunk)
+		if n -= n % r.frameSize; n > 0 {
+			converted, perr := r.pipeline.Process(r.chunk[:n])
+			if perr != nil {
+				return 0, perr
+			}
+			r.out = converted
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = io.EOF
+		}
+		if err != nil && len(r.out) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// overrideList is a repeatable -preset-override flag
+type overrideList []string
+
+// String returns the overrides as given
+func (o *overrideList) String() string {
+	return strings.Join(*o, ",")
+}
+
+// Set adds an override
+func (o *overrideList) Set(value string) error {
+	*o = append(*o, value)
+	return nil
+}
+
+// loadPreset returns the named preset with the overrides applied. An empty
+// name gives an empty preset, which leaves the audio as captured.
+func loadPreset(name string, overrides []string) (audio.Preset, error) {
+	preset := audio.Preset{OpusApplication: audio.OpusAudio, Frame: 20 * time.Millisecond}
+	if name != "" {
+		var ok bool
+		if preset, ok = audio.LookupPreset(name); !ok {
+			return preset, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(audio.PresetNames(), ", "))
+		}
+	}
+	for _, override := range overrides {
+		if err := preset.Override(override); err != nil {
+			return preset, err
+		}
+	}
+	return preset, nil
+}
+
+// encoder turns captured PCM into the payloads sent to servers: it runs the
+// preset's stages, then for Opus cuts the audio into frames of the preset's
+// length and encodes them
+type encoder struct {
+	stages   []audio.Stage
+	bitDepth int
+	// record, if set, gets the audio before any lossy encoding
+	record *recorder
+
+	// Opus only: the resampler to a rate Opus encodes at, if capturing at
+	// another, and audio waiting to fill a frame
+	opus        audio.FrameEncoder
+	resampler   audio.Stage
+	frameLength int
+	pending     []int16
+}
+
+// newEncoder creates the encoder for audio captured at captureRate, and
+// returns the format servers receive. PCM is sent at bitDepth: 16, 24, or
+// 32 for float; the preset's stages and Opus need 16.
+func newEncoder(preset audio.Preset, codec string, captureRate, numChannels, bitDepth int) (*encoder, ws.SourceFormat, error) {
+	format := ws.SourceFormat{SampleRate: captureRate, Channels: numChannels, BitDepth: 16, Codec: ws.CodecPCM, Framed: true}
+
+	switch bitDepth {
+	case 16:
+	case 24, 32:
+		if codec != ws.CodecPCM || len(preset.Stages) > 0 {
+			return nil, format, fmt.Errorf("%d-bit audio is sent unprocessed; it needs -codec pcm and no preset stages", bitDepth)
+		}
+		format.BitDepth = bitDepth
+		if bitDepth == 32 {
+			format.Codec = ws.CodecFloat
+		}
+		return &encoder{bitDepth: bitDepth}, format, nil
+	default:
+		return nil, format, fmt.Errorf("unsupported bit depth %d (use 16, 24 or 32)", bitDepth)
+	}
+
+	stages, err := audio.NewStages(captureRate, numChannels, preset.Stages)
+	if err != nil {
+		return nil, format, err
+	}
+	e := &encoder{stages: stages, bitDepth: bitDepth}
+
+	switch codec {
+	case ws.CodecPCM:
+		return e, format, nil
+	case ws.CodecOpus:
+	default:
+		return nil, format, fmt.Errorf("unknown codec %q", codec)
+	}
+
+	switch captureRate {
+	case 8000, 12000, 16000, 24000, audio.OpusSampleRate:
+		format.SampleRate = captureRate
+	default:
+		format.SampleRate = audio.OpusSampleRate
+		e.resampler = audio.NewSincResampler(numChannels, captureRate, audio.OpusSampleRate)
+	}
+	if e.opus, err = audio.NewOpusEncoder(format.SampleRate, numChannels, preset.OpusApplication); err != nil {
+		return nil, format, err
+	}
+
+	switch preset.Frame {
+	case 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond:
+	default:
+		return nil, format, fmt.Errorf("opus frames must be 2.5, 5, 10, 20, 40 or 60ms, not %s", preset.Frame)
+	}
+	e.frameLength = int(preset.Frame.Seconds()*float64(format.SampleRate)) * numChannels
+	format.Codec = ws.CodecOpus
+	return e, format, nil
+}
+
+// encodeCapture encodes captured samples, keeping their precision when
+// sending more than 16 bits
+func (e *encoder) encodeCapture(samples []float32) ([][]byte, error) {
+	switch e.bitDepth {
+	case 24:
+		data := make([]byte, len(samples)*3)
+		for i, sample := range samples {
+			v := int32(max(-1, min(1, float64(sample))) * 8388607)
+			data[i*3], data[i*3+1], data[i*3+2] = byte(v), byte(v>>8), byte(v>>16)
+		}
+		e.record.add(data)
+		return [][]byte{data}, nil
+	case 32:
+		data := make([]byte, len(samples)*4)
+		for i, sample := range samples {
+			binary.LittleEndian.PutUint32(data[i*4:], math.Float32bits(sample))
+		}
+		e.record.add(data)
+		return [][]byte{data}, nil
+	}
+
+	pcm := make([]int16, len(samples))
+	for i, sample := range samples {
+		// Clamp overs rather than letting them wrap around
+		pcm[i] = int16(max(-1, min(1, sample)) * 32767)
+	}
+	return e.encode(pcm)
+}
+
+// encode processes captured PCM, returning the payloads it completes
+func (e *encoder) encode(pcm []int16) ([][]byte, error) {
+	for _, stage := range e.stages {
+		if pcm = stage.Process(pcm); len(pcm) == 0 {
+			return nil, nil
+		}
+	}
+	if e.opus == nil {
+		data := audio.PCMToBytes(pcm)
+		e.record.add(data)
+		return [][]byte{data}, nil
+	}
+	e.record.add(audio.PCMToBytes(pcm))
+
+	if e.resampler != nil {
+		pcm = e.resampler.Process(pcm)
+	}
+	e.pending = append(e.pending, pcm...)
+
+	var packets [][]byte
+	for len(e.pending) >= e.frameLength {
+		packet, err := e.opus.Encode(e.pending[:e.frameLength])
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, packet)
+		e.pending = e.pending[e.frameLength:]
+	}
+	// Keep the leftover at the start of the buffer so it does not grow
+	e.pending = append(e.pending[:0], e.pending...)
+	return packets, nil
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/frame"
+	"github.com/maks112v/minicast/pkg/qos"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// publishQueue is how many frames beyond the reconnect buffer may wait
+	// for a slow server (about 1.5s at the default buffer size) before the
+	// oldest are dropped
+	publishQueue = 16
+	// liveSlack is how far behind its capture time a frame still counts as
+	// live when a connection starts
+	liveSlack = 200 * time.Millisecond
+	// catchUpLevel is the level (in dBFS) below which frames are skipped
+	// while a connection runs behind live
+	catchUpLevel = -50.0
+
+	// metadataTimeout bounds sending metadata over HTTP
+	metadataTimeout = 5 * time.Second
+
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// addrList is a repeatable -addr flag
+type addrList []string
+
+// String returns the addresses as given
+func (a *addrList) String() string {
+	return strings.Join(*a, ",")
+}
+
+// Set adds an address
+func (a *addrList) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+// publisher streams to one server. It connects and reconnects on its own,
+// so a server that is slow or unreachable never holds up the others.
+type publisher struct {
+	addr      string
+	server    *server
+	handshake []byte
+	dialer    *websocket.Dialer
+	// udp sends audio over UDP when the server takes it
+	udp    bool
+	queue  chan []byte
+	spool  *spool
+	group  *publishers
+	logger *zap.SugaredLogger
+
+	// resume keeps audio queued while disconnected to send on
+	// reconnecting, rather than dropping it. carry is a frame taken from
+	// the queue but not sent when a connection ended.
+	resume bool
+	carry  []byte
+	format ws.SourceFormat
+
+	// metadataChanged is signalled when the group's metadata changes, and
+	// gainChanged when the gain does
+	metadataChanged chan struct{}
+	gainChanged     chan struct{}
+
+	stats uplinkStats
+}
+
+// publishers sends the same stream to every server and reports how many
+// are connected
+type publishers struct {
+	list   []*publisher
+	status chan string
+	// notifier, if set, tells the broadcaster when a server is lost or
+	// regained
+	notifier *notifier
+	// onAir, if set, lights an indicator while a server is connected
+	onAir *onAir
+	// gain, if set, is reported to servers, which may change it
+	gain *gainControl
+	// statsInterval is how often each server's uplink is logged, if at all
+	statsInterval time.Duration
+
+	mu        sync.Mutex
+	connected map[*publisher]bool
+	// metadata is what is playing, sent to every server
+	metadata *ws.Metadata
+}
+
+// metadataMessage is the text frame telling the server what is playing
+type metadataMessage struct {
+	Type string `json:"type"`
+	ws.Metadata
+}
+
+// newPublishers creates a publisher for each server, all connecting with
+// dialer (over UDP first, if udp is set) and announcing the stream with
+// handshake. Up to backlog frames queued while a server is unreachable are
+// sent once it is back, or none when backlog is 0. With a spool directory,
+// audio a server misses while unreachable is uploaded to it afterwards.
+func newPublishers(servers []*server, handshake []byte, dialer *websocket.Dialer, udp bool, backlog int, spoolDir string, format ws.SourceFormat, status chan string, logger *zap.SugaredLogger) (*publishers, error) {
+	g := &publishers{status: status, connected: make(map[*publisher]bool)}
+	for _, s := range servers {
+		addr := s.addr
+		p := &publisher{
+			addr:      addr,
+			server:    s,
+			handshake: handshake,
+			dialer:    dialer,
+			udp:       udp,
+			queue:     make(chan []byte, backlog+publishQueue),
+			group:     g,
+			logger:    logger.With("server", addr),
+			resume:    backlog > 0,
+			format:    format,
+
+			metadataChanged: make(chan struct{}, 1),
+			gainChanged:     make(chan struct{}, 1),
+		}
+		if spoolDir != "" {
+			var err error
+			if p.spool, err = newSpool(spoolDir, s, format, p.logger); err != nil {
+				return nil, err
+			}
+		}
+		g.list = append(g.list, p)
+	}
+	return g, nil
+}
+
+// run streams to every server until ctx is done, then closes the
+// connections cleanly and returns
+func (g *publishers) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	if g.statsInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.logStats(ctx, g.statsInterval)
+		}()
+	}
+	for _, p := range g.list {
+		wg.Add(1)
+		go func(p *publisher) {
+			defer wg.Done()
+			p.run(ctx)
+		}(p)
+
+		if p.spool != nil {
+			wg.Add(1)
+			go func(s *spool) {
+				defer wg.Done()
+				s.run(ctx)
+			}(p.spool)
+		}
+	}
+	wg.Wait()
+}
+
+// send queues a message for every server. It never blocks: a server that
+// falls behind loses its oldest frames to the spool, if any.
+func (g *publishers) send(msg []byte) {
+	for _, p := range g.list {
+		select {
+		case p.queue <- msg:
+			continue
+		default:
+		}
+		select {
+		case old := <-p.queue:
+			p.spill(old)
+		default:
+		}
+		select {
+		case p.queue <- msg:
+		default:
+		}
+	}
+}
+
+// setMetadata sends new now-playing metadata to every server, and to each
+// again whenever it reconnects
+func (g *publishers) setMetadata(md ws.Metadata) {
+	g.mu.Lock()
+	g.metadata = &md
+	g.mu.Unlock()
+
+	for _, p := range g.list {
+		select {
+		case p.metadataChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handleGain applies a gain change a server sent and reports the new gain
+// to every server
+func (g *publishers) handleGain(data []byte, addr string) bool {
+	if g.gain == nil || !g.gain.handleMessage(data, addr) {
+		return false
+	}
+	for _, p := range g.list {
+		select {
+		case p.gainChanged <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// gainReport returns the gain message to send, or nil when servers may not
+// change the gain, and clears any pending change signal
+func (p *publisher) gainReport() *gainMessage {
+	select {
+	case <-p.gainChanged:
+	default:
+	}
+	if p.group.gain == nil || !p.group.gain.remote {
+		return nil
+	}
+	return &gainMessage{Type: "gain", GainDB: p.group.gain.get()}
+}
+
+// nowPlaying returns the metadata to send, or nil if there is none, and
+// clears any pending change signal since it is being sent
+func (p *publisher) nowPlaying() *ws.Metadata {
+	select {
+	case <-p.metadataChanged:
+	default:
+	}
+	p.group.mu.Lock()
+	defer p.group.mu.Unlock()
+	return p.group.metadata
+}
+
+// putMetadata sends metadata to a server that takes audio over UDP, which
+// cannot carry it, through the HTTP API
+func (p *publisher) putMetadata(md ws.Metadata) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	body, _ := json.Marshal(md)
+	req, err := p.server.request(ctx, http.MethodPut, "/api/v1/metadata", nil, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.server.client.Do(req)
+	if err != nil {
+		p.logger.Warnf("Failed to send metadata: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		p.logger.Warnf("Server refused metadata: %s", resp.Status)
+	}
+}
+
+// setConnected records a server's connection state and updates the status
+func (g *publishers) setConnected(p *publisher, connected bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	was, known := g.connected[p]
+	g.connected[p] = connected
+	count := 0
+	for _, c := range g.connected {
+		if c {
+			count++
+		}
+	}
+
+	switch {
+	case count == 0:
+		setStatus(g.status, "Reconnecting...")
+	case count == len(g.list):
+		setStatus(g.status, "On air")
+	default:
+		setStatus(g.status, fmt.Sprintf("On air (%d of %d servers)", count, len(g.list)))
+	}
+
+	g.onAir.setConnected(count > 0)
+
+	offAir := "Listeners are not hearing you; reconnecting."
+	if count > 0 {
+		offAir = fmt.Sprintf("Still on air on %d of %d servers; reconnecting.", count, len(g.list))
+	}
+	switch {
+	case !connected && was:
+		g.notifier.notify("Lost connection to "+p.addr, offAir, true)
+	case !connected && !known:
+		g.notifier.notify("Cannot reach "+p.addr, offAir, true)
+	case connected && known && !was:
+		g.notifier.notify("Reconnected to "+p.addr, "Back on air.", false)
+	}
+}
+
+// run keeps a connection to the server, backing off between attempts
+func (p *publisher) run(ctx context.Context) {
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := p.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		p.group.setConnected(p, false)
+		p.logger.Warnf("Not connected, retrying in %s: %v", delay, err)
+
+		// A connection that lasted a while starts the backoff over
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// stream connects once and writes queued frames until the connection
+// fails or ctx is done
+func (p *publisher) stream(ctx context.Context) error {
+	u := p.server.url("ws", "/ws", url.Values{"source": {"true"}})
+	conn, resp, err := p.dialer.DialContext(ctx, u, p.server.header())
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("the server needs a valid source token (-token): %v", err)
+		}
+		return err
+	}
+	defer conn.Close()
+	c := newUplink(conn, &p.stats)
+
+	if err := c.WriteMessage(websocket.TextMessage, p.handshake); err != nil {
+		return err
+	}
+	if md := p.nowPlaying(); md != nil {
+		if err := c.WriteJSON(metadataMessage{Type: "metadata", Metadata: *md}); err != nil {
+			return err
+		}
+	}
+	if gain := p.gainReport(); gain != nil {
+		if err := c.WriteJSON(gain); err != nil {
+			return err
+		}
+	}
+
+	// Read so server rejections, gain changes, pongs and closes are noticed
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			messageType, data, err := c.ReadMessage()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					err = fmt.Errorf("connection hung: no answer from the server in %s", pongTimeout)
+				}
+				closed <- err
+				return
+			}
+			if messageType == websocket.TextMessage && !p.group.handleGain(data, p.addr) {
+				p.logger.Warnf("Server says: %s", data)
+			}
+		}
+	}()
+
+	p.logger.Infof("Connected to %s", u)
+	p.group.setConnected(p, true)
+	if p.spool != nil {
+		p.spool.reconnected()
+	}
+	queue, stop := p.startPacing()
+	defer stop()
+
+	keepalive := time.NewTicker(pingInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+			}
+			return nil
+		case err := <-closed:
+			return err
+		case <-keepalive.C:
+			if err := c.ping(); err != nil {
+				return err
+			}
+		case msg := <-queue:
+			if err := c.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return err
+			}
+		case <-p.metadataChanged:
+			if md := p.nowPlaying(); md != nil {
+				if err := c.WriteJSON(metadataMessage{Type: "metadata", Metadata: *md}); err != nil {
+					return err
+				}
+			}
+		case <-p.gainChanged:
+			if gain := p.gainReport(); gain != nil {
+				if err := c.WriteJSON(gain); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// startPacing starts a connection's pacing of queued frames, returning the
+// channel they are sent on and a function stopping it
+func (p *publisher) startPacing() (<-chan []byte, func()) {
+	if !p.resume {
+		// Audio queued while disconnected is stale by now
+		for len(p.queue) > 0 {
+			p.spill(<-p.queue)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.pace(ctx, out)
+	}()
+	return out, func() {
+		cancel()
+		<-done
+	}
+}
+
+// pace passes queued frames to out until ctx is done. A connection that
+// starts with audio queued during an outage sends it first and stays that
+// far behind live, each frame going out when its capture time plus the
+// delay comes round, so listeners hear it at its normal pace. Silent PCM
+// frames are dropped meanwhile to catch up.
+func (p *publisher) pace(ctx context.Context, out chan<- []byte) {
+	var delay time.Duration
+	first := true
+	for {
+		msg := p.carry
+		p.carry = nil
+		if msg == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case msg = <-p.queue:
+			}
+		}
+
+		h, payload, err := frame.Decode(msg)
+		if err == nil && p.resume {
+			if first {
+				first = false
+				if delay = time.Since(h.Captured); delay > liveSlack {
+					p.logger.Infof("Sending %s of audio queued while disconnected", delay.Round(time.Millisecond))
+				} else {
+					delay = 0
+				}
+			}
+			if delay > 0 && p.silent(payload) {
+				if delay -= p.duration(payload); delay <= 0 {
+					delay = 0
+					p.logger.Info("Caught up with live")
+				}
+				continue
+			}
+			if wait := time.Until(h.Captured.Add(delay)); wait > 0 {
+				select {
+				case <-ctx.Done():
+					p.carry = msg
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			p.carry = msg
+			return
+		case out <- msg:
+		}
+	}
+}
+
+// silent reports whether a frame's payload is 16-bit PCM below catchUpLevel
+func (p *publisher) silent(payload []byte) bool {
+	return p.format.Codec == ws.CodecPCM && p.format.BitDepth == 16 && audio.LevelDBFS(payload) < catchUpLevel
+}
+
+// duration returns how long a frame's 16-bit PCM payload plays for
+func (p *publisher) duration(payload []byte) time.Duration {
+	bytesPerSecond := p.format.SampleRate * p.format.Channels * 2
+	return time.Duration(len(payload)) * time.Second / time.Duration(bytesPerSecond)
+}
+
+// spill hands a frame the server will never get live to the spool
+func (p *publisher) spill(msg []byte) {
+	if p.spool != nil {
+		p.spool.add(msg)
+	}
+}
+
+// newDialer returns the WebSocket dialer for the servers, marking its
+// connections with the named DSCP class unless it is empty. insecure skips
+// verifying TLS certificates, for labs with self-signed ones.
+func newDialer(dscp string, insecure bool) (*websocket.Dialer, error) {
+	dialer := *websocket.DefaultDialer
+	if insecure {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if dscp != "" {
+		value, err := qos.ParseDSCP(dscp)
+		if err != nil {
+			return nil, err
+		}
+		dialer.NetDialContext = (&net.Dialer{Control: qos.Control(value)}).DialContext
+	}
+	return &dialer, nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"go.uber.org/zap"
+)
+
+const (
+	// recordQueue is how many buffers may wait for the disk, about 20s at
+	// the default buffer size
+	recordQueue = 256
+	// recordHeaderInterval is how often the WAV header's sizes are brought
+	// up to date, so a recording cut short by a crash still plays
+	recordHeaderInterval = 5 * time.Second
+	// maxWAVData is the most audio a WAV file's 32-bit sizes can describe
+	maxWAVData = 0xFFFFFFFF - wavHeaderSize
+)
+
+// recorder writes a local copy of the broadcast to a WAV file, as it is
+// sent but before any lossy encoding. A recording that outgrows what WAV
+// can hold carries on in a new file, and existing files are never
+// overwritten: the next free name is taken instead, out-1.wav, out-2.wav
+// and so on.
+type recorder struct {
+	path   string
+	wav    *audio.Processor
+	float  bool
+	logger *zap.SugaredLogger
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+
+	// The file being written, owned by run
+	file    *os.File
+	size    uint32
+	updated time.Time
+}
+
+// newRecorder starts recording to path, or the next free name after it,
+// audio at rate with channels of bitDepth bits (32 being float)
+func newRecorder(path string, rate, channels, bitDepth int, logger *zap.SugaredLogger) (*recorder, error) {
+	r := &recorder{
+		path:   path,
+		wav:    audio.NewProcessor(rate, channels, bitDepth),
+		float:  bitDepth == 32,
+		logger: logger,
+		queue:  make(chan []byte, recordQueue),
+		done:   make(chan struct{}),
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+// add queues audio to record. It never blocks, dropping audio if the disk
+// cannot keep up.
+func (r *recorder) add(data []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.queue <- data:
+	default:
+		r.logger.Warn("Recording is behind, dropping audio")
+	}
+}
+
+// close writes the queued audio and finishes the recording
+func (r *recorder) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	<-r.done
+}
+
+// run writes queued audio until the recorder is closed. A write error
+// ends the recording but never the broadcast.
+func (r *recorder) run() {
+	defer close(r.done)
+	for data := range r.queue {
+		if r.file == nil {
+			continue
+		}
+		if err := r.write(data); err != nil {
+			r.logger.Errorf("Stopped recording: %v", err)
+			r.finish()
+		}
+	}
+	r.finish()
+}
+
+// write appends audio, moving on to a new file when this one is full
+func (r *recorder) write(data []byte) error {
+	if uint64(r.size)+uint64(len(data)) > maxWAVData {
+		r.finish()
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	if _, err := r.file.Write(data); err != nil {
+		return err
+	}
+	r.size += uint32(len(data))
+	if time.Since(r.updated) >= recordHeaderInterval {
+		return r.updateHeader()
+	}
+	return nil
+}
+
+// open creates the next free file and writes its header
+func (r *recorder) open() error {
+	ext := filepath.Ext(r.path)
+	base := strings.TrimSuffix(r.path, ext)
+	for n := 0; ; n++ {
+		path := r.path
+		if n > 0 {
+			path = fmt.Sprintf("%s-%d%s", base, n, ext)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(r.header(0)); err != nil {
+			f.Close()
+			return err
+		}
+		r.file, r.size, r.updated = f, 0, time.Now()
+		r.logger.Infow("Recording", "file", path)
+		return nil
+	}
+}
+
+// header returns the WAV header for size bytes of audio
+func (r *recorder) header(size uint32) []byte {
+	header := r.wav.Header(size)
+	if r.float {
+		// WAVE_FORMAT_IEEE_FLOAT
+		binary.LittleEndian.PutUint16(header[20:], 3)
+	}
+	return header
+}
+
+// updateHeader rewrites the header for the audio written so far
+func (r *recorder) updateHeader() error {
+	r.updated = time.Now()
+	_, err := r.file.WriteAt(r.header(r.size), 0)
+	return err
+}
+
+// finish completes the header and closes the file
+func (r *recorder) finish() {
+	if r.file == nil {
+		return
+	}
+	if err := r.updateHeader(); err != nil {
+		r.logger.Errorf("Failed to finish recording: %v", err)
+	}
+	if err := r.file.Close(); err != nil {
+		r.logger.Errorf("Failed to finish recording: %v", err)
+	}
+	r.file = nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// server is a server given to -addr and how to reach it: host:port as
+// before, or a ws://, wss://, http:// or https:// URL, optionally with the
+// path the server is proxied under. The secure schemes connect over TLS.
+type server struct {
+	// addr is the address as given, naming the server in logs
+	addr string
+	// host is the host:port connected to, always with a port
+	host   string
+	prefix string
+	secure bool
+
+	// token is sent to the server as a bearer token, if set
+	token  string
+	client *http.Client
+}
+
+// newServer parses an -addr value
+func newServer(addr, token string, client *http.Client) (*server, error) {
+	s := &server{addr: addr, host: addr, token: token, client: client}
+	if !strings.Contains(addr, "://") {
+		return s, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	port := "80"
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		s.secure, port = true, "443"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in %s; use ws, wss, http or https", u.Scheme, addr)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %s", addr)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	s.host = net.JoinHostPort(u.Hostname(), port)
+	// A pasted source URL names the WebSocket endpoint itself
+	s.prefix = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/ws")
+	return s, nil
+}
+
+// url returns the URL of path on the server, over WebSocket ("ws") or HTTP
+// ("http"), secured if the server is
+func (s *server) url(scheme, path string, query url.Values) string {
+	if s.secure {
+		scheme += "s"
+	}
+	u := url.URL{Scheme: scheme, Host: s.host, Path: s.prefix + path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// header returns the headers authorizing requests to the server
+func (s *server) header() http.Header {
+	header := http.Header{}
+	if s.token != "" {
+		header.Set("Authorization", "Bearer "+s.token)
+	}
+	return header
+}
+
+// request returns an authorized HTTP request to path on the server
+func (s *server) request(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url("http", path, query), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range s.header() {
+		req.Header[key] = values
+	}
+	return req, nil
+}
+
+// newHTTPClient returns the client for API requests to servers, dialing and
+// verifying certificates like dialer
+func newHTTPClient(dialer *websocket.Dialer) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if dialer.NetDialContext != nil {
+		transport.DialContext = dialer.NetDialContext
+	}
+	if dialer.TLSClientConfig != nil {
+		transport.TLSClientConfig = dialer.TLSClientConfig.Clone()
+	}
+	return &http.Client{Transport: transport}
+}
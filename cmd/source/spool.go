@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/frame"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// spoolQueue is how many frames may wait for the disk
+	spoolQueue = 256
+
+	// spoolTimeFormat names recordings by the capture time of their first
+	// frame, matching the server's upload names
+	spoolTimeFormat = "20060102T150405.000000Z"
+
+	wavHeaderSize = 44
+)
+
+// spool records the audio a server misses once it has been unreachable
+// for longer than the publish queue covers. Each unbroken run of missed
+// frames becomes a WAV file on disk, uploaded to the server's archive
+// once the source reconnects, so the archive stays complete even though
+// the live stream had an outage.
+type spool struct {
+	dir    string
+	server *server
+	wav    *audio.Processor
+	logger *zap.SugaredLogger
+
+	frames    chan []byte
+	reconnect chan struct{}
+	upload    chan struct{}
+
+	// The recording being written, owned by run
+	file *os.File
+	size uint32
+	next uint32
+}
+
+// newSpool creates a spool for the server under dir, finishing recordings
+// left incomplete by a previous run
+func newSpool(dir string, server *server, format ws.SourceFormat, logger *zap.SugaredLogger) (*spool, error) {
+	dir = filepath.Join(dir, strings.NewReplacer(":", "_", "/", "_", "\\", "_").Replace(server.addr))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:       dir,
+		server:    server,
+		wav:       audio.NewProcessor(format.SampleRate, format.Channels, 16),
+		logger:    logger,
+		frames:    make(chan []byte, spoolQueue),
+		reconnect: make(chan struct{}, 1),
+		upload:    make(chan struct{}, 1),
+	}
+
+	parts, err := filepath.Glob(filepath.Join(dir, "*.wav.part"))
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		if err := s.recoverPart(part); err != nil {
+			logger.Warnf("Failed to recover spooled recording %s: %v", part, err)
+		}
+	}
+	return s, nil
+}
+
+// add queues a frame the server missed. It never blocks.
+func (s *spool) add(msg []byte) {
+	select {
+	case s.frames <- msg:
+	default:
+		s.logger.Warn("Spool is behind, dropping a frame")
+	}
+}
+
+// reconnected ends the current recording and uploads the pending ones
+func (s *spool) reconnected() {
+	select {
+	case s.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// run writes missed frames until ctx is done, uploading after reconnects
+func (s *spool) run(ctx context.Context) {
+	go s.uploader(ctx)
+	defer s.finish()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-s.frames:
+			s.write(msg)
+		case <-s.reconnect:
+			// Frames drained from the queue on reconnect come first
+			for len(s.frames) > 0 {
+				s.write(<-s.frames)
+			}
+			s.finish()
+			select {
+			case s.upload <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// write appends a frame to the current recording, starting a new one when
+// the frame does not follow on from the last
+func (s *spool) write(msg []byte) {
+	header, payload, err := frame.Decode(msg)
+	if err != nil {
+		return
+	}
+	if s.file != nil && header.Seq != s.next {
+		s.finish()
+	}
+
+	if s.file == nil {
+		name := header.Captured.UTC().Format(spoolTimeFormat) + ".wav.part"
+		f, err := os.Create(filepath.Join(s.dir, name))
+		if err != nil {
+			s.logger.Errorf("Failed to spool missed audio: %v", err)
+			return
+		}
+		if _, err := f.Write(s.wav.Header(0)); err != nil {
+			s.logger.Errorf("Failed to spool missed audio: %v", err)
+			f.Close()
+			return
+		}
+		s.file, s.size = f, 0
+		s.logger.Infof("Spooling audio the server missed to %s", f.Name())
+	}
+
+	if _, err := s.file.Write(payload); err != nil {
+		s.logger.Errorf("Failed to spool missed audio: %v", err)
+		s.finish()
+		return
+	}
+	s.size += uint32(len(payload))
+	s.next = header.Seq + 1
+}
+
+// finish completes the current recording, if any
+func (s *spool) finish() {
+	if s.file == nil {
+		return
+	}
+	f := s.file
+	s.file = nil
+
+	_, err := f.WriteAt(s.wav.Header(s.size), 0)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), strings.TrimSuffix(f.Name(), ".part"))
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to finish spooled recording %s: %v", f.Name(), err)
+	}
+}
+
+// recoverPart fixes the header of a recording cut short, and completes it
+func (s *spool) recoverPart(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() > wavHeaderSize {
+		var sizes [4]byte
+		binary.LittleEndian.PutUint32(sizes[:], uint32(info.Size()-8))
+		if _, err = f.WriteAt(sizes[:], 4); err == nil {
+			binary.LittleEndian.PutUint32(sizes[:], uint32(info.Size()-wavHeaderSize))
+			_, err = f.WriteAt(sizes[:], wavHeaderSize-4)
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() <= wavHeaderSize {
+		return os.Remove(path)
+	}
+	return os.Rename(path, strings.TrimSuffix(path, ".part"))
+}
+
+// uploader uploads the finished recordings, oldest first, whenever asked
+func (s *spool) uploader(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.upload:
+		}
+
+		paths, err := filepath.Glob(filepath.Join(s.dir, "*.wav"))
+		if err != nil {
+			continue
+		}
+		for _, path := range paths {
+			if err := s.send(ctx, path); err != nil {
+				s.logger.Warnf("Failed to upload %s, will retry after the next reconnect: %v", filepath.Base(path), err)
+				break
+			}
+		}
+	}
+}
+
+// send uploads one recording to the server's archive and removes it.
+// Recordings the server refuses are removed too, since retrying cannot
+// help; only failures to reach the server are returned.
+func (s *spool) send(ctx context.Context, path string) error {
+	name := filepath.Base(path)
+	start, err := time.Parse(spoolTimeFormat, strings.TrimSuffix(name, ".wav"))
+	if err != nil {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"start": {start.Format(time.RFC3339Nano)}}
+	req, err := s.server.request(ctx, http.MethodPut, "/api/v1/dvr/uploads", query, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "audio/wav")
+
+	resp, err := s.server.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusCreated:
+		s.logger.Infof("Uploaded %s of missed audio", s.duration(info.Size()).Round(time.Second))
+	case resp.StatusCode >= 500:
+		return fmt.Errorf("server error %s", resp.Status)
+	default:
+		// Servers without a DVR answer with the index page
+		s.logger.Warnf("Server refused recording %s (%s), discarding it", name, resp.Status)
+	}
+	return os.Remove(path)
+}
+
+// duration returns how long a recording of size bytes lasts
+func (s *spool) duration(size int64) time.Duration {
+	bytesPerSecond := int64(s.wav.GetSampleRate() * s.wav.GetNumChannels() * 2)
+	return time.Duration((size - wavHeaderSize) * int64(time.Second) / bytesPerSecond)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/frame"
+	"go.uber.org/zap"
+)
+
+// talkGate holds the audio back until the broadcaster talks: while the
+// push-to-talk key has been pressed, or with VOX while the level stays
+// above a threshold and for a hang time after. Held back audio is not sent
+// at all, so a quiet intercom costs no bandwidth.
+type talkGate struct {
+	vox       bool
+	threshold float64
+	hang      time.Duration
+	onAir     *onAir
+	logger    *zap.SugaredLogger
+
+	mu      sync.Mutex
+	pressed bool
+	loudAt  time.Time
+	talking bool
+}
+
+// newPushToTalk returns a gate opened and closed by pressing key
+func newPushToTalk(onAir *onAir, logger *zap.SugaredLogger) *talkGate {
+	g := &talkGate{onAir: onAir, logger: logger}
+	onAir.setStandby(true)
+	return g
+}
+
+// newVOX returns a gate open while the level is above threshold (in dBFS)
+// and for hang after it falls below
+func newVOX(threshold float64, hang time.Duration, onAir *onAir, logger *zap.SugaredLogger) *talkGate {
+	g := &talkGate{vox: true, threshold: threshold, hang: hang, onAir: onAir, logger: logger}
+	onAir.setStandby(true)
+	return g
+}
+
+// update measures a captured buffer and reports whether to send it, and
+// whether it starts a transmission
+func (g *talkGate) update(buf []float32, now time.Time) (send, start bool) {
+	if g == nil {
+		return true, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	talking := g.pressed
+	if g.vox {
+		if rmsDBFS(buf) >= g.threshold {
+			g.loudAt = now
+		}
+		talking = !g.loudAt.IsZero() && now.Sub(g.loudAt) <= g.hang
+	}
+	start = talking && !g.talking
+	if talking != g.talking {
+		g.talking = talking
+		g.onAir.setStandby(!talking)
+		if talking {
+			g.logger.Info("Transmitting")
+		} else {
+			g.logger.Info("Stopped transmitting")
+		}
+	}
+	return talking, start
+}
+
+// toggle presses or releases push-to-talk
+func (g *talkGate) toggle() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pressed = !g.pressed
+}
+
+// readKeys toggles push-to-talk each time key is pressed, until stdin
+// closes
+func (g *talkGate) readKeys(key byte) {
+	r := bufio.NewReader(os.Stdin)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if b == key {
+			g.toggle()
+		}
+	}
+}
+
+// parseKey returns the byte a push-to-talk key name types: a single
+// character, or space, enter or tab
+func parseKey(name string) (byte, error) {
+	switch name {
+	case "space":
+		return ' ', nil
+	case "enter":
+		return '\n', nil
+	case "tab":
+		return '\t', nil
+	}
+	if len(name) != 1 {
+		return 0, fmt.Errorf("unknown key %q (use a single character, space, enter or tab)", name)
+	}
+	return name[0], nil
+}
+
+// rmsDBFS returns the RMS level of samples in dBFS
+func rmsDBFS(samples []float32) float64 {
+	if len(samples) == 0 {
+		return math.Inf(-1)
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return 10 * math.Log10(sum/float64(len(samples)))
+}
+
+// heldAudio is the payloads of one captured buffer, kept until sent
+type heldAudio struct {
+	captured time.Time
+	flags    frame.Flags
+	payloads [][]byte
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// rawInput switches the terminal to deliver keys as they are pressed,
+// without echo, and returns a function restoring it. Ctrl+C still
+// interrupts.
+func rawInput() (restore func(), ok bool) {
+	fd := int(os.Stdin.Fd())
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return func() {}, false
+	}
+
+	raw := *old
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return func() {}, false
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlSetTermios, old) }, true
+}
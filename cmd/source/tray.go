@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+
+	"fyne.io/systray"
+)
+
+// runTray shows a system tray icon with the connection status and mute/quit
+// menu items. Quitting from the menu is delivered as an interrupt so the
+// normal shutdown path runs. It blocks until systray.Quit is called and must
+// run on the main goroutine.
+func runTray(status <-chan string, setMuted func(bool), interrupt chan<- os.Signal) {
+	systray.Run(func() {
+		systray.SetIcon(trayIcon())
+		systray.SetTitle("minicast")
+		systray.SetTooltip("minicast source")
+
+		statusItem := systray.AddMenuItem("Connecting...", "Connection status")
+		statusItem.Disable()
+		systray.AddSeparator()
+		muteItem := systray.AddMenuItemCheckbox("Mute", "Send silence instead of the microphone", false)
+		quitItem := systray.AddMenuItem("Quit", "Stop streaming and exit")
+
+		go func() {
+			// The connection status and mute are kept apart, so neither
+			// hides the other
+			connection, muted := "Connecting...", false
+			for {
+				select {
+				case connection = <-status:
+				case <-muteItem.ClickedCh:
+					muted = !muted
+					if muted {
+						muteItem.Check()
+					} else {
+						muteItem.Uncheck()
+					}
+					setMuted(muted)
+				case <-quitItem.ClickedCh:
+					interrupt <- os.Interrupt
+					return
+				}
+				label := trayLabel(connection, muted)
+				statusItem.SetTitle(label)
+				systray.SetTooltip("minicast: " + label)
+			}
+		}()
+	}, nil)
+}
+
+// trayLabel describes the connection status, noting when the microphone
+// is muted, e.g. "Disconnected (muted)"
+func trayLabel(connection string, muted bool) string {
+	if muted {
+		return connection + " (muted)"
+	}
+	return connection
+}
+
+// trayIcon renders a small red "on air" dot as a PNG
+func trayIcon() []byte {
+	const size = 22
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	center := size / 2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			dx, dy := x-center, y-center
+			if dx*dx+dy*dy <= (center-2)*(center-2) {
+				img.Set(x, y, color.RGBA{R: 220, G: 53, B: 69, A: 255})
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/frame"
+)
+
+const (
+	// udpHistory is how many recent frames are kept to resend when the
+	// server reports them lost
+	udpHistory = 64
+	// udpHelloInterval is how often the hello is repeated, first until the
+	// server answers and then as a keepalive
+	udpHelloInterval = time.Second
+	// udpHandshakeTimeout is how long to wait for the server to answer
+	// before falling back to WebSocket
+	udpHandshakeTimeout = 3 * time.Second
+	// udpTimeout is how long the server may go unheard once streaming
+	udpTimeout = 5 * time.Second
+)
+
+// errNoUDP means UDP does not get through to the server, so the publisher
+// should use a WebSocket instead
+var errNoUDP = errors.New("udp unavailable")
+
+// sentFrame is a frame's packets, kept in case the server asks for them
+type sentFrame struct {
+	seq     uint32
+	packets [][]byte
+}
+
+// connect streams to the server once, over UDP when asked to, falling back
+// to a WebSocket when UDP does not get through
+func (p *publisher) connect(ctx context.Context) error {
+	if !p.udp {
+		return p.stream(ctx)
+	}
+	err := p.streamUDP(ctx)
+	if !errors.Is(err, errNoUDP) || ctx.Err() != nil {
+		return err
+	}
+	p.logger.Warnf("Falling back to WebSocket: %v", err)
+	return p.stream(ctx)
+}
+
+// streamUDP sends queued frames over UDP, resending those the server asks
+// for, until the server stops answering, refuses the source, or ctx is
+// done
+func (p *publisher) streamUDP(ctx context.Context) error {
+	dial := p.dialer.NetDialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	c, err := dial(ctx, "udp", p.server.host)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNoUDP, err)
+	}
+	defer c.Close()
+
+	session := rand.Uint32()
+	// Without headers, the token travels in the hello, unencrypted
+	body := p.handshake
+	if p.server.token != "" {
+		if body, err = p.format.Hello(p.server.token); err != nil {
+			return err
+		}
+	}
+	hello := frame.EncodePacket(frame.Packet{Type: frame.PacketHello, Session: session, Body: body})
+
+	// Read so acks, retransmit requests and rejections are noticed
+	accepted := make(chan struct{}, 1)
+	nacks := make(chan []uint32, 16)
+	closed := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				closed <- fmt.Errorf("%w: %v", errNoUDP, err)
+				return
+			}
+			packet, err := frame.DecodePacket(buf[:n])
+			if err != nil || packet.Session != session {
+				continue
+			}
+			switch packet.Type {
+			case frame.PacketAccept:
+				select {
+				case accepted <- struct{}{}:
+				default:
+				}
+			case frame.PacketReject:
+				closed <- fmt.Errorf("server says: %s", packet.Body)
+				return
+			case frame.PacketNack:
+				select {
+				case nacks <- frame.DecodeNack(packet.Body):
+				default:
+				}
+			}
+		}
+	}()
+
+	// Say hello until the server answers
+	if _, err := c.Write(hello); err != nil {
+		return fmt.Errorf("%w: %v", errNoUDP, err)
+	}
+	retry := time.NewTicker(udpHelloInterval / 4)
+	timeout := time.After(udpHandshakeTimeout)
+handshake:
+	for {
+		select {
+		case <-ctx.Done():
+			retry.Stop()
+			return nil
+		case err := <-closed:
+			retry.Stop()
+			return err
+		case <-timeout:
+			retry.Stop()
+			return fmt.Errorf("%w: no answer in %s", errNoUDP, udpHandshakeTimeout)
+		case <-retry.C:
+			c.Write(hello)
+		case <-accepted:
+			retry.Stop()
+			break handshake
+		}
+	}
+
+	p.logger.Infof("Connected to udp://%s", p.server.host)
+	p.group.setConnected(p, true)
+	if p.spool != nil {
+		p.spool.reconnected()
+	}
+	queue, stop := p.startPacing()
+	defer stop()
+	if md := p.nowPlaying(); md != nil {
+		go p.putMetadata(*md)
+	}
+
+	var history [udpHistory]sentFrame
+	keepalive := time.NewTicker(udpHelloInterval)
+	defer keepalive.Stop()
+	heard, helloSent := time.Now(), time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			c.Write(frame.EncodePacket(frame.Packet{Type: frame.PacketBye, Session: session}))
+			return nil
+		case err := <-closed:
+			return err
+		case <-accepted:
+			heard = time.Now()
+			// Each hello is answered, so the answer times the round trip
+			if !helloSent.IsZero() {
+				p.stats.setRTT(heard.Sub(helloSent))
+				helloSent = time.Time{}
+			}
+		case <-p.metadataChanged:
+			if md := p.nowPlaying(); md != nil {
+				go p.putMetadata(*md)
+			}
+		case <-keepalive.C:
+			if time.Since(heard) > udpTimeout {
+				return fmt.Errorf("%w: no answer in %s", errNoUDP, udpTimeout)
+			}
+			c.Write(hello)
+			helloSent = time.Now()
+		case seqs := <-nacks:
+			for _, seq := range seqs {
+				sent := &history[seq%udpHistory]
+				if sent.packets == nil || sent.seq != seq {
+					continue
+				}
+				for _, packet := range sent.packets {
+					if n, err := c.Write(packet); err == nil {
+						p.stats.sent(false, n)
+					}
+				}
+			}
+		case msg := <-queue:
+			h, _, err := frame.Decode(msg)
+			if err != nil {
+				continue
+			}
+			packets, err := frame.SplitFrame(session, msg)
+			if err != nil {
+				p.logger.Warnf("Dropped frame: %v", err)
+				continue
+			}
+			history[h.Seq%udpHistory] = sentFrame{seq: h.Seq, packets: packets}
+			for _, packet := range packets {
+				n, err := c.Write(packet)
+				if err != nil {
+					return fmt.Errorf("%w: %v", errNoUDP, err)
+				}
+				p.stats.sent(false, n)
+			}
+			p.stats.frames.Add(1)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// pingInterval is how often a WebSocket connection is pinged
+	pingInterval = 5 * time.Second
+	// pongTimeout is how long the server may go unheard before the
+	// connection counts as hung and is dropped
+	pongTimeout = 12 * time.Second
+	// writeTimeout bounds a single write, so a stalled uplink is noticed
+	// even while pongs still arrive
+	writeTimeout = 10 * time.Second
+)
+
+// uplinkStats counts what a publisher sends
+type uplinkStats struct {
+	frames atomic.Int64
+	bytes  atomic.Int64
+	// rtt is the last round trip to the server, in nanoseconds
+	rtt atomic.Int64
+
+	// lastFrames and lastBytes are the counts at the previous log
+	lastFrames, lastBytes int64
+}
+
+// sent counts a write of n bytes, and a frame if it carried audio
+func (s *uplinkStats) sent(frame bool, n int) {
+	if frame {
+		s.frames.Add(1)
+	}
+	s.bytes.Add(int64(n))
+}
+
+// setRTT records a measured round trip
+func (s *uplinkStats) setRTT(rtt time.Duration) {
+	s.rtt.Store(int64(rtt))
+}
+
+// uplink wraps a source's WebSocket, bounding and counting each write
+type uplink struct {
+	*websocket.Conn
+	stats *uplinkStats
+}
+
+// newUplink wraps c, treating it as hung once pongTimeout passes without
+// a pong. It only takes effect while c is being read.
+func newUplink(c *websocket.Conn, stats *uplinkStats) uplink {
+	c.SetReadDeadline(time.Now().Add(pongTimeout))
+	c.SetPongHandler(func(data string) error {
+		c.SetReadDeadline(time.Now().Add(pongTimeout))
+		if sent, err := strconv.ParseInt(data, 10, 64); err == nil {
+			stats.setRTT(time.Since(time.Unix(0, sent)))
+		}
+		return nil
+	})
+	return uplink{Conn: c, stats: stats}
+}
+
+// WriteMessage writes a message, failing if it takes over writeTimeout
+func (u uplink) WriteMessage(messageType int, data []byte) error {
+	u.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := u.Conn.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	u.stats.sent(messageType == websocket.BinaryMessage, len(data))
+	return nil
+}
+
+// WriteJSON writes v as a text message
+func (u uplink) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return u.WriteMessage(websocket.TextMessage, data)
+}
+
+// ping sends a ping carrying the time, so its pong measures the round trip
+func (u uplink) ping() error {
+	data := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	return u.WriteControl(websocket.PingMessage, data, time.Now().Add(writeTimeout))
+}
+
+// logStats logs each server's uplink every interval until ctx is done:
+// frames and kilobits sent per second since the last log, the total bytes
+// sent, and the last round trip. Servers neither connected nor sent to
+// since the last log are left out, their reconnects being logged already.
+func (g *publishers) logStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			seconds := now.Sub(last).Seconds()
+			last = now
+			for _, p := range g.list {
+				s := &p.stats
+				frames, bytes := s.frames.Load(), s.bytes.Load()
+				newFrames, newBytes := frames-s.lastFrames, bytes-s.lastBytes
+				s.lastFrames, s.lastBytes = frames, bytes
+
+				g.mu.Lock()
+				connected := g.connected[p]
+				g.mu.Unlock()
+				if !connected && newBytes == 0 {
+					continue
+				}
+				fields := []any{
+					"frames_per_sec", math.Round(float64(newFrames)/seconds*10) / 10,
+					"kbps", math.Round(float64(newBytes)*8/1000/seconds*10) / 10,
+					"bytes_sent", bytes,
+				}
+				if rtt := s.rtt.Load(); rtt > 0 {
+					fields = append(fields, "rtt", time.Duration(rtt).Round(100*time.Microsecond).String())
+				}
+				p.logger.Infow("Uplink", fields...)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+func init() {
+	RegisterStage("agc", newAGCStage)
+}
+
+const (
+	// agcWindow is the time constant of the AGC's RMS level detector
+	agcWindow = 300 * time.Millisecond
+	// agcFloorDBFS is the level below which the AGC holds its gain, so
+	// pauses and room noise are not pulled up to the target
+	agcFloorDBFS = -50
+)
+
+// AGC is an automatic gain control: it measures the RMS level and steers
+// the gain towards the target level, bringing quiet speakers up and taming
+// loud passages. The gain falls at the attack rate and rises at the slower
+// release rate. Channels share one gain so the stereo image is kept.
+type AGC struct {
+	numChannels int
+	target      float64
+	floor       float64
+	maxGain     float64
+	minGain     float64
+
+	levelCoeff   float64
+	attackCoeff  float64
+	releaseCoeff float64
+
+	// level is the smoothed mean square of the signal
+	level float64
+	gain  float64
+}
+
+// NewAGC creates an AGC for interleaved PCM at sampleRate. target is the
+// RMS level to aim for in dBFS and maxGain bounds the boost (and cut) in
+// decibels.
+func NewAGC(sampleRate, numChannels int, target, maxGain float64, attack, release time.Duration) *AGC {
+	return &AGC{
+		numChannels:  numChannels,
+		target:       math.Pow(10, target/20),
+		floor:        math.Pow(10, agcFloorDBFS/20.0),
+		maxGain:      math.Pow(10, maxGain/20),
+		minGain:      math.Pow(10, -maxGain/20),
+		levelCoeff:   smoothingCoeff(agcWindow, sampleRate),
+		attackCoeff:  smoothingCoeff(attack, sampleRate),
+		releaseCoeff: smoothingCoeff(release, sampleRate),
+		gain:         1,
+	}
+}
+
+// newAGCStage creates an AGC from the "target" (dBFS), "max_gain" (dB),
+// "attack" and "release" options
+func newAGCStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	target, err := options.Float("target", -18)
+	if err != nil {
+		return nil, err
+	}
+	if target >= 0 {
+		return nil, fmt.Errorf("target must be below 0 dBFS")
+	}
+	maxGain, err := options.Float("max_gain", 20)
+	if err != nil {
+		return nil, err
+	}
+	if maxGain < 0 {
+		return nil, fmt.Errorf("max_gain must not be negative")
+	}
+	attack, err := options.Duration("attack", 50*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	release, err := options.Duration("release", 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return NewAGC(sampleRate, numChannels, target, maxGain, attack, release), nil
+}
+
+// Process applies the gain in place
+func (a *AGC) Process(pcm []int16) []int16 {
+	for i := 0; i+a.numChannels <= len(pcm); i += a.numChannels {
+		var square float64
+		for _, sample := range pcm[i : i+a.numChannels] {
+			s := float64(sample) / 32768
+			square += s * s
+		}
+		square /= float64(a.numChannels)
+		a.level = square + a.levelCoeff*(a.level-square)
+
+		if rms := math.Sqrt(a.level); rms > a.floor {
+			want := math.Max(a.minGain, math.Min(a.maxGain, a.target/rms))
+			coeff := a.releaseCoeff
+			if want < a.gain {
+				coeff = a.attackCoeff
+			}
+			a.gain = want + coeff*(a.gain-want)
+		}
+
+		for ch := i; ch < i+a.numChannels; ch++ {
+			pcm[ch] = clip16(float64(pcm[ch]) * a.gain)
+		}
+	}
+	return pcm
+}
+
+// smoothingCoeff returns the one-pole filter coefficient for a time
+// constant at sampleRate; zero means no smoothing
+func smoothingCoeff(t time.Duration, sampleRate int) float64 {
+	if t <= 0 {
+		return 0
+	}
+	return math.Exp(-1 / (t.Seconds() * float64(sampleRate)))
+}
@@ -0,0 +1,99 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrOpusUnavailable is returned when the binary was built without libopus
+var ErrOpusUnavailable = errors.New("opus support not compiled in (build with -tags opus)")
+
+// OpusSampleRate is the rate Opus packets are decoded at
+const OpusSampleRate = 48000
+
+// FrameDecoder decodes a single compressed packet into interleaved 16-bit PCM
+type FrameDecoder interface {
+	Decode(packet []byte) ([]int16, error)
+}
+
+// FrameEncoder encodes one frame of interleaved 16-bit PCM into a packet
+type FrameEncoder interface {
+	Encode(pcm []int16) ([]byte, error)
+}
+
+// Opus applications, tuning the encoder for what it carries
+const (
+	// OpusVoIP favours speech intelligibility
+	OpusVoIP = "voip"
+	// OpusAudio favours fidelity to the input, for music
+	OpusAudio = "audio"
+)
+
+// newOpusDecoder is replaced by the cgo implementation when built with the
+// opus tag, keeping the default build free of a libopus dependency
+var newOpusDecoder func(sampleRate, numChannels int) (FrameDecoder, error)
+
+// newOpusEncoder is likewise replaced when built with the opus tag
+var newOpusEncoder func(sampleRate, numChannels int, voip bool) (FrameEncoder, error)
+
+// OpusAvailable reports whether Opus support was compiled in
+func OpusAvailable() bool {
+	return newOpusDecoder != nil
+}
+
+// NewOpusDecoder creates an Opus packet decoder producing PCM at sampleRate.
+// Rates libopus cannot decode to natively (such as 44100) are resampled from
+// 48kHz.
+func NewOpusDecoder(sampleRate, numChannels int) (FrameDecoder, error) {
+	if newOpusDecoder == nil {
+		return nil, ErrOpusUnavailable
+	}
+
+	switch sampleRate {
+	case 8000, 12000, 16000, 24000, OpusSampleRate:
+		return newOpusDecoder(sampleRate, numChannels)
+	}
+
+	dec, err := newOpusDecoder(OpusSampleRate, numChannels)
+	if err != nil {
+		return nil, err
+	}
+	return &resampledDecoder{
+		dec:       dec,
+		resampler: NewLinearResampler(numChannels, OpusSampleRate, sampleRate),
+	}, nil
+}
+
+// resampledDecoder converts a decoder's output to another sample rate
+type resampledDecoder struct {
+	dec       FrameDecoder
+	resampler *LinearResampler
+}
+
+// Decode decodes a packet and resamples the result
+func (d *resampledDecoder) Decode(packet []byte) ([]int16, error) {
+	pcm, err := d.dec.Decode(packet)
+	if err != nil {
+		return nil, err
+	}
+	return d.resampler.Process(pcm), nil
+}
+
+// NewOpusEncoder creates an Opus encoder for PCM at sampleRate, which must
+// be one libopus encodes natively (8, 12, 16, 24 or 48kHz). application is
+// OpusVoIP or OpusAudio. Frames passed to Encode must be 2.5, 5, 10, 20, 40
+// or 60ms long.
+func NewOpusEncoder(sampleRate, numChannels int, application string) (FrameEncoder, error) {
+	if newOpusEncoder == nil {
+		return nil, ErrOpusUnavailable
+	}
+	if application != OpusVoIP && application != OpusAudio {
+		return nil, fmt.Errorf("unknown opus application %q", application)
+	}
+	switch sampleRate {
+	case 8000, 12000, 16000, 24000, OpusSampleRate:
+	default:
+		return nil, fmt.Errorf("opus cannot encode at %dHz", sampleRate)
+	}
+	return newOpusEncoder(sampleRate, numChannels, application == OpusVoIP)
+}
@@ -0,0 +1,161 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// Decoded is a stream of interleaved 16-bit little-endian PCM
+type Decoded struct {
+	io.Reader
+	SampleRate  int
+	NumChannels int
+}
+
+// NewDecoder wraps an encoded audio stream and returns its PCM output. The
+// format is picked from the content type, falling back to sniffing the data.
+func NewDecoder(contentType string, r io.Reader) (*Decoded, error) {
+	br := bufio.NewReader(r)
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "audio/mpeg" || mediaType == "audio/mp3":
+		return decodeMP3(br)
+	case strings.HasSuffix(mediaType, "wav") || strings.HasSuffix(mediaType, "wave"):
+		return decodeWAV(br)
+	case mediaType == "audio/ogg" || mediaType == "audio/opus":
+		return decodeOggOpus(br)
+	}
+
+	head, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stream header: %v", err)
+	}
+	if bytes.Equal(head, []byte("RIFF")) {
+		return decodeWAV(br)
+	}
+	if bytes.Equal(head, []byte("OggS")) {
+		return decodeOggOpus(br)
+	}
+	return decodeMP3(br)
+}
+
+// decodeMP3 decodes an MP3 stream, which always yields 16-bit stereo
+func decodeMP3(r io.Reader) (*Decoded, error) {
+	dec, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode mp3: %v", err)
+	}
+	return &Decoded{Reader: dec, SampleRate: dec.SampleRate(), NumChannels: 2}, nil
+}
+
+// maxWAVFormatChunk bounds the fmt chunk, which is 40 bytes even for
+// WAVE_FORMAT_EXTENSIBLE
+const maxWAVFormatChunk = 256
+
+// decodeWAV skips a WAV header and returns the PCM data that follows it
+func decodeWAV(r *bufio.Reader) (*Decoded, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return nil, fmt.Errorf("failed to read wav header: %v", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a wav stream")
+	}
+
+	var sampleRate, numChannels, bitDepth int
+	var float bool
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil, fmt.Errorf("failed to read wav chunk: %v", err)
+		}
+		id := string(chunk[0:4])
+		size := binary.LittleEndian.Uint32(chunk[4:8])
+
+		switch id {
+		case "fmt ":
+			// The size comes from the stream, so bound it before allocating
+			if size > maxWAVFormatChunk {
+				return nil, fmt.Errorf("wav format chunk too large (%d bytes)", size)
+			}
+			format := make([]byte, size+size%2)
+			if _, err := io.ReadFull(r, format); err != nil {
+				return nil, fmt.Errorf("failed to read wav format: %v", err)
+			}
+			format = format[:size]
+			if len(format) < 16 {
+				return nil, fmt.Errorf("wav format chunk too short")
+			}
+			tag := binary.LittleEndian.Uint16(format[0:2])
+			// WAVE_FORMAT_EXTENSIBLE keeps the real tag in its subformat GUID
+			if tag == 0xFFFE && len(format) >= 26 {
+				tag = binary.LittleEndian.Uint16(format[24:26])
+			}
+			float = tag == 3
+			numChannels = int(binary.LittleEndian.Uint16(format[2:4]))
+			sampleRate = int(binary.LittleEndian.Uint32(format[4:8]))
+			bitDepth = int(binary.LittleEndian.Uint16(format[14:16]))
+		case "data":
+			if sampleRate == 0 {
+				return nil, fmt.Errorf("wav data before format chunk")
+			}
+			// Streamed WAVs often carry a bogus data size, so read to EOF
+			decoded := &Decoded{Reader: r, SampleRate: sampleRate, NumChannels: numChannels}
+			if bitDepth == 16 && !float {
+				return decoded, nil
+			}
+			conv, err := NewDepthConverter(bitDepth, float)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported wav format: %v", err)
+			}
+			decoded.Reader = &convertingReader{r: r, dec: conv, sampleSize: bitDepth / 8}
+			return decoded, nil
+		default:
+			if _, err := io.CopyN(io.Discard, r, int64(size)+int64(size%2)); err != nil {
+				return nil, fmt.Errorf("failed to skip wav chunk: %v", err)
+			}
+		}
+	}
+}
+
+// convertingReader converts a stream to 16-bit PCM with a FrameDecoder
+type convertingReader struct {
+	r          io.Reader
+	dec        FrameDecoder
+	sampleSize int
+	in         []byte
+	out        []byte
+}
+
+// Read returns converted samples, reading whole samples from the stream
+func (c *convertingReader) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.in == nil {
+			c.in = make([]byte, 4096*c.sampleSize)
+		}
+		n, err := io.ReadFull(c.r, c.in)
+		n -= n % c.sampleSize
+		if n > 0 {
+			pcm, _ := c.dec.Decode(c.in[:n])
+			c.out = PCMToBytes(pcm)
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil && len(c.out) == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
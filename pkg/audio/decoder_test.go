@@ -0,0 +1,66 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// wavChunk returns a RIFF chunk, padded to an even size
+func wavChunk(id string, size uint32, body []byte) []byte {
+	b := append([]byte(id), binary.LittleEndian.AppendUint32(nil, size)...)
+	b = append(b, body...)
+	if len(body)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestDecodeWAVSkipsChunks(t *testing.T) {
+	header := NewProcessor(48000, 2, 16).Header(8)
+	pcm := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// An odd-sized chunk between the format and the data
+	stream := append([]byte{}, header[:36]...)
+	stream = append(stream, wavChunk("LIST", 3, []byte("abc"))...)
+	stream = append(stream, header[36:]...)
+	stream = append(stream, pcm...)
+
+	decoded, err := NewDecoder("audio/wav", bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.SampleRate != 48000 || decoded.NumChannels != 2 {
+		t.Fatalf("got %dHz %d channels, want 48000Hz 2 channels", decoded.SampleRate, decoded.NumChannels)
+	}
+	got, err := io.ReadAll(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, pcm) {
+		t.Fatalf("got %v, want %v", got, pcm)
+	}
+}
+
+func TestDecodeWAVRejectsHugeFormatChunk(t *testing.T) {
+	stream := []byte("RIFF\x00\x00\x00\x00WAVE")
+	stream = append(stream, wavChunk("fmt ", 0xFFFFFFF0, nil)...)
+
+	_, err := NewDecoder("audio/wav", bytes.NewReader(stream))
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("got error %v, want a too large format chunk", err)
+	}
+}
+
+func TestDecodeWAVHugeUnknownChunk(t *testing.T) {
+	stream := []byte("RIFF\x00\x00\x00\x00WAVE")
+	stream = append(stream, wavChunk("junk", 0xFFFFFFFF, nil)...)
+
+	// The chunk is skipped rather than read into memory, so decoding stops
+	// at the end of the stream
+	if _, err := NewDecoder("audio/wav", bytes.NewReader(stream)); err == nil {
+		t.Fatal("decoded a stream that ends inside a chunk")
+	}
+}
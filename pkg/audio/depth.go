@@ -0,0 +1,72 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// DepthConverter reduces 24-bit integer or 32-bit float PCM (little-endian,
+// interleaved) to 16-bit. Truncating to 16 bits turns the discarded bits
+// into distortion that follows the signal, audible on quiet passages and
+// fades; adding TPDF (triangular) dither of one 16-bit step first turns it
+// into a constant, benign noise floor instead.
+type DepthConverter struct {
+	bitDepth int
+	float    bool
+	rng      uint64
+}
+
+// NewDepthConverter creates a converter from 24-bit integer PCM, or from
+// 32-bit float PCM when float is set
+func NewDepthConverter(bitDepth int, float bool) (*DepthConverter, error) {
+	switch {
+	case float && bitDepth != 32:
+		return nil, fmt.Errorf("unsupported float bit depth %d", bitDepth)
+	case !float && bitDepth != 24:
+		return nil, fmt.Errorf("unsupported bit depth %d", bitDepth)
+	}
+	return &DepthConverter{bitDepth: bitDepth, float: float, rng: 0x9E3779B97F4A7C15}, nil
+}
+
+// Decode converts a packet to 16-bit samples. A trailing partial sample is
+// ignored.
+func (c *DepthConverter) Decode(packet []byte) ([]int16, error) {
+	size := c.bitDepth / 8
+	pcm := make([]int16, len(packet)/size)
+
+	for i := range pcm {
+		b := packet[i*size : i*size+size]
+
+		// The sample scaled so that one unit is one 16-bit step
+		var v float64
+		if c.float {
+			f := float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+			if math.IsNaN(f) {
+				f = 0
+			}
+			v = math.Max(-1, math.Min(1, f)) * 32767
+		} else {
+			// Sign-extend the 24-bit sample via the top of an int32
+			s := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			v = float64(s) / 256
+		}
+
+		pcm[i] = clip16(v + c.tpdf())
+	}
+	return pcm, nil
+}
+
+// tpdf returns triangular noise spanning ±1, the sum of two uniform values
+func (c *DepthConverter) tpdf() float64 {
+	return c.uniform() - c.uniform()
+}
+
+// uniform returns a value in [0, 1) from a xorshift generator, which is
+// plenty for dither and avoids contention on math/rand
+func (c *DepthConverter) uniform() float64 {
+	c.rng ^= c.rng << 13
+	c.rng ^= c.rng >> 7
+	c.rng ^= c.rng << 17
+	return float64(c.rng>>11) / (1 << 53)
+}
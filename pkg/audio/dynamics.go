@@ -0,0 +1,251 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+func init() {
+	RegisterStage("compressor", newCompressorStage)
+	RegisterStage("limiter", newLimiterStage)
+}
+
+// Compressor is a feed-forward broadcast compressor: once the peak level
+// rises above the threshold, every further decibel only raises the output
+// by 1/ratio of a decibel. Channels share one gain so the stereo image is
+// kept.
+type Compressor struct {
+	numChannels int
+	threshold   float64
+	slope       float64
+	makeup      float64
+
+	attackCoeff  float64
+	releaseCoeff float64
+
+	// envelope is the smoothed peak level, linear
+	envelope float64
+}
+
+// NewCompressor creates a compressor for interleaved PCM at sampleRate.
+// threshold is in dBFS and makeup in dB.
+func NewCompressor(sampleRate, numChannels int, threshold, ratio, makeup float64, attack, release time.Duration) *Compressor {
+	return &Compressor{
+		numChannels:  numChannels,
+		threshold:    threshold,
+		slope:        1 - 1/ratio,
+		makeup:       makeup,
+		attackCoeff:  smoothingCoeff(attack, sampleRate),
+		releaseCoeff: smoothingCoeff(release, sampleRate),
+	}
+}
+
+// newCompressorStage creates a compressor from the "threshold" (dBFS),
+// "ratio", "attack", "release" and "makeup" (dB) options
+func newCompressorStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	threshold, err := options.Float("threshold", -18)
+	if err != nil {
+		return nil, err
+	}
+	ratio, err := options.Float("ratio", 4)
+	if err != nil {
+		return nil, err
+	}
+	if ratio < 1 {
+		return nil, fmt.Errorf("ratio must be at least 1")
+	}
+	makeup, err := options.Float("makeup", 0)
+	if err != nil {
+		return nil, err
+	}
+	attack, err := options.Duration("attack", 10*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	release, err := options.Duration("release", 200*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return NewCompressor(sampleRate, numChannels, threshold, ratio, makeup, attack, release), nil
+}
+
+// Process compresses pcm in place
+func (c *Compressor) Process(pcm []int16) []int16 {
+	for i := 0; i+c.numChannels <= len(pcm); i += c.numChannels {
+		var peak float64
+		for _, sample := range pcm[i : i+c.numChannels] {
+			peak = math.Max(peak, math.Abs(float64(sample)/32768))
+		}
+
+		coeff := c.releaseCoeff
+		if peak > c.envelope {
+			coeff = c.attackCoeff
+		}
+		c.envelope = peak + coeff*(c.envelope-peak)
+
+		gainDB := c.makeup
+		if level := 20 * math.Log10(c.envelope); level > c.threshold {
+			gainDB -= (level - c.threshold) * c.slope
+		}
+		gain := math.Pow(10, gainDB/20)
+
+		for ch := i; ch < i+c.numChannels; ch++ {
+			pcm[ch] = clip16(float64(pcm[ch]) * gain)
+		}
+	}
+	return pcm
+}
+
+// Limiter is a brickwall look-ahead limiter: output peaks never exceed the
+// ceiling. It delays the audio by the look-ahead so the gain can ramp down
+// before a peak arrives instead of clipping it, then recovers at the
+// release rate. Channels share one gain.
+type Limiter struct {
+	numChannels  int
+	ceiling      float64
+	lookahead    int
+	releaseCoeff float64
+
+	// delay holds the last lookahead-1 frames of audio, interleaved
+	delay    []float64
+	delayPos int
+
+	// required is the gain each of the last lookahead frames needs, and
+	// minima a monotonic queue of indexes into it for the running minimum
+	required []float64
+	minima   []int
+	count    int
+
+	// held is the running minimum of the last lookahead frames, and sum
+	// the running total of held over the same span for the attack ramp
+	held    []float64
+	sum     float64
+	heldPos int
+
+	gain float64
+}
+
+// NewLimiter creates a limiter for interleaved PCM at sampleRate with the
+// ceiling in dBFS
+func NewLimiter(sampleRate, numChannels int, ceiling float64, lookahead, release time.Duration) *Limiter {
+	frames := max(1, int(lookahead.Seconds()*float64(sampleRate)))
+	l := &Limiter{
+		numChannels:  numChannels,
+		ceiling:      math.Pow(10, ceiling/20),
+		lookahead:    frames,
+		releaseCoeff: smoothingCoeff(release, sampleRate),
+		delay:        make([]float64, (frames-1)*numChannels),
+		required:     make([]float64, frames),
+		held:         make([]float64, frames),
+		sum:          float64(frames),
+		gain:         1,
+	}
+	for i := range l.held {
+		l.held[i] = 1
+	}
+	return l
+}
+
+// newLimiterStage creates a limiter from the "ceiling" (dBFS), "lookahead"
+// and "release" options
+func newLimiterStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	ceiling, err := options.Float("ceiling", -1)
+	if err != nil {
+		return nil, err
+	}
+	if ceiling > 0 {
+		return nil, fmt.Errorf("ceiling must not be above 0 dBFS")
+	}
+	lookahead, err := options.Duration("lookahead", 5*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	release, err := options.Duration("release", 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return NewLimiter(sampleRate, numChannels, ceiling, lookahead, release), nil
+}
+
+// Process limits pcm in place
+func (l *Limiter) Process(pcm []int16) []int16 {
+	frame := make([]float64, l.numChannels)
+	for i := 0; i+l.numChannels <= len(pcm); i += l.numChannels {
+		for ch := range frame {
+			frame[ch] = float64(pcm[i+ch]) / 32768
+		}
+		l.limit(frame)
+		for ch, v := range frame {
+			pcm[i+ch] = clip16(v * 32768)
+		}
+	}
+	return pcm
+}
+
+// ProcessFloat limits float samples in [-1, 1] full scale in place, for
+// audio that has not yet been converted to 16-bit and may exceed full scale
+func (l *Limiter) ProcessFloat(samples []float32) []float32 {
+	frame := make([]float64, l.numChannels)
+	for i := 0; i+l.numChannels <= len(samples); i += l.numChannels {
+		for ch := range frame {
+			frame[ch] = float64(samples[i+ch])
+		}
+		l.limit(frame)
+		for ch, v := range frame {
+			samples[i+ch] = float32(v)
+		}
+	}
+	return samples
+}
+
+// limit pushes one frame in and replaces it with the frame leaving the
+// look-ahead delay, scaled by the current gain
+func (l *Limiter) limit(frame []float64) {
+	var peak float64
+	for _, v := range frame {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	need := 1.0
+	if peak > l.ceiling {
+		need = l.ceiling / peak
+	}
+
+	// Running minimum of the gain needed over the look-ahead window
+	pos := l.count % l.lookahead
+	l.required[pos] = need
+	for len(l.minima) > 0 && l.required[l.minima[len(l.minima)-1]%l.lookahead] >= need {
+		l.minima = l.minima[:len(l.minima)-1]
+	}
+	l.minima = append(l.minima, l.count)
+	if l.minima[0] <= l.count-l.lookahead {
+		l.minima = l.minima[1:]
+	}
+	hold := l.required[l.minima[0]%l.lookahead]
+	l.count++
+
+	// Averaging the held minimum over the window ramps the gain down
+	// across the look-ahead and reaches each peak's gain as it leaves the
+	// delay line
+	l.sum += hold - l.held[l.heldPos]
+	l.held[l.heldPos] = hold
+	l.heldPos = (l.heldPos + 1) % l.lookahead
+	target := math.Min(1, l.sum/float64(l.lookahead))
+
+	if target < l.gain {
+		l.gain = target
+	} else {
+		l.gain = target + l.releaseCoeff*(l.gain-target)
+	}
+
+	// Swap the frame with the oldest in the delay line
+	for ch := range frame {
+		if len(l.delay) > 0 {
+			frame[ch], l.delay[l.delayPos+ch] = l.delay[l.delayPos+ch], frame[ch]
+		}
+		frame[ch] = math.Max(-l.ceiling, math.Min(l.ceiling, frame[ch]*l.gain))
+	}
+	if len(l.delay) > 0 {
+		l.delayPos = (l.delayPos + l.numChannels) % len(l.delay)
+	}
+}
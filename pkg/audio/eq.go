@@ -0,0 +1,175 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+func init() {
+	RegisterStage("eq", newEQStage)
+}
+
+// biquad is a second-order IIR filter section, in the coefficient forms
+// of the RBJ Audio EQ Cookbook, with per-channel state
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+
+	// x1, x2, y1, y2 are the previous inputs and outputs, per channel
+	x1, x2, y1, y2 []float64
+}
+
+// newBiquad normalizes the coefficients by a0
+func newBiquad(numChannels int, b0, b1, b2, a0, a1, a2 float64) *biquad {
+	return &biquad{
+		b0: b0 / a0, b1: b1 / a0, b2: b2 / a0, a1: a1 / a0, a2: a2 / a0,
+		x1: make([]float64, numChannels), x2: make([]float64, numChannels),
+		y1: make([]float64, numChannels), y2: make([]float64, numChannels),
+	}
+}
+
+// lowShelf boosts or cuts below freq by gainDB
+func lowShelf(sampleRate, numChannels int, freq, gainDB float64) *biquad {
+	a, w, alpha := shelfParams(sampleRate, freq, gainDB)
+	cos, sqrtA := math.Cos(w), 2*math.Sqrt(a)*alpha
+	return newBiquad(numChannels,
+		a*((a+1)-(a-1)*cos+sqrtA), 2*a*((a-1)-(a+1)*cos), a*((a+1)-(a-1)*cos-sqrtA),
+		(a+1)+(a-1)*cos+sqrtA, -2*((a-1)+(a+1)*cos), (a+1)+(a-1)*cos-sqrtA)
+}
+
+// highShelf boosts or cuts above freq by gainDB
+func highShelf(sampleRate, numChannels int, freq, gainDB float64) *biquad {
+	a, w, alpha := shelfParams(sampleRate, freq, gainDB)
+	cos, sqrtA := math.Cos(w), 2*math.Sqrt(a)*alpha
+	return newBiquad(numChannels,
+		a*((a+1)+(a-1)*cos+sqrtA), -2*a*((a-1)+(a+1)*cos), a*((a+1)+(a-1)*cos-sqrtA),
+		(a+1)-(a-1)*cos+sqrtA, 2*((a-1)-(a+1)*cos), (a+1)-(a-1)*cos-sqrtA)
+}
+
+// peaking boosts or cuts a band around freq by gainDB, q setting its width
+func peaking(sampleRate, numChannels int, freq, gainDB, q float64) *biquad {
+	a := math.Pow(10, gainDB/40)
+	w := 2 * math.Pi * freq / float64(sampleRate)
+	alpha := math.Sin(w) / (2 * q)
+	cos := math.Cos(w)
+	return newBiquad(numChannels,
+		1+alpha*a, -2*cos, 1-alpha*a,
+		1+alpha/a, -2*cos, 1-alpha/a)
+}
+
+// highPass removes content below freq, q setting the resonance at the corner
+func highPass(sampleRate, numChannels int, freq, q float64) *biquad {
+	w := 2 * math.Pi * freq / float64(sampleRate)
+	alpha, cos := math.Sin(w)/(2*q), math.Cos(w)
+	return newBiquad(numChannels,
+		(1+cos)/2, -(1 + cos), (1+cos)/2,
+		1+alpha, -2*cos, 1-alpha)
+}
+
+// lowPass removes content above freq, q setting the resonance at the corner
+func lowPass(sampleRate, numChannels int, freq, q float64) *biquad {
+	w := 2 * math.Pi * freq / float64(sampleRate)
+	alpha, cos := math.Sin(w)/(2*q), math.Cos(w)
+	return newBiquad(numChannels,
+		(1-cos)/2, 1-cos, (1-cos)/2,
+		1+alpha, -2*cos, 1-alpha)
+}
+
+// shelfParams returns the amplitude, angular frequency and alpha of a
+// shelf with a slope of 1, the steepest without overshoot
+func shelfParams(sampleRate int, freq, gainDB float64) (float64, float64, float64) {
+	a := math.Pow(10, gainDB/40)
+	w := 2 * math.Pi * freq / float64(sampleRate)
+	return a, w, math.Sin(w) / 2 * math.Sqrt2
+}
+
+// process filters one sample of channel ch
+func (f *biquad) process(ch int, x float64) float64 {
+	y := f.b0*x + f.b1*f.x1[ch] + f.b2*f.x2[ch] - f.a1*f.y1[ch] - f.a2*f.y2[ch]
+	f.x2[ch], f.x1[ch] = f.x1[ch], x
+	f.y2[ch], f.y1[ch] = f.y1[ch], y
+	return y
+}
+
+// EQ is a three-band equalizer: a low shelf, a peaking mid band and a
+// high shelf, for taming boomy microphones or adding presence. Bands left
+// at 0 dB are skipped.
+type EQ struct {
+	numChannels int
+	bands       []*biquad
+}
+
+// EQBand sets one band's frequency in Hz and gain in dB; Q only applies to
+// the mid band
+type EQBand struct {
+	Freq float64
+	Gain float64
+	Q    float64
+}
+
+// NewEQ creates an equalizer for interleaved PCM at sampleRate
+func NewEQ(sampleRate, numChannels int, low, mid, high EQBand) *EQ {
+	eq := &EQ{numChannels: numChannels}
+	if low.Gain != 0 {
+		eq.bands = append(eq.bands, lowShelf(sampleRate, numChannels, low.Freq, low.Gain))
+	}
+	if mid.Gain != 0 {
+		eq.bands = append(eq.bands, peaking(sampleRate, numChannels, mid.Freq, mid.Gain, mid.Q))
+	}
+	if high.Gain != 0 {
+		eq.bands = append(eq.bands, highShelf(sampleRate, numChannels, high.Freq, high.Gain))
+	}
+	return eq
+}
+
+// newEQStage creates an equalizer from the "low_freq", "low_gain",
+// "mid_freq", "mid_gain", "mid_q", "high_freq" and "high_gain" options
+func newEQStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	var low, mid, high EQBand
+	for _, option := range []struct {
+		name  string
+		value *float64
+		def   float64
+	}{
+		{"low_freq", &low.Freq, 120},
+		{"low_gain", &low.Gain, 0},
+		{"mid_freq", &mid.Freq, 1000},
+		{"mid_gain", &mid.Gain, 0},
+		{"mid_q", &mid.Q, 0.7},
+		{"high_freq", &high.Freq, 8000},
+		{"high_gain", &high.Gain, 0},
+	} {
+		v, err := options.Float(option.name, option.def)
+		if err != nil {
+			return nil, err
+		}
+		*option.value = v
+	}
+
+	nyquist := float64(sampleRate) / 2
+	for _, band := range []EQBand{low, mid, high} {
+		if band.Freq <= 0 || band.Freq >= nyquist {
+			return nil, fmt.Errorf("frequency %gHz must be between 0 and %gHz", band.Freq, nyquist)
+		}
+	}
+	if mid.Q <= 0 {
+		return nil, fmt.Errorf("mid_q must be positive")
+	}
+	return NewEQ(sampleRate, numChannels, low, mid, high), nil
+}
+
+// Process equalizes pcm in place
+func (eq *EQ) Process(pcm []int16) []int16 {
+	if len(eq.bands) == 0 {
+		return pcm
+	}
+	for i := 0; i+eq.numChannels <= len(pcm); i += eq.numChannels {
+		for ch := 0; ch < eq.numChannels; ch++ {
+			v := float64(pcm[i+ch])
+			for _, band := range eq.bands {
+				v = band.process(ch, v)
+			}
+			pcm[i+ch] = clip16(v)
+		}
+	}
+	return pcm
+}
@@ -0,0 +1,386 @@
+package audio
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// FLACMaxBlock is the most samples per channel a FLAC frame can hold
+const FLACMaxBlock = 65535
+
+// FLACEncoder encodes 16-bit PCM into FLAC frames. Each channel is coded
+// on its own with the best of FLAC's fixed predictors and a Rice coded
+// residual, which gets most of the way to reference compression ratios at
+// a fraction of the cost. Frames may hold any number of samples, so they
+// are numbered by sample (FLAC's variable block size strategy).
+type FLACEncoder struct {
+	sampleRate  int
+	numChannels int
+
+	// samples is how many samples per channel have been encoded, which
+	// numbers the next frame
+	samples uint64
+
+	// The block and frame size ranges and the MD5 of the audio so far,
+	// which Summary reports
+	minBlock, maxBlock int
+	minFrame, maxFrame int
+	md5                hash.Hash
+
+	w       bitWriter
+	channel []int32
+}
+
+// NewFLACEncoder creates an encoder for interleaved PCM at sampleRate
+func NewFLACEncoder(sampleRate, numChannels int) *FLACEncoder {
+	return &FLACEncoder{sampleRate: sampleRate, numChannels: numChannels, md5: md5.New()}
+}
+
+// StreamInfo returns the 34-byte STREAMINFO metadata block describing the
+// stream, without the block header. Frame sizes and the total length are
+// left unknown, as they are for live streams.
+func (e *FLACEncoder) StreamInfo() []byte {
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:], 16)
+	binary.BigEndian.PutUint16(info[2:], FLACMaxBlock)
+	// 20 bits of sample rate, 3 of channels-1, 5 of bits per sample-1,
+	// then 36 of total samples (0, unknown)
+	packed := uint64(e.sampleRate)<<44 | uint64(e.numChannels-1)<<41 | uint64(15)<<36
+	binary.BigEndian.PutUint64(info[10:], packed)
+	return info
+}
+
+// Summary returns the STREAMINFO block for a finished file: the block and
+// frame size ranges, total length and MD5 of everything encoded so far.
+// The last frame may be shorter than the minimum block size, as FLAC allows.
+func (e *FLACEncoder) Summary() []byte {
+	info := e.StreamInfo()
+	if e.samples == 0 {
+		return info
+	}
+	binary.BigEndian.PutUint16(info[0:], uint16(e.minBlock))
+	binary.BigEndian.PutUint16(info[2:], uint16(e.maxBlock))
+	info[4], info[5], info[6] = byte(e.minFrame>>16), byte(e.minFrame>>8), byte(e.minFrame)
+	info[7], info[8], info[9] = byte(e.maxFrame>>16), byte(e.maxFrame>>8), byte(e.maxFrame)
+	packed := binary.BigEndian.Uint64(info[10:]) | e.samples&(1<<36-1)
+	binary.BigEndian.PutUint64(info[10:], packed)
+	copy(info[18:], e.md5.Sum(nil))
+	return info
+}
+
+// Samples returns how many samples per channel have been encoded
+func (e *FLACEncoder) Samples() uint64 {
+	return e.samples
+}
+
+// Header returns the start of a FLAC file: the "fLaC" marker and the
+// STREAMINFO block, which is the only metadata
+func (e *FLACEncoder) Header() []byte {
+	header := []byte{'f', 'L', 'a', 'C', 0x80, 0, 0, 34}
+	return append(header, e.StreamInfo()...)
+}
+
+// Encode encodes pcm as one frame. It must hold at most FLACMaxBlock
+// samples per channel.
+func (e *FLACEncoder) Encode(pcm []int16) []byte {
+	blockSize := len(pcm) / e.numChannels
+	if blockSize == 0 {
+		return nil
+	}
+	w := &e.w
+	w.reset()
+
+	// Frame header: sync code and variable block size, block size and
+	// sample rate given at the end of the header, independent channels,
+	// 16-bit samples
+	w.write(0x3FFE, 14)
+	w.write(0, 1)
+	w.write(1, 1)
+	w.write(7, 4)
+	rateCode, rateBits, rateValue := flacRateCode(e.sampleRate)
+	w.write(rateCode, 4)
+	w.write(uint64(e.numChannels-1), 4)
+	w.write(4, 3)
+	w.write(0, 1)
+	w.writeUTF8(e.samples)
+	w.write(uint64(blockSize-1), 16)
+	if rateBits > 0 {
+		w.write(rateValue, rateBits)
+	}
+	w.write(uint64(crc8(w.bytes())), 8)
+
+	for ch := 0; ch < e.numChannels; ch++ {
+		e.channel = e.channel[:0]
+		for i := ch; i < len(pcm); i += e.numChannels {
+			e.channel = append(e.channel, int32(pcm[i]))
+		}
+		e.subframe(e.channel)
+	}
+
+	w.align()
+	w.write(uint64(crc16(w.bytes())), 16)
+	e.samples += uint64(blockSize)
+	e.track(pcm, blockSize, len(w.bytes()))
+	return append([]byte(nil), w.bytes()...)
+}
+
+// track records a frame for Summary
+func (e *FLACEncoder) track(pcm []int16, blockSize, frameSize int) {
+	if e.minBlock == 0 || blockSize < e.minBlock {
+		e.minBlock = blockSize
+	}
+	if e.minFrame == 0 || frameSize < e.minFrame {
+		e.minFrame = frameSize
+	}
+	e.maxBlock = max(e.maxBlock, blockSize)
+	e.maxFrame = max(e.maxFrame, frameSize)
+	e.md5.Write(PCMToBytes(pcm))
+}
+
+// FLACSeekPoint locates a frame for players seeking in a FLAC file
+type FLACSeekPoint struct {
+	// Sample is the number of the frame's first sample
+	Sample uint64
+	// Offset is where the frame starts, counted from the first frame
+	Offset uint64
+	// Samples is how many samples the frame holds
+	Samples uint16
+}
+
+// FLACSeekTable returns a SEEKTABLE metadata block of n points, without
+// the block header. Points past those given are placeholders, so a table
+// can be reserved before the audio is written and filled in afterwards.
+func FLACSeekTable(points []FLACSeekPoint, n int) []byte {
+	table := make([]byte, 18*n)
+	for i := 0; i < n; i++ {
+		point := table[18*i:]
+		if i >= len(points) {
+			binary.BigEndian.PutUint64(point, 0xFFFFFFFFFFFFFFFF)
+			continue
+		}
+		binary.BigEndian.PutUint64(point[0:], points[i].Sample)
+		binary.BigEndian.PutUint64(point[8:], points[i].Offset)
+		binary.BigEndian.PutUint16(point[16:], points[i].Samples)
+	}
+	return table
+}
+
+// flacRateCode returns the header's sample rate code, and the rate itself
+// when it has to follow the header with bits of it
+func flacRateCode(sampleRate int) (code uint64, bits int, value uint64) {
+	switch sampleRate {
+	case 88200:
+		return 1, 0, 0
+	case 176400:
+		return 2, 0, 0
+	case 192000:
+		return 3, 0, 0
+	case 8000:
+		return 4, 0, 0
+	case 16000:
+		return 5, 0, 0
+	case 22050:
+		return 6, 0, 0
+	case 24000:
+		return 7, 0, 0
+	case 32000:
+		return 8, 0, 0
+	case 44100:
+		return 9, 0, 0
+	case 48000:
+		return 10, 0, 0
+	case 96000:
+		return 11, 0, 0
+	}
+	if sampleRate <= 0xFFFF {
+		return 13, 16, uint64(sampleRate)
+	}
+	if sampleRate%10 == 0 && sampleRate/10 <= 0xFFFF {
+		return 14, 16, uint64(sampleRate / 10)
+	}
+	// Otherwise take the rate from STREAMINFO
+	return 0, 0, 0
+}
+
+// subframe codes one channel, as a constant, with the fixed predictor whose
+// residual is smallest, or verbatim when prediction does not help
+func (e *FLACEncoder) subframe(samples []int32) {
+	w := &e.w
+
+	constant := true
+	for _, s := range samples[1:] {
+		if s != samples[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		w.write(0, 8)
+		w.writeSigned(samples[0], 16)
+		return
+	}
+
+	// Pick the predictor order with the smallest residual
+	order, best := 0, uint64(1<<63)
+	for o := 0; o <= 4 && o < len(samples); o++ {
+		var sum uint64
+		for i := o; i < len(samples); i++ {
+			r := fixedResidual(samples, i, o)
+			if r < 0 {
+				r = -r
+			}
+			sum += uint64(r)
+		}
+		if sum < best {
+			order, best = o, sum
+		}
+	}
+	n := len(samples) - order
+	param := 0
+	if n > 0 {
+		if mean := best / uint64(n); mean > 0 {
+			param = bits.Len64(mean)
+		}
+	}
+
+	// The residual would take more room than the samples themselves. Its
+	// zigzag coded values average twice the absolute residual.
+	if param > 14 || (2*best>>param)+uint64(n)*uint64(param+1) > uint64(len(samples))*16 {
+		w.write(2, 8)
+		for _, s := range samples {
+			w.writeSigned(s, 16)
+		}
+		return
+	}
+
+	w.write(uint64(0x08|order)<<1, 8)
+	for _, s := range samples[:order] {
+		w.writeSigned(s, 16)
+	}
+	// Rice coding with 4-bit parameters and a single partition
+	w.write(0, 2)
+	w.write(0, 4)
+	w.write(uint64(param), 4)
+	for i := order; i < len(samples); i++ {
+		r := fixedResidual(samples, i, order)
+		u := uint64(uint32(r<<1) ^ uint32(r>>31))
+		w.writeUnary(u >> param)
+		w.write(u&(1<<param-1), param)
+	}
+}
+
+// fixedResidual is the error of FLAC's fixed predictor of order at i
+func fixedResidual(s []int32, i, order int) int32 {
+	switch order {
+	case 0:
+		return s[i]
+	case 1:
+		return s[i] - s[i-1]
+	case 2:
+		return s[i] - 2*s[i-1] + s[i-2]
+	case 3:
+		return s[i] - 3*s[i-1] + 3*s[i-2] - s[i-3]
+	}
+	return s[i] - 4*s[i-1] + 6*s[i-2] - 4*s[i-3] + s[i-4]
+}
+
+// bitWriter packs big-endian bit fields into bytes
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits int
+}
+
+// reset empties the writer, keeping its buffer
+func (w *bitWriter) reset() {
+	w.buf, w.acc, w.nbits = w.buf[:0], 0, 0
+}
+
+// write appends the low n bits of v, n at most 32
+func (w *bitWriter) write(v uint64, n int) {
+	for n > 0 {
+		take := min(n, 32)
+		n -= take
+		w.acc = w.acc<<take | (v>>n)&(1<<take-1)
+		w.nbits += take
+		for w.nbits >= 8 {
+			w.nbits -= 8
+			w.buf = append(w.buf, byte(w.acc>>w.nbits))
+		}
+	}
+}
+
+// writeSigned appends v in n bits of two's complement
+func (w *bitWriter) writeSigned(v int32, n int) {
+	w.write(uint64(uint32(v))&(1<<n-1), n)
+}
+
+// writeUnary appends q zeros and a one
+func (w *bitWriter) writeUnary(q uint64) {
+	for ; q >= 32; q -= 32 {
+		w.write(0, 32)
+	}
+	w.write(1, int(q)+1)
+}
+
+// writeUTF8 appends v in FLAC's extended UTF-8 coding of frame numbers
+func (w *bitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		w.write(v, 8)
+		return
+	}
+	n := 2
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	w.write(0xFF<<(8-n)&0xFF|v>>(6*(n-1)), 8)
+	for i := n - 2; i >= 0; i-- {
+		w.write(0x80|(v>>(6*i))&0x3F, 8)
+	}
+}
+
+// align pads with zeros to a byte boundary
+func (w *bitWriter) align() {
+	if w.nbits > 0 {
+		w.write(0, 8-w.nbits)
+	}
+}
+
+// bytes returns the whole bytes written so far
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// crc8 is FLAC's header checksum (polynomial x^8+x^2+x+1)
+func crc8(data []byte) uint8 {
+	var crc uint8
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crc16 is FLAC's frame checksum (polynomial x^16+x^15+x^2+1)
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
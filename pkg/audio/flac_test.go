@@ -0,0 +1,86 @@
+package audio
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// flacSignal returns interleaved PCM that exercises every predictor: a
+// tone with noise, silence, a constant, full-scale swings and white noise
+func flacSignal(numChannels, n int) []int16 {
+	rng := rand.New(rand.NewSource(1))
+	pcm := make([]int16, 0, n*numChannels)
+	for i := 0; i < n; i++ {
+		for ch := 0; ch < numChannels; ch++ {
+			var v float64
+			switch section := i * 5 / n; section {
+			case 0:
+				v = 12000*math.Sin(2*math.Pi*float64(i*(ch+1))/100) + rng.NormFloat64()*50
+			case 1:
+				v = 0
+			case 2:
+				v = -1234
+			case 3:
+				v = 32767
+				if i%2 == 1 {
+					v = -32768
+				}
+			default:
+				v = float64(rng.Intn(65536) - 32768)
+			}
+			pcm = append(pcm, int16(v))
+		}
+	}
+	return pcm
+}
+
+func TestFLACRoundTrip(t *testing.T) {
+	for _, numChannels := range []int{1, 2} {
+		e := NewFLACEncoder(48000, numChannels)
+		in := flacSignal(numChannels, 100000)
+
+		// Block sizes FLAC codes in the header and ones it codes after it
+		var stream []byte
+		blocks := []int{4096, 1, 1000, 4608, FLACMaxBlock, 16}
+		for rest, i := in, 0; len(rest) > 0; i++ {
+			n := min(len(rest), blocks[i%len(blocks)]*numChannels)
+			frame := e.Encode(rest[:n])
+			if crc := binary.BigEndian.Uint16(frame[len(frame)-2:]); crc != crc16(frame[:len(frame)-2]) {
+				t.Fatalf("%d channels, frame %d: bad CRC", numChannels, i)
+			}
+			stream = append(stream, frame...)
+			rest = rest[n:]
+		}
+
+		out, err := DecodeFLACFrames(stream)
+		if err != nil {
+			t.Fatalf("%d channels: %v", numChannels, err)
+		}
+		if len(out) != len(in) {
+			t.Fatalf("%d channels: decoded %d samples, want %d", numChannels, len(out), len(in))
+		}
+		for i := range in {
+			if out[i] != in[i] {
+				t.Fatalf("%d channels: sample %d is %d, want %d", numChannels, i, out[i], in[i])
+			}
+		}
+		if len(stream) >= len(in)*2 {
+			t.Errorf("%d channels: %d bytes of FLAC for %d of PCM", numChannels, len(stream), len(in)*2)
+		}
+
+		info := e.Summary()
+		if samples := binary.BigEndian.Uint64(info[10:]) & (1<<36 - 1); samples != uint64(len(in)/numChannels) {
+			t.Errorf("%d channels: summary counts %d samples", numChannels, samples)
+		}
+		if minBlock, maxBlock := binary.BigEndian.Uint16(info), binary.BigEndian.Uint16(info[2:]); minBlock != 1 || maxBlock != FLACMaxBlock {
+			t.Errorf("%d channels: block sizes %d to %d", numChannels, minBlock, maxBlock)
+		}
+		if sum := md5.Sum(PCMToBytes(in)); !bytes.Equal(info[18:], sum[:]) {
+			t.Errorf("%d channels: summary MD5 differs from the audio's", numChannels)
+		}
+	}
+}
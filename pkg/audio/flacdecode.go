@@ -0,0 +1,287 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// errFLACTruncated is returned for a frame that ends early
+var errFLACTruncated = errors.New("flac frame is truncated")
+
+// DecodeFLACFrames decodes consecutive 16-bit FLAC frames, such as those a
+// FLACEncoder produces, into interleaved PCM. Any frame a conforming encoder
+// writes at 16 bits decodes, whatever its predictors and channel coding.
+func DecodeFLACFrames(data []byte) ([]int16, error) {
+	var pcm []int16
+	for len(data) > 0 {
+		r := &bitReader{data: data}
+		frame, err := decodeFLACFrame(r, pcm)
+		if err != nil {
+			return nil, err
+		}
+		pcm = frame
+		data = data[r.pos/8:]
+	}
+	return pcm, nil
+}
+
+// decodeFLACFrame decodes one frame from r, appending its samples to pcm,
+// and leaves r after the frame's footer
+func decodeFLACFrame(r *bitReader, pcm []int16) ([]int16, error) {
+	if r.read(14) != 0x3FFE {
+		return nil, errors.New("missing flac frame sync code")
+	}
+	r.read(2) // reserved and blocking strategy
+	blockCode := int(r.read(4))
+	rateCode := int(r.read(4))
+	assignment := int(r.read(4))
+	if depth := r.read(3); depth != 4 && depth != 0 {
+		return nil, fmt.Errorf("unsupported flac sample size code %d", depth)
+	}
+	r.read(1)
+	r.readUTF8()
+
+	var blockSize int
+	switch {
+	case blockCode == 1:
+		blockSize = 192
+	case blockCode >= 2 && blockCode <= 5:
+		blockSize = 576 << (blockCode - 2)
+	case blockCode == 6:
+		blockSize = int(r.read(8)) + 1
+	case blockCode == 7:
+		blockSize = int(r.read(16)) + 1
+	case blockCode >= 8:
+		blockSize = 256 << (blockCode - 8)
+	default:
+		return nil, errors.New("reserved flac block size")
+	}
+	switch rateCode {
+	case 12:
+		r.read(8)
+	case 13, 14:
+		r.read(16)
+	}
+	r.read(8) // header CRC
+
+	numChannels := assignment + 1
+	if assignment > 7 {
+		numChannels = 2
+	}
+	channels := make([][]int32, numChannels)
+	for ch := range channels {
+		// The side channel of stereo decorrelation needs a bit more
+		depth := 16
+		if (assignment == 8 && ch == 1) || (assignment == 9 && ch == 0) || (assignment == 10 && ch == 1) {
+			depth++
+		}
+		samples, err := decodeFLACSubframe(r, blockSize, depth)
+		if err != nil {
+			return nil, err
+		}
+		channels[ch] = samples
+	}
+	r.align()
+	r.read(16) // frame CRC
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	for i := 0; i < blockSize; i++ {
+		switch assignment {
+		case 8: // left, side
+			channels[1][i] = channels[0][i] - channels[1][i]
+		case 9: // side, right
+			channels[0][i] += channels[1][i]
+		case 10: // mid, side
+			mid := channels[0][i]<<1 | channels[1][i]&1
+			side := channels[1][i]
+			channels[0][i], channels[1][i] = (mid+side)>>1, (mid-side)>>1
+		}
+		for ch := range channels {
+			pcm = append(pcm, int16(channels[ch][i]))
+		}
+	}
+	return pcm, nil
+}
+
+// decodeFLACSubframe decodes one channel of blockSize samples of depth bits
+func decodeFLACSubframe(r *bitReader, blockSize, depth int) ([]int32, error) {
+	r.read(1)
+	kind := int(r.read(6))
+	wasted := 0
+	if r.read(1) == 1 {
+		wasted = 1
+		for r.read(1) == 0 && r.err == nil {
+			wasted++
+		}
+		depth -= wasted
+	}
+
+	samples := make([]int32, blockSize)
+	switch {
+	case kind == 0:
+		v := r.readSigned(depth)
+		for i := range samples {
+			samples[i] = v
+		}
+	case kind == 1:
+		for i := range samples {
+			samples[i] = r.readSigned(depth)
+		}
+	case kind >= 8 && kind <= 12:
+		order := kind - 8
+		for i := 0; i < order; i++ {
+			samples[i] = r.readSigned(depth)
+		}
+		if err := r.readResidual(samples, order); err != nil {
+			return nil, err
+		}
+		// samples[i] holds the residual, which fixedResidual would give
+		// less the prediction
+		for i := order; i < blockSize; i++ {
+			samples[i] += samples[i] - fixedResidual(samples, i, order)
+		}
+	case kind >= 32:
+		order := kind - 31
+		for i := 0; i < order; i++ {
+			samples[i] = r.readSigned(depth)
+		}
+		precision := int(r.read(4)) + 1
+		shift := int(r.readSigned(5))
+		if shift < 0 {
+			return nil, errors.New("negative flac lpc shift")
+		}
+		coefs := make([]int32, order)
+		for i := range coefs {
+			coefs[i] = r.readSigned(precision)
+		}
+		if err := r.readResidual(samples, order); err != nil {
+			return nil, err
+		}
+		for i := order; i < blockSize; i++ {
+			var sum int64
+			for j, c := range coefs {
+				sum += int64(c) * int64(samples[i-1-j])
+			}
+			samples[i] += int32(sum >> shift)
+		}
+	default:
+		return nil, fmt.Errorf("reserved flac subframe type %d", kind)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	for i := range samples {
+		samples[i] <<= wasted
+	}
+	return samples, nil
+}
+
+// bitReader reads big-endian bit fields, recording rather than returning
+// running off the end so callers can check once
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// read returns the next n bits, n at most 32
+func (r *bitReader) read(n int) uint32 {
+	if r.pos+n > 8*len(r.data) {
+		r.err = errFLACTruncated
+		r.pos = 8 * len(r.data)
+		return 0
+	}
+	var v uint32
+	for n > 0 {
+		b := r.data[r.pos/8]
+		avail := 8 - r.pos%8
+		take := min(n, avail)
+		v = v<<take | uint32(b>>(avail-take))&(1<<take-1)
+		r.pos += take
+		n -= take
+	}
+	return v
+}
+
+// readSigned returns the next n bits as two's complement
+func (r *bitReader) readSigned(n int) int32 {
+	if n == 0 {
+		return 0
+	}
+	v := r.read(n)
+	return int32(v<<(32-n)) >> (32 - n)
+}
+
+// align skips to the next byte boundary
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+// readUnary counts zeros up to the next one, a byte at a time
+func (r *bitReader) readUnary() uint32 {
+	var q uint32
+	for {
+		if r.pos >= 8*len(r.data) {
+			r.err = errFLACTruncated
+			return q
+		}
+		avail := 8 - r.pos%8
+		b := r.data[r.pos/8] << (r.pos % 8)
+		if b == 0 {
+			q += uint32(avail)
+			r.pos += avail
+			continue
+		}
+		zeros := bits.LeadingZeros8(b)
+		r.pos += zeros + 1
+		return q + uint32(zeros)
+	}
+}
+
+// readUTF8 skips a frame or sample number in FLAC's extended UTF-8 coding
+func (r *bitReader) readUTF8() {
+	first := r.read(8)
+	for mask := uint32(0x40); first&0x80 != 0 && first&mask != 0; mask >>= 1 {
+		r.read(8)
+	}
+}
+
+// readResidual reads a Rice coded residual into samples after order warmup
+// samples
+func (r *bitReader) readResidual(samples []int32, order int) error {
+	method := r.read(2)
+	if method > 1 {
+		return fmt.Errorf("reserved flac residual coding %d", method)
+	}
+	paramBits, escape := 4, uint32(0xF)
+	if method == 1 {
+		paramBits, escape = 5, 0x1F
+	}
+	partitionOrder := int(r.read(4))
+	partitions := 1 << partitionOrder
+	size := len(samples) >> partitionOrder
+	if size<<partitionOrder != len(samples) || size < order {
+		return errors.New("invalid flac residual partitions")
+	}
+
+	i := order
+	for p := 0; p < partitions; p++ {
+		end := (p + 1) * size
+		param := r.read(paramBits)
+		if param == escape {
+			n := int(r.read(5))
+			for ; i < end; i++ {
+				samples[i] = r.readSigned(n)
+			}
+			continue
+		}
+		for ; i < end && r.err == nil; i++ {
+			u := r.readUnary()<<param | r.read(int(param))
+			samples[i] = int32(u>>1) ^ -int32(u&1)
+		}
+	}
+	return r.err
+}
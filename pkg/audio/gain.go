@@ -0,0 +1,34 @@
+package audio
+
+import "math"
+
+func init() {
+	RegisterStage("gain", newGainStage)
+}
+
+// Gain scales samples by a fixed factor, clipping at full scale
+type Gain struct {
+	factor float64
+}
+
+// NewGain creates a gain of db decibels
+func NewGain(db float64) *Gain {
+	return &Gain{factor: math.Pow(10, db/20)}
+}
+
+// newGainStage creates a gain stage from the "db" option
+func newGainStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	db, err := options.Float("db", 0)
+	if err != nil {
+		return nil, err
+	}
+	return NewGain(db), nil
+}
+
+// Process applies the gain in place
+func (g *Gain) Process(pcm []int16) []int16 {
+	for i, sample := range pcm {
+		pcm[i] = clip16(float64(sample) * g.factor)
+	}
+	return pcm
+}
@@ -0,0 +1,119 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+func init() {
+	RegisterStage("gate", newGateStage)
+}
+
+const (
+	// gateDetectorRelease is how fast the gate's level detector decays,
+	// so it follows syllables rather than individual waveform peaks
+	gateDetectorRelease = 20 * time.Millisecond
+	// gateHysteresis is how far (in dB) below the threshold the level must
+	// fall before the gate starts to close, so it does not chatter
+	gateHysteresis = 3
+)
+
+// Gate is a noise gate: while the level stays below the threshold, as
+// between sentences, it turns the signal down by the range so background
+// hiss and room noise are not heard. It opens at the attack rate when the
+// level rises above the threshold, and closes at the release rate once the
+// level has stayed below it for the hold time.
+type Gate struct {
+	numChannels int
+	open        float64
+	close       float64
+	floor       float64
+	holdFrames  int
+
+	detectorCoeff float64
+	attackCoeff   float64
+	releaseCoeff  float64
+
+	envelope float64
+	held     int
+	gain     float64
+}
+
+// NewGate creates a gate for interleaved PCM at sampleRate. threshold is in
+// dBFS and rangeDB is how far a closed gate turns the signal down.
+func NewGate(sampleRate, numChannels int, threshold, rangeDB float64, attack, hold, release time.Duration) *Gate {
+	return &Gate{
+		numChannels:   numChannels,
+		open:          math.Pow(10, threshold/20),
+		close:         math.Pow(10, (threshold-gateHysteresis)/20),
+		floor:         math.Pow(10, -rangeDB/20),
+		holdFrames:    int(hold.Seconds() * float64(sampleRate)),
+		detectorCoeff: smoothingCoeff(gateDetectorRelease, sampleRate),
+		attackCoeff:   smoothingCoeff(attack, sampleRate),
+		releaseCoeff:  smoothingCoeff(release, sampleRate),
+		gain:          1,
+	}
+}
+
+// newGateStage creates a gate from the "threshold" (dBFS), "range" (dB),
+// "attack", "hold" and "release" options
+func newGateStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	threshold, err := options.Float("threshold", -50)
+	if err != nil {
+		return nil, err
+	}
+	rangeDB, err := options.Float("range", 40)
+	if err != nil {
+		return nil, err
+	}
+	if rangeDB < 0 {
+		return nil, fmt.Errorf("range must not be negative")
+	}
+	attack, err := options.Duration("attack", time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := options.Duration("hold", 200*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	release, err := options.Duration("release", 150*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return NewGate(sampleRate, numChannels, threshold, rangeDB, attack, hold, release), nil
+}
+
+// Process gates pcm in place
+func (g *Gate) Process(pcm []int16) []int16 {
+	for i := 0; i+g.numChannels <= len(pcm); i += g.numChannels {
+		var peak float64
+		for _, sample := range pcm[i : i+g.numChannels] {
+			peak = math.Max(peak, math.Abs(float64(sample)/32768))
+		}
+		if peak > g.envelope {
+			g.envelope = peak
+		} else {
+			g.envelope = peak + g.detectorCoeff*(g.envelope-peak)
+		}
+
+		switch {
+		case g.envelope >= g.open:
+			g.held = g.holdFrames
+		case g.envelope < g.close && g.held > 0:
+			g.held--
+		}
+
+		if g.envelope >= g.open || g.held > 0 {
+			g.gain = 1 + g.attackCoeff*(g.gain-1)
+		} else {
+			g.gain = g.floor + g.releaseCoeff*(g.gain-g.floor)
+		}
+
+		for ch := i; ch < i+g.numChannels; ch++ {
+			pcm[ch] = clip16(float64(pcm[ch]) * g.gain)
+		}
+	}
+	return pcm
+}
@@ -0,0 +1,116 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+func init() {
+	RegisterStage("highpass", newHighPassStage)
+	RegisterStage("dcblock", newDCBlockStage)
+}
+
+// butterworthQ are the section Qs of Butterworth high-pass filters of
+// 12 and 24 dB per octave, which are flat in the passband
+var butterworthQ = map[int][]float64{
+	12: {math.Sqrt2 / 2},
+	24: {0.5411961001461970, 1.3065629648763766},
+}
+
+// HighPass removes rumble below a corner frequency, such as handling noise,
+// air conditioning and the DC offset of cheap USB microphones, before it
+// reaches stages that would react to it
+type HighPass struct {
+	numChannels int
+	sections    []*biquad
+}
+
+// NewHighPass creates a Butterworth high-pass filter for interleaved PCM at
+// sampleRate. slope is 12 or 24 dB per octave.
+func NewHighPass(sampleRate, numChannels int, freq float64, slope int) *HighPass {
+	hp := &HighPass{numChannels: numChannels}
+	for _, q := range butterworthQ[slope] {
+		hp.sections = append(hp.sections, highPass(sampleRate, numChannels, freq, q))
+	}
+	return hp
+}
+
+// newHighPassStage creates a high-pass filter from the "freq" (Hz) and
+// "slope" (dB per octave) options
+func newHighPassStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	freq, err := options.Float("freq", 80)
+	if err != nil {
+		return nil, err
+	}
+	if nyquist := float64(sampleRate) / 2; freq <= 0 || freq >= nyquist {
+		return nil, fmt.Errorf("frequency %gHz must be between 0 and %gHz", freq, nyquist)
+	}
+	slope, err := options.Float("slope", 12)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := butterworthQ[int(slope)]; !ok || slope != math.Trunc(slope) {
+		return nil, fmt.Errorf("slope must be 12 or 24")
+	}
+	return NewHighPass(sampleRate, numChannels, freq, int(slope)), nil
+}
+
+// Process filters pcm in place
+func (hp *HighPass) Process(pcm []int16) []int16 {
+	for i := 0; i+hp.numChannels <= len(pcm); i += hp.numChannels {
+		for ch := 0; ch < hp.numChannels; ch++ {
+			v := float64(pcm[i+ch])
+			for _, section := range hp.sections {
+				v = section.process(ch, v)
+			}
+			pcm[i+ch] = clip16(v)
+		}
+	}
+	return pcm
+}
+
+// DCBlock removes DC offset with a one-pole high-pass filter whose corner
+// is far below anything audible, leaving rumble alone
+type DCBlock struct {
+	numChannels int
+	pole        float64
+
+	// x1 and y1 are the previous input and output, per channel
+	x1, y1 []float64
+}
+
+// NewDCBlock creates a DC blocker for interleaved PCM at sampleRate with
+// its corner at freq
+func NewDCBlock(sampleRate, numChannels int, freq float64) *DCBlock {
+	return &DCBlock{
+		numChannels: numChannels,
+		pole:        math.Exp(-2 * math.Pi * freq / float64(sampleRate)),
+		x1:          make([]float64, numChannels),
+		y1:          make([]float64, numChannels),
+	}
+}
+
+// newDCBlockStage creates a DC blocker from the "freq" (Hz) option
+func newDCBlockStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	freq, err := options.Float("freq", 5)
+	if err != nil {
+		return nil, err
+	}
+	if freq <= 0 || freq > 20 {
+		return nil, fmt.Errorf("frequency %gHz must be between 0 and 20Hz", freq)
+	}
+	return NewDCBlock(sampleRate, numChannels, freq), nil
+}
+
+// Process removes DC from pcm in place
+func (d *DCBlock) Process(pcm []int16) []int16 {
+	for i := 0; i+d.numChannels <= len(pcm); i += d.numChannels {
+		for ch := 0; ch < d.numChannels; ch++ {
+			x := float64(pcm[i+ch])
+			y := x - d.x1[ch] + d.pole*d.y1[ch]
+			d.x1[ch], d.y1[ch] = x, y
+			pcm[i+ch] = clip16(y)
+		}
+	}
+	return pcm
+}
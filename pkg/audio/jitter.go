@@ -0,0 +1,132 @@
+package audio
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// JitterStats describes a JitterBuffer's recent behaviour
+type JitterStats struct {
+	BufferedMs float64 `json:"buffered_ms"`
+	TargetMs   float64 `json:"target_ms"`
+	Underruns  uint64  `json:"underruns"`
+	Dropped    uint64  `json:"dropped"`
+}
+
+// jitterItem is a queued frame and how much audio it holds
+type jitterItem[T any] struct {
+	frame    T
+	duration time.Duration
+}
+
+// JitterBuffer smooths irregular frame arrival. Frames are pushed as they
+// arrive and Run releases them on a steady clock paced by their durations,
+// once target worth of audio has built up. If the buffer runs dry it builds
+// up again before resuming; if it grows past twice the target (a sender
+// running fast or bursting) the oldest frames are dropped to bound latency.
+type JitterBuffer[T any] struct {
+	target time.Duration
+
+	mu       sync.Mutex
+	queue    []jitterItem[T]
+	buffered time.Duration
+	stats    JitterStats
+	pushed   chan struct{}
+}
+
+// NewJitterBuffer creates a buffer that holds target worth of audio
+func NewJitterBuffer[T any](target time.Duration) *JitterBuffer[T] {
+	return &JitterBuffer[T]{
+		target: target,
+		pushed: make(chan struct{}, 1),
+	}
+}
+
+// Push queues a frame holding duration worth of audio
+func (b *JitterBuffer[T]) Push(frame T, duration time.Duration) {
+	b.mu.Lock()
+	b.queue = append(b.queue, jitterItem[T]{frame: frame, duration: duration})
+	b.buffered += duration
+
+	for b.buffered > 2*b.target && len(b.queue) > 1 {
+		b.buffered -= b.queue[0].duration
+		b.queue = b.queue[1:]
+		b.stats.Dropped++
+	}
+	b.mu.Unlock()
+
+	select {
+	case b.pushed <- struct{}{}:
+	default:
+	}
+}
+
+// Run emits frames until ctx is done. resumed is true for the first frame
+// after the buffer (re)filled, where playback may not be continuous.
+func (b *JitterBuffer[T]) Run(ctx context.Context, emit func(frame T, resumed bool)) {
+	for {
+		// Build up the target before releasing anything
+		for b.level() < b.target {
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.pushed:
+			}
+		}
+
+		resumed := true
+		next := time.Now()
+		for {
+			item, ok := b.pop()
+			if !ok {
+				b.mu.Lock()
+				b.stats.Underruns++
+				b.mu.Unlock()
+				break
+			}
+			emit(item.frame, resumed)
+			resumed = false
+
+			next = next.Add(item.duration)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Until(next)):
+			}
+		}
+	}
+}
+
+// level returns how much audio is queued
+func (b *JitterBuffer[T]) level() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buffered
+}
+
+// pop removes the oldest frame
+func (b *JitterBuffer[T]) pop() (jitterItem[T], bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.queue) == 0 {
+		return jitterItem[T]{}, false
+	}
+	item := b.queue[0]
+	b.queue = b.queue[1:]
+	b.buffered -= item.duration
+	return item, true
+}
+
+// Stats returns the buffer's current level and counters
+func (b *JitterBuffer[T]) Stats() JitterStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.BufferedMs = float64(b.buffered) / float64(time.Millisecond)
+	stats.TargetMs = float64(b.target) / float64(time.Millisecond)
+	return stats
+}
@@ -0,0 +1,80 @@
+package audio
+
+import "math"
+
+// SilenceDBFS is the level reported for digital silence
+const SilenceDBFS = -120.0
+
+// LevelDBFS returns the RMS level of interleaved 16-bit PCM in dBFS, across
+// all channels
+func LevelDBFS(data []byte) float64 {
+	pcm := BytesToPCM(data)
+	if len(pcm) == 0 {
+		return SilenceDBFS
+	}
+
+	var sum float64
+	for _, sample := range pcm {
+		s := float64(sample) / 32768
+		sum += s * s
+	}
+	rms := math.Sqrt(sum / float64(len(pcm)))
+	if rms == 0 {
+		return SilenceDBFS
+	}
+	return math.Max(20*math.Log10(rms), SilenceDBFS)
+}
+
+// LevelMeter measures the peak and RMS level of each channel of interleaved
+// PCM, over however many frames were added since it was last read
+type LevelMeter struct {
+	numChannels int
+	peak        []int
+	sum         []float64
+	samples     int
+}
+
+// NewLevelMeter creates a meter for PCM with numChannels
+func NewLevelMeter(numChannels int) *LevelMeter {
+	return &LevelMeter{
+		numChannels: numChannels,
+		peak:        make([]int, numChannels),
+		sum:         make([]float64, numChannels),
+	}
+}
+
+// Add measures pcm
+func (m *LevelMeter) Add(pcm []int16) {
+	for i := 0; i+m.numChannels <= len(pcm); i += m.numChannels {
+		for ch := 0; ch < m.numChannels; ch++ {
+			v := int(pcm[i+ch])
+			if v < 0 {
+				v = -v
+			}
+			m.peak[ch] = max(m.peak[ch], v)
+			s := float64(pcm[i+ch]) / 32768
+			m.sum[ch] += s * s
+		}
+		m.samples++
+	}
+}
+
+// Read returns each channel's peak and RMS level in dBFS since the last
+// read, and starts measuring afresh
+func (m *LevelMeter) Read() (peak, rms []float64) {
+	peak = make([]float64, m.numChannels)
+	rms = make([]float64, m.numChannels)
+	for ch := 0; ch < m.numChannels; ch++ {
+		peak[ch], rms[ch] = SilenceDBFS, SilenceDBFS
+		if m.peak[ch] > 0 {
+			peak[ch] = math.Max(20*math.Log10(float64(m.peak[ch])/32768), SilenceDBFS)
+		}
+		if m.samples > 0 && m.sum[ch] > 0 {
+			rms[ch] = math.Max(10*math.Log10(m.sum[ch]/float64(m.samples)), SilenceDBFS)
+		}
+	}
+	clear(m.peak)
+	clear(m.sum)
+	m.samples = 0
+	return peak, rms
+}
@@ -0,0 +1,216 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+// LoopAction is what a LoopGuard does once it detects a feedback loop
+type LoopAction int
+
+const (
+	// LoopOff disables loop detection
+	LoopOff LoopAction = iota
+	// LoopWarn only reports the loop
+	LoopWarn
+	// LoopMute reports the loop and broadcasts silence for a while
+	LoopMute
+)
+
+// ParseLoopAction returns the action for a config name: off, warn or mute
+func ParseLoopAction(name string) (LoopAction, bool) {
+	switch name {
+	case "off":
+		return LoopOff, true
+	case "warn":
+		return LoopWarn, true
+	case "mute":
+		return LoopMute, true
+	}
+	return LoopOff, false
+}
+
+// Verdict is the outcome of inspecting one source frame
+type Verdict int
+
+const (
+	// VerdictOK means the frame should be broadcast as is
+	VerdictOK Verdict = iota
+	// VerdictLoop means the source appears to be capturing the stream itself
+	VerdictLoop
+	// VerdictMuted means the frame was silenced because of an earlier loop
+	VerdictMuted
+)
+
+const (
+	// fingerprintBlock is the analysis block length
+	fingerprintBlock = 10 * time.Millisecond
+	// fingerprintHistory is how far back a loop can be detected
+	fingerprintHistory = 20 * time.Second
+	// fingerprintWindow is how much audio is compared at each delay
+	fingerprintWindow = 3 * time.Second
+	// minLoopDelay ignores trivially short self-similarity
+	minLoopDelay = 200 * time.Millisecond
+
+	loopSimilarity    = 0.75
+	loopConfirmations = 3
+	loopMuteHold      = 10 * time.Second
+
+	// silenceEnergy is the mean square level (about -60dBFS) below which
+	// blocks are ignored, since silence matches itself perfectly
+	silenceEnergy = 1e-6
+	// steadyChange is the relative change in energy below which a block is
+	// ignored too: a steady tone matches itself at every delay just as well
+	steadyChange = 0.01
+)
+
+// LoopGuard protects the broadcast from a source that captures the stream's
+// own output (for example loopback capture, or a microphone next to a
+// speaker playing the stream). It compares a coarse fingerprint of incoming
+// audio against recently broadcast audio: when the source is a delayed copy
+// of itself, the fingerprints line up at that delay. Audio that merely
+// repeats, such as a line-up tone, is broadcast as is; retransmitted frames
+// are dropped by their sequence numbers instead (see frame.Tracker).
+type LoopGuard struct {
+	numChannels   int
+	blockSamples  int
+	action        LoopAction
+	windowBlocks  int
+	minDelay      int
+	historyBlocks int
+
+	// Running block accumulation, carried across frames
+	blockSum   float64
+	blockCount int
+	lastEnergy float64
+
+	// Fingerprint history: one bit per block (energy rising), and whether
+	// the block was loud and changing enough to count
+	bits   []bool
+	usable []bool
+
+	confirmations int
+	mutedUntil    time.Time
+
+	// LastDelay and LastSimilarity describe the most recent detection
+	LastDelay      time.Duration
+	LastSimilarity float64
+}
+
+// NewLoopGuard creates a guard for interleaved 16-bit PCM in the given format
+func NewLoopGuard(sampleRate, numChannels int, action LoopAction) *LoopGuard {
+	blockSamples := int(float64(sampleRate) * fingerprintBlock.Seconds())
+	return &LoopGuard{
+		numChannels:   numChannels,
+		blockSamples:  blockSamples,
+		action:        action,
+		windowBlocks:  int(fingerprintWindow / fingerprintBlock),
+		minDelay:      int(minLoopDelay / fingerprintBlock),
+		historyBlocks: int(fingerprintHistory / fingerprintBlock),
+	}
+}
+
+// Inspect examines a source frame and returns what to broadcast along with
+// the verdict. A nil frame means it should be dropped.
+func (g *LoopGuard) Inspect(frame []byte) ([]byte, Verdict) {
+	if g.action == LoopOff {
+		return frame, VerdictOK
+	}
+
+	detected := g.analyze(frame)
+
+	if g.action == LoopMute && time.Now().Before(g.mutedUntil) {
+		// Confirm the loop afresh once the hold expires
+		g.confirmations = 0
+		return make([]byte, len(frame)), VerdictMuted
+	}
+	if !detected {
+		return frame, VerdictOK
+	}
+
+	if g.action == LoopMute {
+		g.mutedUntil = time.Now().Add(loopMuteHold)
+		return make([]byte, len(frame)), VerdictLoop
+	}
+	return frame, VerdictLoop
+}
+
+// analyze adds the frame to the fingerprint history and reports whether a
+// loop has been confirmed
+func (g *LoopGuard) analyze(frame []byte) bool {
+	pcm := BytesToPCM(frame)
+	for i := 0; i+g.numChannels <= len(pcm); i += g.numChannels {
+		var sample float64
+		for ch := 0; ch < g.numChannels; ch++ {
+			sample += float64(pcm[i+ch]) / 32768
+		}
+		sample /= float64(g.numChannels)
+
+		g.blockSum += sample * sample
+		g.blockCount++
+		if g.blockCount == g.blockSamples {
+			g.addBlock(g.blockSum / float64(g.blockCount))
+			g.blockSum, g.blockCount = 0, 0
+		}
+	}
+
+	delay, similarity := g.bestMatch()
+	if similarity >= loopSimilarity {
+		g.confirmations++
+	} else {
+		g.confirmations = 0
+	}
+
+	if g.confirmations == loopConfirmations {
+		g.LastDelay = time.Duration(delay) * fingerprintBlock
+		g.LastSimilarity = similarity
+		return true
+	}
+	return false
+}
+
+// addBlock appends one block's energy to the fingerprint history
+func (g *LoopGuard) addBlock(energy float64) {
+	g.bits = append(g.bits, energy > g.lastEnergy)
+	g.usable = append(g.usable, energy > silenceEnergy && g.lastEnergy > silenceEnergy &&
+		math.Abs(energy-g.lastEnergy) > steadyChange*g.lastEnergy)
+	g.lastEnergy = energy
+
+	if excess := len(g.bits) - g.historyBlocks; excess > 0 {
+		g.bits = g.bits[excess:]
+		g.usable = g.usable[excess:]
+	}
+}
+
+// bestMatch compares the latest window against every earlier alignment and
+// returns the delay (in blocks) with the highest share of matching bits
+func (g *LoopGuard) bestMatch() (int, float64) {
+	n := len(g.bits)
+	if n < g.windowBlocks+g.minDelay {
+		return 0, 0
+	}
+
+	bestDelay, best := 0, 0.0
+	for delay := g.minDelay; delay+g.windowBlocks <= n; delay++ {
+		matches, compared := 0, 0
+		for i := n - g.windowBlocks; i < n; i++ {
+			j := i - delay
+			if !g.usable[i] || !g.usable[j] {
+				continue
+			}
+			compared++
+			if g.bits[i] == g.bits[j] {
+				matches++
+			}
+		}
+
+		// Require most of the window to be actual audio
+		if compared < g.windowBlocks/2 {
+			continue
+		}
+		if similarity := float64(matches) / float64(compared); similarity > best {
+			bestDelay, best = delay, similarity
+		}
+	}
+	return bestDelay, best
+}
@@ -0,0 +1,70 @@
+package audio
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// toneFrames returns count identical stereo frames of a 1kHz tone at 48kHz
+func toneFrames(count int) [][]byte {
+	pcm := make([]int16, 4096*2)
+	for i := 0; i < 4096; i++ {
+		v := int16(8000 * math.Sin(2*math.Pi*1000*float64(i)/48000))
+		pcm[2*i], pcm[2*i+1] = v, v
+	}
+	frames := make([][]byte, count)
+	for i := range frames {
+		frames[i] = PCMToBytes(pcm)
+	}
+	return frames
+}
+
+func TestLoopGuardPassesRepeatedFrames(t *testing.T) {
+	for _, action := range []LoopAction{LoopOff, LoopWarn, LoopMute} {
+		g := NewLoopGuard(48000, 2, action)
+		// About 17 seconds of the same frame over and over
+		for i, frame := range toneFrames(200) {
+			out, verdict := g.Inspect(frame)
+			if verdict != VerdictOK || !bytes.Equal(out, frame) {
+				t.Fatalf("action %d: frame %d got verdict %d", action, i, verdict)
+			}
+		}
+	}
+}
+
+func TestLoopGuardDetectsDelayedCopy(t *testing.T) {
+	// Noise with a random envelope, then the same audio again, as a
+	// source capturing the stream's output four seconds late would send
+	rng := rand.New(rand.NewSource(1))
+	var frames [][]byte
+	for i := 0; i < 48; i++ {
+		pcm := make([]int16, 4096*2)
+		for j := 0; j < len(pcm); j += 2 * 480 {
+			level := rng.Float64() * 16000
+			for k := j; k < j+2*480 && k < len(pcm); k += 2 {
+				v := int16(level * (rng.Float64()*2 - 1))
+				pcm[k], pcm[k+1] = v, v
+			}
+		}
+		frames = append(frames, PCMToBytes(pcm))
+	}
+	frames = append(frames, frames...)
+
+	g := NewLoopGuard(48000, 2, LoopMute)
+	for _, frame := range frames {
+		if out, verdict := g.Inspect(frame); verdict == VerdictLoop {
+			if !bytes.Equal(out, make([]byte, len(frame))) {
+				t.Fatal("loop detected but not muted")
+			}
+			// 48 frames of 4096 samples last 4.096s
+			if g.LastDelay < 4*time.Second || g.LastDelay > 4200*time.Millisecond {
+				t.Errorf("detected delay %v, want about 4.1s", g.LastDelay)
+			}
+			return
+		}
+	}
+	t.Fatal("delayed copy not detected")
+}
@@ -0,0 +1,196 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// loudnessBlock is the step between the meter's measurements
+	loudnessBlock = 100 * time.Millisecond
+	// momentaryBlocks (400ms) and shortTermBlocks (3s) are how many blocks
+	// momentary and short-term loudness cover
+	momentaryBlocks = 4
+	shortTermBlocks = 30
+
+	// absoluteGate (in LUFS) and relativeGate (in LU) are the BS.1770
+	// gates for integrated loudness
+	absoluteGate = -70.0
+	relativeGate = -10.0
+
+	// The integration histogram has loudnessBins bins of loudnessBinWidth
+	// LU, from the absolute gate up to +5 LUFS
+	loudnessBinWidth = 0.1
+	loudnessBins     = 750
+)
+
+// LoudnessMeter measures loudness as EBU R128 specifies (ITU-R BS.1770):
+// momentary (400ms), short-term (3s) and integrated over everything since
+// it was created or reset, in LUFS. Integration keeps a histogram of the
+// gating blocks, so memory stays constant however long it runs.
+type LoudnessMeter struct {
+	numChannels int
+	blockFrames int
+	filters     []*biquad
+
+	// The current 100ms block's sum of squares and length, in frames
+	sum    float64
+	frames int
+
+	// blocks holds the mean square of the last 30 blocks, newest last
+	blocks []float64
+
+	// Histogram of 400ms gating blocks above the absolute gate: how many
+	// fell in each bin, and their summed mean squares
+	counts []uint64
+	powers []float64
+}
+
+// NewLoudnessMeter creates a meter for interleaved PCM at sampleRate
+func NewLoudnessMeter(sampleRate, numChannels int) *LoudnessMeter {
+	m := &LoudnessMeter{
+		counts: make([]uint64, loudnessBins),
+		powers: make([]float64, loudnessBins),
+	}
+	m.SetFormat(sampleRate, numChannels)
+	return m
+}
+
+// SetFormat switches to PCM at sampleRate with numChannels, keeping the
+// integrated measurement
+func (m *LoudnessMeter) SetFormat(sampleRate, numChannels int) {
+	m.numChannels = numChannels
+	m.blockFrames = int(loudnessBlock.Seconds() * float64(sampleRate))
+	m.filters = kWeighting(sampleRate, numChannels)
+	m.sum, m.frames = 0, 0
+	m.blocks = m.blocks[:0]
+}
+
+// kWeighting returns BS.1770's K-weighting filter: a high shelf modelling
+// the head, then a high-pass (the "RLB" curve), with coefficients derived
+// for sampleRate
+func kWeighting(sampleRate, numChannels int) []*biquad {
+	rate := float64(sampleRate)
+
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / rate)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := newBiquad(numChannels,
+		(vh+vb*k/q+k*k)/a0, 2*(k*k-vh)/a0, (vh-vb*k/q+k*k)/a0,
+		1, 2*(k*k-1)/a0, (1-k/q+k*k)/a0)
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / rate)
+	a0 = 1 + k/q + k*k
+	highPass := newBiquad(numChannels,
+		1, -2, 1,
+		1, 2*(k*k-1)/a0, (1-k/q+k*k)/a0)
+
+	return []*biquad{shelf, highPass}
+}
+
+// Add measures pcm
+func (m *LoudnessMeter) Add(pcm []int16) {
+	for i := 0; i+m.numChannels <= len(pcm); i += m.numChannels {
+		for ch := 0; ch < m.numChannels; ch++ {
+			x := float64(pcm[i+ch]) / 32768
+			for _, filter := range m.filters {
+				x = filter.process(ch, x)
+			}
+			// Front channels are weighted 1; surround is not supported
+			m.sum += x * x
+		}
+		if m.frames++; m.frames == m.blockFrames {
+			m.endBlock()
+		}
+	}
+}
+
+// endBlock finishes a 100ms block, and with it a 400ms gating block
+func (m *LoudnessMeter) endBlock() {
+	m.blocks = append(m.blocks, m.sum/float64(m.frames))
+	if len(m.blocks) > shortTermBlocks {
+		m.blocks = m.blocks[1:]
+	}
+	m.sum, m.frames = 0, 0
+
+	if len(m.blocks) < momentaryBlocks {
+		return
+	}
+	power := meanPower(m.blocks[len(m.blocks)-momentaryBlocks:])
+	if bin := int((powerToLUFS(power) - absoluteGate) / loudnessBinWidth); bin >= 0 {
+		bin = min(bin, len(m.counts)-1)
+		m.counts[bin]++
+		m.powers[bin] += power
+	}
+}
+
+// Momentary returns the loudness of the last 400ms in LUFS, or -Inf before
+// there is enough audio
+func (m *LoudnessMeter) Momentary() float64 {
+	if len(m.blocks) < momentaryBlocks {
+		return math.Inf(-1)
+	}
+	return powerToLUFS(meanPower(m.blocks[len(m.blocks)-momentaryBlocks:]))
+}
+
+// ShortTerm returns the loudness of the last 3s in LUFS, or -Inf before
+// there is enough audio
+func (m *LoudnessMeter) ShortTerm() float64 {
+	if len(m.blocks) < shortTermBlocks {
+		return math.Inf(-1)
+	}
+	return powerToLUFS(meanPower(m.blocks))
+}
+
+// Integrated returns the gated loudness of everything measured in LUFS, or
+// -Inf when nothing was above the absolute gate
+func (m *LoudnessMeter) Integrated() float64 {
+	var count uint64
+	var power float64
+	for bin := range m.counts {
+		count += m.counts[bin]
+		power += m.powers[bin]
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	// Gate again, relative to the loudness of the blocks above the absolute gate
+	gate := powerToLUFS(power/float64(count)) + relativeGate
+	first := max(int(math.Ceil((gate-absoluteGate)/loudnessBinWidth)), 0)
+	count, power = 0, 0
+	for bin := first; bin < len(m.counts); bin++ {
+		count += m.counts[bin]
+		power += m.powers[bin]
+	}
+	if count == 0 {
+		return math.Inf(-1)
+	}
+	return powerToLUFS(power / float64(count))
+}
+
+// Reset starts integrating afresh
+func (m *LoudnessMeter) Reset() {
+	clear(m.counts)
+	clear(m.powers)
+}
+
+// meanPower averages block mean squares
+func meanPower(blocks []float64) float64 {
+	var sum float64
+	for _, p := range blocks {
+		sum += p
+	}
+	return sum / float64(len(blocks))
+}
+
+// powerToLUFS converts a K-weighted mean square summed over channels to LUFS
+func powerToLUFS(power float64) float64 {
+	if power <= 0 {
+		return math.Inf(-1)
+	}
+	return -0.691 + 10*math.Log10(power)
+}
@@ -0,0 +1,87 @@
+package audio
+
+import "math"
+
+// Mixer converts interleaved PCM between channel counts. Mono is copied to
+// every output channel, anything is averaged down to mono, and 5.1 is
+// folded down to stereo with the usual -3dB center and surround levels.
+// Other layouts fold input channel n onto output channel n modulo the
+// output count, so for stereo even channels go left and odd ones right.
+type Mixer struct {
+	from, to int
+}
+
+// NewMixer creates a mixer from one channel count to another
+func NewMixer(fromChannels, toChannels int) *Mixer {
+	return &Mixer{from: fromChannels, to: toChannels}
+}
+
+// Process mixes a chunk of interleaved samples
+func (m *Mixer) Process(pcm []int16) []int16 {
+	switch {
+	case m.from == m.to:
+		return pcm
+	case m.to == 1:
+		return DownmixMono(pcm, m.from)
+	case m.from == 1:
+		return m.upmixMono(pcm)
+	case m.from == 6 && m.to == 2:
+		return downmix51(pcm)
+	}
+	return m.fold(pcm)
+}
+
+// upmixMono copies each sample to every output channel
+func (m *Mixer) upmixMono(pcm []int16) []int16 {
+	out := make([]int16, len(pcm)*m.to)
+	for i, sample := range pcm {
+		for ch := 0; ch < m.to; ch++ {
+			out[i*m.to+ch] = sample
+		}
+	}
+	return out
+}
+
+// downmix51 folds L, R, C, LFE, Ls, Rs down to stereo, dropping the LFE
+func downmix51(pcm []int16) []int16 {
+	const level = math.Sqrt2 / 2
+	// Scale so a full-scale signal on every channel cannot clip
+	const norm = 1 / (1 + 2*level)
+
+	frames := len(pcm) / 6
+	out := make([]int16, frames*2)
+	for i := 0; i < frames; i++ {
+		f := pcm[i*6 : i*6+6]
+		center := level * float64(f[2])
+		out[i*2] = clip16(norm * (float64(f[0]) + center + level*float64(f[4])))
+		out[i*2+1] = clip16(norm * (float64(f[1]) + center + level*float64(f[5])))
+	}
+	return out
+}
+
+// fold averages input channel ch into output channel ch % to, silencing
+// output channels no input reaches
+func (m *Mixer) fold(pcm []int16) []int16 {
+	frames := len(pcm) / m.from
+	out := make([]int16, frames*m.to)
+	sums := make([]float64, m.to)
+	counts := make([]int, m.to)
+	for ch := 0; ch < m.from; ch++ {
+		counts[ch%m.to]++
+	}
+
+	for i := 0; i < frames; i++ {
+		for ch := range sums {
+			sums[ch] = 0
+		}
+		for ch := 0; ch < m.from; ch++ {
+			sums[ch%m.to] += float64(pcm[i*m.from+ch])
+		}
+		for ch, sum := range sums {
+			if counts[ch] > 0 {
+				out[i*m.to+ch] = clip16(sum / float64(counts[ch]))
+			}
+		}
+	}
+	return out
+}
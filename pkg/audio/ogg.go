@@ -0,0 +1,244 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// oggReader splits the first logical stream of an Ogg file into packets
+type oggReader struct {
+	r      *bufio.Reader
+	serial uint32
+	first  bool
+
+	// segments are the lacing values of the current page still to read,
+	// and data its remaining body
+	segments []byte
+	data     []byte
+	packet   []byte
+}
+
+// newOggReader reads Ogg pages from r
+func newOggReader(r *bufio.Reader) *oggReader {
+	return &oggReader{r: r, first: true}
+}
+
+// nextPage reads the next page of the stream, skipping other streams
+func (o *oggReader) nextPage() error {
+	for {
+		var header [27]byte
+		if _, err := io.ReadFull(o.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return err
+		}
+		if string(header[0:4]) != "OggS" {
+			return errors.New("lost ogg page sync")
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(o.r, segments); err != nil {
+			return err
+		}
+		size := 0
+		for _, s := range segments {
+			size += int(s)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(o.r, data); err != nil {
+			return err
+		}
+
+		serial := binary.LittleEndian.Uint32(header[14:18])
+		if o.first {
+			o.serial, o.first = serial, false
+		}
+		if serial == o.serial {
+			o.segments, o.data = segments, data
+			return nil
+		}
+	}
+}
+
+// ReadPacket returns the next packet, joined across pages
+func (o *oggReader) ReadPacket() ([]byte, error) {
+	for {
+		for len(o.segments) > 0 {
+			n := int(o.segments[0])
+			o.segments = o.segments[1:]
+			o.packet = append(o.packet, o.data[:n]...)
+			o.data = o.data[n:]
+			if n < 255 {
+				packet := o.packet
+				o.packet = nil
+				return packet, nil
+			}
+		}
+		if err := o.nextPage(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decodeOggOpus decodes an Ogg Opus file (RFC 7845) at 48kHz, dropping the
+// encoder's pre-skip
+func decodeOggOpus(r *bufio.Reader) (*Decoded, error) {
+	ogg := newOggReader(r)
+	head, err := ogg.ReadPacket()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ogg stream: %v", err)
+	}
+	if len(head) < 19 || !bytes.HasPrefix(head, []byte("OpusHead")) {
+		return nil, errors.New("ogg stream is not opus")
+	}
+	numChannels := int(head[9])
+	preSkip := int(binary.LittleEndian.Uint16(head[10:12]))
+	if numChannels < 1 || numChannels > 2 {
+		return nil, fmt.Errorf("unsupported opus channel count %d", numChannels)
+	}
+	if _, err := ogg.ReadPacket(); err != nil { // OpusTags
+		return nil, fmt.Errorf("failed to read opus tags: %v", err)
+	}
+
+	dec, err := NewOpusDecoder(OpusSampleRate, numChannels)
+	if err != nil {
+		return nil, err
+	}
+	reader := &opusPacketReader{ogg: ogg, dec: dec, skip: preSkip * numChannels}
+	return &Decoded{Reader: reader, SampleRate: OpusSampleRate, NumChannels: numChannels}, nil
+}
+
+// opusPacketReader decodes Opus packets into a PCM stream
+type opusPacketReader struct {
+	ogg  *oggReader
+	dec  FrameDecoder
+	skip int
+	out  []byte
+}
+
+// Read returns decoded samples, decoding packets as needed
+func (o *opusPacketReader) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		packet, err := o.ogg.ReadPacket()
+		if err != nil {
+			return 0, err
+		}
+		pcm, err := o.dec.Decode(packet)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode opus packet: %v", err)
+		}
+		skip := min(o.skip, len(pcm))
+		o.skip -= skip
+		o.out = PCMToBytes(pcm[skip:])
+	}
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+	return n, nil
+}
+
+// OggWriter writes one logical Ogg stream, a page per packet so live audio
+// is never held back waiting for a page to fill
+type OggWriter struct {
+	w      io.Writer
+	serial uint32
+	seq    uint32
+}
+
+// NewOggWriter starts a logical stream with the given serial number on w.
+// Streams written one after another on the same writer form a chained Ogg
+// file.
+func NewOggWriter(w io.Writer, serial uint32) *OggWriter {
+	return &OggWriter{w: w, serial: serial}
+}
+
+// WritePacket writes packet as its own page. granule is the stream's
+// granule position once the packet is decoded; last ends the stream.
+func (o *OggWriter) WritePacket(packet []byte, granule int64, last bool) error {
+	// Lacing: 255 for every full segment, then the remainder, which is 0
+	// when the packet is a multiple of 255 long
+	segments := len(packet)/255 + 1
+	if segments > 255 {
+		return fmt.Errorf("ogg packet of %d bytes does not fit a page", len(packet))
+	}
+	page := make([]byte, 27+segments, 27+segments+len(packet))
+	copy(page, "OggS")
+	var flags byte
+	if o.seq == 0 {
+		flags |= 0x02
+	}
+	if last {
+		flags |= 0x04
+	}
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.seq)
+	page[26] = byte(segments)
+	for i := 0; i < segments-1; i++ {
+		page[27+i] = 255
+	}
+	page[27+segments-1] = byte(len(packet) % 255)
+	page = append(page, packet...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	o.seq++
+	_, err := o.w.Write(page)
+	return err
+}
+
+// oggCRCTable is the lookup table of Ogg's CRC-32 (polynomial 0x04C11DB7,
+// unreflected)
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// oggCRC is the checksum of a page whose checksum field is zero
+func oggCRC(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// OpusHead returns the identification header starting an Ogg Opus stream
+// (RFC 7845) for audio originally at inputRate, whose first preSkip samples
+// at 48kHz decoders should drop. Only mono and stereo are described.
+func OpusHead(numChannels, preSkip, inputRate int) []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = byte(numChannels)
+	binary.LittleEndian.PutUint16(head[10:], uint16(preSkip))
+	binary.LittleEndian.PutUint32(head[12:], uint32(inputRate))
+	return head
+}
+
+// OpusTags returns the comment header following OpusHead, with comments
+// as "NAME=value" strings
+func OpusTags(vendor string, comments ...string) []byte {
+	tags := []byte("OpusTags")
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(vendor)))
+	tags = append(tags, vendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(comments)))
+	for _, c := range comments {
+		tags = binary.LittleEndian.AppendUint32(tags, uint32(len(c)))
+		tags = append(tags, c...)
+	}
+	return tags
+}
@@ -0,0 +1,65 @@
+//go:build opus
+
+package audio
+
+import (
+	"gopkg.in/hraban/opus.v2"
+)
+
+func init() {
+	newOpusDecoder = func(sampleRate, numChannels int) (FrameDecoder, error) {
+		dec, err := opus.NewDecoder(sampleRate, numChannels)
+		if err != nil {
+			return nil, err
+		}
+		return &opusDecoder{dec: dec, numChannels: numChannels}, nil
+	}
+	newOpusEncoder = func(sampleRate, numChannels int, voip bool) (FrameEncoder, error) {
+		application := opus.AppAudio
+		if voip {
+			application = opus.AppVoIP
+		}
+		enc, err := opus.NewEncoder(sampleRate, numChannels, application)
+		if err != nil {
+			return nil, err
+		}
+		return &opusEncoder{enc: enc}, nil
+	}
+}
+
+// maxOpusFrame is the longest Opus frame (120ms) at 48kHz
+const maxOpusFrame = 5760
+
+// opusDecoder wraps libopus
+type opusDecoder struct {
+	dec         *opus.Decoder
+	numChannels int
+}
+
+// Decode decodes one Opus packet
+func (d *opusDecoder) Decode(packet []byte) ([]int16, error) {
+	pcm := make([]int16, maxOpusFrame*d.numChannels)
+	n, err := d.dec.Decode(packet, pcm)
+	if err != nil {
+		return nil, err
+	}
+	return pcm[:n*d.numChannels], nil
+}
+
+// maxOpusPacket is the largest Opus packet libopus recommends allowing for
+const maxOpusPacket = 4000
+
+// opusEncoder wraps libopus
+type opusEncoder struct {
+	enc *opus.Encoder
+}
+
+// Encode encodes one frame into an Opus packet
+func (e *opusEncoder) Encode(pcm []int16) ([]byte, error) {
+	packet := make([]byte, maxOpusPacket)
+	n, err := e.enc.Encode(pcm, packet)
+	if err != nil {
+		return nil, err
+	}
+	return packet[:n], nil
+}
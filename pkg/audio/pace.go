@@ -0,0 +1,45 @@
+package audio
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// FrameBytes matches the chunk size sent by cmd/source (4096 stereo 16-bit frames)
+const FrameBytes = 4096 * 2 * 2
+
+// Pace reads r in frames of frameBytes and passes each to send, timed against
+// the wall clock so a reader that runs ahead (a file, or an upstream bursting
+// on connect) doesn't flood listeners. It returns nil once ctx is done, or the
+// read error (io.EOF at the end of r).
+func Pace(ctx context.Context, r io.Reader, bytesPerSecond, frameBytes int, send func([]byte)) error {
+	frameDuration := time.Duration(frameBytes) * time.Second / time.Duration(bytesPerSecond)
+
+	buf := make([]byte, frameBytes)
+	next := time.Now()
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return err
+		}
+
+		frame := make([]byte, len(buf))
+		copy(frame, buf)
+		send(frame)
+
+		next = next.Add(frameDuration)
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+		} else if wait < -time.Second {
+			// Fell far behind (e.g. a stalled reader); resync the clock
+			next = time.Now()
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package audio
+
+import "math"
+
+// PCMToBytes converts interleaved int16 samples to little-endian bytes
+func PCMToBytes(pcm []int16) []byte {
+	data := make([]byte, len(pcm)*2)
+	for i, sample := range pcm {
+		data[i*2] = byte(sample)
+		data[i*2+1] = byte(sample >> 8)
+	}
+	return data
+}
+
+// BytesToPCM converts little-endian bytes to interleaved int16 samples
+func BytesToPCM(data []byte) []int16 {
+	pcm := make([]int16, len(data)/2)
+	for i := range pcm {
+		pcm[i] = int16(uint16(data[i*2]) | uint16(data[i*2+1])<<8)
+	}
+	return pcm
+}
+
+// DownmixMono averages interleaved channels into a single channel
+func DownmixMono(pcm []int16, numChannels int) []int16 {
+	if numChannels == 1 {
+		return pcm
+	}
+
+	mono := make([]int16, len(pcm)/numChannels)
+	for i := range mono {
+		var sum int
+		for ch := 0; ch < numChannels; ch++ {
+			sum += int(pcm[i*numChannels+ch])
+		}
+		mono[i] = int16(sum / numChannels)
+	}
+	return mono
+}
+
+// MuLaw encodes a 16-bit sample as G.711 µ-law
+func MuLaw(sample int16) byte {
+	const (
+		bias = 0x84
+		clip = 32635
+	)
+
+	s := int(sample)
+	sign := 0
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > clip {
+		s = clip
+	}
+	s += bias
+
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (s >> (exponent + 3)) & 0x0F
+
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// clip16 rounds v to the nearest 16-bit sample, saturating at full scale
+func clip16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// Ramp scales interleaved samples in place by a gain moving linearly from
+// `from` to `to` across the chunk, to fade audio in or out without a click
+func Ramp(pcm []int16, numChannels int, from, to float64) {
+	frames := len(pcm) / numChannels
+	if frames == 0 {
+		return
+	}
+	for i := 0; i < frames; i++ {
+		gain := from + (to-from)*float64(i)/float64(frames)
+		for ch := 0; ch < numChannels; ch++ {
+			pcm[i*numChannels+ch] = int16(float64(pcm[i*numChannels+ch]) * gain)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package audio
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stage is one DSP step on interleaved 16-bit PCM. Process may modify pcm
+// in place and returns the samples to pass on; returning no samples drops
+// the frame. A stage keeps state across frames of one source.
+type Stage interface {
+	Process(pcm []int16) []int16
+}
+
+// StageFunc adapts a stateless function to a Stage
+type StageFunc func(pcm []int16) []int16
+
+// Process calls f
+func (f StageFunc) Process(pcm []int16) []int16 {
+	return f(pcm)
+}
+
+// Pipeline turns a source's packets into broadcast PCM: decode, convert to
+// the broadcast format, then each DSP stage in order, then encode back to
+// bytes. Muxing into a listener's format happens per listener after
+// broadcast.
+type Pipeline struct {
+	// Decoder decodes compressed packets; nil means the packets are PCM
+	Decoder FrameDecoder
+	// Convert stages, such as mixing and resampling, run before Stages
+	Convert []Stage
+	Stages  []Stage
+
+	// Tap, if set, receives the converted audio before any Stages process
+	// it. It must not keep pcm.
+	Tap func(pcm []int16)
+}
+
+// Process runs one packet through the pipeline. A nil result with no error
+// means a stage dropped the frame.
+func (p *Pipeline) Process(packet []byte) ([]byte, error) {
+	if p.Decoder == nil && len(p.Convert) == 0 && len(p.Stages) == 0 {
+		if p.Tap != nil {
+			p.Tap(BytesToPCM(packet))
+		}
+		return packet, nil
+	}
+
+	var pcm []int16
+	if p.Decoder != nil {
+		var err error
+		if pcm, err = p.Decoder.Decode(packet); err != nil {
+			return nil, err
+		}
+	} else {
+		pcm = BytesToPCM(packet)
+	}
+
+	for _, stage := range p.Convert {
+		if pcm = stage.Process(pcm); len(pcm) == 0 {
+			return nil, nil
+		}
+	}
+	if p.Tap != nil {
+		p.Tap(pcm)
+	}
+	for _, stage := range p.Stages {
+		if pcm = stage.Process(pcm); len(pcm) == 0 {
+			return nil, nil
+		}
+	}
+	return PCMToBytes(pcm), nil
+}
+
+// Speech reports whether the last frame processed held speech, according
+// to the last stage that detects it. ok is false when no stage does.
+func (p *Pipeline) Speech() (speech, ok bool) {
+	for i := len(p.Stages) - 1; i >= 0; i-- {
+		if detector, isDetector := p.Stages[i].(SpeechDetector); isDetector {
+			return detector.Speech(), true
+		}
+	}
+	return false, false
+}
+
+// StageConfig selects a registered stage by name, with its options
+type StageConfig struct {
+	Name    string       `yaml:"stage"`
+	Options StageOptions `yaml:",inline"`
+}
+
+// MarshalJSON writes the options alongside the stage name, as in the
+// config file
+func (c StageConfig) MarshalJSON() ([]byte, error) {
+	fields := map[string]string{"stage": c.Name}
+	for name, value := range c.Options {
+		fields[name] = value
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON reads a stage written as in the config file. Options may
+// be given as strings, numbers or booleans.
+func (c *StageConfig) UnmarshalJSON(data []byte) error {
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	name, ok := fields["stage"].(string)
+	if !ok {
+		return fmt.Errorf("stage name missing")
+	}
+	delete(fields, "stage")
+
+	options := make(StageOptions, len(fields))
+	for option, value := range fields {
+		switch v := value.(type) {
+		case string:
+			options[option] = v
+		case float64:
+			options[option] = strconv.FormatFloat(v, 'g', -1, 64)
+		case bool:
+			options[option] = strconv.FormatBool(v)
+		default:
+			return fmt.Errorf("stage %s: option %s must be a string, number or boolean", name, option)
+		}
+	}
+	*c = StageConfig{Name: name, Options: options}
+	return nil
+}
+
+// StageOptions are a stage's settings as written in the config file
+type StageOptions map[string]string
+
+// Float returns the named option as a number, or def when it is not set
+func (o StageOptions) Float(name string, def float64) (float64, error) {
+	value, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %q is not a number", name, value)
+	}
+	return f, nil
+}
+
+// Duration returns the named option as a duration, or def when it is not set
+func (o StageOptions) Duration(name string, def time.Duration) (time.Duration, error) {
+	value, ok := o[name]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("option %s: %q is not a duration", name, value)
+	}
+	return d, nil
+}
+
+// String returns the named option, or def when it is not set
+func (o StageOptions) String(name, def string) string {
+	if value, ok := o[name]; ok {
+		return value
+	}
+	return def
+}
+
+// StageFactory creates a stage for PCM at sampleRate with numChannels
+type StageFactory func(sampleRate, numChannels int, options StageOptions) (Stage, error)
+
+var (
+	stagesMu sync.RWMutex
+	stages   = make(map[string]StageFactory)
+)
+
+// RegisterStage makes a stage available to config under name
+func RegisterStage(name string, factory StageFactory) {
+	stagesMu.Lock()
+	defer stagesMu.Unlock()
+
+	if _, ok := stages[name]; ok {
+		panic("audio: stage " + name + " registered twice")
+	}
+	stages[name] = factory
+}
+
+// StageNames returns the registered stage names, sorted
+func StageNames() []string {
+	stagesMu.RLock()
+	defer stagesMu.RUnlock()
+
+	names := make([]string, 0, len(stages))
+	for name := range stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStages creates the configured stages, in order, for PCM at sampleRate
+// with numChannels
+func NewStages(sampleRate, numChannels int, configs []StageConfig) ([]Stage, error) {
+	var created []Stage
+	for _, config := range configs {
+		stagesMu.RLock()
+		factory, ok := stages[config.Name]
+		stagesMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown stage %q (available: %s)", config.Name, strings.Join(StageNames(), ", "))
+		}
+
+		stage, err := factory(sampleRate, numChannels, config.Options)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %v", config.Name, err)
+		}
+		created = append(created, stage)
+	}
+	return created, nil
+}
@@ -0,0 +1,146 @@
+package audio
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Preset is a processing chain suited to one kind of programme, selectable
+// by name on the source client and the server
+type Preset struct {
+	Name string
+
+	// Stages run on the source's audio before it is sent or broadcast
+	Stages []StageConfig
+
+	// OpusApplication and Frame apply where the audio is encoded to Opus:
+	// what the encoder favours, and how much audio each packet carries.
+	// Longer frames cost latency but save per-packet overhead.
+	OpusApplication string
+	Frame           time.Duration
+}
+
+// presets are the presets selectable with -preset
+var presets = map[string]Preset{
+	// Voice: rumble filtered, pauses gated, levels evened out
+	"speech": {
+		Name: "speech",
+		Stages: []StageConfig{
+			{Name: "highpass", Options: StageOptions{"freq": "80"}},
+			{Name: "gate", Options: StageOptions{"threshold": "-50"}},
+			{Name: "compressor", Options: StageOptions{"threshold": "-20", "ratio": "3", "makeup": "3"}},
+			{Name: "limiter", Options: StageOptions{"ceiling": "-1"}},
+		},
+		OpusApplication: OpusVoIP,
+		Frame:           20 * time.Millisecond,
+	},
+	// Mastered material: left alone apart from catching overs
+	"music": {
+		Name: "music",
+		Stages: []StageConfig{
+			{Name: "limiter", Options: StageOptions{"ceiling": "-1"}},
+		},
+		OpusApplication: OpusAudio,
+		Frame:           20 * time.Millisecond,
+	},
+	// Room tone and field recordings: nothing gated away, long frames
+	"ambient": {
+		Name: "ambient",
+		Stages: []StageConfig{
+			{Name: "dcblock"},
+			{Name: "limiter", Options: StageOptions{"ceiling": "-1"}},
+		},
+		OpusApplication: OpusAudio,
+		Frame:           60 * time.Millisecond,
+	},
+}
+
+// LookupPreset returns a copy of the named preset
+func LookupPreset(name string) (Preset, bool) {
+	p, ok := presets[name]
+	if !ok {
+		return Preset{}, false
+	}
+	stages := make([]StageConfig, len(p.Stages))
+	for i, stage := range p.Stages {
+		options := make(StageOptions, len(stage.Options))
+		for k, v := range stage.Options {
+			options[k] = v
+		}
+		stages[i] = StageConfig{Name: stage.Name, Options: options}
+	}
+	p.Stages = stages
+	return p, true
+}
+
+// PresetNames lists the presets, sorted
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Override changes one setting of the preset. It takes "stage.option=value"
+// to set a stage option, adding the stage at the end if the preset lacks
+// it, "stage=off" to remove a stage, and "opus.application=" or
+// "opus.frame=" for the encoder settings.
+func (p *Preset) Override(override string) error {
+	key, value, ok := strings.Cut(override, "=")
+	if !ok {
+		return fmt.Errorf("override %q is not of the form stage.option=value", override)
+	}
+	name, option, hasOption := strings.Cut(key, ".")
+
+	if name == "opus" {
+		switch option {
+		case "application":
+			if value != OpusVoIP && value != OpusAudio {
+				return fmt.Errorf("unknown opus application %q", value)
+			}
+			p.OpusApplication = value
+		case "frame":
+			frame, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid opus frame: %v", err)
+			}
+			p.Frame = frame
+		default:
+			return fmt.Errorf("unknown opus setting %q", option)
+		}
+		return nil
+	}
+
+	stagesMu.RLock()
+	_, known := stages[name]
+	stagesMu.RUnlock()
+	if !known {
+		return fmt.Errorf("unknown stage %q", name)
+	}
+	if !hasOption {
+		if value != "off" {
+			return fmt.Errorf("override %q must be %s=off or %s.option=value", override, name, name)
+		}
+		stages := p.Stages[:0]
+		for _, stage := range p.Stages {
+			if stage.Name != name {
+				stages = append(stages, stage)
+			}
+		}
+		p.Stages = stages
+		return nil
+	}
+
+	for i := range p.Stages {
+		if p.Stages[i].Name == name {
+			p.Stages[i].Options[option] = value
+			return nil
+		}
+	}
+	p.Stages = append(p.Stages, StageConfig{Name: name, Options: StageOptions{option: value}})
+	return nil
+}
@@ -28,12 +28,35 @@ func (p *Processor) ProcessRawPCM(data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("empty audio data")
 	}
 
-	// Create WAV header
+	header := p.wavHeader(uint32(len(data)))
+
+	// Combine header and data
+	output := make([]byte, 0, header.Len()+len(data))
+	output = append(output, header.Bytes()...)
+	output = append(output, data...)
+
+	return output, nil
+}
+
+// StreamHeader returns a WAV header for a live stream of unknown length.
+// The sizes are set to the maximum so players keep reading until the
+// connection closes.
+func (p *Processor) StreamHeader() []byte {
+	return p.wavHeader(0xFFFFFFFF - 36).Bytes()
+}
+
+// Header returns a WAV header for dataLen bytes of PCM
+func (p *Processor) Header(dataLen uint32) []byte {
+	return p.wavHeader(dataLen).Bytes()
+}
+
+// wavHeader builds a 44-byte WAV header for dataLen bytes of PCM
+func (p *Processor) wavHeader(dataLen uint32) *bytes.Buffer {
 	header := new(bytes.Buffer)
 
 	// RIFF header
 	header.WriteString("RIFF")
-	binary.Write(header, binary.LittleEndian, uint32(len(data)+36)) // File size - 8
+	binary.Write(header, binary.LittleEndian, dataLen+36) // File size - 8
 	header.WriteString("WAVE")
 
 	// Format chunk
@@ -48,14 +71,9 @@ func (p *Processor) ProcessRawPCM(data []byte) ([]byte, error) {
 
 	// Data chunk
 	header.WriteString("data")
-	binary.Write(header, binary.LittleEndian, uint32(len(data)))
+	binary.Write(header, binary.LittleEndian, dataLen)
 
-	// Combine header and data
-	output := make([]byte, 0, header.Len()+len(data))
-	output = append(output, header.Bytes()...)
-	output = append(output, data...)
-
-	return output, nil
+	return header
 }
 
 // GetSampleRate returns the sample rate
@@ -0,0 +1,175 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+)
+
+// LinearResampler converts interleaved PCM between sample rates using linear
+// interpolation. It keeps state between calls so consecutive chunks join
+// without clicks.
+type LinearResampler struct {
+	numChannels int
+	step        float64
+	pos         float64
+	last        []int16
+}
+
+// NewLinearResampler creates a resampler from one sample rate to another
+func NewLinearResampler(numChannels, fromRate, toRate int) *LinearResampler {
+	return &LinearResampler{
+		numChannels: numChannels,
+		step:        float64(fromRate) / float64(toRate),
+		last:        make([]int16, numChannels),
+	}
+}
+
+// Process resamples a chunk of interleaved samples
+func (r *LinearResampler) Process(pcm []int16) []int16 {
+	frames := len(pcm) / r.numChannels
+	if frames == 0 {
+		return nil
+	}
+
+	// sample returns frame i of the chunk, where -1 is the last frame of the
+	// previous chunk
+	sample := func(i, ch int) float64 {
+		if i < 0 {
+			return float64(r.last[ch])
+		}
+		return float64(pcm[i*r.numChannels+ch])
+	}
+
+	out := make([]int16, 0, (int(float64(frames)/r.step)+1)*r.numChannels)
+	for ; r.pos < float64(frames-1); r.pos += r.step {
+		i := int(r.pos)
+		if r.pos < 0 {
+			i = -1
+		}
+		frac := r.pos - float64(i)
+		for ch := 0; ch < r.numChannels; ch++ {
+			a, b := sample(i, ch), sample(i+1, ch)
+			out = append(out, int16(a+(b-a)*frac))
+		}
+	}
+
+	r.pos -= float64(frames)
+	copy(r.last, pcm[(frames-1)*r.numChannels:])
+	return out
+}
+
+const (
+	// sincZeroCrossings is how many zero crossings of the sinc the filter
+	// spans on each side, trading CPU for a steeper cutoff
+	sincZeroCrossings = 16
+	// sincPhases is the resolution of the precomputed filter table
+	sincPhases = 512
+)
+
+// SincResampler converts interleaved PCM between sample rates with a
+// Blackman-windowed sinc filter. It is much cleaner than linear
+// interpolation (no aliasing or high frequency roll-off to speak of) at the
+// cost of more CPU and a delay of a few dozen samples.
+type SincResampler struct {
+	numChannels int
+	step        float64
+	halfTaps    int
+	table       []float64
+
+	// buf holds input frames still needed, with pos the position of the
+	// next output frame within it
+	buf []int16
+	pos float64
+}
+
+// NewSincResampler creates a resampler from one sample rate to another
+func NewSincResampler(numChannels, fromRate, toRate int) *SincResampler {
+	step := float64(fromRate) / float64(toRate)
+
+	// When downsampling, the cutoff drops to the new Nyquist frequency and
+	// the filter widens to match
+	cutoff := math.Min(1, 1/step)
+	halfTaps := int(math.Ceil(sincZeroCrossings / cutoff))
+
+	table := make([]float64, halfTaps*sincPhases+1)
+	for i := range table {
+		x := float64(i) / sincPhases
+		t := x / float64(halfTaps)
+		window := 0.42 + 0.5*math.Cos(math.Pi*t) + 0.08*math.Cos(2*math.Pi*t)
+		table[i] = cutoff * sinc(cutoff*x) * window
+	}
+
+	return &SincResampler{
+		numChannels: numChannels,
+		step:        step,
+		halfTaps:    halfTaps,
+		table:       table,
+		// Start with silence before the first frame so it can be filtered
+		buf: make([]int16, halfTaps*numChannels),
+		pos: float64(halfTaps),
+	}
+}
+
+// sinc is the normalized sinc function
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// kernel returns the filter weight at distance x, in input frames
+func (r *SincResampler) kernel(x float64) float64 {
+	x = math.Abs(x) * sincPhases
+	i := int(x)
+	if i >= len(r.table)-1 {
+		return 0
+	}
+	frac := x - float64(i)
+	return r.table[i] + (r.table[i+1]-r.table[i])*frac
+}
+
+// Process resamples a chunk of interleaved samples
+func (r *SincResampler) Process(pcm []int16) []int16 {
+	r.buf = append(r.buf, pcm...)
+	frames := len(r.buf) / r.numChannels
+
+	var out []int16
+	for ; int(r.pos)+r.halfTaps < frames; r.pos += r.step {
+		center := int(r.pos)
+		for ch := 0; ch < r.numChannels; ch++ {
+			var sum float64
+			for j := center - r.halfTaps + 1; j <= center+r.halfTaps; j++ {
+				if j < 0 {
+					continue
+				}
+				sum += float64(r.buf[j*r.numChannels+ch]) * r.kernel(r.pos-float64(j))
+			}
+			out = append(out, clip16(sum))
+		}
+	}
+
+	// Drop input no future output frame reaches
+	if drop := int(r.pos) - r.halfTaps + 1; drop > 0 {
+		r.buf = append(r.buf[:0], r.buf[drop*r.numChannels:]...)
+		r.pos -= float64(drop)
+	}
+	return out
+}
+
+// Resampling qualities, for NewResampler
+const (
+	ResampleLinear = "linear"
+	ResampleSinc   = "sinc"
+)
+
+// NewResampler creates a resampling stage of the given quality
+func NewResampler(quality string, numChannels, fromRate, toRate int) (Stage, error) {
+	switch quality {
+	case ResampleLinear:
+		return NewLinearResampler(numChannels, fromRate, toRate), nil
+	case ResampleSinc:
+		return NewSincResampler(numChannels, fromRate, toRate), nil
+	}
+	return nil, fmt.Errorf("unknown resampling quality %q", quality)
+}
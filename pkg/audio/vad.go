@@ -0,0 +1,164 @@
+package audio
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+func init() {
+	RegisterStage("vad", newVADStage)
+}
+
+const (
+	// vadWindow is the length of the blocks the VAD classifies
+	vadWindow = 10 * time.Millisecond
+	// vadFloorRise is how fast (in dB per second) the noise floor estimate
+	// climbs towards a louder background
+	vadFloorRise = 0.5
+	// vadOnset is how many consecutive loud blocks count as speech, so
+	// clicks and knocks do not
+	vadOnset = 3
+)
+
+// SpeechDetector is implemented by stages that tell speech from other
+// sound, such as the VAD
+type SpeechDetector interface {
+	// Speech reports whether the last frame processed held speech
+	Speech() bool
+}
+
+// VAD is a voice activity detector. It tracks the background noise floor
+// in the speech band (200Hz-4kHz) and reports speech while the band's
+// energy stays above the floor by the threshold, plus a hangover so words
+// are not cut between syllables. As a pipeline stage it passes audio
+// through unchanged; later stages and the server read its verdict.
+type VAD struct {
+	numChannels int
+	threshold   float64
+	minLevel    float64
+
+	bands       []*biquad
+	blockFrames int
+	hangover    int
+
+	// The current block's energy and length, in frames
+	energy float64
+	frames int
+
+	floor   float64
+	loud    int
+	holding int
+	speech  bool
+}
+
+// NewVAD creates a detector for interleaved PCM at sampleRate. threshold is
+// how far (in dB) above the noise floor speech must be, and minLevel (in
+// dBFS) is the quietest sound that can be speech.
+func NewVAD(sampleRate, numChannels int, threshold, minLevel float64, hangover time.Duration) *VAD {
+	blockFrames := max(int(vadWindow.Seconds()*float64(sampleRate)), 1)
+	return &VAD{
+		numChannels: numChannels,
+		threshold:   threshold,
+		minLevel:    minLevel,
+		bands: []*biquad{
+			highPass(sampleRate, 1, 200, math.Sqrt2/2),
+			lowPass(sampleRate, 1, min(4000, 0.45*float64(sampleRate)), math.Sqrt2/2),
+		},
+		blockFrames: blockFrames,
+		hangover:    int(hangover / vadWindow),
+		floor:       math.Inf(1),
+	}
+}
+
+// newVADStage creates a VAD from the "threshold" (dB), "min_level" (dBFS)
+// and "hangover" options
+func newVADStage(sampleRate, numChannels int, options StageOptions) (Stage, error) {
+	threshold, err := options.Float("threshold", 10)
+	if err != nil {
+		return nil, err
+	}
+	if threshold <= 0 {
+		return nil, fmt.Errorf("threshold must be positive")
+	}
+	minLevel, err := options.Float("min_level", -55)
+	if err != nil {
+		return nil, err
+	}
+	hangover, err := options.Duration("hangover", 300*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return NewVAD(sampleRate, numChannels, threshold, minLevel, hangover), nil
+}
+
+// Detect analyzes pcm and reports whether it holds speech: whether any
+// block in it did, or the hangover after one has not run out
+func (v *VAD) Detect(pcm []int16) bool {
+	speech := false
+	for i := 0; i+v.numChannels <= len(pcm); i += v.numChannels {
+		var sum float64
+		for _, sample := range pcm[i : i+v.numChannels] {
+			sum += float64(sample)
+		}
+		x := sum / float64(v.numChannels) / 32768
+		for _, band := range v.bands {
+			x = band.process(0, x)
+		}
+		v.energy += x * x
+		v.frames++
+
+		if v.frames == v.blockFrames {
+			if v.classify() {
+				speech = true
+			}
+			v.energy, v.frames = 0, 0
+		}
+	}
+	v.speech = speech || v.holding > 0
+	return v.speech
+}
+
+// classify updates the noise floor with the finished block and reports
+// whether the block is speech
+func (v *VAD) classify() bool {
+	level := SilenceDBFS
+	if v.energy > 0 {
+		level = math.Max(10*math.Log10(v.energy/float64(v.frames)), SilenceDBFS)
+	}
+
+	// The floor follows quieter blocks at once and louder ones slowly, so
+	// it settles on the background between words
+	rise := vadFloorRise * vadWindow.Seconds()
+	if level < v.floor {
+		v.floor = level
+	} else {
+		v.floor += rise
+	}
+
+	if level > v.floor+v.threshold && level > v.minLevel {
+		v.loud++
+	} else {
+		v.loud = 0
+	}
+
+	if v.loud >= vadOnset {
+		v.holding = v.hangover
+		return true
+	}
+	if v.holding > 0 {
+		v.holding--
+	}
+	return false
+}
+
+// Process runs Detect, passing pcm on unchanged
+func (v *VAD) Process(pcm []int16) []int16 {
+	v.Detect(pcm)
+	return pcm
+}
+
+// Speech reports whether the last frame processed held speech
+func (v *VAD) Speech() bool {
+	return v.speech
+}
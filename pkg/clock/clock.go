@@ -0,0 +1,241 @@
+// Package clock keeps a media clock disciplined by a reference, an NTP
+// server or a PTP hardware clock, so timestamps stay accurate over long
+// uptimes even when the system clock drifts or is stepped.
+package clock
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultPoll is how often the reference is queried
+	DefaultPoll = 64 * time.Second
+	// maxSlew is how fast the clock is pulled towards the reference, so it
+	// never jumps or runs backwards for small corrections: 500µs a second
+	maxSlew = 500e-6
+	// stepThreshold is the correction above which the clock steps instead
+	// of slewing, as it would take minutes to slew out
+	stepThreshold = 128 * time.Millisecond
+	// driftSamples is how many measurements the drift is estimated over
+	driftSamples = 16
+)
+
+// reference measures how far the system clock is from a better one
+type reference interface {
+	// measure returns the reference's time minus the system's, and the
+	// round trip the measurement took
+	measure(ctx context.Context) (offset, delay time.Duration, err error)
+	Close() error
+}
+
+// sample is one measurement of the offset
+type sample struct {
+	at     time.Time
+	offset time.Duration
+}
+
+// Stats describes how well the clock follows its reference
+type Stats struct {
+	Source string `json:"source"`
+	// Synced is false until the first measurement succeeds
+	Synced   bool       `json:"synced"`
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	// OffsetMs is the correction applied to the system clock now, and
+	// MeasuredOffsetMs the last one measured, which it slews towards
+	OffsetMs         float64 `json:"offset_ms"`
+	MeasuredOffsetMs float64 `json:"measured_offset_ms"`
+	DelayMs          float64 `json:"delay_ms"`
+	// DriftPPM is how fast the system clock drifts from the reference, in
+	// parts per million; positive means it runs slow
+	DriftPPM  float64 `json:"drift_ppm"`
+	Steps     int64   `json:"steps"`
+	Samples   int64   `json:"samples"`
+	Errors    int64   `json:"errors"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+// Clock is the system clock corrected by a reference. A nil Clock is the
+// system clock.
+type Clock struct {
+	ref    reference
+	poll   time.Duration
+	logger *zap.SugaredLogger
+
+	mu      sync.RWMutex
+	samples []sample
+	// The applied offset follows the line anchor + drift*(t - anchorAt),
+	// less a correction that shrinks at maxSlew from correctionAt
+	anchor       time.Duration
+	anchorAt     time.Time
+	drift        float64
+	correction   time.Duration
+	correctionAt time.Time
+	stats        Stats
+}
+
+// New returns a clock following source: "ntp:host[:port]", a bare NTP host,
+// or "ptp:/dev/ptpN" for a PTP hardware clock kept in time by ptp4l. It is
+// queried every poll once Run starts.
+func New(source string, poll time.Duration, logger *zap.SugaredLogger) (*Clock, error) {
+	var ref reference
+	var err error
+	switch {
+	case source == "ptp":
+		ref, err = openPTP("/dev/ptp0")
+	case strings.HasPrefix(source, "ptp:"):
+		ref, err = openPTP(strings.TrimPrefix(source, "ptp:"))
+	case source != "":
+		ref, err = newNTP(strings.TrimPrefix(source, "ntp:"))
+	default:
+		return nil, fmt.Errorf("no clock source")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if poll <= 0 {
+		poll = DefaultPoll
+	}
+	return &Clock{ref: ref, poll: poll, logger: logger, stats: Stats{Source: source}}, nil
+}
+
+// Now returns the current time on the disciplined clock
+func (c *Clock) Now() time.Time {
+	return c.At(time.Now())
+}
+
+// At converts t, read from the system clock, to the disciplined clock
+func (c *Clock) At(t time.Time) time.Time {
+	if c == nil {
+		return t
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return t.Add(c.offsetAt(t))
+}
+
+// offsetAt returns the offset applied at t, with c.mu held
+func (c *Clock) offsetAt(t time.Time) time.Duration {
+	if c.anchorAt.IsZero() {
+		return 0
+	}
+	line := c.anchor + time.Duration(c.drift*float64(t.Sub(c.anchorAt)))
+	slewed := time.Duration(maxSlew * float64(t.Sub(c.correctionAt)))
+	remaining := c.correction
+	switch {
+	case remaining > 0:
+		remaining = max(remaining-slewed, 0)
+	case remaining < 0:
+		remaining = min(remaining+slewed, 0)
+	}
+	return line - remaining
+}
+
+// Run measures the reference every poll until ctx is done
+func (c *Clock) Run(ctx context.Context) {
+	defer c.ref.Close()
+	ticker := time.NewTicker(c.poll)
+	defer ticker.Stop()
+	for {
+		c.update(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update takes a measurement and disciplines the clock with it
+func (c *Clock) update(ctx context.Context) {
+	offset, delay, err := c.ref.measure(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.stats.Errors++
+		c.stats.LastError = err.Error()
+		c.logger.Warnf("Failed to measure the clock against %s: %v", c.stats.Source, err)
+		return
+	}
+
+	applied := c.offsetAt(now)
+	c.samples = append(c.samples, sample{at: now, offset: offset})
+	if len(c.samples) > driftSamples {
+		c.samples = c.samples[1:]
+	}
+	target, drift := c.fit(now)
+
+	// Small corrections slew so timestamps stay monotonic; large ones, or
+	// the first, step
+	correction := target - applied
+	if c.anchorAt.IsZero() || correction > stepThreshold || correction < -stepThreshold {
+		if !c.anchorAt.IsZero() {
+			c.stats.Steps++
+			c.logger.Warnw("Stepped the media clock", "source", c.stats.Source, "by", correction)
+			// The drift estimate spans the step, so start it over
+			c.samples = c.samples[len(c.samples)-1:]
+			target, drift = offset, 0
+		}
+		correction = 0
+	}
+	c.anchor, c.anchorAt, c.drift = target, now, drift
+	c.correction, c.correctionAt = correction, now
+
+	c.stats.Synced = true
+	c.stats.LastSync = &now
+	c.stats.MeasuredOffsetMs = milliseconds(offset)
+	c.stats.DelayMs = milliseconds(delay)
+	c.stats.DriftPPM = math.Round(drift*1e6*1000) / 1000
+	c.stats.Samples++
+	c.stats.LastError = ""
+}
+
+// fit returns the offset at now and the drift, from a least-squares line
+// through the samples, which smooths the noise of single measurements
+func (c *Clock) fit(now time.Time) (time.Duration, float64) {
+	n := float64(len(c.samples))
+	if len(c.samples) < 2 {
+		return c.samples[len(c.samples)-1].offset, 0
+	}
+	var sx, sy, sxx, sxy float64
+	for _, s := range c.samples {
+		x := s.at.Sub(now).Seconds()
+		y := s.offset.Seconds()
+		sx, sy, sxx, sxy = sx+x, sy+y, sxx+x*x, sxy+x*y
+	}
+	denom := n*sxx - sx*sx
+	if denom == 0 {
+		return c.samples[len(c.samples)-1].offset, 0
+	}
+	slope := (n*sxy - sx*sy) / denom
+	intercept := (sy - slope*sx) / n
+	return time.Duration(intercept * float64(time.Second)), slope
+}
+
+// Stats returns how the clock follows its reference, or nil for the
+// system clock
+func (c *Clock) Stats() *Stats {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	stats := c.stats
+	stats.OffsetMs = milliseconds(c.offsetAt(time.Now()))
+	return &stats
+}
+
+// milliseconds converts d to milliseconds, to the microsecond
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
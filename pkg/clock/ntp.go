@@ -0,0 +1,126 @@
+package clock
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// ntpQueries is how many requests each measurement sends, keeping the
+	// one with the shortest round trip, whose offset is the most accurate
+	ntpQueries = 4
+	// ntpTimeout bounds each request
+	ntpTimeout = 2 * time.Second
+	// ntpEpoch is 1900-01-01, where NTP timestamps count from, in Unix time
+	ntpEpoch = -2208988800
+)
+
+// ntpServer is a reference queried over SNTP (RFC 4330)
+type ntpServer struct {
+	addr string
+}
+
+// newNTP returns a reference querying the NTP server at addr, port 123
+// unless given
+func newNTP(addr string) (*ntpServer, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "123")
+	}
+	return &ntpServer{addr: addr}, nil
+}
+
+// measure queries the server a few times, keeping the best answer
+func (s *ntpServer) measure(ctx context.Context) (time.Duration, time.Duration, error) {
+	var best, bestDelay time.Duration
+	var err error
+	found := false
+	for range ntpQueries {
+		offset, delay, qerr := s.query(ctx)
+		if qerr != nil {
+			err = qerr
+			continue
+		}
+		if !found || delay < bestDelay {
+			best, bestDelay, found = offset, delay, true
+		}
+	}
+	if !found {
+		return 0, 0, err
+	}
+	return best, bestDelay, nil
+}
+
+// query sends one request and computes the offset and round trip from the
+// four timestamps of the exchange
+func (s *ntpServer) query(ctx context.Context) (time.Duration, time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	// Version 4, client mode, with our transmit time for the server to echo
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3
+	sent := time.Now()
+	binary.BigEndian.PutUint64(req[40:], toNTP(sent))
+	if _, err := conn.Write(req); err != nil {
+		return 0, 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return 0, 0, err
+	}
+	if n < 48 {
+		return 0, 0, errors.New("short NTP response")
+	}
+	if mode := resp[0] & 7; mode != 4 {
+		return 0, 0, fmt.Errorf("unexpected NTP mode %d", mode)
+	}
+	if resp[1] == 0 {
+		return 0, 0, fmt.Errorf("NTP server refused the request (%s)", resp[12:16])
+	}
+	if resp[0]>>6 == 3 {
+		return 0, 0, errors.New("NTP server is not synchronized")
+	}
+	if binary.BigEndian.Uint64(resp[24:]) != binary.BigEndian.Uint64(req[40:]) {
+		return 0, 0, errors.New("NTP response does not match the request")
+	}
+
+	t1, t4 := sent, received
+	t2 := fromNTP(binary.BigEndian.Uint64(resp[32:]))
+	t3 := fromNTP(binary.BigEndian.Uint64(resp[40:]))
+	// The server's clock is read at t2 and t3, ours at t1 and t4, so the
+	// times compared are wall times without the monotonic reading
+	t1, t4 = t1.Round(0), t4.Round(0)
+	offset := (t2.Sub(t1) + t3.Sub(t4)) / 2
+	delay := t4.Sub(t1) - t3.Sub(t2)
+	return offset, delay, nil
+}
+
+// Close does nothing; each query has its own socket
+func (s *ntpServer) Close() error {
+	return nil
+}
+
+// toNTP converts t to a 64-bit NTP timestamp
+func toNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() - ntpEpoch)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// fromNTP converts a 64-bit NTP timestamp to a time
+func fromNTP(ts uint64) time.Time {
+	secs := int64(ts>>32) + ntpEpoch
+	nanos := (ts & 0xffffffff) * uint64(time.Second) >> 32
+	return time.Unix(secs, int64(nanos))
+}
@@ -0,0 +1,61 @@
+package clock
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultTAIOffset is TAI minus UTC since 2017, for when the kernel has
+// not been told it
+const defaultTAIOffset = 37 * time.Second
+
+// ptpClock is a PTP hardware clock, which ptp4l keeps on the grandmaster's
+// time, read directly through its character device
+type ptpClock struct {
+	dev *os.File
+	id  int32
+}
+
+// openPTP opens the hardware clock at path, such as /dev/ptp0
+func openPTP(path string) (*ptpClock, error) {
+	dev, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PTP clock: %v", err)
+	}
+	// FD_TO_CLOCKID: dynamic clocks are addressed by their file descriptor
+	id := int32((^int(dev.Fd()))<<3 | 3)
+	return &ptpClock{dev: dev, id: id}, nil
+}
+
+// measure reads the hardware clock between two readings of the system
+// clock. Hardware clocks keep TAI, so the offset is converted to UTC.
+func (p *ptpClock) measure(ctx context.Context) (time.Duration, time.Duration, error) {
+	var before, phc, after unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_REALTIME, &before); err != nil {
+		return 0, 0, err
+	}
+	if err := unix.ClockGettime(p.id, &phc); err != nil {
+		return 0, 0, fmt.Errorf("failed to read PTP clock: %v", err)
+	}
+	if err := unix.ClockGettime(unix.CLOCK_REALTIME, &after); err != nil {
+		return 0, 0, err
+	}
+
+	tai := defaultTAIOffset
+	var tx unix.Timex
+	if _, err := unix.Adjtimex(&tx); err == nil && tx.Tai > 0 {
+		tai = time.Duration(tx.Tai) * time.Second
+	}
+	system := (before.Nano() + after.Nano()) / 2
+	offset := time.Duration(phc.Nano()-system) - tai
+	return offset, time.Duration(after.Nano() - before.Nano()), nil
+}
+
+// Close closes the clock's device
+func (p *ptpClock) Close() error {
+	return p.dev.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package clock
+
+import (
+	"errors"
+)
+
+// openPTP is unsupported off Linux, where hardware clocks are not exposed
+func openPTP(path string) (reference, error) {
+	return nil, errors.New("PTP hardware clocks are only supported on Linux")
+}
@@ -0,0 +1,634 @@
+package dvr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/clock"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// segmentDuration is how much audio each segment file holds
+	segmentDuration = 10 * time.Second
+
+	// indexRecordSize is one index record: unix nanos, offset and length
+	indexRecordSize = 16
+	// flacRecordSize is an index record of a FLAC segment, which adds the
+	// frame's length once decoded
+	flacRecordSize = indexRecordSize + 4
+
+	// seekInterval is how often FLAC segments get a seek point, and
+	// seekPoints how many a segment has room for
+	seekInterval = time.Second
+	seekPoints   = int(2 * segmentDuration / seekInterval)
+)
+
+// Storage is how segments hold their audio, and their data files' extension
+type Storage string
+
+const (
+	// StoragePCM keeps the broadcast frames as they are
+	StoragePCM Storage = "pcm"
+	// StorageFLAC compresses them losslessly to about half the size. Each
+	// segment is a FLAC file that plays on its own, with a seek table.
+	StorageFLAC Storage = "flac"
+)
+
+// entry locates one broadcast frame in a segment
+type entry struct {
+	time   time.Time
+	seq    uint64
+	offset uint32
+	length uint32
+	// size is the frame's length as PCM, which differs from length when
+	// the segment is FLAC
+	size uint32
+	flac bool
+}
+
+// Recorder keeps a rolling archive of the broadcast on disk. Audio goes into
+// fixed-length segment files, each with an index of frame timestamps and
+// offsets. The index is kept in memory so joins in the past and clips seek
+// instantly, while the audio itself never is, so the depth can reach hours.
+// It implements the Listener interface and is fed like any other listener.
+type Recorder struct {
+	dir     string
+	depth   time.Duration
+	storage Storage
+	logger  *zap.SugaredLogger
+	// clock timestamps frames; nil uses the system clock
+	clock *clock.Clock
+
+	mu       sync.RWMutex
+	entries  []entry
+	base     uint64 // number of entries trimmed so far
+	seq      uint64
+	data     *hashingFile
+	index    *hashingFile
+	size     uint32
+	segStart time.Time
+
+	// format is the broadcast's, which FLAC segments are encoded in, with
+	// the current segment's encoder and seek points
+	format ws.SourceFormat
+	flac   *audio.FLACEncoder
+	seeks  []audio.FLACSeekPoint
+
+	// sums are the checksums of closed segment files, by file name
+	sums map[string]string
+
+	// appended is closed and replaced whenever a frame is added
+	appended chan struct{}
+}
+
+// Open loads the archive in dir, creating it if needed, and keeps depth of
+// audio from then on, storing new segments as storage says. Segments
+// recorded with another storage stay readable.
+func Open(dir string, depth time.Duration, storage Storage, logger *zap.SugaredLogger) (*Recorder, error) {
+	if storage != StoragePCM && storage != StorageFLAC {
+		return nil, fmt.Errorf("unknown DVR storage %q", storage)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		dir:      dir,
+		depth:    depth,
+		storage:  storage,
+		logger:   logger,
+		appended: make(chan struct{}),
+	}
+
+	seqs, err := r.segments()
+	if err != nil {
+		return nil, err
+	}
+	if r.sums, err = readManifest(dir); err != nil {
+		return nil, fmt.Errorf("failed to read DVR manifest: %v", err)
+	}
+	for _, seq := range seqs {
+		r.seq = seq
+		loaded, err := r.loadIndex(seq)
+		if err != nil {
+			logger.Warnf("Skipping DVR segment %d: %v", seq, err)
+			continue
+		}
+		if loaded == 0 {
+			r.remove(seq)
+			continue
+		}
+		// The segment recording when the server last stopped has no checksums
+		r.addSums(seq)
+	}
+	r.addUploadSums()
+	for name := range r.sums {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			logger.Warnf("DVR file %s in the manifest is missing", name)
+			delete(r.sums, name)
+		}
+	}
+	r.trim(r.clock.Now())
+	r.saveManifest()
+
+	if len(r.entries) > 0 {
+		logger.Infof("Loaded %s of DVR audio from %s", r.entries[len(r.entries)-1].time.Sub(r.entries[0].time).Round(time.Second), dir)
+	}
+	return r, nil
+}
+
+// segments lists the sequence numbers of the segments on disk, oldest first
+func (r *Recorder) segments() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(r.dir, "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".idx"), 10, 64)
+		if err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// path returns the file name of a segment's data or index
+func (r *Recorder) path(seq uint64, ext string) string {
+	return filepath.Join(r.dir, fmt.Sprintf("%010d.%s", seq, ext))
+}
+
+// storageOf returns how a segment on disk holds its audio
+func (r *Recorder) storageOf(seq uint64) Storage {
+	if _, err := os.Stat(r.path(seq, string(StorageFLAC))); err == nil {
+		return StorageFLAC
+	}
+	return StoragePCM
+}
+
+// loadIndex reads a segment's index into memory and returns the number of
+// frames in it. A record cut short by a crash is ignored.
+func (r *Recorder) loadIndex(seq uint64) (int, error) {
+	data, err := os.ReadFile(r.path(seq, "idx"))
+	if err != nil {
+		return 0, err
+	}
+
+	flac := r.storageOf(seq) == StorageFLAC
+	size := indexRecordSize
+	if flac {
+		size = flacRecordSize
+	}
+	for i := 0; i+size <= len(data); i += size {
+		record := data[i : i+size]
+		e := entry{
+			time:   time.Unix(0, int64(binary.LittleEndian.Uint64(record[0:8]))),
+			seq:    seq,
+			offset: binary.LittleEndian.Uint32(record[8:12]),
+			length: binary.LittleEndian.Uint32(record[12:16]),
+			flac:   flac,
+		}
+		e.size = e.length
+		if flac {
+			e.size = binary.LittleEndian.Uint32(record[16:20])
+		}
+		r.entries = append(r.entries, e)
+	}
+	return len(data) / size, nil
+}
+
+// SetClock sets the clock frames are timestamped with, in place of the
+// system clock. It must be called before the first frame.
+func (r *Recorder) SetClock(c *clock.Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = c
+}
+
+// Send appends a broadcast frame to the archive
+func (r *Recorder) Send(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	if r.data == nil || now.Sub(r.segStart) >= segmentDuration {
+		if err := r.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	stored, size := data, len(data)
+	if r.flac != nil {
+		stored, size = r.encode(data)
+	}
+	if _, err := r.data.Write(stored); err != nil {
+		return err
+	}
+
+	var record [flacRecordSize]byte
+	binary.LittleEndian.PutUint64(record[0:8], uint64(now.UnixNano()))
+	binary.LittleEndian.PutUint32(record[8:12], r.size)
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(stored)))
+	binary.LittleEndian.PutUint32(record[16:20], uint32(size))
+	recordSize := indexRecordSize
+	if r.flac != nil {
+		recordSize = flacRecordSize
+	}
+	if _, err := r.index.Write(record[:recordSize]); err != nil {
+		return err
+	}
+
+	r.entries = append(r.entries, entry{
+		time:   now,
+		seq:    r.seq,
+		offset: r.size,
+		length: uint32(len(stored)),
+		size:   uint32(size),
+		flac:   r.flac != nil,
+	})
+	r.size += uint32(len(stored))
+
+	close(r.appended)
+	r.appended = make(chan struct{})
+	return nil
+}
+
+// rotate closes the current segment, starts the next one and drops segments
+// that have fallen out of the archive depth. Called with the lock held.
+func (r *Recorder) rotate(now time.Time) error {
+	r.closeSegment()
+	r.trim(now)
+	r.saveManifest()
+
+	if r.storage == StorageFLAC && r.format.SampleRate == 0 {
+		return errors.New("the DVR needs the broadcast format to record FLAC")
+	}
+	r.seq++
+	data, err := createHashing(r.path(r.seq, string(r.storage)))
+	if err != nil {
+		return err
+	}
+	index, err := createHashing(r.path(r.seq, "idx"))
+	if err != nil {
+		data.Close()
+		return err
+	}
+
+	r.data, r.index = data, index
+	r.size = 0
+	r.segStart = now
+	r.flac = nil
+	if r.storage == StorageFLAC {
+		return r.startFLAC()
+	}
+	return nil
+}
+
+// trim removes whole segments whose newest frame is older than the depth,
+// and uploads that started before it
+func (r *Recorder) trim(now time.Time) {
+	cutoff := now.Add(-r.depth)
+	r.trimUploads(cutoff)
+	for len(r.entries) > 0 {
+		seq := r.entries[0].seq
+		end := sort.Search(len(r.entries), func(i int) bool { return r.entries[i].seq != seq })
+		if (seq == r.seq && r.data != nil) || !r.entries[end-1].time.Before(cutoff) {
+			return
+		}
+
+		r.remove(seq)
+		r.entries = r.entries[end:]
+		r.base += uint64(end)
+	}
+}
+
+// remove deletes a segment's files and checksums
+func (r *Recorder) remove(seq uint64) {
+	for _, ext := range []string{string(StoragePCM), string(StorageFLAC), "idx"} {
+		os.Remove(r.path(seq, ext))
+		delete(r.sums, filepath.Base(r.path(seq, ext)))
+	}
+}
+
+// addSums checksums a closed segment's files if the manifest lacks them
+func (r *Recorder) addSums(seq uint64) {
+	for _, ext := range []string{string(r.storageOf(seq)), "idx"} {
+		name := filepath.Base(r.path(seq, ext))
+		if _, ok := r.sums[name]; ok {
+			continue
+		}
+		sum, err := hashFile(r.path(seq, ext))
+		if err != nil {
+			r.logger.Warnf("Failed to checksum DVR segment %s: %v", name, err)
+			continue
+		}
+		r.sums[name] = sum
+	}
+}
+
+// saveManifest writes the checksums of the closed segments to disk
+func (r *Recorder) saveManifest() {
+	if err := writeManifest(r.dir, r.sums); err != nil {
+		r.logger.Warnf("Failed to write DVR manifest: %v", err)
+	}
+}
+
+// closeSegment closes the files of the segment being written, recording
+// their checksums
+func (r *Recorder) closeSegment() {
+	if r.data == nil {
+		return
+	}
+	if r.flac != nil {
+		// Finishing the headers rewrites the start of the file, so its
+		// checksum is taken afresh
+		if err := r.finishFLAC(); err != nil {
+			r.logger.Warnf("Failed to finish DVR segment %s: %v", r.data.Name(), err)
+		}
+		r.data.Close()
+		if sum, err := hashFile(r.data.Name()); err == nil {
+			r.sums[filepath.Base(r.data.Name())] = sum
+		}
+	} else {
+		r.data.Close()
+		r.sums[filepath.Base(r.data.Name())] = r.data.sum()
+	}
+	r.index.Close()
+	r.sums[filepath.Base(r.index.Name())] = r.index.sum()
+	r.data, r.index, r.flac = nil, nil, nil
+}
+
+// SendFormat records the broadcast format. A FLAC segment holds one
+// format, so a change starts the next segment.
+func (r *Recorder) SendFormat(format ws.SourceFormat) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := format.SampleRate != r.format.SampleRate || format.Channels != r.format.Channels
+	r.format = format
+	if changed && r.flac != nil {
+		r.closeSegment()
+	}
+	return nil
+}
+
+// Close stops recording
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closeSegment()
+	r.saveManifest()
+	return nil
+}
+
+// Range returns the timestamps of the oldest and newest archived frames
+func (r *Recorder) Range() (time.Time, time.Time, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.entries) == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	return r.entries[0].time, r.entries[len(r.entries)-1].time, true
+}
+
+// Storage returns how new segments hold their audio
+func (r *Recorder) Storage() Storage {
+	return r.storage
+}
+
+// Depth returns how far back the archive reaches at most
+func (r *Recorder) Depth() time.Duration {
+	return r.depth
+}
+
+// search returns the position of the first frame at or after t. Positions
+// count every frame ever archived, so they stay valid as the archive is trimmed.
+// Called with the lock held.
+func (r *Recorder) search(t time.Time) uint64 {
+	i := sort.Search(len(r.entries), func(i int) bool { return !r.entries[i].time.Before(t) })
+	return r.base + uint64(i)
+}
+
+// segmentReader reads frames, keeping the last segment file open and the
+// last FLAC frame decoded
+type segmentReader struct {
+	r    *Recorder
+	seq  uint64
+	file *os.File
+
+	decodedAt entry
+	decoded   []byte
+}
+
+// read returns the audio for an entry
+func (sr *segmentReader) read(e entry) ([]byte, error) {
+	buf := make([]byte, e.size)
+	if _, err := sr.readAt(e, buf, 0); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// readAt reads from an entry's audio, starting off bytes into it
+func (sr *segmentReader) readAt(e entry, p []byte, off int64) (int, error) {
+	if sr.file == nil || sr.seq != e.seq {
+		sr.close()
+		storage := StoragePCM
+		if e.flac {
+			storage = StorageFLAC
+		}
+		file, err := os.Open(sr.r.path(e.seq, string(storage)))
+		if err != nil {
+			return 0, err
+		}
+		sr.file, sr.seq = file, e.seq
+	}
+
+	if remaining := int64(e.size) - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if !e.flac {
+		return sr.file.ReadAt(p, int64(e.offset)+off)
+	}
+
+	if sr.decoded == nil || sr.decodedAt != e {
+		frame := make([]byte, e.length)
+		if _, err := sr.file.ReadAt(frame, int64(e.offset)); err != nil {
+			return 0, err
+		}
+		pcm, err := audio.DecodeFLACFrames(frame)
+		if err != nil {
+			return 0, fmt.Errorf("segment %d: %v", e.seq, err)
+		}
+		sr.decoded, sr.decodedAt = audio.PCMToBytes(pcm), e
+	}
+	n := copy(p, sr.decoded[min(off, int64(len(sr.decoded))):])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// close closes the open segment file
+func (sr *segmentReader) close() {
+	if sr.file != nil {
+		sr.file.Close()
+		sr.file = nil
+	}
+}
+
+// Clip is a span of archived audio
+type Clip struct {
+	r       *Recorder
+	entries []entry
+}
+
+// Clip returns the archived audio between from and to
+func (r *Recorder) Clip(from, to time.Time) *Clip {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	start, end := r.search(from)-r.base, r.search(to)-r.base
+	if end < start {
+		end = start
+	}
+	return &Clip{r: r, entries: append([]entry(nil), r.entries[start:end]...)}
+}
+
+// Size returns the clip length in bytes
+func (c *Clip) Size() int64 {
+	var size int64
+	for _, e := range c.entries {
+		size += int64(e.size)
+	}
+	return size
+}
+
+// WriteTo writes the clip's audio to w
+func (c *Clip) WriteTo(w io.Writer) (int64, error) {
+	sr := &segmentReader{r: c.r}
+	defer sr.close()
+
+	var written int64
+	for _, e := range c.entries {
+		frame, err := sr.read(e)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(frame)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Start returns the time of the clip's first frame
+func (c *Clip) Start() time.Time {
+	if len(c.entries) == 0 {
+		return time.Time{}
+	}
+	return c.entries[0].time
+}
+
+// End returns the time of the clip's last frame
+func (c *Clip) End() time.Time {
+	if len(c.entries) == 0 {
+		return time.Time{}
+	}
+	return c.entries[len(c.entries)-1].time
+}
+
+// Reader returns a seekable reader over header followed by the clip's
+// audio, so the clip can be served in byte ranges
+func (c *Clip) Reader(header []byte) *ClipReader {
+	cr := &ClipReader{
+		clip:   c,
+		header: header,
+		ends:   make([]int64, len(c.entries)),
+		sr:     segmentReader{r: c.r},
+	}
+	var end int64
+	for i, e := range c.entries {
+		end += int64(e.size)
+		cr.ends[i] = end
+	}
+	cr.size = int64(len(header)) + end
+	return cr
+}
+
+// ClipReader reads a clip, reading frames from disk only as they are reached
+type ClipReader struct {
+	clip   *Clip
+	header []byte
+	ends   []int64 // end of each frame in the audio, after the header
+	size   int64
+	pos    int64
+	sr     segmentReader
+}
+
+// Read reads from the current position
+func (cr *ClipReader) Read(p []byte) (int, error) {
+	if cr.pos >= cr.size {
+		return 0, io.EOF
+	}
+
+	if cr.pos < int64(len(cr.header)) {
+		n := copy(p, cr.header[cr.pos:])
+		cr.pos += int64(n)
+		return n, nil
+	}
+
+	pos := cr.pos - int64(len(cr.header))
+	i := sort.Search(len(cr.ends), func(i int) bool { return cr.ends[i] > pos })
+	e := cr.clip.entries[i]
+	start := cr.ends[i] - int64(e.size)
+
+	n, err := cr.sr.readAt(e, p, pos-start)
+	cr.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the position for the next Read
+func (cr *ClipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cr.pos
+	case io.SeekEnd:
+		offset += cr.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	cr.pos = offset
+	return offset, nil
+}
+
+// Close closes the segment file being read
+func (cr *ClipReader) Close() error {
+	cr.sr.close()
+	return nil
+}
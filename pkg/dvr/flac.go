@@ -0,0 +1,66 @@
+package dvr
+
+import (
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// flacHeaderSize is the length of a FLAC segment's headers: the marker,
+// STREAMINFO and a SEEKTABLE with room for seekPoints
+const flacHeaderSize = 4 + 4 + 34 + 4 + 18*seekPoints
+
+// startFLAC writes the headers of a new FLAC segment. They describe a live
+// stream until finishFLAC fills them in. Called with the lock held.
+func (r *Recorder) startFLAC() error {
+	r.flac = audio.NewFLACEncoder(r.format.SampleRate, r.format.Channels)
+	r.seeks = r.seeks[:0]
+	if _, err := r.data.Write(r.flacHeader()); err != nil {
+		return err
+	}
+	r.size = uint32(flacHeaderSize)
+	return nil
+}
+
+// finishFLAC rewrites the headers with the segment's length, checksum and
+// seek points. Called with the lock held.
+func (r *Recorder) finishFLAC() error {
+	_, err := r.data.WriteAt(r.flacHeader(), 0)
+	return err
+}
+
+// flacHeader returns the headers for what has been encoded so far
+func (r *Recorder) flacHeader() []byte {
+	header := []byte{'f', 'L', 'a', 'C', 0, 0, 0, 34}
+	header = append(header, r.flac.Summary()...)
+	table := audio.FLACSeekTable(r.seeks, seekPoints)
+	header = append(header, 0x80|3, byte(len(table)>>16), byte(len(table)>>8), byte(len(table)))
+	return append(header, table...)
+}
+
+// encode compresses a broadcast frame into FLAC frames, adding a seek point
+// every seekInterval, and returns them with the length of the PCM they
+// hold. Called with the lock held.
+func (r *Recorder) encode(data []byte) ([]byte, int) {
+	channels := r.format.Channels
+	pcm := audio.BytesToPCM(data)
+	pcm = pcm[:len(pcm)-len(pcm)%channels]
+	size := 2 * len(pcm)
+
+	interval := uint64(r.format.SampleRate) * uint64(seekInterval) / uint64(time.Second)
+	var out []byte
+	for len(pcm) > 0 {
+		n := min(len(pcm), audio.FLACMaxBlock*channels)
+		sample := r.flac.Samples()
+		if len(r.seeks) < seekPoints && (len(r.seeks) == 0 || sample >= r.seeks[len(r.seeks)-1].Sample+interval) {
+			r.seeks = append(r.seeks, audio.FLACSeekPoint{
+				Sample:  sample,
+				Offset:  uint64(int(r.size) + len(out) - flacHeaderSize),
+				Samples: uint16(n / channels),
+			})
+		}
+		out = append(out, r.flac.Encode(pcm[:n])...)
+		pcm = pcm[n:]
+	}
+	return out, size
+}
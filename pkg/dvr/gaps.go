@@ -0,0 +1,42 @@
+package dvr
+
+import (
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// Gap is a stretch of silence in archived audio, from its first silent
+// frame to the first frame after it
+type Gap struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Gaps returns the stretches of the clip at least minLength long in which
+// every frame stays below threshold (in dBFS). A silence running into the
+// end of the clip is not reported, since it may go on.
+func (c *Clip) Gaps(threshold float64, minLength time.Duration) ([]Gap, error) {
+	sr := &segmentReader{r: c.r}
+	defer sr.close()
+
+	var gaps []Gap
+	var since time.Time
+	for _, e := range c.entries {
+		frame, err := sr.read(e)
+		if err != nil {
+			return gaps, err
+		}
+		if audio.LevelDBFS(frame) < threshold {
+			if since.IsZero() {
+				since = e.time
+			}
+			continue
+		}
+		if !since.IsZero() && e.time.Sub(since) >= minLength {
+			gaps = append(gaps, Gap{Start: since, End: e.time})
+		}
+		since = time.Time{}
+	}
+	return gaps, nil
+}
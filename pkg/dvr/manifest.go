@@ -0,0 +1,175 @@
+package dvr
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestName is the checksum manifest kept alongside the segments. It is
+// in sha256sum format, so `sha256sum -c MANIFEST.sha256` checks it too.
+const ManifestName = "MANIFEST.sha256"
+
+// hashingFile writes to a file while hashing what was written, so a
+// segment's checksum is ready the moment it is closed
+type hashingFile struct {
+	*os.File
+	hash hash.Hash
+}
+
+// Write writes to the file and the hash
+func (f *hashingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.hash.Write(p[:n])
+	return n, err
+}
+
+// ReadFrom copies r through Write, since the embedded file's ReadFrom
+// would bypass the hash
+func (f *hashingFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{f}, r)
+}
+
+// sum returns the hex SHA-256 of everything written
+func (f *hashingFile) sum() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// createHashing creates a file that hashes what is written to it
+func createHashing(path string) (*hashingFile, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &hashingFile{File: file, hash: sha256.New()}, nil
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readManifest reads the manifest in dir, mapping file names to checksums.
+// A missing manifest is empty.
+func readManifest(dir string) (map[string]string, error) {
+	sums := make(map[string]string)
+
+	file, err := os.Open(filepath.Join(dir, ManifestName))
+	if os.IsNotExist(err) {
+		return sums, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		sum, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			continue
+		}
+		sums[name] = sum
+	}
+	return sums, scanner.Err()
+}
+
+// writeManifest replaces the manifest in dir, going through a temporary
+// file so a crash never leaves it half written
+func writeManifest(dir string, sums map[string]string) error {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+
+	tmp := filepath.Join(dir, ManifestName+".tmp")
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, ManifestName))
+}
+
+// Check is the verification result for one archive file
+type Check struct {
+	Name   string
+	Status CheckStatus
+}
+
+// CheckStatus is the outcome of verifying one file
+type CheckStatus string
+
+const (
+	// CheckOK means the file matches its checksum
+	CheckOK CheckStatus = "OK"
+	// CheckFailed means the file's contents changed
+	CheckFailed CheckStatus = "FAILED"
+	// CheckMissing means a file in the manifest is gone
+	CheckMissing CheckStatus = "MISSING"
+	// CheckUnlisted means a segment file has no checksum yet, such as the
+	// one being recorded
+	CheckUnlisted CheckStatus = "UNLISTED"
+)
+
+// Verify checks every file in the manifest in dir against its checksum,
+// and reports segment files the manifest does not list. On a running
+// archive, segments trimmed during the check show up as missing.
+func Verify(dir string) ([]Check, error) {
+	sums, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var checks []Check
+	for name, sum := range sums {
+		actual, err := hashFile(filepath.Join(dir, name))
+		switch {
+		case os.IsNotExist(err):
+			checks = append(checks, Check{Name: name, Status: CheckMissing})
+		case err != nil:
+			return nil, err
+		case actual != sum:
+			checks = append(checks, Check{Name: name, Status: CheckFailed})
+		default:
+			checks = append(checks, Check{Name: name, Status: CheckOK})
+		}
+	}
+
+	for _, pattern := range []string{"*.pcm", "*.flac", "*.idx", uploadsDir + "/*.wav"} {
+		names, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range names {
+			name, _ := filepath.Rel(dir, path)
+			if name = filepath.ToSlash(name); sums[name] == "" {
+				checks = append(checks, Check{Name: name, Status: CheckUnlisted})
+			}
+		}
+	}
+
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks, nil
+}
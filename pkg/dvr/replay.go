@@ -0,0 +1,75 @@
+package dvr
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+// Replay plays the archive a fixed delay behind the live broadcast
+type Replay struct {
+	r     *Recorder
+	delay time.Duration
+}
+
+// Replay returns a feed that starts delay in the past and keeps that delay,
+// preserving gaps where nothing was broadcast
+func (r *Recorder) Replay(delay time.Duration) *Replay {
+	return &Replay{r: r, delay: delay}
+}
+
+// Run sends archived frames as they come due until ctx is done
+func (p *Replay) Run(ctx context.Context, send func([]byte)) error {
+	sr := &segmentReader{r: p.r}
+	defer sr.close()
+
+	p.r.mu.RLock()
+	pos := p.r.search(p.r.clock.Now().Add(-p.delay))
+	p.r.mu.RUnlock()
+
+	for {
+		p.r.mu.RLock()
+		if pos < p.r.base {
+			// Fell behind the trimmed end of the archive
+			pos = p.r.base
+		}
+		var e entry
+		var appended chan struct{}
+		if i := pos - p.r.base; i < uint64(len(p.r.entries)) {
+			e = p.r.entries[i]
+		} else {
+			appended = p.r.appended
+		}
+		p.r.mu.RUnlock()
+
+		if appended != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-appended:
+			}
+			continue
+		}
+
+		if wait := time.Until(e.time.Add(p.delay)); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+		}
+
+		frame, err := sr.read(e)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The segment was trimmed after we looked it up
+			pos++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		send(frame)
+		pos++
+	}
+}
@@ -0,0 +1,154 @@
+package dvr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// uploadsDir is the subdirectory holding recordings sources upload to
+	// fill gaps in the live archive
+	uploadsDir = "uploads"
+
+	// uploadTimeFormat names uploads by start time, so they sort in order
+	uploadTimeFormat = "20060102T150405.000000Z"
+)
+
+// ErrUploadTooOld is returned for an upload that starts before the archive
+// depth, since it would be trimmed straight away
+var ErrUploadTooOld = errors.New("recording is older than the archive depth")
+
+// Upload is a WAV recording a source made while it could not reach the
+// server, covering audio missing from the archive
+type Upload struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	Size  int64     `json:"size"`
+}
+
+// SaveUpload stores a WAV recording that starts at start. Uploading the
+// same start again replaces it, so sources can safely retry.
+func (r *Recorder) SaveUpload(start time.Time, wav io.Reader) (Upload, error) {
+	if start.Before(r.clock.Now().Add(-r.depth)) {
+		return Upload{}, ErrUploadTooOld
+	}
+
+	dir := filepath.Join(r.dir, uploadsDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Upload{}, err
+	}
+
+	name := start.UTC().Format(uploadTimeFormat) + ".wav"
+	f, err := createHashing(filepath.Join(dir, name+".tmp"))
+	if err != nil {
+		return Upload{}, err
+	}
+	defer os.Remove(f.Name())
+
+	var riff [12]byte
+	if _, err := io.ReadFull(wav, riff[:]); err != nil || !bytes.Equal(riff[0:4], []byte("RIFF")) || !bytes.Equal(riff[8:12], []byte("WAVE")) {
+		f.Close()
+		return Upload{}, fmt.Errorf("not a wav file")
+	}
+	size, err := io.Copy(f, io.MultiReader(bytes.NewReader(riff[:]), wav))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return Upload{}, err
+	}
+
+	r.mu.Lock()
+	r.sums[uploadsDir+"/"+name] = f.sum()
+	r.saveManifest()
+	r.mu.Unlock()
+
+	return Upload{Name: name, Start: start, Size: size}, nil
+}
+
+// Uploads lists the uploaded recordings, oldest first
+func (r *Recorder) Uploads() ([]Upload, error) {
+	paths, err := filepath.Glob(filepath.Join(r.dir, uploadsDir, "*.wav"))
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := []Upload{}
+	for _, path := range paths {
+		start, ok := uploadStart(filepath.Base(path))
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		uploads = append(uploads, Upload{Name: filepath.Base(path), Start: start, Size: info.Size()})
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Start.Before(uploads[j].Start) })
+	return uploads, nil
+}
+
+// UploadPath returns the file holding the named upload
+func (r *Recorder) UploadPath(name string) (string, bool) {
+	if _, ok := uploadStart(name); !ok {
+		return "", false
+	}
+	return filepath.Join(r.dir, uploadsDir, name), true
+}
+
+// trimUploads removes uploads that started before cutoff. Called with the
+// lock held.
+func (r *Recorder) trimUploads(cutoff time.Time) {
+	uploads, err := r.Uploads()
+	if err != nil {
+		return
+	}
+	for _, upload := range uploads {
+		if !upload.Start.Before(cutoff) {
+			return
+		}
+		os.Remove(filepath.Join(r.dir, uploadsDir, upload.Name))
+		delete(r.sums, uploadsDir+"/"+upload.Name)
+	}
+}
+
+// addUploadSums checksums uploads the manifest lacks. Called with the lock
+// held.
+func (r *Recorder) addUploadSums() {
+	uploads, err := r.Uploads()
+	if err != nil {
+		return
+	}
+	for _, upload := range uploads {
+		name := uploadsDir + "/" + upload.Name
+		if _, ok := r.sums[name]; ok {
+			continue
+		}
+		sum, err := hashFile(filepath.Join(r.dir, uploadsDir, upload.Name))
+		if err != nil {
+			r.logger.Warnf("Failed to checksum DVR upload %s: %v", upload.Name, err)
+			continue
+		}
+		r.sums[name] = sum
+	}
+}
+
+// uploadStart parses an upload's start time from its file name
+func uploadStart(name string) (time.Time, bool) {
+	if filepath.Base(name) != name || !strings.HasSuffix(name, ".wav") {
+		return time.Time{}, false
+	}
+	start, err := time.Parse(uploadTimeFormat, strings.TrimSuffix(name, ".wav"))
+	return start, err == nil
+}
@@ -0,0 +1,120 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// WebhookConfig is where a webhook delivers, and what
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Secret, when set, signs deliveries so the receiver can check they
+	// came from the server
+	Secret string `yaml:"secret,omitempty"`
+	// Events are the event types delivered; empty delivers every event
+	Events []string `yaml:"events,omitempty"`
+}
+
+// Webhook POSTs the events on a bus to a URL as JSON. Signed deliveries
+// carry an X-Minicast-Timestamp header, the Unix time they were sent, and
+// X-Minicast-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">.
+type Webhook struct {
+	url    string
+	secret []byte
+	events map[string]bool
+	client *http.Client
+	logger *zap.SugaredLogger
+}
+
+// NewWebhook creates a webhook delivering as config says
+func NewWebhook(config WebhookConfig, logger *zap.SugaredLogger) *Webhook {
+	w := &Webhook{
+		url:    config.URL,
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger,
+	}
+	if config.Secret != "" {
+		w.secret = []byte(config.Secret)
+	}
+	if len(config.Events) > 0 {
+		w.events = make(map[string]bool, len(config.Events))
+		for _, typ := range config.Events {
+			w.events[typ] = true
+		}
+	}
+	return w
+}
+
+// Run delivers events from bus until ctx is done. Deliveries are made one
+// at a time, in order; failures are logged and not retried.
+func (w *Webhook) Run(ctx context.Context, bus *Bus) {
+	events, unsubscribe := bus.Subscribe(64)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if w.events != nil && !w.events[event.Type] {
+				continue
+			}
+			if err := w.deliver(ctx, event); err != nil {
+				w.logger.Warnf("Webhook %s failed for %s event: %v", w.url, event.Type, err)
+			}
+		}
+	}
+}
+
+// deliver POSTs one event
+func (w *Webhook) deliver(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Minicast-Event", event.Type)
+	if w.secret != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Minicast-Timestamp", timestamp)
+		req.Header.Set("X-Minicast-Signature", "sha256="+sign(w.secret, timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// sign returns the hex HMAC-SHA256 a webhook delivery sent at timestamp
+// with body is signed with
+func sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,263 @@
+// Package fanout carries the broadcast between server instances, so
+// instances behind a load balancer can all serve listeners the audio of a
+// source connected to any one of them
+package fanout
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/frame"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// publishQueue is how many messages may wait for the bus (about 3s of
+	// audio) before new ones are dropped
+	publishQueue = 32
+	// retryDelay is how long publishing pauses after a failure
+	retryDelay = time.Second
+)
+
+// magic starts every message, so stray publishes on the channel are ignored
+const magic = "MCB1"
+
+// Bus is a publish/subscribe channel shared by server instances
+type Bus interface {
+	// Publish queues msg for every subscriber. It never blocks; messages
+	// that cannot be sent in time are dropped.
+	Publish(msg []byte)
+	// Subscribe calls handle with every message published, the
+	// instance's own included, until ctx is done or the connection fails
+	Subscribe(ctx context.Context, handle func(msg []byte)) error
+	// Close stops publishing
+	Close() error
+}
+
+// Open returns the bus at rawURL, chosen by its scheme, on channel. NATS
+// URLs may list several servers of a cluster, separated by commas.
+func Open(rawURL, channel string, logger *zap.SugaredLogger) (Bus, error) {
+	var urls []*url.URL
+	for _, s := range strings.Split(rawURL, ",") {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+	switch urls[0].Scheme {
+	case "redis", "rediss":
+		if len(urls) > 1 {
+			return nil, errors.New("redis fanout takes one server")
+		}
+		return newRedis(urls[0], channel, logger)
+	case "nats", "tls":
+		return newNATS(urls, channel, logger)
+	}
+	return nil, fmt.Errorf("unsupported fanout scheme %q (use redis, rediss, nats or tls)", urls[0].Scheme)
+}
+
+// publisher queues messages and sends them over one connection at a time,
+// reconnecting after failures. Buses embed it for Publish and Close.
+type publisher struct {
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPublisher() *publisher {
+	return &publisher{queue: make(chan []byte, publishQueue), done: make(chan struct{})}
+}
+
+// Publish queues msg, dropping it if the bus is not keeping up
+func (p *publisher) Publish(msg []byte) {
+	select {
+	case p.queue <- msg:
+	default:
+	}
+}
+
+// Close stops publishing
+func (p *publisher) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// run sends queued messages to the bus named name, connecting with dial,
+// which returns the connection and a function sending a message on it.
+// Messages queued while the bus is unreachable are dropped.
+func (p *publisher) run(name string, logger *zap.SugaredLogger, dial func() (io.Closer, func([]byte) error, error)) {
+	var conn io.Closer
+	var send func([]byte) error
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	var retryAt time.Time
+	failing := false
+	for {
+		var msg []byte
+		select {
+		case <-p.done:
+			return
+		case msg = <-p.queue:
+		}
+		if time.Now().Before(retryAt) {
+			continue
+		}
+
+		var err error
+		if conn == nil {
+			conn, send, err = dial()
+		}
+		if err == nil {
+			err = send(msg)
+		}
+		if err != nil {
+			if !failing {
+				logger.Warnf("Failed to publish to %s: %v", name, err)
+			}
+			failing = true
+			retryAt = time.Now().Add(retryDelay)
+			if conn != nil {
+				conn.Close()
+				conn = nil
+			}
+			continue
+		}
+		if failing {
+			logger.Infof("Publishing to %s again", name)
+			failing = false
+		}
+	}
+}
+
+// Kind says what a message carries
+type Kind byte
+
+const (
+	// KindFrame is a frame of source audio
+	KindFrame Kind = 'a'
+	// KindMetadata is a now-playing update
+	KindMetadata Kind = 'm'
+	// KindState is an instance's periodic report on itself
+	KindState Kind = 's'
+)
+
+// State is what an instance reports about itself to the others
+type State struct {
+	// Listeners is how many people listen through the instance
+	Listeners int `json:"listeners"`
+	// Source is the source connected to the instance itself, not one
+	// followed from another instance
+	Source *ws.ConnInfo `json:"source,omitempty"`
+	// Started is when the instance started
+	Started time.Time `json:"started"`
+}
+
+// errInvalid is returned for messages that cannot be decoded
+var errInvalid = errors.New("invalid fanout message")
+
+// Message is what instances tell each other
+type Message struct {
+	// Instance names the instance that published the message
+	Instance string
+	Kind     Kind
+
+	// Format, Header and PCM describe a frame: processed source audio as
+	// 16-bit PCM
+	Format ws.SourceFormat
+	Header frame.Header
+	PCM    []byte
+
+	// Metadata is a now-playing update
+	Metadata ws.Metadata
+
+	// State is an instance's report on itself
+	State State
+}
+
+// Encode returns the message as published
+func (m Message) Encode() ([]byte, error) {
+	if len(m.Instance) > 255 {
+		return nil, errors.New("instance name too long")
+	}
+	buf := make([]byte, 0, len(magic)+2+len(m.Instance)+6+frame.HeaderSize+len(m.PCM))
+	buf = append(buf, magic...)
+	buf = append(buf, byte(m.Kind), byte(len(m.Instance)))
+	buf = append(buf, m.Instance...)
+
+	switch m.Kind {
+	case KindFrame:
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(m.Format.SampleRate))
+		buf = append(buf, byte(m.Format.Channels), byte(m.Format.BitDepth))
+		buf = append(buf, frame.Encode(m.Header, m.PCM)...)
+	case KindMetadata, KindState:
+		var v interface{} = m.Metadata
+		if m.Kind == KindState {
+			v = m.State
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	default:
+		return nil, fmt.Errorf("unknown message kind %q", m.Kind)
+	}
+	return buf, nil
+}
+
+// Decode parses a published message
+func Decode(data []byte) (Message, error) {
+	if len(data) < len(magic)+2 || string(data[:len(magic)]) != magic {
+		return Message{}, errInvalid
+	}
+	data = data[len(magic):]
+	m := Message{Kind: Kind(data[0])}
+	n := int(data[1])
+	data = data[2:]
+	if len(data) < n {
+		return Message{}, errInvalid
+	}
+	m.Instance, data = string(data[:n]), data[n:]
+
+	switch m.Kind {
+	case KindFrame:
+		if len(data) < 6 {
+			return Message{}, errInvalid
+		}
+		m.Format = ws.SourceFormat{
+			SampleRate: int(binary.LittleEndian.Uint32(data)),
+			Channels:   int(data[4]),
+			BitDepth:   int(data[5]),
+			Codec:      ws.CodecPCM,
+		}
+		h, pcm, err := frame.Decode(data[6:])
+		if err != nil {
+			return Message{}, errInvalid
+		}
+		m.Header, m.PCM = h, pcm
+	case KindMetadata:
+		if err := json.Unmarshal(data, &m.Metadata); err != nil {
+			return Message{}, errInvalid
+		}
+	case KindState:
+		if err := json.Unmarshal(data, &m.State); err != nil {
+			return Message{}, errInvalid
+		}
+	default:
+		return Message{}, errInvalid
+	}
+	return m, nil
+}
@@ -0,0 +1,324 @@
+package fanout
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// natsTimeout bounds dialing, the handshake and each write
+	natsTimeout = 5 * time.Second
+	// natsPingInterval is how often a subscription is pinged, so a dead
+	// server is noticed even on a quiet subject
+	natsPingInterval = 5 * time.Second
+)
+
+// nats is a Bus on a NATS subject. Publishes are not acknowledged, so
+// nothing waits on a round trip to the server.
+type nats struct {
+	*publisher
+	servers []*url.URL
+	subject string
+
+	// next is the server of the cluster tried first, moved on after
+	// failures so instances spread over the cluster
+	next atomic.Uint32
+}
+
+// newNATS returns a bus on subject of the NATS cluster made of servers,
+// nats://[user:password@]host[:port] URLs (a user alone is a token), or
+// tls:// to require TLS
+func newNATS(servers []*url.URL, subject string, logger *zap.SugaredLogger) (*nats, error) {
+	for _, u := range servers {
+		if u.Scheme != "nats" && u.Scheme != "tls" {
+			return nil, fmt.Errorf("cannot mix %s with NATS servers", u.Scheme)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("no host in %s", natsRedacted(u))
+		}
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("invalid fanout subject %q", subject)
+	}
+
+	names := make([]string, len(servers))
+	for i, u := range servers {
+		names[i] = natsRedacted(u)
+	}
+	n := &nats{publisher: newPublisher(), servers: servers, subject: subject}
+	go n.run(strings.Join(names, ","), logger, func() (io.Closer, func([]byte) error, error) {
+		conn, err := n.dial(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		// Answer the server's pings, closing the connection if it fails
+		go conn.drain()
+		return conn, func(msg []byte) error {
+			if len(msg) > conn.maxPayload {
+				return fmt.Errorf("message of %d bytes exceeds the server's max_payload", len(msg))
+			}
+			return conn.write(fmt.Sprintf("PUB %s %d\r\n", subject, len(msg)), msg, []byte("\r\n"))
+		}, nil
+	})
+	return n, nil
+}
+
+// dial connects to the first server of the cluster that answers
+func (n *nats) dial(ctx context.Context) (*natsConn, error) {
+	var errs []error
+	for range n.servers {
+		u := n.servers[int(n.next.Load())%len(n.servers)]
+		conn, err := dialNATS(ctx, u)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %v", natsRedacted(u), err))
+		n.next.Add(1)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// natsRedacted returns u for logs, hiding a token as well as a password
+func natsRedacted(u *url.URL) string {
+	if u.User != nil {
+		if _, ok := u.User.Password(); !ok {
+			redacted := *u
+			redacted.User = url.User("xxxxx")
+			return redacted.String()
+		}
+	}
+	return u.Redacted()
+}
+
+// Subscribe passes on the subject's messages until ctx is done or the
+// connection fails
+func (n *nats) Subscribe(ctx context.Context, handle func(msg []byte)) error {
+	conn, err := n.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.write(fmt.Sprintf("SUB %s 1\r\n", n.subject)); err != nil {
+		return err
+	}
+
+	// Pings keep a quiet subject from looking hung, and a hung connection
+	// from going unnoticed; closing the connection ends the read below
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(natsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+				if conn.write("PING\r\n") != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * natsPingInterval))
+		op, payload, err := conn.read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		switch op {
+		case "MSG":
+			handle(payload)
+		case "PING":
+			if err := conn.write("PONG\r\n"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// natsError is an -ERR from the NATS server
+type natsError string
+
+func (e natsError) Error() string {
+	return "nats: " + string(e)
+}
+
+// natsInfo is the part of the server's INFO the client needs
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// natsConnect is the CONNECT sent to the server
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Protocol  int    `json:"protocol"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+// natsConn speaks the NATS client protocol over one connection. Writes
+// are serialized, so one goroutine may ping while another reads.
+type natsConn struct {
+	net.Conn
+	r          *bufio.Reader
+	maxPayload int
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+}
+
+// dialNATS connects and authenticates to the NATS server at u
+func dialNATS(ctx context.Context, u *url.URL) (*natsConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := (&net.Dialer{Timeout: natsTimeout}).DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	c := &natsConn{Conn: conn, r: bufio.NewReader(conn)}
+
+	// The server introduces itself first, saying whether it wants TLS
+	op, args, err := c.readLine()
+	if err == nil && op != "INFO" {
+		err = errors.New("not a NATS server")
+	}
+	var info natsInfo
+	if err == nil {
+		err = json.Unmarshal([]byte(args), &info)
+	}
+	if err == nil && (u.Scheme == "tls" || info.TLSRequired) {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err = tlsConn.HandshakeContext(ctx); err == nil {
+			c.Conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.w = bufio.NewWriter(c.Conn)
+	c.maxPayload = info.MaxPayload
+	if c.maxPayload <= 0 {
+		c.maxPayload = 1 << 20
+	}
+
+	connect := natsConnect{Name: "minicast", Lang: "go", Protocol: 1}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			connect.User, connect.Pass = u.User.Username(), password
+		} else {
+			connect.AuthToken = u.User.Username()
+		}
+	}
+	data, _ := json.Marshal(connect)
+
+	// The server answers the ping once it has accepted the connection
+	err = c.write("CONNECT "+string(data)+"\r\n", []byte("PING\r\n"))
+	for err == nil {
+		op, _, err = c.read()
+		if op == "PONG" {
+			c.SetDeadline(time.Time{})
+			return c, nil
+		}
+	}
+	c.Close()
+	return nil, err
+}
+
+// write sends a protocol line and any payload parts
+func (c *natsConn) write(line string, parts ...[]byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.SetWriteDeadline(time.Now().Add(natsTimeout))
+	c.w.WriteString(line)
+	for _, part := range parts {
+		c.w.Write(part)
+	}
+	return c.w.Flush()
+}
+
+// read reads one operation, returning the payload of a MSG
+func (c *natsConn) read() (string, []byte, error) {
+	op, args, err := c.readLine()
+	if err != nil {
+		return "", nil, err
+	}
+	switch op {
+	case "-ERR":
+		return "", nil, natsError(strings.Trim(args, "'"))
+	case "MSG":
+		// MSG <subject> <sid> [reply-to] <#bytes>
+		fields := strings.Fields(args)
+		if len(fields) < 3 {
+			return "", nil, errors.New("nats: malformed MSG")
+		}
+		size, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil || size < 0 {
+			return "", nil, errors.New("nats: malformed MSG")
+		}
+		payload := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return "", nil, err
+		}
+		return op, payload[:size], nil
+	}
+	return op, nil, nil
+}
+
+// readLine reads a protocol line, split into its operation and arguments
+func (c *natsConn) readLine() (string, string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	op, args, _ := strings.Cut(line, " ")
+	return strings.ToUpper(op), args, nil
+}
+
+// drain answers the server's pings on a connection only written to,
+// closing it when the server goes away or reports an error
+func (c *natsConn) drain() {
+	for {
+		op, _, err := c.read()
+		if err != nil {
+			c.Close()
+			return
+		}
+		if op == "PING" {
+			c.write("PONG\r\n")
+		}
+	}
+}
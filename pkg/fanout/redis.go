@@ -0,0 +1,255 @@
+package fanout
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// redisTimeout bounds dialing and each command
+	redisTimeout = 5 * time.Second
+	// redisPingInterval is how often a subscription is pinged, since Redis
+	// sends nothing on a quiet channel
+	redisPingInterval = 5 * time.Second
+)
+
+// redis is a Bus on a Redis pub/sub channel
+type redis struct {
+	*publisher
+	url     *url.URL
+	channel string
+}
+
+// newRedis returns a bus on channel of the Redis server at u, a
+// redis://[user:password@]host[:port] URL or rediss:// for TLS
+func newRedis(u *url.URL, channel string, logger *zap.SugaredLogger) (*redis, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %s", u.Redacted())
+	}
+	if channel == "" {
+		return nil, errors.New("no fanout channel")
+	}
+	r := &redis{publisher: newPublisher(), url: u, channel: channel}
+	go r.run(u.Redacted(), logger, func() (io.Closer, func([]byte) error, error) {
+		conn, err := dialRedis(context.Background(), u)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func(msg []byte) error {
+			conn.SetDeadline(time.Now().Add(redisTimeout))
+			_, err := conn.Do([]byte("PUBLISH"), []byte(channel), msg)
+			return err
+		}, nil
+	})
+	return r, nil
+}
+
+// Subscribe passes on the channel's messages until ctx is done or the
+// connection fails
+func (r *redis) Subscribe(ctx context.Context, handle func(msg []byte)) error {
+	conn, err := dialRedis(ctx, r.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	if err := conn.Send([]byte("SUBSCRIBE"), []byte(r.channel)); err != nil {
+		return err
+	}
+
+	// Pings keep a quiet channel from looking hung, and a hung connection
+	// from going unnoticed; closing the connection ends the read below
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(redisPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+				conn.SetWriteDeadline(time.Now().Add(redisTimeout))
+				if conn.Send([]byte("PING")) != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		reply, err := conn.Receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * redisPingInterval))
+
+		// Subscribed connections get pushes: subscribe confirmations,
+		// pongs and ["message", channel, payload]
+		push, ok := reply.([]interface{})
+		if !ok || len(push) == 0 {
+			continue
+		}
+		kind, _ := push[0].([]byte)
+		if string(kind) != "message" || len(push) != 3 {
+			continue
+		}
+		if payload, ok := push[2].([]byte); ok {
+			handle(payload)
+		}
+	}
+}
+
+// redisError is an error reply from the Redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks the Redis protocol (RESP) over one connection. Writes
+// are serialized, so one goroutine may ping while another reads.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+}
+
+// dialRedis connects and authenticates to the Redis server at u
+func dialRedis(ctx context.Context, u *url.URL) (*redisConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "rediss" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if u.User != nil {
+		conn.SetDeadline(time.Now().Add(redisTimeout))
+		password, _ := u.User.Password()
+		args := [][]byte{[]byte("AUTH"), []byte(password)}
+		if name := u.User.Username(); name != "" {
+			args = [][]byte{[]byte("AUTH"), []byte(name), []byte(password)}
+		}
+		if _, err := c.Do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and returns its reply
+func (c *redisConn) Do(args ...[]byte) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	return c.Receive()
+}
+
+// Send writes a command as an array of bulk strings
+func (c *redisConn) Send(args ...[]byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(arg))
+		c.w.Write(arg)
+		c.w.WriteString("\r\n")
+	}
+	return c.w.Flush()
+}
+
+// Receive reads one reply: a string, an int64, a []byte (nil for a null),
+// an []interface{} for arrays and pushes, or a redisError
+func (c *redisConn) Receive() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return []byte(nil), nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*', '>':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := c.Receive()
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// readLine reads a line without its CRLF
+func (c *redisConn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,184 @@
+package fanout
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/frame"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// pipeRedis returns a connection reading wire, and what it writes
+func pipeRedis(wire string) (*redisConn, *bytes.Buffer) {
+	var written bytes.Buffer
+	return &redisConn{r: bufio.NewReader(bytes.NewBufferString(wire)), w: bufio.NewWriter(&written)}, &written
+}
+
+func TestRedisSend(t *testing.T) {
+	c, written := pipeRedis("")
+	// Payloads are binary, so CRLF inside one is counted, not parsed
+	if err := c.Send([]byte("PUBLISH"), []byte("live"), []byte("a\r\nb")); err != nil {
+		t.Fatal(err)
+	}
+	want := "*3\r\n$7\r\nPUBLISH\r\n$4\r\nlive\r\n$4\r\na\r\nb\r\n"
+	if written.String() != want {
+		t.Fatalf("wrote %q, want %q", written, want)
+	}
+}
+
+func TestRedisReceive(t *testing.T) {
+	// Replies as a Redis 7 server sends them to a subscribed client
+	wire := "*3\r\n$9\r\nsubscribe\r\n$4\r\nlive\r\n:1\r\n" +
+		">3\r\n$7\r\nmessage\r\n$4\r\nlive\r\n$5\r\nhe\r\nl\r\n" +
+		"*2\r\n$4\r\npong\r\n$0\r\n\r\n" +
+		"+OK\r\n" +
+		"$-1\r\n" +
+		"-WRONGPASS invalid username-password pair or user is disabled.\r\n" +
+		"*2\r\n:7\r\n-ERR no such key\r\n"
+	c, _ := pipeRedis(wire)
+
+	want := []interface{}{
+		[]interface{}{[]byte("subscribe"), []byte("live"), int64(1)},
+		[]interface{}{[]byte("message"), []byte("live"), []byte("he\r\nl")},
+		[]interface{}{[]byte("pong"), []byte{}},
+		"OK",
+		[]byte(nil),
+	}
+	for i, w := range want {
+		got, err := c.Receive()
+		if err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("reply %d: got %#v, want %#v", i, got, w)
+		}
+	}
+
+	_, err := c.Receive()
+	var redisErr redisError
+	if !errors.As(err, &redisErr) || !strings.HasPrefix(string(redisErr), "WRONGPASS") {
+		t.Errorf("got %v, want the WRONGPASS error", err)
+	}
+	// An error inside an array is an item, not a failed read
+	got, err := c.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := got.([]interface{}); items[0] != int64(7) || items[1] != redisError("ERR no such key") {
+		t.Errorf("got %#v", items)
+	}
+
+	if _, err := c.Receive(); err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want EOF", err)
+	}
+}
+
+func TestRedisReceiveMalformed(t *testing.T) {
+	for _, wire := range []string{"+OK\n", "?what\r\n", "$5\r\nab"} {
+		c, _ := pipeRedis(wire)
+		if reply, err := c.Receive(); err == nil {
+			t.Errorf("%q: got %#v", wire, reply)
+		}
+	}
+}
+
+func TestRedisSubscribe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	commands := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		server := &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+		for _, reply := range []string{
+			"+OK\r\n",
+			"*3\r\n$9\r\nsubscribe\r\n$4\r\nlive\r\n:1\r\n*3\r\n$7\r\nmessage\r\n$4\r\nlive\r\n$5\r\nhello\r\n",
+		} {
+			cmd, err := server.Receive()
+			if err != nil {
+				return
+			}
+			var words []string
+			for _, arg := range cmd.([]interface{}) {
+				words = append(words, string(arg.([]byte)))
+			}
+			commands <- strings.Join(words, " ")
+			conn.Write([]byte(reply))
+		}
+		io.Copy(io.Discard, conn)
+	}()
+
+	u, _ := url.Parse("redis://:secret@" + ln.Addr().String())
+	r := &redis{url: u, channel: "live"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got := make(chan []byte, 1)
+	go r.Subscribe(ctx, func(msg []byte) {
+		got <- msg
+		cancel()
+	})
+
+	select {
+	case msg := <-got:
+		if string(msg) != "hello" {
+			t.Errorf("got message %q", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("no message")
+	}
+	for _, want := range []string{"AUTH secret", "SUBSCRIBE live"} {
+		if cmd := <-commands; cmd != want {
+			t.Errorf("sent %q, want %q", cmd, want)
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	captured := time.UnixMicro(1700000000123456)
+	tests := []Message{
+		{
+			Instance: "eu-1",
+			Kind:     KindFrame,
+			Format:   ws.SourceFormat{SampleRate: 48000, Channels: 2, BitDepth: 16, Codec: ws.CodecPCM},
+			Header:   frame.Header{Seq: 42, Captured: captured, Flags: frame.FlagDiscontinuity},
+			PCM:      []byte{1, 2, 3, 4},
+		},
+		{Instance: "eu-1", Kind: KindMetadata, Metadata: ws.Metadata{Title: "Song", Artist: "Band"}},
+		{Instance: "us-2", Kind: KindState, State: State{Listeners: 12, Started: captured.UTC()}},
+	}
+	for _, m := range tests {
+		data, err := m.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decode(data)
+		if err != nil {
+			t.Fatalf("kind %q: %v", m.Kind, err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("kind %q: got %+v, want %+v", m.Kind, got, m)
+		}
+	}
+
+	for _, data := range [][]byte{nil, []byte("nope"), []byte(magic + "z\x00")} {
+		if _, err := Decode(data); err == nil {
+			t.Errorf("decoded %q", data)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Magic starts every framed message
+const Magic = "MCF1"
+
+// HeaderSize is the length of the header preceding the payload:
+// magic, sequence number, capture timestamp and flags, little-endian
+const HeaderSize = 4 + 4 + 8 + 4
+
+// Flags describe a frame
+type Flags uint32
+
+const (
+	// FlagDiscontinuity marks the first frame after a gap or a new source,
+	// where players should resync rather than expect continuous audio
+	FlagDiscontinuity Flags = 1 << iota
+	// FlagMuted marks a frame the sender silenced on purpose
+	FlagMuted
+	// FlagSpeech marks a frame a voice activity detector found speech in
+	FlagSpeech
+)
+
+// ErrNotFramed is returned for messages without a valid header
+var ErrNotFramed = errors.New("message is not a frame")
+
+// Header carries the framing for one audio payload
+type Header struct {
+	// Seq increases by one per frame and wraps around
+	Seq uint32
+	// Captured is when the sender captured the audio
+	Captured time.Time
+	Flags    Flags
+}
+
+// Encode returns the header followed by payload
+func Encode(h Header, payload []byte) []byte {
+	data := make([]byte, HeaderSize+len(payload))
+	copy(data, Magic)
+	binary.LittleEndian.PutUint32(data[4:8], h.Seq)
+	binary.LittleEndian.PutUint64(data[8:16], uint64(h.Captured.UnixMicro()))
+	binary.LittleEndian.PutUint32(data[16:20], uint32(h.Flags))
+	copy(data[HeaderSize:], payload)
+	return data
+}
+
+// Decode splits a framed message into its header and payload
+func Decode(data []byte) (Header, []byte, error) {
+	if len(data) < HeaderSize || string(data[:4]) != Magic {
+		return Header{}, nil, ErrNotFramed
+	}
+	h := Header{
+		Seq:      binary.LittleEndian.Uint32(data[4:8]),
+		Captured: time.UnixMicro(int64(binary.LittleEndian.Uint64(data[8:16]))),
+		Flags:    Flags(binary.LittleEndian.Uint32(data[16:20])),
+	}
+	return h, data[HeaderSize:], nil
+}
+
+// Verdict is the outcome of tracking one incoming frame
+type Verdict int
+
+const (
+	// VerdictNext is the expected next frame
+	VerdictNext Verdict = iota
+	// VerdictGap means frames before this one went missing
+	VerdictGap
+	// VerdictLate means the frame arrived after newer frames, and should
+	// be dropped
+	VerdictLate
+	// VerdictDuplicate means the frame was already received, as when a
+	// sender or proxy retransmits, and should be dropped
+	VerdictDuplicate
+)
+
+// lateWindow is how far behind the latest sequence number a frame counts
+// as late rather than as a restarted sender
+const lateWindow = 1 << 16
+
+// Stats summarises the frames a Tracker has seen
+type Stats struct {
+	Frames     uint64  `json:"frames"`
+	Gaps       uint64  `json:"gaps"`
+	Lost       uint64  `json:"lost"`
+	Late       uint64  `json:"late"`
+	Duplicates uint64  `json:"duplicates"`
+	LatencyMs  float64 `json:"latency_ms"`
+}
+
+// Tracker follows the sequence numbers and timestamps of a stream of frames
+// to detect gaps, late and duplicate frames, and latency. It is safe for
+// concurrent use.
+type Tracker struct {
+	mu      sync.Mutex
+	started bool
+	last    uint32
+	// seen has bit i set when frame last-i arrived, telling duplicates from
+	// frames that were overtaken for the 64 most recent sequence numbers
+	seen  uint64
+	stats Stats
+}
+
+// Track records an incoming frame received at now
+func (t *Tracker) Track(h Header, now time.Time) Verdict {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	verdict := VerdictNext
+	if t.started {
+		// Signed distance copes with wraparound
+		d := int32(h.Seq - t.last)
+		switch {
+		case d <= 0 && d > -lateWindow:
+			if d > -64 && t.seen&(1<<-d) != 0 {
+				t.stats.Duplicates++
+				return VerdictDuplicate
+			}
+			t.stats.Late++
+			if d > -64 {
+				// Remember it, so another copy counts as a duplicate
+				t.seen |= 1 << -d
+			}
+			return VerdictLate
+		case d > 1:
+			t.stats.Gaps++
+			t.stats.Lost += uint64(d - 1)
+			verdict = VerdictGap
+		}
+		if d > 0 && d < 64 {
+			t.seen <<= d
+		} else {
+			t.seen = 0
+		}
+	}
+	t.started = true
+	t.last = h.Seq
+	t.seen |= 1
+	t.stats.Frames++
+
+	// Smoothed one-way latency; only meaningful if the clocks agree
+	latency := float64(now.Sub(h.Captured)) / float64(time.Millisecond)
+	if t.stats.Frames == 1 {
+		t.stats.LatencyMs = latency
+	} else {
+		t.stats.LatencyMs += (latency - t.stats.LatencyMs) / 16
+	}
+	return verdict
+}
+
+// Stats returns what the tracker has seen so far
+func (t *Tracker) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stats
+}
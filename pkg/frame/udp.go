@@ -0,0 +1,141 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// UDPMagic starts every UDP ingest packet
+const UDPMagic = "MCU1"
+
+// UDPHeaderSize is the length of a packet's magic, type and session
+const UDPHeaderSize = 4 + 1 + 4
+
+// UDPChunk is the most frame bytes one data packet carries, so packets fit
+// a typical path MTU and are never fragmented by IP
+const UDPChunk = 1200
+
+// PacketType says what a UDP ingest packet carries
+type PacketType byte
+
+const (
+	// PacketHello announces a session with the source's format handshake.
+	// Sources repeat it every second as a keepalive.
+	PacketHello PacketType = 'H'
+	// PacketAccept answers a hello when the server takes the source
+	PacketAccept PacketType = 'A'
+	// PacketReject answers a hello with the reason the source was refused
+	PacketReject PacketType = 'R'
+	// PacketData carries one chunk of a framed message
+	PacketData PacketType = 'D'
+	// PacketNack asks the source to resend the listed frames
+	PacketNack PacketType = 'N'
+	// PacketBye ends a session
+	PacketBye PacketType = 'B'
+)
+
+// ErrNotPacket is returned for datagrams that are not UDP ingest packets
+var ErrNotPacket = errors.New("datagram is not an ingest packet")
+
+// Packet is one UDP ingest datagram
+type Packet struct {
+	Type PacketType
+	// Session is chosen by the source, and tells its packets apart from
+	// those of an earlier run
+	Session uint32
+	Body    []byte
+}
+
+// EncodePacket returns the packet as a datagram
+func EncodePacket(p Packet) []byte {
+	data := make([]byte, UDPHeaderSize+len(p.Body))
+	copy(data, UDPMagic)
+	data[4] = byte(p.Type)
+	binary.LittleEndian.PutUint32(data[5:9], p.Session)
+	copy(data[UDPHeaderSize:], p.Body)
+	return data
+}
+
+// DecodePacket parses a datagram
+func DecodePacket(data []byte) (Packet, error) {
+	if len(data) < UDPHeaderSize || string(data[:4]) != UDPMagic {
+		return Packet{}, ErrNotPacket
+	}
+	return Packet{
+		Type:    PacketType(data[4]),
+		Session: binary.LittleEndian.Uint32(data[5:9]),
+		Body:    data[UDPHeaderSize:],
+	}, nil
+}
+
+// Chunk is the body of a data packet: part of the framed message with
+// sequence number Seq
+type Chunk struct {
+	Seq   uint32
+	Part  uint16
+	Parts uint16
+	Data  []byte
+}
+
+// chunkHeaderSize is the length of a chunk's sequence number and part
+// numbers
+const chunkHeaderSize = 4 + 2 + 2
+
+// SplitFrame splits a framed message into the data packets that carry it
+func SplitFrame(session uint32, msg []byte) ([][]byte, error) {
+	h, _, err := Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	parts := (len(msg) + UDPChunk - 1) / UDPChunk
+	if parts > 0xFFFF {
+		return nil, errors.New("frame is too large to send over udp")
+	}
+
+	packets := make([][]byte, 0, parts)
+	for part := 0; part < parts; part++ {
+		data := msg[part*UDPChunk : min((part+1)*UDPChunk, len(msg))]
+		body := make([]byte, chunkHeaderSize+len(data))
+		binary.LittleEndian.PutUint32(body[0:4], h.Seq)
+		binary.LittleEndian.PutUint16(body[4:6], uint16(part))
+		binary.LittleEndian.PutUint16(body[6:8], uint16(parts))
+		copy(body[chunkHeaderSize:], data)
+		packets = append(packets, EncodePacket(Packet{Type: PacketData, Session: session, Body: body}))
+	}
+	return packets, nil
+}
+
+// DecodeChunk parses the body of a data packet
+func DecodeChunk(body []byte) (Chunk, error) {
+	if len(body) < chunkHeaderSize {
+		return Chunk{}, ErrNotPacket
+	}
+	c := Chunk{
+		Seq:   binary.LittleEndian.Uint32(body[0:4]),
+		Part:  binary.LittleEndian.Uint16(body[4:6]),
+		Parts: binary.LittleEndian.Uint16(body[6:8]),
+		Data:  body[chunkHeaderSize:],
+	}
+	if c.Parts == 0 || c.Part >= c.Parts {
+		return Chunk{}, ErrNotPacket
+	}
+	return c, nil
+}
+
+// EncodeNack returns the body of a nack packet for seqs
+func EncodeNack(seqs []uint32) []byte {
+	body := make([]byte, 4*len(seqs))
+	for i, seq := range seqs {
+		binary.LittleEndian.PutUint32(body[4*i:], seq)
+	}
+	return body
+}
+
+// DecodeNack returns the sequence numbers a nack packet asks for
+func DecodeNack(body []byte) []uint32 {
+	seqs := make([]uint32, len(body)/4)
+	for i := range seqs {
+		seqs[i] = binary.LittleEndian.Uint32(body[4*i:])
+	}
+	return seqs
+}
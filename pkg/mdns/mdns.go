@@ -0,0 +1,357 @@
+// Package mdns is a minimal Multicast DNS responder and browser for DNS
+// service discovery (Bonjour): it advertises a service on the LAN and
+// finds the instances of one. It does not probe for conflicting names.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ServiceType is the type minicast servers are advertised as
+const ServiceType = "_minicast._tcp"
+
+const (
+	// mdnsAddr is the Multicast DNS group and port
+	mdnsAddr = "224.0.0.251:5353"
+	mdnsPort = 5353
+
+	// hostTTL is how long records naming the host are cached, and
+	// serviceTTL how long the others are
+	hostTTL    = 120
+	serviceTTL = 4500
+	// legacyTTL caps the TTLs sent to queriers that are not mDNS
+	// responders themselves
+	legacyTTL = 10
+)
+
+// domain is the domain names on the LAN are in
+var domain = name{"local"}
+
+// Service is a service to advertise
+type Service struct {
+	// Instance names this instance of the service, such as "Studio"
+	Instance string
+	// Type is the service type, such as ServiceType
+	Type string
+	Port int
+	// TXT holds key=value pairs describing the instance
+	TXT []string
+}
+
+// Responder advertises a service and answers queries for it
+type Responder struct {
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+	logger *zap.SugaredLogger
+
+	// names of the service type, the instance, the host, and the listing
+	// of service types
+	serviceName  name
+	instanceName name
+	hostName     name
+	port         uint16
+	txt          []string
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// Advertise announces svc on the interface multicast leaves by default and
+// answers queries for it, until the responder is closed
+func Advertise(svc Service, logger *zap.SugaredLogger) (*Responder, error) {
+	if svc.Instance == "" || svc.Port <= 0 || svc.Port > 0xFFFF {
+		return nil, errors.New("mdns: a service needs an instance name and a port")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+
+	service := append(newName(svc.Type), domain...)
+	r := &Responder{
+		conn:         conn,
+		group:        group,
+		logger:       logger,
+		serviceName:  service,
+		instanceName: service.child(svc.Instance),
+		hostName:     name{strings.Split(host, ".")[0], "local"},
+		port:         uint16(svc.Port),
+		txt:          svc.TXT,
+		stop:         make(chan struct{}),
+	}
+	go r.serve()
+	go r.announce()
+	return r, nil
+}
+
+// Close says the service is going away and stops advertising it
+func (r *Responder) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		if local, lerr := localAddr(r.group); lerr == nil {
+			r.send(&message{response: true, answers: r.service(local, 0, false)}, r.group)
+		}
+		err = r.conn.Close()
+	})
+	return err
+}
+
+// announce announces the service twice, a second apart, as RFC 6762 asks
+func (r *Responder) announce() {
+	for i := 0; i < 2; i++ {
+		if local, err := localAddr(r.group); err == nil {
+			r.send(&message{response: true, answers: r.service(local, 1, true)}, r.group)
+		} else {
+			r.logger.Debugf("Not announcing: %v", err)
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// service returns the records describing the service, with the host at
+// address local. TTLs are scaled by ttl, so 0 withdraws them.
+func (r *Responder) service(local net.IP, ttl uint32, flush bool) []record {
+	return []record{
+		{name: r.serviceName, typ: typePTR, ttl: serviceTTL * ttl, ptr: r.instanceName},
+		{name: r.instanceName, typ: typeSRV, ttl: hostTTL * ttl, flush: flush, port: r.port, target: r.hostName},
+		{name: r.instanceName, typ: typeTXT, ttl: serviceTTL * ttl, flush: flush, txt: r.txt},
+		{name: r.hostName, typ: typeA, ttl: hostTTL * ttl, flush: flush, ip: local},
+	}
+}
+
+// send sends a message, logging failures
+func (r *Responder) send(m *message, to *net.UDPAddr) {
+	if _, err := r.conn.WriteToUDP(m.pack(), to); err != nil {
+		r.logger.Debugf("Failed to send to %s: %v", to, err)
+	}
+}
+
+// serve answers queries until the responder is closed
+func (r *Responder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.stop:
+			default:
+				r.logger.Errorf("mDNS stopped: %v", err)
+			}
+			return
+		}
+		query, err := parseMessage(buf[:n])
+		if err != nil || query.response || len(query.questions) == 0 {
+			continue
+		}
+		r.answer(query, from)
+	}
+}
+
+// answer answers the questions of a query about the service, if any.
+// Queries from ports other than mDNS's own come from simple resolvers,
+// which are answered directly as a unicast DNS server would.
+func (r *Responder) answer(query *message, from *net.UDPAddr) {
+	local, err := localAddr(from)
+	if err != nil {
+		return
+	}
+	legacy := from.Port != mdnsPort
+	records := r.service(local, 1, !legacy)
+	ptr, srv, txt, a := records[0], records[1], records[2], records[3]
+	services := record{name: append(name{"_services", "_dns-sd", "_udp"}, domain...), typ: typePTR, ttl: serviceTTL, ptr: r.serviceName}
+
+	resp := &message{response: true}
+	unicast := legacy
+	matches := func(q question, rec record) bool {
+		return q.name.equal(rec.name) && (q.typ == rec.typ || q.typ == typeANY)
+	}
+	for _, q := range query.questions {
+		switch {
+		case matches(q, services):
+			resp.answers = append(resp.answers, services)
+		case matches(q, ptr):
+			resp.answers = append(resp.answers, ptr)
+			resp.additionals = append(resp.additionals, srv, txt, a)
+		case matches(q, srv) || matches(q, txt):
+			if matches(q, srv) {
+				resp.answers = append(resp.answers, srv)
+				resp.additionals = append(resp.additionals, a)
+			}
+			if matches(q, txt) {
+				resp.answers = append(resp.answers, txt)
+			}
+		case matches(q, a):
+			resp.answers = append(resp.answers, a)
+		default:
+			continue
+		}
+		unicast = unicast || q.unicast
+	}
+	if len(resp.answers) == 0 {
+		return
+	}
+
+	to := r.group
+	if unicast {
+		to = from
+	}
+	if legacy {
+		resp.id, resp.questions = query.id, query.questions
+		for _, records := range [][]record{resp.answers, resp.additionals} {
+			for i := range records {
+				records[i].ttl = min(records[i].ttl, legacyTTL)
+			}
+		}
+	} else if !unicast {
+		// Hold multicast answers back a little, so several responders do
+		// not all answer at once
+		time.Sleep(time.Duration(20+rand.IntN(100)) * time.Millisecond)
+	}
+	r.send(resp, to)
+}
+
+// Instance is an instance of a service found on the LAN
+type Instance struct {
+	// Name is the instance's name, such as "Studio"
+	Name string
+	// Host is the host it runs on, such as "studio.local."
+	Host  string
+	Port  int
+	Addrs []net.IP
+	// TXT holds the key=value pairs describing it
+	TXT map[string]string
+}
+
+// Addr returns the instance's host:port, preferring an IPv4 address,
+// then any address, then the host name
+func (in Instance) Addr() string {
+	host := strings.TrimSuffix(in.Host, ".")
+	for _, ip := range in.Addrs {
+		if ip.To4() != nil {
+			return net.JoinHostPort(ip.String(), strconv.Itoa(in.Port))
+		}
+	}
+	if len(in.Addrs) > 0 {
+		host = in.Addrs[0].String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(in.Port))
+}
+
+// Browse looks for instances of a service type, such as ServiceType,
+// collecting the answers that arrive within wait. Instances are sorted by
+// name.
+func Browse(ctx context.Context, serviceType string, wait time.Duration) ([]Instance, error) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+	// Asking from a port of its own, as a simple resolver, gets answers
+	// sent straight back rather than to the whole LAN
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	service := append(newName(serviceType), domain...)
+	query := &message{id: uint16(rand.Uint32()), questions: []question{{name: service, typ: typePTR}}}
+	if _, err := conn.WriteToUDP(query.pack(), group); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	var (
+		instances []name
+		srvs      = make(map[string]record)
+		txts      = make(map[string][]string)
+		addrs     = make(map[string][]net.IP)
+	)
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		resp, err := parseMessage(buf[:n])
+		if err != nil || !resp.response {
+			continue
+		}
+		for _, rec := range append(resp.answers, resp.additionals...) {
+			key := strings.ToLower(rec.name.String())
+			switch rec.typ {
+			case typePTR:
+				if rec.name.equal(service) && len(rec.ptr) > 0 {
+					instances = append(instances, rec.ptr)
+				}
+			case typeSRV:
+				srvs[key] = rec
+			case typeTXT:
+				txts[key] = rec.txt
+			case typeA, typeAAAA:
+				addrs[key] = append(addrs[key], rec.ip)
+			}
+		}
+	}
+
+	var found []Instance
+	seen := make(map[string]bool)
+	for _, inst := range instances {
+		key := strings.ToLower(inst.String())
+		srv, ok := srvs[key]
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		in := Instance{Name: inst[0], Host: srv.target.String(), Port: int(srv.port), TXT: make(map[string]string)}
+		for _, kv := range txts[key] {
+			k, v, _ := strings.Cut(kv, "=")
+			in.TXT[k] = v
+		}
+		in.Addrs = addrs[strings.ToLower(in.Host)]
+		found = append(found, in)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	return found, nil
+}
+
+// localAddr returns the local address traffic to addr leaves from
+func localAddr(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
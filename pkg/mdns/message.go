@@ -0,0 +1,297 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Record types
+const (
+	typeA    = 1
+	typePTR  = 12
+	typeTXT  = 16
+	typeAAAA = 28
+	typeSRV  = 33
+	typeANY  = 255
+)
+
+const (
+	classIN = 1
+	// classTopBit is the cache-flush bit of a record's class, or the
+	// unicast-response bit of a question's
+	classTopBit = 0x8000
+)
+
+var errMalformed = errors.New("mdns: malformed message")
+
+// name is a domain name as its labels, which may themselves contain dots
+// as service instance names do
+type name []string
+
+// newName splits a dotted domain name into its labels
+func newName(s string) name {
+	return strings.Split(strings.TrimSuffix(s, "."), ".")
+}
+
+// String formats the name, for display
+func (n name) String() string {
+	return strings.Join(n, ".") + "."
+}
+
+// equal compares names, ignoring case as DNS does
+func (n name) equal(o name) bool {
+	if len(n) != len(o) {
+		return false
+	}
+	for i := range n {
+		if !strings.EqualFold(n[i], o[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// child returns the name with label prepended
+func (n name) child(label string) name {
+	return append(name{label}, n...)
+}
+
+// question asks for the records of a name and type
+type question struct {
+	name name
+	typ  uint16
+	// unicast asks for the answer to be sent straight back
+	unicast bool
+}
+
+// record is a resource record. Which of its data fields are set depends
+// on its type.
+type record struct {
+	name name
+	typ  uint16
+	// flush tells caches this record replaces any others of its name and
+	// type
+	flush bool
+	ttl   uint32
+
+	ptr    name
+	target name
+	port   uint16
+	ip     net.IP
+	txt    []string
+}
+
+// message is a DNS message. Authority records are not kept.
+type message struct {
+	id          uint16
+	response    bool
+	questions   []question
+	answers     []record
+	additionals []record
+}
+
+// pack encodes the message, without name compression
+func (m *message) pack() []byte {
+	b := binary.BigEndian.AppendUint16(nil, m.id)
+	var flags uint16
+	if m.response {
+		flags = 0x8400 // response, authoritative
+	}
+	b = binary.BigEndian.AppendUint16(b, flags)
+	for _, n := range []int{len(m.questions), len(m.answers), 0, len(m.additionals)} {
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	}
+	for _, q := range m.questions {
+		b = appendName(b, q.name)
+		class := uint16(classIN)
+		if q.unicast {
+			class |= classTopBit
+		}
+		b = binary.BigEndian.AppendUint16(b, q.typ)
+		b = binary.BigEndian.AppendUint16(b, class)
+	}
+	for _, r := range append(m.answers, m.additionals...) {
+		b = r.append(b)
+	}
+	return b
+}
+
+// append appends the encoded record
+func (r record) append(b []byte) []byte {
+	b = appendName(b, r.name)
+	class := uint16(classIN)
+	if r.flush {
+		class |= classTopBit
+	}
+	b = binary.BigEndian.AppendUint16(b, r.typ)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, r.ttl)
+
+	var data []byte
+	switch r.typ {
+	case typePTR:
+		data = appendName(nil, r.ptr)
+	case typeSRV:
+		data = binary.BigEndian.AppendUint16(nil, 0)  // priority
+		data = binary.BigEndian.AppendUint16(data, 0) // weight
+		data = binary.BigEndian.AppendUint16(data, r.port)
+		data = appendName(data, r.target)
+	case typeTXT:
+		for _, s := range r.txt {
+			data = append(data, byte(len(s)))
+			data = append(data, s...)
+		}
+		// A TXT record holds at least one string, if an empty one
+		if len(data) == 0 {
+			data = []byte{0}
+		}
+	case typeA:
+		data = r.ip.To4()
+	case typeAAAA:
+		data = r.ip.To16()
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+// appendName appends an uncompressed name
+func appendName(b []byte, n name) []byte {
+	for _, label := range n {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// parseMessage decodes a message
+func parseMessage(b []byte) (*message, error) {
+	if len(b) < 12 {
+		return nil, errMalformed
+	}
+	m := &message{
+		id:       binary.BigEndian.Uint16(b),
+		response: b[2]&0x80 != 0,
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(b[4+2*i:]))
+	}
+
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		n, next, err := readName(b, off)
+		if err != nil || next+4 > len(b) {
+			return nil, errMalformed
+		}
+		class := binary.BigEndian.Uint16(b[next+2:])
+		m.questions = append(m.questions, question{name: n, typ: binary.BigEndian.Uint16(b[next:]), unicast: class&classTopBit != 0})
+		off = next + 4
+	}
+	for section := 1; section < 4; section++ {
+		for i := 0; i < counts[section]; i++ {
+			r, next, err := readRecord(b, off)
+			if err != nil {
+				return nil, err
+			}
+			off = next
+			switch section {
+			case 1:
+				m.answers = append(m.answers, r)
+			case 3:
+				m.additionals = append(m.additionals, r)
+			}
+		}
+	}
+	return m, nil
+}
+
+// readRecord decodes the record at off, returning where the next begins
+func readRecord(b []byte, off int) (record, int, error) {
+	n, off, err := readName(b, off)
+	if err != nil || off+10 > len(b) {
+		return record{}, 0, errMalformed
+	}
+	class := binary.BigEndian.Uint16(b[off+2:])
+	r := record{
+		name:  n,
+		typ:   binary.BigEndian.Uint16(b[off:]),
+		flush: class&classTopBit != 0,
+		ttl:   binary.BigEndian.Uint32(b[off+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(b[off+8:]))
+	start, end := off+10, off+10+length
+	if end > len(b) {
+		return record{}, 0, errMalformed
+	}
+	data := b[start:end]
+
+	switch r.typ {
+	case typePTR:
+		r.ptr, _, err = readName(b, start)
+	case typeSRV:
+		if length < 7 {
+			return record{}, 0, errMalformed
+		}
+		r.port = binary.BigEndian.Uint16(data[4:])
+		r.target, _, err = readName(b, start+6)
+	case typeTXT:
+		for len(data) > 0 {
+			size := int(data[0])
+			if 1+size > len(data) {
+				return record{}, 0, errMalformed
+			}
+			if size > 0 {
+				r.txt = append(r.txt, string(data[1:1+size]))
+			}
+			data = data[1+size:]
+		}
+	case typeA, typeAAAA:
+		if length != net.IPv4len && length != net.IPv6len {
+			return record{}, 0, errMalformed
+		}
+		r.ip = net.IP(append([]byte(nil), data...))
+	}
+	if err != nil {
+		return record{}, 0, err
+	}
+	return r, end, nil
+}
+
+// readName decodes the name at off, following compression pointers, and
+// returns where the data after it begins
+func readName(b []byte, off int) (name, int, error) {
+	var n name
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return nil, 0, errMalformed
+		}
+		size := int(b[off])
+		switch {
+		case size == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return n, end, nil
+		case size&0xC0 == 0xC0:
+			if off+1 >= len(b) || jumps > 16 {
+				return nil, 0, errMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			jumps++
+		case size&0xC0 != 0:
+			return nil, 0, errMalformed
+		default:
+			if off+1+size > len(b) {
+				return nil, 0, errMalformed
+			}
+			n = append(n, string(b[off+1:off+1+size]))
+			off += 1 + size
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package mdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// response is an answer to a PTR query for _minicast._tcp.local as
+// responders send it, with names compressed against earlier ones
+var response = []byte{
+	0x00, 0x00, 0x84, 0x00, // ID, response and authoritative
+	0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x03,
+	// 12: PTR _minicast._tcp.local -> Studio One._minicast._tcp.local
+	0x09, '_', 'm', 'i', 'n', 'i', 'c', 'a', 's', 't',
+	0x04, '_', 't', 'c', 'p',
+	0x05, 'l', 'o', 'c', 'a', 'l', 0x00,
+	0x00, 0x0C, 0x00, 0x01, 0x00, 0x00, 0x11, 0x94, 0x00, 0x0D,
+	// 44: the instance name
+	0x0A, 'S', 't', 'u', 'd', 'i', 'o', ' ', 'O', 'n', 'e', 0xC0, 0x0C,
+	// 57: SRV, port 8001 on minicast.local, cache flush
+	0xC0, 0x2C, 0x00, 0x21, 0x80, 0x01, 0x00, 0x00, 0x00, 0x78, 0x00, 0x11,
+	0x00, 0x00, 0x00, 0x00, 0x1F, 0x41,
+	// 75: the host name
+	0x08, 'm', 'i', 'n', 'i', 'c', 'a', 's', 't', 0xC0, 0x1B,
+	// 86: TXT
+	0xC0, 0x2C, 0x00, 0x10, 0x80, 0x01, 0x00, 0x00, 0x11, 0x94, 0x00, 0x13,
+	0x08, 'p', 'a', 't', 'h', '=', '/', 'w', 's',
+	0x09, 't', 'x', 't', 'v', 'e', 'r', 's', '=', '1',
+	// 117: A for the host name
+	0xC0, 0x4B, 0x00, 0x01, 0x80, 0x01, 0x00, 0x00, 0x00, 0x78, 0x00, 0x04,
+	192, 168, 1, 10,
+}
+
+func TestParseCompressed(t *testing.T) {
+	m, err := parseMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := name{"_minicast", "_tcp", "local"}
+	instance := service.child("Studio One")
+	host := name{"minicast", "local"}
+
+	wantAnswers := []record{{name: service, typ: typePTR, ttl: 4500, ptr: instance}}
+	wantAdditionals := []record{
+		{name: instance, typ: typeSRV, flush: true, ttl: 120, port: 8001, target: host},
+		{name: instance, typ: typeTXT, flush: true, ttl: 4500, txt: []string{"path=/ws", "txtvers=1"}},
+		{name: host, typ: typeA, flush: true, ttl: 120, ip: net.IP{192, 168, 1, 10}},
+	}
+	if !m.response || len(m.questions) != 0 {
+		t.Errorf("response %v with %d questions", m.response, len(m.questions))
+	}
+	if !reflect.DeepEqual(m.answers, wantAnswers) {
+		t.Errorf("answers %+v\nwant %+v", m.answers, wantAnswers)
+	}
+	if !reflect.DeepEqual(m.additionals, wantAdditionals) {
+		t.Errorf("additionals %+v\nwant %+v", m.additionals, wantAdditionals)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	// Every truncation falls short of a count or a length
+	for n := 0; n < len(response); n++ {
+		if _, err := parseMessage(response[:n]); err == nil {
+			t.Errorf("parsed %d of %d bytes", n, len(response))
+		}
+	}
+
+	// A name pointing at itself
+	loop := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 0x0C, 0, 12, 0, 1}
+	if _, err := parseMessage(loop); err == nil {
+		t.Error("parsed a name pointer loop")
+	}
+	// Labels over 63 bytes use the reserved length bits
+	reserved := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 'a', 0, 0, 12, 0, 1}
+	if _, err := parseMessage(reserved); err == nil {
+		t.Error("parsed a reserved label type")
+	}
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	// Instance names may contain dots, which stay inside their label
+	instance := name{"Studio.One", "_minicast", "_tcp", "local"}
+	m := &message{
+		id:        7,
+		response:  true,
+		questions: []question{{name: instance, typ: typeANY, unicast: true}},
+		answers: []record{
+			{name: instance, typ: typeSRV, flush: true, ttl: 120, port: 8001, target: name{"box", "local"}},
+			{name: instance, typ: typeTXT, ttl: 4500},
+		},
+		additionals: []record{
+			{name: name{"box", "local"}, typ: typeAAAA, flush: true, ttl: 120, ip: net.ParseIP("fe80::1")},
+		},
+	}
+	got, err := parseMessage(m.pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("got %+v\nwant %+v", got, m)
+	}
+	if got.answers[0].name.String() != `Studio.One._minicast._tcp.local.` {
+		t.Errorf("name %s", got.answers[0].name)
+	}
+}
+
+func TestNameEqual(t *testing.T) {
+	if !newName("_MiniCast._TCP.local.").equal(name{"_minicast", "_tcp", "local"}) {
+		t.Error("names differing in case are not equal")
+	}
+	if newName("a.local").equal(newName("a.b.local")) {
+		t.Error("names of different lengths are equal")
+	}
+}
@@ -0,0 +1,98 @@
+package mp3
+
+import "math"
+
+// granuleSize is the samples per channel in a granule, two of which make a
+// frame
+const granuleSize = 576
+
+var (
+	// filterMatrix is the cosine modulation of the analysis filterbank
+	filterMatrix [32][64]float64
+	// mdctMatrix is the long block MDCT with its sine window folded in, and
+	// scaled by 1/9 so the decoder's inverse restores the input's level
+	mdctMatrix [18][36]float64
+	// aliasCS and aliasCA are the butterflies the decoder undoes to reduce
+	// aliasing between subbands
+	aliasCS, aliasCA [8]float64
+)
+
+func init() {
+	for k := 0; k < 32; k++ {
+		for i := 0; i < 64; i++ {
+			filterMatrix[k][i] = math.Cos(float64((2*k+1)*(i-16)) * math.Pi / 64)
+		}
+	}
+	for k := 0; k < 18; k++ {
+		for n := 0; n < 36; n++ {
+			window := math.Sin(math.Pi / 36 * (float64(n) + 0.5))
+			mdctMatrix[k][n] = window * math.Cos(math.Pi/72*float64((2*n+1+18)*(2*k+1))) / 9
+		}
+	}
+	for i, c := range []float64{-0.6, -0.535, -0.33, -0.185, -0.095, -0.041, -0.0142, -0.0037} {
+		sq := math.Sqrt(1 + c*c)
+		aliasCS[i], aliasCA[i] = 1/sq, c/sq
+	}
+}
+
+// analysis turns one channel's samples into the frequency lines of Layer
+// III's long blocks: a polyphase filterbank into 32 subbands, then an MDCT
+// of each subband across this and the previous granule
+type analysis struct {
+	// fifo holds the last 512 samples, newest first
+	fifo [512]float64
+	// subbands are this granule's subband samples, and prev the last
+	// granule's, by subband
+	subbands [32][18]float64
+	prev     [32][18]float64
+}
+
+// granule transforms granuleSize samples, scaled to ±1, into xr
+func (a *analysis) granule(samples []float64, xr *[granuleSize]float64) {
+	var y [64]float64
+	for t := 0; t < 18; t++ {
+		copy(a.fifo[32:], a.fifo[:512-32])
+		for i := 0; i < 32; i++ {
+			a.fifo[31-i] = samples[32*t+i]
+		}
+		for i := range y {
+			sum := 0.0
+			for j := i; j < 512; j += 64 {
+				sum += analysisWindow[j] * a.fifo[j]
+			}
+			y[i] = sum
+		}
+		for k := 0; k < 32; k++ {
+			sum := 0.0
+			for i, v := range y {
+				sum += filterMatrix[k][i] * v
+			}
+			// Odd subbands are frequency inverted
+			if k&1 == 1 && t&1 == 1 {
+				sum = -sum
+			}
+			a.subbands[k][t] = sum
+		}
+	}
+
+	var in [36]float64
+	for k := 0; k < 32; k++ {
+		copy(in[:18], a.prev[k][:])
+		copy(in[18:], a.subbands[k][:])
+		for i := 0; i < 18; i++ {
+			sum := 0.0
+			for n, v := range in {
+				sum += mdctMatrix[i][n] * v
+			}
+			xr[18*k+i] = sum
+		}
+	}
+	a.prev = a.subbands
+
+	for k := 1; k < 32; k++ {
+		for i := 0; i < 8; i++ {
+			lo, hi := &xr[18*k-1-i], &xr[18*k+i]
+			*lo, *hi = *lo*aliasCS[i]+*hi*aliasCA[i], *hi*aliasCS[i]-*lo*aliasCA[i]
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package mp3
+
+import (
+	"fmt"
+	"slices"
+)
+
+// FrameSize is the samples per channel in an MPEG-1 Layer III frame
+const FrameSize = 2 * granuleSize
+
+// Bitrates are the constant bitrates, in kbit/s, an Encoder can produce
+var Bitrates = []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+
+// sampleRateIndex is the header's code for each sample rate
+var sampleRateIndex = map[int]uint32{44100: 0, 48000: 1, 32000: 2}
+
+// Encoder encodes 16-bit PCM into MPEG-1 Layer III at a constant bitrate,
+// without cgo or external libraries. It trades quality for simplicity:
+// long blocks only, no psychoacoustic model and no bit reservoir, which is
+// transparent enough for talk and live music at 128kbit/s and above.
+type Encoder struct {
+	sampleRate  int
+	numChannels int
+	bitrate     int
+
+	// lag accumulates the fraction of a byte frames fall short by, which
+	// padding makes up
+	lag int
+
+	// cutoff is the first frequency line left out, above the band the
+	// bitrate can carry
+	cutoff int
+
+	pending  []int16
+	analysis [2]analysis
+	quant    quantizer
+	xr       [2][2][granuleSize]float64
+	w        bitWriter
+}
+
+// NewEncoder creates an encoder for interleaved PCM at sampleRate (32,
+// 44.1 or 48kHz) with one or two channels, producing bitrate kbit/s (one
+// of Bitrates)
+func NewEncoder(sampleRate, numChannels, bitrate int) (*Encoder, error) {
+	edges, ok := bandEdges[sampleRate]
+	if !ok {
+		return nil, fmt.Errorf("mp3 encodes at 32, 44.1 or 48kHz, not %dHz", sampleRate)
+	}
+	if numChannels < 1 || numChannels > 2 {
+		return nil, fmt.Errorf("mp3 encodes 1 or 2 channels, not %d", numChannels)
+	}
+	if !slices.Contains(Bitrates, bitrate) {
+		return nil, fmt.Errorf("unsupported mp3 bitrate %dkbit/s", bitrate)
+	}
+
+	e := &Encoder{sampleRate: sampleRate, numChannels: numChannels, bitrate: bitrate}
+	e.quant.edges = &edges
+	e.cutoff = min(granuleSize, lowpass(bitrate/numChannels)*2*granuleSize/sampleRate)
+	return e, nil
+}
+
+// lowpass returns the highest frequency worth coding at kbit/s per channel.
+// Spending bits above it costs more audible noise below than it gains.
+func lowpass(perChannel int) int {
+	switch {
+	case perChannel < 24:
+		return 5500
+	case perChannel < 32:
+		return 8000
+	case perChannel < 40:
+		return 11000
+	case perChannel < 48:
+		return 13000
+	case perChannel < 56:
+		return 15000
+	case perChannel < 64:
+		return 16000
+	case perChannel < 80:
+		return 17000
+	case perChannel < 96:
+		return 19000
+	}
+	return 24000
+}
+
+// Encode buffers pcm and returns the frames it completes, if any
+func (e *Encoder) Encode(pcm []int16) ([]byte, error) {
+	e.pending = append(e.pending, pcm...)
+
+	var out []byte
+	frame := FrameSize * e.numChannels
+	for len(e.pending) >= frame {
+		out = append(out, e.encodeFrame(e.pending[:frame])...)
+		e.pending = e.pending[frame:]
+	}
+	// Keep the leftover at the start of the buffer so it does not grow
+	e.pending = append(e.pending[:0], e.pending...)
+	return out, nil
+}
+
+// encodeFrame encodes FrameSize samples per channel
+func (e *Encoder) encodeFrame(pcm []int16) []byte {
+	n := e.numChannels
+	samples := make([]float64, granuleSize)
+	for gr := 0; gr < 2; gr++ {
+		for ch := 0; ch < n; ch++ {
+			for i := range samples {
+				samples[i] = float64(pcm[(gr*granuleSize+i)*n+ch]) / 32768
+			}
+			xr := &e.xr[gr][ch]
+			e.analysis[ch].granule(samples, xr)
+			clear(xr[e.cutoff:])
+		}
+	}
+
+	padding := 0
+	bytes := 144000 * e.bitrate / e.sampleRate
+	e.lag += 144000 * e.bitrate % e.sampleRate
+	if e.lag >= e.sampleRate {
+		e.lag -= e.sampleRate
+		padding = 1
+	}
+	sideBits := 136
+	if n == 2 {
+		sideBits = 256
+	}
+	avail := 8*(bytes+padding) - 32 - sideBits
+
+	// Quantize granule by granule, each taking an even share of what is
+	// left of the frame, and code the main data as it goes
+	var main bitWriter
+	var infos [2][2]granuleInfo
+	for gr := 0; gr < 2; gr++ {
+		for ch := 0; ch < n; ch++ {
+			remaining := 2*n - (gr*n + ch)
+			info := e.quant.quantize(&e.xr[gr][ch], min(avail/remaining, 4095))
+			e.quant.write(&main, info, &e.xr[gr][ch])
+			avail -= info.part23Length
+			infos[gr][ch] = info
+		}
+	}
+
+	w := &e.w
+	w.reset()
+	e.writeHeader(w, padding)
+	// Side information: main data begins in this frame, no private bits
+	// or scalefactor sharing
+	w.write(0, 9)
+	if n == 1 {
+		w.write(0, 5)
+	} else {
+		w.write(0, 3)
+	}
+	w.write(0, 4*n)
+	for gr := 0; gr < 2; gr++ {
+		for ch := 0; ch < n; ch++ {
+			info := infos[gr][ch]
+			w.write(uint32(info.part23Length), 12)
+			w.write(uint32(info.bigValues), 9)
+			w.write(uint32(info.globalGain), 8)
+			w.write(0, 4) // scalefac_compress: no scalefactors
+			w.write(0, 1) // long blocks
+			for _, t := range info.tableSelect {
+				w.write(uint32(t), 5)
+			}
+			w.write(uint32(info.region0Count), 4)
+			w.write(uint32(info.region1Count), 3)
+			w.write(0, 1) // preflag
+			w.write(0, 1) // scalefac_scale
+			w.write(uint32(info.count1Table), 1)
+		}
+	}
+	w.append(&main)
+
+	// Unused bits of the frame are ancillary data
+	frame := make([]byte, bytes+padding)
+	copy(frame, w.bytes())
+	return frame
+}
+
+// writeHeader writes the 32-bit frame header
+func (e *Encoder) writeHeader(w *bitWriter, padding int) {
+	bitrateIndex := slices.Index(Bitrates, e.bitrate) + 1
+	w.write(0xFFF, 12)
+	w.write(1, 1) // MPEG-1
+	w.write(1, 2) // Layer III
+	w.write(1, 1) // no CRC
+	w.write(uint32(bitrateIndex), 4)
+	w.write(sampleRateIndex[e.sampleRate], 2)
+	w.write(uint32(padding), 1)
+	w.write(0, 1) // private
+	if e.numChannels == 1 {
+		w.write(3, 2) // single channel
+	} else {
+		w.write(0, 2) // stereo
+	}
+	w.write(0, 2) // mode extension
+	w.write(0, 1) // not copyrighted
+	w.write(1, 1) // original
+	w.write(0, 2) // no emphasis
+}
+
+// bitWriter packs big-endian bit fields into bytes
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits int
+}
+
+// reset empties the writer, keeping its buffer
+func (w *bitWriter) reset() {
+	w.buf, w.acc, w.nbits = w.buf[:0], 0, 0
+}
+
+// write appends the low n bits of v
+func (w *bitWriter) write(v uint32, n int) {
+	w.acc = w.acc<<n | uint64(v)&(1<<n-1)
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.nbits -= 8
+		w.buf = append(w.buf, byte(w.acc>>w.nbits))
+	}
+}
+
+// append appends everything written to other
+func (w *bitWriter) append(other *bitWriter) {
+	for _, b := range other.buf {
+		w.write(uint32(b), 8)
+	}
+	if other.nbits > 0 {
+		w.write(uint32(other.acc), other.nbits)
+	}
+}
+
+// bytes returns the bytes written so far, the last padded with zeros
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		return append(w.buf, byte(w.acc<<(8-w.nbits)))
+	}
+	return w.buf
+}
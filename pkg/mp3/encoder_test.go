@@ -0,0 +1,117 @@
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+
+	gomp3 "github.com/hajimehoshi/go-mp3"
+)
+
+// tone returns seconds of interleaved PCM: 440Hz on the left channel and
+// 1kHz on the right
+func tone(sampleRate, numChannels int, seconds float64) []int16 {
+	n := int(float64(sampleRate) * seconds)
+	pcm := make([]int16, 0, n*numChannels)
+	for i := 0; i < n; i++ {
+		t := float64(i) / float64(sampleRate)
+		pcm = append(pcm, int16(10000*math.Sin(2*math.Pi*440*t)))
+		if numChannels == 2 {
+			pcm = append(pcm, int16(10000*math.Sin(2*math.Pi*1000*t)))
+		}
+	}
+	return pcm
+}
+
+// decode decodes an MP3 stream with an independent decoder, which always
+// produces stereo
+func decode(t *testing.T, stream []byte) ([]int16, int) {
+	d, err := gomp3.NewDecoder(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm := make([]int16, len(raw)/2)
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(raw[2*i:]))
+	}
+	return pcm, d.SampleRate()
+}
+
+// snr returns the signal to noise ratio in dB of channel ch of got against
+// want, at the delay that matches them best
+func snr(want []int16, wantChannels int, got []int16, ch int) float64 {
+	frames := len(want)/wantChannels - 4*FrameSize
+	best := math.Inf(-1)
+	for delay := 0; delay < 2*FrameSize; delay++ {
+		var signal, noise float64
+		for i := FrameSize; i < frames; i++ {
+			s := float64(want[i*wantChannels+ch])
+			d := float64(got[(i+delay)*2+ch]) - s
+			signal += s * s
+			noise += d * d
+		}
+		best = math.Max(best, 10*math.Log10(signal/noise))
+	}
+	return best
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		sampleRate, numChannels, bitrate int
+	}{
+		{44100, 2, 128},
+		{48000, 2, 192},
+		{32000, 1, 64},
+	}
+	for _, tt := range tests {
+		e, err := NewEncoder(tt.sampleRate, tt.numChannels, tt.bitrate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := tone(tt.sampleRate, tt.numChannels, 2)
+		// Odd chunk sizes leave samples pending between calls
+		var stream []byte
+		for rest := in; len(rest) > 0; {
+			n := min(len(rest), 1000*tt.numChannels+tt.numChannels)
+			frames, err := e.Encode(rest[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream = append(stream, frames...)
+			rest = rest[n:]
+		}
+
+		frames := len(in) / tt.numChannels / FrameSize
+		// A constant bitrate, padded to keep the average exact
+		if want := frames * 144 * tt.bitrate * 1000 / tt.sampleRate; len(stream) < want || len(stream) > want+frames {
+			t.Errorf("%dHz %dkbit/s: %d bytes for %d frames, want about %d", tt.sampleRate, tt.bitrate, len(stream), frames, want)
+		}
+
+		out, rate := decode(t, stream)
+		if rate != tt.sampleRate {
+			t.Errorf("decoded at %dHz, want %d", rate, tt.sampleRate)
+		}
+		if got := len(out) / 2; got != frames*FrameSize {
+			t.Errorf("%dHz: decoded %d samples, want %d", tt.sampleRate, got, frames*FrameSize)
+		}
+		for ch := 0; ch < tt.numChannels; ch++ {
+			if db := snr(in, tt.numChannels, out, ch); db < 30 {
+				t.Errorf("%dHz %d channels %dkbit/s: channel %d at %.1fdB SNR", tt.sampleRate, tt.numChannels, tt.bitrate, ch, db)
+			}
+		}
+	}
+}
+
+func TestNewEncoderRejects(t *testing.T) {
+	for _, args := range [][3]int{{22050, 2, 128}, {44100, 3, 128}, {44100, 2, 100}} {
+		if _, err := NewEncoder(args[0], args[1], args[2]); err == nil {
+			t.Errorf("NewEncoder(%d, %d, %d) succeeded", args[0], args[1], args[2])
+		}
+	}
+}
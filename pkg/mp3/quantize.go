@@ -0,0 +1,258 @@
+package mp3
+
+import "math"
+
+// maxQuantized is the largest value the Huffman tables can code
+const maxQuantized = 15 + 1<<13 - 1
+
+// bandEdges are the long block scalefactor bands by sample rate
+var bandEdges = map[int][23]int{
+	44100: {0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 52, 62, 74, 90, 110, 134, 162, 196, 238, 288, 342, 418, 576},
+	48000: {0, 4, 8, 12, 16, 20, 24, 30, 36, 42, 50, 60, 72, 88, 106, 128, 156, 190, 230, 276, 330, 384, 576},
+	32000: {0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 54, 66, 82, 102, 126, 156, 194, 240, 296, 364, 448, 550, 576},
+}
+
+// regionSplit is how many scalefactor bands go to region 0 and region 1 of
+// the big values, by the number of bands they span
+var regionSplit = [23][2]int{
+	{0, 0}, {0, 0}, {0, 0}, {0, 0}, {0, 0}, {0, 1}, {1, 1}, {1, 1}, {1, 2}, {2, 2}, {2, 3}, {2, 3},
+	{3, 4}, {3, 4}, {3, 4}, {4, 5}, {4, 5}, {4, 6}, {5, 6}, {5, 6}, {5, 7}, {6, 7}, {6, 7},
+}
+
+// granuleInfo is the side information of one granule of one channel
+type granuleInfo struct {
+	part23Length int
+	bigValues    int
+	globalGain   int
+	tableSelect  [3]int
+	region0Count int
+	region1Count int
+	count1Table  int
+
+	// count1End is where the count1 region ends and only zeros follow
+	count1End int
+}
+
+// quantizer finds the coarsest quantization of a granule that fits a bit
+// budget. No psychoacoustic model shapes the noise: scalefactors stay at
+// zero, so the global gain alone trades quality for bits.
+type quantizer struct {
+	edges *[23]int
+	// xr34 holds |xr|^(3/4), and ix the quantized values
+	xr34 [granuleSize]float64
+	ix   [granuleSize]int
+}
+
+// quantize picks the global gain for xr and returns the side information.
+// The signs stay in xr, and the values in q.ix.
+func (q *quantizer) quantize(xr *[granuleSize]float64, budget int) granuleInfo {
+	peak := 0.0
+	for i, v := range xr {
+		q.xr34[i] = math.Pow(math.Abs(v), 0.75)
+		peak = max(peak, q.xr34[i])
+	}
+	if peak == 0 {
+		clear(q.ix[:])
+		return granuleInfo{globalGain: 210}
+	}
+
+	// The finest gain that keeps every value codable, then a binary search
+	// for the finest that fits the budget, since coarser gains need fewer bits
+	lo := 210 + int(math.Ceil(16.0/3*math.Log2(peak/(maxQuantized-0.4054))))
+	lo = min(max(lo, 0), 255)
+	hi := 255
+	best := granuleInfo{}
+	found := false
+	for lo <= hi {
+		gain := (lo + hi) / 2
+		info := q.layout(gain)
+		if info.part23Length <= budget {
+			best, found = info, true
+			hi = gain - 1
+		} else {
+			lo = gain + 1
+		}
+	}
+	if !found {
+		// Nothing fits: send silence rather than a corrupt granule
+		clear(q.ix[:])
+		return granuleInfo{globalGain: 210}
+	}
+	q.layout(best.globalGain)
+	return best
+}
+
+// layout quantizes at gain and works out the regions, tables and size
+func (q *quantizer) layout(gain int) granuleInfo {
+	step := math.Pow(2, -0.1875*float64(gain-210))
+	for i, v := range q.xr34 {
+		q.ix[i] = min(int(v*step+0.4054), maxQuantized)
+	}
+	info := granuleInfo{globalGain: gain}
+
+	// Trailing zero pairs are not coded, then quadruples of values at most
+	// one go to the count1 region, and the rest are big value pairs
+	end := granuleSize
+	for end > 1 && q.ix[end-1] == 0 && q.ix[end-2] == 0 {
+		end -= 2
+	}
+	info.count1End = end
+	for end > 3 && q.ix[end-1] <= 1 && q.ix[end-2] <= 1 && q.ix[end-3] <= 1 && q.ix[end-4] <= 1 {
+		end -= 4
+	}
+	info.bigValues = end / 2
+
+	if end > 0 {
+		bands := 0
+		for q.edges[bands] < end {
+			bands++
+		}
+		info.region0Count, info.region1Count = regionSplit[bands][0], regionSplit[bands][1]
+	}
+	bits := 0
+	for r, span := range q.regions(info) {
+		info.tableSelect[r] = q.chooseTable(span[0], span[1])
+		bits += q.pairBits(span[0], span[1], info.tableSelect[r])
+	}
+
+	a, b := q.count1Bits(end, info.count1End)
+	if b < a {
+		info.count1Table, bits = 1, bits+b
+	} else {
+		bits += a
+	}
+	info.part23Length = bits
+	return info
+}
+
+// regions returns the start and end of the three big values regions
+func (q *quantizer) regions(info granuleInfo) [3][2]int {
+	end := 2 * info.bigValues
+	r1 := min(q.edges[info.region0Count+1], end)
+	r2 := min(q.edges[info.region0Count+info.region1Count+2], end)
+	return [3][2]int{{0, r1}, {r1, r2}, {r2, end}}
+}
+
+// chooseTable returns the table coding ix[start:end] in the fewest bits
+func (q *quantizer) chooseTable(start, end int) int {
+	peak := 0
+	for _, v := range q.ix[start:end] {
+		peak = max(peak, v)
+	}
+	if peak == 0 {
+		return 0
+	}
+
+	var candidates []int
+	if peak < 15 {
+		for n := 1; n <= 15; n++ {
+			if huffmanTables[n].codes != nil && huffmanTables[n].xlen > peak {
+				candidates = append(candidates, n)
+			}
+		}
+	} else {
+		// Of each group sharing codes, the fewest linbits that hold the peak
+		for _, group := range [][2]int{{16, 24}, {24, 32}} {
+			for n := group[0]; n < group[1]; n++ {
+				if peak-15 < 1<<linbits[n] {
+					candidates = append(candidates, n)
+					break
+				}
+			}
+		}
+	}
+
+	best, bestBits := candidates[0], math.MaxInt
+	for _, n := range candidates {
+		if bits := q.pairBits(start, end, n); bits < bestBits {
+			best, bestBits = n, bits
+		}
+	}
+	return best
+}
+
+// pairBits counts the bits coding ix[start:end] with table n takes
+func (q *quantizer) pairBits(start, end, n int) int {
+	if n == 0 {
+		return 0
+	}
+	t := &huffmanTables[n]
+	bits := 0
+	for i := start; i < end; i += 2 {
+		x, y := q.ix[i], q.ix[i+1]
+		if x >= 15 && t.linbits > 0 {
+			bits += t.linbits
+			x = 15
+		}
+		if y >= 15 && t.linbits > 0 {
+			bits += t.linbits
+			y = 15
+		}
+		bits += int(t.lens[x*t.xlen+y])
+		if x != 0 {
+			bits++
+		}
+		if y != 0 {
+			bits++
+		}
+	}
+	return bits
+}
+
+// count1Bits counts the bits of ix[start:end] with count1 tables A and B
+func (q *quantizer) count1Bits(start, end int) (a, b int) {
+	for i := start; i < end; i += 4 {
+		quad := q.ix[i]<<3 | q.ix[i+1]<<2 | q.ix[i+2]<<1 | q.ix[i+3]
+		signs := q.ix[i] + q.ix[i+1] + q.ix[i+2] + q.ix[i+3]
+		a += int(huffmanTables[32].lens[quad]) + signs
+		b += int(huffmanTables[33].lens[quad]) + signs
+	}
+	return a, b
+}
+
+// write appends the Huffman coded values, with the signs of xr
+func (q *quantizer) write(w *bitWriter, info granuleInfo, xr *[granuleSize]float64) {
+	sign := func(i int) {
+		if q.ix[i] == 0 {
+			return
+		}
+		if xr[i] < 0 {
+			w.write(1, 1)
+		} else {
+			w.write(0, 1)
+		}
+	}
+
+	for r, span := range q.regions(info) {
+		n := info.tableSelect[r]
+		if n == 0 {
+			continue
+		}
+		t := &huffmanTables[n]
+		for i := span[0]; i < span[1]; i += 2 {
+			x, y := q.ix[i], q.ix[i+1]
+			cx, cy := x, y
+			if t.linbits > 0 {
+				cx, cy = min(x, 15), min(y, 15)
+			}
+			w.write(t.codes[cx*t.xlen+cy], int(t.lens[cx*t.xlen+cy]))
+			if cx == 15 && t.linbits > 0 {
+				w.write(uint32(x-15), t.linbits)
+			}
+			sign(i)
+			if cy == 15 && t.linbits > 0 {
+				w.write(uint32(y-15), t.linbits)
+			}
+			sign(i + 1)
+		}
+	}
+
+	t := &huffmanTables[32+info.count1Table]
+	for i := 2 * info.bigValues; i < info.count1End; i += 4 {
+		quad := q.ix[i]<<3 | q.ix[i+1]<<2 | q.ix[i+2]<<1 | q.ix[i+3]
+		w.write(t.codes[quad], int(t.lens[quad]))
+		for j := i; j < i+4; j++ {
+			sign(j)
+		}
+	}
+}
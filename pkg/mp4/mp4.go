@@ -0,0 +1,128 @@
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+// trackID is the ID of the single audio track
+const trackID = 1
+
+// box builds an ISO BMFF box of typ around the concatenated payloads
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// fullBox builds a box with a version and flags ahead of the payloads
+func fullBox(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	vf := be32(uint32(version)<<24 | flags&0xFFFFFF)
+	return box(typ, append([][]byte{vf}, payloads...)...)
+}
+
+// be16, be32 and be64 encode big-endian integers
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// zeros returns n zero bytes, for reserved fields
+func zeros(n int) []byte { return make([]byte, n) }
+
+// unityMatrix is the identity transformation of movie and track headers
+var unityMatrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// FLACInit returns the initialization segment of a fragmented MP4 stream
+// holding one FLAC track, as MediaSource Extensions take it: the file type
+// and a movie with no samples, whose track's samples all come in fragments.
+// streamInfo is the FLAC STREAMINFO block, without its header. Timestamps
+// are in samples.
+func FLACInit(sampleRate, numChannels int, streamInfo []byte) []byte {
+	ftyp := box("ftyp", []byte("iso6"), be32(0), []byte("iso6"), []byte("isom"), []byte("mp41"))
+
+	// The dfLa box carries FLAC's metadata blocks: STREAMINFO, marked last
+	dfLa := fullBox("dfLa", 0, 0, []byte{0x80, 0, 0, byte(len(streamInfo))}, streamInfo)
+	// The sample rate is 16.16 fixed point, so rates above 65535 are left
+	// to the codec configuration
+	rate := uint32(sampleRate) << 16
+	if sampleRate > 0xFFFF {
+		rate = 0
+	}
+	fLaC := box("fLaC",
+		zeros(6), be16(1), // reserved, data reference index
+		zeros(8), be16(uint16(numChannels)), be16(16), zeros(4), be32(rate),
+		dfLa)
+
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, be32(1), fLaC),
+		fullBox("stts", 0, 0, be32(0)),
+		fullBox("stsc", 0, 0, be32(0)),
+		fullBox("stsz", 0, 0, be32(0), be32(0)),
+		fullBox("stco", 0, 0, be32(0)))
+	minf := box("minf",
+		fullBox("smhd", 0, 0, zeros(4)),
+		box("dinf", fullBox("dref", 0, 0, be32(1), fullBox("url ", 0, 1))),
+		stbl)
+	mdia := box("mdia",
+		// Language "und", packed as three 5-bit letters
+		fullBox("mdhd", 0, 0, zeros(8), be32(uint32(sampleRate)), be32(0), be16(0x55C4), zeros(2)),
+		fullBox("hdlr", 0, 0, zeros(4), []byte("soun"), zeros(12), []byte("SoundHandler\x00")),
+		minf)
+	trak := box("trak",
+		// Flags: enabled and in the movie
+		fullBox("tkhd", 0, 3, zeros(8), be32(trackID), zeros(4), be32(0), zeros(8),
+			zeros(4), be16(0x0100), zeros(2), unityMatrix, be32(0), be32(0)),
+		mdia)
+	mvex := box("mvex", fullBox("trex", 0, 0, be32(trackID), be32(1), be32(0), be32(0), be32(0)))
+	moov := box("moov",
+		fullBox("mvhd", 0, 0, zeros(8), be32(uint32(sampleRate)), be32(0),
+			be32(0x00010000), be16(0x0100), zeros(10), unityMatrix, zeros(24), be32(trackID+1)),
+		trak,
+		mvex)
+
+	return append(ftyp, moov...)
+}
+
+// Fragment returns a movie fragment holding samples, the first decoded at
+// decodeTime, each lasting its duration. seq numbers the fragments from 1.
+func Fragment(seq uint32, decodeTime uint64, samples [][]byte, durations []uint32) []byte {
+	entries := make([]byte, 0, 8*len(samples))
+	dataSize := 0
+	for i, sample := range samples {
+		entries = binary.BigEndian.AppendUint32(entries, durations[i])
+		entries = binary.BigEndian.AppendUint32(entries, uint32(len(sample)))
+		dataSize += len(sample)
+	}
+
+	// The data offset counts from the start of the moof, which is built
+	// with a placeholder first to learn its size. Flags: data offset,
+	// sample durations and sample sizes present.
+	build := func(offset uint32) []byte {
+		return box("moof",
+			fullBox("mfhd", 0, 0, be32(seq)),
+			box("traf",
+				// Flags: offsets are relative to the moof
+				fullBox("tfhd", 0, 0x020000, be32(trackID)),
+				fullBox("tfdt", 1, 0, be64(decodeTime)),
+				fullBox("trun", 0, 0x000301, be32(uint32(len(samples))), be32(offset), entries)))
+	}
+	moof := build(0)
+	moof = build(uint32(len(moof) + 8))
+
+	mdat := make([]byte, 0, dataSize)
+	for _, sample := range samples {
+		mdat = append(mdat, sample...)
+	}
+	return append(moof, box("mdat", mdat)...)
+}
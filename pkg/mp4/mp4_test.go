@@ -0,0 +1,123 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// children splits b into boxes by type, failing on a size that does not fit
+func children(t *testing.T, b []byte) map[string][]byte {
+	boxes := make(map[string][]byte)
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("%d bytes left over", len(b))
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("box %q of %d bytes in %d", b[4:8], size, len(b))
+		}
+		boxes[string(b[4:8])] = b[8:size]
+		b = b[size:]
+	}
+	return boxes
+}
+
+// path descends through nested boxes, skipping the fields that come before
+// the boxes inside stsd and fLaC
+func path(t *testing.T, b []byte, types ...string) []byte {
+	for _, typ := range types {
+		box, ok := children(t, b)[typ]
+		if !ok {
+			t.Fatalf("no %q box", typ)
+		}
+		switch typ {
+		case "stsd":
+			box = box[8:]
+		case "fLaC":
+			// The audio sample entry's fields come before its boxes
+			box = box[28:]
+		}
+		b = box
+	}
+	return b
+}
+
+func TestFLACInit(t *testing.T) {
+	streamInfo := bytes.Repeat([]byte{0xAB}, 34)
+	init := FLACInit(48000, 2, streamInfo)
+
+	top := children(t, init)
+	if ftyp := top["ftyp"]; !bytes.HasPrefix(ftyp, []byte("iso6")) {
+		t.Errorf("major brand %q", ftyp[:4])
+	}
+
+	moov := top["moov"]
+	mdhd := path(t, moov, "trak", "mdia", "mdhd")
+	if timescale := binary.BigEndian.Uint32(mdhd[12:]); timescale != 48000 {
+		t.Errorf("track timescale %d, want the sample rate", timescale)
+	}
+	if handler := path(t, moov, "trak", "mdia", "hdlr")[8:12]; string(handler) != "soun" {
+		t.Errorf("handler %q", handler)
+	}
+
+	entry := children(t, path(t, moov, "trak", "mdia", "minf", "stbl", "stsd"))["fLaC"]
+	if channels := binary.BigEndian.Uint16(entry[16:]); channels != 2 {
+		t.Errorf("%d channels", channels)
+	}
+	if rate := binary.BigEndian.Uint32(entry[24:]) >> 16; rate != 48000 {
+		t.Errorf("sample entry rate %d", rate)
+	}
+	dfLa := path(t, moov, "trak", "mdia", "minf", "stbl", "stsd", "fLaC", "dfLa")
+	// Version and flags, then STREAMINFO marked as the last block
+	want := append([]byte{0, 0, 0, 0, 0x80, 0, 0, 34}, streamInfo...)
+	if !bytes.Equal(dfLa, want) {
+		t.Errorf("dfLa % x, want % x", dfLa, want)
+	}
+
+	if _, ok := children(t, path(t, moov, "mvex"))["trex"]; !ok {
+		t.Error("no trex box: the track is not fragmented")
+	}
+}
+
+func TestFLACInitHighRate(t *testing.T) {
+	init := FLACInit(96000, 2, make([]byte, 34))
+	entry := children(t, path(t, children(t, init)["moov"], "trak", "mdia", "minf", "stbl", "stsd"))["fLaC"]
+	if rate := binary.BigEndian.Uint32(entry[24:]); rate != 0 {
+		t.Errorf("sample entry rate %#x, want 0 above 16 bits", rate)
+	}
+}
+
+func TestFragment(t *testing.T) {
+	samples := [][]byte{[]byte("first"), []byte("second frame"), []byte("3")}
+	durations := []uint32{4096, 4096, 1024}
+	fragment := Fragment(7, 123456789012, samples, durations)
+
+	top := children(t, fragment)
+	moof, mdat := top["moof"], top["mdat"]
+	if !bytes.Equal(mdat, []byte("firstsecond frame3")) {
+		t.Fatalf("mdat %q", mdat)
+	}
+	if seq := binary.BigEndian.Uint32(path(t, moof, "mfhd")[4:]); seq != 7 {
+		t.Errorf("sequence number %d", seq)
+	}
+	if decodeTime := binary.BigEndian.Uint64(path(t, moof, "traf", "tfdt")[4:]); decodeTime != 123456789012 {
+		t.Errorf("decode time %d", decodeTime)
+	}
+
+	trun := path(t, moof, "traf", "trun")
+	if count := binary.BigEndian.Uint32(trun[4:]); count != 3 {
+		t.Fatalf("%d samples", count)
+	}
+	// The data offset, from the start of the moof, lands on the mdat payload
+	offset := int(binary.BigEndian.Uint32(trun[8:]))
+	if !bytes.HasPrefix(fragment[offset:], []byte("first")) {
+		t.Errorf("data offset %d points at %q", offset, fragment[offset:offset+5])
+	}
+	for i, entry := 0, trun[12:]; i < len(samples); i, entry = i+1, entry[8:] {
+		duration, size := binary.BigEndian.Uint32(entry), binary.BigEndian.Uint32(entry[4:])
+		if duration != durations[i] || int(size) != len(samples[i]) {
+			t.Errorf("sample %d: duration %d size %d", i, duration, size)
+		}
+	}
+}
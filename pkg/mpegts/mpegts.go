@@ -0,0 +1,282 @@
+// Package mpegts muxes MPEG audio into an MPEG transport stream, the
+// container of broadcast tooling, IPTV and set-top boxes. The stream holds a
+// single program with one audio track, announced by the PAT, PMT and DVB
+// SDT, which repeat so receivers can join at any point.
+package mpegts
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	// PacketSize is the size of every transport stream packet
+	PacketSize = 188
+	// DatagramPackets is how many packets fit one UDP datagram under a
+	// typical MTU, as IPTV sends them
+	DatagramPackets = 7
+
+	// payloadSize is what a packet carries after its header
+	payloadSize = PacketSize - 4
+)
+
+// PIDs of the tables and the audio track, as ffmpeg assigns them
+const (
+	patPID   = 0x0000
+	sdtPID   = 0x0011
+	pmtPID   = 0x1000
+	audioPID = 0x0100
+)
+
+const (
+	// programNumber identifies the stream's one program, or DVB service
+	programNumber = 1
+	// streamTypeMPEG1Audio is the PMT stream type of MPEG-1 audio, which
+	// includes Layer III at 32, 44.1 and 48kHz
+	streamTypeMPEG1Audio = 0x03
+	// serviceTypeRadio is the DVB service type of digital radio
+	serviceTypeRadio = 0x02
+	// audioStreamID is the PES stream ID of the first MPEG audio stream
+	audioStreamID = 0xC0
+	// provider is the service provider named in the SDT
+	provider = "MiniCast"
+
+	// tableInterval is how often the tables repeat, well within the 500ms
+	// DVB asks for
+	tableInterval = 100 * time.Millisecond
+	// presentationDelay is how far each frame's presentation time runs
+	// ahead of the clock reference sent with it, the buffer receivers may
+	// fill, as ffmpeg's muxer allows
+	presentationDelay = 700 * time.Millisecond
+)
+
+// Muxer writes MPEG audio frames to a transport stream
+type Muxer struct {
+	w       io.Writer
+	service string
+
+	// continuity counts the packets carrying payload on each PID
+	continuity map[uint16]uint8
+	// tables is the stream time the tables were last written at
+	tables     time.Duration
+	tablesSent bool
+	buf        []byte
+}
+
+// NewMuxer creates a muxer writing to w, naming the program service.
+// Every Write to w is at most DatagramPackets packets, so w may be a UDP
+// socket.
+func NewMuxer(w io.Writer, service string) *Muxer {
+	return &Muxer{w: w, service: service, continuity: make(map[uint16]uint8)}
+}
+
+// WriteAudio writes MPEG audio frames as one PES packet, preceded by the
+// tables when they are due. t is the stream time of the first frame,
+// which sets the clock reference and presentation time.
+func (m *Muxer) WriteAudio(t time.Duration, frames []byte) error {
+	// The PES header after the packet length is 8 bytes
+	if len(frames) > 0xFFFF-8 {
+		return errors.New("mpegts: too much audio for one PES packet")
+	}
+	b := m.buf[:0]
+	if !m.tablesSent || t < m.tables || t-m.tables >= tableInterval {
+		b = m.appendSection(b, patPID, m.pat())
+		b = m.appendSection(b, pmtPID, m.pmt())
+		b = m.appendSection(b, sdtPID, m.sdt())
+		m.tables, m.tablesSent = t, true
+	}
+
+	pes := make([]byte, 0, 14+len(frames))
+	pes = append(pes, 0, 0, 1, audioStreamID)
+	pes = binary.BigEndian.AppendUint16(pes, uint16(8+len(frames)))
+	// Data aligned, with a presentation time only
+	pes = append(pes, 0x84, 0x80, 5)
+	pes = appendTimestamp(pes, 0x20, ticks90k(t+presentationDelay))
+	pes = append(pes, frames...)
+
+	// The first packet carries the clock reference and marks a random
+	// access point, which every audio frame is
+	fields := append([]byte{0x50}, pcr(t)...)
+	b, pes = m.appendPacket(b, audioPID, true, fields, pes)
+	for len(pes) > 0 {
+		b, pes = m.appendPacket(b, audioPID, false, nil, pes)
+	}
+	m.buf = b
+
+	for len(b) > 0 {
+		n := min(len(b), DatagramPackets*PacketSize)
+		if _, err := m.w.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// appendPacket appends a packet on pid carrying as much of payload as fits
+// after the adaptation field holding fields, if any, and returns what is
+// left. A short payload is made up with stuffing in the adaptation field.
+func (m *Muxer) appendPacket(b []byte, pid uint16, start bool, fields, payload []byte) ([]byte, []byte) {
+	hasAdaptation := fields != nil
+	space := payloadSize
+	if hasAdaptation {
+		space -= 1 + len(fields)
+	}
+	n := min(len(payload), space)
+	if stuffing := space - n; stuffing > 0 {
+		if !hasAdaptation {
+			// The field's length byte alone stuffs one byte; more needs
+			// its flags too
+			hasAdaptation = true
+			stuffing--
+			if stuffing > 0 {
+				fields = []byte{0}
+				stuffing--
+			}
+		}
+		for ; stuffing > 0; stuffing-- {
+			fields = append(fields, 0xFF)
+		}
+	}
+
+	control := byte(0x10)
+	if hasAdaptation {
+		control = 0x30
+	}
+	first := byte(pid >> 8 & 0x1F)
+	if start {
+		first |= 0x40
+	}
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0F
+
+	b = append(b, 0x47, first, byte(pid), control|cc)
+	if hasAdaptation {
+		b = append(b, byte(len(fields)))
+		b = append(b, fields...)
+	}
+	b = append(b, payload[:n]...)
+	return b, payload[n:]
+}
+
+// appendSection appends a packet on pid carrying a table section, padded
+// with 0xFF as tables are
+func (m *Muxer) appendSection(b []byte, pid uint16, section []byte) []byte {
+	payload := make([]byte, payloadSize)
+	// The pointer field says the section starts right after it
+	n := copy(payload[1:], section)
+	for i := 1 + n; i < len(payload); i++ {
+		payload[i] = 0xFF
+	}
+	b, _ = m.appendPacket(b, pid, true, nil, payload)
+	return b
+}
+
+// pat returns the program association table, pointing at the PMT
+func (m *Muxer) pat() []byte {
+	body := binary.BigEndian.AppendUint16(nil, programNumber)
+	body = binary.BigEndian.AppendUint16(body, 0xE000|pmtPID)
+	return section(0x00, 0xB0, 1, body)
+}
+
+// pmt returns the program map table, listing the audio track, which also
+// carries the clock reference
+func (m *Muxer) pmt() []byte {
+	body := binary.BigEndian.AppendUint16(nil, 0xE000|audioPID)
+	// No program descriptors
+	body = binary.BigEndian.AppendUint16(body, 0xF000)
+	body = append(body, streamTypeMPEG1Audio)
+	body = binary.BigEndian.AppendUint16(body, 0xE000|audioPID)
+	body = binary.BigEndian.AppendUint16(body, 0xF000)
+	return section(0x02, 0xB0, programNumber, body)
+}
+
+// sdt returns the DVB service description table, naming the program as
+// receivers list it
+func (m *Muxer) sdt() []byte {
+	service := m.service
+	if len(service) > 100 {
+		service = service[:100]
+	}
+	descriptor := []byte{0x48, byte(3 + len(provider) + len(service)), serviceTypeRadio, byte(len(provider))}
+	descriptor = append(descriptor, provider...)
+	descriptor = append(descriptor, byte(len(service)))
+	descriptor = append(descriptor, service...)
+
+	// The original network ID, then the one service: no EIT, running
+	body := binary.BigEndian.AppendUint16(nil, 0xFF01)
+	body = append(body, 0xFF)
+	body = binary.BigEndian.AppendUint16(body, programNumber)
+	body = append(body, 0xFC)
+	body = binary.BigEndian.AppendUint16(body, 0x8000|uint16(len(descriptor)))
+	body = append(body, descriptor...)
+	return section(0x42, 0xF0, 1, body)
+}
+
+// section builds a long-form table section: its table ID, the flags in the
+// high bits of its length, the table ID extension, version 0 and a single
+// section holding body, followed by its CRC
+func section(tableID, flags byte, extension uint16, body []byte) []byte {
+	// The length counts from the extension to the end of the CRC
+	length := 5 + len(body) + 4
+	s := []byte{tableID, flags | byte(length>>8), byte(length)}
+	s = binary.BigEndian.AppendUint16(s, extension)
+	s = append(s, 0xC1, 0, 0)
+	s = append(s, body...)
+	return binary.BigEndian.AppendUint32(s, crc32(s))
+}
+
+// ticks90k converts a stream time to the 90kHz clock of presentation
+// times, which wraps at 33 bits
+func ticks90k(t time.Duration) uint64 {
+	return uint64(int64(t)*9/100000) & (1<<33 - 1)
+}
+
+// appendTimestamp appends a 33-bit PES timestamp behind the 4-bit prefix
+// in the high bits of prefix
+func appendTimestamp(b []byte, prefix byte, ts uint64) []byte {
+	return append(b,
+		prefix|byte(ts>>29)&0x0E|1,
+		byte(ts>>22), byte(ts>>14)|1,
+		byte(ts>>7), byte(ts<<1)|1)
+}
+
+// pcr encodes the program clock reference for stream time t: a 90kHz base
+// and a 27MHz extension
+func pcr(t time.Duration) []byte {
+	clock := uint64(int64(t) * 27 / 1000)
+	base := clock / 300 & (1<<33 - 1)
+	ext := clock % 300
+	return []byte{
+		byte(base >> 25), byte(base >> 17), byte(base >> 9), byte(base >> 1),
+		byte(base<<7) | 0x7E | byte(ext>>8), byte(ext),
+	}
+}
+
+// crcTable speeds up crc32
+var crcTable = func() (table [256]uint32) {
+	for i := range table {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04C11DB7
+			} else {
+				c <<= 1
+			}
+		}
+		table[i] = c
+	}
+	return table
+}()
+
+// crc32 is the MPEG-2 CRC of table sections: unreflected, with no final
+// inversion, unlike hash/crc32
+func crc32(b []byte) uint32 {
+	c := uint32(0xFFFFFFFF)
+	for _, v := range b {
+		c = c<<8 ^ crcTable[byte(c>>24)^v]
+	}
+	return c
+}
@@ -0,0 +1,196 @@
+package mpegts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// recorder keeps every write, as a UDP socket would send them
+type recorder struct {
+	writes [][]byte
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.writes = append(r.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// packets splits the recorded writes into packets
+func (r *recorder) packets(t *testing.T) [][]byte {
+	var packets [][]byte
+	for _, w := range r.writes {
+		if len(w)%PacketSize != 0 || len(w) > DatagramPackets*PacketSize {
+			t.Fatalf("write of %d bytes", len(w))
+		}
+		for ; len(w) > 0; w = w[PacketSize:] {
+			packets = append(packets, w[:PacketSize])
+		}
+	}
+	r.writes = nil
+	return packets
+}
+
+// packet is a parsed transport stream packet
+type packet struct {
+	pid        uint16
+	start      bool
+	cc         byte
+	adaptation []byte
+	payload    []byte
+}
+
+func parse(t *testing.T, b []byte) packet {
+	if b[0] != 0x47 {
+		t.Fatalf("sync byte %#x", b[0])
+	}
+	p := packet{
+		pid:   binary.BigEndian.Uint16(b[1:]) & 0x1FFF,
+		start: b[1]&0x40 != 0,
+		cc:    b[3] & 0x0F,
+	}
+	rest := b[4:]
+	if b[3]&0x20 != 0 {
+		n := int(rest[0])
+		p.adaptation, rest = rest[1:1+n], rest[1+n:]
+	}
+	if b[3]&0x10 != 0 {
+		p.payload = rest
+	} else if len(rest) > 0 {
+		t.Fatalf("PID %#x: %d bytes after an adaptation-only packet", p.pid, len(rest))
+	}
+	return p
+}
+
+func TestCRC32(t *testing.T) {
+	// The check value of CRC-32/MPEG-2
+	if got := crc32([]byte("123456789")); got != 0x0376E6E7 {
+		t.Fatalf("got %#08x, want 0x0376e6e7", got)
+	}
+	// A section followed by its CRC checks out to zero, as receivers verify
+	for _, s := range [][]byte{(&Muxer{}).pat(), (&Muxer{}).pmt(), (&Muxer{service: "Test"}).sdt()} {
+		if got := crc32(s); got != 0 {
+			t.Errorf("table %#x: CRC over the section is %#08x, want 0", s[0], got)
+		}
+	}
+}
+
+func TestSections(t *testing.T) {
+	pat := (&Muxer{}).pat()
+	if pat[0] != 0x00 {
+		t.Fatalf("PAT table ID %#x", pat[0])
+	}
+	if length := int(binary.BigEndian.Uint16(pat[1:]) & 0x0FFF); length != len(pat)-3 {
+		t.Errorf("PAT section length %d, want %d", length, len(pat)-3)
+	}
+	if program := binary.BigEndian.Uint16(pat[8:]); program != programNumber {
+		t.Errorf("PAT program %d", program)
+	}
+	if pid := binary.BigEndian.Uint16(pat[10:]) & 0x1FFF; pid != pmtPID {
+		t.Errorf("PAT points at PID %#x, want %#x", pid, pmtPID)
+	}
+
+	pmt := (&Muxer{}).pmt()
+	if pcrPID := binary.BigEndian.Uint16(pmt[8:]) & 0x1FFF; pcrPID != audioPID {
+		t.Errorf("PCR on PID %#x, want %#x", pcrPID, audioPID)
+	}
+	if pmt[12] != streamTypeMPEG1Audio || binary.BigEndian.Uint16(pmt[13:])&0x1FFF != audioPID {
+		t.Errorf("PMT stream % x", pmt[12:17])
+	}
+
+	sdt := (&Muxer{service: "Test"}).sdt()
+	if !bytes.Contains(sdt, []byte("\x08MiniCast\x04Test")) {
+		t.Errorf("SDT lacks the provider and service names: % x", sdt)
+	}
+}
+
+func TestWriteAudio(t *testing.T) {
+	var r recorder
+	m := NewMuxer(&r, "Test")
+	frames := bytes.Repeat([]byte{0xFF, 0xFB, 0x90, 0x64}, 600)
+	start := 2 * time.Second
+	if err := m.WriteAudio(start, frames); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := r.packets(t)
+	// The tables, then the PES packet
+	pids := []uint16{patPID, pmtPID, sdtPID}
+	for i, pid := range pids {
+		p := parse(t, packets[i])
+		if p.pid != pid || !p.start || p.payload[0] != 0 {
+			t.Fatalf("packet %d: PID %#x start %v, want table on PID %#x", i, p.pid, p.start, pid)
+		}
+	}
+
+	var pes []byte
+	cc := byte(0)
+	for i, b := range packets[3:] {
+		p := parse(t, b)
+		if p.pid != audioPID {
+			t.Fatalf("audio packet %d on PID %#x", i, p.pid)
+		}
+		if p.start != (i == 0) {
+			t.Errorf("audio packet %d: start %v", i, p.start)
+		}
+		if p.cc != cc {
+			t.Errorf("audio packet %d: continuity %d, want %d", i, p.cc, cc)
+		}
+		cc = (cc + 1) & 0x0F
+		if i == 0 {
+			if len(p.adaptation) != 7 || p.adaptation[0] != 0x50 {
+				t.Fatalf("first audio packet adaptation field % x", p.adaptation)
+			}
+			a := p.adaptation[1:]
+			base := uint64(a[0])<<25 | uint64(a[1])<<17 | uint64(a[2])<<9 | uint64(a[3])<<1 | uint64(a[4])>>7
+			if want := ticks90k(start); base != want {
+				t.Errorf("PCR base %d, want %d", base, want)
+			}
+		}
+		pes = append(pes, p.payload...)
+	}
+
+	if !bytes.Equal(pes[:4], []byte{0, 0, 1, audioStreamID}) {
+		t.Fatalf("PES start % x", pes[:4])
+	}
+	if length := int(binary.BigEndian.Uint16(pes[4:])); length != len(pes)-6 {
+		t.Errorf("PES length %d, want %d", length, len(pes)-6)
+	}
+	ts := pes[9:14]
+	pts := uint64(ts[0]>>1&0x07)<<30 | uint64(ts[1])<<22 | uint64(ts[2]>>1)<<15 | uint64(ts[3])<<7 | uint64(ts[4]>>1)
+	if want := ticks90k(start + presentationDelay); pts != want {
+		t.Errorf("PTS %d, want %d", pts, want)
+	}
+	if !bytes.Equal(pes[14:], frames) {
+		t.Error("PES payload differs from the frames")
+	}
+
+	// The tables repeat only once they are due
+	m.WriteAudio(start+tableInterval/2, frames[:100])
+	if p := parse(t, r.packets(t)[0]); p.pid != audioPID {
+		t.Errorf("tables repeated after %v", tableInterval/2)
+	}
+	m.WriteAudio(start+tableInterval, frames[:100])
+	packets = r.packets(t)
+	if p := parse(t, packets[0]); p.pid != patPID || p.cc != 1 {
+		t.Errorf("PID %#x continuity %d, want the PAT again with continuity 1", p.pid, p.cc)
+	}
+}
+
+func TestWriteAudioStuffing(t *testing.T) {
+	// Every payload length stuffs the last packet to exactly 188 bytes
+	for n := 1; n < 2*PacketSize; n++ {
+		var r recorder
+		if err := NewMuxer(&r, "Test").WriteAudio(0, make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+		var pes []byte
+		for _, b := range r.packets(t)[3:] {
+			pes = append(pes, parse(t, b).payload...)
+		}
+		if len(pes) != 14+n {
+			t.Fatalf("%d bytes of audio: PES of %d bytes, want %d", n, len(pes), 14+n)
+		}
+	}
+}
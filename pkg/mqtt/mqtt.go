@@ -0,0 +1,291 @@
+// Package mqtt is a minimal MQTT 3.1.1 client for publishing status to a
+// broker: it connects, optionally with a will and credentials, publishes
+// at QoS 0 and keeps the connection alive. It does not subscribe.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Packet types, in the high nibble of a packet's first byte
+const (
+	packetConnect    = 1
+	packetConnAck    = 2
+	packetPublish    = 3
+	packetPingReq    = 12
+	packetDisconnect = 14
+)
+
+// timeout bounds dialing, the handshake and each write
+const timeout = 5 * time.Second
+
+// connAckErrors are why a broker refuses a connection, by return code
+var connAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Message is a message published to a topic
+type Message struct {
+	Topic   string
+	Payload []byte
+	// Retain asks the broker to keep the message and hand it to clients
+	// that subscribe later
+	Retain bool
+}
+
+// Options are how a client connects
+type Options struct {
+	ClientID string
+	// KeepAlive is how often the client pings a quiet connection; the
+	// broker drops clients silent for half as long again
+	KeepAlive time.Duration
+	// Will, when set, is published by the broker if the client goes away
+	// without disconnecting
+	Will *Message
+}
+
+// Conn is a connection to an MQTT broker. Its methods may be called from
+// several goroutines.
+type Conn struct {
+	conn net.Conn
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	done chan struct{}
+	err  error
+}
+
+// Dial connects to the broker at u, an mqtt://[user:password@]host[:port]
+// URL or mqtts:// for TLS
+func Dial(ctx context.Context, u *url.URL, opts Options) (*Conn, error) {
+	var port string
+	switch u.Scheme {
+	case "mqtt":
+		port = "1883"
+	case "mqtts":
+		port = "8883"
+	default:
+		return nil, fmt.Errorf("unsupported MQTT scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %s", u.Redacted())
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = 30 * time.Second
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "mqtts" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: u.Hostname()}}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, w: bufio.NewWriter(conn), done: make(chan struct{})}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	r := bufio.NewReader(conn)
+	err = c.write(packetConnect<<4, connectPacket(u, opts))
+	if err == nil {
+		err = readConnAck(r)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.read(r, opts.KeepAlive)
+	go c.ping(opts.KeepAlive)
+	return c, nil
+}
+
+// connectPacket returns the body of a CONNECT packet
+func connectPacket(u *url.URL, opts Options) []byte {
+	var flags byte = 0x02 // clean session
+	body := appendString(nil, "MQTT")
+	var payload []byte
+	payload = appendString(payload, opts.ClientID)
+	if opts.Will != nil {
+		flags |= 0x04
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+		payload = appendString(payload, opts.Will.Topic)
+		payload = appendBytes(payload, opts.Will.Payload)
+	}
+	if u.User != nil {
+		flags |= 0x80
+		payload = appendString(payload, u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			flags |= 0x40
+			payload = appendString(payload, password)
+		}
+	}
+	keepAlive := min(int(opts.KeepAlive/time.Second), 0xFFFF)
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	return append(body, payload...)
+}
+
+// readConnAck reads the broker's answer to CONNECT
+func readConnAck(r *bufio.Reader) error {
+	typ, body, err := readPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ>>4 != packetConnAck || len(body) != 2 {
+		return errors.New("mqtt: not an MQTT broker")
+	}
+	if code := body[1]; code != 0 {
+		if reason, ok := connAckErrors[code]; ok {
+			return fmt.Errorf("mqtt: %s", reason)
+		}
+		return fmt.Errorf("mqtt: connection refused with code %d", code)
+	}
+	return nil
+}
+
+// Publish sends msg at QoS 0: the broker does not acknowledge it
+func (c *Conn) Publish(msg Message) error {
+	header := byte(packetPublish << 4)
+	if msg.Retain {
+		header |= 0x01
+	}
+	body := appendString(nil, msg.Topic)
+	return c.write(header, append(body, msg.Payload...))
+}
+
+// Done is closed once the connection has failed or been closed
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, once Done is closed
+func (c *Conn) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Close disconnects cleanly, so the broker does not publish the will
+func (c *Conn) Close() error {
+	c.write(packetDisconnect<<4, nil)
+	return c.conn.Close()
+}
+
+// write sends a packet
+func (c *Conn) write(header byte, body []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	c.w.WriteByte(header)
+	c.w.Write(appendLength(nil, len(body)))
+	c.w.Write(body)
+	return c.w.Flush()
+}
+
+// read consumes the broker's packets, ending the connection when the
+// broker has been silent too long or goes away
+func (c *Conn) read(r *bufio.Reader, keepAlive time.Duration) {
+	var err error
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(keepAlive + keepAlive/2))
+		if _, _, err = readPacket(r); err != nil {
+			break
+		}
+	}
+	c.err = err
+	c.conn.Close()
+	close(c.done)
+}
+
+// ping keeps the connection alive. The broker's answers are read by read.
+func (c *Conn) ping(keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.write(packetPingReq<<4, nil) != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// readPacket reads one packet, returning its first byte and its body
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, shift := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("mqtt: malformed packet length")
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// appendLength appends a packet's remaining length
+func appendLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		if n /= 128; n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// appendString appends a length-prefixed UTF-8 string
+func appendString(b []byte, s string) []byte {
+	return appendBytes(b, []byte(s))
+}
+
+// appendBytes appends length-prefixed binary data
+func appendBytes(b []byte, data []byte) []byte {
+	b = append(b, byte(len(data)>>8), byte(len(data)))
+	return append(b, data...)
+}
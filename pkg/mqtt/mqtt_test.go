@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectPacket(t *testing.T) {
+	u, _ := url.Parse("mqtt://user:pw@broker")
+	opts := Options{
+		ClientID:  "mc",
+		KeepAlive: 30 * time.Second,
+		Will:      &Message{Topic: "s", Payload: []byte("off"), Retain: true},
+	}
+	want := []byte{
+		0, 4, 'M', 'Q', 'T', 'T', // protocol name
+		4,     // protocol level 3.1.1
+		0xE6,  // user name, password, will retain, will flag, clean session
+		0, 30, // keep alive
+		0, 2, 'm', 'c',
+		0, 1, 's',
+		0, 3, 'o', 'f', 'f',
+		0, 4, 'u', 's', 'e', 'r',
+		0, 2, 'p', 'w',
+	}
+	if got := connectPacket(u, opts); !bytes.Equal(got, want) {
+		t.Errorf("got % x\nwant % x", got, want)
+	}
+
+	// A user alone, no will
+	u, _ = url.Parse("mqtt://token@broker")
+	got := connectPacket(u, Options{ClientID: "mc", KeepAlive: time.Minute})
+	if flags := got[7]; flags != 0x82 {
+		t.Errorf("flags %#x, want user name and clean session", flags)
+	}
+}
+
+func TestLength(t *testing.T) {
+	// The examples of the MQTT 3.1.1 specification, section 2.2.3
+	tests := []struct {
+		n    int
+		wire []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7F}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xFF, 0x7F}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xFF, 0xFF, 0x7F}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, tt := range tests {
+		if got := appendLength(nil, tt.n); !bytes.Equal(got, tt.wire) {
+			t.Errorf("%d: got % x, want % x", tt.n, got, tt.wire)
+		}
+		packet := append([]byte{0x30}, tt.wire...)
+		packet = append(packet, make([]byte, tt.n)...)
+		typ, body, err := readPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || typ != 0x30 || len(body) != tt.n {
+			t.Errorf("%d: read type %#x, %d bytes, %v", tt.n, typ, len(body), err)
+		}
+	}
+
+	if _, _, err := readPacket(bufio.NewReader(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}))); err == nil {
+		t.Error("read a five byte length")
+	}
+}
+
+func TestReadConnAck(t *testing.T) {
+	tests := []struct {
+		wire []byte
+		err  string
+	}{
+		{[]byte{0x20, 0x02, 0x00, 0x00}, ""},
+		// Session present makes no difference to a clean session
+		{[]byte{0x20, 0x02, 0x01, 0x00}, ""},
+		{[]byte{0x20, 0x02, 0x00, 0x04}, "bad user name or password"},
+		{[]byte{0x20, 0x02, 0x00, 0x05}, "not authorized"},
+		{[]byte{0x20, 0x02, 0x00, 0x09}, "code 9"},
+		{[]byte{0x90, 0x03, 0x00, 0x01, 0x00}, "not an MQTT broker"},
+	}
+	for _, tt := range tests {
+		err := readConnAck(bufio.NewReader(bytes.NewReader(tt.wire)))
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("% x: got %v, want %q", tt.wire, err, tt.err)
+		}
+	}
+}
+
+func TestDialPublish(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type packet struct {
+		typ  byte
+		body []byte
+	}
+	received := make(chan packet, 4)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			typ, body, err := readPacket(r)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- packet{typ, body}
+			if typ>>4 == packetConnect {
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+			}
+		}
+	}()
+
+	u, _ := url.Parse("mqtt://" + ln.Addr().String())
+	c, err := Dial(context.Background(), u, Options{ClientID: "mc", KeepAlive: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish(Message{Topic: "minicast/status", Payload: []byte(`{"live":true}`), Retain: true}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if p := <-received; p.typ != 0x10 {
+		t.Fatalf("first packet %#x, want CONNECT", p.typ)
+	}
+	p := <-received
+	want := append([]byte{0, 15}, "minicast/status{\"live\":true}"...)
+	if p.typ != 0x31 || !bytes.Equal(p.body, want) {
+		t.Errorf("got %#x % x, want a retained PUBLISH", p.typ, p.body)
+	}
+	if p := <-received; p.typ != 0xE0 || len(p.body) != 0 {
+		t.Errorf("got %#x, want DISCONNECT", p.typ)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package natpmp
+
+import (
+	"net"
+)
+
+// DefaultGateway guesses the default gateway: the first address of the
+// /24 the host's default route leaves from, where home routers sit. Give
+// the gateway explicitly where that guess is wrong.
+func DefaultGateway() (net.IP, error) {
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	return net.IPv4(ip[0], ip[1], ip[2], 1), nil
+}
@@ -0,0 +1,149 @@
+// Package natpmp is a minimal NAT-PMP client (RFC 6886), for asking a home
+// router to forward a port and for its address on the internet.
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// port is where gateways take requests
+	port = 5351
+
+	opExternalAddress = 0
+	opMapUDP          = 1
+	opMapTCP          = 2
+
+	// firstTimeout is how long the first attempt waits for an answer,
+	// doubling with each of the attempts
+	firstTimeout = 250 * time.Millisecond
+	attempts     = 5
+)
+
+// resultErrors are why a gateway refused a request, by result code
+var resultErrors = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// Client asks a gateway for port mappings
+type Client struct {
+	gateway net.IP
+}
+
+// New returns a client for the gateway at the address given, usually the
+// default gateway
+func New(gateway net.IP) *Client {
+	return &Client{gateway: gateway}
+}
+
+// Gateway returns the gateway's address
+func (c *Client) Gateway() net.IP {
+	return c.gateway
+}
+
+// ExternalAddress returns the gateway's address on the internet
+func (c *Client) ExternalAddress(ctx context.Context) (net.IP, error) {
+	resp, err := c.call(ctx, []byte{0, opExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(resp[8:12]), nil
+}
+
+// AddPortMapping forwards external to internal over protocol ("TCP" or
+// "UDP") for lifetime. The gateway may choose another external port or
+// lifetime, which are returned.
+func (c *Client) AddPortMapping(ctx context.Context, protocol string, internal, external int, lifetime time.Duration) (int, time.Duration, error) {
+	op, err := mapOp(protocol)
+	if err != nil {
+		return 0, 0, err
+	}
+	req := []byte{0, op, 0, 0}
+	req = binary.BigEndian.AppendUint16(req, uint16(internal))
+	req = binary.BigEndian.AppendUint16(req, uint16(external))
+	req = binary.BigEndian.AppendUint32(req, uint32(lifetime/time.Second))
+	resp, err := c.call(ctx, req, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	mapped := int(binary.BigEndian.Uint16(resp[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	return mapped, granted, nil
+}
+
+// DeletePortMapping stops forwarding to internal over protocol
+func (c *Client) DeletePortMapping(ctx context.Context, protocol string, internal int) error {
+	_, _, err := c.AddPortMapping(ctx, protocol, internal, 0, 0)
+	return err
+}
+
+// mapOp returns the opcode mapping protocol
+func mapOp(protocol string) (byte, error) {
+	switch protocol {
+	case "TCP":
+		return opMapTCP, nil
+	case "UDP":
+		return opMapUDP, nil
+	}
+	return 0, fmt.Errorf("natpmp: unknown protocol %q", protocol)
+}
+
+// call sends a request, resending it with a growing timeout until the
+// gateway answers with at least size bytes
+func (c *Client) call(ctx context.Context, req []byte, size int) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp4", net.JoinHostPort(c.gateway.String(), strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+	timeout := firstTimeout
+	for i := 0; i < attempts; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			// Answers to another request, or too short, are not ours
+			if n < size || buf[0] != 0 || buf[1] != 128+req[1] {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:]); code != 0 {
+				if reason, ok := resultErrors[code]; ok {
+					return nil, fmt.Errorf("natpmp: %s", reason)
+				}
+				return nil, fmt.Errorf("natpmp: request failed with result %d", code)
+			}
+			return buf[:n], nil
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("natpmp: no answer from %s", c.gateway)
+}
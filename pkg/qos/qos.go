@@ -0,0 +1,65 @@
+package qos
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// classes are the standard per-hop behaviour names (RFC 2474, 2597, 3246)
+var classes = map[string]int{
+	"default": 0,
+	"be":      0,
+	"ef":      46,
+}
+
+func init() {
+	for n := 0; n <= 7; n++ {
+		classes["cs"+strconv.Itoa(n)] = n * 8
+	}
+	for class := 1; class <= 4; class++ {
+		for drop := 1; drop <= 3; drop++ {
+			classes["af"+strconv.Itoa(class)+strconv.Itoa(drop)] = class*8 + drop*2
+		}
+	}
+}
+
+// ParseDSCP returns the DSCP for a class name (such as ef, af41 or cs1) or
+// a number from 0 to 63
+func ParseDSCP(value string) (int, error) {
+	if dscp, ok := classes[strings.ToLower(value)]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.Atoi(value)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q: use a class such as ef, af41 or cs1, or a number from 0 to 63", value)
+	}
+	return dscp, nil
+}
+
+// Set marks the packets conn sends with dscp
+func Set(conn net.Conn, dscp int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("cannot mark %T connections", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return Control(dscp)("", "", raw)
+}
+
+// Control returns a net.Dialer Control function that marks new sockets
+// with dscp
+func Control(dscp int) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) { err = setTOS(fd, dscp<<2) }); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
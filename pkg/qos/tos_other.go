@@ -0,0 +1,13 @@
+//go:build !unix
+
+package qos
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// setTOS is unsupported: Windows ignores IP_TOS unless a QoS policy is set
+func setTOS(fd uintptr, tos int) error {
+	return fmt.Errorf("DSCP marking is not supported on %s", runtime.GOOS)
+}
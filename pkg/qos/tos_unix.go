@@ -0,0 +1,16 @@
+//go:build unix
+
+package qos
+
+import "syscall"
+
+// setTOS sets the traffic class byte for both address families, since a
+// dual-stack socket may carry either. It fails only if neither applies.
+func setTOS(fd uintptr, tos int) error {
+	err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	retryDelay = 5 * time.Second
+	// stallTimeout is how long the upstream may send nothing, connecting
+	// included, before the relay drops it and reconnects
+	stallTimeout = 15 * time.Second
+)
+
+// errStalled ends a connection the upstream stopped sending on
+var errStalled = errors.New("upstream stalled")
+
+// Relay pulls an external HTTP/Icecast stream and feeds it into the Manager
+// as the audio source
+type Relay struct {
+	url     string
+	manager *ws.Manager
+	logger  *zap.SugaredLogger
+	client  *http.Client
+	stall   time.Duration
+}
+
+// New creates a relay for the given stream URL
+func New(url string, manager *ws.Manager, logger *zap.SugaredLogger) *Relay {
+	return &Relay{
+		url:     url,
+		manager: manager,
+		logger:  logger,
+		client:  &http.Client{},
+		stall:   stallTimeout,
+	}
+}
+
+// Run relays the stream until ctx is cancelled, reconnecting when the
+// upstream drops
+func (r *Relay) Run(ctx context.Context) {
+	for {
+		if err := r.relayOnce(ctx); err != nil {
+			r.logger.Errorf("Relay from %s failed: %v", r.url, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// relayOnce connects to the upstream and broadcasts it until it ends or
+// stalls
+func (r *Relay) relayOnce(ctx context.Context) (err error) {
+	// Neither the client nor the pacing has a deadline of its own, so a
+	// watchdog drops the connection once it has been quiet for too long
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	watchdog := time.AfterFunc(r.stall, func() { stop(errStalled) })
+	defer watchdog.Stop()
+	defer func() {
+		if context.Cause(ctx) == errStalled {
+			err = fmt.Errorf("nothing from the upstream in %s", r.stall)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body := &watchedReader{r: resp.Body, watchdog: watchdog, stall: r.stall}
+	decoded, err := audio.NewDecoder(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		return err
+	}
+
+	info := ws.ConnInfo{Transport: "relay", RemoteAddr: r.url, HTTPVersion: resp.Proto, ConnectedAt: time.Now()}
+	if resp.TLS != nil {
+		info.TLSVersion = tls.VersionName(resp.TLS.Version)
+		info.TLSCipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+	}
+	// The Manager may drop the source (e.g. for maintenance); that ends this
+	// connection but the relay keeps retrying
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	src := &session{cancel: cancel}
+	format := ws.SourceFormat{SampleRate: decoded.SampleRate, Channels: decoded.NumChannels, BitDepth: 16, Codec: ws.CodecPCM}
+	if err := r.manager.AttachSource(src, info, format); err != nil {
+		return err
+	}
+	defer r.manager.DetachSource(src)
+
+	pipeline, err := r.manager.NewPipeline(format)
+	if err != nil {
+		return err
+	}
+
+	r.logger.Infof("Relaying %s", r.url)
+
+	// Pacing smooths upstream bursts (e.g. Icecast burst-on-connect)
+	bytesPerSecond := decoded.SampleRate * decoded.NumChannels * 2
+	err = audio.Pace(ctx, decoded, bytesPerSecond, audio.FrameBytes, func(data []byte) {
+		if data, _ = pipeline.Process(data); data != nil {
+			r.manager.Broadcast(data)
+		}
+	})
+	if err == io.EOF {
+		return fmt.Errorf("upstream ended")
+	}
+	return err
+}
+
+// watchedReader reads the upstream, putting the watchdog back each time
+// something arrives
+type watchedReader struct {
+	r        io.Reader
+	watchdog *time.Timer
+	stall    time.Duration
+}
+
+// Read reads from the upstream
+func (w *watchedReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	if n > 0 {
+		w.watchdog.Reset(w.stall)
+	}
+	return n, err
+}
+
+// session is one upstream connection held as the Manager's source
+type session struct {
+	cancel context.CancelFunc
+}
+
+// Close ends the connection
+func (s *session) Close() error {
+	s.cancel()
+	return nil
+}
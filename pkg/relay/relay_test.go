@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+// newTestRelay returns a relay from url that gives up after stall
+func newTestRelay(url string, stall time.Duration) *Relay {
+	logger := zap.NewNop().Sugar()
+	r := New(url, ws.NewManager(audio.NewProcessor(44100, 2, 16), logger), logger)
+	r.stall = stall
+	return r
+}
+
+func TestRelayDropsStalledUpstream(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	headers := make(chan struct{}, 1)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/silent" {
+			// Never answers at all
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		// Sends a second of audio, then nothing
+		w.Header().Set("Content-Type", "audio/wav")
+		w.Write(audio.NewProcessor(44100, 2, 16).Header(1 << 30))
+		w.Write(make([]byte, 44100*4))
+		w.(http.Flusher).Flush()
+		headers <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer upstream.Close()
+
+	for _, path := range []string{"/silent", "/stream"} {
+		r := newTestRelay(upstream.URL+path, 200*time.Millisecond)
+		start := time.Now()
+		err := r.relayOnce(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "nothing from the upstream") {
+			t.Fatalf("%s: got %v, want a stall", path, err)
+		}
+		// The second of audio is paced out before the stall is noticed
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("%s: took %s to notice the stall", path, elapsed)
+		}
+	}
+	select {
+	case <-headers:
+	default:
+		t.Error("the stream was never connected")
+	}
+}
+
+func TestRelayKeepsSteadyUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/wav")
+		w.Write(audio.NewProcessor(44100, 2, 16).Header(1 << 30))
+		// 20ms of audio every 20ms, for half a second, slower than the
+		// watchdog's timeout in total but never quiet for long
+		for i := 0; i < 25; i++ {
+			w.Write(make([]byte, 44100*4/50))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	r := newTestRelay(upstream.URL, 200*time.Millisecond)
+	if err := r.relayOnce(context.Background()); err == nil || err.Error() != "upstream ended" {
+		t.Fatalf("got %v, want the upstream to end", err)
+	}
+}
@@ -0,0 +1,251 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maks112v/minicast/pkg/frame"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// upstreamPingInterval is how often the upstream is pinged
+	upstreamPingInterval = 5 * time.Second
+	// upstreamTimeout is how long the upstream may go unheard, pongs
+	// included, before the connection counts as hung
+	upstreamTimeout = 12 * time.Second
+
+	minUpstreamDelay = time.Second
+	maxUpstreamDelay = 30 * time.Second
+)
+
+// UpstreamHandler receives the broadcast of an upstream minicast server.
+// Its methods are called from one goroutine, between Connect and
+// Disconnect for each connection.
+type UpstreamHandler interface {
+	// Connect starts a connection whose audio is in format. An error
+	// ends the connection, which is retried.
+	Connect(info ws.ConnInfo, format ws.SourceFormat) error
+	// Format announces that the audio that follows is in a new format
+	Format(format ws.SourceFormat) error
+	// Metadata passes on a now-playing update
+	Metadata(md ws.Metadata)
+	// Frame passes on one frame of PCM. The first frame of a connection
+	// and frames after lost ones are marked FlagDiscontinuity.
+	Frame(pcm []byte, captured time.Time, flags frame.Flags)
+	// Disconnect ends a connection Connect accepted
+	Disconnect()
+}
+
+// Upstream listens to another minicast server over WebSocket, as framed
+// PCM so capture times and gaps carry through, and reconnects with a
+// backoff when the connection drops
+type Upstream struct {
+	url    string
+	dialer *websocket.Dialer
+	logger *zap.SugaredLogger
+
+	// conn is the current connection, for Drop
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+// upstreamMessage is a text frame from the upstream: a format or metadata
+type upstreamMessage struct {
+	Type string `json:"type"`
+	ws.SourceFormat
+	ws.Metadata
+}
+
+// NewUpstream returns an Upstream for addr, a ws:// or wss:// URL of a
+// server or its /ws endpoint. A ?profile= in it is kept; the default is
+// "stable", which drops the connection rather than audio if it falls behind.
+func NewUpstream(addr string, dialer *websocket.Dialer, logger *zap.SugaredLogger) (*Upstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported upstream scheme %q (use ws or wss)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %s", addr)
+	}
+	if !strings.HasSuffix(u.Path, "/ws") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	}
+	query := u.Query()
+	query.Set("format", "framed")
+	if query.Get("profile") == "" {
+		query.Set("profile", "stable")
+	}
+	u.RawQuery = query.Encode()
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	return &Upstream{url: u.String(), dialer: dialer, logger: logger}, nil
+}
+
+// URL returns the URL the upstream is listened to at
+func (u *Upstream) URL() string {
+	return u.url
+}
+
+// Drop ends the current connection, if any, which is retried after the
+// usual backoff
+func (u *Upstream) Drop() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil {
+		u.conn.Close()
+	}
+}
+
+// setConn records the current connection
+func (u *Upstream) setConn(conn *websocket.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.conn = conn
+}
+
+// Run passes the upstream's broadcast to h until ctx is done
+func (u *Upstream) Run(ctx context.Context, h UpstreamHandler) {
+	delay := minUpstreamDelay
+	for {
+		started := time.Now()
+		err := u.listen(ctx, h)
+		if ctx.Err() != nil {
+			return
+		}
+		u.logger.Warnf("Not connected to upstream %s, retrying in %s: %v", u.url, delay, err)
+
+		// A connection that lasted a while starts the backoff over
+		if time.Since(started) > maxUpstreamDelay {
+			delay = minUpstreamDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxUpstreamDelay)
+	}
+}
+
+// listen connects once and passes on the broadcast until the connection
+// fails, h refuses it or ctx is done
+func (u *Upstream) listen(ctx context.Context, h UpstreamHandler) error {
+	conn, resp, err := u.dialer.DialContext(ctx, u.url, nil)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			return fmt.Errorf("upstream is busy (retry after %ss)", resp.Header.Get("Retry-After"))
+		}
+		return err
+	}
+	defer conn.Close()
+	u.setConn(conn)
+	defer u.setConn(nil)
+
+	info := ws.ConnInfo{Transport: "upstream", RemoteAddr: u.url, HTTPVersion: resp.Proto, ConnectedAt: time.Now()}
+	if tlsConn, ok := conn.NetConn().(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		info.TLSVersion = tls.VersionName(state.Version)
+		info.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	}
+
+	// Pings keep a quiet upstream from looking hung, and a hung one from
+	// going unnoticed
+	conn.SetReadDeadline(time.Now().Add(upstreamTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(upstreamTimeout))
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(upstreamPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ctx.Done():
+				conn.Close()
+				return
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(upstreamTimeout))
+			}
+		}
+	}()
+
+	connected := false
+	defer func() {
+		if connected {
+			h.Disconnect()
+		}
+	}()
+	var next uint32
+	flags := frame.FlagDiscontinuity
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = fmt.Errorf("connection hung: nothing from the upstream in %s", upstreamTimeout)
+			}
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(upstreamTimeout))
+
+		if messageType == websocket.TextMessage {
+			var msg upstreamMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+			switch msg.Type {
+			case "format":
+				if err := msg.SourceFormat.Validate(); err != nil {
+					return fmt.Errorf("upstream sent an unusable format: %v", err)
+				}
+				if !connected {
+					if err := h.Connect(info, msg.SourceFormat); err != nil {
+						return err
+					}
+					connected = true
+					u.logger.Infof("Listening to upstream %s", u.url)
+				} else if err := h.Format(msg.SourceFormat); err != nil {
+					return err
+				}
+			case "metadata":
+				if connected {
+					h.Metadata(msg.Metadata)
+				}
+			}
+			continue
+		}
+
+		// Audio sent before the format cannot be interpreted
+		if !connected {
+			continue
+		}
+		header, pcm, err := frame.Decode(data)
+		if err != nil {
+			return errors.New("upstream is not sending framed audio")
+		}
+		if flags == 0 && header.Seq != next {
+			flags = frame.FlagDiscontinuity
+		}
+		next = header.Seq + 1
+		h.Frame(pcm, header.Captured, flags|header.Flags)
+		flags = 0
+	}
+}
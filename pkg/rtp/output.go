@@ -0,0 +1,302 @@
+package rtp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/qos"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+const (
+	// maxPayload keeps packets under a typical MTU
+	maxPayload = 1152
+
+	// pcmuPacketSamples is 20ms at 8kHz, the usual telephony packet size
+	pcmuPacketSamples = 160
+	pcmuRate          = 8000
+
+	// l16PayloadType is the dynamic payload type of L16 in formats without
+	// a static one, after RED's
+	l16PayloadType = 97
+)
+
+// Codec is an RTP payload format
+type Codec struct {
+	Name        string
+	PayloadType uint8
+	ClockRate   int
+	NumChannels int
+}
+
+var (
+	// L16 carries the stream losslessly as big-endian 16-bit PCM. RFC 3551
+	// gives 44.1kHz stereo PT 10; other formats get a dynamic payload type.
+	L16 = Codec{Name: "L16", PayloadType: 10, ClockRate: 44100, NumChannels: 2}
+	// PCMU is G.711 µ-law 8kHz mono, understood by PBXs and SIP paging gear
+	PCMU = Codec{Name: "PCMU", PayloadType: 0, ClockRate: pcmuRate, NumChannels: 1}
+)
+
+// LookupCodec returns the codec for a config name, "l16" or "pcmu"
+func LookupCodec(name string) (Codec, bool) {
+	switch name {
+	case "l16":
+		return L16, true
+	case "pcmu":
+		return PCMU, true
+	}
+	return Codec{}, false
+}
+
+// Output packetizes the broadcast as RTP and sends it to a unicast or
+// multicast UDP address. It implements the Manager's Listener interface, so
+// the network does the fanout instead of one connection per receiver.
+type Output struct {
+	// conn is not connected, so an ICMP port unreachable from a receiver
+	// that is not up yet does not fail the writes that follow
+	conn        *net.UDPConn
+	addr        *net.UDPAddr
+	numChannels int
+
+	// mu guards codec, which follows the broadcast's format, for SDP
+	mu    sync.Mutex
+	codec Codec
+	// version counts the formats, versioning the session description
+	version int
+	// pcm is false while the broadcast is not PCM, such as an Opus source
+	// in passthrough mode, when nothing is sent
+	pcm bool
+
+	ssrc      uint32
+	seq       uint16
+	timestamp uint32
+	marker    bool
+
+	resampler *audio.LinearResampler
+	pending   []int16
+
+	redundancy Redundancy
+	distance   int
+	history    []sentPacket
+}
+
+// NewOutput creates an RTP sender to addr. The source audio is interleaved
+// 16-bit PCM at sampleRate with numChannels channels, until SendFormat
+// says otherwise.
+func NewOutput(addr string, codec Codec, sampleRate, numChannels int) (*Output, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids [8]byte
+	rand.Read(ids[:])
+
+	o := &Output{
+		conn:   conn,
+		addr:   udpAddr,
+		codec:  codec,
+		ssrc:   binary.BigEndian.Uint32(ids[0:4]),
+		seq:    binary.BigEndian.Uint16(ids[4:6]),
+		marker: true,
+	}
+	o.setFormat(sampleRate, numChannels)
+	return o, nil
+}
+
+// l16Codec returns L16 in a format, with its static payload type where
+// RFC 3551 has one
+func l16Codec(sampleRate, numChannels int) Codec {
+	codec := Codec{Name: L16.Name, PayloadType: l16PayloadType, ClockRate: sampleRate, NumChannels: numChannels}
+	if sampleRate == 44100 && numChannels <= 2 {
+		// PT 10 is stereo, 11 mono
+		codec.PayloadType = uint8(12 - numChannels)
+	}
+	return codec
+}
+
+// setFormat takes audio at sampleRate with numChannels channels from now on
+func (o *Output) setFormat(sampleRate, numChannels int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.numChannels, o.pcm = numChannels, true
+	o.version++
+	o.pending, o.history = nil, nil
+	if o.codec == PCMU {
+		o.resampler = audio.NewLinearResampler(1, sampleRate, pcmuRate)
+		return
+	}
+	o.codec = l16Codec(sampleRate, numChannels)
+}
+
+// Send packetizes one broadcast frame
+func (o *Output) Send(data []byte) error {
+	if !o.pcm {
+		return nil
+	}
+	pcm := audio.BytesToPCM(data)
+
+	if o.codec == PCMU {
+		return o.sendPCMU(pcm)
+	}
+	return o.sendL16(pcm)
+}
+
+// SendFormat follows a change of the broadcast's format. L16 is sent in
+// the new format, so receivers need the session description again.
+func (o *Output) SendFormat(format ws.SourceFormat) error {
+	if format.Codec != ws.CodecPCM {
+		o.pcm = false
+		return nil
+	}
+	o.setFormat(format.SampleRate, format.Channels)
+	if o.redundancy == RedundancyRED && o.packetFrames()*o.distance > redMaxOffset {
+		return fmt.Errorf("redundancy distance %d is too far back for RED at %d channels", o.distance, format.Channels)
+	}
+	o.marker = true
+	return nil
+}
+
+// SetDSCP marks the RTP packets with dscp
+func (o *Output) SetDSCP(dscp int) error {
+	return qos.Set(o.conn, dscp)
+}
+
+// Close closes the UDP socket
+func (o *Output) Close() error {
+	return o.conn.Close()
+}
+
+// l16PacketSamples returns how many samples each L16 packet carries: as
+// many as fit the MTU, or with RED, as many as fit it twice over in blocks
+// short enough for RED's headers
+func (o *Output) l16PacketSamples() int {
+	bytes := maxPayload
+	if o.redundancy == RedundancyRED {
+		bytes = min((maxPayload-5)/2, redMaxBlock)
+	}
+	return bytes / 2 / o.numChannels * o.numChannels
+}
+
+// sendL16 sends PCM in network byte order, split to fit the MTU
+func (o *Output) sendL16(pcm []int16) error {
+	samplesPerPacket := o.l16PacketSamples()
+
+	for start := 0; start < len(pcm); start += samplesPerPacket {
+		end := min(start+samplesPerPacket, len(pcm))
+
+		payload := make([]byte, (end-start)*2)
+		for i, sample := range pcm[start:end] {
+			binary.BigEndian.PutUint16(payload[i*2:], uint16(sample))
+		}
+		if err := o.write(payload, uint32((end-start)/o.numChannels)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendPCMU downmixes, resamples to 8kHz and sends 20ms µ-law packets
+func (o *Output) sendPCMU(pcm []int16) error {
+	mono := audio.DownmixMono(pcm, o.numChannels)
+	o.pending = append(o.pending, o.resampler.Process(mono)...)
+
+	for len(o.pending) >= pcmuPacketSamples {
+		payload := make([]byte, pcmuPacketSamples)
+		for i, sample := range o.pending[:pcmuPacketSamples] {
+			payload[i] = audio.MuLaw(sample)
+		}
+		o.pending = o.pending[pcmuPacketSamples:]
+
+		if err := o.write(payload, pcmuPacketSamples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write sends one RTP packet, with any redundancy, and advances the
+// sequence number and timestamp
+func (o *Output) write(payload []byte, frames uint32) error {
+	earlier, repeat := o.earlier()
+
+	payloadType, body := o.codec.PayloadType, payload
+	if o.redundancy == RedundancyRED {
+		payloadType, body = redPayloadType, o.redPayload(payload, o.timestamp, earlier, repeat)
+	}
+
+	packet := make([]byte, 12+len(body))
+	packet[0] = 2 << 6 // version 2, no padding, extension or CSRCs
+	packet[1] = payloadType
+	if o.marker {
+		packet[1] |= 0x80
+		o.marker = false
+	}
+	binary.BigEndian.PutUint16(packet[2:], o.seq)
+	binary.BigEndian.PutUint32(packet[4:], o.timestamp)
+	binary.BigEndian.PutUint32(packet[8:], o.ssrc)
+	copy(packet[12:], body)
+
+	o.remember(sentPacket{packet: packet, payload: payload, timestamp: o.timestamp})
+	o.seq++
+	o.timestamp += frames
+
+	if _, err := o.conn.WriteToUDP(packet, o.addr); err != nil {
+		return err
+	}
+	if o.redundancy == RedundancyRepeat && repeat {
+		_, err := o.conn.WriteToUDP(earlier.packet, o.addr)
+		return err
+	}
+	return nil
+}
+
+// SDP describes the session so receivers such as ffmpeg or VLC can play it
+func (o *Output) SDP() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	addr := o.addr
+	connection := addr.IP.String()
+	if addr.IP.IsMulticast() {
+		connection += "/1"
+	}
+
+	rtpmap := fmt.Sprintf("%s/%d", o.codec.Name, o.codec.ClockRate)
+	if o.codec.NumChannels > 1 {
+		rtpmap += fmt.Sprintf("/%d", o.codec.NumChannels)
+	}
+
+	session := fmt.Sprintf("v=0\r\n"+
+		"o=- %d %d IN IP4 %s\r\n"+
+		"s=minicast\r\n"+
+		"c=IN IP4 %s\r\n"+
+		"t=0 0\r\n",
+		o.ssrc, o.version, addr.IP, connection)
+
+	if o.redundancy == RedundancyRED {
+		redmap := "red/" + strings.TrimPrefix(rtpmap, o.codec.Name+"/")
+		return session + fmt.Sprintf("m=audio %d RTP/AVP %d %d\r\n"+
+			"a=rtpmap:%d %s\r\n"+
+			"a=fmtp:%d %d/%d\r\n"+
+			"a=rtpmap:%d %s\r\n",
+			addr.Port, redPayloadType, o.codec.PayloadType,
+			redPayloadType, redmap,
+			redPayloadType, o.codec.PayloadType, o.codec.PayloadType,
+			o.codec.PayloadType, rtpmap)
+	}
+	return session + fmt.Sprintf("m=audio %d RTP/AVP %d\r\n"+
+		"a=rtpmap:%d %s\r\n",
+		addr.Port, o.codec.PayloadType, o.codec.PayloadType, rtpmap)
+}
@@ -0,0 +1,116 @@
+package rtp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// frame returns a broadcast frame of silence
+func frame(samples int) []byte {
+	return make([]byte, samples*2)
+}
+
+func TestOutputSurvivesClosedPort(t *testing.T) {
+	// Find a port nothing listens on
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.LocalAddr().String()
+	probe.Close()
+
+	o, err := NewOutput(addr, L16, 44100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	// A connected socket fails the write after the ICMP port unreachable
+	for i := 0; i < 5; i++ {
+		if err := o.Send(frame(1024)); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOutputFollowsFormat(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	o, err := NewOutput(receiver.LocalAddr().String(), L16, 44100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	tests := []struct {
+		format      ws.SourceFormat
+		payloadType byte
+		rtpmap      string
+	}{
+		{ws.SourceFormat{SampleRate: 44100, Channels: 2, BitDepth: 16, Codec: ws.CodecPCM}, 10, "a=rtpmap:10 L16/44100/2\r\n"},
+		{ws.SourceFormat{SampleRate: 44100, Channels: 1, BitDepth: 16, Codec: ws.CodecPCM}, 11, "a=rtpmap:11 L16/44100\r\n"},
+		{ws.SourceFormat{SampleRate: 48000, Channels: 1, BitDepth: 16, Codec: ws.CodecPCM}, 97, "a=rtpmap:97 L16/48000\r\n"},
+		{ws.SourceFormat{SampleRate: 48000, Channels: 2, BitDepth: 16, Codec: ws.CodecPCM}, 97, "a=rtpmap:97 L16/48000/2\r\n"},
+	}
+	for _, tt := range tests {
+		if err := o.SendFormat(tt.format); err != nil {
+			t.Fatal(err)
+		}
+		if sdp := o.SDP(); !strings.Contains(sdp, tt.rtpmap) {
+			t.Errorf("%dHz %d channels: SDP lacks %q:\n%s", tt.format.SampleRate, tt.format.Channels, tt.rtpmap, sdp)
+		}
+		if err := o.Send(frame(64)); err != nil {
+			t.Fatal(err)
+		}
+		receiver.SetReadDeadline(time.Now().Add(time.Second))
+		packet := make([]byte, 2048)
+		n, err := receiver.Read(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pt := packet[1] & 0x7F; pt != tt.payloadType {
+			t.Errorf("%dHz %d channels: payload type %d, want %d", tt.format.SampleRate, tt.format.Channels, pt, tt.payloadType)
+		}
+		// A new format starts a talkspurt
+		if packet[1]&0x80 == 0 {
+			t.Errorf("%dHz %d channels: marker not set", tt.format.SampleRate, tt.format.Channels)
+		}
+		if n != 12+64*2 {
+			t.Errorf("%dHz %d channels: packet of %d bytes, want %d", tt.format.SampleRate, tt.format.Channels, n, 12+64*2)
+		}
+	}
+}
+
+func TestOutputSkipsEncodedAudio(t *testing.T) {
+	receiver, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	o, err := NewOutput(receiver.LocalAddr().String(), L16, 44100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	if err := o.SendFormat(ws.SourceFormat{SampleRate: 48000, Channels: 2, Codec: ws.CodecOpus}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Send([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	receiver.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := receiver.Read(make([]byte, 2048)); err == nil {
+		t.Fatal("sent Opus as L16")
+	}
+}
@@ -0,0 +1,117 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// redPayloadType is the dynamic payload type RED packets are sent with
+	redPayloadType = 96
+
+	// redMaxBlock is the longest block an RFC 2198 header can describe
+	redMaxBlock = 1023
+	// redMaxOffset is the furthest back, in timestamp units, a redundant
+	// block can be
+	redMaxOffset = 1<<14 - 1
+)
+
+// Redundancy is how an Output repeats audio so receivers on lossy networks,
+// such as bad Wi-Fi, can fill in lost packets
+type Redundancy int
+
+const (
+	// RedundancyOff sends every packet once
+	RedundancyOff Redundancy = iota
+	// RedundancyRED carries an earlier packet's audio inside each packet,
+	// as RFC 2198 redundant audio, for receivers that understand it
+	RedundancyRED
+	// RedundancyRepeat sends every packet a second time later on. Receivers
+	// drop the copy when the original arrived, so any receiver benefits.
+	RedundancyRepeat
+)
+
+// ParseRedundancy returns the redundancy for a config name: "off", "red"
+// or "repeat"
+func ParseRedundancy(name string) (Redundancy, bool) {
+	switch name {
+	case "", "off":
+		return RedundancyOff, true
+	case "red":
+		return RedundancyRED, true
+	case "repeat":
+		return RedundancyRepeat, true
+	}
+	return RedundancyOff, false
+}
+
+// sentPacket is a packet kept for repeating later
+type sentPacket struct {
+	packet    []byte
+	payload   []byte
+	timestamp uint32
+}
+
+// SetRedundancy makes every packet also carry (RED) or be followed by
+// (repeat) the packet sent distance packets earlier. The further back, the
+// longer the burst of losses receivers can recover from, at the cost of
+// that much more latency for the recovered audio. It must be set before
+// sending, and changes the SDP.
+func (o *Output) SetRedundancy(redundancy Redundancy, distance int) error {
+	if redundancy != RedundancyOff && distance < 1 {
+		return fmt.Errorf("redundancy distance must be at least 1")
+	}
+	if redundancy == RedundancyRED {
+		// The redundant block's header holds how far back it is
+		if o.packetFrames()*distance > redMaxOffset {
+			return fmt.Errorf("redundancy distance %d is too far back for RED", distance)
+		}
+	}
+	o.redundancy = redundancy
+	o.distance = distance
+	return nil
+}
+
+// packetFrames returns how many frames of audio each packet carries
+func (o *Output) packetFrames() int {
+	if o.codec == PCMU {
+		return pcmuPacketSamples
+	}
+	return o.l16PacketSamples() / o.numChannels
+}
+
+// earlier returns the packet sent distance packets ago, if any
+func (o *Output) earlier() (sentPacket, bool) {
+	if o.redundancy == RedundancyOff || len(o.history) < o.distance {
+		return sentPacket{}, false
+	}
+	return o.history[0], true
+}
+
+// remember keeps a sent packet for redundancy
+func (o *Output) remember(sent sentPacket) {
+	if o.redundancy == RedundancyOff {
+		return
+	}
+	o.history = append(o.history, sent)
+	if len(o.history) > o.distance {
+		o.history = o.history[1:]
+	}
+}
+
+// redPayload wraps payload, sent at timestamp, in an RFC 2198 payload
+// carrying the earlier packet's audio as a redundant block
+func (o *Output) redPayload(payload []byte, timestamp uint32, earlier sentPacket, ok bool) []byte {
+	if !ok {
+		return append([]byte{o.codec.PayloadType}, payload...)
+	}
+
+	body := make([]byte, 0, 5+len(earlier.payload)+len(payload))
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:],
+		1<<31|uint32(o.codec.PayloadType)<<24|(timestamp-earlier.timestamp)<<10|uint32(len(earlier.payload)))
+	body = append(body, header[:]...)
+	body = append(body, o.codec.PayloadType)
+	body = append(body, earlier.payload...)
+	return append(body, payload...)
+}
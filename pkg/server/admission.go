@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// admissionMaxWait is the longest a listener is held waiting for its
+	// turn before it is turned away instead
+	admissionMaxWait = 5 * time.Second
+	// closeTryAgainLater is the WebSocket close code asking a client to
+	// reconnect later (RFC 6455 registry)
+	closeTryAgainLater = 1013
+)
+
+// admission limits how fast listeners may connect, so that hundreds of
+// players reconnecting at once after a restart are let in a few at a time
+// instead of all together. It is a token bucket: bursts up to its size are
+// let straight in, and then rate per second. Listeners arriving while it
+// is empty are held until their turn if that comes soon enough, which
+// staggers them, or told to come back later with a jittered Retry-After so
+// they do not all return at the same moment.
+type admission struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	admitted, delayed, rejected uint64
+}
+
+// newAdmission creates a full bucket, or nil when rate is 0 to let
+// everyone in
+func newAdmission(rate float64, burst int) *admission {
+	if rate <= 0 {
+		return nil
+	}
+	burst = max(burst, 1)
+	return &admission{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a turn, returning how long to wait before it comes. When
+// that would be longer than admissionMaxWait no turn is taken, ok is false
+// and retry is when to come back.
+func (a *admission) reserve(now time.Time) (wait time.Duration, retry time.Duration, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.tokens = math.Min(a.tokens+now.Sub(a.last).Seconds()*a.rate, a.burst)
+	a.last = now
+
+	// A negative balance is turns promised to listeners being held
+	wait = time.Duration((1 - a.tokens) / a.rate * float64(time.Second))
+	if wait > admissionMaxWait {
+		a.rejected++
+		// Spread returns over as long again as the backlog takes to clear
+		retry = wait + time.Duration(rand.Int63n(int64(wait)))
+		return 0, retry, false
+	}
+	a.tokens--
+	if wait > 0 {
+		a.delayed++
+		return wait, 0, true
+	}
+	a.admitted++
+	return 0, 0, true
+}
+
+// admit decides whether a listener's request may go ahead, holding it
+// until its turn. Turned away, it gets a 429 with Retry-After, except for
+// WebSockets from browsers, which cannot read a refused handshake's
+// response: those are upgraded and closed with "try again later", giving
+// the delay in the reason.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request) bool {
+	if s.admission == nil {
+		return true
+	}
+
+	wait, retry, ok := s.admission.reserve(time.Now())
+	if ok {
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return false
+			}
+		}
+		return true
+	}
+
+	seconds := int(math.Ceil(retry.Seconds()))
+	s.logger.Debugw("Listener turned away", "retry_after", seconds, "remote", r.RemoteAddr)
+	if websocket.IsWebSocketUpgrade(r) && r.Header.Get("Origin") != "" {
+		conn, err := s.wsManager.GetUpgrader().Upgrade(w, r, nil)
+		if err != nil {
+			return false
+		}
+		reason := fmt.Sprintf("Server busy, retry after %d", seconds)
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeTryAgainLater, reason), time.Now().Add(time.Second))
+		conn.Close()
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many listeners connecting, try again later", http.StatusTooManyRequests)
+	return false
+}
+
+// writeAdmissionMetrics writes how many listeners were let in straight
+// away, held for their turn and turned away
+func (s *Server) writeAdmissionMetrics(w io.Writer) {
+	a := s.admission
+	a.mu.Lock()
+	admitted, delayed, rejected := a.admitted, a.delayed, a.rejected
+	a.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP minicast_admission_total Listener connections by admission result.\n"+
+		"# TYPE minicast_admission_total counter\n"+
+		"minicast_admission_total{result=\"admitted\"} %d\n"+
+		"minicast_admission_total{result=\"delayed\"} %d\n"+
+		"minicast_admission_total{result=\"rejected\"} %d\n", admitted, delayed, rejected)
+}
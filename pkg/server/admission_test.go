@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestAdmissionReserve(t *testing.T) {
+	a := newAdmission(2, 3)
+	now := a.last
+
+	// The burst is let straight in
+	for i := 0; i < 3; i++ {
+		if wait, _, ok := a.reserve(now); !ok || wait != 0 {
+			t.Fatalf("listener %d: wait %v ok %v, want straight in", i, wait, ok)
+		}
+	}
+	// Then each waits half a second longer than the last, up to the limit
+	for i := 1; i <= 10; i++ {
+		wait, _, ok := a.reserve(now)
+		if want := time.Duration(i) * 500 * time.Millisecond; !ok || wait != want {
+			t.Fatalf("held listener %d: wait %v ok %v, want %v", i, wait, ok, want)
+		}
+	}
+	_, retry, ok := a.reserve(now)
+	if ok || retry < admissionMaxWait {
+		t.Fatalf("retry %v ok %v, want turned away for at least %v", retry, ok, admissionMaxWait)
+	}
+
+	// The bucket refills with time
+	if wait, _, ok := a.reserve(now.Add(10 * time.Second)); !ok || wait != 0 {
+		t.Fatalf("after refilling: wait %v ok %v, want straight in", wait, ok)
+	}
+	if a.admitted != 4 || a.delayed != 10 || a.rejected != 1 {
+		t.Errorf("counted %d admitted, %d delayed, %d rejected", a.admitted, a.delayed, a.rejected)
+	}
+}
+
+func TestAdmitTurnsAway(t *testing.T) {
+	s := &Server{admission: newAdmission(0.1, 1), logger: zap.NewNop().Sugar()}
+
+	w := httptest.NewRecorder()
+	if !s.admit(w, httptest.NewRequest(http.MethodGet, "/stream", nil)) {
+		t.Fatal("first listener turned away")
+	}
+	// The next turn is ten seconds off, beyond what a listener is held for
+	w = httptest.NewRecorder()
+	if s.admit(w, httptest.NewRequest(http.MethodGet, "/stream", nil)) {
+		t.Fatal("second listener let in")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", w.Code)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 10 || retry > 20 {
+		t.Errorf("Retry-After %q, want 10 to 20 seconds", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestAdmissionDisabled(t *testing.T) {
+	if a := newAdmission(0, 10); a != nil {
+		t.Fatal("rate 0 should let everyone in")
+	}
+	s := &Server{logger: zap.NewNop().Sugar()}
+	if !s.admit(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stream", nil)) {
+		t.Fatal("turned away with admission disabled")
+	}
+}
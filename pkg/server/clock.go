@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/maks112v/minicast/pkg/clock"
+)
+
+// startClock disciplines the media clock from the configured reference, so
+// frame and DVR timestamps stay accurate over long uptimes
+func (s *Server) startClock() error {
+	c, err := clock.New(s.config.ClockSource, s.config.ClockPoll, s.logger.With("module", "clock"))
+	if err != nil {
+		return fmt.Errorf("invalid clock source: %v", err)
+	}
+	s.clock = c
+	s.wsManager.SetClock(c)
+	s.metrics.collect(s.writeClockMetrics)
+	go c.Run(context.Background())
+	s.logger.Infof("Disciplining the media clock from %s", s.config.ClockSource)
+	return nil
+}
+
+// writeClockMetrics writes how far the media clock is from the system
+// clock, and how fast the system clock drifts
+func (s *Server) writeClockMetrics(w io.Writer) {
+	stats := s.clock.Stats()
+	synced := 0
+	if stats.Synced {
+		synced = 1
+	}
+	fmt.Fprintf(w, "# HELP minicast_clock_synced Whether the media clock has been measured against its reference.\n"+
+		"# TYPE minicast_clock_synced gauge\nminicast_clock_synced %d\n", synced)
+	fmt.Fprintf(w, "# HELP minicast_clock_offset_seconds Correction applied to the system clock.\n"+
+		"# TYPE minicast_clock_offset_seconds gauge\nminicast_clock_offset_seconds %g\n", stats.OffsetMs/1000)
+	fmt.Fprintf(w, "# HELP minicast_clock_drift_ppm How fast the system clock drifts from the reference.\n"+
+		"# TYPE minicast_clock_drift_ppm gauge\nminicast_clock_drift_ppm %g\n", stats.DriftPPM)
+	fmt.Fprintf(w, "# HELP minicast_clock_steps_total Corrections too large to slew.\n"+
+		"# TYPE minicast_clock_steps_total counter\nminicast_clock_steps_total %d\n", stats.Steps)
+	fmt.Fprintf(w, "# HELP minicast_clock_errors_total Failed measurements of the reference.\n"+
+		"# TYPE minicast_clock_errors_total counter\nminicast_clock_errors_total %d\n", stats.Errors)
+}
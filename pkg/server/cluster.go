@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/fanout"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+const (
+	// clusterHeartbeat is how often instances report their state
+	clusterHeartbeat = 2 * time.Second
+	// clusterExpiry is how long an instance may go unheard before it is
+	// taken to be gone
+	clusterExpiry = 3 * clusterHeartbeat
+)
+
+// ClusterState is the cluster of instances sharing a fanout bus, as one
+// of them sees it
+type ClusterState struct {
+	// Instance is the instance answering
+	Instance string `json:"instance"`
+	// Listeners is the audience across the cluster
+	Listeners int `json:"listeners"`
+	// SourceInstance is the instance the source is connected to, if any
+	SourceInstance string            `json:"source_instance,omitempty"`
+	Instances      []ClusterInstance `json:"instances"`
+}
+
+// ClusterInstance is one instance of a cluster
+type ClusterInstance struct {
+	Name string `json:"name"`
+	fanout.State
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// cluster tracks the other instances on the fanout bus from their
+// heartbeats, so figures can cover the whole cluster and only one
+// instance at a time takes a source
+type cluster struct {
+	f        *fanoutFollower
+	audience func(ws.Stats) int
+	started  time.Time
+
+	mu    sync.Mutex
+	peers map[string]ClusterInstance
+}
+
+// newCluster returns the cluster of f's instance, which counts its own
+// audience with audience
+func newCluster(f *fanoutFollower, audience func(ws.Stats) int) *cluster {
+	return &cluster{f: f, audience: audience, started: time.Now(), peers: make(map[string]ClusterInstance)}
+}
+
+// state returns what this instance reports about itself
+func (c *cluster) state() fanout.State {
+	stats := c.f.manager.Stats()
+	state := fanout.State{Listeners: c.audience(stats), Started: c.started}
+	if stats.Source != nil && stats.Source.Transport != "fanout" {
+		state.Source = stats.Source
+	}
+	return state
+}
+
+// heartbeat reports this instance's state until the server exits
+func (c *cluster) heartbeat() {
+	ticker := time.NewTicker(clusterHeartbeat)
+	defer ticker.Stop()
+	for {
+		c.publish()
+		<-ticker.C
+	}
+}
+
+// publish reports this instance's state now
+func (c *cluster) publish() {
+	msg, err := fanout.Message{Instance: c.f.instance, Kind: fanout.KindState, State: c.state()}.Encode()
+	if err == nil {
+		c.f.bus.Publish(msg)
+	}
+}
+
+// update takes another instance's report. If both have a source, the
+// source that connected later is dropped, so sources that connected to
+// two instances at once do not both stay on air.
+func (c *cluster) update(name string, state fanout.State) {
+	c.mu.Lock()
+	c.peers[name] = ClusterInstance{Name: name, State: state, LastSeen: time.Now()}
+	c.mu.Unlock()
+
+	if state.Source == nil {
+		return
+	}
+	local := c.state().Source
+	if local == nil {
+		return
+	}
+	theirs, ours := state.Source.ConnectedAt, local.ConnectedAt
+	if theirs.Before(ours) || (theirs.Equal(ours) && name < c.f.instance) {
+		c.f.logger.Warnf("Dropping the source: %s has had one since %s", name, theirs.Format(time.RFC3339))
+		c.f.manager.DropSource()
+	}
+}
+
+// live returns the other instances heard from recently, forgetting the
+// rest
+func (c *cluster) live() []ClusterInstance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	peers := make([]ClusterInstance, 0, len(c.peers))
+	for name, peer := range c.peers {
+		if time.Since(peer.LastSeen) > clusterExpiry {
+			delete(c.peers, name)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// gate refuses sources while another instance has one. Frames followed
+// from that instance are let through.
+func (c *cluster) gate(info ws.ConnInfo) error {
+	if info.Transport == "fanout" {
+		return nil
+	}
+	for _, peer := range c.live() {
+		if peer.Source != nil {
+			return fmt.Errorf("%w on %s", ws.ErrSourceConnected, peer.Name)
+		}
+	}
+	return nil
+}
+
+// snapshot returns the cluster, this instance included
+func (c *cluster) snapshot() ClusterState {
+	self := ClusterInstance{Name: c.f.instance, State: c.state(), LastSeen: time.Now()}
+	instances := append(c.live(), self)
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+
+	state := ClusterState{Instance: c.f.instance, Instances: instances}
+	for _, instance := range instances {
+		state.Listeners += instance.Listeners
+		if instance.Source != nil && state.SourceInstance == "" {
+			state.SourceInstance = instance.Name
+		}
+	}
+	return state
+}
+
+// handleCluster returns the instances sharing the broadcast and the
+// figures across them
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cluster == nil {
+		http.Error(w, "not clustered; start the server with -fanout", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.cluster.snapshot()); err != nil {
+		s.logger.Errorf("Failed to encode cluster state: %v", err)
+	}
+}
+
+// writeClusterMetrics writes the cluster's size and audience
+func (s *Server) writeClusterMetrics(w io.Writer) {
+	state := s.cluster.snapshot()
+	fmt.Fprintf(w, "# HELP minicast_cluster_instances Instances sharing the broadcast.\n"+
+		"# TYPE minicast_cluster_instances gauge\nminicast_cluster_instances %d\n", len(state.Instances))
+	fmt.Fprintf(w, "# HELP minicast_cluster_listeners Listeners across the cluster.\n"+
+		"# TYPE minicast_cluster_listeners gauge\nminicast_cluster_listeners %d\n", state.Listeners)
+	fmt.Fprintf(w, "# HELP minicast_cluster_instance_listeners Listeners by instance.\n"+
+		"# TYPE minicast_cluster_instance_listeners gauge\n")
+	for _, instance := range state.Instances {
+		fmt.Fprintf(w, "minicast_cluster_instance_listeners{instance=%q} %d\n", instance.Name, instance.Listeners)
+	}
+}
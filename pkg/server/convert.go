@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+const (
+	// maxConvertUpload is the largest file the convert API accepts
+	maxConvertUpload = 64 << 20
+	// maxConvertOutput caps the converted audio, which upsampling and
+	// upmixing can make several times larger than the upload
+	maxConvertOutput = 256 << 20
+	// convertChunk is how many bytes of decoded PCM are processed at a time
+	convertChunk = 64 << 10
+)
+
+// convertOptions are the output format the convert API was asked for
+type convertOptions struct {
+	sampleRate  int
+	numChannels int
+	codec       string
+	quality     string
+}
+
+// parseConvertOptions reads ?rate=, ?channels=, ?codec= and ?quality=,
+// keeping the input's rate and channels when they are not given
+func parseConvertOptions(r *http.Request, decoded *audio.Decoded) (convertOptions, error) {
+	query := r.URL.Query()
+	opts := convertOptions{
+		sampleRate:  decoded.SampleRate,
+		numChannels: decoded.NumChannels,
+		codec:       "wav",
+		quality:     audio.ResampleSinc,
+	}
+
+	if v := query.Get("rate"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate < 8000 || rate > 192000 {
+			return opts, fmt.Errorf("rate must be between 8000 and 192000")
+		}
+		opts.sampleRate = rate
+	}
+	if v := query.Get("channels"); v != "" {
+		channels, err := strconv.Atoi(v)
+		if err != nil || channels < 1 || channels > 2 {
+			return opts, fmt.Errorf("channels must be 1 or 2")
+		}
+		opts.numChannels = channels
+	}
+	if v := query.Get("codec"); v != "" {
+		if v != "wav" && v != "pcm" {
+			return opts, fmt.Errorf("unknown codec %q", v)
+		}
+		opts.codec = v
+	}
+	if v := query.Get("quality"); v != "" {
+		opts.quality = v
+	}
+	return opts, nil
+}
+
+// handleConvert converts an uploaded WAV, MP3 or Ogg Opus file to 16-bit
+// PCM at another rate or channel count, for preparing fallback files and
+// jingles. The body is the file itself; the result is a WAV file, or raw
+// little-endian samples with ?codec=pcm.
+func (s *Server) handleConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxConvertUpload)
+	decoded, err := audio.NewDecoder(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		status := http.StatusUnsupportedMediaType
+		if errors.Is(err, audio.ErrOpusUnavailable) {
+			status = http.StatusNotImplemented
+		}
+		http.Error(w, fmt.Sprintf("cannot decode upload: %v", err), status)
+		return
+	}
+	opts, err := parseConvertOptions(r, decoded)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var stages []audio.Stage
+	if opts.numChannels != decoded.NumChannels {
+		stages = append(stages, audio.NewMixer(decoded.NumChannels, opts.numChannels))
+	}
+	if opts.sampleRate != decoded.SampleRate {
+		resampler, err := audio.NewResampler(opts.quality, opts.numChannels, decoded.SampleRate, opts.sampleRate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stages = append(stages, resampler)
+	}
+
+	// The WAV header needs the length, so the result is collected first
+	var out bytes.Buffer
+	pipeline := audio.Pipeline{Stages: stages}
+	frameSize := 2 * decoded.NumChannels
+	chunk := make([]byte, convertChunk-convertChunk%frameSize)
+	for {
+		n, err := io.ReadFull(decoded.Reader, chunk)
+		if n -= n % frameSize; n > 0 {
+			converted, perr := pipeline.Process(chunk[:n])
+			if perr != nil {
+				http.Error(w, fmt.Sprintf("conversion failed: %v", perr), http.StatusInternalServerError)
+				return
+			}
+			if out.Len()+len(converted) > maxConvertOutput {
+				http.Error(w, "converted audio is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			out.Write(converted)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "upload is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, fmt.Sprintf("cannot decode upload: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.logger.Infow("Converted audio",
+		"from_rate", decoded.SampleRate, "from_channels", decoded.NumChannels,
+		"rate", opts.sampleRate, "channels", opts.numChannels, "bytes", out.Len(), "remote", r.RemoteAddr)
+
+	if opts.codec == "pcm" {
+		w.Header().Set("Content-Type", fmt.Sprintf("audio/L16;rate=%d;channels=%d", opts.sampleRate, opts.numChannels))
+		w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+		w.Write(out.Bytes())
+		return
+	}
+	header := audio.NewProcessor(opts.sampleRate, opts.numChannels, 16).Header(uint32(out.Len()))
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Content-Length", strconv.Itoa(len(header)+out.Len()))
+	w.Write(header)
+	w.Write(out.Bytes())
+}
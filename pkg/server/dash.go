@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/mp4"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+const (
+	// dashWindow is how many segments the cache keeps, and so how far back
+	// DASH players may seek
+	dashWindow = 30
+	// dashPlayerSegments is how many segments long a player may go without
+	// fetching one before it no longer counts as listening
+	dashPlayerSegments = 3
+)
+
+// validateDASH checks the DASH settings
+func (s *Server) validateDASH() error {
+	switch {
+	case s.config.DASHSegment == 0:
+		return nil
+	case s.config.Passthrough:
+		return errors.New("passthrough mode cannot serve dash, since segmenting re-encodes the audio")
+	case s.config.DASHSegment < 500*time.Millisecond || s.config.DASHSegment > 10*time.Second:
+		return fmt.Errorf("dash segments must last from 500ms to 10s, not %s", s.config.DASHSegment)
+	}
+	return nil
+}
+
+// segmentCache cuts the broadcast into segments, keeping the most recent
+// dashWindow of each representation for players to fetch. It is a
+// listener, so it encodes once however many players fetch the segments.
+type segmentCache struct {
+	mu      sync.Mutex
+	segment time.Duration
+
+	// start is when media time 0 was live. A period begins with every
+	// format change at periodStart, counted in media time.
+	start       time.Time
+	period      int
+	periodStart time.Duration
+	format      ws.SourceFormat
+	reps        []*dashRepresentation
+
+	// next numbers the open segment, which holds pending source samples
+	next    uint32
+	pending int
+
+	// players holds when each player last fetched a media segment, keyed
+	// by its address and user agent
+	players map[string]time.Time
+}
+
+// dashRepresentation is one encoding of the stream, at its own rate and
+// channel count, cut at the same source frames as the others
+type dashRepresentation struct {
+	id        string
+	format    ws.SourceFormat
+	mono      bool
+	resampler audio.Stage
+	enc       *audio.FLACEncoder
+	init      []byte
+
+	// The open segment's FLAC frames, starting at decodeTime
+	decodeTime uint64
+	frames     [][]byte
+	durations  []uint32
+
+	segments []dashSegment
+}
+
+// dashSegment is a cached segment. Times are in the representation's
+// samples.
+type dashSegment struct {
+	number          uint32
+	start, duration uint64
+	data            []byte
+}
+
+// startDASH registers the segmenter on the broadcast
+func (s *Server) startDASH() {
+	s.dash = &segmentCache{segment: s.config.DASHSegment, next: 1, players: make(map[string]time.Time)}
+	s.dash.SendFormat(s.wsManager.OutputFormat())
+
+	// Segments are cut from the whole broadcast, so none may be skipped
+	profile, _ := ws.LookupProfile("stable")
+	profile.Drop = ws.DropOldest
+	info := ws.ConnInfo{Transport: "dash", ConnectedAt: time.Now()}
+	s.wsManager.AddListener(s.dash, info, profile, nil)
+}
+
+// Send adds a broadcast frame to the open segment, cutting it once it is
+// long enough
+func (c *segmentCache) Send(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pcm := audio.BytesToPCM(data)
+	n := c.format.Channels
+	pcm = pcm[:len(pcm)-len(pcm)%n]
+	if len(pcm) == 0 {
+		return nil
+	}
+	if c.start.IsZero() {
+		c.start = time.Now()
+	}
+	for _, rep := range c.reps {
+		rep.add(pcm, n)
+	}
+	c.pending += len(pcm) / n
+
+	if time.Duration(c.pending)*time.Second/time.Duration(c.format.SampleRate) < c.segment {
+		return nil
+	}
+	// A resampler may not have produced anything yet, and timelines
+	// cannot skip a number
+	for _, rep := range c.reps {
+		if len(rep.frames) == 0 {
+			return nil
+		}
+	}
+	for _, rep := range c.reps {
+		rep.cut(c.next)
+	}
+	c.next++
+	c.pending = 0
+	return nil
+}
+
+// SendFormat starts a new period when the format changes. The segments of
+// the old one are dropped, since players move on when they next reload
+// the manifest.
+func (c *segmentCache) SendFormat(format ws.SourceFormat) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reps != nil && format.SampleRate == c.format.SampleRate && format.Channels == c.format.Channels {
+		return nil
+	}
+	if c.reps != nil {
+		c.periodStart += c.reps[0].elapsed()
+	}
+	c.period++
+	c.format = format
+	c.pending = 0
+	c.reps = []*dashRepresentation{newDASHRepresentation("full", format, false)}
+
+	// A mono representation at half the rate (or the same rate, for low
+	// rates) gives players on poor connections something to fall back to
+	low := format
+	low.Channels = 1
+	if format.SampleRate >= 32000 {
+		low.SampleRate = format.SampleRate / 2
+	}
+	if low != format {
+		c.reps = append(c.reps, newDASHRepresentation("low", low, format.Channels > 1))
+		if low.SampleRate != format.SampleRate {
+			c.reps[1].resampler = audio.NewSincResampler(1, format.SampleRate, low.SampleRate)
+		}
+	}
+	return nil
+}
+
+// Close does nothing: the cache lasts as long as the server
+func (c *segmentCache) Close() error {
+	return nil
+}
+
+// newDASHRepresentation starts a representation in format
+func newDASHRepresentation(id string, format ws.SourceFormat, mono bool) *dashRepresentation {
+	enc := audio.NewFLACEncoder(format.SampleRate, format.Channels)
+	return &dashRepresentation{
+		id:     id,
+		format: format,
+		mono:   mono,
+		enc:    enc,
+		init:   mp4.FLACInit(format.SampleRate, format.Channels, enc.StreamInfo()),
+	}
+}
+
+// add encodes source PCM with n channels into the open segment
+func (r *dashRepresentation) add(pcm []int16, n int) {
+	if r.mono {
+		pcm = audio.DownmixMono(pcm, n)
+	}
+	if r.resampler != nil {
+		pcm = r.resampler.Process(pcm)
+	}
+	ch := r.format.Channels
+	for len(pcm) >= ch {
+		block := min(len(pcm)-len(pcm)%ch, audio.FLACMaxBlock*ch)
+		r.frames = append(r.frames, r.enc.Encode(pcm[:block]))
+		r.durations = append(r.durations, uint32(block/ch))
+		pcm = pcm[block:]
+	}
+}
+
+// cut closes the open segment as number, dropping the oldest beyond the
+// window
+func (r *dashRepresentation) cut(number uint32) {
+	var duration uint64
+	for _, d := range r.durations {
+		duration += uint64(d)
+	}
+	r.segments = append(r.segments, dashSegment{
+		number:   number,
+		start:    r.decodeTime,
+		duration: duration,
+		data:     mp4.Fragment(number, r.decodeTime, r.frames, r.durations),
+	})
+	if len(r.segments) > dashWindow {
+		r.segments = r.segments[len(r.segments)-dashWindow:]
+	}
+	r.decodeTime += duration
+	r.frames, r.durations = nil, nil
+}
+
+// elapsed returns the media time the representation has cut
+func (r *dashRepresentation) elapsed() time.Duration {
+	return time.Duration(r.decodeTime) * time.Second / time.Duration(r.format.SampleRate)
+}
+
+// bandwidth returns the representation's bits per second, measured over
+// the cached segments or estimated from FLAC's usual ratio before any
+func (r *dashRepresentation) bandwidth() int {
+	var size, duration uint64
+	for _, seg := range r.segments {
+		size += uint64(len(seg.data))
+		duration += seg.duration
+	}
+	if duration == 0 {
+		return r.format.SampleRate * r.format.Channels * 16 * 6 / 10
+	}
+	return int(size * 8 * uint64(r.format.SampleRate) / duration)
+}
+
+// segmentData returns the cached segment with number
+func (r *dashRepresentation) segmentData(number uint32) ([]byte, bool) {
+	for _, seg := range r.segments {
+		if seg.number == number {
+			return seg.data, true
+		}
+	}
+	return nil, false
+}
+
+// manifest returns the MPD listing the cached segments, or false before
+// the first is cut
+func (c *segmentCache) manifest(now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.reps[0].segments) == 0 {
+		return nil, false
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic"`+
+		` availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="%s" minBufferTime="%s"`+
+		` timeShiftBufferDepth="%s" suggestedPresentationDelay="%s">`+"\n",
+		c.start.UTC().Format(time.RFC3339Nano), now.UTC().Format(time.RFC3339Nano), isoDuration(c.segment),
+		isoDuration(2*c.segment), isoDuration(dashWindow*c.segment), isoDuration(3*c.segment))
+	fmt.Fprintf(&b, `  <Period id="%d" start="%s">`+"\n", c.period, isoDuration(c.periodStart))
+	b.WriteString(`    <AdaptationSet contentType="audio" mimeType="audio/mp4" segmentAlignment="true" startWithSAP="1">` + "\n")
+	for _, rep := range c.reps {
+		fmt.Fprintf(&b, `      <Representation id="%s" codecs="flac" bandwidth="%d" audioSamplingRate="%d">`+"\n",
+			rep.id, rep.bandwidth(), rep.format.SampleRate)
+		fmt.Fprintf(&b, `        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>`+"\n",
+			rep.format.Channels)
+		fmt.Fprintf(&b, `        <SegmentTemplate timescale="%d" initialization="dash/$RepresentationID$-init-%d.mp4" media="dash/$RepresentationID$-$Number$.m4s" startNumber="%d">`+"\n",
+			rep.format.SampleRate, c.period, rep.segments[0].number)
+		b.WriteString("          <SegmentTimeline>\n")
+		for _, seg := range rep.segments {
+			fmt.Fprintf(&b, `            <S t="%d" d="%d"/>`+"\n", seg.start, seg.duration)
+		}
+		b.WriteString("          </SegmentTimeline>\n        </SegmentTemplate>\n      </Representation>\n")
+	}
+	b.WriteString("    </AdaptationSet>\n  </Period>\n")
+	fmt.Fprintf(&b, `  <UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="%s"/>`+"\n", now.UTC().Format(time.RFC3339Nano))
+	b.WriteString("</MPD>\n")
+	return b.Bytes(), true
+}
+
+// file returns the initialization or media segment named name, as in the
+// manifest's templates
+func (c *segmentCache) file(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, rest, ok := strings.Cut(name, "-")
+	if !ok {
+		return nil, false
+	}
+	var rep *dashRepresentation
+	for _, r := range c.reps {
+		if r.id == id {
+			rep = r
+		}
+	}
+	if rep == nil {
+		return nil, false
+	}
+	if period, ok := strings.CutPrefix(rest, "init-"); ok {
+		return rep.init, period == strconv.Itoa(c.period)+".mp4"
+	}
+	number, err := strconv.ParseUint(strings.TrimSuffix(rest, ".m4s"), 10, 32)
+	if err != nil || !strings.HasSuffix(rest, ".m4s") {
+		return nil, false
+	}
+	return rep.segmentData(uint32(number))
+}
+
+// fetched records that a player fetched a media segment at now
+func (c *segmentCache) fetched(player string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.players[player] = now
+}
+
+// listening counts the players that fetched a media segment recently,
+// forgetting the rest
+func (c *segmentCache) listening(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for player, at := range c.players {
+		if now.Sub(at) > dashPlayerSegments*c.segment {
+			delete(c.players, player)
+		}
+	}
+	return len(c.players)
+}
+
+// isoDuration formats d as an ISO 8601 duration in seconds
+func isoDuration(d time.Duration) string {
+	return "PT" + strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "S"
+}
+
+// handleDASHManifest serves the MPD for DASH players such as ExoPlayer
+func (s *Server) handleDASHManifest(w http.ResponseWriter, r *http.Request) {
+	if s.dash == nil {
+		http.Error(w, "the dash stream is disabled", http.StatusNotFound)
+		return
+	}
+	mpd, ok := s.dash.manifest(time.Now())
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.config.DASHSegment.Seconds())+1))
+		http.Error(w, "the dash stream has no segments yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(mpd)
+}
+
+// handleDASHSegment serves initialization and media segments from the
+// cache. Both never change once cut, so players and proxies may cache them.
+// Players hold no connection, so fetching media segments is what counts
+// them as listening.
+func (s *Server) handleDASHSegment(w http.ResponseWriter, r *http.Request) {
+	if s.dash == nil {
+		http.Error(w, "the dash stream is disabled", http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/dash/")
+	data, ok := s.dash.file(name)
+	if !ok {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
+	if strings.HasSuffix(name, ".m4s") {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		s.dash.fetched(host+" "+r.UserAgent(), time.Now())
+	}
+	w.Header().Set("Content-Type", "audio/mp4")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int((dashWindow*s.config.DASHSegment).Seconds())))
+	w.Write(data)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/events"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+// newDASHServer returns a server cutting segments of segment, with the
+// first already cut
+func newDASHServer(t *testing.T, segment, idle time.Duration) *Server {
+	t.Helper()
+	logger := zap.NewNop().Sugar()
+	s := &Server{
+		config:    Config{DASHSegment: segment, IdleTimeout: idle},
+		logger:    logger,
+		wsManager: ws.NewManager(audio.NewProcessor(44100, 2, 16), logger),
+		events:    events.NewBus(),
+	}
+	s.startDASH()
+	format := s.wsManager.OutputFormat()
+	frames := int(2 * segment * time.Duration(format.SampleRate) / time.Second)
+	s.dash.Send(make([]byte, frames*format.Channels*2))
+	if _, ok := s.dash.manifest(time.Now()); !ok {
+		t.Fatal("no segment was cut")
+	}
+	return s
+}
+
+// fetchDASH fetches a file from the segment cache as the player at addr
+func fetchDASH(s *Server, name, addr, agent string) int {
+	r := httptest.NewRequest(http.MethodGet, "/dash/"+name, nil)
+	r.RemoteAddr = addr
+	r.Header.Set("User-Agent", agent)
+	w := httptest.NewRecorder()
+	s.handleDASHSegment(w, r)
+	return w.Code
+}
+
+func TestDASHPlayersCountAsAudience(t *testing.T) {
+	s := newDASHServer(t, time.Second, time.Minute)
+
+	// Fetching the initialization segment is not listening yet
+	if code := fetchDASH(s, "full-init-1.mp4", "192.0.2.1:5000", "ExoPlayer"); code != http.StatusOK {
+		t.Fatalf("init segment: status %d", code)
+	}
+	if n := s.audience(s.wsManager.Stats()); n != 0 {
+		t.Fatalf("audience %d before any media segment, want 0", n)
+	}
+
+	// Players are told apart by address and user agent, not connection
+	fetchDASH(s, "full-1.m4s", "192.0.2.1:5000", "ExoPlayer")
+	fetchDASH(s, "low-1.m4s", "192.0.2.1:5001", "ExoPlayer")
+	fetchDASH(s, "full-1.m4s", "192.0.2.1:5002", "dash.js")
+	fetchDASH(s, "full-1.m4s", "[2001:db8::1]:5000", "ExoPlayer")
+	if n := s.audience(s.wsManager.Stats()); n != 3 {
+		t.Fatalf("audience %d, want 3 players", n)
+	}
+	public, _ := s.publicStats()
+	if want := `"listeners":3`; !strings.Contains(string(public), want) {
+		t.Errorf("public stats %s, want %s", public, want)
+	}
+
+	// Players that stop fetching are forgotten
+	if n := s.dash.listening(time.Now().Add(dashPlayerSegments*time.Second + time.Second)); n != 0 {
+		t.Errorf("%d players still listening after they stopped fetching", n)
+	}
+}
+
+func TestIdleCountsDASHPlayers(t *testing.T) {
+	s := newDASHServer(t, 20*time.Millisecond, 40*time.Millisecond)
+
+	stopped := make(chan struct{})
+	go s.watchIdle(func() { close(stopped) })
+	for end := time.Now().Add(200 * time.Millisecond); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		fetchDASH(s, "full-1.m4s", "192.0.2.1:5000", "ExoPlayer")
+		select {
+		case <-stopped:
+			t.Fatal("went idle with a DASH player fetching segments")
+		default:
+		}
+	}
+
+	// Once the player stops fetching, the server goes idle
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not go idle once the DASH player stopped")
+	}
+}
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/upnp"
+)
+
+const (
+	mediaServer       = "urn:schemas-upnp-org:device:MediaServer:1"
+	contentDirectory  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	connectionManager = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+	// dlnaLive marks a resource as a live stream: streamed as it is
+	// produced, with no seeking
+	dlnaLive = "DLNA.ORG_OP=00;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+
+	// didlOpen and didlClose enclose DIDL-Lite object descriptions
+	didlOpen  = `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`
+	didlClose = `</DIDL-Lite>`
+
+	// rendererSearch is how long renderers are searched for by default,
+	// and maxRendererSearch the longest a search may be asked to take
+	rendererSearch    = 2 * time.Second
+	maxRendererSearch = 10 * time.Second
+	// rendererTimeout bounds commands sent to a renderer
+	rendererTimeout = 10 * time.Second
+)
+
+// dlna announces the stream as a UPnP media server and pushes it to
+// renderers
+type dlna struct {
+	advertiser *upnp.Advertiser
+
+	mu sync.Mutex
+	// renderers are those found by the last search, by ID
+	renderers map[string]*upnp.Renderer
+}
+
+// dlnaResource is a URL the stream can be played from, and how it is
+// encoded
+type dlnaResource struct {
+	protocolInfo string
+	url          string
+}
+
+// dlnaResources returns the URLs the stream is played from on host, the
+// most widely supported first
+func (s *Server) dlnaResources(host string) []dlnaResource {
+	var resources []dlnaResource
+	if s.config.MP3Encoder != "" && !s.config.Passthrough {
+		resources = append(resources, dlnaResource{"http-get:*:audio/mpeg:DLNA.ORG_PN=MP3;" + dlnaLive, "http://" + host + "/stream.mp3"})
+	}
+	return append(resources, dlnaResource{"http-get:*:audio/wav:" + dlnaLive, "http://" + host + "/stream"})
+}
+
+// dlnaTitle is what players show the stream as: what is playing, or the
+// server's name
+func (s *Server) dlnaTitle() string {
+	if title := s.wsManager.Metadata().StreamTitle(); title != "" {
+		return title
+	}
+	return s.config.DLNAName
+}
+
+// didl describes the stream, played from host, as DIDL-Lite
+func (s *Server) didl(host string) string {
+	var b strings.Builder
+	b.WriteString(didlOpen)
+	fmt.Fprintf(&b, `<item id="1" parentID="0" restricted="1"><dc:title>%s</dc:title><upnp:class>object.item.audioItem.audioBroadcast</upnp:class>`, xmlEscape(s.dlnaTitle()))
+	for _, res := range s.dlnaResources(host) {
+		fmt.Fprintf(&b, `<res protocolInfo="%s">%s</res>`, xmlEscape(res.protocolInfo), xmlEscape(res.url))
+	}
+	b.WriteString(`</item>` + didlClose)
+	return b.String()
+}
+
+// dlnaUUID identifies the media server, the same across restarts as long
+// as the host, port and name are
+func (s *Server) dlnaUUID() string {
+	host, _ := os.Hostname()
+	sum := sha1.Sum([]byte("minicast:" + host + ":" + s.port + ":" + s.config.DLNAName))
+	sum[6] = sum[6]&0x0F | 0x50 // version 5
+	sum[8] = sum[8]&0x3F | 0x80 // variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// startDLNA serves the media server's description and services, and
+// announces it so smart TVs and speakers list the stream
+func (s *Server) startDLNA() error {
+	uuid := s.dlnaUUID()
+	description := fmt.Sprintf(dlnaDescription, xmlEscape(s.config.DLNAName), uuid)
+	http.HandleFunc("/upnp/description.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(description))
+	})
+	http.HandleFunc("/upnp/ContentDirectory.xml", serveSCPD(contentDirectorySCPD))
+	http.HandleFunc("/upnp/ConnectionManager.xml", serveSCPD(connectionManagerSCPD))
+	http.HandleFunc("/upnp/control/ContentDirectory", s.handleContentDirectory)
+	http.HandleFunc("/upnp/control/ConnectionManager", s.handleConnectionManager)
+	// Nothing changes that is worth subscribing to
+	http.HandleFunc("/upnp/event/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "eventing is not supported", http.StatusNotImplemented)
+	})
+
+	port := s.port
+	advertiser, err := upnp.Advertise(upnp.Device{
+		UUID:  uuid,
+		Types: []string{mediaServer, contentDirectory, connectionManager},
+		Location: func(local net.IP) string {
+			return "http://" + net.JoinHostPort(local.String(), port) + "/upnp/description.xml"
+		},
+		Server: "minicast UPnP/1.0 DLNADOC/1.50",
+	}, s.logger.With("module", "dlna"))
+	if err != nil {
+		return fmt.Errorf("failed to announce the stream over UPnP: %v", err)
+	}
+	s.dlna.advertiser = advertiser
+	s.logger.Infof("Announcing the stream over UPnP as %q", s.config.DLNAName)
+	return nil
+}
+
+// serveSCPD serves a service description
+func serveSCPD(scpd string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write([]byte(scpd))
+	}
+}
+
+// handleContentDirectory answers the ContentDirectory service, which
+// holds one item: the stream
+func (s *Server) handleContentDirectory(w http.ResponseWriter, r *http.Request) {
+	action, args, err := upnp.ReadAction(r)
+	if err != nil {
+		upnp.WriteError(w, 401, "Invalid Action")
+		return
+	}
+	switch action {
+	case "Browse":
+		s.browse(w, r, args)
+	case "GetSearchCapabilities":
+		upnp.WriteResult(w, contentDirectory, action, upnp.Arg{Name: "SearchCaps"})
+	case "GetSortCapabilities":
+		upnp.WriteResult(w, contentDirectory, action, upnp.Arg{Name: "SortCaps"})
+	case "GetSystemUpdateID":
+		upnp.WriteResult(w, contentDirectory, action, upnp.Arg{Name: "Id", Value: "1"})
+	default:
+		upnp.WriteError(w, 401, "Invalid Action")
+	}
+}
+
+// browse answers a Browse of the root container or the stream in it
+func (s *Server) browse(w http.ResponseWriter, r *http.Request, args map[string]string) {
+	start, _ := strconv.Atoi(args["StartingIndex"])
+	result := didlOpen + didlClose
+	returned, total := 0, 0
+	switch object, flag := args["ObjectID"], args["BrowseFlag"]; {
+	case object == "0" && flag == "BrowseMetadata":
+		result = didlOpen + fmt.Sprintf(`<container id="0" parentID="-1" childCount="1" restricted="1" searchable="0">`+
+			`<dc:title>%s</dc:title><upnp:class>object.container</upnp:class></container>`, xmlEscape(s.config.DLNAName)) + didlClose
+		returned, total = 1, 1
+	case object == "0" && flag == "BrowseDirectChildren":
+		if start == 0 {
+			result, returned = s.didl(r.Host), 1
+		}
+		total = 1
+	case object == "1" && flag == "BrowseMetadata":
+		result, returned, total = s.didl(r.Host), 1, 1
+	case object == "1" && flag == "BrowseDirectChildren":
+	default:
+		upnp.WriteError(w, 701, "No such object")
+		return
+	}
+	upnp.WriteResult(w, contentDirectory, "Browse",
+		upnp.Arg{Name: "Result", Value: result},
+		upnp.Arg{Name: "NumberReturned", Value: strconv.Itoa(returned)},
+		upnp.Arg{Name: "TotalMatches", Value: strconv.Itoa(total)},
+		upnp.Arg{Name: "UpdateID", Value: "1"})
+}
+
+// handleConnectionManager answers the ConnectionManager service, which
+// says what the stream can be played as
+func (s *Server) handleConnectionManager(w http.ResponseWriter, r *http.Request) {
+	action, args, err := upnp.ReadAction(r)
+	if err != nil {
+		upnp.WriteError(w, 401, "Invalid Action")
+		return
+	}
+	switch action {
+	case "GetProtocolInfo":
+		var protocols []string
+		for _, res := range s.dlnaResources(r.Host) {
+			protocols = append(protocols, res.protocolInfo)
+		}
+		upnp.WriteResult(w, connectionManager, action,
+			upnp.Arg{Name: "Source", Value: strings.Join(protocols, ",")}, upnp.Arg{Name: "Sink"})
+	case "GetCurrentConnectionIDs":
+		upnp.WriteResult(w, connectionManager, action, upnp.Arg{Name: "ConnectionIDs", Value: "0"})
+	case "GetCurrentConnectionInfo":
+		if args["ConnectionID"] != "0" {
+			upnp.WriteError(w, 706, "Invalid connection reference")
+			return
+		}
+		upnp.WriteResult(w, connectionManager, action,
+			upnp.Arg{Name: "RcsID", Value: "-1"},
+			upnp.Arg{Name: "AVTransportID", Value: "-1"},
+			upnp.Arg{Name: "ProtocolInfo"},
+			upnp.Arg{Name: "PeerConnectionManager"},
+			upnp.Arg{Name: "PeerConnectionID", Value: "-1"},
+			upnp.Arg{Name: "Direction", Value: "Output"},
+			upnp.Arg{Name: "Status", Value: "OK"})
+	default:
+		upnp.WriteError(w, 401, "Invalid Action")
+	}
+}
+
+// findRenderers searches for renderers for wait and remembers them, so
+// they can be told to play the stream by ID
+func (s *Server) findRenderers(ctx context.Context, wait time.Duration) ([]*upnp.Renderer, error) {
+	renderers, err := upnp.FindRenderers(ctx, wait)
+	if err != nil {
+		return nil, err
+	}
+	s.dlna.mu.Lock()
+	defer s.dlna.mu.Unlock()
+	s.dlna.renderers = make(map[string]*upnp.Renderer, len(renderers))
+	for _, r := range renderers {
+		s.dlna.renderers[r.ID] = r
+	}
+	return renderers, nil
+}
+
+// renderer returns the renderer with id, searching again if the last
+// search did not find it
+func (s *Server) renderer(ctx context.Context, id string) (*upnp.Renderer, error) {
+	s.dlna.mu.Lock()
+	r := s.dlna.renderers[id]
+	s.dlna.mu.Unlock()
+	if r != nil {
+		return r, nil
+	}
+	if _, err := s.findRenderers(ctx, rendererSearch); err != nil {
+		return nil, err
+	}
+	s.dlna.mu.Lock()
+	defer s.dlna.mu.Unlock()
+	return s.dlna.renderers[id], nil
+}
+
+// handleRenderers searches the LAN for DLNA renderers, for ?wait= (2s by
+// default)
+func (s *Server) handleRenderers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	wait := rendererSearch
+	if v := r.URL.Query().Get("wait"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxRendererSearch {
+			http.Error(w, fmt.Sprintf("wait must be a duration up to %s", maxRendererSearch), http.StatusBadRequest)
+			return
+		}
+		wait = d
+	}
+
+	renderers, err := s.findRenderers(r.Context(), wait)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to search for renderers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if renderers == nil {
+		renderers = []*upnp.Renderer{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(renderers); err != nil {
+		s.logger.Errorf("Failed to encode renderers: %v", err)
+	}
+}
+
+// handleRenderer tells the renderer whose ID ends the path to play the
+// stream on POST, and to stop on DELETE
+func (s *Server) handleRenderer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/api/v1/renderers/"))
+	if err != nil || id == "" {
+		http.Error(w, "invalid renderer id", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), rendererTimeout)
+	defer cancel()
+	renderer, err := s.renderer(ctx, id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to search for renderers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if renderer == nil {
+		http.Error(w, "no such renderer", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err = renderer.Stop(ctx)
+	} else {
+		err = s.pushStream(ctx, renderer)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		s.logger.Infof("Stopped the stream on %s", renderer.Name)
+	} else {
+		s.logger.Infof("Playing the stream on %s", renderer.Name)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pushStream tells a renderer to play the stream, from the address it
+// reaches this host at
+func (s *Server) pushStream(ctx context.Context, renderer *upnp.Renderer) error {
+	u, err := url.Parse(renderer.Location)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	local, err := upnp.LocalAddr(net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	host := net.JoinHostPort(local.String(), s.port)
+	return renderer.Play(ctx, s.dlnaResources(host)[0].url, s.didl(host))
+}
+
+// xmlEscape escapes s for XML text or attributes
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// dlnaDescription describes the media server, given its name and UUID
+const dlnaDescription = `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>` + mediaServer + `</deviceType>
+<dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC>
+<friendlyName>%s</friendlyName>
+<manufacturer>minicast</manufacturer>
+<manufacturerURL>https://github.com/maks112v/minicast</manufacturerURL>
+<modelName>minicast</modelName>
+<UDN>uuid:%s</UDN>
+<serviceList>
+<service><serviceType>` + contentDirectory + `</serviceType><serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId><SCPDURL>/upnp/ContentDirectory.xml</SCPDURL><controlURL>/upnp/control/ContentDirectory</controlURL><eventSubURL>/upnp/event/ContentDirectory</eventSubURL></service>
+<service><serviceType>` + connectionManager + `</serviceType><serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId><SCPDURL>/upnp/ConnectionManager.xml</SCPDURL><controlURL>/upnp/control/ConnectionManager</controlURL><eventSubURL>/upnp/event/ConnectionManager</eventSubURL></service>
+</serviceList>
+</device>
+</root>
+`
+
+// scpdAction is an action in a service description: its name, and the
+// direction and state variable of each argument in turn
+type scpdAction struct {
+	name string
+	args [][3]string
+}
+
+// scpd describes a service's actions and the state variables, by name and
+// type, their arguments are
+func scpd(actions []scpdAction, variables [][2]string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+		`<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion><actionList>`)
+	for _, action := range actions {
+		fmt.Fprintf(&b, "<action><name>%s</name><argumentList>", action.name)
+		for _, arg := range action.args {
+			fmt.Fprintf(&b, "<argument><name>%s</name><direction>%s</direction><relatedStateVariable>%s</relatedStateVariable></argument>", arg[0], arg[1], arg[2])
+		}
+		b.WriteString("</argumentList></action>")
+	}
+	b.WriteString("</actionList><serviceStateTable>")
+	for _, v := range variables {
+		fmt.Fprintf(&b, `<stateVariable sendEvents="no"><name>%s</name><dataType>%s</dataType></stateVariable>`, v[0], v[1])
+	}
+	b.WriteString("</serviceStateTable></scpd>\n")
+	return b.String()
+}
+
+var (
+	contentDirectorySCPD = scpd([]scpdAction{
+		{"Browse", [][3]string{
+			{"ObjectID", "in", "A_ARG_TYPE_ObjectID"},
+			{"BrowseFlag", "in", "A_ARG_TYPE_BrowseFlag"},
+			{"Filter", "in", "A_ARG_TYPE_Filter"},
+			{"StartingIndex", "in", "A_ARG_TYPE_Index"},
+			{"RequestedCount", "in", "A_ARG_TYPE_Count"},
+			{"SortCriteria", "in", "A_ARG_TYPE_SortCriteria"},
+			{"Result", "out", "A_ARG_TYPE_Result"},
+			{"NumberReturned", "out", "A_ARG_TYPE_Count"},
+			{"TotalMatches", "out", "A_ARG_TYPE_Count"},
+			{"UpdateID", "out", "A_ARG_TYPE_UpdateID"},
+		}},
+		{"GetSearchCapabilities", [][3]string{{"SearchCaps", "out", "SearchCapabilities"}}},
+		{"GetSortCapabilities", [][3]string{{"SortCaps", "out", "SortCapabilities"}}},
+		{"GetSystemUpdateID", [][3]string{{"Id", "out", "SystemUpdateID"}}},
+	}, [][2]string{
+		{"A_ARG_TYPE_ObjectID", "string"},
+		{"A_ARG_TYPE_BrowseFlag", "string"},
+		{"A_ARG_TYPE_Filter", "string"},
+		{"A_ARG_TYPE_Index", "ui4"},
+		{"A_ARG_TYPE_Count", "ui4"},
+		{"A_ARG_TYPE_SortCriteria", "string"},
+		{"A_ARG_TYPE_Result", "string"},
+		{"A_ARG_TYPE_UpdateID", "ui4"},
+		{"SearchCapabilities", "string"},
+		{"SortCapabilities", "string"},
+		{"SystemUpdateID", "ui4"},
+	})
+
+	connectionManagerSCPD = scpd([]scpdAction{
+		{"GetProtocolInfo", [][3]string{{"Source", "out", "SourceProtocolInfo"}, {"Sink", "out", "SinkProtocolInfo"}}},
+		{"GetCurrentConnectionIDs", [][3]string{{"ConnectionIDs", "out", "CurrentConnectionIDs"}}},
+		{"GetCurrentConnectionInfo", [][3]string{
+			{"ConnectionID", "in", "A_ARG_TYPE_ConnectionID"},
+			{"RcsID", "out", "A_ARG_TYPE_RcsID"},
+			{"AVTransportID", "out", "A_ARG_TYPE_AVTransportID"},
+			{"ProtocolInfo", "out", "A_ARG_TYPE_ProtocolInfo"},
+			{"PeerConnectionManager", "out", "A_ARG_TYPE_ConnectionManager"},
+			{"PeerConnectionID", "out", "A_ARG_TYPE_ConnectionID"},
+			{"Direction", "out", "A_ARG_TYPE_Direction"},
+			{"Status", "out", "A_ARG_TYPE_ConnectionStatus"},
+		}},
+	}, [][2]string{
+		{"SourceProtocolInfo", "string"},
+		{"SinkProtocolInfo", "string"},
+		{"CurrentConnectionIDs", "string"},
+		{"A_ARG_TYPE_ConnectionID", "i4"},
+		{"A_ARG_TYPE_RcsID", "i4"},
+		{"A_ARG_TYPE_AVTransportID", "i4"},
+		{"A_ARG_TYPE_ProtocolInfo", "string"},
+		{"A_ARG_TYPE_ConnectionManager", "string"},
+		{"A_ARG_TYPE_Direction", "string"},
+		{"A_ARG_TYPE_ConnectionStatus", "string"},
+	})
+)
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/dvr"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// startDVR opens the on-disk archive and registers it as a listener
+func (s *Server) startDVR() error {
+	storage := dvr.Storage(s.config.DVRFormat)
+	if storage == "" {
+		storage = dvr.StoragePCM
+	}
+	tap, ok := ws.ParseTap(s.config.DVRTap)
+	if !ok {
+		return fmt.Errorf("unknown dvr tap %q (available: mix, source)", s.config.DVRTap)
+	}
+	rec, err := dvr.Open(s.config.DVRDir, s.config.DVRDepth, storage, s.logger.With("module", "dvr"))
+	if err != nil {
+		return fmt.Errorf("failed to open DVR: %v", err)
+	}
+	s.dvr = rec
+	rec.SetClock(s.clock)
+	// FLAC segments are encoded in the broadcast format, which the archive
+	// must know before the first frame
+	rec.SendFormat(s.wsManager.OutputFormat())
+
+	// A deep queue rides out slow disks; frames are only dropped, never the archive
+	profile, _ := ws.LookupProfile("stable")
+	profile.Drop = ws.DropNewest
+	profile.Tap = tap
+	info := ws.ConnInfo{Transport: "dvr", RemoteAddr: s.config.DVRDir, ConnectedAt: time.Now()}
+	s.wsManager.AddListener(rec, info, profile, nil)
+
+	// Archive info and clip extraction
+	http.HandleFunc("/api/v1/dvr", s.corsMiddleware(s.handleDVR))
+	http.HandleFunc("/api/v1/dvr/clip", s.corsMiddleware(s.handleClip))
+	http.HandleFunc("/api/v1/dvr/tracks", s.corsMiddleware(s.handleTracks))
+
+	// Recordings sources made while they could not reach the server
+	http.HandleFunc("/api/v1/dvr/uploads", s.corsMiddleware(s.authorizeSource(s.handleUploads)))
+	http.HandleFunc("/api/v1/dvr/uploads/", s.corsMiddleware(s.handleUpload))
+
+	from := "mix"
+	if tap == ws.TapSource {
+		from = "source"
+	}
+	s.logger.Infof("Recording %s of DVR to %s as %s from the %s", s.config.DVRDepth, s.config.DVRDir, storage, from)
+	return nil
+}
+
+// listenerFeed returns the time-shifted feed for a listener joining in the
+// past with ?rewind=, or nil for the live broadcast
+func (s *Server) listenerFeed(r *http.Request) (ws.Feed, error) {
+	value := r.URL.Query().Get("rewind")
+	if value == "" {
+		return nil, nil
+	}
+	if s.dvr == nil {
+		return nil, fmt.Errorf("rewind needs the DVR, which is not enabled")
+	}
+
+	delay, err := parseDelay(value)
+	if err != nil || delay < 0 {
+		return nil, fmt.Errorf("invalid rewind %q", value)
+	}
+	if delay > s.dvr.Depth() {
+		return nil, fmt.Errorf("rewind %s is beyond the DVR depth of %s", delay, s.dvr.Depth())
+	}
+	return s.dvr.Replay(delay), nil
+}
+
+// parseDelay parses a duration such as "90s" or "5m", or a number of seconds
+func parseDelay(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// parseClipTime parses a clip boundary: an RFC 3339 time, or a duration ago
+// such as "10m" (or "-10m"). Empty means now.
+func parseClipTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	ago, err := parseDelay(strings.TrimPrefix(value, "-"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return now.Add(-ago), nil
+}
+
+// dvrInfo is the API view of the archive
+type dvrInfo struct {
+	Depth  string     `json:"depth"`
+	Format string     `json:"format"`
+	Oldest *time.Time `json:"oldest"`
+	Newest *time.Time `json:"newest"`
+}
+
+// handleDVR reports how much audio the archive holds
+func (s *Server) handleDVR(w http.ResponseWriter, r *http.Request) {
+	info := dvrInfo{Depth: s.dvr.Depth().String(), Format: string(s.dvr.Storage())}
+	if oldest, newest, ok := s.dvr.Range(); ok {
+		info.Oldest, info.Newest = &oldest, &newest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		s.logger.Errorf("Failed to encode DVR info: %v", err)
+	}
+}
+
+// handleClip serves archived audio between ?from= and ?to= as a WAV file
+func (s *Server) handleClip(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	from, err := parseClipTime(r.URL.Query().Get("from"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseClipTime(r.URL.Query().Get("to"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !to.After(from) {
+		http.Error(w, "clip must end after it starts", http.StatusBadRequest)
+		return
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "wav"
+	}
+	format, ok := clipFormats[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown clip format %q", name), http.StatusBadRequest)
+		return
+	}
+
+	clip := s.dvr.Clip(from, to)
+	size := clip.Size()
+	if size == 0 {
+		http.Error(w, "no audio archived in that range", http.StatusNotFound)
+		return
+	}
+	if format.wav && size > 0xFFFFFFFF-36 {
+		http.Error(w, "clip is too long for a WAV file", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var header []byte
+	if format.wav {
+		header = s.audio.Header(uint32(size))
+	}
+	reader := clip.Reader(header)
+	defer reader.Close()
+
+	// The same frames always make the same bytes, so a resumed download of
+	// a clip between fixed times continues where it left off, while one
+	// relative to now (or trimmed meanwhile) starts over via If-Range
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x-%s\"", clip.Start().UnixNano(), clip.End().UnixNano(), name))
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"clip-%s.%s\"", from.UTC().Format("20060102-150405"), name))
+	http.ServeContent(w, r, "", clip.End(), reader)
+}
+
+// clipFormat is a file format clips can be downloaded in
+type clipFormat struct {
+	contentType string
+	wav         bool
+}
+
+// clipFormats are the formats selectable with ?format=, named by extension
+var clipFormats = map[string]clipFormat{
+	"wav": {contentType: "audio/wav", wav: true},
+	// Headerless 16-bit little-endian PCM in the broadcast format
+	"pcm": {contentType: "application/octet-stream"},
+}
+
+// maxUploadSize is the largest recording accepted, the most a WAV file holds
+const maxUploadSize = 0xFFFFFFFF + 8
+
+// handleUploads lists the uploaded recordings, or stores one sent with PUT
+// and ?start= (an RFC 3339 time) as a WAV file
+func (s *Server) handleUploads(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		uploads, err := s.dvr.Uploads()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(uploads); err != nil {
+			s.logger.Errorf("Failed to encode DVR uploads: %v", err)
+		}
+
+	case http.MethodPut:
+		start, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("start"))
+		if err != nil {
+			http.Error(w, "start must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		upload, err := s.dvr.SaveUpload(start, http.MaxBytesReader(w, r.Body, maxUploadSize))
+		if errors.Is(err, dvr.ErrUploadTooOld) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.logger.Infow("Stored uploaded recording", "name", upload.Name, "size", upload.Size, "remote", r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(upload)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleUpload serves one uploaded recording
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	path, ok := s.dvr.UploadPath(strings.TrimPrefix(r.URL.Path, "/api/v1/dvr/uploads/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/wav")
+	http.ServeFile(w, r, path)
+}
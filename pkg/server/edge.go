@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/frame"
+	"github.com/maks112v/minicast/pkg/relay"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+// edge is the source of a server in edge mode: the broadcast of an origin
+// server, listened to over WebSocket, so listeners can be spread across
+// edge nodes. It holds the source slot while the origin is reachable.
+type edge struct {
+	manager  *ws.Manager
+	upstream *relay.Upstream
+	logger   *zap.SugaredLogger
+
+	// pipeline is only used by the upstream's goroutine
+	pipeline *ws.SourcePipeline
+	// dropped is set when the Manager lets the edge go, e.g. for
+	// maintenance, until the origin is next connected
+	dropped atomic.Bool
+}
+
+// startEdge pulls the broadcast from the origin server, reconnecting
+// whenever it is lost
+func (s *Server) startEdge() error {
+	logger := s.logger.With("module", "edge")
+	upstream, err := relay.NewUpstream(s.config.OriginURL, nil, logger)
+	if err != nil {
+		return err
+	}
+	e := &edge{manager: s.wsManager, upstream: upstream, logger: logger}
+	go upstream.Run(context.Background(), e)
+	s.logger.Infof("Edge of origin %s", upstream.URL())
+	return nil
+}
+
+// Connect claims the source slot for a new connection to the origin
+func (e *edge) Connect(info ws.ConnInfo, format ws.SourceFormat) error {
+	info.Transport = "edge"
+	if err := e.manager.AttachSource(e, info, format); err != nil {
+		return err
+	}
+	pipeline, err := e.manager.NewPipeline(format)
+	if err != nil {
+		e.manager.DetachSource(e)
+		return err
+	}
+	e.pipeline = pipeline
+	e.dropped.Store(false)
+	return nil
+}
+
+// Format switches to the origin's new format
+func (e *edge) Format(format ws.SourceFormat) error {
+	if err := e.manager.SetSourceFormat(e, format); err != nil {
+		return err
+	}
+	pipeline, err := e.manager.NewPipeline(format)
+	if err != nil {
+		return err
+	}
+	e.pipeline = pipeline
+	return nil
+}
+
+// Metadata passes the origin's now-playing metadata on to listeners
+func (e *edge) Metadata(md ws.Metadata) {
+	if !e.dropped.Load() {
+		e.manager.SetMetadata(md)
+	}
+}
+
+// Frame broadcasts a frame from the origin, keeping its capture time
+func (e *edge) Frame(pcm []byte, captured time.Time, flags frame.Flags) {
+	if e.dropped.Load() {
+		return
+	}
+	data, err := e.pipeline.Process(pcm)
+	if err != nil {
+		e.logger.Debugf("Failed to process origin frame: %v", err)
+		return
+	}
+	if data != nil {
+		e.manager.BroadcastFrame(data, captured, flags)
+	}
+}
+
+// Disconnect releases the source slot once the origin is lost
+func (e *edge) Disconnect() {
+	e.manager.DetachSource(e)
+}
+
+// Close lets the source slot go when the Manager drops the edge, ending
+// the connection to the origin, which is retried
+func (e *edge) Close() error {
+	e.dropped.Store(true)
+	e.upstream.Drop()
+	return nil
+}
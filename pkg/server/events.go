@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/maks112v/minicast/pkg/events"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// eventTypes are the types of event the server publishes
+var eventTypes = map[string]bool{
+	"source":      true,
+	"metadata":    true,
+	"maintenance": true,
+	"hold":        true,
+	"silence":     true,
+	"trigger":     true,
+	"idle":        true,
+	"recording":   true,
+	"listeners":   true,
+}
+
+// validateWebhooks checks that webhooks have URLs and only ask for events
+// the server publishes
+func validateWebhooks(hooks []events.WebhookConfig) error {
+	for _, hook := range hooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %q needs an http or https URL", hook.URL)
+		}
+		for _, typ := range hook.Events {
+			if !eventTypes[typ] {
+				return fmt.Errorf("webhook %s: unknown event %q", u.Redacted(), typ)
+			}
+		}
+	}
+	return nil
+}
+
+// startWebhooks delivers events to the configured webhooks
+func (s *Server) startWebhooks() error {
+	if err := validateWebhooks(s.config.Webhooks); err != nil {
+		return err
+	}
+	for _, config := range s.config.Webhooks {
+		hook := events.NewWebhook(config, s.logger.With("module", "webhook"))
+		go hook.Run(context.Background(), s.events)
+	}
+	return nil
+}
+
+// publicEvent returns event without the source's address, for clients
+// without an admin token
+func publicEvent(event events.Event) events.Event {
+	if source, ok := event.Data.(ws.SourceEvent); ok {
+		source.RemoteAddr = ""
+		event.Data = source
+	}
+	return event
+}
+
+// handleEvents streams events to the client as server-sent events, leaving
+// out the source's address unless the client may read the admin endpoints
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	admin := s.isAdmin(r)
+	events, unsubscribe := s.events.Subscribe(64)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if !admin {
+				event = publicEvent(event)
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				s.logger.Errorf("Failed to encode event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
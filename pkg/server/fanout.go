@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/events"
+	"github.com/maks112v/minicast/pkg/fanout"
+	"github.com/maks112v/minicast/pkg/frame"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// fanoutTimeout is how long another instance's source may go unheard
+	// before its slot is released, so a local source can take over
+	fanoutTimeout = 2 * time.Second
+
+	minFanoutDelay = time.Second
+	maxFanoutDelay = 30 * time.Second
+)
+
+// fanoutFollower shares the broadcast with other server instances over a
+// fanout bus. The instance a source connects to publishes its processed
+// frames and metadata; the others take them as their source, so each can
+// serve its own listeners.
+type fanoutFollower struct {
+	bus      fanout.Bus
+	instance string
+	manager  *ws.Manager
+	logger   *zap.SugaredLogger
+	cluster  *cluster
+
+	// attached is set while frames from another instance hold the source
+	// slot, so they are not published back
+	attached  atomic.Bool
+	lastHeard atomic.Int64
+
+	// mu guards the follower's state, used by the subscription
+	mu       sync.Mutex
+	from     string
+	format   ws.SourceFormat
+	mismatch bool
+	busy     bool
+
+	// applied is the last metadata taken from the bus, which is not
+	// published back
+	metadataMu sync.Mutex
+	applied    *ws.Metadata
+}
+
+// startFanout connects the broadcast to the fanout bus
+func (s *Server) startFanout() error {
+	logger := s.logger.With("module", "fanout")
+	bus, err := fanout.Open(s.config.FanoutURL, s.config.FanoutChannel, logger)
+	if err != nil {
+		return err
+	}
+	f := &fanoutFollower{bus: bus, instance: instanceName(), manager: s.wsManager, logger: logger}
+	f.cluster = newCluster(f, s.audience)
+	s.cluster = f.cluster
+	s.wsManager.SetFanout(f.publishFrame)
+	s.wsManager.SetSourceGate(f.cluster.gate)
+	s.metrics.collect(s.writeClusterMetrics)
+
+	updates, _ := s.events.Subscribe(16)
+	go f.publishEvents(updates)
+	go f.subscribe()
+	go f.watch()
+	go f.cluster.heartbeat()
+	s.logger.Infof("Sharing the broadcast as %s on fanout channel %q", f.instance, s.config.FanoutChannel)
+	return nil
+}
+
+// instanceName names this instance on the bus: its host name, made
+// unique so instances on one host can be told apart
+func instanceName() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "minicast"
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// publishFrame publishes a frame of a local source
+func (f *fanoutFollower) publishFrame(data []byte, captured time.Time, flags frame.Flags) {
+	if f.attached.Load() {
+		return
+	}
+	msg, err := fanout.Message{
+		Instance: f.instance,
+		Kind:     fanout.KindFrame,
+		Format:   f.manager.OutputFormat(),
+		Header:   frame.Header{Captured: captured, Flags: flags},
+		PCM:      data,
+	}.Encode()
+	if err != nil {
+		f.logger.Debugf("Failed to encode frame: %v", err)
+		return
+	}
+	f.bus.Publish(msg)
+}
+
+// publishEvents publishes now-playing updates made on this instance, and
+// its state as soon as its source changes
+func (f *fanoutFollower) publishEvents(updates <-chan events.Event) {
+	for event := range updates {
+		if event.Type == "source" {
+			f.cluster.publish()
+			continue
+		}
+		md, ok := event.Data.(ws.Metadata)
+		if event.Type != "metadata" || !ok {
+			continue
+		}
+		f.metadataMu.Lock()
+		echo := f.applied != nil && *f.applied == md
+		f.applied = nil
+		f.metadataMu.Unlock()
+		if echo {
+			continue
+		}
+		msg, err := fanout.Message{Instance: f.instance, Kind: fanout.KindMetadata, Metadata: md}.Encode()
+		if err != nil {
+			continue
+		}
+		f.bus.Publish(msg)
+	}
+}
+
+// subscribe follows the bus, reconnecting with a backoff when it is lost
+func (f *fanoutFollower) subscribe() {
+	delay := minFanoutDelay
+	for {
+		started := time.Now()
+		err := f.bus.Subscribe(context.Background(), f.handle)
+		f.logger.Warnf("Not subscribed to the fanout bus, retrying in %s: %v", delay, err)
+
+		// A subscription that lasted a while starts the backoff over
+		if time.Since(started) > maxFanoutDelay {
+			delay = minFanoutDelay
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxFanoutDelay)
+	}
+}
+
+// handle takes a message published by any instance
+func (f *fanoutFollower) handle(data []byte) {
+	msg, err := fanout.Decode(data)
+	if err != nil || msg.Instance == f.instance {
+		return
+	}
+	switch msg.Kind {
+	case fanout.KindMetadata:
+		if msg.Metadata == f.manager.Metadata() {
+			return
+		}
+		f.metadataMu.Lock()
+		f.applied = &msg.Metadata
+		f.metadataMu.Unlock()
+		f.manager.SetMetadata(msg.Metadata)
+	case fanout.KindFrame:
+		f.frame(msg)
+	case fanout.KindState:
+		f.cluster.update(msg.Instance, msg.State)
+	}
+}
+
+// frame broadcasts another instance's frame, claiming the source slot for
+// it unless a local source holds it
+func (f *fanoutFollower) frame(msg fanout.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.attached.Load() {
+		info := ws.ConnInfo{Transport: "fanout", RemoteAddr: msg.Instance, ConnectedAt: time.Now()}
+		if err := f.manager.AttachSource(f, info, msg.Format); err != nil {
+			if err == ws.ErrSourceConnected && !f.busy {
+				f.logger.Warnf("Ignoring the source of %s while a local source is connected", msg.Instance)
+				f.busy = true
+			}
+			return
+		}
+		f.attached.Store(true)
+		f.busy = false
+		f.from, f.format = msg.Instance, msg.Format
+		f.checkFormat()
+		f.logger.Infof("Following the source of %s", msg.Instance)
+	} else if msg.Instance != f.from {
+		// Two instances with sources; keep following the first
+		return
+	} else if msg.Format != f.format {
+		if err := f.manager.SetSourceFormat(f, msg.Format); err != nil {
+			f.logger.Warnf("Failed to follow format of %s: %v", msg.Instance, err)
+			return
+		}
+		f.format = msg.Format
+		f.checkFormat()
+	}
+
+	f.lastHeard.Store(time.Now().UnixNano())
+	if !f.mismatch {
+		f.manager.BroadcastFrame(msg.PCM, msg.Header.Captured, msg.Header.Flags)
+	}
+}
+
+// checkFormat notes whether the followed frames can be broadcast as they
+// are, which needs the instances to share their audio settings. Called
+// with the lock held.
+func (f *fanoutFollower) checkFormat() {
+	f.mismatch = f.manager.OutputFormat() != f.format
+	if f.mismatch {
+		f.logger.Warnf("Cannot follow %s: its %d Hz/%d channel audio would need converting here; give instances the same settings",
+			f.from, f.format.SampleRate, f.format.Channels)
+	}
+}
+
+// watch releases the source slot once the followed instance goes quiet
+func (f *fanoutFollower) watch() {
+	ticker := time.NewTicker(fanoutTimeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.mu.Lock()
+		if f.attached.Load() && time.Since(time.Unix(0, f.lastHeard.Load())) > fanoutTimeout {
+			f.logger.Infof("Lost the source of %s", f.from)
+			f.release()
+		}
+		f.mu.Unlock()
+	}
+}
+
+// release lets the source slot go. Called with the lock held.
+func (f *fanoutFollower) release() {
+	f.attached.Store(false)
+	f.manager.DetachSource(f)
+}
+
+// Close lets the source slot go when the Manager drops the follower, e.g.
+// for maintenance; frames that follow claim it again once allowed
+func (f *fanoutFollower) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.release()
+	return nil
+}
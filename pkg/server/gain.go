@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// SourceGain is the gain of the source, in dB
+type SourceGain struct {
+	GainDB float64 `json:"gain_db"`
+}
+
+// handleSourceGain returns the gain the source applies on GET, and asks it
+// to change it on PUT. The source confirms the change asynchronously, so a
+// PUT is answered with 202 Accepted.
+func (s *Server) handleSourceGain(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	var gain SourceGain
+	switch r.Method {
+	case http.MethodGet:
+		current, ok := s.wsManager.SourceGain()
+		if !ok {
+			http.Error(w, "the source does not report a gain", http.StatusNotFound)
+			return
+		}
+		gain.GainDB = current
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&gain); err != nil {
+			http.Error(w, fmt.Sprintf("invalid gain: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.wsManager.SetSourceGain(gain.GainDB); err != nil {
+			code := http.StatusBadRequest
+			if errors.Is(err, ws.ErrNoSource) || errors.Is(err, ws.ErrNoGainControl) {
+				code = http.StatusConflict
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		status = http.StatusAccepted
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(gain); err != nil {
+		s.logger.Errorf("Failed to encode gain: %v", err)
+	}
+}
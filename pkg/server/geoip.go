@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoRecord is the part of a GeoIP2 or GeoLite2 Country or City record
+// listeners are tagged with. Country databases have no city.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// geoIP locates listeners from a MaxMind database
+type geoIP struct {
+	reader *maxminddb.Reader
+}
+
+// startGeoIP opens the GeoIP database and tags listeners with where they
+// connect from
+func (s *Server) startGeoIP() error {
+	reader, err := maxminddb.Open(s.config.GeoIPDB)
+	if err != nil {
+		return fmt.Errorf("failed to open GeoIP database: %v", err)
+	}
+	s.geoIP = &geoIP{reader: reader}
+	s.wsManager.SetLocator(s.geoIP.locate)
+	s.metrics.collect(s.writeGeoMetrics)
+	s.logger.Infof("Locating listeners with %s (%s, built %d)", s.config.GeoIPDB,
+		reader.Metadata.DatabaseType, reader.Metadata.BuildEpoch)
+	return nil
+}
+
+// locate returns the country code and English city name of the address,
+// or empty strings when it is not in the database, such as private
+// addresses
+func (g *geoIP) locate(remoteAddr string) (country, city string) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", ""
+	}
+	var record geoRecord
+	if err := g.reader.Lookup(ip, &record); err != nil {
+		return "", ""
+	}
+	return record.Country.ISOCode, record.City.Names["en"]
+}
+
+// GeoCount is how many listeners are connected from one place
+type GeoCount struct {
+	Country   string `json:"country"`
+	City      string `json:"city,omitempty"`
+	Listeners int    `json:"listeners"`
+}
+
+// geography counts the remote listeners by country, and by city as well
+// when byCity is set, largest first. Listeners that could not be located
+// count under an empty country.
+func (s *Server) geography(byCity bool) []GeoCount {
+	type place struct{ country, city string }
+	counts := make(map[place]int)
+	for _, l := range s.wsManager.Stats().Listeners {
+		if l.Transport != "websocket" && l.Transport != "http" && l.Transport != "webrtc" {
+			continue
+		}
+		p := place{country: l.Country}
+		if byCity {
+			p.city = l.City
+		}
+		counts[p]++
+	}
+
+	geo := make([]GeoCount, 0, len(counts))
+	for p, n := range counts {
+		geo = append(geo, GeoCount{Country: p.country, City: p.city, Listeners: n})
+	}
+	sort.Slice(geo, func(i, j int) bool {
+		if geo[i].Listeners != geo[j].Listeners {
+			return geo[i].Listeners > geo[j].Listeners
+		}
+		if geo[i].Country != geo[j].Country {
+			return geo[i].Country < geo[j].Country
+		}
+		return geo[i].City < geo[j].City
+	})
+	return geo
+}
+
+// handleGeo returns how many listeners are connected from each country,
+// or each city with ?by=city
+func (s *Server) handleGeo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.geoIP == nil {
+		http.Error(w, "listeners are not located; start the server with -geoip-db", http.StatusNotFound)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by != "" && by != "country" && by != "city" {
+		http.Error(w, "by must be country or city", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.geography(by == "city")); err != nil {
+		s.logger.Errorf("Failed to encode listener geography: %v", err)
+	}
+}
+
+// writeGeoMetrics writes the listeners by country and city
+func (s *Server) writeGeoMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP minicast_listeners_by_country Remote listeners by country (ISO 3166 code, empty when unknown).\n"+
+		"# TYPE minicast_listeners_by_country gauge\n")
+	for _, g := range s.geography(false) {
+		fmt.Fprintf(w, "minicast_listeners_by_country{country=%q} %d\n", g.Country, g.Listeners)
+	}
+	fmt.Fprintf(w, "# HELP minicast_listeners_by_city Remote listeners by city (empty when unknown).\n"+
+		"# TYPE minicast_listeners_by_city gauge\n")
+	for _, g := range s.geography(true) {
+		fmt.Fprintf(w, "minicast_listeners_by_city{country=%q,city=%q} %d\n", g.Country, g.City, g.Listeners)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// holdFrameSamples is how many samples per channel the hold audio is sent
+// in, and faded over when it starts and stops
+const holdFrameSamples = 4096
+
+// errHoldMaintenance is returned when holding during maintenance, which
+// already keeps the source off air
+var errHoldMaintenance = errors.New("cannot hold during maintenance")
+
+// Hold is a request to put the broadcast on hold
+type Hold struct {
+	Message string `json:"message"`
+}
+
+// holdLoop tracks the audio played to listeners while the broadcast is on
+// hold
+type holdLoop struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// announcement is the PCM looped to listeners, in the broadcast
+	// format, or nil for silence
+	announcement []byte
+}
+
+// startHold puts the broadcast on hold, or changes the message of an
+// active hold
+func (s *Server) startHold(message string) error {
+	if _, ok := s.wsManager.Maintenance(); ok {
+		return errHoldMaintenance
+	}
+
+	h := &s.hold
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s.wsManager.EnterHold(message)
+	if h.cancel == nil {
+		var ctx context.Context
+		ctx, h.cancel = context.WithCancel(context.Background())
+		h.done = make(chan struct{})
+		go func(done chan struct{}) {
+			defer close(done)
+			s.playHold(ctx)
+		}(h.done)
+	}
+	return nil
+}
+
+// endHold fades out the hold audio and resumes broadcasting the source
+func (s *Server) endHold() {
+	h := &s.hold
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.cancel == nil {
+		return
+	}
+	h.cancel()
+	<-h.done
+	h.cancel, h.done = nil, nil
+	s.wsManager.ExitHold()
+}
+
+// playHold loops the hold audio to listeners until ctx is done. It is
+// played in the format listeners are receiving, so the source resumes
+// without a format change, and fades in at the start and out at the end.
+func (s *Server) playHold(ctx context.Context) {
+	var (
+		format ws.SourceFormat
+		r      *loopReader
+		gain   float64
+	)
+	next := time.Now()
+	for {
+		if current := s.wsManager.OutputFormat(); r == nil || current != format {
+			format = current
+			r = &loopReader{data: s.holdAudio(format)}
+		}
+		frame := make([]byte, holdFrameSamples*format.Channels*2)
+		io.ReadFull(r, frame)
+
+		target := 1.0
+		if ctx.Err() != nil {
+			target = 0
+		}
+		if gain != target {
+			pcm := audio.BytesToPCM(frame)
+			audio.Ramp(pcm, format.Channels, gain, target)
+			frame, gain = audio.PCMToBytes(pcm), target
+		}
+		s.wsManager.BroadcastAnnouncement(frame)
+		if target == 0 {
+			return
+		}
+
+		next = next.Add(time.Duration(holdFrameSamples) * time.Second / time.Duration(format.SampleRate))
+		wait := time.Until(next)
+		if wait < -time.Second {
+			// Fell far behind; resync the clock
+			next, wait = time.Now(), 0
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// holdAudio returns the hold announcement converted to format
+func (s *Server) holdAudio(format ws.SourceFormat) []byte {
+	if s.hold.announcement == nil {
+		return make([]byte, format.Channels*2)
+	}
+
+	broadcast := s.wsManager.BroadcastFormat()
+	pcm := audio.NewMixer(broadcast.Channels, format.Channels).Process(audio.BytesToPCM(s.hold.announcement))
+	if format.SampleRate != broadcast.SampleRate {
+		pcm = audio.NewLinearResampler(format.Channels, broadcast.SampleRate, format.SampleRate).Process(pcm)
+	}
+	return audio.PCMToBytes(pcm)
+}
+
+// handleHold returns the hold on GET, starts one on PUT and resumes the
+// broadcast on DELETE
+func (s *Server) handleHold(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var hold Hold
+		if err := json.NewDecoder(r.Body).Decode(&hold); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("invalid hold: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.startHold(hold.Message); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case http.MethodDelete:
+		s.endHold()
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var status *ws.HoldState
+	if state, ok := s.wsManager.Hold(); ok {
+		status = &state
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.logger.Errorf("Failed to encode hold: %v", err)
+	}
+}
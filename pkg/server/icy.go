@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+)
+
+const (
+	// icyMetaInt is the number of stream bytes between ICY metadata blocks
+	icyMetaInt = 16000
+
+	// icyMaxBlocks is the most 16-byte blocks a metadata length byte can describe
+	icyMaxBlocks = 255
+)
+
+// icyWriter interleaves SHOUTcast-style metadata blocks into a stream for
+// clients that asked for them with the Icy-MetaData request header
+type icyWriter struct {
+	w         io.Writer
+	untilMeta int
+	title     string
+	changed   bool
+}
+
+// newIcyWriter wraps w, inserting a metadata block every icyMetaInt bytes
+func newIcyWriter(w io.Writer) *icyWriter {
+	return &icyWriter{w: w, untilMeta: icyMetaInt}
+}
+
+// SetTitle changes the title sent in the next metadata block
+func (iw *icyWriter) SetTitle(title string) {
+	iw.title = title
+	iw.changed = true
+}
+
+// Write writes stream bytes, adding metadata blocks at the interval
+func (iw *icyWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > iw.untilMeta {
+			n = iw.untilMeta
+		}
+		m, err := iw.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+
+		iw.untilMeta -= n
+		if iw.untilMeta == 0 {
+			if _, err := iw.w.Write(iw.block()); err != nil {
+				return written, err
+			}
+			iw.untilMeta = icyMetaInt
+		}
+	}
+	return written, nil
+}
+
+// block returns the next metadata block: the title when it changed since the
+// last block, or a single zero length byte otherwise
+func (iw *icyWriter) block() []byte {
+	if !iw.changed {
+		return []byte{0}
+	}
+	iw.changed = false
+
+	meta := []byte("StreamTitle='" + iw.title + "';")
+	if len(meta) > icyMaxBlocks*16 {
+		meta = meta[:icyMaxBlocks*16]
+	}
+	blocks := (len(meta) + 15) / 16
+
+	block := make([]byte, 1+blocks*16)
+	block[0] = byte(blocks)
+	copy(block[1:], meta)
+	return block
+}
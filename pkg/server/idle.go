@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxIdleCheck bounds how often the server checks whether it is idle
+	maxIdleCheck = 10 * time.Second
+	// idleCommandTimeout is how long the idle command may run
+	idleCommandTimeout = time.Minute
+	// shutdownTimeout is how long an idle shutdown waits for requests in
+	// flight before closing their connections
+	shutdownTimeout = 5 * time.Second
+)
+
+// IdleEvent is the data of an "idle" event, published once the server has
+// had no source and no listeners for the idle timeout
+type IdleEvent struct {
+	Since time.Time `json:"since"`
+}
+
+// watchIdle calls stop once the server has had no source and no listeners
+// for the idle timeout. With an idle command, it runs that instead, once
+// each time the server goes idle, and keeps serving.
+func (s *Server) watchIdle(stop func()) {
+	timeout := s.config.IdleTimeout
+	since, fired := time.Now(), false
+	ticker := time.NewTicker(min(timeout/4, maxIdleCheck))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stats := s.wsManager.Stats()
+		if stats.Source != nil || s.audience(stats) > 0 {
+			since, fired = time.Now(), false
+			continue
+		}
+		if fired || time.Since(since) < timeout {
+			continue
+		}
+		fired = true
+		s.events.Publish("idle", IdleEvent{Since: since})
+		if len(s.config.IdleCommand) == 0 {
+			s.logger.Infof("Shutting down after %s without a source or listeners", timeout)
+			stop()
+			return
+		}
+		s.logger.Infof("Idle for %s, running the idle command", timeout)
+		go s.runIdleCommand(since)
+	}
+}
+
+// runIdleCommand runs the idle command, telling it since when the server
+// has been idle
+func (s *Server) runIdleCommand(since time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), idleCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.config.IdleCommand[0], s.config.IdleCommand[1:]...)
+	cmd.Env = append(os.Environ(), "MINICAST_IDLE_SINCE="+since.UTC().Format(time.RFC3339))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		s.logger.Warnf("Idle command failed: %v: %.256s", err, out)
+	}
+}
+
+// listen returns the socket to serve on: one passed in by systemd socket
+// activation or another on-demand launcher, or else addr bound now
+func listen(addr string) (net.Listener, error) {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		if fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS")); fds > 0 {
+			// Passed sockets start at file descriptor 3
+			f := os.NewFile(3, "listen")
+			defer f.Close()
+			ln, err := net.FileListener(f)
+			if err != nil {
+				return nil, fmt.Errorf("failed to use the activated socket: %v", err)
+			}
+			return ln, nil
+		}
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/events"
+	"github.com/maks112v/minicast/pkg/snapcast"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+// snapcastHello is a client's hello as it goes over the wire: a 26-byte
+// header and its JSON prefixed with its length
+func snapcastHello() []byte {
+	body := []byte(`{"HostName":"kitchen","ID":"00:11:22:33:44:55","SnapStreamProtocolVersion":2}`)
+	b := binary.LittleEndian.AppendUint16(nil, 5)
+	b = append(b, make([]byte, 20)...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(4+len(body)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+func TestIdleCountsSnapcastClients(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	snap, err := snapcast.Listen("127.0.0.1:0", time.Second, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+	s := &Server{
+		config:    Config{IdleTimeout: 40 * time.Millisecond},
+		logger:    logger,
+		wsManager: ws.NewManager(audio.NewProcessor(44100, 2, 16), logger),
+		events:    events.NewBus(),
+		snapcast:  snap,
+	}
+
+	conn, err := net.Dial("tcp", snap.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(snapcastHello()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); snap.Clients() == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the Snapcast client never connected")
+		}
+	}
+	if n := s.audience(s.wsManager.Stats()); n != 1 {
+		t.Fatalf("audience %d, want the Snapcast client", n)
+	}
+
+	stopped := make(chan struct{})
+	go s.watchIdle(func() { close(stopped) })
+	select {
+	case <-stopped:
+		t.Fatal("went idle with a Snapcast client connected")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Once the client leaves, the server goes idle
+	conn.Close()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not go idle once the Snapcast client left")
+	}
+}
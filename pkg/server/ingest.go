@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// startUDPIngest takes sources over UDP at UDPIngestAddr, alongside the
+// WebSocket endpoint
+func (s *Server) startUDPIngest() error {
+	if s.config.Passthrough {
+		return errors.New("udp ingest is not available in passthrough mode, since it needs framed sources")
+	}
+	if s.config.UDPIngestDelay <= 0 {
+		return fmt.Errorf("invalid udp ingest delay %s", s.config.UDPIngestDelay)
+	}
+	conn, err := net.ListenPacket("udp", s.config.UDPIngestAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start udp ingest: %v", err)
+	}
+
+	go func() {
+		defer conn.Close()
+		if err := s.wsManager.ServeUDP(context.Background(), conn, s.config.UDPIngestDelay); err != nil {
+			s.logger.Errorf("UDP ingest stopped: %v", err)
+		}
+	}()
+	s.logger.Infof("Taking UDP sources on %s", conn.LocalAddr())
+	return nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// ListenersEvent is the data of a "listeners" event, published when the
+// audience reaches one of the listener thresholds and again when it falls
+// back below it
+type ListenersEvent struct {
+	Threshold int  `json:"threshold"`
+	Listeners int  `json:"listeners"`
+	Above     bool `json:"above"`
+}
+
+// startListenerThresholds watches the audience for the listener
+// thresholds, if there are any
+func (s *Server) startListenerThresholds() error {
+	for _, threshold := range s.config.ListenerThresholds {
+		if threshold < 1 {
+			return fmt.Errorf("listener threshold %d must be at least 1", threshold)
+		}
+	}
+	if len(s.config.ListenerThresholds) > 0 {
+		go s.watchListenerThresholds()
+	}
+	return nil
+}
+
+// watchListenerThresholds samples the audience and publishes an event
+// whenever it crosses a listener threshold
+func (s *Server) watchListenerThresholds() {
+	above := make([]bool, len(s.config.ListenerThresholds))
+	ticker := time.NewTicker(audienceTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		count := s.audience(s.wsManager.Stats())
+		for i, threshold := range s.config.ListenerThresholds {
+			if now := count >= threshold; now != above[i] {
+				above[i] = now
+				s.events.Publish("listeners", ListenersEvent{Threshold: threshold, Listeners: count, Above: now})
+			}
+		}
+	}
+}
+
+// handleListeners returns the connected listeners
+func (s *Server) handleListeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.wsManager.Stats().Listeners); err != nil {
+		s.logger.Errorf("Failed to encode listeners: %v", err)
+	}
+}
+
+// handleListener disconnects the listener whose ID ends the path on DELETE
+func (s *Server) handleListener(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/api/v1/listeners/"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid listener id", http.StatusBadRequest)
+		return
+	}
+
+	err = s.wsManager.Kick(id)
+	switch {
+	case errors.Is(err, ws.ErrNoListener):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// loudnessStale is how long without frames before momentary and short-term
+// loudness are no longer reported
+const loudnessStale = time.Second
+
+// loudnessMonitor is a listener metering the broadcast's loudness. The
+// integrated loudness restarts whenever a source connects, so it covers
+// the current show.
+type loudnessMonitor struct {
+	mu        sync.Mutex
+	meter     *audio.LoudnessMeter
+	since     time.Time
+	lastFrame time.Time
+}
+
+// Loudness is the API view of the loudness meter, in LUFS. Values are null
+// until there is enough audio to measure.
+type Loudness struct {
+	Momentary  *float64  `json:"momentary_lufs"`
+	ShortTerm  *float64  `json:"short_term_lufs"`
+	Integrated *float64  `json:"integrated_lufs"`
+	Target     float64   `json:"target_lufs"`
+	Since      time.Time `json:"since"`
+}
+
+// startLoudness registers a loudness meter on the broadcast
+func (s *Server) startLoudness() {
+	format := s.wsManager.OutputFormat()
+	s.loudness = &loudnessMonitor{
+		meter: audio.NewLoudnessMeter(format.SampleRate, format.Channels),
+		since: time.Now(),
+	}
+
+	events, _ := s.events.Subscribe(16)
+	go func() {
+		for event := range events {
+			if source, ok := event.Data.(ws.SourceEvent); ok && source.Connected {
+				s.loudness.reset()
+			}
+		}
+	}()
+
+	profile, _ := ws.LookupProfile("low-latency")
+	info := ws.ConnInfo{Transport: "loudness", ConnectedAt: time.Now()}
+	s.wsManager.AddListener(s.loudness, info, profile, nil)
+	s.metrics.collect(s.writeLoudnessMetrics)
+}
+
+// Send measures one broadcast frame
+func (m *loudnessMonitor) Send(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.meter.Add(audio.BytesToPCM(data))
+	m.lastFrame = time.Now()
+	return nil
+}
+
+// SendFormat follows the broadcast to a new format
+func (m *loudnessMonitor) SendFormat(format ws.SourceFormat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.meter.SetFormat(format.SampleRate, format.Channels)
+	return nil
+}
+
+// Close does nothing; the monitor lasts as long as the server
+func (m *loudnessMonitor) Close() error {
+	return nil
+}
+
+// reset restarts the integrated loudness
+func (m *loudnessMonitor) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.meter.Reset()
+	m.since = time.Now()
+}
+
+// read returns the current measurements, with target as the goal
+func (m *loudnessMonitor) read(target float64) Loudness {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	loudness := Loudness{Integrated: lufs(m.meter.Integrated()), Target: target, Since: m.since}
+	if time.Since(m.lastFrame) < loudnessStale {
+		loudness.Momentary = lufs(m.meter.Momentary())
+		loudness.ShortTerm = lufs(m.meter.ShortTerm())
+	}
+	return loudness
+}
+
+// lufs returns v, or nil when nothing was measured
+func lufs(v float64) *float64 {
+	if math.IsInf(v, -1) {
+		return nil
+	}
+	v = math.Round(v*10) / 10
+	return &v
+}
+
+// handleLoudness returns the broadcast's loudness on GET, and restarts the
+// integrated loudness on DELETE
+func (s *Server) handleLoudness(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		s.loudness.reset()
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.loudness.read(s.config.LoudnessTarget)); err != nil {
+		s.logger.Errorf("Failed to encode loudness: %v", err)
+	}
+}
+
+// writeLoudnessMetrics adds the loudness to the Prometheus metrics
+func (s *Server) writeLoudnessMetrics(w io.Writer) {
+	loudness := s.loudness.read(s.config.LoudnessTarget)
+	for _, gauge := range []struct {
+		name, help string
+		value      *float64
+	}{
+		{"minicast_loudness_momentary_lufs", "Loudness of the last 400ms.", loudness.Momentary},
+		{"minicast_loudness_short_term_lufs", "Loudness of the last 3s.", loudness.ShortTerm},
+		{"minicast_loudness_integrated_lufs", "Loudness since the source connected.", loudness.Integrated},
+	} {
+		if gauge.value == nil {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", gauge.name, gauge.help, gauge.name, gauge.name, *gauge.value)
+	}
+	fmt.Fprintf(w, "# HELP minicast_loudness_target_lufs Loudness the stream should have.\n"+
+		"# TYPE minicast_loudness_target_lufs gauge\nminicast_loudness_target_lufs %g\n", loudness.Target)
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// Maintenance is a planned maintenance window. A missing Start begins
+// immediately and a missing End lasts until the window is cancelled.
+type Maintenance struct {
+	Message string     `json:"message"`
+	Start   *time.Time `json:"start,omitempty"`
+	End     *time.Time `json:"end,omitempty"`
+}
+
+// started reports whether the window has begun at now
+func (mt *Maintenance) started(now time.Time) bool {
+	return mt.Start == nil || !now.Before(*mt.Start)
+}
+
+// ended reports whether the window is over at now
+func (mt *Maintenance) ended(now time.Time) bool {
+	return mt.End != nil && !now.Before(*mt.End)
+}
+
+// maintenanceSchedule tracks the scheduled window and the announcement loop
+// played to listeners while it is active
+type maintenanceSchedule struct {
+	mu      sync.Mutex
+	window  *Maintenance
+	message string
+	timer   *time.Timer
+	cancel  context.CancelFunc
+
+	// announcement is the PCM looped to listeners, or nil for silence
+	announcement []byte
+}
+
+// scheduleMaintenance replaces the maintenance window; nil cancels it
+func (s *Server) scheduleMaintenance(window *Maintenance) {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+
+	s.maintenance.window = window
+	s.updateMaintenance()
+}
+
+// updateMaintenance enters or leaves maintenance according to the window
+// and arms a timer for the next transition. Called with the lock held.
+func (s *Server) updateMaintenance() {
+	m := &s.maintenance
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+
+	now := time.Now()
+	if m.window != nil && m.window.ended(now) {
+		m.window = nil
+	}
+	active := m.window != nil && m.window.started(now)
+
+	switch {
+	case active && (m.cancel == nil || m.message != m.window.Message):
+		m.message = m.window.Message
+		s.wsManager.EnterMaintenance(m.message)
+		if m.cancel == nil {
+			// Maintenance takes the source off air itself
+			s.endHold()
+			var ctx context.Context
+			ctx, m.cancel = context.WithCancel(context.Background())
+			go s.announce(ctx, m.announcement)
+		}
+	case !active && m.cancel != nil:
+		m.cancel()
+		m.cancel = nil
+		s.wsManager.ExitMaintenance()
+	}
+
+	var next *time.Time
+	if m.window != nil {
+		if active {
+			next = m.window.End
+		} else {
+			next = m.window.Start
+		}
+	}
+	if next != nil {
+		m.timer = time.AfterFunc(time.Until(*next), func() {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			s.updateMaintenance()
+		})
+	}
+}
+
+// announce loops an announcement to listeners until ctx is done
+func (s *Server) announce(ctx context.Context, pcm []byte) {
+	if pcm == nil {
+		pcm = make([]byte, audio.FrameBytes)
+	}
+
+	bytesPerSecond := s.audio.GetSampleRate() * s.audio.GetNumChannels() * 2
+	r := &loopReader{data: pcm}
+	if err := audio.Pace(ctx, r, bytesPerSecond, audio.FrameBytes, s.wsManager.BroadcastAnnouncement); err != nil {
+		s.logger.Errorf("Announcement failed: %v", err)
+	}
+}
+
+// loopReader reads data over and over
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+// Read fills p from data, wrapping around at the end
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.pos:])
+		n += c
+		r.pos = (r.pos + c) % len(r.data)
+	}
+	return n, nil
+}
+
+// loadAnnouncement decodes an audio file into PCM in the broadcast format
+func (s *Server) loadAnnouncement(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoded, err := audio.NewDecoder(mime.TypeByExtension(filepath.Ext(path)), f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(decoded)
+	if err != nil {
+		return nil, err
+	}
+	pcm := audio.BytesToPCM(data)
+
+	numChannels := s.audio.GetNumChannels()
+	switch {
+	case decoded.NumChannels == numChannels:
+	case decoded.NumChannels == 1:
+		pcm = upmix(pcm, numChannels)
+	default:
+		return nil, fmt.Errorf("announcement has %d channels, stream has %d", decoded.NumChannels, numChannels)
+	}
+
+	if decoded.SampleRate != s.audio.GetSampleRate() {
+		pcm = audio.NewLinearResampler(numChannels, decoded.SampleRate, s.audio.GetSampleRate()).Process(pcm)
+	}
+	if len(pcm) == 0 {
+		return nil, errors.New("announcement is empty")
+	}
+	return audio.PCMToBytes(pcm), nil
+}
+
+// upmix copies mono samples to every channel
+func upmix(mono []int16, numChannels int) []int16 {
+	out := make([]int16, 0, len(mono)*numChannels)
+	for _, sample := range mono {
+		for ch := 0; ch < numChannels; ch++ {
+			out = append(out, sample)
+		}
+	}
+	return out
+}
+
+// maintenanceStatus is the API view of the maintenance window
+type maintenanceStatus struct {
+	*Maintenance
+	Active bool `json:"active"`
+}
+
+// handleMaintenance returns the maintenance window on GET, schedules one on
+// PUT and cancels it on DELETE
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var window Maintenance
+		if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+			http.Error(w, fmt.Sprintf("invalid maintenance window: %v", err), http.StatusBadRequest)
+			return
+		}
+		if window.End != nil && window.Start != nil && !window.End.After(*window.Start) {
+			http.Error(w, "maintenance must end after it starts", http.StatusBadRequest)
+			return
+		}
+		if window.ended(time.Now()) {
+			http.Error(w, "maintenance window is in the past", http.StatusBadRequest)
+			return
+		}
+		s.scheduleMaintenance(&window)
+	case http.MethodDelete:
+		s.scheduleMaintenance(nil)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.maintenance.mu.Lock()
+	var status *maintenanceStatus
+	if s.maintenance.window != nil {
+		window := *s.maintenance.window
+		status = &maintenanceStatus{Maintenance: &window, Active: s.maintenance.cancel != nil}
+	}
+	s.maintenance.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.logger.Errorf("Failed to encode maintenance: %v", err)
+	}
+}
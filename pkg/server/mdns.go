@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/maks112v/minicast/pkg/mdns"
+)
+
+// mdnsName is the name the server is advertised under: MDNSName, or one
+// naming the host
+func (s *Server) mdnsName() string {
+	if s.config.MDNSName != "" {
+		return s.config.MDNSName
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "MiniCast"
+	}
+	return "MiniCast on " + strings.Split(host, ".")[0]
+}
+
+// startMDNS advertises the server on the LAN, so clients find it without
+// being given its address
+func (s *Server) startMDNS() error {
+	port, err := strconv.Atoi(s.port)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", s.port)
+	}
+	responder, err := mdns.Advertise(mdns.Service{
+		Instance: s.mdnsName(),
+		Type:     mdns.ServiceType,
+		Port:     port,
+		TXT:      []string{"path=/ws", "stream=/stream"},
+	}, s.logger.With("module", "mdns"))
+	if err != nil {
+		return fmt.Errorf("failed to advertise over mDNS: %v", err)
+	}
+	s.mdns = responder
+	s.logger.Infof("Advertising as %q (%s) over mDNS", s.mdnsName(), mdns.ServiceType)
+	return nil
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// httpMetrics counts requests, responses by status class and latency for
+// each route, keyed by the pattern the route was registered with. Latency
+// is the time to the first byte of the response, so streams and WebSocket
+// upgrades are measured by how quickly they start rather than how long
+// they run.
+type httpMetrics struct {
+	mux     *http.ServeMux
+	started time.Time
+
+	mu     sync.Mutex
+	routes map[string]*routeMetrics
+
+	// collectors write further metrics after the HTTP ones
+	collectors []func(w io.Writer)
+}
+
+// routeMetrics are the counters for one route
+type routeMetrics struct {
+	// classes counts responses by status class, 1xx to 5xx
+	classes  [6]uint64
+	inFlight int64
+
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// newHTTPMetrics creates metrics for the routes registered on mux
+func newHTTPMetrics(mux *http.ServeMux) *httpMetrics {
+	return &httpMetrics{mux: mux, started: time.Now(), routes: make(map[string]*routeMetrics)}
+}
+
+// route returns the counters for pattern, creating them. Called with the
+// lock held.
+func (m *httpMetrics) route(pattern string) *routeMetrics {
+	rm, ok := m.routes[pattern]
+	if !ok {
+		rm = &routeMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		m.routes[pattern] = rm
+	}
+	return rm
+}
+
+// collect adds a function writing further Prometheus metrics. Call it
+// before serving.
+func (m *httpMetrics) collect(collector func(w io.Writer)) {
+	m.collectors = append(m.collectors, collector)
+}
+
+// middleware records every request served by next
+func (m *httpMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := m.mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		m.mu.Lock()
+		m.route(pattern).inFlight++
+		m.mu.Unlock()
+
+		rec := &recordingWriter{ResponseWriter: w, start: time.Now()}
+		defer func() {
+			status, latency := rec.result()
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			rm := m.route(pattern)
+			rm.inFlight--
+			rm.classes[min(max(status/100, 0), 5)]++
+			rm.count++
+			rm.sum += latency.Seconds()
+			for i, bound := range latencyBuckets {
+				if latency.Seconds() <= bound {
+					rm.buckets[i]++
+				}
+			}
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// recordingWriter notes a response's status and when its first byte was
+// written. It passes through flushing and hijacking, which streams and
+// WebSockets need.
+type recordingWriter struct {
+	http.ResponseWriter
+	start time.Time
+
+	status    int
+	firstByte time.Time
+}
+
+// WriteHeader records the status
+func (w *recordingWriter) WriteHeader(status int) {
+	w.wrote(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.wrote(http.StatusOK)
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush flushes the underlying writer
+func (w *recordingWriter) Flush() {
+	w.wrote(http.StatusOK)
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, which counts as switching protocols
+func (w *recordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	w.wrote(http.StatusSwitchingProtocols)
+	return h.Hijack()
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// wrote records the first status written
+func (w *recordingWriter) wrote(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.firstByte = time.Now()
+	}
+}
+
+// result returns the status and latency once the handler has returned
+func (w *recordingWriter) result() (int, time.Duration) {
+	if w.status == 0 {
+		return http.StatusOK, time.Since(w.start)
+	}
+	return w.status, w.firstByte.Sub(w.start)
+}
+
+// snapshot copies the counters, sorted by route
+func (m *httpMetrics) snapshot() ([]string, map[string]routeMetrics) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	patterns := make([]string, 0, len(m.routes))
+	routes := make(map[string]routeMetrics, len(m.routes))
+	for pattern, rm := range m.routes {
+		patterns = append(patterns, pattern)
+		copied := *rm
+		copied.buckets = append([]uint64(nil), rm.buckets...)
+		routes[pattern] = copied
+	}
+	sort.Strings(patterns)
+	return patterns, routes
+}
+
+// quantile estimates the q-th latency quantile from the histogram, as the
+// upper bound of the bucket it falls in
+func (rm routeMetrics) quantile(q float64) string {
+	if rm.count == 0 {
+		return "-"
+	}
+	rank := uint64(q * float64(rm.count))
+	for i, n := range rm.buckets {
+		if n > rank {
+			return "<" + (time.Duration(latencyBuckets[i] * float64(time.Second))).String()
+		}
+	}
+	return ">" + (time.Duration(latencyBuckets[len(latencyBuckets)-1] * float64(time.Second))).String()
+}
+
+// handleMetrics serves the metrics in the Prometheus text format
+func (m *httpMetrics) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	patterns, routes := m.snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var b strings.Builder
+	b.WriteString("# HELP minicast_http_requests_total HTTP requests by route and status class.\n")
+	b.WriteString("# TYPE minicast_http_requests_total counter\n")
+	for _, pattern := range patterns {
+		for class, n := range routes[pattern].classes {
+			if n > 0 {
+				fmt.Fprintf(&b, "minicast_http_requests_total{route=%q,code=\"%dxx\"} %d\n", pattern, class, n)
+			}
+		}
+	}
+
+	b.WriteString("# HELP minicast_http_requests_in_flight HTTP requests being served, including open streams.\n")
+	b.WriteString("# TYPE minicast_http_requests_in_flight gauge\n")
+	for _, pattern := range patterns {
+		fmt.Fprintf(&b, "minicast_http_requests_in_flight{route=%q} %d\n", pattern, routes[pattern].inFlight)
+	}
+
+	b.WriteString("# HELP minicast_http_first_byte_seconds Time to the first byte of the response.\n")
+	b.WriteString("# TYPE minicast_http_first_byte_seconds histogram\n")
+	for _, pattern := range patterns {
+		rm := routes[pattern]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "minicast_http_first_byte_seconds_bucket{route=%q,le=\"%s\"} %d\n",
+				pattern, strconv.FormatFloat(bound, 'g', -1, 64), rm.buckets[i])
+		}
+		fmt.Fprintf(&b, "minicast_http_first_byte_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", pattern, rm.count)
+		fmt.Fprintf(&b, "minicast_http_first_byte_seconds_sum{route=%q} %g\n", pattern, rm.sum)
+		fmt.Fprintf(&b, "minicast_http_first_byte_seconds_count{route=%q} %d\n", pattern, rm.count)
+	}
+	for _, collector := range m.collectors {
+		collector(&b)
+	}
+	w.Write([]byte(b.String()))
+}
+
+// handleStatus serves a plain text summary of the metrics for operators
+func (m *httpMetrics) handleStatus(w http.ResponseWriter, r *http.Request) {
+	patterns, routes := m.snapshot()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	fmt.Fprintf(w, "MiniCast up %s\n\n", time.Since(m.started).Round(time.Second))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "ROUTE\tREQUESTS\tACTIVE\t4XX\t5XX\tERROR RATE\tP50\tP95\tP99\t")
+	for _, pattern := range patterns {
+		rm := routes[pattern]
+		rate := "-"
+		if rm.count > 0 {
+			rate = fmt.Sprintf("%.1f%%", 100*float64(rm.classes[5])/float64(rm.count))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t\n", pattern, rm.count, rm.inFlight,
+			rm.classes[4], rm.classes[5], rate, rm.quantile(0.5), rm.quantile(0.95), rm.quantile(0.99))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/mp3"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// MP3 encoders, for Config.MP3Encoder
+const (
+	// MP3EncoderGo is the built-in pure Go encoder
+	MP3EncoderGo = "go"
+)
+
+// validateMP3 checks the MP3 encoder settings
+func (s *Server) validateMP3() error {
+	switch s.config.MP3Encoder {
+	case "":
+		return nil
+	case MP3EncoderGo:
+	default:
+		return fmt.Errorf("unknown mp3 encoder %q", s.config.MP3Encoder)
+	}
+	if !slices.Contains(mp3.Bitrates, s.config.MP3Bitrate) {
+		return fmt.Errorf("unsupported mp3 bitrate %dkbit/s (available: %v)", s.config.MP3Bitrate, mp3.Bitrates)
+	}
+	return nil
+}
+
+// mp3Encoding encodes broadcast frames as MP3, converting sample rates MP3
+// cannot carry
+type mp3Encoding struct {
+	bitrate int
+
+	format    ws.SourceFormat
+	resampler audio.Stage
+	enc       *mp3.Encoder
+	rate      int
+	// fed counts the samples per channel given to enc, which has completed
+	// a frame for every mp3.FrameSize of them
+	fed int
+}
+
+// encode encodes the frame and returns the MP3 frames it completes
+func (e *mp3Encoding) encode(data []byte) ([]byte, error) {
+	pcm := audio.BytesToPCM(data)
+	if e.resampler != nil {
+		pcm = e.resampler.Process(pcm)
+	}
+	e.fed += len(pcm) / e.format.Channels
+	return e.enc.Encode(pcm)
+}
+
+// encoded returns how much audio the frames completed by enc hold
+func (e *mp3Encoding) encoded() time.Duration {
+	if e.enc == nil {
+		return 0
+	}
+	return time.Duration(e.fed/mp3.FrameSize*mp3.FrameSize) * time.Second / time.Duration(e.rate)
+}
+
+// setFormat starts a new encoder when the rate or channel count changes
+func (e *mp3Encoding) setFormat(format ws.SourceFormat) error {
+	if e.enc != nil && format.SampleRate == e.format.SampleRate && format.Channels == e.format.Channels {
+		return nil
+	}
+	if format.Channels > 2 {
+		return fmt.Errorf("mp3 streams carry at most 2 channels, not %d", format.Channels)
+	}
+
+	// MP3 encodes at 32, 44.1 and 48kHz, so other rates are converted
+	rate := format.SampleRate
+	e.resampler = nil
+	switch rate {
+	case 32000, 44100, 48000:
+	default:
+		rate = 44100
+		e.resampler = audio.NewSincResampler(format.Channels, format.SampleRate, rate)
+	}
+	enc, err := mp3.NewEncoder(rate, format.Channels, e.bitrate)
+	if err != nil {
+		return err
+	}
+	e.format, e.enc, e.rate, e.fed = format, enc, rate, 0
+	return nil
+}
+
+// mp3Listener streams broadcast frames as MP3, with ICY metadata for radio
+// clients that ask for it
+type mp3Listener struct {
+	mp3Encoding
+	w       io.Writer
+	flusher http.Flusher
+	icy     *icyWriter
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Send encodes the frame and writes the MP3 frames it completes
+func (l *mp3Listener) Send(data []byte) error {
+	frames, err := l.encode(data)
+	if err != nil || len(frames) == 0 {
+		return err
+	}
+	if _, err := l.w.Write(frames); err != nil {
+		return err
+	}
+	l.flusher.Flush()
+	return nil
+}
+
+// SendFormat starts a new encoder when the rate or channel count changes.
+// MP3 frames each carry their format, so players follow along.
+func (l *mp3Listener) SendFormat(format ws.SourceFormat) error {
+	return l.setFormat(format)
+}
+
+// SendMetadata updates the ICY title for clients that requested metadata
+func (l *mp3Listener) SendMetadata(md ws.Metadata) error {
+	if l.icy != nil {
+		l.icy.SetTitle(md.StreamTitle())
+	}
+	return nil
+}
+
+// Close ends the response
+func (l *mp3Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// handleMP3Stream serves the live stream as MP3, the format every radio
+// client and smart speaker plays
+func (s *Server) handleMP3Stream(w http.ResponseWriter, r *http.Request) {
+	if s.config.MP3Encoder == "" {
+		http.Error(w, "the mp3 stream is disabled", http.StatusNotFound)
+		return
+	}
+	if s.config.Passthrough {
+		http.Error(w, "the mp3 stream is not available in passthrough mode", http.StatusBadRequest)
+		return
+	}
+	profile, err := s.listenerProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if profile.Format == ws.FormatFramed {
+		http.Error(w, "framed audio is only available over WebSockets", http.StatusBadRequest)
+		return
+	}
+	feed, err := s.listenerFeed(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	listener := &mp3Listener{mp3Encoding: mp3Encoding{bitrate: s.config.MP3Bitrate}, w: w, flusher: flusher, done: make(chan struct{})}
+	if err := listener.SendFormat(s.wsManager.ListenerFormat(profile)); err != nil {
+		http.Error(w, err.Error()+", ask for ?channels=1", http.StatusBadRequest)
+		return
+	}
+	if !s.admit(w, r) {
+		return
+	}
+
+	s.markListener(r, profile)
+	if r.Header.Get("Icy-MetaData") == "1" {
+		listener.icy = newIcyWriter(w)
+		listener.w = listener.icy
+		w.Header().Set("icy-metaint", strconv.Itoa(icyMetaInt))
+		w.Header().Set("icy-name", "MiniCast")
+	}
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("icy-br", strconv.Itoa(s.config.MP3Bitrate))
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	s.wsManager.AddListener(listener, ws.RequestInfo(r, "http"), profile, feed)
+	defer s.wsManager.RemoveListener(listener)
+
+	waitListener(w, r, listener.done)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/mpegts"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// tsService names the program in the transport stream
+const tsService = "MiniCast"
+
+// tsListener streams broadcast frames as an MPEG transport stream carrying
+// the MP3 encoding, over HTTP or to a UDP address
+type tsListener struct {
+	mp3Encoding
+	mux     *mpegts.Muxer
+	flusher http.Flusher
+	conn    *net.UDPConn
+
+	// base is the stream time the current encoder started at
+	base time.Duration
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Send encodes the frame and muxes the MP3 frames it completes, timed by
+// the audio before them
+func (l *tsListener) Send(data []byte) error {
+	start := l.base + l.encoded()
+	frames, err := l.encode(data)
+	if err != nil || len(frames) == 0 {
+		return err
+	}
+	if err := l.mux.WriteAudio(start, frames); err != nil {
+		return err
+	}
+	if l.flusher != nil {
+		l.flusher.Flush()
+	}
+	return nil
+}
+
+// SendFormat starts a new encoder when the rate or channel count changes,
+// its frames carrying on the stream time where the last one's stopped
+func (l *tsListener) SendFormat(format ws.SourceFormat) error {
+	enc, elapsed := l.enc, l.encoded()
+	if err := l.setFormat(format); err != nil {
+		return err
+	}
+	if l.enc != enc && enc != nil {
+		l.base += elapsed
+	}
+	return nil
+}
+
+// SendMetadata does nothing: the service name stays the same
+func (l *tsListener) SendMetadata(ws.Metadata) error {
+	return nil
+}
+
+// udpWriter sends each write as one datagram to addr. The socket is not
+// connected, so an ICMP port unreachable from a receiver that is not running
+// yet does not fail the next write.
+type udpWriter struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (w udpWriter) Write(b []byte) (int, error) {
+	return w.conn.WriteToUDP(b, w.addr)
+}
+
+// Close ends the response, or closes the UDP socket
+func (l *tsListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		if l.conn != nil {
+			err = l.conn.Close()
+		}
+	})
+	return err
+}
+
+// handleTSStream serves the live stream as MPEG-TS, for broadcast tooling
+// and set-top boxes
+func (s *Server) handleTSStream(w http.ResponseWriter, r *http.Request) {
+	if s.config.MP3Encoder == "" {
+		http.Error(w, "the MPEG-TS stream needs the mp3 encoder, which is disabled", http.StatusNotFound)
+		return
+	}
+	if s.config.Passthrough {
+		http.Error(w, "the MPEG-TS stream is not available in passthrough mode", http.StatusBadRequest)
+		return
+	}
+	profile, err := s.listenerProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if profile.Format == ws.FormatFramed {
+		http.Error(w, "framed audio is only available over WebSockets", http.StatusBadRequest)
+		return
+	}
+	feed, err := s.listenerFeed(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	listener := &tsListener{
+		mp3Encoding: mp3Encoding{bitrate: s.config.MP3Bitrate},
+		mux:         mpegts.NewMuxer(w, tsService),
+		flusher:     flusher,
+		done:        make(chan struct{}),
+	}
+	if err := listener.SendFormat(s.wsManager.ListenerFormat(profile)); err != nil {
+		http.Error(w, err.Error()+", ask for ?channels=1", http.StatusBadRequest)
+		return
+	}
+	if !s.admit(w, r) {
+		return
+	}
+
+	s.markListener(r, profile)
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	s.wsManager.AddListener(listener, ws.RequestInfo(r, "http"), profile, feed)
+	defer s.wsManager.RemoveListener(listener)
+
+	waitListener(w, r, listener.done)
+}
+
+// startTSUDP registers a listener sending the stream as MPEG-TS to a
+// unicast or multicast UDP address, seven packets per datagram as IPTV
+// receivers expect
+func (s *Server) startTSUDP() error {
+	if s.config.MP3Encoder == "" {
+		return errors.New("MPEG-TS over UDP needs the mp3 encoder")
+	}
+	if s.config.Passthrough {
+		return errors.New("MPEG-TS over UDP is not available in passthrough mode")
+	}
+	addr, err := net.ResolveUDPAddr("udp", s.config.TSUDPAddr)
+	if err != nil {
+		return fmt.Errorf("invalid MPEG-TS UDP address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("failed to start MPEG-TS output: %v", err)
+	}
+
+	// Receivers buffer up to the presentation delay, so stay as close to
+	// live as possible
+	profile, _ := ws.LookupProfile("low-latency")
+	listener := &tsListener{
+		mp3Encoding: mp3Encoding{bitrate: s.config.MP3Bitrate},
+		mux:         mpegts.NewMuxer(udpWriter{conn: conn, addr: addr}, tsService),
+		conn:        conn,
+		done:        make(chan struct{}),
+	}
+	if err := listener.SendFormat(s.wsManager.ListenerFormat(profile)); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start MPEG-TS output: %v", err)
+	}
+	info := ws.ConnInfo{Transport: "mpegts", RemoteAddr: s.config.TSUDPAddr, ConnectedAt: time.Now()}
+	s.wsManager.AddListener(listener, info, profile, nil)
+	s.logger.Infof("Sending MPEG-TS to udp://%s", s.config.TSUDPAddr)
+	return nil
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/events"
+	"github.com/maks112v/minicast/pkg/mqtt"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	minMQTTDelay = time.Second
+	maxMQTTDelay = 30 * time.Second
+	// minMQTTInterval keeps level readings from flooding the broker
+	minMQTTInterval = 100 * time.Millisecond
+	// mqttKeepAlive is how often a quiet connection to the broker is
+	// pinged; the broker publishes the will once it has not heard from
+	// the server for half as long again
+	mqttKeepAlive = 30 * time.Second
+)
+
+// MQTTTopics are the topics status is published to. Empty ones are named
+// after the topic prefix: <prefix>/status and so on.
+type MQTTTopics struct {
+	// Status is "online" while the server is connected and "offline"
+	// once it is not, retained
+	Status string `yaml:"status,omitempty"`
+	// State is the stream's MQTTState as JSON, retained
+	State string `yaml:"state,omitempty"`
+	// Listeners is the number of listeners, retained
+	Listeners string `yaml:"listeners,omitempty"`
+	// Levels are the broadcast's ws.Levels as JSON, every interval
+	Levels string `yaml:"levels,omitempty"`
+}
+
+// MQTTState is the state of the stream published over MQTT
+type MQTTState struct {
+	// Live is whether listeners hear a source, as in the public stats
+	Live        bool         `json:"live"`
+	Source      *ws.ConnInfo `json:"source"`
+	Maintenance bool         `json:"maintenance"`
+	Hold        bool         `json:"hold"`
+	Listeners   int          `json:"listeners"`
+	Metadata    ws.Metadata  `json:"metadata"`
+}
+
+// mqttStatus publishes the stream's status to an MQTT broker, for home
+// automation and dashboards. It is a listener, so it can meter the
+// broadcast.
+type mqttStatus struct {
+	s        *Server
+	url      *url.URL
+	topics   MQTTTopics
+	interval time.Duration
+	logger   *zap.SugaredLogger
+
+	mu        sync.Mutex
+	meter     *audio.LevelMeter
+	channels  int
+	lastFrame time.Time
+}
+
+// startMQTT checks the MQTT settings and starts publishing status
+func (s *Server) startMQTT() error {
+	u, err := url.Parse(s.config.MQTTURL)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT URL: %v", err)
+	}
+	if u.Scheme != "mqtt" && u.Scheme != "mqtts" {
+		return fmt.Errorf("MQTT URL %s must be mqtt:// or mqtts://", u.Redacted())
+	}
+	if s.config.MQTTInterval < minMQTTInterval {
+		return fmt.Errorf("MQTT interval must be at least %s", minMQTTInterval)
+	}
+
+	topics := s.config.MQTTTopics
+	prefix := s.config.MQTTTopic
+	for _, topic := range []struct {
+		name *string
+		leaf string
+	}{{&topics.Status, "status"}, {&topics.State, "state"}, {&topics.Listeners, "listeners"}, {&topics.Levels, "levels"}} {
+		if *topic.name == "" {
+			if prefix == "" {
+				return fmt.Errorf("no MQTT topic for %s, and no prefix to name it after", topic.leaf)
+			}
+			*topic.name = prefix + "/" + topic.leaf
+		}
+	}
+
+	m := &mqttStatus{s: s, url: u, topics: topics, interval: s.config.MQTTInterval, logger: s.logger.With("module", "mqtt")}
+	profile, _ := ws.LookupProfile("low-latency")
+	info := ws.ConnInfo{Transport: "mqtt", RemoteAddr: u.Redacted(), ConnectedAt: time.Now()}
+	s.wsManager.AddListener(m, info, profile, nil)
+	go m.run()
+	return nil
+}
+
+// Send meters one broadcast frame
+func (m *mqttStatus) Send(data []byte) error {
+	format := m.s.wsManager.OutputFormat()
+	if format.Codec != ws.CodecPCM || format.BitDepth != 16 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.meter == nil || m.channels != format.Channels {
+		m.meter, m.channels = audio.NewLevelMeter(format.Channels), format.Channels
+	}
+	m.meter.Add(audio.BytesToPCM(data))
+	m.lastFrame = time.Now()
+	return nil
+}
+
+// Close does nothing: status is published for as long as the server runs
+func (m *mqttStatus) Close() error {
+	return nil
+}
+
+// levels returns the levels since the last reading, or false when there
+// has been no audio to meter
+func (m *mqttStatus) levels() (ws.Levels, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.meter == nil || time.Since(m.lastFrame) > m.interval {
+		return ws.Levels{}, false
+	}
+	peak, rms := m.meter.Read()
+	for ch := range peak {
+		peak[ch] = math.Round(peak[ch]*10) / 10
+		rms[ch] = math.Round(rms[ch]*10) / 10
+	}
+	return ws.Levels{Peak: peak, RMS: rms}, true
+}
+
+// state returns the stream's current state
+func (m *mqttStatus) state() MQTTState {
+	stats := m.s.wsManager.Stats()
+	return MQTTState{
+		Live:        stats.Source != nil && stats.Maintenance == nil && stats.Hold == nil,
+		Source:      stats.Source,
+		Maintenance: stats.Maintenance != nil,
+		Hold:        stats.Hold != nil,
+		Listeners:   m.s.audience(stats),
+		Metadata:    m.s.wsManager.Metadata(),
+	}
+}
+
+// run stays connected to the broker, reconnecting with a backoff, and
+// warns once per outage
+func (m *mqttStatus) run() {
+	updates, _ := m.s.events.Subscribe(16)
+	delay, failing := minMQTTDelay, false
+	for {
+		err := m.session(updates, func() {
+			m.logger.Infof("Publishing status to %s", m.url.Redacted())
+			delay, failing = minMQTTDelay, false
+		})
+		if !failing {
+			m.logger.Warnf("Not publishing status to %s, retrying: %v", m.url.Redacted(), err)
+			failing = true
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, maxMQTTDelay)
+	}
+}
+
+// session connects to the broker and publishes status until the
+// connection fails. The state is published as soon as an event may have
+// changed it, and checked again with every level reading.
+func (m *mqttStatus) session(updates <-chan events.Event, connected func()) error {
+	conn, err := mqtt.Dial(context.Background(), m.url, mqtt.Options{
+		ClientID:  "minicast-" + instanceName(),
+		KeepAlive: mqttKeepAlive,
+		Will:      &mqtt.Message{Topic: m.topics.Status, Payload: []byte("offline"), Retain: true},
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	connected()
+	if err := conn.Publish(mqtt.Message{Topic: m.topics.Status, Payload: []byte("online"), Retain: true}); err != nil {
+		return err
+	}
+
+	state := &mqttPayload{topic: m.topics.State}
+	listeners := &mqttPayload{topic: m.topics.Listeners}
+	update := func() error {
+		current := m.state()
+		data, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		if err := state.set(conn, data); err != nil {
+			return err
+		}
+		return listeners.set(conn, []byte(strconv.Itoa(current.Listeners)))
+	}
+	if err := update(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.Done():
+			return conn.Err()
+		case <-updates:
+			err = update()
+		case <-ticker.C:
+			err = update()
+			if levels, ok := m.levels(); ok && err == nil {
+				data, _ := json.Marshal(levels)
+				err = conn.Publish(mqtt.Message{Topic: m.topics.Levels, Payload: data})
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// mqttPayload is a retained value, published again only once it changes
+type mqttPayload struct {
+	topic string
+	last  []byte
+}
+
+// set publishes value if it differs from the last one published
+func (p *mqttPayload) set(conn *mqtt.Conn, value []byte) error {
+	if p.last != nil && string(p.last) == string(value) {
+		return nil
+	}
+	if err := conn.Publish(mqtt.Message{Topic: p.topic, Payload: value, Retain: true}); err != nil {
+		return err
+	}
+	p.last = value
+	return nil
+}
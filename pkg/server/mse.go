@@ -0,0 +1,140 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/mp4"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// mp4Listener streams broadcast frames as fragmented MP4 holding FLAC, which
+// browsers play gaplessly through MediaSource Extensions. Every broadcast
+// frame becomes one fragment.
+type mp4Listener struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	enc        *audio.FLACEncoder
+	format     ws.SourceFormat
+	seq        uint32
+	decodeTime uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// newMP4Listener creates a listener and writes the initialization segment
+// for format
+func newMP4Listener(w http.ResponseWriter, flusher http.Flusher, format ws.SourceFormat) (*mp4Listener, error) {
+	l := &mp4Listener{w: w, flusher: flusher, done: make(chan struct{})}
+	if err := l.SendFormat(format); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Send encodes the frame into a fragment and flushes it to the client
+func (l *mp4Listener) Send(data []byte) error {
+	pcm := audio.BytesToPCM(data)
+	n := l.format.Channels
+	pcm = pcm[:len(pcm)-len(pcm)%n]
+	if len(pcm) == 0 {
+		return nil
+	}
+
+	var frames [][]byte
+	var durations []uint32
+	for len(pcm) > 0 {
+		block := min(len(pcm), audio.FLACMaxBlock*n)
+		frames = append(frames, l.enc.Encode(pcm[:block]))
+		durations = append(durations, uint32(block/n))
+		pcm = pcm[block:]
+	}
+
+	l.seq++
+	fragment := mp4.Fragment(l.seq, l.decodeTime, frames, durations)
+	for _, d := range durations {
+		l.decodeTime += uint64(d)
+	}
+	if _, err := l.w.Write(fragment); err != nil {
+		return err
+	}
+	l.flusher.Flush()
+	return nil
+}
+
+// SendFormat starts a new initialization segment when the format changes.
+// The timeline carries on at the new rate, so playback does not jump.
+func (l *mp4Listener) SendFormat(format ws.SourceFormat) error {
+	if l.enc != nil && format.SampleRate == l.format.SampleRate && format.Channels == l.format.Channels {
+		return nil
+	}
+	if l.format.SampleRate > 0 {
+		l.decodeTime = l.decodeTime * uint64(format.SampleRate) / uint64(l.format.SampleRate)
+	}
+	l.format = format
+	l.enc = audio.NewFLACEncoder(format.SampleRate, format.Channels)
+
+	if _, err := l.w.Write(mp4.FLACInit(format.SampleRate, format.Channels, l.enc.StreamInfo())); err != nil {
+		return err
+	}
+	l.flusher.Flush()
+	return nil
+}
+
+// Close ends the response
+func (l *mp4Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// handleMP4Stream serves the live stream as fragmented MP4 with FLAC audio,
+// for players built on MediaSource Extensions
+func (s *Server) handleMP4Stream(w http.ResponseWriter, r *http.Request) {
+	if s.config.Passthrough {
+		http.Error(w, "the mp4 stream is not available in passthrough mode", http.StatusBadRequest)
+		return
+	}
+	profile, err := s.listenerProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if profile.Format == ws.FormatFramed {
+		http.Error(w, "framed audio is only available over WebSockets", http.StatusBadRequest)
+		return
+	}
+	feed, err := s.listenerFeed(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if !s.admit(w, r) {
+		return
+	}
+
+	s.markListener(r, profile)
+	w.Header().Set("Content-Type", `audio/mp4; codecs="flac"`)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	// The initialization segment describes what the current source sends
+	listener, err := newMP4Listener(w, flusher, s.wsManager.ListenerFormat(profile))
+	if err != nil {
+		return
+	}
+
+	s.wsManager.AddListener(listener, ws.RequestInfo(r, "http"), profile, feed)
+	defer s.wsManager.RemoveListener(listener)
+
+	waitListener(w, r, listener.done)
+}
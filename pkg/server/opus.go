@@ -0,0 +1,211 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+const (
+	// opusFrame is the samples per channel in each 20ms Opus packet
+	opusFrame = audio.OpusSampleRate / 50
+	// opusPreSkip is libopus's lookahead at 48kHz, which players drop from
+	// the start of every stream
+	opusPreSkip = 312
+	// opusVendor names the encoder in the comment header
+	opusVendor = "MiniCast"
+)
+
+// opusListener streams broadcast frames as chained Ogg Opus. Each link of
+// the chain is a complete Ogg Opus stream; a new one starts whenever the
+// format or the now-playing metadata changes, which is how Icecast carries
+// titles in Ogg and what players expect.
+type opusListener struct {
+	w       io.Writer
+	flusher http.Flusher
+
+	format    ws.SourceFormat
+	metadata  ws.Metadata
+	resampler audio.Stage
+
+	// The current link: its encoder and page writer, the samples encoded
+	// (its granule position), audio waiting to fill a packet, and the last
+	// packet, held back so it can end the link when the next one starts
+	enc     audio.FrameEncoder
+	ogg     *audio.OggWriter
+	granule int64
+	pending []int16
+	held    []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Send encodes the frame and writes the packets it completes
+func (l *opusListener) Send(data []byte) error {
+	pcm := audio.BytesToPCM(data)
+	if l.resampler != nil {
+		pcm = l.resampler.Process(pcm)
+	}
+	l.pending = append(l.pending, pcm...)
+
+	frame := opusFrame * l.format.Channels
+	wrote := false
+	for len(l.pending) >= frame {
+		packet, err := l.enc.Encode(l.pending[:frame])
+		if err != nil {
+			return fmt.Errorf("failed to encode opus: %v", err)
+		}
+		l.pending = l.pending[frame:]
+		if err := l.writeHeld(false); err != nil {
+			return err
+		}
+		l.held = packet
+		l.granule += opusFrame
+		wrote = true
+	}
+	// Keep the leftover at the start of the buffer so it does not grow
+	l.pending = append(l.pending[:0], l.pending...)
+	if wrote {
+		l.flusher.Flush()
+	}
+	return nil
+}
+
+// SendFormat starts a new link when the rate or channel count changes
+func (l *opusListener) SendFormat(format ws.SourceFormat) error {
+	if format.SampleRate == l.format.SampleRate && format.Channels == l.format.Channels {
+		return nil
+	}
+	if format.Channels > 2 {
+		return fmt.Errorf("opus streams carry at most 2 channels, not %d", format.Channels)
+	}
+	l.format = format
+	l.resampler = nil
+	if format.SampleRate != audio.OpusSampleRate {
+		l.resampler = audio.NewSincResampler(format.Channels, format.SampleRate, audio.OpusSampleRate)
+	}
+	return l.chain()
+}
+
+// SendMetadata starts a new link whose comments carry the new title
+func (l *opusListener) SendMetadata(md ws.Metadata) error {
+	if md == l.metadata {
+		return nil
+	}
+	l.metadata = md
+	return l.chain()
+}
+
+// chain ends the current link, if any, and starts another with fresh
+// headers and encoder. Audio short of a packet is dropped.
+func (l *opusListener) chain() error {
+	if err := l.writeHeld(true); err != nil {
+		return err
+	}
+
+	enc, err := audio.NewOpusEncoder(audio.OpusSampleRate, l.format.Channels, audio.OpusAudio)
+	if err != nil {
+		return err
+	}
+	l.enc = enc
+	l.ogg = audio.NewOggWriter(l.w, rand.Uint32())
+	l.granule = 0
+	l.pending = l.pending[:0]
+
+	var comments []string
+	if l.metadata.Title != "" {
+		comments = append(comments, "TITLE="+l.metadata.Title)
+	}
+	if l.metadata.Artist != "" {
+		comments = append(comments, "ARTIST="+l.metadata.Artist)
+	}
+	if err := l.ogg.WritePacket(audio.OpusHead(l.format.Channels, opusPreSkip, l.format.SampleRate), 0, false); err != nil {
+		return err
+	}
+	if err := l.ogg.WritePacket(audio.OpusTags(opusVendor, comments...), 0, false); err != nil {
+		return err
+	}
+	l.flusher.Flush()
+	return nil
+}
+
+// writeHeld writes the held packet, ending the link with it if last
+func (l *opusListener) writeHeld(last bool) error {
+	if l.held == nil {
+		return nil
+	}
+	packet := l.held
+	l.held = nil
+	return l.ogg.WritePacket(packet, l.granule, last)
+}
+
+// Close ends the response
+func (l *opusListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// handleOpusStream serves the live stream as chained Ogg Opus, which
+// browsers play in a bare audio element and tools like ffmpeg read directly
+func (s *Server) handleOpusStream(w http.ResponseWriter, r *http.Request) {
+	if !audio.OpusAvailable() {
+		http.Error(w, audio.ErrOpusUnavailable.Error(), http.StatusNotImplemented)
+		return
+	}
+	if s.config.Passthrough {
+		http.Error(w, "the opus stream is not available in passthrough mode", http.StatusBadRequest)
+		return
+	}
+	profile, err := s.listenerProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if profile.Format == ws.FormatFramed {
+		http.Error(w, "framed audio is only available over WebSockets", http.StatusBadRequest)
+		return
+	}
+	feed, err := s.listenerFeed(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := s.wsManager.ListenerFormat(profile)
+	if format.Channels > 2 {
+		http.Error(w, "opus streams carry at most 2 channels, ask for ?channels=1", http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if !s.admit(w, r) {
+		return
+	}
+
+	s.markListener(r, profile)
+	w.Header().Set("Content-Type", "audio/ogg; codecs=opus")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	// The first link describes what the current source sends
+	listener := &opusListener{w: w, flusher: flusher, metadata: s.wsManager.Metadata(), done: make(chan struct{})}
+	if err := listener.SendFormat(format); err != nil {
+		s.logger.Errorf("Failed to start opus stream: %v", err)
+		return
+	}
+
+	s.wsManager.AddListener(listener, ws.RequestInfo(r, "http"), profile, feed)
+	defer s.wsManager.RemoveListener(listener)
+
+	waitListener(w, r, listener.done)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// pipelineInfo is the API view of the processing pipeline
+type pipelineInfo struct {
+	Stages []audio.StageConfig `json:"stages"`
+
+	// Available lists the stages that can be configured
+	Available []string `json:"available,omitempty"`
+}
+
+// handlePipeline reports the DSP stages, or replaces them with PUT. Changes
+// apply to the connected source straight away but are not saved to the
+// config file.
+func (s *Server) handlePipeline(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var info pipelineInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, fmt.Sprintf("invalid pipeline: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.wsManager.SetPipeline(info.Stages); err != nil {
+			http.Error(w, fmt.Sprintf("invalid pipeline: %v", err), http.StatusBadRequest)
+			return
+		}
+		s.logger.Infow("Pipeline changed", "stages", len(info.Stages), "remote", r.RemoteAddr)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info := pipelineInfo{Stages: s.wsManager.Pipeline(), Available: audio.StageNames()}
+	if info.Stages == nil {
+		info.Stages = []audio.StageConfig{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		s.logger.Errorf("Failed to encode pipeline: %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/natpmp"
+	"github.com/maks112v/minicast/pkg/upnp"
+)
+
+// Port mapping methods, for Config.PortMapping
+const (
+	// PortMappingAuto tries UPnP, then NAT-PMP
+	PortMappingAuto   = "auto"
+	PortMappingUPnP   = "upnp"
+	PortMappingNATPMP = "natpmp"
+)
+
+const (
+	// portMappingLease is how long mappings are asked for; they are
+	// renewed halfway through
+	portMappingLease = time.Hour
+	// portMappingRetry is how long after a failure the router is tried
+	// again
+	portMappingRetry = time.Minute
+	// portMappingTimeout bounds finding the router and mapping the port
+	portMappingTimeout = 10 * time.Second
+	// gatewaySearch is how long UPnP gateways are searched for
+	gatewaySearch = 2 * time.Second
+)
+
+// portMapper maps the server's port on the router
+type portMapper interface {
+	// mapPort maps port, returning the address it is reachable at from
+	// the internet and how soon the mapping lapses, or 0 if it does not
+	mapPort(ctx context.Context, port int) (string, time.Duration, error)
+	unmapPort(ctx context.Context, port int) error
+	String() string
+}
+
+// upnpMapper maps ports with a UPnP internet gateway
+type upnpMapper struct {
+	gateway *upnp.Gateway
+}
+
+func (m upnpMapper) mapPort(ctx context.Context, port int) (string, time.Duration, error) {
+	local, err := m.gateway.LocalAddr()
+	if err != nil {
+		return "", 0, err
+	}
+	lease, err := m.gateway.AddPortMapping(ctx, "TCP", port, local, portMappingLease, "minicast")
+	if err != nil {
+		return "", 0, err
+	}
+	ip, err := m.gateway.ExternalIP(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), lease, nil
+}
+
+func (m upnpMapper) unmapPort(ctx context.Context, port int) error {
+	return m.gateway.DeletePortMapping(ctx, "TCP", port)
+}
+
+func (m upnpMapper) String() string {
+	return fmt.Sprintf("UPnP gateway %q", m.gateway.Name)
+}
+
+// natpmpMapper maps ports with a NAT-PMP gateway
+type natpmpMapper struct {
+	client *natpmp.Client
+}
+
+func (m natpmpMapper) mapPort(ctx context.Context, port int) (string, time.Duration, error) {
+	mapped, lease, err := m.client.AddPortMapping(ctx, "TCP", port, port, portMappingLease)
+	if err != nil {
+		return "", 0, err
+	}
+	ip, err := m.client.ExternalAddress(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(mapped)), lease, nil
+}
+
+func (m natpmpMapper) unmapPort(ctx context.Context, port int) error {
+	return m.client.DeletePortMapping(ctx, "TCP", port)
+}
+
+func (m natpmpMapper) String() string {
+	return fmt.Sprintf("NAT-PMP gateway %s", m.client.Gateway())
+}
+
+// portMapping is the current mapping of the HTTP port
+type portMapping struct {
+	mu       sync.Mutex
+	mapper   portMapper
+	external string
+}
+
+// startPortMapping checks the port mapping settings and keeps the HTTP
+// port mapped on the router in the background
+func (s *Server) startPortMapping() error {
+	switch s.config.PortMapping {
+	case PortMappingAuto, PortMappingUPnP, PortMappingNATPMP:
+	default:
+		return fmt.Errorf("unknown port mapping method %q (available: auto, upnp, natpmp)", s.config.PortMapping)
+	}
+	if gw := s.config.PortMappingGateway; gw != "" && net.ParseIP(gw).To4() == nil {
+		return fmt.Errorf("invalid port mapping gateway %q", gw)
+	}
+	port, err := strconv.Atoi(s.port)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", s.port)
+	}
+	s.metrics.collect(s.writePortMappingMetrics)
+	go s.keepPortMapped(port)
+	return nil
+}
+
+// findPortMapper finds a router to map ports with, by the configured
+// method
+func (s *Server) findPortMapper(ctx context.Context) (portMapper, error) {
+	var errs []error
+	if s.config.PortMapping != PortMappingNATPMP {
+		gateway, err := upnp.FindGateway(ctx, gatewaySearch)
+		if err == nil {
+			return upnpMapper{gateway}, nil
+		}
+		errs = append(errs, fmt.Errorf("UPnP: %v", err))
+	}
+	if s.config.PortMapping != PortMappingUPnP {
+		gateway := net.ParseIP(s.config.PortMappingGateway)
+		var err error
+		if gateway == nil {
+			gateway, err = natpmp.DefaultGateway()
+		}
+		if err == nil {
+			// Make sure the gateway speaks NAT-PMP before relying on it
+			client := natpmp.New(gateway)
+			if _, err = client.ExternalAddress(ctx); err == nil {
+				return natpmpMapper{client}, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("NAT-PMP: %v", err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// keepPortMapped maps port and renews the mapping halfway through each
+// lease, finding the router again after a failure. It warns once per
+// outage.
+func (s *Server) keepPortMapped(port int) {
+	var mapper portMapper
+	failing := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), portMappingTimeout)
+		var err error
+		if mapper == nil {
+			mapper, err = s.findPortMapper(ctx)
+		}
+		var (
+			external string
+			lease    time.Duration
+		)
+		if err == nil {
+			external, lease, err = mapper.mapPort(ctx, port)
+		}
+		cancel()
+		if err != nil {
+			if !failing {
+				s.logger.Warnf("Failed to map port %d on the router, retrying: %v", port, err)
+				failing = true
+			}
+			mapper = nil
+			s.portMapping.mu.Lock()
+			s.portMapping.mapper, s.portMapping.external = nil, ""
+			s.portMapping.mu.Unlock()
+			time.Sleep(portMappingRetry)
+			continue
+		}
+		failing = false
+
+		s.portMapping.mu.Lock()
+		changed := external != s.portMapping.external
+		s.portMapping.mapper, s.portMapping.external = mapper, external
+		s.portMapping.mu.Unlock()
+		if changed {
+			s.logger.Infof("Reachable from the internet at http://%s/ through %s", external, mapper)
+		}
+		if lease == 0 {
+			return
+		}
+		time.Sleep(lease / 2)
+	}
+}
+
+// unmapPort removes the port mapping, if there is one, as the server
+// stops
+func (s *Server) unmapPort() {
+	s.portMapping.mu.Lock()
+	mapper := s.portMapping.mapper
+	s.portMapping.mu.Unlock()
+	if mapper == nil {
+		return
+	}
+	port, _ := strconv.Atoi(s.port)
+	ctx, cancel := context.WithTimeout(context.Background(), portMappingTimeout)
+	defer cancel()
+	if err := mapper.unmapPort(ctx, port); err != nil {
+		s.logger.Warnf("Failed to remove the port mapping: %v", err)
+	}
+}
+
+// writePortMappingMetrics writes whether the HTTP port is mapped
+func (s *Server) writePortMappingMetrics(w io.Writer) {
+	s.portMapping.mu.Lock()
+	mapped := 0
+	if s.portMapping.mapper != nil {
+		mapped = 1
+	}
+	s.portMapping.mu.Unlock()
+	fmt.Fprintf(w, "# HELP minicast_port_mapped Whether the router forwards the HTTP port.\n"+
+		"# TYPE minicast_port_mapped gauge\nminicast_port_mapped %d\n", mapped)
+}
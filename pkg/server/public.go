@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// publicStatsMaxAge is how long browsers and CDNs may reuse the public
+	// stats before asking again
+	publicStatsMaxAge = 5 * time.Second
+	// publicStatsRefresh is how often the public stats are recomputed, so
+	// a widget on a busy site costs the server next to nothing
+	publicStatsRefresh = time.Second
+)
+
+// PublicStats is what the public stats endpoint shows: whether the stream
+// is on air and how many people are listening, and nothing else
+type PublicStats struct {
+	Live      bool `json:"live"`
+	Listeners int  `json:"listeners"`
+}
+
+// publicStatsCache holds the last rendered public stats
+type publicStatsCache struct {
+	mu   sync.Mutex
+	body []byte
+	etag string
+	at   time.Time
+}
+
+// publicStats returns the rendered public stats and their ETag, rendering
+// them again when they are older than publicStatsRefresh
+func (s *Server) publicStats() ([]byte, string) {
+	c := &s.publicStatsCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.body != nil && time.Since(c.at) < publicStatsRefresh {
+		return c.body, c.etag
+	}
+	stats := s.wsManager.Stats()
+	public := PublicStats{
+		// Listeners hear an interlude, not the source, during holds and
+		// maintenance
+		Live:      stats.Source != nil && stats.Maintenance == nil && stats.Hold == nil,
+		Listeners: s.audience(stats),
+	}
+	body, _ := json.Marshal(public)
+	h := fnv.New64a()
+	h.Write(body)
+	c.body, c.etag, c.at = body, fmt.Sprintf(`"%x"`, h.Sum64()), time.Now()
+	return c.body, c.etag
+}
+
+// handlePublicStats serves the listener count and live status for station
+// websites. It needs no token and shows no addresses or internals, so it
+// is safe to call from any page; it answers conditional requests, so
+// polling widgets and caches in front of the server mostly get 304s.
+func (s *Server) handlePublicStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, etag := s.publicStats()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(publicStatsMaxAge.Seconds())))
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/maks112v/minicast/pkg/qos"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// DSCP is the traffic class marked on each kind of connection the server
+// sends audio over, as a class name (ef, af41, cs1...) or a number. Empty
+// values leave the operating system's default.
+type DSCP struct {
+	// Listeners marks WebSocket and HTTP stream listeners
+	Listeners string `yaml:"listeners,omitempty"`
+
+	// Profiles overrides Listeners for listeners using the named profile,
+	// for example ef for low-latency monitors
+	Profiles map[string]string `yaml:"profiles,omitempty"`
+
+	// RTP marks the RTP output
+	RTP string `yaml:"rtp,omitempty"`
+}
+
+// connKey is the request context key holding the client's connection
+type connKey struct{}
+
+// withConn stores each connection in its requests' context, so handlers
+// can mark the socket
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// listenerDSCP resolves the configured class for each listener profile,
+// returning nil when listeners are not marked
+func (s *Server) listenerDSCP() (map[string]int, error) {
+	config := s.config.DSCP
+	if config.Listeners == "" && len(config.Profiles) == 0 {
+		return nil, nil
+	}
+
+	classes := make(map[string]int)
+	for _, name := range ws.ProfileNames() {
+		value := config.Listeners
+		if override, ok := config.Profiles[name]; ok {
+			value = override
+		}
+		if value == "" {
+			continue
+		}
+		dscp, err := qos.ParseDSCP(value)
+		if err != nil {
+			return nil, err
+		}
+		classes[name] = dscp
+	}
+
+	for name := range config.Profiles {
+		if _, ok := ws.LookupProfile(name); !ok {
+			return nil, fmt.Errorf("unknown profile %q", name)
+		}
+	}
+	return classes, nil
+}
+
+// markListener marks a listener's connection with its profile's class
+func (s *Server) markListener(r *http.Request, profile ws.Profile) {
+	dscp, ok := s.dscp[profile.Name]
+	if !ok {
+		return
+	}
+	conn, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+	if err := qos.Set(conn, dscp); err != nil {
+		s.logger.Debugf("Failed to set DSCP for %s: %v", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitSweep is how often clients that have gone quiet are forgotten
+	rateLimitSweep = time.Minute
+	// rateLimitStrikes is how many refusals within rateLimitStrikeWindow
+	// get a client banned, so that a client briefly over the limit is only
+	// slowed down
+	rateLimitStrikes      = 10
+	rateLimitStrikeWindow = 10 * time.Second
+)
+
+// rateLimiter limits how fast each client IP may make requests, so that
+// one client flooding the server with connections cannot starve the
+// others. Each IP has a token bucket: bursts up to its size go straight
+// through, then rate per second. A client that empties its bucket is
+// refused until it refills, and banned for a while if a ban is set and it
+// keeps trying.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	ban    time.Duration
+	exempt []netip.Prefix
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*clientBucket
+
+	limited, bans uint64
+}
+
+// clientBucket is one IP's token bucket
+type clientBucket struct {
+	tokens float64
+	last   time.Time
+	// strikes counts the client's refusals since firstStrike, and banned
+	// is when its ban ends
+	strikes     int
+	firstStrike time.Time
+	banned      time.Time
+}
+
+// newRateLimiter creates a limiter, or nil when rate is 0 to let every
+// request through. Exempt holds addresses and CIDR ranges that are never
+// limited, on top of loopback.
+func newRateLimiter(rate float64, burst int, ban time.Duration, exempt []string) (*rateLimiter, error) {
+	if rate < 0 || ban < 0 {
+		return nil, fmt.Errorf("rate limit and ban must not be negative")
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	l := &rateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		ban:     ban,
+		clients: make(map[netip.Addr]*clientBucket),
+	}
+	for _, e := range exempt {
+		prefix, err := netip.ParsePrefix(e)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(e)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid rate limit exemption %q: not an address or CIDR range", e)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		l.exempt = append(l.exempt, prefix.Masked())
+	}
+	go l.sweep()
+	return l, nil
+}
+
+// allow takes a token from addr's bucket. Refused, it returns how long
+// until the client may try again, and whether it was just banned.
+// IPv4-mapped IPv6 addresses count as the IPv4 address.
+func (l *rateLimiter) allow(addr netip.Addr, now time.Time) (retry time.Duration, banned bool, ok bool) {
+	addr = addr.Unmap()
+	if addr.IsLoopback() {
+		return 0, false, true
+	}
+	for _, prefix := range l.exempt {
+		if prefix.Contains(addr) {
+			return 0, false, true
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.clients[addr]
+	if b == nil {
+		b = &clientBucket{tokens: l.burst, last: now}
+		l.clients[addr] = b
+	}
+	if now.Before(b.banned) {
+		l.limited++
+		return b.banned.Sub(now), false, false
+	}
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*l.rate, l.burst)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, false, true
+	}
+
+	l.limited++
+	retry = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	if l.ban == 0 {
+		return retry, false, false
+	}
+	if b.strikes == 0 || now.Sub(b.firstStrike) > rateLimitStrikeWindow {
+		b.strikes, b.firstStrike = 0, now
+	}
+	if b.strikes++; b.strikes < rateLimitStrikes {
+		return retry, false, false
+	}
+	l.bans++
+	b.strikes = 0
+	b.banned = now.Add(l.ban)
+	return l.ban, true, false
+}
+
+// sweep forgets clients whose buckets have filled up again and who are
+// not banned, so the map does not grow with every address ever seen
+func (l *rateLimiter) sweep() {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for range time.Tick(rateLimitSweep) {
+		now := time.Now()
+		l.mu.Lock()
+		for addr, b := range l.clients {
+			if now.Sub(b.last) > full && now.After(b.banned) {
+				delete(l.clients, addr)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// bannedCount returns how many clients are banned now
+func (l *rateLimiter) bannedCount(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := 0
+	for _, b := range l.clients {
+		if now.Before(b.banned) {
+			count++
+		}
+	}
+	return count
+}
+
+// rateLimit refuses requests, WebSocket upgrades included, from clients
+// over the per-IP rate limit with a 429 and Retry-After
+func (s *Server) rateLimit(next http.Handler) http.Handler {
+	if s.limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		retry, banned, ok := s.limiter.allow(addr, time.Now())
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if banned {
+			s.logger.Warnf("Banned %s for %s for exceeding the rate limit", addr.Unmap(), s.limiter.ban)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+	})
+}
+
+// writeRateLimitMetrics writes how many requests were refused by the rate
+// limit, how many bans were made and how many are in force
+func (s *Server) writeRateLimitMetrics(w io.Writer) {
+	l := s.limiter
+	l.mu.Lock()
+	limited, bans := l.limited, l.bans
+	l.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP minicast_rate_limited_total Requests refused by the per-IP rate limit.\n"+
+		"# TYPE minicast_rate_limited_total counter\nminicast_rate_limited_total %d\n", limited)
+	fmt.Fprintf(w, "# HELP minicast_rate_limit_bans_total Clients banned for exceeding the rate limit.\n"+
+		"# TYPE minicast_rate_limit_bans_total counter\nminicast_rate_limit_bans_total %d\n", bans)
+	fmt.Fprintf(w, "# HELP minicast_rate_limit_banned Clients banned now.\n"+
+		"# TYPE minicast_rate_limit_banned gauge\nminicast_rate_limit_banned %d\n", l.bannedCount(time.Now()))
+}
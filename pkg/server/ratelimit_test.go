@@ -0,0 +1,169 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	// A request from addr at, and what the limiter should answer
+	type step struct {
+		addr   string
+		at     time.Duration
+		ok     bool
+		banned bool
+		retry  time.Duration
+	}
+	tests := []struct {
+		name   string
+		rate   float64
+		burst  int
+		ban    time.Duration
+		exempt []string
+		steps  []step
+	}{
+		{
+			name: "burst", rate: 1, burst: 3,
+			steps: []step{
+				{addr: "192.0.2.1", ok: true},
+				{addr: "192.0.2.1", ok: true},
+				{addr: "192.0.2.1", ok: true},
+				{addr: "192.0.2.1", retry: time.Second},
+				// Each address has its own bucket
+				{addr: "192.0.2.2", ok: true},
+			},
+		},
+		{
+			name: "refill", rate: 4, burst: 2,
+			steps: []step{
+				{addr: "192.0.2.1", ok: true},
+				{addr: "192.0.2.1", ok: true},
+				{addr: "192.0.2.1", at: 125 * time.Millisecond, retry: 125 * time.Millisecond},
+				{addr: "192.0.2.1", at: 250 * time.Millisecond, ok: true},
+				{addr: "192.0.2.1", at: 250 * time.Millisecond, retry: 250 * time.Millisecond},
+				// The bucket fills up no further than the burst
+				{addr: "192.0.2.1", at: time.Hour, ok: true},
+				{addr: "192.0.2.1", at: time.Hour, ok: true},
+				{addr: "192.0.2.1", at: time.Hour, retry: 250 * time.Millisecond},
+			},
+		},
+		{
+			name: "no ban without one set", rate: 1, burst: 1,
+			steps: append([]step{{addr: "192.0.2.1", ok: true}},
+				repeatStep(step{addr: "192.0.2.1", retry: time.Second}, 2*rateLimitStrikes)...),
+		},
+		{
+			name: "ban after repeated refusals", rate: 1, burst: 1, ban: time.Minute,
+			steps: append(append([]step{{addr: "192.0.2.1", ok: true}},
+				repeatStep(step{addr: "192.0.2.1", retry: time.Second}, rateLimitStrikes-1)...),
+				step{addr: "192.0.2.1", banned: true, retry: time.Minute},
+				step{addr: "192.0.2.1", at: 20 * time.Second, retry: 40 * time.Second},
+				// The ban expires with a full bucket
+				step{addr: "192.0.2.1", at: time.Minute, ok: true},
+				step{addr: "192.0.2.1", at: time.Minute, retry: time.Second},
+			),
+		},
+		{
+			// Refusals outside the window start the count again
+			name: "strikes expire", rate: 0.0625, burst: 1, ban: time.Minute,
+			steps: append(append(append([]step{{addr: "192.0.2.1", ok: true}},
+				repeatStep(step{addr: "192.0.2.1", retry: 16 * time.Second}, rateLimitStrikes-1)...),
+				repeatStep(step{addr: "192.0.2.1", at: 11 * time.Second, retry: 5 * time.Second}, rateLimitStrikes-1)...),
+				step{addr: "192.0.2.1", at: 11 * time.Second, banned: true, retry: time.Minute},
+			),
+		},
+		{
+			name: "exemptions", rate: 1, burst: 1, ban: time.Minute, exempt: []string{"10.0.0.0/8", "2001:db8::1"},
+			steps: []step{
+				{addr: "10.1.2.3", ok: true},
+				{addr: "10.1.2.3", ok: true},
+				{addr: "::ffff:10.1.2.3", ok: true},
+				{addr: "2001:db8::1", ok: true},
+				{addr: "2001:db8::1", ok: true},
+				{addr: "127.0.0.1", ok: true},
+				{addr: "127.0.0.1", ok: true},
+				{addr: "::1", ok: true},
+				{addr: "::1", ok: true},
+				{addr: "2001:db8::2", ok: true},
+				{addr: "2001:db8::2", retry: time.Second},
+			},
+		},
+		{
+			name: "IPv4-mapped addresses", rate: 1, burst: 1,
+			steps: []step{
+				{addr: "192.0.2.1", ok: true},
+				{addr: "::ffff:192.0.2.1", retry: time.Second},
+				{addr: "::ffff:192.0.2.2", ok: true},
+				{addr: "192.0.2.2", retry: time.Second},
+			},
+		},
+	}
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := newRateLimiter(tt.rate, tt.burst, tt.ban, tt.exempt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range tt.steps {
+				retry, banned, ok := l.allow(netip.MustParseAddr(s.addr), start.Add(s.at))
+				if ok != s.ok || banned != s.banned || retry != s.retry {
+					t.Fatalf("step %d, %s at %s: got ok %v banned %v retry %s, want ok %v banned %v retry %s",
+						i, s.addr, s.at, ok, banned, retry, s.ok, s.banned, s.retry)
+				}
+			}
+		})
+	}
+}
+
+// repeatStep returns n copies of s
+func repeatStep[T any](s T, n int) []T {
+	steps := make([]T, n)
+	for i := range steps {
+		steps[i] = s
+	}
+	return steps
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter, err := newRateLimiter(1, 1, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{limiter: limiter, logger: zap.NewNop().Sugar()}
+	handler := s.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get("192.0.2.1:5000"); w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	// Refused until the bucket refills, then banned for the ban
+	for i := 1; i <= rateLimitStrikes; i++ {
+		w := get("[::ffff:192.0.2.1]:5001")
+		want := "1"
+		if i == rateLimitStrikes {
+			want = "60"
+		}
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != want {
+			t.Fatalf("refusal %d: status %d Retry-After %q, want 429 with %s", i, w.Code, w.Header().Get("Retry-After"), want)
+		}
+	}
+	if limiter.bans != 1 {
+		t.Errorf("%d bans, want 1", limiter.bans)
+	}
+	if w := get("192.0.2.2:5000"); w.Code != http.StatusOK {
+		t.Errorf("another client: status %d", w.Code)
+	}
+}
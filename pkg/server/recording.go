@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// recordingHeaderInterval is how often a recording's WAV header is brought
+// up to date, so a crash leaves a playable file
+const recordingHeaderInterval = 5 * time.Second
+
+// maxRecordingData is the most PCM one WAV file can hold; recordings carry
+// on in a new part beyond it
+const maxRecordingData = 0xFFFFFFFF - 36
+
+// errRecording is returned when starting a recording while one is running
+var errRecording = errors.New("already recording")
+
+// errRecordingDisabled is returned when recording without a directory to
+// record into
+var errRecordingDisabled = errors.New("recording is not enabled; start the server with -record-dir")
+
+// Recording is a request to record the broadcast
+type Recording struct {
+	// Name is the file to record into, without a directory; empty names
+	// it after the time recording started
+	Name string `json:"name"`
+}
+
+// RecordingState describes the recording in progress
+type RecordingState struct {
+	// Path is the file being written. Recordings continue in numbered
+	// parts when the broadcast format changes or a file fills up.
+	Path    string    `json:"path"`
+	Started time.Time `json:"started"`
+	Bytes   int64     `json:"bytes"`
+	// Error is why recording stopped early, if it did
+	Error string `json:"error,omitempty"`
+}
+
+// RecordingEvent is the data of a "recording" event, published when a
+// recording starts and when it finishes
+type RecordingEvent struct {
+	Active bool `json:"active"`
+	RecordingState
+}
+
+// recording tracks the recording started through the API
+type recording struct {
+	mu  sync.Mutex
+	rec *wavRecorder
+}
+
+// startRecording starts recording the broadcast as heard into name in the
+// recording directory
+func (s *Server) startRecording(name string) (RecordingState, error) {
+	if s.config.RecordDir == "" {
+		return RecordingState{}, errRecordingDisabled
+	}
+	if name == "" {
+		name = "recording-" + time.Now().Format("2006-01-02T15-04-05")
+	}
+	name = strings.TrimSuffix(name, ".wav")
+	if name == "." || name == ".." || filepath.Base(name) != name || strings.ContainsAny(name, `/\`) {
+		return RecordingState{}, fmt.Errorf("invalid recording name %q", name)
+	}
+
+	rs := &s.recording
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.rec != nil {
+		return RecordingState{}, errRecording
+	}
+	rec, err := newWAVRecorder(filepath.Join(s.config.RecordDir, name), s.wsManager.OutputFormat())
+	if err != nil {
+		return RecordingState{}, err
+	}
+	rs.rec = rec
+
+	// Like the DVR, a deep queue rides out slow disks and drops frames
+	// rather than ending the recording
+	profile, _ := ws.LookupProfile("stable")
+	profile.Drop = ws.DropNewest
+	info := ws.ConnInfo{Transport: "recording", RemoteAddr: rec.path, ConnectedAt: rec.started}
+	s.wsManager.AddListener(rec, info, profile, nil)
+	s.logger.Infof("Recording the broadcast to %s", rec.path)
+	state := rec.state()
+	s.events.Publish("recording", RecordingEvent{Active: true, RecordingState: state})
+	return state, nil
+}
+
+// stopRecording stops the recording in progress, returning its final state
+func (s *Server) stopRecording() (RecordingState, bool) {
+	rs := &s.recording
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.rec == nil {
+		return RecordingState{}, false
+	}
+	s.wsManager.RemoveListener(rs.rec)
+	state := rs.rec.state()
+	rs.rec = nil
+	s.logger.Infof("Stopped recording the broadcast to %s after %s", state.Path, time.Since(state.Started).Round(time.Second))
+	s.events.Publish("recording", RecordingEvent{RecordingState: state})
+	return state, true
+}
+
+// recordingState returns the state of the recording in progress
+func (s *Server) recordingState() (RecordingState, bool) {
+	rs := &s.recording
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.rec == nil {
+		return RecordingState{}, false
+	}
+	return rs.rec.state(), true
+}
+
+// handleRecording returns the recording in progress on GET, starts one on
+// POST and stops it on DELETE, returning the final state
+func (s *Server) handleRecording(w http.ResponseWriter, r *http.Request) {
+	var (
+		state RecordingState
+		ok    bool
+	)
+	switch r.Method {
+	case http.MethodGet:
+		state, ok = s.recordingState()
+	case http.MethodPost:
+		var req Recording
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("invalid recording: %v", err), http.StatusBadRequest)
+			return
+		}
+		var err error
+		state, err = s.startRecording(req.Name)
+		switch {
+		case errors.Is(err, errRecordingDisabled):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errRecording), errors.Is(err, os.ErrExist):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ok = true
+	case http.MethodDelete:
+		state, ok = s.stopRecording()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var status *RecordingState
+	if ok {
+		status = &state
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		s.logger.Errorf("Failed to encode recording: %v", err)
+	}
+}
+
+// wavRecorder is a listener writing the broadcast to WAV files, starting a
+// new part when the format changes or a file fills up
+type wavRecorder struct {
+	base    string
+	started time.Time
+
+	mu       sync.Mutex
+	format   ws.SourceFormat
+	f        *os.File
+	path     string
+	part     int
+	size     uint32
+	bytes    int64
+	headerAt time.Time
+	err      error
+}
+
+// newWAVRecorder creates base.wav for audio in format, refusing to
+// overwrite an existing file
+func newWAVRecorder(base string, format ws.SourceFormat) (*wavRecorder, error) {
+	r := &wavRecorder{base: base, format: format, started: time.Now()}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open starts the next part, writing a header to be filled in as audio
+// arrives
+func (r *wavRecorder) open() error {
+	r.part++
+	path := r.base + ".wav"
+	if r.part > 1 {
+		path = fmt.Sprintf("%s-%d.wav", r.base, r.part)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(r.header()); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	r.f, r.path, r.size, r.headerAt = f, path, 0, time.Now()
+	return nil
+}
+
+// header returns the WAV header for the current part
+func (r *wavRecorder) header() []byte {
+	return audio.NewProcessor(r.format.SampleRate, r.format.Channels, r.format.BitDepth).Header(r.size)
+}
+
+// finish brings the current part's header up to date and closes it
+func (r *wavRecorder) finish() error {
+	if r.f == nil {
+		return nil
+	}
+	_, err := r.f.WriteAt(r.header(), 0)
+	if closeErr := r.f.Close(); err == nil {
+		err = closeErr
+	}
+	r.f = nil
+	return err
+}
+
+// fail stops recording after err, keeping what was written
+func (r *wavRecorder) fail(err error) error {
+	r.finish()
+	r.err = err
+	return err
+}
+
+// Send appends a frame of PCM
+func (r *wavRecorder) Send(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return r.err
+	}
+
+	if uint64(r.size)+uint64(len(data)) > maxRecordingData {
+		if err := r.finish(); err != nil {
+			return r.fail(err)
+		}
+		if err := r.open(); err != nil {
+			return r.fail(err)
+		}
+	}
+	if _, err := r.f.Write(data); err != nil {
+		return r.fail(err)
+	}
+	r.size += uint32(len(data))
+	r.bytes += int64(len(data))
+
+	if now := time.Now(); now.Sub(r.headerAt) >= recordingHeaderInterval {
+		r.headerAt = now
+		if _, err := r.f.WriteAt(r.header(), 0); err != nil {
+			return r.fail(err)
+		}
+	}
+	return nil
+}
+
+// SendFormat starts a new part when the broadcast changes format, since a
+// WAV file has only one
+func (r *wavRecorder) SendFormat(format ws.SourceFormat) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil || format == r.format {
+		return nil
+	}
+
+	r.format = format
+	if r.size == 0 {
+		if _, err := r.f.WriteAt(r.header(), 0); err != nil {
+			return r.fail(err)
+		}
+		return nil
+	}
+	if err := r.finish(); err != nil {
+		return r.fail(err)
+	}
+	if err := r.open(); err != nil {
+		return r.fail(err)
+	}
+	return nil
+}
+
+// Close finishes the current part
+func (r *wavRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.finish()
+}
+
+// state describes the recording
+func (r *wavRecorder) state() RecordingState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := RecordingState{Path: r.path, Started: r.started, Bytes: r.bytes}
+	if r.err != nil {
+		state.Error = r.err.Error()
+	}
+	return state
+}
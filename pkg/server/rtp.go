@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/qos"
+	"github.com/maks112v/minicast/pkg/rtp"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// startRTP registers the RTP output as a listener and publishes its SDP at
+// /stream.sdp
+func (s *Server) startRTP() error {
+	codec, ok := rtp.LookupCodec(s.config.RTPCodec)
+	if !ok {
+		return fmt.Errorf("unknown RTP codec %q", s.config.RTPCodec)
+	}
+	if s.config.Passthrough && codec != rtp.L16 {
+		return fmt.Errorf("RTP codec %s is not available in passthrough mode", codec.Name)
+	}
+
+	output, err := rtp.NewOutput(s.config.RTPAddr, codec, s.audio.GetSampleRate(), s.audio.GetNumChannels())
+	if err != nil {
+		return fmt.Errorf("failed to start RTP output: %v", err)
+	}
+	redundancy, ok := rtp.ParseRedundancy(s.config.RTPRedundancy)
+	if !ok {
+		return fmt.Errorf("unknown RTP redundancy %q", s.config.RTPRedundancy)
+	}
+	if err := output.SetRedundancy(redundancy, s.config.RTPRedundancyDistance); err != nil {
+		return fmt.Errorf("invalid RTP redundancy: %v", err)
+	}
+	if s.config.DSCP.RTP != "" {
+		dscp, err := qos.ParseDSCP(s.config.DSCP.RTP)
+		if err != nil {
+			return fmt.Errorf("invalid RTP DSCP: %v", err)
+		}
+		if err := output.SetDSCP(dscp); err != nil {
+			return fmt.Errorf("failed to set RTP DSCP: %v", err)
+		}
+	}
+
+	// Receivers have their own jitter buffers, so stay as close to live as possible
+	profile, _ := ws.LookupProfile("low-latency")
+	info := ws.ConnInfo{Transport: "rtp", RemoteAddr: s.config.RTPAddr, ConnectedAt: time.Now()}
+	s.wsManager.AddListener(output, info, profile, nil)
+
+	// The description follows the broadcast's format, so it is built on
+	// each request
+	http.HandleFunc("/stream.sdp", s.corsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Write([]byte(output.SDP()))
+	}))
+
+	s.logger.Infof("Sending RTP (%s) to %s", codec.Name, s.config.RTPAddr)
+	if redundancy != rtp.RedundancyOff {
+		s.logger.Infof("Resending RTP audio (%s) %d packets later", s.config.RTPRedundancy, s.config.RTPRedundancyDistance)
+	}
+	return nil
+}
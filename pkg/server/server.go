@@ -1,11 +1,28 @@
 package server
 
 import (
+	"context"
 	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/clock"
+	"github.com/maks112v/minicast/pkg/dvr"
+	"github.com/maks112v/minicast/pkg/events"
+	"github.com/maks112v/minicast/pkg/mdns"
+	"github.com/maks112v/minicast/pkg/relay"
+	"github.com/maks112v/minicast/pkg/sink"
+	"github.com/maks112v/minicast/pkg/snapcast"
 	ws "github.com/maks112v/minicast/pkg/websocket"
 	"go.uber.org/zap"
 )
@@ -13,26 +30,306 @@ import (
 //go:embed templates/*
 var templates embed.FS
 
+// Config holds the server settings
+type Config struct {
+	// StaticDir is served under /static/, defaulting to the working directory
+	StaticDir string
+
+	// TemplateDir optionally points at a directory whose templates override
+	// the embedded ones. Missing or broken files fall back to the embedded copy.
+	TemplateDir string
+
+	// RelayURL, when set, makes the server pull an external HTTP/Icecast
+	// stream and use it as the audio source instead of waiting for one
+	RelayURL string
+
+	// OriginURL, when set, makes the server an edge of another minicast
+	// server: it listens to the origin's broadcast over WebSocket (a ws://
+	// or wss:// URL) and uses it as the source, reconnecting when it is lost
+	OriginURL string
+
+	// FanoutURL, when set, shares the broadcast with other instances over a
+	// bus such as Redis pub/sub, on FanoutChannel: sources connected to one
+	// instance are broadcast by all of them
+	FanoutURL     string
+	FanoutChannel string
+
+	// MQTTURL, when set, is an MQTT broker the stream's state, listener
+	// count and levels are published to, every MQTTInterval, under
+	// MQTTTopic or the topics given in MQTTTopics
+	MQTTURL      string
+	MQTTTopic    string
+	MQTTTopics   MQTTTopics
+	MQTTInterval time.Duration
+
+	// SnapcastAddr, when set, is where Snapcast clients connect to play
+	// the broadcast in sync, SnapcastBuffer behind the server
+	SnapcastAddr   string
+	SnapcastBuffer time.Duration
+
+	// WebRTCAddr, when set, is the UDP address WebRTC media flows over,
+	// which enables WHIP sources and WHEP players. WebRTCPublicIPs are
+	// advertised to peers in place of the host's own addresses, for
+	// servers behind NAT.
+	WebRTCAddr      string
+	WebRTCPublicIPs []string
+
+	// PortMapping, when set, asks the router to forward the HTTP port
+	// from the internet, by UPnP or NAT-PMP ("auto", "upnp" or "natpmp").
+	// PortMappingGateway is the NAT-PMP gateway, if not the default one.
+	PortMapping        string
+	PortMappingGateway string
+
+	// MDNS advertises the server on the LAN as MDNSName, so sources and
+	// listeners started with -discover find it
+	MDNS     bool
+	MDNSName string
+
+	// DLNA announces the stream over UPnP as a media server named
+	// DLNAName, so smart TVs and network speakers list it
+	DLNA     bool
+	DLNAName string
+
+	// Passthrough guarantees source frames reach listeners byte-for-byte:
+	// nothing is decoded, re-encoded or re-framed per message, and
+	// listeners asking for a format that would require it are refused
+	Passthrough bool
+
+	// RTPAddr, when set, sends the stream as RTP to this unicast or
+	// multicast host:port, encoded with RTPCodec ("l16" or "pcmu")
+	RTPAddr  string
+	RTPCodec string
+
+	// RTPRedundancy ("off", "red" or "repeat") resends RTP audio
+	// RTPRedundancyDistance packets later, for receivers on lossy networks
+	RTPRedundancy         string
+	RTPRedundancyDistance int
+
+	// LoopProtection is what happens when a source captures the stream's
+	// own output: "off", "warn" (the default) or "mute"
+	LoopProtection string
+
+	// JitterBuffer is how much audio from WebSocket and UDP sources is
+	// buffered and re-emitted on a steady clock; 0 broadcasts frames as
+	// they arrive
+	JitterBuffer time.Duration
+
+	// ClockSource, when set, disciplines the clock stamping frames and the
+	// DVR from a reference: an NTP server, or "ptp:/dev/ptpN" for a PTP
+	// hardware clock. It is queried every ClockPoll.
+	ClockSource string
+	ClockPoll   time.Duration
+
+	// UDPIngestAddr, when set, also takes sources over UDP on this address,
+	// waiting up to UDPIngestDelay for lost packets to be resent
+	UDPIngestAddr  string
+	UDPIngestDelay time.Duration
+
+	// DVRDir, when set, keeps the last DVRDepth of the broadcast on disk so
+	// listeners can join in the past with ?rewind= and clips can be cut.
+	// DVRFormat is how segments are stored: "pcm" (the default) or "flac".
+	// DVRTap records the "mix" listeners hear (the default) or the
+	// "source" before processing.
+	DVRDir    string
+	DVRDepth  time.Duration
+	DVRFormat string
+	DVRTap    string
+
+	// RecordDir, when set, is where recordings started through the API
+	// are written, as WAV files of the broadcast as heard
+	RecordDir string
+
+	// SessionsDB, when set, is a SQLite database every listener and source
+	// session is recorded in when it ends, for reviewing the audience
+	SessionsDB string
+
+	// GeoIPDB, when set, is a MaxMind GeoIP2 or GeoLite2 Country or City
+	// database remote listeners are located with
+	GeoIPDB string
+
+	// MaintenanceAudio is a WAV or MP3 file looped to listeners during
+	// maintenance. Listeners get silence when it is empty.
+	MaintenanceAudio string
+
+	// HoldAudio is a WAV or MP3 file looped to listeners while the
+	// broadcast is on hold. Listeners get silence when it is empty.
+	HoldAudio string
+
+	// Resample is the quality ("linear" or "sinc") sources at another
+	// sample rate are converted to the broadcast rate with; empty
+	// broadcasts at the source's rate
+	Resample string
+
+	// ChannelMixing mixes sources with another channel count, such as mono
+	// microphones, to the broadcast's channel count
+	ChannelMixing bool
+
+	// Pipeline is the DSP stages source audio runs through before broadcast
+	Pipeline []audio.StageConfig
+
+	// Silence says when the source counts as silent and whether it stops
+	// being broadcast while it is
+	Silence ws.SilenceConfig
+
+	// APITokens, when set, are required to change the server through the
+	// API, each within its scopes
+	APITokens []APIToken
+
+	// SilenceFallback is a WAV or MP3 file looped to listeners while a
+	// silent source is paused
+	SilenceFallback string
+
+	// LoudnessTarget is the integrated loudness (in LUFS) the stream should
+	// have, reported alongside the measurements
+	LoudnessTarget float64
+
+	// Triggers publish events when the broadcast level crosses thresholds
+	Triggers []Trigger
+
+	// ListenerThresholds publish a "listeners" event when the audience
+	// reaches each of them, and another when it falls back below
+	ListenerThresholds []int
+
+	// Webhooks receive events as JSON POSTs
+	Webhooks []events.WebhookConfig
+
+	// Sinks are external commands fed the live stream
+	Sinks []sink.Config
+
+	// DSCP marks outgoing audio so QoS-aware networks can prioritize it
+	DSCP DSCP
+
+	// AdmissionRate is how many listeners may connect per second once
+	// AdmissionBurst have connected at once; 0 lets everyone in. Sources
+	// are never limited.
+	AdmissionRate  float64
+	AdmissionBurst int
+
+	// RateLimit is how many requests per second each client IP may make,
+	// WebSocket upgrades included, once it has made RateLimitBurst at
+	// once; 0 turns the limit off. A client over it is refused until its
+	// bucket refills, and one refused again and again is banned for
+	// RateLimitBan, unless that is 0.
+	// Loopback and the addresses and CIDR ranges in RateLimitExempt are
+	// never limited.
+	RateLimit       float64
+	RateLimitBurst  int
+	RateLimitBan    time.Duration
+	RateLimitExempt []string
+
+	// MP3Encoder ("go") encodes the stream served at /stream.mp3, at
+	// MP3Bitrate kbit/s; empty disables it
+	MP3Encoder string
+	MP3Bitrate int
+
+	// TSUDPAddr, when set, sends the MPEG-TS stream served at /stream.ts
+	// to this unicast or multicast host:port too. Both carry the MP3
+	// encoding.
+	TSUDPAddr string
+
+	// DASHSegment is the segment length of the MPEG-DASH stream served at
+	// /stream.mpd; 0 disables it
+	DASHSegment time.Duration
+
+	// IdleTimeout, when set, shuts the server down once it has had no
+	// source and no listeners this long, or runs IdleCommand instead when
+	// that is set
+	IdleTimeout time.Duration
+	IdleCommand []string
+}
+
 // Server represents the HTTP server
 type Server struct {
 	wsManager *ws.Manager
 	logger    *zap.SugaredLogger
 	audio     *audio.Processor
+	config    Config
+	dvr       *dvr.Recorder
+	events    *events.Bus
+	metrics   *httpMetrics
+	timeline  timeline
+	loudness  *loudnessMonitor
+	dash      *segmentCache
+	admission *admission
+	limiter   *rateLimiter
+	clock     *clock.Clock
+	cluster   *cluster
+	sessions  *sessionStore
+	geoIP     *geoIP
+	snapcast  *snapcast.Server
+	rtc       *webrtcServer
+	dlna      *dlna
+	mdns      *mdns.Responder
+
+	// port is the HTTP port, which the stream is served on
+	port        string
+	portMapping portMapping
+
+	publicStatsCache publicStatsCache
+
+	// dscp is the class marked on listeners, by profile name
+	dscp map[string]int
+
+	maintenance maintenanceSchedule
+	hold        holdLoop
+	recording   recording
 }
 
 // New creates a new server instance
-func New(logger *zap.SugaredLogger) *Server {
+func New(logger *zap.SugaredLogger, config Config) *Server {
+	processor := audio.NewProcessor(44100, 2, 16) // CD quality audio
 	return &Server{
-		wsManager: ws.NewManager(logger),
+		wsManager: ws.NewManager(processor, logger),
+		events:    events.NewBus(),
+		metrics:   newHTTPMetrics(http.DefaultServeMux),
 		logger:    logger,
-		audio:     audio.NewProcessor(44100, 2, 16), // CD quality audio
+		audio:     processor,
+		config:    config,
 	}
 }
 
 // Start starts the HTTP server
 func (s *Server) Start(addr string) error {
-	// Serve static files from the current directory
-	fs := http.FileServer(http.Dir("."))
+	if s.config.Passthrough && s.config.RelayURL != "" {
+		return errors.New("passthrough mode cannot relay, since relaying decodes the upstream")
+	}
+	if s.config.RelayURL != "" && s.config.OriginURL != "" {
+		return errors.New("a server can relay a stream or be an edge of an origin, not both")
+	}
+	if err := s.validateMP3(); err != nil {
+		return err
+	}
+	if err := s.validateDASH(); err != nil {
+		return err
+	}
+	limiter, err := newRateLimiter(s.config.RateLimit, s.config.RateLimitBurst, s.config.RateLimitBan, s.config.RateLimitExempt)
+	if err != nil {
+		return err
+	}
+	s.limiter = limiter
+
+	// Bind first, so on-demand launchers see the port open at once and
+	// connections made while starting up wait instead of being refused
+	start := time.Now()
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	s.port, s.dlna = port, &dlna{}
+	serving := false
+	defer func() {
+		if !serving {
+			ln.Close()
+		}
+	}()
+
+	// Serve static files, from the current directory unless configured
+	staticDir := s.config.StaticDir
+	if staticDir == "" {
+		staticDir = "."
+	}
+	fs := http.FileServer(http.Dir(staticDir))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 
 	// Root endpoint serves index.html
@@ -41,21 +338,326 @@ func (s *Server) Start(addr string) error {
 	// WebSocket endpoint
 	http.HandleFunc("/ws", s.corsMiddleware(s.handleWebSocket))
 
+	// Chunked HTTP stream for listeners that cannot use WebSockets
+	http.HandleFunc("/stream", s.corsMiddleware(s.handleHTTPStream))
+
+	// Fragmented MP4 stream for MediaSource Extensions players
+	http.HandleFunc("/stream.mp4", s.corsMiddleware(s.handleMP4Stream))
+
+	// Chained Ogg Opus stream for audio elements and command-line tools
+	http.HandleFunc("/stream.opus", s.corsMiddleware(s.handleOpusStream))
+
+	// MP3 stream for radio clients and smart speakers
+	http.HandleFunc("/stream.mp3", s.corsMiddleware(s.handleMP3Stream))
+
+	// MPEG-TS stream for broadcast tooling and set-top boxes
+	http.HandleFunc("/stream.ts", s.corsMiddleware(s.handleTSStream))
+
+	// MPEG-DASH manifest and segments, for ExoPlayer and dash.js
+	http.HandleFunc("/stream.mpd", s.corsMiddleware(s.handleDASHManifest))
+	http.HandleFunc("/dash/", s.corsMiddleware(s.handleDASHSegment))
+
+	// WHIP sources over WebRTC, and ending their sessions
+	http.HandleFunc("/whip", s.corsMiddleware(s.handleWHIP))
+	http.HandleFunc("/whip/", s.corsMiddleware(s.handleWHIP))
+	// WHEP players over WebRTC, and ending their sessions
+	http.HandleFunc("/whep", s.corsMiddleware(s.handleWHEP))
+	http.HandleFunc("/whep/", s.corsMiddleware(s.handleWHEP))
+
+	s.registerAPI(http.DefaultServeMux)
+
+	// Per-route request metrics, for Prometheus and as a text page
+	http.HandleFunc("/metrics", s.metrics.handleMetrics)
+	http.HandleFunc("/status", s.metrics.handleStatus)
+
 	// Serve the stream player page
 	http.HandleFunc("/listen", s.corsMiddleware(s.serveStreamPage))
 
-	s.logger.Info("Starting streaming server on http://localhost" + addr + "/")
-	s.logger.Info("Stream player available at http://localhost" + addr + "/listen")
-	return http.ListenAndServe(addr, nil)
+	// Serve the browser source page
+	http.HandleFunc("/broadcast", s.corsMiddleware(s.serveBroadcastPage))
+
+	if s.config.LoopProtection != "" {
+		action, ok := audio.ParseLoopAction(s.config.LoopProtection)
+		if !ok {
+			return fmt.Errorf("unknown loop protection %q", s.config.LoopProtection)
+		}
+		if s.config.Passthrough && action == audio.LoopMute {
+			return errors.New("loop protection cannot mute in passthrough mode")
+		}
+		s.wsManager.SetLoopAction(action)
+	}
+	if s.config.ClockSource != "" {
+		if err := s.startClock(); err != nil {
+			return err
+		}
+	}
+	s.wsManager.SetEvents(s.events)
+	s.wsManager.SetSilence(s.config.Silence)
+	s.wsManager.SetPassthrough(s.config.Passthrough)
+	s.wsManager.SetJitterBuffer(s.config.JitterBuffer)
+	s.wsManager.SetChannelMixing(s.config.ChannelMixing)
+	if err := s.wsManager.SetResampling(s.config.Resample); err != nil {
+		return err
+	}
+	if err := s.wsManager.SetPipeline(s.config.Pipeline); err != nil {
+		return fmt.Errorf("invalid pipeline: %v", err)
+	}
+
+	if err := validateTokens(s.config.APITokens); err != nil {
+		return err
+	}
+	if s.sourceAuth() {
+		s.wsManager.SetSourceAuth(s.sourceTokenAllowed)
+	}
+
+	dscp, err := s.listenerDSCP()
+	if err != nil {
+		return fmt.Errorf("invalid listener DSCP: %v", err)
+	}
+	s.dscp = dscp
+
+	if s.config.MaintenanceAudio != "" {
+		pcm, err := s.loadAnnouncement(s.config.MaintenanceAudio)
+		if err != nil {
+			return fmt.Errorf("failed to load maintenance audio: %v", err)
+		}
+		s.maintenance.announcement = pcm
+	}
+
+	if s.config.HoldAudio != "" {
+		pcm, err := s.loadAnnouncement(s.config.HoldAudio)
+		if err != nil {
+			return fmt.Errorf("failed to load hold audio: %v", err)
+		}
+		s.hold.announcement = pcm
+	}
+
+	if s.config.SilenceFallback != "" {
+		if !s.config.Silence.Pause {
+			return errors.New("silence fallback needs silence pausing enabled")
+		}
+		pcm, err := s.loadAnnouncement(s.config.SilenceFallback)
+		if err != nil {
+			return fmt.Errorf("failed to load silence fallback: %v", err)
+		}
+		s.startSilenceFallback(pcm)
+	}
+
+	if s.config.DVRDir != "" {
+		if err := s.startDVR(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.RecordDir != "" {
+		if err := os.MkdirAll(s.config.RecordDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create recording directory: %v", err)
+		}
+	}
+
+	if s.config.GeoIPDB != "" {
+		if err := s.startGeoIP(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.SessionsDB != "" {
+		if err := s.startSessions(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.RTPAddr != "" {
+		if err := s.startRTP(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.TSUDPAddr != "" {
+		if err := s.startTSUDP(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.SnapcastAddr != "" {
+		if err := s.startSnapcast(); err != nil {
+			return err
+		}
+	}
+	if s.config.DASHSegment > 0 {
+		s.startDASH()
+	}
+	if s.config.WebRTCAddr != "" {
+		if err := s.startWebRTC(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.PortMapping != "" {
+		if err := s.startPortMapping(); err != nil {
+			return err
+		}
+		defer s.unmapPort()
+	}
+
+	if s.config.MDNS {
+		if err := s.startMDNS(); err != nil {
+			return err
+		}
+		defer s.mdns.Close()
+	}
+
+	if s.config.DLNA {
+		if err := s.startDLNA(); err != nil {
+			return err
+		}
+		defer s.dlna.advertiser.Close()
+	}
+
+	if len(s.config.Triggers) > 0 {
+		if err := s.startTriggers(); err != nil {
+			return err
+		}
+	}
+	if err := s.startWebhooks(); err != nil {
+		return err
+	}
+	if err := s.startListenerThresholds(); err != nil {
+		return err
+	}
+	if s.config.MQTTURL != "" {
+		if err := s.startMQTT(); err != nil {
+			return err
+		}
+	}
+	if err := s.startSinks(); err != nil {
+		return err
+	}
+	s.startTimeline()
+	s.startLoudness()
+	s.metrics.collect(s.writeFrameMetrics)
+	if s.admission = newAdmission(s.config.AdmissionRate, s.config.AdmissionBurst); s.admission != nil {
+		s.metrics.collect(s.writeAdmissionMetrics)
+	}
+	if s.limiter != nil {
+		s.metrics.collect(s.writeRateLimitMetrics)
+	}
+
+	if s.config.UDPIngestAddr != "" {
+		if err := s.startUDPIngest(); err != nil {
+			return err
+		}
+	}
+
+	if s.config.FanoutURL != "" {
+		if err := s.startFanout(); err != nil {
+			return fmt.Errorf("invalid fanout: %v", err)
+		}
+	}
+
+	if s.config.OriginURL != "" {
+		if err := s.startEdge(); err != nil {
+			return fmt.Errorf("invalid origin: %v", err)
+		}
+	}
+
+	if s.config.RelayURL != "" {
+		go relay.New(s.config.RelayURL, s.wsManager, s.logger.With("module", "relay")).Run(context.Background())
+	}
+
+	s.logger.Infof("Started in %s", time.Since(start).Round(time.Millisecond))
+	s.logger.Info("Starting streaming server on http://localhost:" + port + "/")
+	s.logger.Info("Stream player available at http://localhost:" + port + "/listen")
+	s.logger.Info("Browser source available at http://localhost:" + port + "/broadcast")
+	httpServer := &http.Server{Handler: s.metrics.middleware(s.rateLimit(http.DefaultServeMux)), ConnContext: withConn}
+
+	stopped := make(chan struct{})
+	if s.config.IdleTimeout > 0 {
+		go s.watchIdle(func() {
+			defer close(stopped)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := httpServer.Shutdown(ctx); err != nil {
+				httpServer.Close()
+			}
+		})
+	}
+	serving = true
+	if err := httpServer.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-stopped
+	return nil
+}
+
+// registerAPI adds the /api endpoints to mux
+func (s *Server) registerAPI(mux *http.ServeMux) {
+	// Connection stats, with listener addresses; /api/public/stats is the
+	// anonymous summary
+	mux.HandleFunc("/api/v1/stats", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleStats)))
+
+	// The instances sharing the broadcast over a fanout bus, with their
+	// sources' addresses
+	mux.HandleFunc("/api/v1/cluster", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleCluster)))
+
+	// Connected listeners, and disconnecting them
+	mux.HandleFunc("/api/v1/listeners", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleListeners)))
+	mux.HandleFunc("/api/v1/listeners/", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleListener)))
+
+	// Where listeners are connected from, located with the GeoIP database
+	mux.HandleFunc("/api/v1/geo", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleGeo)))
+
+	// DLNA renderers on the LAN, and pushing the stream to them
+	mux.HandleFunc("/api/v1/renderers", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleRenderers)))
+	mux.HandleFunc("/api/v1/renderers/", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleRenderer)))
+
+	// Listener count and live status for station websites
+	mux.HandleFunc("/api/public/stats", s.corsMiddleware(s.handlePublicStats))
+
+	// Now-playing metadata
+	mux.HandleFunc("/api/v1/metadata", s.corsMiddleware(s.authorizeChanges(ScopeMetadata, s.handleMetadata)))
+
+	// Maintenance windows
+	mux.HandleFunc("/api/v1/maintenance", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleMaintenance)))
+
+	// Holding the source off air for an interlude
+	mux.HandleFunc("/api/v1/hold", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleHold)))
+
+	// Gain of the source client, adjustable from the server
+	mux.HandleFunc("/api/v1/source/gain", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleSourceGain)))
+
+	// Listener and source sessions recorded in the session database
+	mux.HandleFunc("/api/v1/sessions", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleSessions)))
+
+	// Recording the broadcast on demand
+	mux.HandleFunc("/api/v1/recording", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleRecording)))
+
+	// DSP stages, adjustable while on air
+	mux.HandleFunc("/api/v1/pipeline", s.corsMiddleware(s.authorize(ScopeAdmin, s.handlePipeline)))
+
+	// Notable events of the last day, for reviewing shows, with sources'
+	// addresses
+	mux.HandleFunc("/api/v1/timeline", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleTimeline)))
+
+	// EBU R128 loudness of the broadcast
+	mux.HandleFunc("/api/v1/loudness", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleLoudness)))
+
+	// Conversion of uploaded audio files to another rate or channel count,
+	// which is heavy enough to keep from anonymous clients
+	mux.HandleFunc("/api/v1/convert", s.corsMiddleware(s.authorize(ScopeAdmin, s.handleConvert)))
+
+	// Server events, such as level triggers, as server-sent events
+	mux.HandleFunc("/api/v1/events", s.corsMiddleware(s.handleEvents))
 }
 
 // corsMiddleware handles CORS headers
 func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers",
-			"Content-Type, Authorization, Accept, Origin, X-Requested-With")
+			"Content-Type, Authorization, Accept, Origin, X-Requested-With, Range, If-Range")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Accept-Ranges, ETag")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -68,6 +670,36 @@ func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 // handleWebSocket handles WebSocket connections
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Check if this is a source connection
+	isSource := r.URL.Query().Get("source") == "true"
+
+	profile, err := s.listenerProfile(r)
+	if !isSource && err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !isSource && !s.admit(w, r) {
+		return
+	}
+	if isSource && !s.sourceAllowed(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="minicast"`)
+		http.Error(w, "a valid source token is required", http.StatusUnauthorized)
+		return
+	}
+
+	var format ws.SourceFormat
+	var feed ws.Feed
+	if isSource {
+		format, err = s.sourceFormat(r)
+	} else {
+		feed, err = s.listenerFeed(r)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Upgrade HTTP connection to WebSocket
 	conn, err := s.wsManager.GetUpgrader().Upgrade(w, r, nil)
 	if err != nil {
@@ -75,36 +707,152 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if this is a source connection
-	isSource := r.URL.Query().Get("source") == "true"
-
+	info := s.wsManager.ConnInfo(r, conn)
 	if isSource {
-		s.wsManager.HandleSource(conn)
+		s.wsManager.HandleSource(conn, info, format)
 	} else {
-		s.wsManager.HandleListener(conn)
+		s.markListener(r, profile)
+		s.wsManager.HandleListener(conn, info, profile, feed)
 	}
 }
 
-// serveIndexPage serves the index page
-func (s *Server) serveIndexPage(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.ParseFS(templates, "templates/index.html")
-	if err != nil {
-		s.logger.Errorf("Failed to parse template: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+// sourceFormat returns the format a source announces with ?codec=, ?rate=,
+// ?channels= and ?bits=, defaulting to the broadcast format. Sources may instead
+// (or also) send a handshake frame once connected.
+func (s *Server) sourceFormat(r *http.Request) (ws.SourceFormat, error) {
+	query := r.URL.Query()
+	format := s.wsManager.BroadcastFormat()
+
+	if codec := query.Get("codec"); codec != "" {
+		format.Codec = codec
+		if codec == ws.CodecFloat {
+			format.BitDepth = 32
+		}
+	}
+	if bits := query.Get("bits"); bits != "" {
+		format.BitDepth, _ = strconv.Atoi(bits)
+	}
+	if rate := query.Get("rate"); rate != "" {
+		format.SampleRate, _ = strconv.Atoi(rate)
 	}
+	if channels := query.Get("channels"); channels != "" {
+		format.Channels, _ = strconv.Atoi(channels)
+	}
+	if s.config.Passthrough && (format.Codec != ws.CodecPCM || format.BitDepth != 16) {
+		return format, errors.New("passthrough mode only accepts 16-bit pcm sources")
+	}
+	return format, format.Validate()
+}
 
-	w.Header().Set("Content-Type", "text/html")
-	if err := tmpl.Execute(w, nil); err != nil {
-		s.logger.Errorf("Failed to execute template: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+// handleStats reports the source and listeners with their negotiated
+// connection details
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.wsManager.Stats()); err != nil {
+		s.logger.Errorf("Failed to encode stats: %v", err)
+	}
+}
+
+// writeFrameMetrics writes how many source frames were dropped as
+// retransmitted or out of order
+func (s *Server) writeFrameMetrics(w io.Writer) {
+	duplicate, late := s.wsManager.DroppedFrames()
+	fmt.Fprintf(w, "# HELP minicast_source_frames_dropped_total Framed source frames dropped by reason.\n"+
+		"# TYPE minicast_source_frames_dropped_total counter\n"+
+		"minicast_source_frames_dropped_total{reason=\"duplicate\"} %d\n"+
+		"minicast_source_frames_dropped_total{reason=\"late\"} %d\n", duplicate, late)
+}
+
+// handleMetadata returns the now-playing metadata on GET and replaces it on PUT
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var md ws.Metadata
+		if err := json.NewDecoder(r.Body).Decode(&md); err != nil {
+			http.Error(w, fmt.Sprintf("invalid metadata: %v", err), http.StatusBadRequest)
+			return
+		}
+		s.wsManager.SetMetadata(md)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.wsManager.Metadata()); err != nil {
+		s.logger.Errorf("Failed to encode metadata: %v", err)
+	}
+}
+
+// listenerProfile resolves the profile and format requested by a listener
+// with ?profile= and ?format=, validating them against passthrough mode
+func (s *Server) listenerProfile(r *http.Request) (ws.Profile, error) {
+	query := r.URL.Query()
+
+	profile, ok := ws.LookupProfile(query.Get("profile"))
+	if !ok {
+		return profile, fmt.Errorf("unknown profile %q", query.Get("profile"))
+	}
+
+	if name := query.Get("format"); name != "" {
+		format, ok := ws.ParseFormat(name)
+		if !ok {
+			return profile, fmt.Errorf("unknown format %q", name)
+		}
+		if s.config.Passthrough && format != ws.FormatPCM {
+			return profile, fmt.Errorf("format %q is not available in passthrough mode", name)
+		}
+		profile.Format = format
+	} else if s.config.Passthrough {
+		profile.Format = ws.FormatPCM
+	}
+
+	switch channels := query.Get("channels"); channels {
+	case "":
+	case "1":
+		if s.config.Passthrough {
+			return profile, fmt.Errorf("mono is not available in passthrough mode")
+		}
+		profile.Mono = true
+	default:
+		return profile, fmt.Errorf("unsupported channels %q (only 1 can be requested)", channels)
+	}
+	profile.Levels = query.Get("levels") == "true"
+
+	return profile, nil
+}
+
+// serveIndexPage serves the index page
+func (s *Server) serveIndexPage(w http.ResponseWriter, r *http.Request) {
+	s.renderTemplate(w, "index.html", nil)
 }
 
 // serveStreamPage serves the stream player page
 func (s *Server) serveStreamPage(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.ParseFS(templates, "templates/player.html")
+	s.renderTemplate(w, "player.html", struct{ Framing, MSE bool }{
+		Framing: !s.config.Passthrough,
+		MSE:     !s.config.Passthrough,
+	})
+}
+
+// serveBroadcastPage serves the browser source page
+func (s *Server) serveBroadcastPage(w http.ResponseWriter, r *http.Request) {
+	s.renderTemplate(w, "broadcast.html", struct {
+		SampleRate  int
+		NumChannels int
+		Opus        bool
+	}{
+		SampleRate:  s.audio.GetSampleRate(),
+		NumChannels: s.audio.GetNumChannels(),
+		Opus:        audio.OpusAvailable() && !s.config.Passthrough,
+	})
+}
+
+// renderTemplate executes the named template and writes it to the response
+func (s *Server) renderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	tmpl, err := s.loadTemplate(name)
 	if err != nil {
 		s.logger.Errorf("Failed to parse template: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -112,9 +860,27 @@ func (s *Server) serveStreamPage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "text/html")
-	if err := tmpl.Execute(w, nil); err != nil {
+	if err := tmpl.Execute(w, data); err != nil {
 		s.logger.Errorf("Failed to execute template: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 }
+
+// loadTemplate parses the named template, preferring the override directory
+// when one is configured. Templates are read on every request so edits to the
+// override directory take effect without a restart.
+func (s *Server) loadTemplate(name string) (*template.Template, error) {
+	if s.config.TemplateDir != "" {
+		path := filepath.Join(s.config.TemplateDir, name)
+		if _, err := os.Stat(path); err == nil {
+			tmpl, err := template.ParseFiles(path)
+			if err == nil {
+				return tmpl, nil
+			}
+			s.logger.Warnf("Failed to parse override template %s, using embedded copy: %v", path, err)
+		}
+	}
+
+	return template.ParseFS(templates, "templates/"+name)
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"go.uber.org/zap"
+)
+
+const (
+	// sessionQueue is how many finished sessions may wait to be written
+	// before more are dropped
+	sessionQueue = 1024
+	// sessionTime is how times are stored: SQLite's own format, in UTC,
+	// so they sort and work with its date functions
+	sessionTime = "2006-01-02 15:04:05.000"
+
+	defaultSessionLimit = 100
+	maxSessionLimit     = 10000
+)
+
+// sessionSchema creates the sessions table and the index reviews use
+const sessionSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id               INTEGER PRIMARY KEY,
+	kind             TEXT NOT NULL,
+	listener_id      INTEGER,
+	profile          TEXT,
+	transport        TEXT NOT NULL,
+	mount            TEXT,
+	remote_addr      TEXT,
+	ip               TEXT,
+	user_agent       TEXT,
+	http_version     TEXT,
+	tls_version      TEXT,
+	country          TEXT,
+	city             TEXT,
+	connected_at     TEXT NOT NULL,
+	disconnected_at  TEXT NOT NULL,
+	duration_seconds REAL NOT NULL,
+	bytes            INTEGER NOT NULL,
+	dropped          INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_connected_at ON sessions (connected_at);
+`
+
+// sessionColumns are the columns added since the sessions table was
+// first created, added to older databases when they are opened
+var sessionColumns = []string{"country TEXT", "city TEXT"}
+
+// sessionStore writes finished listener and source sessions to a SQLite
+// database, from a queue so the Manager never waits on the disk
+type sessionStore struct {
+	db     *sql.DB
+	queue  chan ws.Session
+	logger *zap.SugaredLogger
+}
+
+// startSessions opens the session database and logs sessions into it
+func (s *Server) startSessions() error {
+	db, err := sql.Open("sqlite3", s.config.SessionsDB+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err == nil {
+		_, err = db.Exec(sessionSchema)
+	}
+	if err == nil {
+		err = migrateSessions(db)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open session database: %v", err)
+	}
+	store := &sessionStore{db: db, queue: make(chan ws.Session, sessionQueue), logger: s.logger.With("module", "sessions")}
+	s.sessions = store
+	s.wsManager.SetSessionLog(store.log)
+	go store.run()
+	s.logger.Infof("Recording sessions in %s", s.config.SessionsDB)
+	return nil
+}
+
+// migrateSessions adds the columns an older sessions table lacks
+func migrateSessions(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('sessions')")
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range sessionColumns {
+		name, _, _ := strings.Cut(column, " ")
+		if have[name] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE sessions ADD COLUMN " + column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// log queues a finished session, dropping it if the disk is not keeping up
+func (st *sessionStore) log(session ws.Session) {
+	select {
+	case st.queue <- session:
+	default:
+		st.logger.Warnw("Session queue full, dropped a session", "kind", session.Kind, "remote", session.RemoteAddr)
+	}
+}
+
+// run writes queued sessions
+func (st *sessionStore) run() {
+	for session := range st.queue {
+		if err := st.insert(session); err != nil {
+			st.logger.Errorf("Failed to record session: %v", err)
+		}
+	}
+}
+
+// insert writes one session
+func (st *sessionStore) insert(session ws.Session) error {
+	ip := session.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	var listenerID interface{}
+	if session.Kind == "listener" {
+		listenerID = session.ID
+	}
+	_, err := st.db.Exec(`INSERT INTO sessions (kind, listener_id, profile, transport, mount, remote_addr, ip,
+		user_agent, http_version, tls_version, country, city, connected_at, disconnected_at, duration_seconds,
+		bytes, dropped)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.Kind, listenerID, session.Profile, session.Transport, session.Path, session.RemoteAddr, ip,
+		session.UserAgent, session.HTTPVersion, session.TLSVersion, nullable(session.Country), nullable(session.City),
+		session.ConnectedAt.UTC().Format(sessionTime), session.EndedAt.UTC().Format(sessionTime),
+		session.EndedAt.Sub(session.ConnectedAt).Seconds(), session.Bytes, session.Dropped)
+	return err
+}
+
+// nullable stores an empty string as NULL
+func nullable(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// sessionQuery selects recorded sessions
+type sessionQuery struct {
+	kind         string
+	country      string
+	since, until time.Time
+	limit        int
+}
+
+// query returns the sessions that started in the query's window, newest
+// first
+func (st *sessionStore) query(q sessionQuery) ([]ws.Session, error) {
+	var where []string
+	var args []interface{}
+	if q.kind != "" {
+		where, args = append(where, "kind = ?"), append(args, q.kind)
+	}
+	if q.country != "" {
+		where, args = append(where, "country = ?"), append(args, q.country)
+	}
+	if !q.since.IsZero() {
+		where, args = append(where, "connected_at >= ?"), append(args, q.since.UTC().Format(sessionTime))
+	}
+	if !q.until.IsZero() {
+		where, args = append(where, "connected_at < ?"), append(args, q.until.UTC().Format(sessionTime))
+	}
+	query := `SELECT kind, COALESCE(listener_id, 0), profile, transport, mount, remote_addr, user_agent,
+		http_version, tls_version, COALESCE(country, ''), COALESCE(city, ''), connected_at, disconnected_at,
+		bytes, dropped FROM sessions`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY connected_at DESC, id DESC LIMIT ?"
+	args = append(args, q.limit)
+
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []ws.Session{}
+	for rows.Next() {
+		var session ws.Session
+		var connected, ended string
+		if err := rows.Scan(&session.Kind, &session.ID, &session.Profile, &session.Transport, &session.Path,
+			&session.RemoteAddr, &session.UserAgent, &session.HTTPVersion, &session.TLSVersion,
+			&session.Country, &session.City, &connected, &ended, &session.Bytes, &session.Dropped); err != nil {
+			return nil, err
+		}
+		session.ConnectedAt, _ = time.Parse(sessionTime, connected)
+		session.EndedAt, _ = time.Parse(sessionTime, ended)
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// parseSessionTime reads a query's time: an RFC 3339 time, or a duration
+// meaning that long ago
+func parseSessionTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// handleSessions returns recorded sessions, newest first, filtered by
+// ?kind=listener|source, ?country= (an ISO 3166 code), ?since= and
+// ?until= (RFC 3339 times or durations ago) and ?limit=
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.sessions == nil {
+		http.Error(w, "session history is not enabled; start the server with -sessions-db", http.StatusNotFound)
+		return
+	}
+
+	params := r.URL.Query()
+	now := time.Now()
+	q := sessionQuery{kind: params.Get("kind"), country: strings.ToUpper(params.Get("country")), limit: defaultSessionLimit}
+	if q.kind != "" && q.kind != "listener" && q.kind != "source" {
+		http.Error(w, "kind must be listener or source", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if q.since, err = parseSessionTime(params.Get("since"), now); err != nil {
+		http.Error(w, fmt.Sprintf("invalid since: %v", err), http.StatusBadRequest)
+		return
+	}
+	if q.until, err = parseSessionTime(params.Get("until"), now); err != nil {
+		http.Error(w, fmt.Sprintf("invalid until: %v", err), http.StatusBadRequest)
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.limit, err = strconv.Atoi(limit); err != nil || q.limit < 1 || q.limit > maxSessionLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxSessionLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sessions, err := s.sessions.query(q)
+	if err != nil {
+		s.logger.Errorf("Failed to query sessions: %v", err)
+		http.Error(w, "failed to query sessions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		s.logger.Errorf("Failed to encode sessions: %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// startSilenceFallback loops pcm to listeners whenever a silent source is
+// paused, until its audio resumes or it disconnects
+func (s *Server) startSilenceFallback(pcm []byte) {
+	events, _ := s.events.Subscribe(16)
+
+	go func() {
+		var cancel context.CancelFunc
+		for event := range events {
+			silence, ok := event.Data.(ws.SilenceEvent)
+			if !ok {
+				continue
+			}
+			switch {
+			case silence.Paused && cancel == nil:
+				ctx, stop := context.WithCancel(context.Background())
+				cancel = stop
+				go s.announce(ctx, pcm)
+			case !silence.Active && cancel != nil:
+				cancel()
+				cancel = nil
+			}
+		}
+	}()
+}
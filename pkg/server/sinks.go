@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/sink"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// startSinks starts the configured external commands and registers them
+// as listeners
+func (s *Server) startSinks() error {
+	names := make(map[string]bool)
+	for _, config := range s.config.Sinks {
+		if names[config.Name] {
+			return fmt.Errorf("sink %q is configured twice", config.Name)
+		}
+		names[config.Name] = true
+
+		tap, ok := ws.ParseTap(config.Tap)
+		if !ok {
+			return fmt.Errorf("sink %q: unknown tap %q (available: mix, source)", config.Name, config.Tap)
+		}
+		exec, err := sink.New(config, s.wsManager.OutputFormat(), s.logger.With("module", "sink"))
+		if err != nil {
+			return err
+		}
+		go exec.Run(context.Background())
+
+		// A command that falls behind loses audio rather than being
+		// disconnected, which would stop it for good
+		profile, _ := ws.LookupProfile("balanced")
+		profile.Tap = tap
+		info := ws.ConnInfo{Transport: "exec", RemoteAddr: config.Name, ConnectedAt: time.Now()}
+		s.wsManager.AddListener(exec, info, profile, nil)
+	}
+	if len(s.config.Sinks) > 0 {
+		s.logger.Infof("Started %d external command sinks", len(s.config.Sinks))
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/snapcast"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// startSnapcast serves the broadcast to Snapcast clients for synchronized
+// multiroom playback
+func (s *Server) startSnapcast() error {
+	if s.config.Passthrough {
+		return errors.New("Snapcast output is not available in passthrough mode")
+	}
+	server, err := snapcast.Listen(s.config.SnapcastAddr, s.config.SnapcastBuffer, s.logger.With("module", "snapcast"))
+	if err != nil {
+		return fmt.Errorf("failed to start Snapcast server: %v", err)
+	}
+	s.snapcast = server
+
+	// Clients have their own buffers, so stay as close to live as possible
+	profile, _ := ws.LookupProfile("low-latency")
+	info := ws.ConnInfo{Transport: "snapcast", RemoteAddr: server.Addr().String(), ConnectedAt: time.Now()}
+	s.wsManager.AddListener(server, info, profile, nil)
+	s.metrics.collect(s.writeSnapcastMetrics)
+	s.logger.Infof("Serving Snapcast clients on %s, playing %s behind", server.Addr(), s.config.SnapcastBuffer)
+	return nil
+}
+
+// writeSnapcastMetrics writes how many Snapcast clients are connected
+func (s *Server) writeSnapcastMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP minicast_snapcast_clients Connected Snapcast clients.\n"+
+		"# TYPE minicast_snapcast_clients gauge\nminicast_snapcast_clients %d\n", s.snapcast.Clients())
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+// httpListener streams broadcast frames over a chunked HTTP response, for
+// clients whose network blocks WebSockets
+type httpListener struct {
+	w       io.Writer
+	flusher http.Flusher
+	icy     *icyWriter
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Send writes the frame and flushes it to the client
+func (l *httpListener) Send(data []byte) error {
+	if _, err := l.w.Write(data); err != nil {
+		return err
+	}
+	l.flusher.Flush()
+	return nil
+}
+
+// SendMetadata updates the ICY title for clients that requested metadata
+func (l *httpListener) SendMetadata(md ws.Metadata) error {
+	if l.icy != nil {
+		l.icy.SetTitle(md.StreamTitle())
+	}
+	return nil
+}
+
+// Close ends the response
+func (l *httpListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// handleHTTPStream serves the live stream as a never-ending WAV file over
+// chunked HTTP, registered with the same listener registry as WebSockets
+func (s *Server) handleHTTPStream(w http.ResponseWriter, r *http.Request) {
+	// The WAV header is sent once and payloads are untouched, so this is
+	// compatible with passthrough; only the buffering side of the profile applies
+	profile, err := s.listenerProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if profile.Format == ws.FormatFramed {
+		http.Error(w, "framed audio is only available over WebSockets", http.StatusBadRequest)
+		return
+	}
+	feed, err := s.listenerFeed(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if !s.admit(w, r) {
+		return
+	}
+
+	s.markListener(r, profile)
+	listener := &httpListener{w: w, flusher: flusher, done: make(chan struct{})}
+
+	// Radio clients ask for interleaved now-playing metadata
+	if r.Header.Get("Icy-MetaData") == "1" {
+		listener.icy = newIcyWriter(w)
+		listener.w = listener.icy
+		w.Header().Set("icy-metaint", strconv.Itoa(icyMetaInt))
+		w.Header().Set("icy-name", "MiniCast")
+	}
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	// The header describes what the current source sends
+	format := s.wsManager.ListenerFormat(profile)
+	header := audio.NewProcessor(format.SampleRate, format.Channels, format.BitDepth).StreamHeader()
+	if _, err := listener.w.Write(header); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	s.wsManager.AddListener(listener, ws.RequestInfo(r, "http"), profile, feed)
+	defer s.wsManager.RemoveListener(listener)
+
+	waitListener(w, r, listener.done)
+}
+
+// waitListener blocks until the client goes away or its listener is closed,
+// as kicking it does. A write still in flight to a stalled client is then
+// cut short, so removing the listener does not wait on it.
+func waitListener(w http.ResponseWriter, r *http.Request, done <-chan struct{}) {
+	select {
+	case <-r.Context().Done():
+	case <-done:
+		http.NewResponseController(w).SetWriteDeadline(time.Now())
+	}
+}
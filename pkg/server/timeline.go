@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/events"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+const (
+	// timelineSize is how many events the timeline keeps, oldest dropped first
+	timelineSize = 10000
+	// timelineWindow is how far back the timeline API looks without ?from=
+	timelineWindow = 24 * time.Hour
+	// audienceTick is how often the listener count is sampled for peaks
+	audienceTick = time.Second
+)
+
+// timelineTypes are the events worth keeping in the timeline
+var timelineTypes = map[string]bool{
+	"source":      true,
+	"silence":     true,
+	"metadata":    true,
+	"maintenance": true,
+	"hold":        true,
+	"trigger":     true,
+	"recording":   true,
+}
+
+// ListenerPeakEvent is the data of a "listener_peak" timeline event: the
+// most listeners connected at once while a source was on air, or while
+// none was
+type ListenerPeakEvent struct {
+	Listeners int `json:"listeners"`
+}
+
+// timeline records notable events for reviewing a show afterwards: source
+// connects and disconnects, silences, metadata changes, maintenance,
+// holds, triggers, recordings and listener peaks. It is kept in memory.
+type timeline struct {
+	mu     sync.Mutex
+	events []events.Event
+
+	// peak is the index of the current session's listener peak event, or
+	// -1 before anyone has listened in this session
+	peak int
+}
+
+// startTimeline records events from the bus and listener peaks
+func (s *Server) startTimeline() {
+	s.timeline.peak = -1
+	events, _ := s.events.Subscribe(256)
+
+	go func() {
+		ticker := time.NewTicker(audienceTick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case event := <-events:
+				s.timeline.add(event)
+			case now := <-ticker.C:
+				s.timeline.sampleAudience(s.audience(s.wsManager.Stats()), now)
+			}
+		}
+	}()
+}
+
+// audience counts the listeners that are people, leaving out internal ones
+// such as the DVR and triggers. Snapcast clients share one listener, so
+// they are counted from the Snapcast server, and DASH players hold no
+// connection, so they are counted from their recent fetches.
+func (s *Server) audience(stats ws.Stats) int {
+	count := 0
+	for _, l := range stats.Listeners {
+		if l.Transport == "websocket" || l.Transport == "http" || l.Transport == "webrtc" {
+			count++
+		}
+	}
+	if s.snapcast != nil {
+		count += s.snapcast.Clients()
+	}
+	if s.dash != nil {
+		count += s.dash.listening(time.Now())
+	}
+	return count
+}
+
+// add records an event if it belongs in the timeline. A source connecting
+// or disconnecting starts a new session with its own listener peak.
+func (t *timeline) add(event events.Event) {
+	if !timelineTypes[event.Type] {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.append(event)
+	if _, ok := event.Data.(ws.SourceEvent); ok {
+		t.peak = -1
+	}
+}
+
+// sampleAudience records a new listener peak for the current session,
+// updating the session's peak event rather than adding one per listener
+func (t *timeline) sampleAudience(count int, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.peak >= 0 {
+		if count <= t.events[t.peak].Data.(ListenerPeakEvent).Listeners {
+			return
+		}
+		t.events[t.peak].Data = ListenerPeakEvent{Listeners: count}
+		t.events[t.peak].Time = now
+		return
+	}
+	if count > 0 {
+		t.append(events.Event{Type: "listener_peak", Time: now, Data: ListenerPeakEvent{Listeners: count}})
+		t.peak = len(t.events) - 1
+	}
+}
+
+// append adds an event, dropping the oldest when full. Called with the lock
+// held.
+func (t *timeline) append(event events.Event) {
+	if len(t.events) == timelineSize {
+		t.events = append(t.events[:0], t.events[1:]...)
+		if t.peak--; t.peak < 0 {
+			t.peak = -1
+		}
+	}
+	t.events = append(t.events, event)
+}
+
+// between returns the events from from up to to, in time order. A peak
+// updated since it was added may be out of order, so they are sorted.
+func (t *timeline) between(from, to time.Time) []events.Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	found := []events.Event{}
+	for _, event := range t.events {
+		if !event.Time.Before(from) && !event.Time.After(to) {
+			found = append(found, event)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Time.Before(found[j].Time) })
+	return found
+}
+
+// timelineResponse is the API view of the timeline
+type timelineResponse struct {
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Events []events.Event `json:"events"`
+}
+
+// handleTimeline returns the timeline events between ?from= and ?to=
+// (RFC 3339), defaulting to the last day
+func (s *Server) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-timelineWindow)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if to.Before(from) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := timelineResponse{From: from, To: to, Events: s.timeline.between(from, to)}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Errorf("Failed to encode timeline: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestTimelineNeedsAdminToken(t *testing.T) {
+	s := &Server{
+		config: Config{APITokens: []APIToken{
+			{Name: "dj", Token: "metadata-token-0123", Scopes: []string{ScopeMetadata}},
+			{Name: "ops", Token: "admin-token-0123456", Scopes: []string{ScopeAdmin}},
+		}},
+		logger: zap.NewNop().Sugar(),
+	}
+	mux := http.NewServeMux()
+	s.registerAPI(mux)
+
+	for token, want := range map[string]int{
+		"":                    http.StatusUnauthorized,
+		"metadata-token-0123": http.StatusForbidden,
+		"admin-token-0123456": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/timeline", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("token %q: got %d, want %d", token, w.Code, want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Token scopes
+const (
+	// ScopeAdmin allows every change made through the API
+	ScopeAdmin = "admin"
+	// ScopeMetadata only allows updating the now-playing metadata, for
+	// scripts such as a DJ's now-playing pusher
+	ScopeMetadata = "metadata"
+	// ScopeSource allows broadcasting and uploading missed audio. Once any
+	// token has it, sources must present one.
+	ScopeSource = "source"
+)
+
+// minTokenLength keeps tokens long enough not to be guessed
+const minTokenLength = 16
+
+// APIToken is a bearer token allowed to change the server through its API,
+// within its scopes
+type APIToken struct {
+	Name   string   `yaml:"name"`
+	Token  string   `yaml:"token"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// validateTokens checks that tokens are named, long enough, distinct and
+// scoped to known scopes
+func validateTokens(tokens []APIToken) error {
+	names := map[string]bool{}
+	values := map[string]bool{}
+	for _, t := range tokens {
+		switch {
+		case t.Name == "":
+			return fmt.Errorf("api token needs a name")
+		case names[t.Name]:
+			return fmt.Errorf("duplicate api token name %q", t.Name)
+		case len(t.Token) < minTokenLength:
+			return fmt.Errorf("api token %q must be at least %d characters", t.Name, minTokenLength)
+		case values[t.Token]:
+			return fmt.Errorf("api token %q reuses another token", t.Name)
+		case len(t.Scopes) == 0:
+			return fmt.Errorf("api token %q needs scopes (%s, %s or %s)", t.Name, ScopeAdmin, ScopeMetadata, ScopeSource)
+		}
+		for _, scope := range t.Scopes {
+			if scope != ScopeAdmin && scope != ScopeMetadata && scope != ScopeSource {
+				return fmt.Errorf("api token %q has unknown scope %q", t.Name, scope)
+			}
+		}
+		names[t.Name], values[t.Token] = true, true
+	}
+	return nil
+}
+
+// lookupToken returns the configured token matching value, comparing in
+// constant time
+func (s *Server) lookupToken(value string) (APIToken, bool) {
+	var found APIToken
+	ok := false
+	for _, t := range s.config.APITokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(value)) == 1 {
+			found, ok = t, true
+		}
+	}
+	return found, ok
+}
+
+// authorize requires requests to carry a bearer token with scope, or the
+// admin scope, once any tokens are configured. Reads need one too, as admin
+// endpoints expose listener addresses and history.
+func (s *Server) authorize(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.config.APITokens) == 0 {
+			next(w, r)
+			return
+		}
+
+		value, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token, ok := s.lookupToken(strings.TrimSpace(value))
+		if !found || !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="minicast"`)
+			http.Error(w, "a valid api token is required", http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(token.Scopes, scope) && !slices.Contains(token.Scopes, ScopeAdmin) {
+			s.logger.Warnw("API token used outside its scopes", "token", token.Name, "path", r.URL.Path)
+			http.Error(w, fmt.Sprintf("api token %q may not use %s", token.Name, r.URL.Path), http.StatusForbidden)
+			return
+		}
+		s.logger.Debugw("Authorized API request", "token", token.Name, "method", r.Method, "path", r.URL.Path)
+		next(w, r)
+	}
+}
+
+// isAdmin reports whether r may see what admin endpoints show: anyone
+// until tokens are configured, and then requests with an admin token
+func (s *Server) isAdmin(r *http.Request) bool {
+	if len(s.config.APITokens) == 0 {
+		return true
+	}
+	value, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	token, ok := s.lookupToken(strings.TrimSpace(value))
+	return found && ok && slices.Contains(token.Scopes, ScopeAdmin)
+}
+
+// authorizeChanges is authorize for public endpoints, such as the
+// now-playing metadata the player shows: anyone may read them, and only
+// requests that change something need a token
+func (s *Server) authorizeChanges(scope string, next http.HandlerFunc) http.HandlerFunc {
+	authorized := s.authorize(scope, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		authorized(w, r)
+	}
+}
+
+// sourceAuth reports whether sources must present a token, which they do
+// once any token has the source scope
+func (s *Server) sourceAuth() bool {
+	for _, t := range s.config.APITokens {
+		if slices.Contains(t.Scopes, ScopeSource) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceTokenAllowed reports whether value is a token with the source or
+// admin scope
+func (s *Server) sourceTokenAllowed(value string) bool {
+	token, ok := s.lookupToken(value)
+	return ok && (slices.Contains(token.Scopes, ScopeSource) || slices.Contains(token.Scopes, ScopeAdmin))
+}
+
+// sourceAllowed reports whether a request may broadcast or upload audio:
+// always without source tokens, and otherwise with one sent as a bearer
+// token or, for browsers, which cannot set headers on WebSockets, ?token=
+func (s *Server) sourceAllowed(r *http.Request) bool {
+	if !s.sourceAuth() {
+		return true
+	}
+	value, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		value = r.URL.Query().Get("token")
+	}
+	if s.sourceTokenAllowed(strings.TrimSpace(value)) {
+		return true
+	}
+	s.logger.Warnw("Refused a source without a valid token", "remote", r.RemoteAddr, "path", r.URL.Path)
+	return false
+}
+
+// authorizeSource requires requests that change something to come from a
+// source allowed by sourceAllowed
+func (s *Server) authorizeSource(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.sourceAllowed(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="minicast"`)
+			http.Error(w, "a valid source token is required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
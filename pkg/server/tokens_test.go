@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maks112v/minicast/pkg/events"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+func TestAuthorize(t *testing.T) {
+	s := &Server{
+		config: Config{APITokens: []APIToken{
+			{Name: "dj", Token: "metadata-token-0123", Scopes: []string{ScopeMetadata}},
+			{Name: "ops", Token: "admin-token-0123456", Scopes: []string{ScopeAdmin}},
+		}},
+		logger: zap.NewNop().Sugar(),
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	admin := s.authorize(ScopeAdmin, ok)
+	metadata := s.authorizeChanges(ScopeMetadata, ok)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		token   string
+		want    int
+	}{
+		{"admin read without token", admin, http.MethodGet, "", http.StatusUnauthorized},
+		{"admin head without token", admin, http.MethodHead, "", http.StatusUnauthorized},
+		{"admin read with wrong token", admin, http.MethodGet, "not-a-token-at-all", http.StatusUnauthorized},
+		{"admin read with metadata token", admin, http.MethodGet, "metadata-token-0123", http.StatusForbidden},
+		{"admin read with admin token", admin, http.MethodGet, "admin-token-0123456", http.StatusOK},
+		{"admin change with admin token", admin, http.MethodDelete, "admin-token-0123456", http.StatusOK},
+		{"public read without token", metadata, http.MethodGet, "", http.StatusOK},
+		{"public change without token", metadata, http.MethodPut, "", http.StatusUnauthorized},
+		{"public change with metadata token", metadata, http.MethodPut, "metadata-token-0123", http.StatusOK},
+		{"public change with admin token", metadata, http.MethodPut, "admin-token-0123456", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/v1/test", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		tt.handler(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAuthorizeWithoutTokens(t *testing.T) {
+	s := &Server{logger: zap.NewNop().Sugar()}
+	handler := s.authorize(ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {})
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, "/api/v1/test", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d, want 200", method, w.Code)
+		}
+	}
+}
+
+func TestAdminRoutesNeedTokens(t *testing.T) {
+	s := &Server{
+		config: Config{APITokens: []APIToken{
+			{Name: "dj", Token: "metadata-token-0123", Scopes: []string{ScopeMetadata}},
+		}},
+		logger: zap.NewNop().Sugar(),
+	}
+	mux := http.NewServeMux()
+	s.registerAPI(mux)
+
+	for _, path := range []string{
+		"/api/v1/stats", "/api/v1/cluster", "/api/v1/listeners", "/api/v1/listeners/1",
+		"/api/v1/geo", "/api/v1/renderers", "/api/v1/maintenance", "/api/v1/hold",
+		"/api/v1/source/gain", "/api/v1/sessions", "/api/v1/recording", "/api/v1/pipeline",
+		"/api/v1/timeline", "/api/v1/loudness", "/api/v1/convert",
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without a token: got %d, want 401", path, w.Code)
+		}
+	}
+}
+
+func TestEventsHideSourceAddress(t *testing.T) {
+	s := &Server{
+		config: Config{APITokens: []APIToken{
+			{Name: "ops", Token: "admin-token-0123456", Scopes: []string{ScopeAdmin}},
+		}},
+		events: events.NewBus(),
+		logger: zap.NewNop().Sugar(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(s.handleEvents))
+	defer server.Close()
+
+	for token, want := range map[string]bool{"": false, "admin-token-0123456": true} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The handler has subscribed once the headers are sent
+		s.events.Publish("source", ws.SourceEvent{Connected: true, Transport: "websocket", RemoteAddr: "192.0.2.7:5000"})
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				if got := strings.Contains(data, "192.0.2.7"); got != want {
+					t.Errorf("token %q: address shown %v, want %v: %s", token, got, want, data)
+				}
+				break
+			}
+		}
+		resp.Body.Close()
+	}
+}
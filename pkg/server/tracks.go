@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+const (
+	// defaultTrackGap is the shortest silence that separates tracks
+	defaultTrackGap = 2 * time.Second
+	// defaultTrackThreshold is the level (in dBFS) below which audio
+	// counts as a gap between tracks
+	defaultTrackThreshold = -50.0
+	// defaultMinTrack is the shortest track a silence may cut off, so
+	// pauses in speech or quiet passages do not split tracks
+	defaultMinTrack = 30 * time.Second
+	// metadataSnap is how far a metadata change moves to a gap between
+	// tracks, since now-playing scripts rarely update exactly on time
+	metadataSnap = 10 * time.Second
+)
+
+// Track is a track found in the archive
+type Track struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_seconds"`
+	Title    string    `json:"title,omitempty"`
+	Artist   string    `json:"artist,omitempty"`
+	// By is what marks the track's start: a "silence" gap, a "metadata"
+	// change or both. It is empty for the first track.
+	By []string `json:"by,omitempty"`
+	// Clip downloads the track as a file
+	Clip string `json:"clip"`
+}
+
+// trackBoundary is where one track ends and the next begins
+type trackBoundary struct {
+	time     time.Time
+	silence  bool
+	metadata *ws.Metadata
+}
+
+// findTracks splits the archive between from and to into tracks at
+// silence gaps and metadata changes
+func (s *Server) findTracks(from, to time.Time, threshold float64, gap, minTrack time.Duration) ([]Track, error) {
+	clip := s.dvr.Clip(from, to)
+	if clip.Size() == 0 {
+		return nil, nil
+	}
+	start, end := clip.Start(), clip.End()
+
+	gaps, err := clip.Gaps(threshold, gap)
+	if err != nil {
+		return nil, err
+	}
+	var boundaries []trackBoundary
+	for _, g := range gaps {
+		if mid := g.Start.Add(g.End.Sub(g.Start) / 2); mid.After(start) {
+			boundaries = append(boundaries, trackBoundary{time: mid, silence: true})
+		}
+	}
+
+	// Metadata changes mark tracks too, at the nearest gap if one is close.
+	// The metadata in effect when the range starts names the first track.
+	var first ws.Metadata
+	for _, event := range s.timeline.between(time.Time{}, end) {
+		md, ok := event.Data.(ws.Metadata)
+		if !ok {
+			continue
+		}
+		if !event.Time.After(start) {
+			first = md
+			continue
+		}
+		nearest := -1
+		for i, b := range boundaries {
+			d := b.time.Sub(event.Time).Abs()
+			if d <= metadataSnap && (nearest < 0 || d < boundaries[nearest].time.Sub(event.Time).Abs()) {
+				nearest = i
+			}
+		}
+		if nearest >= 0 {
+			boundaries[nearest].metadata = &md
+		} else {
+			boundaries = append(boundaries, trackBoundary{time: event.Time, metadata: &md})
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i].time.Before(boundaries[j].time) })
+
+	tracks := []Track{{Start: start, Title: first.Title, Artist: first.Artist}}
+	for _, b := range boundaries {
+		last := &tracks[len(tracks)-1]
+		// A silence alone only ends a track long enough on both sides
+		if b.metadata == nil && (b.time.Sub(last.Start) < minTrack || end.Sub(b.time) < minTrack) {
+			continue
+		}
+		last.End = b.time
+		track := Track{Start: b.time, Title: last.Title, Artist: last.Artist}
+		if b.silence {
+			track.By = append(track.By, "silence")
+		}
+		if b.metadata != nil {
+			track.By = append(track.By, "metadata")
+			track.Title, track.Artist = b.metadata.Title, b.metadata.Artist
+		}
+		tracks = append(tracks, track)
+	}
+	tracks[len(tracks)-1].End = end
+
+	for i := range tracks {
+		t := &tracks[i]
+		t.Duration = t.End.Sub(t.Start).Seconds()
+		t.Clip = "/api/v1/dvr/clip?from=" + url.QueryEscape(t.Start.UTC().Format(time.RFC3339Nano)) +
+			"&to=" + url.QueryEscape(t.End.UTC().Format(time.RFC3339Nano))
+	}
+	return tracks, nil
+}
+
+// tracksResponse is the API view of the tracks found
+type tracksResponse struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Tracks []Track   `json:"tracks"`
+}
+
+// chapters are JSON chapters as podcast feeds link them with
+// <podcast:chapters>, timed from the start of the range
+type chapters struct {
+	Version  string    `json:"version"`
+	Chapters []chapter `json:"chapters"`
+}
+
+// chapter is one entry of JSON chapters
+type chapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime"`
+	Title     string  `json:"title"`
+}
+
+// handleTracks finds the tracks in the archive between ?from= and ?to=,
+// as JSON or, with ?format=chapters, as podcast chapters. ?gap=,
+// ?threshold= and ?min_track= tune the silence detection.
+func (s *Server) handleTracks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now()
+	from, err := parseClipTime(query.Get("from"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseClipTime(query.Get("to"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !to.After(from) {
+		http.Error(w, "range must end after it starts", http.StatusBadRequest)
+		return
+	}
+
+	gap, minTrack, threshold := defaultTrackGap, defaultMinTrack, defaultTrackThreshold
+	if v := query.Get("gap"); v != "" {
+		if gap, err = parseDelay(v); err != nil || gap <= 0 {
+			http.Error(w, fmt.Sprintf("invalid gap %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("min_track"); v != "" {
+		if minTrack, err = parseDelay(v); err != nil || minTrack < 0 {
+			http.Error(w, fmt.Sprintf("invalid min_track %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("threshold"); v != "" {
+		if threshold, err = strconv.ParseFloat(v, 64); err != nil || threshold > 0 {
+			http.Error(w, fmt.Sprintf("invalid threshold %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tracks, err := s.findTracks(from, to, threshold, gap, minTrack)
+	if err != nil {
+		s.logger.Errorf("Failed to find tracks: %v", err)
+		http.Error(w, "failed to read the archive", http.StatusInternalServerError)
+		return
+	}
+	if len(tracks) == 0 {
+		http.Error(w, "no audio archived in that range", http.StatusNotFound)
+		return
+	}
+
+	var resp interface{}
+	switch format := query.Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		resp = tracksResponse{From: tracks[0].Start, To: tracks[len(tracks)-1].End, Tracks: tracks}
+	case "chapters":
+		w.Header().Set("Content-Type", "application/json+chapters")
+		list := chapters{Version: "1.2.0", Chapters: make([]chapter, len(tracks))}
+		for i, t := range tracks {
+			title := ws.Metadata{Title: t.Title, Artist: t.Artist}.StreamTitle()
+			if title == "" {
+				title = fmt.Sprintf("Track %d", i+1)
+			}
+			list.Chapters[i] = chapter{
+				StartTime: t.Start.Sub(tracks[0].Start).Seconds(),
+				EndTime:   t.End.Sub(tracks[0].Start).Seconds(),
+				Title:     title,
+			}
+		}
+		resp = list
+	default:
+		http.Error(w, fmt.Sprintf("unknown tracks format %q", format), http.StatusBadRequest)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Errorf("Failed to encode tracks: %v", err)
+	}
+}
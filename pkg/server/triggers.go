@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/events"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+)
+
+const (
+	// triggerTick is how often triggers are re-evaluated without audio
+	triggerTick = 100 * time.Millisecond
+	// triggerStale is how long without frames counts as silence, so
+	// triggers also react to the source going away
+	triggerStale = 500 * time.Millisecond
+)
+
+// Trigger fires an event once the broadcast level has stayed above or below
+// a threshold (in dBFS) for a while, and another once it no longer does
+type Trigger struct {
+	Name  string        `yaml:"name"`
+	Above *float64      `yaml:"above,omitempty"`
+	Below *float64      `yaml:"below,omitempty"`
+	For   time.Duration `yaml:"for"`
+}
+
+// validate checks that the trigger has a name and exactly one threshold
+func (t Trigger) validate() error {
+	if t.Name == "" {
+		return errors.New("trigger needs a name")
+	}
+	if (t.Above == nil) == (t.Below == nil) {
+		return fmt.Errorf("trigger %q needs exactly one of above and below", t.Name)
+	}
+	if t.For < 0 {
+		return fmt.Errorf("trigger %q has a negative duration", t.Name)
+	}
+	return nil
+}
+
+// holds reports whether level meets the trigger's condition
+func (t Trigger) holds(level float64) bool {
+	if t.Above != nil {
+		return level > *t.Above
+	}
+	return level < *t.Below
+}
+
+// TriggerEvent is the data of a "trigger" event
+type TriggerEvent struct {
+	Name   string  `json:"name"`
+	Active bool    `json:"active"`
+	Level  float64 `json:"level_dbfs"`
+}
+
+// triggerState tracks one trigger: whether its condition holds, since when,
+// and whether it has fired
+type triggerState struct {
+	Trigger
+	holds  bool
+	since  time.Time
+	active bool
+}
+
+// levelMonitor is a listener that measures the broadcast level and
+// publishes trigger events on the bus
+type levelMonitor struct {
+	bus *events.Bus
+
+	mu        sync.Mutex
+	triggers  []*triggerState
+	lastFrame time.Time
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// startTriggers validates the configured triggers and registers a monitor
+// evaluating them
+func (s *Server) startTriggers() error {
+	monitor := &levelMonitor{bus: s.events, stop: make(chan struct{})}
+	for _, t := range s.config.Triggers {
+		if err := t.validate(); err != nil {
+			return err
+		}
+		monitor.triggers = append(monitor.triggers, &triggerState{Trigger: t, since: time.Now()})
+	}
+	go monitor.run()
+
+	profile, _ := ws.LookupProfile("low-latency")
+	info := ws.ConnInfo{Transport: "triggers", ConnectedAt: time.Now()}
+	s.wsManager.AddListener(monitor, info, profile, nil)
+
+	s.logger.Infof("Watching %d audio level triggers", len(monitor.triggers))
+	return nil
+}
+
+// Send measures one broadcast frame
+func (m *levelMonitor) Send(data []byte) error {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastFrame = now
+	m.evaluate(audio.LevelDBFS(data), now)
+	return nil
+}
+
+// Close stops the monitor
+func (m *levelMonitor) Close() error {
+	m.closeOnce.Do(func() { close(m.stop) })
+	return nil
+}
+
+// run treats a broadcast without frames as silence
+func (m *levelMonitor) run() {
+	ticker := time.NewTicker(triggerTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			if now.Sub(m.lastFrame) > triggerStale {
+				m.evaluate(audio.SilenceDBFS, now)
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// evaluate updates every trigger with the current level, publishing an
+// event for each that changes state
+func (m *levelMonitor) evaluate(level float64, now time.Time) {
+	for _, t := range m.triggers {
+		if holds := t.Trigger.holds(level); holds != t.holds {
+			t.holds, t.since = holds, now
+		}
+		if t.holds != t.active && now.Sub(t.since) >= t.For {
+			t.active = t.holds
+			m.bus.Publish("trigger", TriggerEvent{Name: t.Name, Active: t.active, Level: level})
+		}
+	}
+}
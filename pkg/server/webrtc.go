@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// maxOffer bounds the SDP offers WHIP and WHEP clients post
+	maxOffer = 64 << 10
+	// gatherTimeout bounds how long an answer waits for its candidates,
+	// which are only the host's own, so gathering is quick
+	gatherTimeout = 5 * time.Second
+)
+
+// webrtcServer negotiates the peer connections of WebRTC sessions, whose
+// media all flows over one UDP socket
+type webrtcServer struct {
+	api  *webrtc.API
+	conn net.PacketConn
+
+	mu       sync.Mutex
+	sessions map[string]*webrtcSession
+}
+
+// webrtcSession is one peer connection, open until its client deletes it,
+// its connection fails or its owner closes it
+type webrtcSession struct {
+	id   string
+	kind string
+	pc   *webrtc.PeerConnection
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Close ends the session
+func (sess *webrtcSession) Close() error {
+	sess.closeOnce.Do(func() {
+		close(sess.done)
+		sess.pc.Close()
+	})
+	return nil
+}
+
+// newWebRTCServer serves WebRTC media on the UDP address addr, telling
+// peers to reach it at publicIPs instead of the host's own addresses when
+// they are set. Only Opus audio is negotiated.
+func newWebRTCServer(addr string, publicIPs []string) (*webrtcServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	media := &webrtc.MediaEngine{}
+	opus := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1;stereo=1;sprop-stereo=1",
+		},
+		PayloadType: 111,
+	}
+	if err := media.RegisterCodec(opus, webrtc.RTPCodecTypeAudio); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var settings webrtc.SettingEngine
+	settings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+	// Encoders on the server's own host reach it over loopback
+	settings.SetIncludeLoopbackCandidate(true)
+	if len(publicIPs) > 0 {
+		settings.SetNAT1To1IPs(publicIPs, webrtc.ICECandidateTypeHost)
+	}
+
+	return &webrtcServer{
+		api:      webrtc.NewAPI(webrtc.WithMediaEngine(media), webrtc.WithInterceptorRegistry(interceptors), webrtc.WithSettingEngine(settings)),
+		conn:     conn,
+		sessions: make(map[string]*webrtcSession),
+	}, nil
+}
+
+// startWebRTC starts taking WHIP sources and WHEP players
+func (s *Server) startWebRTC() error {
+	if s.config.Passthrough {
+		return errors.New("WebRTC is not available in passthrough mode, since it carries Opus")
+	}
+	rtc, err := newWebRTCServer(s.config.WebRTCAddr, s.config.WebRTCPublicIPs)
+	if err != nil {
+		return fmt.Errorf("failed to start WebRTC: %v", err)
+	}
+	s.rtc = rtc
+	s.logger.Infof("Serving WebRTC media on %s", rtc.conn.LocalAddr())
+	return nil
+}
+
+// open answers offer with a new session of kind, which setup prepares
+// before negotiating, for instance by adding its tracks. The answer carries
+// every candidate, since sessions do not trickle them.
+func (w *webrtcServer) open(kind, offer string, setup func(*webrtcSession) error) (*webrtcSession, string, error) {
+	pc, err := w.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	sess := &webrtcSession{id: hex.EncodeToString(id), kind: kind, pc: pc, done: make(chan struct{})}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			go sess.Close()
+		}
+	})
+
+	if err := setup(sess); err != nil {
+		sess.Close()
+		return nil, "", err
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		sess.Close()
+		return nil, "", fmt.Errorf("invalid offer: %v", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		sess.Close()
+		return nil, "", fmt.Errorf("invalid offer: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		sess.Close()
+		return nil, "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+	}
+
+	w.mu.Lock()
+	w.sessions[sess.id] = sess
+	w.mu.Unlock()
+	go func() {
+		<-sess.done
+		w.mu.Lock()
+		delete(w.sessions, sess.id)
+		w.mu.Unlock()
+	}()
+	return sess, pc.LocalDescription().SDP, nil
+}
+
+// end closes the session of kind with id, as its client asks by deleting
+// its resource
+func (w *webrtcServer) end(rw http.ResponseWriter, kind, id string) {
+	w.mu.Lock()
+	sess := w.sessions[id]
+	w.mu.Unlock()
+	if sess == nil || sess.kind != kind {
+		http.Error(rw, "session not found", http.StatusNotFound)
+		return
+	}
+	sess.Close()
+	rw.WriteHeader(http.StatusOK)
+}
+
+// readOffer reads the SDP offer a WHIP or WHEP client posts, answering
+// the request itself when it is not one
+func readOffer(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+		http.Error(w, "the offer must be application/sdp", http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	offer, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxOffer))
+	if err != nil {
+		http.Error(w, "failed to read the offer", http.StatusBadRequest)
+		return "", false
+	}
+	return string(offer), true
+}
+
+// writeAnswer answers an offer with the session's SDP, naming the resource
+// that ends it
+func writeAnswer(w http.ResponseWriter, location, answer string) {
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", location)
+	w.Header().Add("Access-Control-Expose-Headers", "Location")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
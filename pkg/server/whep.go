@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// whepListener plays broadcast frames to a WHEP session, encoding them as
+// the 20ms Opus packets of its track
+type whepListener struct {
+	sess  *webrtcSession
+	track *webrtc.TrackLocalStaticSample
+
+	format    ws.SourceFormat
+	resampler audio.Stage
+	enc       audio.FrameEncoder
+	pending   []int16
+}
+
+// Send encodes the frame and writes the packets it completes to the track
+func (l *whepListener) Send(data []byte) error {
+	pcm := audio.BytesToPCM(data)
+	if l.resampler != nil {
+		pcm = l.resampler.Process(pcm)
+	}
+	l.pending = append(l.pending, pcm...)
+
+	frame := opusFrame * l.format.Channels
+	for len(l.pending) >= frame {
+		packet, err := l.enc.Encode(l.pending[:frame])
+		if err != nil {
+			return fmt.Errorf("failed to encode opus: %v", err)
+		}
+		l.pending = l.pending[frame:]
+		if err := l.track.WriteSample(media.Sample{Data: packet, Duration: 20 * time.Millisecond}); err != nil {
+			return err
+		}
+	}
+	// Keep the leftover at the start of the buffer so it does not grow
+	l.pending = append(l.pending[:0], l.pending...)
+	return nil
+}
+
+// SendFormat starts a new encoder when the rate or channel count changes.
+// The track stays stereo: Opus packets say how many channels they carry.
+func (l *whepListener) SendFormat(format ws.SourceFormat) error {
+	if format.SampleRate == l.format.SampleRate && format.Channels == l.format.Channels {
+		return nil
+	}
+	if format.Channels > 2 {
+		return fmt.Errorf("opus streams carry at most 2 channels, not %d", format.Channels)
+	}
+	enc, err := audio.NewOpusEncoder(audio.OpusSampleRate, format.Channels, audio.OpusAudio)
+	if err != nil {
+		return err
+	}
+	l.format = format
+	l.enc = enc
+	l.pending = l.pending[:0]
+	l.resampler = nil
+	if format.SampleRate != audio.OpusSampleRate {
+		l.resampler = audio.NewSincResampler(format.Channels, format.SampleRate, audio.OpusSampleRate)
+	}
+	return nil
+}
+
+// Close ends the session
+func (l *whepListener) Close() error {
+	return l.sess.Close()
+}
+
+// handleWHEP plays the stream over WebRTC, as players negotiate with WHEP:
+// a POST of an SDP offer to /whep starts a session with one Opus track,
+// and a DELETE of the resource it names ends it
+func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	if s.rtc == nil {
+		http.Error(w, "WebRTC is disabled", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/whep":
+		s.startWHEP(w, r)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/whep/"):
+		s.rtc.end(w, "whep", strings.TrimPrefix(r.URL.Path, "/whep/"))
+	default:
+		// Candidates are not trickled, so there is no PATCH
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startWHEP answers a WHEP offer, adding the session as a listener with
+// the low-latency profile, since the player's own jitter buffer absorbs
+// what the server's would
+func (s *Server) startWHEP(w http.ResponseWriter, r *http.Request) {
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+	if !audio.OpusAvailable() {
+		http.Error(w, audio.ErrOpusUnavailable.Error(), http.StatusNotImplemented)
+		return
+	}
+	profile, _ := ws.LookupProfile("low-latency")
+	format := s.wsManager.ListenerFormat(profile)
+	if format.Channels > 2 {
+		http.Error(w, "opus streams carry at most 2 channels", http.StatusBadRequest)
+		return
+	}
+	if !s.admit(w, r) {
+		return
+	}
+
+	listener := &whepListener{}
+	sess, answer, err := s.rtc.open("whep", offer, func(sess *webrtcSession) error {
+		track, err := sendTrack(sess)
+		if err != nil {
+			return err
+		}
+		listener.sess = sess
+		listener.track = track
+		return listener.SendFormat(format)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info := ws.RequestInfo(r, "webrtc")
+	s.wsManager.AddListener(listener, info, profile, nil)
+	go func() {
+		<-sess.done
+		s.wsManager.RemoveListener(listener)
+	}()
+	s.logger.Infow("WHEP listener connected", "remote", info.RemoteAddr, "user_agent", info.UserAgent)
+	writeAnswer(w, "/whep/"+sess.id, answer)
+}
+
+// sendTrack adds an Opus track to the session, reading the receiver
+// reports for it so the interceptors see them
+func sendTrack(sess *webrtcSession) (*webrtc.TrackLocalStaticSample, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "minicast")
+	if err != nil {
+		return nil, err
+	}
+	sender, err := sess.pc.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return track, nil
+}
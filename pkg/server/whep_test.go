@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"go.uber.org/zap"
+)
+
+func TestWHEPRequests(t *testing.T) {
+	s := &Server{logger: zap.NewNop().Sugar()}
+	request := func(method, path, contentType string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader("v=0\r\n"))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		s.handleWHEP(w, r)
+		return w.Code
+	}
+
+	if code := request(http.MethodPost, "/whep", "application/sdp"); code != http.StatusNotFound {
+		t.Errorf("with WebRTC off: status %d, want 404", code)
+	}
+
+	s.rtc = newTestWebRTC(t)
+	tests := []struct {
+		name                string
+		method, path, ctype string
+		want                int
+	}{
+		{"not an offer", http.MethodPost, "/whep", "text/plain", http.StatusUnsupportedMediaType},
+		{"trickle", http.MethodPatch, "/whep/0123", "application/trickle-ice-sdpfrag", http.StatusMethodNotAllowed},
+		{"get", http.MethodGet, "/whep", "", http.StatusMethodNotAllowed},
+		{"unknown session", http.MethodDelete, "/whep/0123", "", http.StatusNotFound},
+		{"without opus", http.MethodPost, "/whep", "application/sdp", http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		if tt.want == http.StatusNotImplemented && audio.OpusAvailable() {
+			continue
+		}
+		if code := request(tt.method, tt.path, tt.ctype); code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
+
+func TestWebRTCSessionSendsAudio(t *testing.T) {
+	rtc := newTestWebRTC(t)
+	client := newTestPeer(t)
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	packets := make(chan []byte, 100)
+	client.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		receiveTrack(track, func(packet []byte) { packets <- packet })
+	})
+
+	// The session sends as WHEP's does
+	var track *webrtc.TrackLocalStaticSample
+	sess, answer, err := rtc.open("whep", offer(t, client), func(sess *webrtcSession) error {
+		var err error
+		track, err = sendTrack(sess)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(answer, "a=sendonly") {
+		t.Errorf("answer does not send:\n%s", answer)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(10 * time.Second)
+	for sent := byte(0); ; sent++ {
+		track.WriteSample(media.Sample{Data: []byte{0xfc, sent}, Duration: 20 * time.Millisecond})
+		select {
+		case packet := <-packets:
+			if len(packet) != 2 || packet[0] != 0xfc {
+				t.Fatalf("received %x, want a packet that was sent", packet)
+			}
+		case <-deadline:
+			t.Fatal("no audio arrived")
+		case <-time.After(20 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	// The player ends its session by deleting the resource
+	w := httptest.NewRecorder()
+	rtc.end(w, "whep", sess.id)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deleting: status %d, want 200", w.Code)
+	}
+	select {
+	case <-sess.done:
+	case <-time.After(time.Second):
+		t.Fatal("the session did not end")
+	}
+}
+
+func TestWHEPListenersCountAsAudience(t *testing.T) {
+	logger := zap.NewNop().Sugar()
+	s := &Server{logger: logger, wsManager: ws.NewManager(audio.NewProcessor(44100, 2, 16), logger)}
+	profile, _ := ws.LookupProfile("low-latency")
+	listener := &whepListener{sess: &webrtcSession{pc: newTestPeer(t), done: make(chan struct{})}}
+	s.wsManager.AddListener(listener, ws.ConnInfo{Transport: "webrtc", RemoteAddr: "192.0.2.7:5000"}, profile, nil)
+	defer s.wsManager.RemoveListener(listener)
+
+	if n := s.audience(s.wsManager.Stats()); n != 1 {
+		t.Fatalf("audience %d, want the WHEP player", n)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// whipFormat is what WHIP sources send: Opus, which the source pipeline
+// decodes like Opus from any other source
+var whipFormat = ws.SourceFormat{SampleRate: audio.OpusSampleRate, Channels: 2, BitDepth: 16, Codec: ws.CodecOpus}
+
+// handleWHIP takes sources over WebRTC, as OBS and browsers publish with
+// WHIP: a POST of an SDP offer to /whip starts a session holding the
+// source slot, and a DELETE of the resource it names ends it
+func (s *Server) handleWHIP(w http.ResponseWriter, r *http.Request) {
+	if s.rtc == nil {
+		http.Error(w, "WebRTC is disabled", http.StatusNotFound)
+		return
+	}
+	if !s.sourceAllowed(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="minicast"`)
+		http.Error(w, "a valid source token is required", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/whip":
+		s.startWHIP(w, r)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/whip/"):
+		s.rtc.end(w, "whip", strings.TrimPrefix(r.URL.Path, "/whip/"))
+	default:
+		// Candidates are not trickled, so there is no PATCH
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startWHIP answers a WHIP offer, attaching the session as the source and
+// broadcasting the audio track it publishes
+func (s *Server) startWHIP(w http.ResponseWriter, r *http.Request) {
+	offer, ok := readOffer(w, r)
+	if !ok {
+		return
+	}
+	if !audio.OpusAvailable() {
+		http.Error(w, audio.ErrOpusUnavailable.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	info := ws.RequestInfo(r, "whip")
+	var attachErr error
+	sess, answer, err := s.rtc.open("whip", offer, func(sess *webrtcSession) error {
+		if attachErr = s.wsManager.AttachSource(sess, info, whipFormat); attachErr != nil {
+			return attachErr
+		}
+		go func() {
+			<-sess.done
+			s.wsManager.DetachSource(sess)
+			s.logger.Infow("WHIP source disconnected", "remote", info.RemoteAddr)
+		}()
+
+		pipeline, err := s.wsManager.NewPipeline(whipFormat)
+		if err != nil {
+			return err
+		}
+		if _, err := sess.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+			webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return err
+		}
+		// The pipeline takes one stream, so further tracks are ignored
+		var receiving atomic.Bool
+		sess.pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			if track.Kind() != webrtc.RTPCodecTypeAudio || !receiving.CompareAndSwap(false, true) {
+				return
+			}
+			receiveTrack(track, func(packet []byte) {
+				if data, _ := pipeline.Process(packet); data != nil {
+					s.wsManager.Broadcast(data)
+				}
+			})
+		})
+		return nil
+	})
+	switch {
+	case attachErr != nil:
+		http.Error(w, attachErr.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Infow("WHIP source connected", "remote", info.RemoteAddr, "user_agent", info.UserAgent)
+	writeAnswer(w, "/whip/"+sess.id, answer)
+}
+
+// receiveTrack passes the packets of a track to deliver until its session
+// ends
+func receiveTrack(track *webrtc.TrackRemote, deliver func([]byte)) {
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if len(packet.Payload) > 0 {
+			deliver(packet.Payload)
+		}
+	}
+}
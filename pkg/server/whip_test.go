@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"go.uber.org/zap"
+)
+
+// newTestWebRTC returns a WebRTC server on loopback
+func newTestWebRTC(t *testing.T) *webrtcServer {
+	t.Helper()
+	rtc, err := newWebRTCServer("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rtc.conn.Close() })
+	return rtc
+}
+
+// newTestPeer returns a peer connection for the client side of a session,
+// which can reach the server on loopback
+func newTestPeer(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	var settings webrtc.SettingEngine
+	settings.SetIncludeLoopbackCandidate(true)
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	engine := &webrtc.MediaEngine{}
+	if err := engine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(engine), webrtc.WithSettingEngine(settings)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// offer returns pc's offer with its candidates gathered, as WHIP and WHEP
+// clients send it
+func offer(t *testing.T, pc *webrtc.PeerConnection) string {
+	t.Helper()
+	desc, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+func TestWHIPRequests(t *testing.T) {
+	s := &Server{
+		config: Config{APITokens: []APIToken{{Name: "studio", Token: "source-token-012345", Scopes: []string{ScopeSource}}}},
+		logger: zap.NewNop().Sugar(),
+	}
+	request := func(method, path, contentType, token string) int {
+		r := httptest.NewRequest(method, path, strings.NewReader("v=0\r\n"))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.handleWHIP(w, r)
+		return w.Code
+	}
+
+	if code := request(http.MethodPost, "/whip", "application/sdp", "source-token-012345"); code != http.StatusNotFound {
+		t.Errorf("with WebRTC off: status %d, want 404", code)
+	}
+
+	s.rtc = newTestWebRTC(t)
+	tests := []struct {
+		name                      string
+		method, path, ctype, auth string
+		want                      int
+	}{
+		{"no token", http.MethodPost, "/whip", "application/sdp", "", http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "/whip", "application/sdp", "admin-token-0123456", http.StatusUnauthorized},
+		{"not an offer", http.MethodPost, "/whip", "text/plain", "source-token-012345", http.StatusUnsupportedMediaType},
+		{"trickle", http.MethodPatch, "/whip/0123", "application/trickle-ice-sdpfrag", "source-token-012345", http.StatusMethodNotAllowed},
+		{"get", http.MethodGet, "/whip", "", "source-token-012345", http.StatusMethodNotAllowed},
+		{"unknown session", http.MethodDelete, "/whip/0123", "", "source-token-012345", http.StatusNotFound},
+		{"without opus", http.MethodPost, "/whip", "application/sdp", "source-token-012345", http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		if tt.want == http.StatusNotImplemented && audio.OpusAvailable() {
+			continue
+		}
+		if code := request(tt.method, tt.path, tt.ctype, tt.auth); code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
+
+func TestWebRTCSessionReceivesAudio(t *testing.T) {
+	rtc := newTestWebRTC(t)
+	client := newTestPeer(t)
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "minicast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The session receives as WHIP's does
+	packets := make(chan []byte, 100)
+	sess, answer, err := rtc.open("whip", offer(t, client), func(sess *webrtcSession) error {
+		_, err := sess.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+			webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		sess.pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+			receiveTrack(track, func(packet []byte) { packets <- packet })
+		})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Packets flow once the connection is up
+	deadline := time.After(10 * time.Second)
+	for sent := byte(0); ; sent++ {
+		track.WriteSample(media.Sample{Data: []byte{0xfc, sent}, Duration: 20 * time.Millisecond})
+		select {
+		case packet := <-packets:
+			if len(packet) != 2 || packet[0] != 0xfc {
+				t.Fatalf("received %x, want a packet that was sent", packet)
+			}
+		case <-deadline:
+			t.Fatal("no audio arrived")
+		case <-time.After(20 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	// Deleting the resource ends the session
+	w := httptest.NewRecorder()
+	rtc.end(w, "whep", sess.id)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("deleting as another kind: status %d, want 404", w.Code)
+	}
+	w = httptest.NewRecorder()
+	rtc.end(w, "whip", sess.id)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deleting: status %d, want 200", w.Code)
+	}
+	select {
+	case <-sess.done:
+	case <-time.After(time.Second):
+		t.Fatal("the session did not end")
+	}
+	if state := sess.pc.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("peer connection %s, want closed", state)
+	}
+}
@@ -0,0 +1,323 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxRestartDelay caps the backoff between restarts
+	maxRestartDelay = 30 * time.Second
+	// stableRun is how long a command must run before a crash counts as
+	// new, resetting the backoff
+	stableRun = 30 * time.Second
+	// stopTimeout is how long a command gets to exit after its input is
+	// closed and it is asked to stop, before it is killed
+	stopTimeout = 5 * time.Second
+)
+
+// Restart policies
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// Config describes an external command fed the live stream
+type Config struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+	// Dir is the working directory, by default the server's
+	Dir string `yaml:"dir,omitempty"`
+	// Env is added to the command's environment, which otherwise holds
+	// only PATH, HOME and the stream format
+	Env map[string]string `yaml:"env,omitempty"`
+
+	// Restart is "always" (the default), "on-failure" or "never", with
+	// RestartDelay (default 1s) doubling between attempts
+	Restart      string        `yaml:"restart,omitempty"`
+	RestartDelay time.Duration `yaml:"restart_delay,omitempty"`
+
+	Limits Limits `yaml:"limits,omitempty"`
+
+	// Tap is "mix" (the default) to feed the broadcast as listeners hear
+	// it, or "source" for the source's audio before processing
+	Tap string `yaml:"tap,omitempty"`
+}
+
+// Limits are resource limits applied to the command before it starts.
+// Zero means unlimited. They are only supported on Linux, where the server
+// must call Init first thing in main.
+type Limits struct {
+	// MemoryMB caps the command's address space
+	MemoryMB int `yaml:"memory_mb,omitempty"`
+	// CPUTime is how much processor time it may use in total
+	CPUTime time.Duration `yaml:"cpu_time,omitempty"`
+	// OpenFiles caps its file descriptors
+	OpenFiles int `yaml:"open_files,omitempty"`
+	// Nice lowers its scheduling priority, from 1 to 19
+	Nice int `yaml:"nice,omitempty"`
+}
+
+// Validate checks the config and fills in defaults
+func (c *Config) Validate() error {
+	if c.Name == "" {
+		return errors.New("sink needs a name")
+	}
+	if len(c.Command) == 0 {
+		return fmt.Errorf("sink %q needs a command", c.Name)
+	}
+	switch c.Restart {
+	case "":
+		c.Restart = RestartAlways
+	case RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("sink %q: unknown restart policy %q", c.Name, c.Restart)
+	}
+	if c.RestartDelay <= 0 {
+		c.RestartDelay = time.Second
+	}
+	if c.Limits.Nice < 0 || c.Limits.Nice > 19 {
+		return fmt.Errorf("sink %q: nice must be between 0 and 19", c.Name)
+	}
+	if _, _, _, err := command(c.Command, c.Limits); err != nil {
+		return fmt.Errorf("sink %q: %v", c.Name, err)
+	}
+	return nil
+}
+
+// Exec pipes the live stream into an external command's standard input as
+// raw interleaved 16-bit little-endian PCM, restarting the command according
+// to its policy. It implements the Manager's Listener interface; audio
+// arriving while the command is not running is dropped.
+type Exec struct {
+	config Config
+	logger *zap.SugaredLogger
+
+	mu       sync.Mutex
+	format   ws.SourceFormat
+	stdin    io.WriteCloser
+	reformat bool
+	stopped  bool
+	cancel   context.CancelFunc
+}
+
+// New creates a sink for audio in format. Call Run to start the command.
+func New(config Config, format ws.SourceFormat, logger *zap.SugaredLogger) (*Exec, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := exec.LookPath(config.Command[0]); err != nil {
+		return nil, fmt.Errorf("sink %q: %v", config.Name, err)
+	}
+	return &Exec{config: config, format: format, logger: logger}, nil
+}
+
+// Run starts the command and keeps it running according to the restart
+// policy until ctx is done or the sink is closed
+func (e *Exec) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		cancel()
+		return
+	}
+	e.cancel = cancel
+	e.mu.Unlock()
+	defer cancel()
+
+	delay := e.config.RestartDelay
+	for {
+		started := time.Now()
+		err := e.runOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		e.mu.Lock()
+		reformat := e.reformat
+		e.reformat = false
+		e.mu.Unlock()
+		if reformat {
+			e.logger.Infof("Restarting sink %s for the new stream format", e.config.Name)
+			continue
+		}
+
+		if err != nil {
+			e.logger.Errorf("Sink %s failed: %v", e.config.Name, err)
+		} else {
+			e.logger.Infof("Sink %s exited", e.config.Name)
+		}
+		if e.config.Restart == RestartNever || (err == nil && e.config.Restart == RestartOnFailure) {
+			return
+		}
+
+		if time.Since(started) >= stableRun {
+			delay = e.config.RestartDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRestartDelay)
+	}
+}
+
+// runOnce runs the command until it exits
+func (e *Exec) runOnce(ctx context.Context) error {
+	e.mu.Lock()
+	format := e.format
+	e.mu.Unlock()
+
+	path, args, wrapperEnv, err := command(e.config.Command, e.config.Limits)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Dir = e.config.Dir
+	cmd.Env = append(e.environ(format), wrapperEnv...)
+	cmd.Stdout = &lineLogger{log: func(line string) { e.logger.Infow(line, "sink", e.config.Name) }}
+	cmd.Stderr = &lineLogger{log: func(line string) { e.logger.Infow(line, "sink", e.config.Name) }}
+	cmd.SysProcAttr = sysProcAttr()
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = stopTimeout
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	e.logger.Infow("Sink started", "sink", e.config.Name, "pid", cmd.Process.Pid)
+
+	e.mu.Lock()
+	e.stdin = stdin
+	e.mu.Unlock()
+
+	err = cmd.Wait()
+
+	e.mu.Lock()
+	e.stdin = nil
+	e.mu.Unlock()
+	return err
+}
+
+// environ returns the command's environment: PATH and HOME from the
+// server's, the stream format, then the configured variables
+func (e *Exec) environ(format ws.SourceFormat) []string {
+	env := map[string]string{
+		"MINICAST_SINK":        e.config.Name,
+		"MINICAST_FORMAT":      "s16le",
+		"MINICAST_SAMPLE_RATE": strconv.Itoa(format.SampleRate),
+		"MINICAST_CHANNELS":    strconv.Itoa(format.Channels),
+		"MINICAST_BIT_DEPTH":   "16",
+	}
+	for _, name := range []string{"PATH", "HOME"} {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+	for name, value := range e.config.Env {
+		env[name] = value
+	}
+
+	environ := make([]string, 0, len(env))
+	for name, value := range env {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
+
+// Send writes one broadcast frame to the command, dropping it when the
+// command is not running
+func (e *Exec) Send(data []byte) error {
+	e.mu.Lock()
+	stdin := e.stdin
+	e.mu.Unlock()
+
+	if stdin == nil {
+		return nil
+	}
+	if _, err := stdin.Write(data); err != nil {
+		// The command has exited or closed its input; Run deals with it
+		e.mu.Lock()
+		if e.stdin == stdin {
+			e.stdin = nil
+		}
+		e.mu.Unlock()
+	}
+	return nil
+}
+
+// SendFormat restarts the command for a new stream format, since the format
+// is passed in its environment. Closing its input lets it finish cleanly.
+func (e *Exec) SendFormat(format ws.SourceFormat) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if format == e.format {
+		return nil
+	}
+	e.format = format
+	if e.stdin != nil {
+		e.reformat = true
+		e.stdin.Close()
+		e.stdin = nil
+	}
+	return nil
+}
+
+// Close stops the command and does not restart it
+func (e *Exec) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stopped = true
+	if e.stdin != nil {
+		e.stdin.Close()
+		e.stdin = nil
+	}
+	if e.cancel != nil {
+		e.cancel()
+	}
+	return nil
+}
+
+// lineLogger logs what a command writes, a line at a time
+type lineLogger struct {
+	log     func(line string)
+	partial []byte
+}
+
+// Write logs every complete line in p
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexAny(l.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		if line := bytes.TrimSpace(l.partial[:i]); len(line) > 0 {
+			l.log(string(line))
+		}
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// limitsEnv passes a command's limits to the server re-executed as its
+// wrapper, which applies them to itself and then becomes the command, so
+// they hold from the command's first instruction
+const limitsEnv = "MINICAST_SINK_LIMITS"
+
+// sysProcAttr puts the command in its own process group and kills it if
+// the server dies
+func sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+}
+
+// command returns the command to run, wrapped to apply limits if there
+// are any
+func command(args []string, limits Limits) (string, []string, []string, error) {
+	if limits == (Limits{}) {
+		return args[0], args[1:], nil, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	value := fmt.Sprintf("%d,%d,%d,%d", limits.MemoryMB, int64(limits.CPUTime.Seconds()), limits.OpenFiles, limits.Nice)
+	return self, args, []string{limitsEnv + "=" + value}, nil
+}
+
+// Init must be called first thing in main. In a server re-executed to wrap
+// a sink's command it applies the limits and replaces the process with the
+// command, never returning.
+func Init() {
+	value, ok := os.LookupEnv(limitsEnv)
+	if !ok {
+		return
+	}
+	var limits Limits
+	var cpuSeconds int64
+	if _, err := fmt.Sscanf(value, "%d,%d,%d,%d", &limits.MemoryMB, &cpuSeconds, &limits.OpenFiles, &limits.Nice); err != nil {
+		fail(fmt.Errorf("invalid %s: %v", limitsEnv, err))
+	}
+	limits.CPUTime = time.Duration(cpuSeconds) * time.Second
+	if len(os.Args) < 2 {
+		fail(fmt.Errorf("no command to run"))
+	}
+	if err := applyLimits(limits); err != nil {
+		fail(err)
+	}
+
+	path, err := exec.LookPath(os.Args[1])
+	if err != nil {
+		fail(err)
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, limitsEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	fail(syscall.Exec(path, os.Args[1:], env))
+}
+
+// fail reports why the wrapper could not become the command
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "sink: %v\n", err)
+	os.Exit(126)
+}
+
+// applyLimits sets the resource limits of this process
+func applyLimits(limits Limits) error {
+	set := func(resource int, value uint64) error {
+		return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: value, Max: value})
+	}
+	if limits.MemoryMB > 0 {
+		if err := set(syscall.RLIMIT_AS, uint64(limits.MemoryMB)<<20); err != nil {
+			return fmt.Errorf("memory limit: %v", err)
+		}
+	}
+	if limits.CPUTime > 0 {
+		if err := set(syscall.RLIMIT_CPU, uint64(limits.CPUTime.Seconds())); err != nil {
+			return fmt.Errorf("cpu time limit: %v", err)
+		}
+	}
+	if limits.OpenFiles > 0 {
+		if err := set(syscall.RLIMIT_NOFILE, uint64(limits.OpenFiles)); err != nil {
+			return fmt.Errorf("open files limit: %v", err)
+		}
+	}
+	if limits.Nice > 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, limits.Nice); err != nil {
+			return fmt.Errorf("nice: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package sink
+
+import (
+	"errors"
+	"syscall"
+)
+
+// sysProcAttr uses the defaults on platforms without Linux's controls
+func sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// command returns the command to run, refusing limits it cannot enforce
+// rather than ignore them
+func command(args []string, limits Limits) (string, []string, []string, error) {
+	if limits != (Limits{}) {
+		return "", nil, nil, errors.New("resource limits are only supported on Linux")
+	}
+	return args[0], args[1:], nil, nil
+}
+
+// Init does nothing; limits are not supported
+func Init() {}
@@ -0,0 +1,159 @@
+package snapcast
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// Message types of the Snapcast stream protocol
+const (
+	typeCodecHeader    = 1
+	typeWireChunk      = 2
+	typeServerSettings = 3
+	typeTime           = 4
+	typeHello          = 5
+	typeClientInfo     = 7
+)
+
+// headerSize is the size of the header every message starts with
+const headerSize = 26
+
+// maxPayload bounds what a client may send, which is only small JSON
+// messages and time requests
+const maxPayload = 1 << 16
+
+// header starts every message. Times are on the sender's clock, except
+// received, which the receiver fills in as the message arrives.
+type header struct {
+	typ      uint16
+	id       uint16
+	refersTo uint16
+	sent     time.Duration
+	received time.Duration
+	size     uint32
+}
+
+// message is a message to send: its header, less the send time and size
+// filled in as it is written, and its payload
+type message struct {
+	header
+	payload []byte
+}
+
+// hello is what a client tells the server about itself when it connects
+type hello struct {
+	ClientName string `json:"ClientName"`
+	HostName   string `json:"HostName"`
+	ID         string `json:"ID"`
+	Version    string `json:"Version"`
+	OS         string `json:"OS"`
+	Protocol   int    `json:"SnapStreamProtocolVersion"`
+}
+
+// serverSettings tells a client how far behind the server's clock to play
+// and at what volume
+type serverSettings struct {
+	BufferMs int  `json:"bufferMs"`
+	Latency  int  `json:"latency"`
+	Muted    bool `json:"muted"`
+	Volume   int  `json:"volume"`
+}
+
+// appendTime appends a time as the protocol's seconds and microseconds
+func appendTime(b []byte, t time.Duration) []byte {
+	sec := t / time.Second
+	usec := (t % time.Second) / time.Microsecond
+	b = binary.LittleEndian.AppendUint32(b, uint32(int32(sec)))
+	return binary.LittleEndian.AppendUint32(b, uint32(int32(usec)))
+}
+
+// readTime reads a time written by appendTime
+func readTime(b []byte) time.Duration {
+	sec := int32(binary.LittleEndian.Uint32(b))
+	usec := int32(binary.LittleEndian.Uint32(b[4:]))
+	return time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond
+}
+
+// encode returns the message as sent at time sent
+func (m message) encode(sent time.Duration) []byte {
+	b := make([]byte, 0, headerSize+len(m.payload))
+	b = binary.LittleEndian.AppendUint16(b, m.typ)
+	b = binary.LittleEndian.AppendUint16(b, m.id)
+	b = binary.LittleEndian.AppendUint16(b, m.refersTo)
+	b = appendTime(b, sent)
+	b = appendTime(b, m.received)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(m.payload)))
+	return append(b, m.payload...)
+}
+
+// readMessage reads a message, stamping it with the time it was received
+func readMessage(r io.Reader, now func() time.Duration) (header, []byte, error) {
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return header{}, nil, err
+	}
+	h := header{
+		typ:      binary.LittleEndian.Uint16(buf),
+		id:       binary.LittleEndian.Uint16(buf[2:]),
+		refersTo: binary.LittleEndian.Uint16(buf[4:]),
+		sent:     readTime(buf[6:]),
+		received: now(),
+		size:     binary.LittleEndian.Uint32(buf[22:]),
+	}
+	if h.size > maxPayload {
+		return header{}, nil, errors.New("snapcast: message too large")
+	}
+	payload := make([]byte, h.size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return header{}, nil, err
+	}
+	return h, payload, nil
+}
+
+// appendBytes appends data prefixed with its length
+func appendBytes(b []byte, data []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+// jsonMessage returns a message carrying v as JSON
+func jsonMessage(typ uint16, v interface{}) message {
+	data, _ := json.Marshal(v)
+	return message{header: header{typ: typ}, payload: appendBytes(nil, data)}
+}
+
+// decodeJSON reads the JSON carried by a message's payload into v
+func decodeJSON(payload []byte, v interface{}) error {
+	if len(payload) < 4 || int(binary.LittleEndian.Uint32(payload)) != len(payload)-4 {
+		return errors.New("snapcast: malformed message")
+	}
+	return json.Unmarshal(payload[4:], v)
+}
+
+// codecHeader returns the message telling clients how chunks are encoded:
+// as PCM, described by a WAV header
+func codecHeader(wav []byte) message {
+	payload := appendBytes(nil, []byte("pcm"))
+	return message{header: header{typ: typeCodecHeader}, payload: appendBytes(payload, wav)}
+}
+
+// wireChunk returns the message carrying audio whose first sample was
+// captured at timestamp on the server's clock
+func wireChunk(timestamp time.Duration, pcm []byte) message {
+	payload := appendTime(make([]byte, 0, 12+len(pcm)), timestamp)
+	return message{header: header{typ: typeWireChunk}, payload: appendBytes(payload, pcm)}
+}
+
+// timeReply answers a client's time request. Its latency is how long the
+// request took to arrive by the two clocks; with the time the reply takes
+// by them, the client works out the offset between its clock and the
+// server's.
+func timeReply(request header) message {
+	return message{
+		header:  header{typ: typeTime, id: request.id, refersTo: request.id},
+		payload: appendTime(nil, request.received-request.sent),
+	}
+}
@@ -0,0 +1,272 @@
+// Package snapcast serves the broadcast to Snapcast clients, so receivers
+// around a house play it in sync. It speaks the Snapcast stream protocol:
+// clients keep their clocks in step with the server's and play each chunk
+// of audio a fixed buffer after its timestamp, which is the same for all
+// of them.
+package snapcast
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	ws "github.com/maks112v/minicast/pkg/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultBuffer is how far behind the server's clock clients play, as
+	// snapserver defaults to
+	DefaultBuffer = time.Second
+
+	// maxSkew is how far chunk timestamps, counted from the audio, may
+	// drift from the clock before they are brought back to it
+	maxSkew = 250 * time.Millisecond
+	// sessionQueue is how many messages may wait for a slow client before
+	// it is disconnected
+	sessionQueue = 256
+	// writeTimeout bounds each write to a client
+	writeTimeout = 5 * time.Second
+)
+
+// Server is a listener serving the broadcast to Snapcast clients
+type Server struct {
+	ln     net.Listener
+	buffer time.Duration
+	logger *zap.SugaredLogger
+
+	// epoch starts the server's clock, read from the monotonic clock so
+	// changes to the system time do not upset playback
+	epoch time.Time
+
+	mu       sync.Mutex
+	format   ws.SourceFormat
+	header   message
+	sessions map[*session]struct{}
+	// next is the timestamp of the next chunk, counted from the samples
+	// broadcast, and anchored the time it was last brought back to the
+	// clock
+	next     time.Duration
+	anchored bool
+
+	closeOnce sync.Once
+}
+
+// Listen starts serving Snapcast clients on addr (snapserver uses :1704),
+// telling them to play buffer behind the server
+func Listen(addr string, buffer time.Duration, logger *zap.SugaredLogger) (*Server, error) {
+	if buffer <= 0 {
+		return nil, fmt.Errorf("invalid Snapcast buffer %s", buffer)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:       ln,
+		buffer:   buffer,
+		logger:   logger,
+		epoch:    time.Now(),
+		sessions: make(map[*session]struct{}),
+	}
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address clients connect to
+func (s *Server) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+// Clients returns how many clients are connected
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// now reads the server's clock
+func (s *Server) now() time.Duration {
+	return time.Since(s.epoch)
+}
+
+// SendFormat describes audio in the new format to clients, which restart
+// their decoders. Only 16-bit PCM can be served.
+func (s *Server) SendFormat(format ws.SourceFormat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.format = format
+	s.anchored = false
+	if format.Codec != ws.CodecPCM {
+		s.header = message{}
+		return nil
+	}
+	wav := audio.NewProcessor(format.SampleRate, format.Channels, format.BitDepth).Header(0)
+	s.header = codecHeader(wav)
+	for sess := range s.sessions {
+		sess.send(s.header)
+	}
+	return nil
+}
+
+// Send timestamps a broadcast frame and passes it to every client.
+// Timestamps follow the audio, so chunks are contiguous however unevenly
+// they arrive, until they drift too far from the clock, such as after the
+// broadcast has stopped for a while.
+func (s *Server) Send(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bytesPerSecond := s.format.SampleRate * s.format.Channels * s.format.BitDepth / 8
+	if s.header.payload == nil || bytesPerSecond == 0 {
+		return nil
+	}
+	length := time.Duration(len(data)) * time.Second / time.Duration(bytesPerSecond)
+	if start := s.now() - length; !s.anchored || s.next < start-maxSkew || s.next > start+maxSkew {
+		s.next, s.anchored = start, true
+	}
+	chunk := wireChunk(s.next, data)
+	s.next += length
+
+	for sess := range s.sessions {
+		sess.send(chunk)
+	}
+	return nil
+}
+
+// Close stops serving and disconnects every client
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.ln.Close()
+		s.mu.Lock()
+		for sess := range s.sessions {
+			sess.conn.Close()
+		}
+		s.mu.Unlock()
+	})
+	return err
+}
+
+// accept takes clients until the server is closed
+func (s *Server) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Errorf("Snapcast server stopped: %v", err)
+			}
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// session is one connected client
+type session struct {
+	conn  net.Conn
+	queue chan message
+	// full is closed when the client fell too far behind, and stop once
+	// it has gone
+	full     chan struct{}
+	fullOnce sync.Once
+	stop     chan struct{}
+}
+
+// send queues a message for the client, giving up on a client too slow to
+// keep up
+func (sess *session) send(m message) {
+	select {
+	case sess.queue <- m:
+	default:
+		sess.fullOnce.Do(func() { close(sess.full) })
+	}
+}
+
+// serve talks to one client: it waits for its hello, then sends it the
+// settings, the codec header and the audio, answering its time requests
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(writeTimeout))
+	h, payload, err := readMessage(r, s.now)
+	var hi hello
+	if err == nil && h.typ != typeHello {
+		err = errors.New("expected a hello")
+	}
+	if err == nil {
+		err = decodeJSON(payload, &hi)
+	}
+	if err != nil {
+		s.logger.Debugf("Snapcast client %s failed to connect: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	sess := &session{conn: conn, queue: make(chan message, sessionQueue), full: make(chan struct{}), stop: make(chan struct{})}
+	sess.send(jsonMessage(typeServerSettings, serverSettings{BufferMs: int(s.buffer / time.Millisecond), Volume: 100}))
+	s.mu.Lock()
+	if s.header.payload != nil {
+		sess.send(s.header)
+	}
+	s.sessions[sess] = struct{}{}
+	count := len(s.sessions)
+	s.mu.Unlock()
+	s.logger.Infow("Snapcast client connected", "remote", conn.RemoteAddr().String(), "name", hi.HostName,
+		"id", hi.ID, "version", hi.Version, "clients", count)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.write(sess)
+	}()
+
+	// Clients send time requests every second or so, and their volume
+	for err == nil {
+		h, _, err = readMessage(r, s.now)
+		if err == nil && h.typ == typeTime {
+			sess.send(timeReply(h))
+		}
+	}
+
+	s.mu.Lock()
+	delete(s.sessions, sess)
+	count = len(s.sessions)
+	s.mu.Unlock()
+	close(sess.stop)
+	<-done
+	s.logger.Infow("Snapcast client disconnected", "remote", conn.RemoteAddr().String(), "name", hi.HostName, "clients", count)
+}
+
+// write sends a client its queued messages, stamped with the time they
+// leave, until the connection fails or the client falls behind
+func (s *Server) write(sess *session) {
+	w := bufio.NewWriter(sess.conn)
+	for {
+		select {
+		case <-sess.stop:
+			return
+		case <-sess.full:
+			s.logger.Warnf("Snapcast client %s fell behind, disconnecting", sess.conn.RemoteAddr())
+			sess.conn.Close()
+			return
+		case m := <-sess.queue:
+			sess.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			w.Write(m.encode(s.now()))
+			// Flush once nothing else is waiting, so time replies are not
+			// held back behind audio
+			if len(sess.queue) == 0 {
+				if err := w.Flush(); err != nil {
+					sess.conn.Close()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Description is a device's description, as published at its location
+type Description struct {
+	URLBase string        `xml:"URLBase"`
+	Device  DeviceDetails `xml:"device"`
+
+	base *url.URL
+}
+
+// DeviceDetails describes a device, its services and embedded devices
+type DeviceDetails struct {
+	DeviceType   string          `xml:"deviceType"`
+	FriendlyName string          `xml:"friendlyName"`
+	Manufacturer string          `xml:"manufacturer"`
+	ModelName    string          `xml:"modelName"`
+	UDN          string          `xml:"UDN"`
+	Services     []Service       `xml:"serviceList>service"`
+	Devices      []DeviceDetails `xml:"deviceList>device"`
+}
+
+// Service is a service of a device
+type Service struct {
+	ServiceType string `xml:"serviceType"`
+	ServiceID   string `xml:"serviceId"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// Describe fetches the description of the device at location
+func Describe(ctx context.Context, location string) (*Description, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp: description at %s: HTTP %d", location, resp.StatusCode)
+	}
+
+	var d Description
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, maxSOAPSize)).Decode(&d); err != nil {
+		return nil, fmt.Errorf("upnp: description at %s: %v", location, err)
+	}
+	// Relative URLs are relative to URLBase, if the device gives one
+	d.base = resp.Request.URL
+	if d.URLBase != "" {
+		if base, err := url.Parse(d.URLBase); err == nil {
+			d.base = base
+		}
+	}
+	return &d, nil
+}
+
+// FindService returns the first service, in the device or those embedded
+// in it, whose type starts with prefix, so that a prefix without a version
+// matches any version. Its control URL is made absolute.
+func (d *Description) FindService(prefix string) (Service, bool) {
+	var find func(dev DeviceDetails) (Service, bool)
+	find = func(dev DeviceDetails) (Service, bool) {
+		for _, svc := range dev.Services {
+			if strings.HasPrefix(svc.ServiceType, prefix) {
+				return svc, true
+			}
+		}
+		for _, sub := range dev.Devices {
+			if svc, ok := find(sub); ok {
+				return svc, true
+			}
+		}
+		return Service{}, false
+	}
+
+	svc, ok := find(d.Device)
+	if !ok {
+		return Service{}, false
+	}
+	if ref, err := url.Parse(strings.TrimSpace(svc.ControlURL)); err == nil {
+		svc.ControlURL = d.base.ResolveReference(ref).String()
+	}
+	return svc, true
+}
@@ -0,0 +1,137 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Internet gateway device types, which routers that map ports announce
+// themselves as
+var gatewayTypes = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+}
+
+// Connection services, one of which a gateway maps ports with
+var connectionTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:",
+	"urn:schemas-upnp-org:service:WANPPPConnection:",
+}
+
+// errOnlyPermanentLeases is returned by gateways that cannot map ports for
+// a limited time
+const errOnlyPermanentLeases = "725"
+
+// Gateway is a router that maps ports from the internet to the LAN
+type Gateway struct {
+	Name     string
+	Location string
+
+	connection Service
+}
+
+// FindGateway searches for an internet gateway for wait, returning the
+// first that answers with a connection service
+func FindGateway(ctx context.Context, wait time.Duration) (*Gateway, error) {
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		responses []Response
+		errs      []error
+	)
+	for _, typ := range gatewayTypes {
+		wg.Add(1)
+		go func(typ string) {
+			defer wg.Done()
+			found, err := Search(ctx, typ, wait)
+			mu.Lock()
+			defer mu.Unlock()
+			responses = append(responses, found...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}(typ)
+	}
+	wg.Wait()
+
+	for _, resp := range responses {
+		d, err := Describe(ctx, resp.Location)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, typ := range connectionTypes {
+			if svc, ok := d.FindService(typ); ok {
+				return &Gateway{Name: d.Device.FriendlyName, Location: resp.Location, connection: svc}, nil
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, errors.New("upnp: no internet gateway found")
+}
+
+// LocalAddr returns the local address the gateway reaches this host at
+func (g *Gateway) LocalAddr() (net.IP, error) {
+	u, err := url.Parse(g.connection.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return LocalAddr(net.JoinHostPort(u.Hostname(), port))
+}
+
+// ExternalIP returns the gateway's address on the internet
+func (g *Gateway) ExternalIP(ctx context.Context) (net.IP, error) {
+	results, err := Call(ctx, g.connection.ControlURL, g.connection.ServiceType, "GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(results["NewExternalIPAddress"])
+	if ip == nil {
+		return nil, fmt.Errorf("upnp: gateway gave an invalid external address %q", results["NewExternalIPAddress"])
+	}
+	return ip, nil
+}
+
+// AddPortMapping forwards port on the gateway, over protocol ("TCP" or
+// "UDP"), to the same port at client, for lease. Gateways that only map
+// ports permanently are asked for a permanent mapping instead, and the
+// lease returned is then 0.
+func (g *Gateway) AddPortMapping(ctx context.Context, protocol string, port int, client net.IP, lease time.Duration, description string) (time.Duration, error) {
+	add := func(lease time.Duration) error {
+		_, err := Call(ctx, g.connection.ControlURL, g.connection.ServiceType, "AddPortMapping",
+			Arg{"NewRemoteHost", ""},
+			Arg{"NewExternalPort", strconv.Itoa(port)},
+			Arg{"NewProtocol", protocol},
+			Arg{"NewInternalPort", strconv.Itoa(port)},
+			Arg{"NewInternalClient", client.String()},
+			Arg{"NewEnabled", "1"},
+			Arg{"NewPortMappingDescription", description},
+			Arg{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))})
+		return err
+	}
+	err := add(lease)
+	var upnpErr *Error
+	if errors.As(err, &upnpErr) && upnpErr.Code == errOnlyPermanentLeases {
+		return 0, add(0)
+	}
+	return lease, err
+}
+
+// DeletePortMapping stops forwarding port over protocol
+func (g *Gateway) DeletePortMapping(ctx context.Context, protocol string, port int) error {
+	_, err := Call(ctx, g.connection.ControlURL, g.connection.ServiceType, "DeletePortMapping",
+		Arg{"NewRemoteHost", ""}, Arg{"NewExternalPort", strconv.Itoa(port)}, Arg{"NewProtocol", protocol})
+	return err
+}
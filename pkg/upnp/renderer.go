@@ -0,0 +1,99 @@
+package upnp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// MediaRenderer is the device type of DLNA renderers, such as smart
+	// TVs and network speakers
+	MediaRenderer = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	// avTransport is the type of the service renderers play media with
+	avTransport = "urn:schemas-upnp-org:service:AVTransport:"
+)
+
+// Renderer is a media renderer that can be told to play a URL
+type Renderer struct {
+	// ID is the renderer's UDN
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	Location     string `json:"location"`
+
+	transport Service
+}
+
+// FindRenderers searches for media renderers for wait and describes
+// those that answer. Renderers that cannot be described or have no
+// AVTransport service are left out.
+func FindRenderers(ctx context.Context, wait time.Duration) ([]*Renderer, error) {
+	responses, err := Search(ctx, MediaRenderer, wait)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		renderers []*Renderer
+		locations = make(map[string]bool)
+	)
+	for _, resp := range responses {
+		if locations[resp.Location] {
+			continue
+		}
+		locations[resp.Location] = true
+		wg.Add(1)
+		go func(location string) {
+			defer wg.Done()
+			if r, err := NewRenderer(ctx, location); err == nil {
+				mu.Lock()
+				renderers = append(renderers, r)
+				mu.Unlock()
+			}
+		}(resp.Location)
+	}
+	wg.Wait()
+	return renderers, nil
+}
+
+// NewRenderer describes the renderer whose description is at location
+func NewRenderer(ctx context.Context, location string) (*Renderer, error) {
+	d, err := Describe(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	transport, ok := d.FindService(avTransport)
+	if !ok {
+		return nil, fmt.Errorf("upnp: no AVTransport service at %s", location)
+	}
+	return &Renderer{
+		ID:           d.Device.UDN,
+		Name:         d.Device.FriendlyName,
+		Manufacturer: d.Device.Manufacturer,
+		Model:        d.Device.ModelName,
+		Location:     location,
+		transport:    transport,
+	}, nil
+}
+
+// Play has the renderer play uri, described by metadata as DIDL-Lite
+func (r *Renderer) Play(ctx context.Context, uri, metadata string) error {
+	_, err := Call(ctx, r.transport.ControlURL, r.transport.ServiceType, "SetAVTransportURI",
+		Arg{"InstanceID", "0"}, Arg{"CurrentURI", uri}, Arg{"CurrentURIMetaData", metadata})
+	if err != nil {
+		return err
+	}
+	_, err = Call(ctx, r.transport.ControlURL, r.transport.ServiceType, "Play", Arg{"InstanceID", "0"}, Arg{"Speed", "1"})
+	return err
+}
+
+// Stop has the renderer stop playing
+func (r *Renderer) Stop(ctx context.Context) error {
+	_, err := Call(ctx, r.transport.ControlURL, r.transport.ServiceType, "Stop", Arg{"InstanceID", "0"})
+	return err
+}
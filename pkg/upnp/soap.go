@@ -0,0 +1,153 @@
+package upnp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxSOAPSize bounds SOAP messages read, which are small
+const maxSOAPSize = 1 << 20
+
+// Arg is an action's argument, or one of its results
+type Arg struct {
+	Name  string
+	Value string
+}
+
+// Error is a fault returned by a call
+type Error struct {
+	Action      string
+	Code        string
+	Description string
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("upnp: %s failed with error %s", e.Action, e.Code)
+	}
+	return fmt.Sprintf("upnp: %s failed with error %s: %s", e.Action, e.Code, e.Description)
+}
+
+// Call invokes action of the service of type serviceType at controlURL
+// and returns its results by name
+func Call(ctx context.Context, controlURL, serviceType, action string, args ...Arg) (map[string]string, error) {
+	var body bytes.Buffer
+	writeEnvelope(&body, serviceType, action, args)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPACTION", fmt.Sprintf(`"%s#%s"`, serviceType, action))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	name, values, err := readEnvelope(io.LimitReader(resp.Body, maxSOAPSize))
+	if err != nil {
+		return nil, fmt.Errorf("upnp: %s: HTTP %d with an unreadable answer: %v", action, resp.StatusCode, err)
+	}
+	if name == "Fault" {
+		return nil, &Error{Action: action, Code: values["errorCode"], Description: values["errorDescription"]}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upnp: %s: HTTP %d", action, resp.StatusCode)
+	}
+	return values, nil
+}
+
+// ReadAction reads a call to one of our services, returning the action
+// and its arguments by name
+func ReadAction(r *http.Request) (string, map[string]string, error) {
+	return readEnvelope(io.LimitReader(r.Body, maxSOAPSize))
+}
+
+// WriteResult answers a call to action of serviceType with its results
+func WriteResult(w http.ResponseWriter, serviceType, action string, results ...Arg) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	writeEnvelope(w, serviceType, action+"Response", results)
+}
+
+// WriteError answers a call with a fault, such as 401 for an unknown
+// action or 402 for invalid arguments
+func WriteError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>`+
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError>`+
+		`</detail></s:Fault></s:Body></s:Envelope>`, code, escape(description))
+}
+
+// writeEnvelope writes a SOAP envelope carrying element of serviceType
+// with args
+func writeEnvelope(w io.Writer, serviceType, element string, args []Arg) {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>`)
+	b.WriteString(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&b, `<u:%s xmlns:u="%s">`, element, escape(serviceType))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "<%s>%s</%s>", arg.Name, escape(arg.Value), arg.Name)
+	}
+	fmt.Fprintf(&b, "</u:%s></s:Body></s:Envelope>", element)
+	io.WriteString(w, b.String())
+}
+
+// readEnvelope reads a SOAP envelope, returning the name of the element
+// in its body and the text of every element within it by name
+func readEnvelope(r io.Reader) (string, map[string]string, error) {
+	dec := xml.NewDecoder(r)
+	var (
+		name  string
+		path  []string
+		text  strings.Builder
+		value = make(map[string]string)
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			// Envelope, Body, then the action, its response or a fault
+			if len(path) == 3 && path[1] == "Body" {
+				name = t.Name.Local
+			}
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if len(path) > 3 {
+				value[path[len(path)-1]] = text.String()
+			}
+			text.Reset()
+			path = path[:len(path)-1]
+		}
+	}
+	if name == "" {
+		return "", nil, errors.New("no SOAP body")
+	}
+	return name, value, nil
+}
+
+// escape escapes s for XML text or attributes
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
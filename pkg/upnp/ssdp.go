@@ -0,0 +1,274 @@
+// Package upnp is a minimal UPnP toolkit: SSDP to announce devices and find
+// them on the LAN, device descriptions, and SOAP to call their actions and
+// answer calls to ours.
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// ssdpAddr is the SSDP multicast group
+	ssdpAddr = "239.255.255.250:1900"
+	// maxAge is how long announcements are valid for
+	maxAge = 30 * time.Minute
+	// announceInterval is how often announcements are renewed, well
+	// within maxAge so a lost one does not make the device disappear
+	announceInterval = maxAge / 3
+	// maxResponseDelay caps how long a search response is held back
+	maxResponseDelay = 5 * time.Second
+)
+
+// Device is a root device to announce
+type Device struct {
+	// UUID identifies the device, without the "uuid:" prefix. It should
+	// stay the same across restarts.
+	UUID string
+	// Types are the device's own type and the types of its services
+	Types []string
+	// Location returns the URL of the device's description, reached at
+	// the local address given
+	Location func(local net.IP) string
+	// Server names the device's software in SSDP messages
+	Server string
+}
+
+// notifications returns the NT and USN of everything announced for d: the
+// root device, the device itself and each of its types
+func (d Device) notifications() [][2]string {
+	udn := "uuid:" + d.UUID
+	notes := [][2]string{{"upnp:rootdevice", udn + "::upnp:rootdevice"}, {udn, udn}}
+	for _, typ := range d.Types {
+		notes = append(notes, [2]string{typ, udn + "::" + typ})
+	}
+	return notes
+}
+
+// Advertiser announces a device on the LAN and answers searches for it
+type Advertiser struct {
+	device Device
+	// conn receives searches, and out sends announcements: conn does not
+	// loop multicast back, so announcements from it would not reach
+	// players on this host
+	conn   *net.UDPConn
+	out    *net.UDPConn
+	group  *net.UDPAddr
+	logger *zap.SugaredLogger
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// Advertise announces device on the interface multicast leaves by
+// default, until the advertiser is closed
+func Advertise(device Device, logger *zap.SugaredLogger) (*Advertiser, error) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	out, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	a := &Advertiser{device: device, conn: conn, out: out, group: group, logger: logger, stop: make(chan struct{})}
+	go a.serve()
+	go a.announce()
+	return a, nil
+}
+
+// Close announces the device is leaving and stops advertising it
+func (a *Advertiser) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.stop)
+		a.notify("ssdp:byebye")
+		a.out.Close()
+		err = a.conn.Close()
+	})
+	return err
+}
+
+// announce announces the device now and again before the announcement
+// expires
+func (a *Advertiser) announce() {
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		a.notify("ssdp:alive")
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notify multicasts a NOTIFY of kind nts for everything the device is
+// announced as
+func (a *Advertiser) notify(nts string) {
+	local, err := LocalAddr(a.group.String())
+	if err != nil {
+		a.logger.Debugf("Not announcing: %v", err)
+		return
+	}
+	for _, note := range a.device.notifications() {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "NOTIFY * HTTP/1.1\r\nHOST: %s\r\nNT: %s\r\nNTS: %s\r\nUSN: %s\r\n", ssdpAddr, note[0], nts, note[1])
+		if nts == "ssdp:alive" {
+			fmt.Fprintf(&b, "CACHE-CONTROL: max-age=%d\r\nLOCATION: %s\r\nSERVER: %s\r\n",
+				int(maxAge/time.Second), a.device.Location(local), a.device.Server)
+		}
+		b.WriteString("\r\n")
+		if _, err := a.out.WriteToUDP(b.Bytes(), a.group); err != nil {
+			a.logger.Debugf("Failed to announce: %v", err)
+			return
+		}
+	}
+}
+
+// serve answers searches until the advertiser is closed
+func (a *Advertiser) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-a.stop:
+			default:
+				a.logger.Errorf("SSDP stopped: %v", err)
+			}
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+		target := req.Header.Get("ST")
+		var matches [][2]string
+		for _, note := range a.device.notifications() {
+			if target == "ssdp:all" || target == note[0] {
+				matches = append(matches, note)
+			}
+		}
+		if len(matches) > 0 {
+			mx, _ := strconv.Atoi(req.Header.Get("MX"))
+			go a.respond(from, matches, time.Duration(mx)*time.Second)
+		}
+	}
+}
+
+// respond answers a search, after a random delay up to mx so devices do
+// not all answer at once
+func (a *Advertiser) respond(to *net.UDPAddr, matches [][2]string, mx time.Duration) {
+	if mx = min(mx, maxResponseDelay); mx > 0 {
+		select {
+		case <-a.stop:
+			return
+		case <-time.After(rand.N(mx)):
+		}
+	}
+	local, err := LocalAddr(to.String())
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		msg := fmt.Sprintf("HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=%d\r\nEXT:\r\nLOCATION: %s\r\nSERVER: %s\r\nST: %s\r\nUSN: %s\r\n\r\n",
+			int(maxAge/time.Second), a.device.Location(local), a.device.Server, match[0], match[1])
+		if _, err := a.conn.WriteToUDP([]byte(msg), to); err != nil {
+			return
+		}
+	}
+}
+
+// Response is a device's answer to a search
+type Response struct {
+	// Target is the search target the device matched
+	Target string
+	// USN identifies the device, or one of its services
+	USN      string
+	Location string
+	Server   string
+}
+
+// Search looks for devices matching target, such as a device or service
+// type, collecting the answers that arrive within wait
+func Search(ctx context.Context, target string, wait time.Duration) ([]Response, error) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	mx := max(int(wait/time.Second), 1)
+	msg := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: %d\r\nST: %s\r\n\r\n", ssdpAddr, mx, target)
+	if _, err := conn.WriteToUDP([]byte(msg), group); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	var responses []Response
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return responses, nil
+			}
+			return responses, err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		r := Response{
+			Target:   resp.Header.Get("ST"),
+			USN:      resp.Header.Get("USN"),
+			Location: resp.Header.Get("LOCATION"),
+			Server:   resp.Header.Get("SERVER"),
+		}
+		if r.Location == "" || seen[r.USN+" "+r.Location] {
+			continue
+		}
+		seen[r.USN+" "+r.Location] = true
+		responses = append(responses, r)
+	}
+}
+
+// LocalAddr returns the local address traffic to addr, a host:port, leaves
+// from, which is where a device there reaches this host
+func LocalAddr(addr string) (net.IP, error) {
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
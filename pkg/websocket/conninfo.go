@@ -0,0 +1,76 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnInfo records what a client negotiated when it connected, to help debug
+// clients that underperform or fail to connect
+type ConnInfo struct {
+	Transport   string    `json:"transport"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Path        string    `json:"path,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	HTTPVersion string    `json:"http_version,omitempty"`
+	TLSVersion  string    `json:"tls_version,omitempty"`
+	TLSCipher   string    `json:"tls_cipher,omitempty"`
+	Subprotocol string    `json:"subprotocol,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// Country (an ISO 3166 code) and City are where a remote listener's
+	// address was located, when a GeoIP database is set
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+}
+
+// RequestInfo captures the HTTP and TLS details of a request
+func RequestInfo(r *http.Request, transport string) ConnInfo {
+	info := ConnInfo{
+		Transport:   transport,
+		RemoteAddr:  r.RemoteAddr,
+		Path:        r.URL.Path,
+		UserAgent:   r.UserAgent(),
+		HTTPVersion: r.Proto,
+		ConnectedAt: time.Now(),
+	}
+	if r.TLS != nil {
+		info.TLSVersion = tls.VersionName(r.TLS.Version)
+		info.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+	return info
+}
+
+// ConnInfo captures the request details plus what the WebSocket handshake
+// negotiated
+func (m *Manager) ConnInfo(r *http.Request, conn *websocket.Conn) ConnInfo {
+	info := RequestInfo(r, "websocket")
+	info.Subprotocol = conn.Subprotocol()
+	return info
+}
+
+// remote reports whether the connection came from a client over the
+// network, rather than being one of the server's own outputs
+func (i ConnInfo) remote() bool {
+	return i.Transport == "websocket" || i.Transport == "http" || i.Transport == "webrtc"
+}
+
+// logFields flattens the info for structured logging
+func (i ConnInfo) logFields() []interface{} {
+	fields := []interface{}{"transport", i.Transport, "remote", i.RemoteAddr}
+	if i.HTTPVersion != "" {
+		fields = append(fields, "http", i.HTTPVersion)
+	}
+	if i.TLSVersion != "" {
+		fields = append(fields, "tls", i.TLSVersion, "cipher", i.TLSCipher)
+	}
+	if i.Subprotocol != "" {
+		fields = append(fields, "subprotocol", i.Subprotocol)
+	}
+	if i.Country != "" {
+		fields = append(fields, "country", i.Country)
+	}
+	return fields
+}
@@ -0,0 +1,128 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// SilenceConfig says when source audio counts as silent, and what to do
+// about it
+type SilenceConfig struct {
+	// Threshold is the level (in dBFS) below which audio is silent
+	Threshold float64
+	// After is how long the source must stay silent before the silence is
+	// reported, so pauses between sentences are not
+	After time.Duration
+	// Pause stops broadcasting the source while it is silent, rather than
+	// sending listeners zeros, until its audio resumes
+	Pause bool
+}
+
+// DefaultSilence reports ten seconds of dead air without pausing
+var DefaultSilence = SilenceConfig{Threshold: -60, After: 10 * time.Second}
+
+// Publisher receives the Manager's events, such as an events.Bus
+type Publisher interface {
+	Publish(typ string, data interface{})
+}
+
+// SourceEvent is the data of a "source" event, published when a source
+// connects or disconnects
+type SourceEvent struct {
+	Connected  bool   `json:"connected"`
+	Transport  string `json:"transport"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+}
+
+// SilenceEvent is the data of a "silence" event, published when the source
+// has been silent for a while and again when audio resumes
+type SilenceEvent struct {
+	Active bool `json:"active"`
+	// Paused is set while the source is not being broadcast
+	Paused bool `json:"paused,omitempty"`
+	// Duration is how long the silence lasted, once it has ended
+	Duration float64 `json:"duration_seconds,omitempty"`
+}
+
+// MaintenanceEvent is the data of a "maintenance" event
+type MaintenanceEvent struct {
+	Active  bool   `json:"active"`
+	Message string `json:"message,omitempty"`
+}
+
+// SetEvents publishes source, metadata, silence, maintenance and hold
+// events to publisher
+func (m *Manager) SetEvents(publisher Publisher) {
+	m.events = publisher
+}
+
+// publish sends an event if a publisher is set
+func (m *Manager) publish(typ string, data interface{}) {
+	if m.events != nil {
+		m.events.Publish(typ, data)
+	}
+}
+
+// silenceDetector tracks how long the source has been silent
+type silenceDetector struct {
+	mu     sync.Mutex
+	config SilenceConfig
+	since  time.Time
+	active bool
+}
+
+// SetSilence sets when the source counts as silent and whether it is
+// paused while it is
+func (m *Manager) SetSilence(config SilenceConfig) {
+	m.silence.mu.Lock()
+	defer m.silence.mu.Unlock()
+
+	m.silence.config = config
+}
+
+// observe measures a source frame, publishing when silence starts or ends.
+// It reports whether the frame should be broadcast.
+func (m *Manager) observe(data []byte, now time.Time) bool {
+	d := &m.silence
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if audio.LevelDBFS(data) >= d.config.Threshold {
+		if d.active {
+			m.publish("silence", SilenceEvent{Duration: now.Sub(d.since).Seconds()})
+			if d.config.Pause {
+				m.logger.Info("Source audio resumed, broadcasting again")
+				m.discontinuity.Store(true)
+			}
+		}
+		d.since, d.active = time.Time{}, false
+		return true
+	}
+
+	if d.since.IsZero() {
+		d.since = now
+	}
+	if !d.active && now.Sub(d.since) >= d.config.After {
+		d.active = true
+		m.publish("silence", SilenceEvent{Active: true, Paused: d.config.Pause})
+		if d.config.Pause {
+			m.logger.Infof("Source silent for %s, pausing the broadcast", d.config.After)
+		}
+	}
+	return !(d.active && d.config.Pause)
+}
+
+// resetSilence forgets the silence of a source that has gone, reporting
+// its end if it had been reported
+func (m *Manager) resetSilence(now time.Time) {
+	d := &m.silence
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.active {
+		m.publish("silence", SilenceEvent{Duration: now.Sub(d.since).Seconds()})
+	}
+	d.since, d.active = time.Time{}, false
+}
@@ -0,0 +1,223 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// Codecs a source can send
+const (
+	// CodecPCM is integer PCM, 16 or 24-bit
+	CodecPCM = "pcm"
+	// CodecFloat is 32-bit float PCM, as Web Audio and many DAWs produce
+	CodecFloat = "float"
+	CodecOpus  = "opus"
+)
+
+// SourceFormat describes the audio a source sends. Sources announce it in a
+// handshake text frame on connect; listeners are sent the PCM format they
+// receive so they can decode it.
+type SourceFormat struct {
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	BitDepth   int    `json:"bit_depth"`
+	Codec      string `json:"codec"`
+
+	// Framed sources put a frame header (see package frame) before every
+	// binary message
+	Framed bool `json:"framed,omitempty"`
+}
+
+// formatMessage is the text frame carrying a format
+type formatMessage struct {
+	Type string `json:"type"`
+	SourceFormat
+	// Token authorizes UDP sources, which have no headers to send it in
+	Token string `json:"token,omitempty"`
+}
+
+// Handshake returns the text frame a source sends to announce its format
+func (f SourceFormat) Handshake() ([]byte, error) {
+	return json.Marshal(formatMessage{Type: "format", SourceFormat: f})
+}
+
+// Hello returns the handshake a UDP source opens its session with,
+// carrying its token when the server requires one
+func (f SourceFormat) Hello(token string) ([]byte, error) {
+	return json.Marshal(formatMessage{Type: "format", SourceFormat: f, Token: token})
+}
+
+// Validate checks that the format is one the server can broadcast
+func (f SourceFormat) Validate() error {
+	if f.SampleRate < 8000 || f.SampleRate > 192000 {
+		return fmt.Errorf("unsupported sample rate %d", f.SampleRate)
+	}
+	if f.Channels < 1 || f.Channels > 8 {
+		return fmt.Errorf("unsupported channel count %d", f.Channels)
+	}
+
+	switch f.Codec {
+	case CodecPCM:
+		if f.BitDepth != 16 && f.BitDepth != 24 {
+			return fmt.Errorf("unsupported bit depth %d", f.BitDepth)
+		}
+	case CodecFloat:
+		if f.BitDepth != 32 {
+			return fmt.Errorf("unsupported float bit depth %d", f.BitDepth)
+		}
+	case CodecOpus:
+		if !audio.OpusAvailable() {
+			return audio.ErrOpusUnavailable
+		}
+	default:
+		return fmt.Errorf("unknown codec %q", f.Codec)
+	}
+	return nil
+}
+
+// FormatListener is implemented by listeners that are told the format of
+// the audio they receive. Updates are delivered on the same goroutine as Send.
+type FormatListener interface {
+	SendFormat(format SourceFormat) error
+}
+
+// errPassthroughCodec is returned for formats that would need decoding or
+// unframing in passthrough mode
+var errPassthroughCodec = errors.New("passthrough mode only accepts unframed 16-bit pcm sources")
+
+// BroadcastFormat returns the format the server is configured to broadcast
+func (m *Manager) BroadcastFormat() SourceFormat {
+	return SourceFormat{
+		SampleRate: m.audio.GetSampleRate(),
+		Channels:   m.audio.GetNumChannels(),
+		BitDepth:   m.audio.GetBitDepth(),
+		Codec:      CodecPCM,
+	}
+}
+
+// SetPassthrough makes the Manager refuse sources it would have to decode
+func (m *Manager) SetPassthrough(passthrough bool) {
+	m.sourceMu.Lock()
+	defer m.sourceMu.Unlock()
+
+	m.passthrough = passthrough
+}
+
+// OutputFormat returns the format of the PCM listeners currently receive:
+// the source's format once decoded, or the broadcast format with no source
+func (m *Manager) OutputFormat() SourceFormat {
+	m.sourceMu.RLock()
+	defer m.sourceMu.RUnlock()
+
+	return m.outputFormat
+}
+
+// SetSourceFormat validates and applies a format announced by src, which
+// must hold the source slot, and tells listeners about the change
+func (m *Manager) SetSourceFormat(src io.Closer, format SourceFormat) error {
+	m.sourceMu.Lock()
+	if m.source != src {
+		m.sourceMu.Unlock()
+		return errors.New("not the current source")
+	}
+	changed, err := m.applyFormat(format)
+	m.sourceMu.Unlock()
+
+	if changed {
+		m.notifyFormat()
+	}
+	return err
+}
+
+// applyFormat validates format and makes it the current source's format,
+// reporting whether the format listeners receive changed. Called with
+// sourceMu held; the caller notifies listeners after releasing it.
+func (m *Manager) applyFormat(format SourceFormat) (bool, error) {
+	if err := format.Validate(); err != nil {
+		return false, err
+	}
+	if m.passthrough && (format.Codec != CodecPCM || format.BitDepth != 16 || format.Framed) {
+		return false, errPassthroughCodec
+	}
+
+	// Compressed sources are decoded to the broadcast format, other
+	// sources are reduced to 16-bit PCM, and frame headers are stripped
+	output := format
+	output.Framed = false
+	output.Codec, output.BitDepth = CodecPCM, 16
+	if format.Codec == CodecOpus {
+		output = m.BroadcastFormat()
+	}
+	// With resampling and remixing on, PCM sources are converted to the
+	// broadcast rate and channel count
+	if m.resample != "" && !m.passthrough {
+		output.SampleRate = m.BroadcastFormat().SampleRate
+	}
+	if m.remix && !m.passthrough {
+		output.Channels = m.BroadcastFormat().Channels
+	}
+
+	m.sourceFormat = format
+	changed := output != m.outputFormat
+	m.outputFormat = output
+
+	if broadcast := m.BroadcastFormat(); output != broadcast {
+		m.logger.Warnf("Source sends %dHz/%dch but the broadcast format is %dHz/%dch",
+			output.SampleRate, output.Channels, broadcast.SampleRate, broadcast.Channels)
+	}
+
+	m.guardMu.Lock()
+	m.guard = audio.NewLoopGuard(output.SampleRate, output.Channels, m.loopAction)
+	m.guardMu.Unlock()
+	return changed, nil
+}
+
+// notifyFormat tells listeners the format they now receive. Holding the
+// clients lock, which joins take too, means a listener joining meanwhile
+// can't miss the change.
+func (m *Manager) notifyFormat() {
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+
+	format := m.OutputFormat()
+	for _, c := range m.snapshot() {
+		c.updateFormat(format)
+	}
+}
+
+// newSourceDecoder returns the decoder for a format, or nil for 16-bit PCM
+func (m *Manager) newSourceDecoder(format SourceFormat) (audio.FrameDecoder, error) {
+	switch {
+	case format.Codec == CodecOpus:
+		return audio.NewOpusDecoder(m.audio.GetSampleRate(), m.audio.GetNumChannels())
+	case format.Codec == CodecFloat:
+		return audio.NewDepthConverter(format.BitDepth, true)
+	case format.BitDepth != 16:
+		return audio.NewDepthConverter(format.BitDepth, false)
+	}
+	return nil, nil
+}
+
+// parseFormatMessage decodes a format text frame sent by a source
+func parseFormatMessage(data []byte) (SourceFormat, bool) {
+	var msg formatMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "format" {
+		return SourceFormat{}, false
+	}
+	if msg.Codec == "" {
+		msg.Codec = CodecPCM
+	}
+	if msg.BitDepth == 0 {
+		switch msg.Codec {
+		case CodecPCM:
+			msg.BitDepth = 16
+		case CodecFloat:
+			msg.BitDepth = 32
+		}
+	}
+	return msg.SourceFormat, true
+}
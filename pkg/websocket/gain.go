@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MaxSourceGain is the largest gain, in dB either way, a source may be set to
+const MaxSourceGain = 40.0
+
+// sourceWriteTimeout bounds writing a control message to the source
+const sourceWriteTimeout = 5 * time.Second
+
+var (
+	// ErrNoSource is returned when controlling a source while none is
+	// connected
+	ErrNoSource = errors.New("no source is connected")
+	// ErrNoGainControl is returned when the source has not said it takes
+	// gain changes, such as browsers, relays and UDP sources
+	ErrNoGainControl = errors.New("the source does not take gain changes")
+)
+
+// gainMessage is the text frame in which the server sets a source's gain,
+// and the source reports the gain it applies
+type gainMessage struct {
+	Type   string  `json:"type"`
+	GainDB float64 `json:"gain_db"`
+}
+
+// parseGainMessage decodes a gain report sent by a source
+func parseGainMessage(data []byte) (float64, bool) {
+	var msg gainMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "gain" {
+		return 0, false
+	}
+	return msg.GainDB, true
+}
+
+// SetSourceGain asks the connected source to apply gainDB to its audio
+// before sending it. The source reports the gain back once applied.
+func (m *Manager) SetSourceGain(gainDB float64) error {
+	if math.IsNaN(gainDB) || math.Abs(gainDB) > MaxSourceGain {
+		return fmt.Errorf("gain must be between -%g and %g dB", MaxSourceGain, MaxSourceGain)
+	}
+
+	m.sourceMu.RLock()
+	source, controllable := m.source, m.sourceGain != nil
+	m.sourceMu.RUnlock()
+	if source == nil {
+		return ErrNoSource
+	}
+	conn, ok := source.(*websocket.Conn)
+	if !ok || !controllable {
+		return ErrNoGainControl
+	}
+	data, _ := json.Marshal(gainMessage{Type: "gain", GainDB: gainDB})
+	return m.writeSource(conn, data)
+}
+
+// SourceGain returns the gain the source reported applying, if it takes
+// gain changes
+func (m *Manager) SourceGain() (float64, bool) {
+	m.sourceMu.RLock()
+	defer m.sourceMu.RUnlock()
+
+	if m.source == nil || m.sourceGain == nil {
+		return 0, false
+	}
+	return *m.sourceGain, true
+}
+
+// reportSourceGain records the gain reported by src, if it is the source
+func (m *Manager) reportSourceGain(src *websocket.Conn, gainDB float64) {
+	m.sourceMu.Lock()
+	defer m.sourceMu.Unlock()
+
+	if m.source != src {
+		return
+	}
+	m.sourceGain = &gainDB
+	m.logger.Infow("Source gain", "gain_db", gainDB)
+}
+
+// writeSource writes a text message to a WebSocket source. Control
+// messages come from API requests, so writes are serialized.
+func (m *Manager) writeSource(conn *websocket.Conn, data []byte) error {
+	m.sourceWriteMu.Lock()
+	defer m.sourceWriteMu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(sourceWriteTimeout))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// HoldState describes the broadcast being on hold
+type HoldState struct {
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+// HoldEvent is the data of a "hold" event
+type HoldEvent struct {
+	Active  bool   `json:"active"`
+	Message string `json:"message,omitempty"`
+}
+
+// EnterHold stops broadcasting the source until ExitHold, without
+// disconnecting it, or changes the message of an active hold. Its audio keeps flowing through the pipeline and jitter
+// buffer, and is dropped before listeners and source taps; feed listeners
+// with BroadcastAnnouncement meanwhile.
+func (m *Manager) EnterHold(message string) {
+	m.hold.Store(&HoldState{Message: message, Since: time.Now()})
+	// A silence in progress ends, stopping any fallback for it
+	m.resetSilence(time.Now())
+	m.logger.Infow("Broadcast on hold", "message", message)
+	m.publish("hold", HoldEvent{Active: true, Message: message})
+}
+
+// ExitHold broadcasts the source again, fading it in
+func (m *Manager) ExitHold() {
+	if m.hold.Swap(nil) == nil {
+		return
+	}
+	// The source's silence before the hold says nothing about after it
+	m.resetSilence(time.Now())
+	m.logger.Info("Broadcast resumed")
+	m.publish("hold", HoldEvent{})
+}
+
+// Hold returns the active hold, if any
+func (m *Manager) Hold() (HoldState, bool) {
+	if state := m.hold.Load(); state != nil {
+		return *state, true
+	}
+	return HoldState{}, false
+}
+
+// holdFrame returns nil for a source frame held back, and fades in the
+// first frame after a hold ends. Passthrough frames are never altered.
+func (m *Manager) holdFrame(data []byte) []byte {
+	held := m.hold.Load() != nil
+	was := m.sourceHeld.Swap(held)
+	switch {
+	case held:
+		return nil
+	case !was || m.passthrough:
+		return data
+	}
+
+	pcm := audio.BytesToPCM(data)
+	audio.Ramp(pcm, m.OutputFormat().Channels, 0, 1)
+	return audio.PCMToBytes(pcm)
+}
@@ -0,0 +1,62 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/frame"
+)
+
+// sourceFrame is a decoded source frame waiting in the jitter buffer
+type sourceFrame struct {
+	data     []byte
+	captured time.Time
+	flags    frame.Flags
+}
+
+// SetJitterBuffer sets how much audio from WebSocket and UDP sources is
+// buffered to smooth out irregular arrival; 0 broadcasts frames as they
+// arrive. It applies from the next source that connects.
+func (m *Manager) SetJitterBuffer(target time.Duration) {
+	m.sourceMu.Lock()
+	defer m.sourceMu.Unlock()
+
+	m.jitterTarget = target
+}
+
+// startJitter returns the function a source should hand its frames to: a
+// jitter buffer that re-emits them on a steady clock until ctx is done, or
+// BroadcastFrame directly when buffering is disabled
+func (m *Manager) startJitter(ctx context.Context) func(sourceFrame) {
+	m.sourceMu.Lock()
+	target := m.jitterTarget
+	if target <= 0 {
+		m.sourceMu.Unlock()
+		return func(f sourceFrame) { m.BroadcastFrame(f.data, f.captured, f.flags) }
+	}
+	jitter := audio.NewJitterBuffer[sourceFrame](target)
+	m.jitter = jitter
+	m.sourceMu.Unlock()
+
+	go func() {
+		jitter.Run(ctx, func(f sourceFrame, resumed bool) {
+			if resumed {
+				f.flags |= frame.FlagDiscontinuity
+			}
+			m.BroadcastFrame(f.data, f.captured, f.flags)
+		})
+
+		m.sourceMu.Lock()
+		if m.jitter == jitter {
+			m.jitter = nil
+		}
+		m.sourceMu.Unlock()
+	}()
+
+	return func(f sourceFrame) {
+		format := m.OutputFormat()
+		bytesPerSecond := format.SampleRate * format.Channels * 2
+		jitter.Push(f, time.Duration(len(f.data))*time.Second/time.Duration(bytesPerSecond))
+	}
+}
@@ -0,0 +1,92 @@
+package websocket
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// LevelInterval is how often level readings are pushed to listeners
+const LevelInterval = 100 * time.Millisecond
+
+// Levels are the peak and RMS level of each broadcast channel in dBFS over
+// the last LevelInterval
+type Levels struct {
+	Peak []float64 `json:"peak"`
+	RMS  []float64 `json:"rms"`
+}
+
+// LevelListener is implemented by listeners that can show level meters.
+// Readings are delivered on the same goroutine as Send.
+type LevelListener interface {
+	SendLevels(levels Levels) error
+}
+
+// levelsMessage is the text frame carrying levels to WebSocket clients
+type levelsMessage struct {
+	Type string `json:"type"`
+	Levels
+}
+
+// levelMeter measures the broadcast between readings
+type levelMeter struct {
+	mu       sync.Mutex
+	meter    *audio.LevelMeter
+	channels int
+	last     time.Time
+}
+
+// meter measures a broadcast frame, pushing a reading to listeners that
+// asked for levels once LevelInterval has passed. Audio that is not 16-bit
+// PCM, as in passthrough mode, is not measured.
+func (m *Manager) meter(data []byte, now time.Time) {
+	format := m.OutputFormat()
+	if format.Codec != CodecPCM || format.BitDepth != 16 {
+		return
+	}
+
+	l := &m.levels
+	l.mu.Lock()
+	if l.meter == nil || l.channels != format.Channels {
+		l.meter, l.channels, l.last = audio.NewLevelMeter(format.Channels), format.Channels, now
+	}
+	l.meter.Add(audio.BytesToPCM(data))
+	if now.Sub(l.last) < LevelInterval {
+		l.mu.Unlock()
+		return
+	}
+	peak, rms := l.meter.Read()
+	l.last = now
+	l.mu.Unlock()
+
+	// Tenths of a dB are plenty for a meter and keep the messages small
+	for ch := range peak {
+		peak[ch] = math.Round(peak[ch]*10) / 10
+		rms[ch] = math.Round(rms[ch]*10) / 10
+	}
+	levels := Levels{Peak: peak, RMS: rms}
+	for _, c := range m.snapshot() {
+		if c.profile.Levels {
+			c.updateLevels(levels)
+		}
+	}
+}
+
+// updateLevels queues a level reading, replacing one not yet delivered.
+// Listeners that cannot show levels ignore it.
+func (c *client) updateLevels(levels Levels) {
+	if _, ok := c.Listener.(LevelListener); !ok {
+		return
+	}
+
+	select {
+	case <-c.levels:
+	default:
+	}
+	select {
+	case c.levels <- levels:
+	default:
+	}
+}
@@ -0,0 +1,241 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/frame"
+)
+
+// Listener is a connected client that receives broadcast audio. WebSocket
+// connections and HTTP fallback streams both implement it, so they share the
+// same registry and accounting.
+type Listener interface {
+	// Send delivers one broadcast frame to the listener
+	Send(data []byte) error
+
+	// Close disconnects the listener
+	Close() error
+}
+
+// Feed supplies a listener's audio in place of the live broadcast, such as
+// a time-shifted replay
+type Feed interface {
+	// Run sends frames until ctx is done
+	Run(ctx context.Context, send func([]byte)) error
+}
+
+// wsListener delivers frames as binary WebSocket messages
+type wsListener struct {
+	conn   *websocket.Conn
+	format Format
+	audio  *audio.Processor
+}
+
+// Send writes the frame as a binary message in the listener's format
+func (l *wsListener) Send(data []byte) error {
+	if l.format == FormatWAV {
+		wav, err := l.audio.ProcessRawPCM(data)
+		if err != nil {
+			return err
+		}
+		data = wav
+	}
+	return l.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// SendFormat switches WAV framing to the new format and tells the client
+func (l *wsListener) SendFormat(format SourceFormat) error {
+	l.audio = audio.NewProcessor(format.SampleRate, format.Channels, format.BitDepth)
+	return l.conn.WriteJSON(formatMessage{Type: "format", SourceFormat: format})
+}
+
+// SendMetadata writes now-playing metadata as a JSON text message
+func (l *wsListener) SendMetadata(md Metadata) error {
+	return l.conn.WriteJSON(metadataMessage{Type: "metadata", Metadata: md})
+}
+
+// SendLevels writes a level reading as a JSON text message
+func (l *wsListener) SendLevels(levels Levels) error {
+	return l.conn.WriteJSON(levelsMessage{Type: "levels", Levels: levels})
+}
+
+// SendBufferTarget tells the player how much audio to keep scheduled ahead
+func (l *wsListener) SendBufferTarget(target time.Duration) error {
+	return l.conn.WriteJSON(bufferMessage{Type: "buffer", TargetMs: target.Milliseconds()})
+}
+
+// Close closes the underlying connection
+func (l *wsListener) Close() error {
+	return l.conn.Close()
+}
+
+// client feeds a listener from its own queue, so a slow listener never
+// holds up the broadcast to everyone else
+type client struct {
+	Listener
+	id      uint64
+	info    ConnInfo
+	profile Profile
+	feed    Feed
+	queue   chan []byte
+	meta    chan Metadata
+	formats chan SourceFormat
+	levels  chan Levels
+	buffer  chan time.Duration
+	stop    chan struct{}
+	done    chan struct{}
+
+	// tuner adjusts the buffer target of players that report on it
+	tuner *bufferTuner
+
+	closeOnce sync.Once
+	dropped   atomic.Int64
+	sent      atomic.Int64
+}
+
+// newClient creates the queue for a listener
+func newClient(id uint64, l Listener, info ConnInfo, profile Profile, feed Feed) *client {
+	c := &client{
+		Listener: l,
+		id:       id,
+		info:     info,
+		profile:  profile,
+		feed:     feed,
+		queue:    make(chan []byte, profile.QueueFrames),
+		meta:     make(chan Metadata, 1),
+		formats:  make(chan SourceFormat, 1),
+		levels:   make(chan Levels, 1),
+		buffer:   make(chan time.Duration, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if _, ok := l.(BufferListener); ok {
+		c.tuner = newBufferTuner(profile.BufferTarget, time.Now())
+		c.updateBuffer(c.tuner.current())
+	}
+	return c
+}
+
+// enqueue queues a frame, applying the profile's drop policy when full.
+// It never blocks, so one slow listener can't hold up a broadcast.
+func (c *client) enqueue(data []byte) {
+	select {
+	case c.queue <- data:
+		return
+	default:
+	}
+
+	c.dropped.Add(1)
+	switch c.profile.Drop {
+	case DropOldest:
+		select {
+		case <-c.queue:
+		default:
+		}
+		select {
+		case c.queue <- data:
+		default:
+		}
+	case DropListener:
+		c.disconnect()
+	}
+}
+
+// feedSender returns how the client's feed queues frames, framing them
+// with the feed's own sequence numbers for framed listeners
+func (c *client) feedSender() func([]byte) {
+	if c.profile.Format != FormatFramed {
+		return c.enqueue
+	}
+
+	var seq uint32
+	flags := frame.FlagDiscontinuity
+	return func(data []byte) {
+		seq++
+		c.enqueue(frame.Encode(frame.Header{Seq: seq, Captured: time.Now(), Flags: flags}, data))
+		flags = 0
+	}
+}
+
+// updateMetadata queues a metadata update, replacing one not yet delivered.
+// Listeners that cannot show metadata ignore it.
+func (c *client) updateMetadata(md Metadata) {
+	if _, ok := c.Listener.(MetadataListener); !ok {
+		return
+	}
+
+	select {
+	case <-c.meta:
+	default:
+	}
+	select {
+	case c.meta <- md:
+	default:
+	}
+}
+
+// updateFormat queues a format update, replacing one not yet delivered.
+// Listeners that are not told the format ignore it.
+func (c *client) updateFormat(format SourceFormat) {
+	if _, ok := c.Listener.(FormatListener); !ok {
+		return
+	}
+
+	format = c.profile.listenerFormat(format)
+	select {
+	case <-c.formats:
+	default:
+	}
+	select {
+	case c.formats <- format:
+	default:
+	}
+}
+
+// disconnect closes the listener; its owner then removes it from the Manager
+func (c *client) disconnect() {
+	c.closeOnce.Do(func() { c.Listener.Close() })
+}
+
+// run writes queued frames to the listener until stopped or a write fails
+func (c *client) run() error {
+	defer close(c.done)
+
+	for {
+		select {
+		case <-c.stop:
+			return nil
+		case data := <-c.queue:
+			if err := c.Send(data); err != nil {
+				c.disconnect()
+				return err
+			}
+			c.sent.Add(int64(len(data)))
+		case format := <-c.formats:
+			if err := c.Listener.(FormatListener).SendFormat(format); err != nil {
+				c.disconnect()
+				return err
+			}
+		case md := <-c.meta:
+			if err := c.Listener.(MetadataListener).SendMetadata(md); err != nil {
+				c.disconnect()
+				return err
+			}
+		case levels := <-c.levels:
+			if err := c.Listener.(LevelListener).SendLevels(levels); err != nil {
+				c.disconnect()
+				return err
+			}
+		case target := <-c.buffer:
+			if err := c.Listener.(BufferListener).SendBufferTarget(target); err != nil {
+				c.disconnect()
+				return err
+			}
+		}
+	}
+}
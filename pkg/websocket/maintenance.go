@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMaintenance is returned when a source tries to attach during maintenance
+var ErrMaintenance = errors.New("server is in maintenance")
+
+// MaintenanceState describes an active maintenance period
+type MaintenanceState struct {
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+}
+
+// EnterMaintenance disconnects the current source and rejects new ones with
+// message until ExitMaintenance. Listeners stay connected; feed them with
+// BroadcastAnnouncement.
+func (m *Manager) EnterMaintenance(message string) {
+	m.sourceMu.Lock()
+	m.maintenance = &MaintenanceState{Message: message, Since: time.Now()}
+	src := m.source
+	m.sourceMu.Unlock()
+
+	if src != nil {
+		src.Close()
+	}
+	m.logger.Infow("Entered maintenance", "message", message)
+	m.publish("maintenance", MaintenanceEvent{Active: true, Message: message})
+}
+
+// ExitMaintenance accepts sources again
+func (m *Manager) ExitMaintenance() {
+	m.sourceMu.Lock()
+	defer m.sourceMu.Unlock()
+
+	if m.maintenance != nil {
+		m.maintenance = nil
+		m.logger.Info("Exited maintenance")
+		m.publish("maintenance", MaintenanceEvent{})
+	}
+}
+
+// Maintenance returns the active maintenance period, if any
+func (m *Manager) Maintenance() (MaintenanceState, bool) {
+	m.sourceMu.RLock()
+	defer m.sourceMu.RUnlock()
+
+	if m.maintenance == nil {
+		return MaintenanceState{}, false
+	}
+	return *m.maintenance, true
+}
+
+// BroadcastAnnouncement queues audio for all listeners without screening it.
+// Announcements loop, so they would otherwise look like a feedback loop.
+func (m *Manager) BroadcastAnnouncement(data []byte) {
+	m.broadcast(data, m.clock.Now(), 0)
+}
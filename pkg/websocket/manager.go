@@ -1,66 +1,209 @@
 package websocket
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/clock"
+	"github.com/maks112v/minicast/pkg/frame"
 	"go.uber.org/zap"
 )
 
+// ErrSourceConnected is returned when a source tries to attach while another is active
+var ErrSourceConnected = errors.New("another source is already connected")
+
+// ErrNoListener is returned when kicking a listener that is not connected
+var ErrNoListener = errors.New("no such listener")
+
+// ErrNotKickable is returned when kicking one of the server's own outputs,
+// such as the DVR, which are not listeners anyone connected
+var ErrNotKickable = errors.New("only remote listeners can be kicked")
+
+// ErrSourceUnauthorized is returned when a UDP source's token is missing or
+// not allowed to broadcast
+var ErrSourceUnauthorized = errors.New("a valid source token is required")
+
 // Manager handles WebSocket connections and broadcasting
 type Manager struct {
 	// WebSocket upgrader
 	upgrader websocket.Upgrader
 
-	// Manage connected clients
-	clientsMu sync.RWMutex
-	clients   map[*websocket.Conn]bool
+	// Manage connected clients. Joins and leaves copy the slice under
+	// clientsMu and publish it atomically, so broadcasts iterate an
+	// immutable snapshot without taking any lock.
+	clientsMu sync.Mutex
+	clients   atomic.Pointer[[]*client]
+	nextID    atomic.Uint64
 
 	// Manage audio source
-	sourceMu   sync.RWMutex
-	sourceConn *websocket.Conn
+	sourceMu     sync.RWMutex
+	source       io.Closer
+	sourceInfo   ConnInfo
+	sourceFormat SourceFormat
+	outputFormat SourceFormat
+	passthrough  bool
+	maintenance  *MaintenanceState
+	tracker      *frame.Tracker
+	jitterTarget time.Duration
+	jitter       *audio.JitterBuffer[sourceFrame]
+	stages       []audio.StageConfig
+	stagesGen    atomic.Uint64
+	resample     string
+	remix        bool
+	// sourceGain is the gain the source reports applying, nil if it does
+	// not take gain changes; sourceWriteMu serializes writes to it
+	sourceGain    *float64
+	sourceWriteMu sync.Mutex
+
+	// Broadcast framing: the last sequence number sent, and whether the
+	// next frame follows a source change
+	seq           atomic.Uint32
+	discontinuity atomic.Bool
+
+	// Source frames dropped for arriving twice or out of order, across
+	// all sources
+	duplicateFrames atomic.Uint64
+	lateFrames      atomic.Uint64
+
+	// Feedback loop protection for the current source
+	guardMu    sync.Mutex
+	guard      *audio.LoopGuard
+	loopAction audio.LoopAction
+
+	// Hold keeps the source connected but off air; sourceHeld is whether
+	// the last source frame was held back
+	hold       atomic.Pointer[HoldState]
+	sourceHeld atomic.Bool
+
+	// Now-playing metadata pushed to listeners
+	metadataMu sync.RWMutex
+	metadata   Metadata
+
+	// Events about the source and broadcast, and silence tracking for them
+	events  Publisher
+	silence silenceDetector
+
+	// Level meters for listeners that show them
+	levels levelMeter
+
+	// clock stamps the broadcast's frames; nil uses the system clock
+	clock *clock.Clock
 
+	// fanout, when set, is handed every source frame before hold
+	fanout func(data []byte, captured time.Time, flags frame.Flags)
+	// sourceGate, when set, may refuse sources the slot is free for
+	sourceGate func(info ConnInfo) error
+
+	// sessionLog, when set, is handed every finished session;
+	// sourceBytes counts what the current source has sent
+	sessionLog  func(Session)
+	sourceBytes atomic.Int64
+
+	// locate, when set, finds where remote listeners connect from
+	locate func(remoteAddr string) (country, city string)
+
+	// sourceAuth, when set, checks the tokens of UDP sources; WebSocket
+	// sources are checked before they are upgraded
+	sourceAuth func(token string) bool
+
+	audio  *audio.Processor
 	logger *zap.SugaredLogger
 }
 
-// NewManager creates a new WebSocket manager
-func NewManager(logger *zap.SugaredLogger) *Manager {
-	return &Manager{
+// NewManager creates a new WebSocket manager broadcasting audio in the
+// format described by processor
+func NewManager(processor *audio.Processor, logger *zap.SugaredLogger) *Manager {
+	m := &Manager{
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Allow all origins for development
 			},
 		},
-		clients: make(map[*websocket.Conn]bool),
-		logger:  logger,
+		audio:      processor,
+		loopAction: audio.LoopWarn,
+		silence:    silenceDetector{config: DefaultSilence},
+		logger:     logger,
 	}
+	m.outputFormat = m.BroadcastFormat()
+	return m
 }
 
-// HandleSource manages a source connection
-func (m *Manager) HandleSource(conn *websocket.Conn) {
-	m.logger.Info("Audio source connected")
+// SetClock sets the clock that stamps the broadcast's frames, in place of
+// the system clock. It must be called before sources connect.
+func (m *Manager) SetClock(c *clock.Clock) {
+	m.clock = c
+}
 
-	m.sourceMu.Lock()
-	if m.sourceConn != nil {
-		m.sourceMu.Unlock()
-		conn.WriteMessage(websocket.TextMessage, []byte("Another source is already connected"))
+// SetFanout sets a function handed every source frame the Manager
+// broadcasts, processed but not yet held back, to share it with other
+// server instances. It must be called before sources connect.
+func (m *Manager) SetFanout(fn func(data []byte, captured time.Time, flags frame.Flags)) {
+	m.fanout = fn
+}
+
+// SetSourceGate sets a check sources must pass to claim the source slot,
+// besides the slot being free, such as no other server instance having a
+// source. It must be called before sources connect.
+func (m *Manager) SetSourceGate(gate func(info ConnInfo) error) {
+	m.sourceGate = gate
+}
+
+// SetLocator sets a function finding the country and city a remote
+// listener's address is in. It must be called before clients connect.
+func (m *Manager) SetLocator(locate func(remoteAddr string) (country, city string)) {
+	m.locate = locate
+}
+
+// SetSourceAuth sets the check UDP sources' tokens must pass. It must be
+// called before sources connect.
+func (m *Manager) SetSourceAuth(allowed func(token string) bool) {
+	m.sourceAuth = allowed
+}
+
+// SetLoopAction sets what happens when a source is detected capturing the
+// stream's own output. It applies from the next source that connects.
+func (m *Manager) SetLoopAction(action audio.LoopAction) {
+	m.guardMu.Lock()
+	defer m.guardMu.Unlock()
+
+	m.loopAction = action
+}
+
+// HandleSource manages a source connection that announced format (usually
+// the broadcast format, until its handshake says otherwise). Binary messages
+// are audio in that format; text messages are handshakes and metadata.
+func (m *Manager) HandleSource(conn *websocket.Conn, info ConnInfo, format SourceFormat) {
+	m.logger.Infow("Audio source connected", info.logFields()...)
+
+	if err := m.AttachSource(conn, info, format); err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte(m.rejectMessage(err)))
 		conn.Close()
 		return
 	}
-	m.sourceConn = conn
-	m.sourceMu.Unlock()
 
 	defer func() {
-		m.sourceMu.Lock()
-		if m.sourceConn == conn {
-			m.sourceConn = nil
-		}
-		m.sourceMu.Unlock()
+		m.DetachSource(conn)
 		conn.Close()
 		m.logger.Info("Audio source disconnected")
 	}()
 
+	pipeline, err := m.NewPipeline(format)
+	if err != nil {
+		m.logger.Errorf("Failed to create source pipeline: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := m.newIngest(ctx, pipeline, format)
+
 	for {
 		messageType, data, err := conn.ReadMessage()
 		if err != nil {
@@ -70,53 +213,465 @@ func (m *Manager) HandleSource(conn *websocket.Conn) {
 			break
 		}
 
-		if messageType == websocket.BinaryMessage {
-			m.Broadcast(data)
+		if messageType == websocket.TextMessage {
+			if md, ok := parseMetadataMessage(data); ok {
+				m.SetMetadata(md)
+			} else if gain, ok := parseGainMessage(data); ok {
+				m.reportSourceGain(conn, gain)
+			} else if format, ok := parseFormatMessage(data); ok {
+				if in.pipeline, err = m.handshake(conn, format); err != nil {
+					m.logger.Warnf("Rejected source format: %v", err)
+					m.writeSource(conn, []byte("Unsupported format: "+err.Error()))
+					break
+				}
+				in.framed = format.Framed
+			}
+			continue
 		}
+		in.push(data, time.Now())
 	}
 }
 
-// HandleListener manages a listener connection
-func (m *Manager) HandleListener(conn *websocket.Conn) {
-	m.logger.Info("Listener connected")
+// ingest carries a source's audio messages through frame tracking, its
+// pipeline and the jitter buffer, whatever transport they arrive over
+type ingest struct {
+	m        *Manager
+	pipeline *SourcePipeline
+	framed   bool
+	tracker  *frame.Tracker
+	emit     func(sourceFrame)
+}
 
-	m.clientsMu.Lock()
-	m.clients[conn] = true
-	m.clientsMu.Unlock()
+// newIngest returns the ingest for the current source, whose jitter
+// buffer runs until ctx is done
+func (m *Manager) newIngest(ctx context.Context, pipeline *SourcePipeline, format SourceFormat) *ingest {
+	return &ingest{
+		m:        m,
+		pipeline: pipeline,
+		framed:   format.Framed,
+		tracker:  m.sourceTracker(),
+		emit:     m.startJitter(ctx),
+	}
+}
 
-	defer func() {
-		m.clientsMu.Lock()
-		delete(m.clients, conn)
-		m.clientsMu.Unlock()
-		conn.Close()
-		m.logger.Info("Listener disconnected")
-	}()
+// push handles one binary message received at now
+func (in *ingest) push(data []byte, now time.Time) {
+	m := in.m
+	m.sourceBytes.Add(int64(len(data)))
+	captured, flags := m.clock.At(now), frame.Flags(0)
+	if in.framed {
+		h, payload, err := frame.Decode(data)
+		if err != nil {
+			m.logger.Debugf("Dropped source message: %v", err)
+			return
+		}
+		switch in.tracker.Track(h, captured) {
+		case frame.VerdictLate:
+			m.lateFrames.Add(1)
+			m.logger.Debugw("Dropped late source frame", "seq", h.Seq)
+			return
+		case frame.VerdictDuplicate:
+			m.duplicateFrames.Add(1)
+			m.logger.Debugw("Dropped duplicate source frame", "seq", h.Seq)
+			return
+		case frame.VerdictGap:
+			flags |= frame.FlagDiscontinuity
+		}
+		data, captured, flags = payload, h.Captured, flags|h.Flags
+	}
 
-	// Keep the connection alive and handle any incoming messages
+	data, err := in.pipeline.Process(data)
+	if err != nil {
+		m.logger.Debugf("Failed to decode source packet: %v", err)
+		return
+	}
+	if data == nil {
+		return
+	}
+	if speech, ok := in.pipeline.Speech(); ok && speech {
+		flags |= frame.FlagSpeech
+	}
+	in.emit(sourceFrame{data: data, captured: captured, flags: flags})
+}
+
+// rejectMessage is sent to a WebSocket source that could not attach
+func (m *Manager) rejectMessage(err error) string {
+	if errors.Is(err, ErrMaintenance) {
+		if state, ok := m.Maintenance(); ok && state.Message != "" {
+			return "Server is in maintenance: " + state.Message
+		}
+		return "Server is in maintenance"
+	}
+	if errors.Is(err, ErrSourceConnected) {
+		return "Another source is already connected"
+	}
+	if errors.Is(err, ErrSourceUnauthorized) {
+		return "A valid source token is required"
+	}
+	return "Unsupported format: " + err.Error()
+}
+
+// handshake applies a format announced by a WebSocket source and returns
+// the pipeline for it
+func (m *Manager) handshake(conn *websocket.Conn, format SourceFormat) (*SourcePipeline, error) {
+	if err := m.SetSourceFormat(conn, format); err != nil {
+		return nil, err
+	}
+	m.logger.Infow("Source format", "codec", format.Codec, "sample_rate", format.SampleRate,
+		"channels", format.Channels, "bit_depth", format.BitDepth)
+	return m.NewPipeline(format)
+}
+
+// AttachSource claims the source slot for src, so that only one source
+// broadcasts at a time, with audio in the given format. Non-WebSocket
+// sources such as relays use this directly and feed audio through Broadcast.
+func (m *Manager) AttachSource(src io.Closer, info ConnInfo, format SourceFormat) error {
+	if m.sourceGate != nil {
+		if err := m.sourceGate(info); err != nil {
+			return err
+		}
+	}
+
+	m.sourceMu.Lock()
+	if m.maintenance != nil {
+		m.sourceMu.Unlock()
+		return ErrMaintenance
+	}
+	if m.source != nil {
+		m.sourceMu.Unlock()
+		return ErrSourceConnected
+	}
+
+	changed, err := m.applyFormat(format)
+	if err == nil {
+		m.source = src
+		m.sourceInfo = info
+		m.sourceGain = nil
+		m.tracker = &frame.Tracker{}
+		m.discontinuity.Store(true)
+		m.sourceBytes.Store(0)
+	}
+	m.sourceMu.Unlock()
+
+	if changed {
+		m.notifyFormat()
+	}
+	if err == nil {
+		m.publish("source", SourceEvent{Connected: true, Transport: info.Transport, RemoteAddr: info.RemoteAddr})
+	}
+	return err
+}
+
+// DropSource disconnects the current source, whose owner then detaches
+// it, reporting whether there was one
+func (m *Manager) DropSource() bool {
+	m.sourceMu.RLock()
+	src := m.source
+	m.sourceMu.RUnlock()
+
+	if src == nil {
+		return false
+	}
+	m.logger.Info("Dropping the source")
+	src.Close()
+	return true
+}
+
+// DetachSource releases the source slot if src still holds it. Listeners
+// fall back to the broadcast format, which announcements are played in.
+func (m *Manager) DetachSource(src io.Closer) {
+	m.sourceMu.Lock()
+	changed, detached := false, m.source == src
+	info := m.sourceInfo
+	if detached {
+		m.source = nil
+		changed = m.outputFormat != m.BroadcastFormat()
+		m.outputFormat = m.BroadcastFormat()
+	}
+	m.sourceMu.Unlock()
+
+	if changed {
+		m.notifyFormat()
+	}
+	if detached {
+		m.resetSilence(time.Now())
+		m.publish("source", SourceEvent{Transport: info.Transport, RemoteAddr: info.RemoteAddr})
+		m.logSession(Session{Kind: "source", ConnInfo: info, EndedAt: time.Now(), Bytes: m.sourceBytes.Load()})
+	}
+}
+
+// HandleListener manages a listener connection, fed from feed instead of the
+// live broadcast when it is not nil
+func (m *Manager) HandleListener(conn *websocket.Conn, info ConnInfo, profile Profile, feed Feed) {
+	listener := &wsListener{conn: conn, format: profile.Format, audio: m.audio}
+	m.AddListener(listener, info, profile, feed)
+	defer m.RemoveListener(listener)
+
+	// Keep the connection alive and handle the player's reports
 	for {
-		_, _, err := conn.ReadMessage()
+		messageType, data, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				m.logger.Debugf("Listener WebSocket error: %v", err)
 			}
 			break
 		}
+		if messageType == websocket.TextMessage {
+			m.handleListenerMessage(listener, data)
+		}
 	}
 }
 
-// Broadcast sends data to all connected listeners
+// AddListener registers a listener to receive broadcasts, buffered and
+// dropped according to its profile. A listener with a feed receives the
+// feed's audio instead of the live broadcast.
+func (m *Manager) AddListener(l Listener, info ConnInfo, profile Profile, feed Feed) {
+	if m.locate != nil && info.remote() {
+		info.Country, info.City = m.locate(info.RemoteAddr)
+	}
+	c := newClient(m.nextID.Add(1), l, info, profile, feed)
+	go func() {
+		if err := c.run(); err != nil {
+			m.logger.Debugf("Error sending to listener: %v", err)
+		}
+	}()
+	if feed != nil {
+		go func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-c.stop
+				cancel()
+			}()
+			send := c.feedSender()
+			if profile.Mono {
+				queue := send
+				send = func(data []byte) { queue(m.downmix(data)) }
+			}
+			if err := feed.Run(ctx, send); err != nil {
+				m.logger.Errorf("Listener feed failed: %v", err)
+				c.disconnect()
+			}
+		}()
+	}
+
+	m.clientsMu.Lock()
+	c.updateFormat(m.OutputFormat())
+	if md := m.Metadata(); md != (Metadata{}) {
+		c.updateMetadata(md)
+	}
+	clients := append(m.snapshot(), c)
+	m.clients.Store(&clients)
+	count := len(clients)
+	m.clientsMu.Unlock()
+
+	fields := append([]interface{}{"id", c.id, "listeners", count, "profile", profile.Name}, info.logFields()...)
+	m.logger.Infow("Listener connected", fields...)
+}
+
+// RemoveListener unregisters and closes a listener. Once it returns the
+// listener receives no further broadcasts.
+func (m *Manager) RemoveListener(l Listener) {
+	m.clientsMu.Lock()
+	var c *client
+	old := m.snapshot()
+	clients := make([]*client, 0, len(old))
+	for _, existing := range old {
+		if existing.Listener == l {
+			c = existing
+		} else {
+			clients = append(clients, existing)
+		}
+	}
+	m.clients.Store(&clients)
+	count := len(clients)
+	m.clientsMu.Unlock()
+
+	if c == nil {
+		return
+	}
+
+	// Closing first unblocks a write stuck on a dead connection
+	close(c.stop)
+	c.disconnect()
+	<-c.done
+	m.logger.Infow("Listener disconnected", "id", c.id, "listeners", count, "dropped", c.dropped.Load())
+	if c.info.remote() {
+		m.logSession(Session{Kind: "listener", ID: c.id, Profile: c.profile.Name, ConnInfo: c.info,
+			EndedAt: time.Now(), Bytes: c.sent.Load(), Dropped: c.dropped.Load()})
+	}
+}
+
+// Kick disconnects the remote listener with the given ID
+func (m *Manager) Kick(id uint64) error {
+	for _, c := range m.snapshot() {
+		if c.id != id {
+			continue
+		}
+		if !c.info.remote() {
+			return ErrNotKickable
+		}
+		m.logger.Infow("Kicking listener", append([]interface{}{"id", id}, c.info.logFields()...)...)
+		// Its owner sees the listener closed and removes it, once nothing
+		// is writing to the connection any more
+		c.disconnect()
+		return nil
+	}
+	return ErrNoListener
+}
+
+// ListenerCount returns the number of connected listeners
+func (m *Manager) ListenerCount() int {
+	return len(m.snapshot())
+}
+
+// snapshot returns the current listeners. The slice is never modified, so
+// it can be used without holding clientsMu.
+func (m *Manager) snapshot() []*client {
+	clients := m.clients.Load()
+	if clients == nil {
+		return nil
+	}
+	// Cap the length so appending always copies
+	return (*clients)[:len(*clients):len(*clients)]
+}
+
+// Broadcast queues data captured now for all connected listeners, after
+// screening it for feedback loops
 func (m *Manager) Broadcast(data []byte) {
-	m.clientsMu.RLock()
-	defer m.clientsMu.RUnlock()
+	m.BroadcastFrame(data, m.clock.Now(), 0)
+}
 
-	for client := range m.clients {
-		err := client.WriteMessage(websocket.BinaryMessage, data)
-		if err != nil {
-			m.logger.Debugf("Error sending to listener: %v", err)
-			client.Close()
-			delete(m.clients, client)
+// BroadcastFrame is Broadcast for audio with a known capture time and flags,
+// which are passed on to listeners that receive framed audio
+func (m *Manager) BroadcastFrame(data []byte, captured time.Time, flags frame.Flags) {
+	data = m.screen(data)
+	if data == nil {
+		return
+	}
+	if m.fanout != nil {
+		m.fanout(data, captured, flags)
+	}
+	if data = m.holdFrame(data); data == nil {
+		return
+	}
+	now := time.Now()
+	if !m.observe(data, now) {
+		return
+	}
+	m.meter(data, now)
+	m.broadcast(data, captured, flags)
+}
+
+// broadcast queues data for all connected listeners, stamping it with the
+// next broadcast sequence number
+func (m *Manager) broadcast(data []byte, captured time.Time, flags frame.Flags) {
+	if m.discontinuity.Swap(false) {
+		flags |= frame.FlagDiscontinuity
+	}
+	h := frame.Header{Seq: m.seq.Add(1), Captured: captured, Flags: flags}
+
+	// Listeners wanting the same variant of the frame share one copy
+	var mono, framed, framedMono []byte
+	for _, c := range m.snapshot() {
+		if c.feed != nil || c.profile.Tap != TapMix {
+			continue
+		}
+
+		payload := data
+		if c.profile.Mono {
+			if mono == nil {
+				mono = m.downmix(data)
+			}
+			payload = mono
+		}
+
+		switch {
+		case c.profile.Format == FormatFramed && c.profile.Mono:
+			if framedMono == nil {
+				framedMono = frame.Encode(h, payload)
+			}
+			c.enqueue(framedMono)
+		case c.profile.Format == FormatFramed:
+			if framed == nil {
+				framed = frame.Encode(h, payload)
+			}
+			c.enqueue(framed)
+		default:
+			c.enqueue(payload)
+		}
+	}
+}
+
+// tapSource queues the source's converted but unprocessed audio for
+// listeners tapping it
+func (m *Manager) tapSource(pcm []int16) {
+	if m.hold.Load() != nil {
+		return
+	}
+	var data, mono []byte
+	for _, c := range m.snapshot() {
+		if c.feed != nil || c.profile.Tap != TapSource {
+			continue
+		}
+		if data == nil {
+			data = audio.PCMToBytes(pcm)
+		}
+		payload := data
+		if c.profile.Mono {
+			if mono == nil {
+				mono = m.downmix(data)
+			}
+			payload = mono
 		}
+		c.enqueue(payload)
+	}
+}
+
+// downmix converts a broadcast frame to mono
+func (m *Manager) downmix(data []byte) []byte {
+	channels := m.OutputFormat().Channels
+	if channels == 1 {
+		return data
+	}
+	return audio.PCMToBytes(audio.DownmixMono(audio.BytesToPCM(data), channels))
+}
+
+// ListenerFormat returns the format a listener with profile receives
+func (m *Manager) ListenerFormat(profile Profile) SourceFormat {
+	return profile.listenerFormat(m.OutputFormat())
+}
+
+// DroppedFrames returns how many source frames were dropped as duplicates
+// and for arriving late since the server started
+func (m *Manager) DroppedFrames() (duplicate, late uint64) {
+	return m.duplicateFrames.Load(), m.lateFrames.Load()
+}
+
+// sourceTracker returns the frame tracker of the current source
+func (m *Manager) sourceTracker() *frame.Tracker {
+	m.sourceMu.RLock()
+	defer m.sourceMu.RUnlock()
+
+	return m.tracker
+}
+
+// screen runs a source frame through the loop guard, returning nil for
+// frames that should be dropped
+func (m *Manager) screen(data []byte) []byte {
+	m.guardMu.Lock()
+	defer m.guardMu.Unlock()
+
+	if m.guard == nil {
+		return data
+	}
+
+	out, verdict := m.guard.Inspect(data)
+	if verdict == audio.VerdictLoop {
+		m.logger.Warnw("Source appears to be capturing the stream's own output (feedback loop)",
+			"delay", m.guard.LastDelay, "similarity", m.guard.LastSimilarity,
+			"muted", m.loopAction == audio.LoopMute)
 	}
+	return out
 }
 
 // GetUpgrader returns the WebSocket upgrader
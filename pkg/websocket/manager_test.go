@@ -0,0 +1,90 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"go.uber.org/zap"
+)
+
+// stalledListener blocks in Send, as writing to a client that stopped
+// reading does, until it is closed
+type stalledListener struct {
+	sending   chan struct{}
+	closed    chan struct{}
+	sendOnce  sync.Once
+	closeOnce sync.Once
+}
+
+func newStalledListener() *stalledListener {
+	return &stalledListener{sending: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (l *stalledListener) Send([]byte) error {
+	l.sendOnce.Do(func() { close(l.sending) })
+	<-l.closed
+	return errors.New("closed")
+}
+
+func (l *stalledListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func TestKickLeavesRemovalToOwner(t *testing.T) {
+	m := NewManager(audio.NewProcessor(48000, 2, 16), zap.NewNop().Sugar())
+	profile, _ := LookupProfile("balanced")
+	l := newStalledListener()
+	m.AddListener(l, ConnInfo{Transport: "http", RemoteAddr: "192.0.2.1:5000"}, profile, nil)
+
+	m.Broadcast(make([]byte, 4096))
+	select {
+	case <-l.sending:
+	case <-time.After(time.Second):
+		t.Fatal("listener never sent")
+	}
+
+	id := m.Stats().Listeners[0].ID
+	kicked := make(chan error, 1)
+	go func() { kicked <- m.Kick(id) }()
+	select {
+	case err := <-kicked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("kick waited on a stalled listener")
+	}
+
+	select {
+	case <-l.closed:
+	default:
+		t.Fatal("kick did not close the listener")
+	}
+	// The owner, still holding the connection, removes the listener
+	if n := len(m.Stats().Listeners); n != 1 {
+		t.Fatalf("%d listeners after the kick, want the owner to remove it", n)
+	}
+	m.RemoveListener(l)
+	if n := len(m.Stats().Listeners); n != 0 {
+		t.Fatalf("%d listeners after removal", n)
+	}
+}
+
+func TestKickOwnOutput(t *testing.T) {
+	m := NewManager(audio.NewProcessor(48000, 2, 16), zap.NewNop().Sugar())
+	profile, _ := LookupProfile("low-latency")
+	l := newStalledListener()
+	m.AddListener(l, ConnInfo{Transport: "rtp"}, profile, nil)
+	defer m.RemoveListener(l)
+
+	if err := m.Kick(m.Stats().Listeners[0].ID); !errors.Is(err, ErrNotKickable) {
+		t.Fatalf("got %v, want ErrNotKickable", err)
+	}
+	if err := m.Kick(12345); !errors.Is(err, ErrNoListener) {
+		t.Fatalf("got %v, want ErrNoListener", err)
+	}
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Metadata describes what is currently playing
+type Metadata struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+}
+
+// StreamTitle formats the metadata as a single line, as shown by radio clients
+func (md Metadata) StreamTitle() string {
+	if md.Artist == "" {
+		return md.Title
+	}
+	if md.Title == "" {
+		return md.Artist
+	}
+	return md.Artist + " - " + md.Title
+}
+
+// MetadataListener is implemented by listeners that can show now-playing
+// updates. Updates are delivered on the same goroutine as Send.
+type MetadataListener interface {
+	SendMetadata(md Metadata) error
+}
+
+// metadataMessage is the text frame exchanged with WebSocket clients
+type metadataMessage struct {
+	Type string `json:"type"`
+	Metadata
+}
+
+// parseMetadataMessage decodes a metadata text frame sent by a source
+func parseMetadataMessage(data []byte) (Metadata, bool) {
+	var msg metadataMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "metadata" {
+		return Metadata{}, false
+	}
+	msg.Title = strings.TrimSpace(msg.Title)
+	msg.Artist = strings.TrimSpace(msg.Artist)
+	return msg.Metadata, true
+}
+
+// SetMetadata updates the now-playing metadata and pushes it to listeners
+func (m *Manager) SetMetadata(md Metadata) {
+	// Joins take the clients lock too, so none can miss the update
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+
+	// Holding the lock while pushing keeps concurrent updates in order
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+
+	m.metadata = md
+	for _, c := range m.snapshot() {
+		c.updateMetadata(md)
+	}
+	m.logger.Infow("Now playing", "title", md.Title, "artist", md.Artist)
+	m.publish("metadata", md)
+}
+
+// Metadata returns the current now-playing metadata
+func (m *Manager) Metadata() Metadata {
+	m.metadataMu.RLock()
+	defer m.metadataMu.RUnlock()
+
+	return m.metadata
+}
@@ -0,0 +1,130 @@
+package websocket
+
+import (
+	"errors"
+
+	"github.com/maks112v/minicast/pkg/audio"
+)
+
+// SetPipeline sets the DSP stages every source's audio runs through before
+// broadcast. A connected source switches to them with its next frame.
+func (m *Manager) SetPipeline(configs []audio.StageConfig) error {
+	m.sourceMu.Lock()
+	defer m.sourceMu.Unlock()
+
+	if m.passthrough && len(configs) > 0 {
+		return errors.New("passthrough mode cannot process audio")
+	}
+	// Catch bad config up front rather than when a source connects
+	format := m.BroadcastFormat()
+	if _, err := audio.NewStages(format.SampleRate, format.Channels, configs); err != nil {
+		return err
+	}
+
+	m.stages = configs
+	m.stagesGen.Add(1)
+	return nil
+}
+
+// Pipeline returns the configured DSP stages
+func (m *Manager) Pipeline() []audio.StageConfig {
+	m.sourceMu.RLock()
+	defer m.sourceMu.RUnlock()
+
+	return m.stages
+}
+
+// SetResampling sets the quality ("linear" or "sinc") at which sources at
+// another rate are converted to the broadcast rate, or "" to broadcast at
+// the source's own rate. It applies from the next source that connects, and
+// never in passthrough mode.
+func (m *Manager) SetResampling(quality string) error {
+	if quality != "" {
+		if _, err := audio.NewResampler(quality, 1, 1, 1); err != nil {
+			return err
+		}
+	}
+
+	m.sourceMu.Lock()
+	defer m.sourceMu.Unlock()
+
+	m.resample = quality
+	return nil
+}
+
+// SetChannelMixing sets whether sources with another channel count are
+// mixed to the broadcast's, rather than broadcast as they are. It applies
+// from the next source that connects, and never in passthrough mode.
+func (m *Manager) SetChannelMixing(remix bool) {
+	m.sourceMu.Lock()
+	defer m.sourceMu.Unlock()
+
+	m.remix = remix
+}
+
+// SourcePipeline is the pipeline for one source. It is rebuilt when the
+// configured stages change, so they can be adjusted while on air.
+type SourcePipeline struct {
+	*audio.Pipeline
+	m      *Manager
+	format SourceFormat
+	gen    uint64
+}
+
+// Process runs one packet through the pipeline, first switching to the
+// configured stages if they changed. See audio.Pipeline.Process.
+func (p *SourcePipeline) Process(packet []byte) ([]byte, error) {
+	if gen := p.m.stagesGen.Load(); gen != p.gen {
+		rebuilt, err := p.m.NewPipeline(p.format)
+		if err != nil {
+			// Keep the old stages rather than retry on every frame
+			p.m.logger.Errorf("Failed to rebuild source pipeline: %v", err)
+			p.gen = gen
+		} else {
+			*p = *rebuilt
+		}
+	}
+	return p.Pipeline.Process(packet)
+}
+
+// NewPipeline creates the pipeline for a source sending format, which
+// must already be applied: it decodes, mixes and resamples to the output
+// format and runs the configured stages. Sources call it again after a format
+// change, since stages keep state for one format.
+func (m *Manager) NewPipeline(format SourceFormat) (*SourcePipeline, error) {
+	dec, err := m.newSourceDecoder(format)
+	if err != nil {
+		return nil, err
+	}
+
+	m.sourceMu.RLock()
+	output, configs, quality := m.outputFormat, m.stages, m.resample
+	gen := m.stagesGen.Load()
+	m.sourceMu.RUnlock()
+	p := &SourcePipeline{m: m, format: format, gen: gen}
+
+	stages, err := audio.NewStages(output.SampleRate, output.Channels, configs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compressed sources are decoded straight to the output format
+	if format.Codec == CodecOpus {
+		p.Pipeline = &audio.Pipeline{Decoder: dec, Stages: stages, Tap: m.tapSource}
+		return p, nil
+	}
+
+	var convert []audio.Stage
+	if format.Channels != output.Channels {
+		convert = append(convert, audio.NewMixer(format.Channels, output.Channels))
+	}
+	if format.SampleRate != output.SampleRate {
+		resampler, err := audio.NewResampler(quality, output.Channels, format.SampleRate, output.SampleRate)
+		if err != nil {
+			return nil, err
+		}
+		convert = append(convert, resampler)
+	}
+	p.Pipeline = &audio.Pipeline{Decoder: dec, Convert: convert, Stages: stages, Tap: m.tapSource}
+	return p, nil
+}
@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// minBufferTarget and maxBufferTarget bound how much audio a player is
+	// told to keep scheduled ahead
+	minBufferTarget = 40 * time.Millisecond
+	maxBufferTarget = 3 * time.Second
+	// cleanReports is how many reports in a row without underruns lower
+	// the target a step, seeking the lowest latency that plays cleanly
+	cleanReports = 6
+	// underrunMemory is how long a target that underran stays off limits
+	// when lowering it again
+	underrunMemory = 5 * time.Minute
+)
+
+// BufferListener is implemented by listeners whose player keeps a buffer
+// the server tunes. Targets are delivered on the same goroutine as Send.
+type BufferListener interface {
+	SendBufferTarget(target time.Duration) error
+}
+
+// bufferMessage is the text frame telling a WebSocket player its target
+type bufferMessage struct {
+	Type     string `json:"type"`
+	TargetMs int64  `json:"target_ms"`
+}
+
+// PlaybackReport is what a player reports about its buffer, counting
+// since its previous report
+type PlaybackReport struct {
+	// Underruns counts the times playback ran out of audio
+	Underruns int `json:"underruns"`
+	// Overruns counts the times audio arrived so far ahead of the target
+	// that the player dropped it to stay near live
+	Overruns int `json:"overruns"`
+	// BufferMs is how much audio was scheduled ahead when reporting
+	BufferMs float64 `json:"buffer_ms"`
+}
+
+// playbackMessage is the text frame a WebSocket player reports with
+type playbackMessage struct {
+	Type string `json:"type"`
+	PlaybackReport
+}
+
+// PlaybackStats describes a listener's buffer tuning, and whether the last
+// adjustment helped: fewer underruns per minute at the current target than
+// at the previous one
+type PlaybackStats struct {
+	TargetMs    int64   `json:"target_ms"`
+	BufferMs    float64 `json:"buffer_ms"`
+	Underruns   int64   `json:"underruns"`
+	Overruns    int64   `json:"overruns"`
+	Adjustments int     `json:"adjustments"`
+
+	UnderrunsPerMinute         float64  `json:"underruns_per_minute"`
+	PreviousUnderrunsPerMinute *float64 `json:"previous_underruns_per_minute,omitempty"`
+}
+
+// bufferTuner adjusts a player's buffer target from its reports: up after
+// underruns, down after overruns or a long clean run
+type bufferTuner struct {
+	mu       sync.Mutex
+	target   time.Duration
+	reported bool
+	stats    PlaybackStats
+	clean    int
+
+	// floor is the largest target that underran within underrunMemory
+	floor      time.Duration
+	floorUntil time.Time
+
+	// since is when the target was last changed, and sinceUnderruns the
+	// underruns at it so far
+	since          time.Time
+	sinceUnderruns int64
+}
+
+// newBufferTuner starts tuning from target
+func newBufferTuner(target time.Duration, now time.Time) *bufferTuner {
+	return &bufferTuner{target: min(max(target, minBufferTarget), maxBufferTarget), since: now}
+}
+
+// report applies a player's report, returning the new target if it changed
+func (t *bufferTuner) report(r PlaybackReport, now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.reported = true
+	t.stats.Underruns += int64(max(r.Underruns, 0))
+	t.stats.Overruns += int64(max(r.Overruns, 0))
+	t.stats.BufferMs = r.BufferMs
+	t.sinceUnderruns += int64(max(r.Underruns, 0))
+
+	target := t.target
+	switch {
+	case r.Underruns > 0:
+		t.clean = 0
+		t.floor, t.floorUntil = max(t.target, t.floorFor(now)), now.Add(underrunMemory)
+		target = t.target * 3 / 2
+	case r.Overruns > 0:
+		t.clean = 0
+		target = t.target * 4 / 5
+	default:
+		if t.clean++; t.clean >= cleanReports {
+			t.clean = 0
+			target = t.target * 9 / 10
+		}
+	}
+	if target < t.target && target <= t.floorFor(now) {
+		// Lowering stops short of a target that recently underran
+		target = t.target
+	}
+	target = min(max(target, minBufferTarget), maxBufferTarget)
+	if target == t.target {
+		return target, false
+	}
+
+	rate := t.rate(now)
+	t.stats.PreviousUnderrunsPerMinute = &rate
+	t.stats.Adjustments++
+	t.target, t.since, t.sinceUnderruns = target, now, 0
+	return target, true
+}
+
+// floorFor returns the floor, or 0 once it is forgotten
+func (t *bufferTuner) floorFor(now time.Time) time.Duration {
+	if now.After(t.floorUntil) {
+		return 0
+	}
+	return t.floor
+}
+
+// rate returns the underruns per minute at the current target
+func (t *bufferTuner) rate(now time.Time) float64 {
+	minutes := now.Sub(t.since).Minutes()
+	if minutes <= 0 {
+		return 0
+	}
+	return math.Round(float64(t.sinceUnderruns)/minutes*100) / 100
+}
+
+// current returns the target
+func (t *bufferTuner) current() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.target
+}
+
+// snapshot returns the tuning stats, or nil before the first report
+func (t *bufferTuner) snapshot(now time.Time) *PlaybackStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.reported {
+		return nil
+	}
+	stats := t.stats
+	stats.TargetMs = t.target.Milliseconds()
+	stats.UnderrunsPerMinute = t.rate(now)
+	return &stats
+}
+
+// updateBuffer queues a buffer target, replacing one not yet delivered
+func (c *client) updateBuffer(target time.Duration) {
+	select {
+	case <-c.buffer:
+	default:
+	}
+	select {
+	case c.buffer <- target:
+	default:
+	}
+}
+
+// handleListenerMessage handles a text message from a WebSocket listener
+func (m *Manager) handleListenerMessage(l Listener, data []byte) {
+	var msg playbackMessage
+	if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "playback" {
+		m.logger.Debugf("Ignored listener message: %.64s", data)
+		return
+	}
+	m.ReportPlayback(l, msg.PlaybackReport)
+}
+
+// ReportPlayback applies a player's report on its buffer, sending the
+// listener a new buffer target if the report calls for one
+func (m *Manager) ReportPlayback(l Listener, r PlaybackReport) {
+	var c *client
+	for _, existing := range m.snapshot() {
+		if existing.Listener == l {
+			c = existing
+			break
+		}
+	}
+	if c == nil || c.tuner == nil {
+		return
+	}
+
+	previous := c.tuner.current()
+	target, changed := c.tuner.report(r, time.Now())
+	if !changed {
+		return
+	}
+	m.logger.Debugw("Adjusted listener buffer target", "id", c.id, "from", previous, "to", target,
+		"underruns", r.Underruns, "overruns", r.Overruns)
+	c.updateBuffer(target)
+}
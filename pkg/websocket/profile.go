@@ -0,0 +1,137 @@
+package websocket
+
+import (
+	"sort"
+	"time"
+)
+
+// DropPolicy decides what happens when a listener falls behind and its queue is full
+type DropPolicy int
+
+const (
+	// DropOldest discards queued audio to stay close to live
+	DropOldest DropPolicy = iota
+	// DropNewest discards incoming audio, keeping what is already queued
+	DropNewest
+	// DropListener disconnects the listener rather than leave silent gaps
+	DropListener
+)
+
+// Format is the framing of audio sent to a WebSocket listener
+type Format int
+
+const (
+	// FormatWAV wraps every frame in its own WAV header so it can be decoded standalone
+	FormatWAV Format = iota
+	// FormatPCM sends raw interleaved 16-bit little-endian PCM
+	FormatPCM
+	// FormatFramed sends PCM behind a frame header with a sequence number
+	// and capture timestamp, so players can detect gaps and measure latency
+	FormatFramed
+)
+
+// formats are the listener formats selectable with ?format=
+var formats = map[string]Format{
+	"wav":    FormatWAV,
+	"pcm":    FormatPCM,
+	"framed": FormatFramed,
+}
+
+// ParseFormat returns the named format
+func ParseFormat(name string) (Format, bool) {
+	f, ok := formats[name]
+	return f, ok
+}
+
+// Profile configures buffering, drop policy and format for one listener
+type Profile struct {
+	Name string
+
+	// QueueFrames is how many frames may wait for a slow listener
+	QueueFrames int
+
+	Drop   DropPolicy
+	Format Format
+
+	// Mono downmixes the broadcast for listeners short on bandwidth
+	Mono bool
+
+	// Levels pushes peak and RMS readings for level meters alongside the audio
+	Levels bool
+
+	// BufferTarget is how much audio the web player keeps scheduled ahead
+	// at first, before its reports tune it
+	BufferTarget time.Duration
+
+	// Tap is where in the signal chain the listener's audio comes from.
+	// Source taps receive unframed audio.
+	Tap Tap
+}
+
+// Tap is a point in the signal chain audio can be taken from
+type Tap int
+
+const (
+	// TapMix is the broadcast listeners hear: processed, normalized, and
+	// with announcements and fallback audio in place of the source
+	TapMix Tap = iota
+	// TapSource is the source's audio in the broadcast format, before the
+	// pipeline processes it. It has gaps while no source is connected.
+	TapSource
+)
+
+// taps are the taps selectable by name in configuration
+var taps = map[string]Tap{
+	"mix":    TapMix,
+	"source": TapSource,
+}
+
+// ParseTap returns the named tap, or TapMix for an empty name
+func ParseTap(name string) (Tap, bool) {
+	if name == "" {
+		return TapMix, true
+	}
+	t, ok := taps[name]
+	return t, ok
+}
+
+// listenerFormat returns the format a listener with this profile receives
+// when the broadcast is in format
+func (p Profile) listenerFormat(format SourceFormat) SourceFormat {
+	if p.Mono {
+		format.Channels = 1
+	}
+	return format
+}
+
+// DefaultProfile is used when a listener does not ask for one
+const DefaultProfile = "balanced"
+
+// profiles are the listener profiles selectable with ?profile=
+var profiles = map[string]Profile{
+	// Archive listeners: deep buffer, never lose audio silently
+	"stable": {Name: "stable", QueueFrames: 128, Drop: DropListener, Format: FormatWAV, BufferTarget: time.Second},
+	// General listening
+	"balanced": {Name: "balanced", QueueFrames: 32, Drop: DropNewest, Format: FormatWAV, BufferTarget: 250 * time.Millisecond},
+	// Live monitors: shallow buffer, skip ahead when behind, no per-frame headers
+	"low-latency": {Name: "low-latency", QueueFrames: 4, Drop: DropOldest, Format: FormatPCM, BufferTarget: 80 * time.Millisecond},
+}
+
+// LookupProfile returns the named profile, or the default for an empty name
+func LookupProfile(name string) (Profile, bool) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// ProfileNames returns the names of the listener profiles, sorted
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
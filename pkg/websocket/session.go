@@ -0,0 +1,33 @@
+package websocket
+
+import "time"
+
+// Session is a finished connection of a remote listener or a source, for
+// reviewing the audience after the fact
+type Session struct {
+	// Kind is "listener" or "source"
+	Kind string `json:"kind"`
+	// ID is the listener's ID; sources have none
+	ID      uint64 `json:"id,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	ConnInfo
+	EndedAt time.Time `json:"ended_at"`
+	// Bytes is how much was sent to the listener, or received from a
+	// WebSocket or UDP source
+	Bytes int64 `json:"bytes"`
+	// Dropped is how many frames a listener missed for falling behind
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+// SetSessionLog sets a function handed every session as it ends. It must
+// not block, and must be called before clients connect.
+func (m *Manager) SetSessionLog(log func(Session)) {
+	m.sessionLog = log
+}
+
+// logSession hands s to the session log, if one is set
+func (m *Manager) logSession(s Session) {
+	if m.sessionLog != nil {
+		m.sessionLog(s)
+	}
+}
@@ -0,0 +1,90 @@
+package websocket
+
+import (
+	"sort"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/audio"
+	"github.com/maks112v/minicast/pkg/clock"
+	"github.com/maks112v/minicast/pkg/frame"
+)
+
+// Stats is a snapshot of the Manager's connections
+type Stats struct {
+	Source       *ConnInfo          `json:"source"`
+	SourceFormat *SourceFormat      `json:"source_format,omitempty"`
+	SourceFrames *frame.Stats       `json:"source_frames,omitempty"`
+	SourceGainDB *float64           `json:"source_gain_db,omitempty"`
+	Jitter       *audio.JitterStats `json:"jitter,omitempty"`
+	Maintenance  *MaintenanceState  `json:"maintenance,omitempty"`
+	Hold         *HoldState         `json:"hold,omitempty"`
+	Clock        *clock.Stats       `json:"clock,omitempty"`
+	Listeners    []ListenerStats    `json:"listeners"`
+}
+
+// ListenerStats describes one connected listener
+type ListenerStats struct {
+	ID      uint64 `json:"id"`
+	Profile string `json:"profile"`
+	Queued  int    `json:"queued"`
+	Dropped int64  `json:"dropped"`
+	// Playback is the buffer tuning of players that report on it
+	Playback *PlaybackStats `json:"playback,omitempty"`
+	ConnInfo
+}
+
+// Stats returns a snapshot of the source and listeners
+func (m *Manager) Stats() Stats {
+	var stats Stats
+
+	m.sourceMu.RLock()
+	if m.source != nil {
+		info := m.sourceInfo
+		stats.Source = &info
+		format := m.sourceFormat
+		stats.SourceFormat = &format
+		if m.sourceGain != nil {
+			gain := *m.sourceGain
+			stats.SourceGainDB = &gain
+		}
+		if format.Framed {
+			frames := m.tracker.Stats()
+			stats.SourceFrames = &frames
+		}
+		if m.jitter != nil {
+			jitter := m.jitter.Stats()
+			stats.Jitter = &jitter
+		}
+	}
+	if m.maintenance != nil {
+		state := *m.maintenance
+		stats.Maintenance = &state
+	}
+	m.sourceMu.RUnlock()
+	if state, ok := m.Hold(); ok {
+		stats.Hold = &state
+	}
+	stats.Clock = m.clock.Stats()
+
+	clients := m.snapshot()
+	now := time.Now()
+	stats.Listeners = make([]ListenerStats, 0, len(clients))
+	for _, c := range clients {
+		ls := ListenerStats{
+			ID:       c.id,
+			Profile:  c.profile.Name,
+			Queued:   len(c.queue),
+			Dropped:  c.dropped.Load(),
+			ConnInfo: c.info,
+		}
+		if c.tuner != nil {
+			ls.Playback = c.tuner.snapshot(now)
+		}
+		stats.Listeners = append(stats.Listeners, ls)
+	}
+
+	sort.Slice(stats.Listeners, func(i, j int) bool {
+		return stats.Listeners[i].ID < stats.Listeners[j].ID
+	})
+	return stats
+}
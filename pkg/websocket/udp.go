@@ -0,0 +1,336 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maks112v/minicast/pkg/frame"
+)
+
+const (
+	// udpTick is how often a UDP ingest checks for frames to request again
+	// or give up on, and for sessions that went quiet
+	udpTick = 10 * time.Millisecond
+	// udpTimeout ends a session whose source sent nothing, not even its
+	// once a second hello, for this long
+	udpTimeout = 5 * time.Second
+	// udpReorderWindow is how far ahead of the next frame one may arrive
+	// before the ingest assumes the source started over
+	udpReorderWindow = 256
+)
+
+// ServeUDP takes sources over UDP on conn until ctx is done. Sources split
+// framed messages into packets (see package frame), and the ingest holds
+// frames back in order for up to delay while it asks for missing ones to
+// be resent, so a lost packet costs a retransmit instead of the stall a TCP
+// connection would suffer.
+func (m *Manager) ServeUDP(ctx context.Context, conn net.PacketConn, delay time.Duration) error {
+	u := &udpIngest{m: m, conn: conn, delay: delay, retry: max(delay/4, 2*udpTick)}
+	defer u.end()
+
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(time.Now().Add(udpTick))
+		n, addr, err := conn.ReadFrom(buf)
+		now := time.Now()
+		var ne net.Error
+		if err != nil && !(errors.As(err, &ne) && ne.Timeout()) {
+			return err
+		}
+		if err == nil {
+			u.handle(buf[:n], addr, now)
+		}
+		if now.Sub(u.ticked) >= udpTick {
+			u.tick(now)
+		}
+	}
+	return nil
+}
+
+// udpIngest is the state of ServeUDP, touched only by its goroutine
+type udpIngest struct {
+	m      *Manager
+	conn   net.PacketConn
+	delay  time.Duration
+	retry  time.Duration
+	ticked time.Time
+
+	session *udpSession
+}
+
+// udpSession is the source currently sending over UDP
+type udpSession struct {
+	id        uint32
+	addr      net.Addr
+	in        *ingest
+	cancel    context.CancelFunc
+	lastHeard time.Time
+
+	// next is the sequence number to deliver next, and highest the newest
+	// seen. Frames between them wait in ready until next arrives, or
+	// until next is given up on.
+	next, highest uint32
+	started       bool
+	ready         map[uint32][]byte
+	chunks        map[uint32]*assembly
+	missing       map[uint32]*missingFrame
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// assembly collects the chunks of one framed message
+type assembly struct {
+	parts [][]byte
+	have  int
+}
+
+// missingFrame is a frame the ingest has asked the source to resend
+type missingFrame struct {
+	noticed, requested time.Time
+}
+
+// Close ends the session, as when the Manager drops the source
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// handle processes one datagram
+func (u *udpIngest) handle(data []byte, addr net.Addr, now time.Time) {
+	p, err := frame.DecodePacket(data)
+	if err != nil {
+		u.m.logger.Debugf("Dropped UDP datagram from %s: %v", addr, err)
+		return
+	}
+	s := u.session
+	if s != nil && s.id == p.Session {
+		// A source behind NAT may come back from another port
+		s.addr, s.lastHeard = addr, now
+	} else if p.Type != frame.PacketHello {
+		return
+	}
+
+	switch p.Type {
+	case frame.PacketHello:
+		if s == nil || s.id != p.Session {
+			if err := u.start(p, addr, now); err != nil {
+				u.send(addr, frame.Packet{Type: frame.PacketReject, Session: p.Session, Body: []byte(u.m.rejectMessage(err))})
+				return
+			}
+		}
+		u.send(addr, frame.Packet{Type: frame.PacketAccept, Session: p.Session})
+	case frame.PacketData:
+		chunk, err := frame.DecodeChunk(p.Body)
+		if err != nil {
+			u.m.logger.Debugf("Dropped UDP chunk: %v", err)
+			return
+		}
+		u.receive(chunk, now)
+	case frame.PacketBye:
+		u.end()
+	}
+}
+
+// start attaches a new session as the source
+func (u *udpIngest) start(p frame.Packet, addr net.Addr, now time.Time) error {
+	format, ok := parseFormatMessage(p.Body)
+	if !ok {
+		return errors.New("the hello must carry a format handshake")
+	}
+	if auth := u.m.sourceAuth; auth != nil {
+		var hello formatMessage
+		json.Unmarshal(p.Body, &hello)
+		if !auth(hello.Token) {
+			return ErrSourceUnauthorized
+		}
+	}
+	if !format.Framed {
+		return errors.New("udp sources must send framed audio")
+	}
+
+	m := u.m
+	s := &udpSession{
+		id:        p.Session,
+		addr:      addr,
+		lastHeard: now,
+		ready:     make(map[uint32][]byte),
+		chunks:    make(map[uint32]*assembly),
+		missing:   make(map[uint32]*missingFrame),
+		closed:    make(chan struct{}),
+	}
+	info := ConnInfo{Transport: "udp", RemoteAddr: addr.String(), ConnectedAt: now}
+	if err := m.AttachSource(s, info, format); err != nil {
+		return err
+	}
+	pipeline, err := m.NewPipeline(format)
+	if err != nil {
+		m.DetachSource(s)
+		return err
+	}
+	m.logger.Infow("Audio source connected", info.logFields()...)
+
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	s.in = m.newIngest(ctx, pipeline, format)
+	u.session = s
+	return nil
+}
+
+// end detaches the current session, if any
+func (u *udpIngest) end() {
+	s := u.session
+	if s == nil {
+		return
+	}
+	u.session = nil
+	s.cancel()
+	u.m.DetachSource(s)
+	u.m.logger.Info("Audio source disconnected")
+}
+
+// receive adds a chunk, delivering the frames it completes in order
+func (u *udpIngest) receive(c frame.Chunk, now time.Time) {
+	s := u.session
+	if !s.started {
+		s.next, s.highest, s.started = c.Seq, c.Seq, true
+	}
+
+	d := int32(c.Seq - s.next)
+	if d <= -udpReorderWindow {
+		return
+	}
+	if d >= udpReorderWindow {
+		// Too far ahead to wait for what is in between
+		clear(s.ready)
+		clear(s.chunks)
+		clear(s.missing)
+		s.next, s.highest, d = c.Seq, c.Seq, 0
+	}
+	if ahead := int32(c.Seq - s.highest); ahead > 0 {
+		// Everything since the previous newest frame that has not arrived
+		// whole is missing, and is asked for right away
+		var lost []uint32
+		for seq := s.highest; seq != c.Seq; seq++ {
+			if _, ok := s.ready[seq]; !ok && int32(seq-s.next) >= 0 && s.missing[seq] == nil {
+				s.missing[seq] = &missingFrame{noticed: now, requested: now}
+				lost = append(lost, seq)
+			}
+		}
+		s.highest = c.Seq
+		u.nack(lost)
+	}
+
+	a := s.chunks[c.Seq]
+	if a == nil || len(a.parts) != int(c.Parts) {
+		a = &assembly{parts: make([][]byte, c.Parts)}
+		s.chunks[c.Seq] = a
+	}
+	if a.parts[c.Part] != nil {
+		return
+	}
+	a.parts[c.Part] = append([]byte(nil), c.Data...)
+	if a.have++; a.have < len(a.parts) {
+		return
+	}
+	delete(s.chunks, c.Seq)
+	delete(s.missing, c.Seq)
+	var msg []byte
+	for _, part := range a.parts {
+		msg = append(msg, part...)
+	}
+
+	if d < 0 {
+		// Already delivered or given up on: the tracker counts it as late
+		// or a duplicate
+		s.in.push(msg, now)
+		return
+	}
+	s.ready[c.Seq] = msg
+	u.deliver(now)
+}
+
+// deliver pushes the frames that are ready, in order
+func (u *udpIngest) deliver(now time.Time) {
+	s := u.session
+	for {
+		msg, ok := s.ready[s.next]
+		if !ok {
+			return
+		}
+		delete(s.ready, s.next)
+		s.in.push(msg, now)
+		s.next++
+	}
+}
+
+// tick gives up on frames that were not resent in time, asks again for
+// those still worth waiting for, and ends quiet or dropped sessions
+func (u *udpIngest) tick(now time.Time) {
+	u.ticked = now
+	s := u.session
+	if s == nil {
+		return
+	}
+	select {
+	case <-s.closed:
+		u.end()
+		return
+	default:
+	}
+	if now.Sub(s.lastHeard) > udpTimeout {
+		u.m.logger.Warnw("UDP source timed out", "remote", s.addr.String())
+		u.end()
+		return
+	}
+
+	// The oldest missing frame holds up the rest until its time is up
+	for {
+		f := s.missing[s.next]
+		if f == nil || now.Sub(f.noticed) < u.delay {
+			break
+		}
+		u.m.logger.Debugw("Gave up on source frame", "seq", s.next)
+		delete(s.missing, s.next)
+		delete(s.chunks, s.next)
+		s.next++
+		u.deliver(now)
+	}
+
+	// Chunks of frames long gone will never complete
+	for seq := range s.chunks {
+		if int32(seq-s.next) < -64 {
+			delete(s.chunks, seq)
+		}
+	}
+
+	var again []uint32
+	for seq, f := range s.missing {
+		if now.Sub(f.requested) >= u.retry {
+			f.requested = now
+			again = append(again, seq)
+		}
+	}
+	u.nack(again)
+}
+
+// nack asks the source to resend the frames in seqs
+func (u *udpIngest) nack(seqs []uint32) {
+	const perPacket = frame.UDPChunk / 4
+	for len(seqs) > 0 {
+		n := min(len(seqs), perPacket)
+		u.send(u.session.addr, frame.Packet{Type: frame.PacketNack, Session: u.session.id, Body: frame.EncodeNack(seqs[:n])})
+		seqs = seqs[n:]
+	}
+}
+
+// send writes a packet to addr
+func (u *udpIngest) send(addr net.Addr, p frame.Packet) {
+	if _, err := u.conn.WriteTo(frame.EncodePacket(p), addr); err != nil {
+		u.m.logger.Debugf("Failed to send UDP packet to %s: %v", addr, err)
+	}
+}